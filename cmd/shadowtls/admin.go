@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AdminConfig holds configuration for the admin endpoint
+type AdminConfig struct {
+	Addr     string
+	Token    string // Bearer token required on every request, empty to disable
+	TLSCert  string // Server certificate (PEM), enables HTTPS together with TLSKey
+	TLSKey   string // Server private key (PEM)
+	ClientCA string // CA bundle (PEM) for verifying client certificates (mTLS)
+}
+
+// AdminServer exposes live stats and the connection table over HTTP as JSON
+type AdminServer struct {
+	config *AdminConfig
+	mux    *http.ServeMux
+	server *http.Server
+	log    *logrus.Logger
+}
+
+// NewAdminServer creates an admin server. Non-loopback addresses are only
+// accepted when requests are authenticated by bearer token or client certificate.
+func NewAdminServer(config *AdminConfig, logger *logrus.Logger) (*AdminServer, error) {
+	host, _, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin address %s: %v", config.Addr, err)
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("admin TLS requires both certificate and key")
+	}
+	if config.ClientCA != "" && config.TLSCert == "" {
+		return nil, fmt.Errorf("admin client CA requires a TLS certificate and key")
+	}
+
+	loopback := host == "localhost"
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		loopback = true
+	}
+	if !loopback {
+		if config.Token == "" && config.ClientCA == "" {
+			return nil, fmt.Errorf("admin address %s is not loopback; set an admin token or client CA", config.Addr)
+		}
+		if config.TLSCert == "" {
+			logger.Warnf("Admin endpoint on %s uses a bearer token over plain HTTP; consider enabling TLS", config.Addr)
+		}
+	}
+
+	a := &AdminServer{
+		config: config,
+		mux:    http.NewServeMux(),
+		log:    logger,
+	}
+	a.server = &http.Server{
+		Handler:           a.authenticate(a.mux),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	if config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin TLS certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if config.ClientCA != "" {
+			pem, err := os.ReadFile(config.ClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read admin client CA: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in admin client CA %s", config.ClientCA)
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		a.server.TLSConfig = tlsConfig
+	}
+
+	return a, nil
+}
+
+// authenticate enforces the bearer token, if one is configured. Client
+// certificates are already verified during the TLS handshake.
+func (a *AdminServer) authenticate(next http.Handler) http.Handler {
+	if a.config.Token == "" {
+		return next
+	}
+	want := []byte("Bearer " + a.config.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(strings.TrimSpace(r.Header.Get("Authorization")))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			a.log.Debugf("Admin: rejected unauthenticated request from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="shadowtls"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleJSON registers a GET endpoint that serves the value returned by fn
+func (a *AdminServer) HandleJSON(path string, fn func() any) {
+	a.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(fn()); err != nil {
+			a.log.Debugf("Admin: failed to write %s response: %v", path, err)
+		}
+	})
+}
+
+// Handle registers h for path, for endpoints that do more than serve JSON
+func (a *AdminServer) Handle(path string, h http.Handler) {
+	a.mux.Handle(path, h)
+}
+
+// URL returns the base URL of the admin endpoint
+func (a *AdminServer) URL() string {
+	if a.server.TLSConfig != nil {
+		return "https://" + a.config.Addr
+	}
+	return "http://" + a.config.Addr
+}
+
+// Start binds the admin listener and serves in the background
+func (a *AdminServer) Start() error {
+	listener, err := net.Listen("tcp", a.config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", a.config.Addr, err)
+	}
+	if a.server.TLSConfig != nil {
+		listener = tls.NewListener(listener, a.server.TLSConfig)
+	}
+	go func() {
+		if err := a.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			a.log.Warnf("Admin server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops the admin server
+func (a *AdminServer) Close() error {
+	return a.server.Close()
+}
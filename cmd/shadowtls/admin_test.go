@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAdminServerRequiresAuthOffLoopback(t *testing.T) {
+	if _, err := NewAdminServer(&AdminConfig{Addr: "0.0.0.0:9090"}, Log); err == nil {
+		t.Error("expected error for unauthenticated non-loopback admin address")
+	}
+	if _, err := NewAdminServer(&AdminConfig{Addr: "0.0.0.0:9090", Token: "secret"}, Log); err != nil {
+		t.Errorf("token-authenticated admin address rejected: %v", err)
+	}
+	if _, err := NewAdminServer(&AdminConfig{Addr: "127.0.0.1:9090"}, Log); err != nil {
+		t.Errorf("loopback admin address rejected: %v", err)
+	}
+	if _, err := NewAdminServer(&AdminConfig{Addr: "127.0.0.1:9090", TLSCert: "cert.pem"}, Log); err == nil {
+		t.Error("expected error for TLS certificate without key")
+	}
+}
+
+func TestAdminServerBearerToken(t *testing.T) {
+	admin, err := NewAdminServer(&AdminConfig{Addr: "127.0.0.1:0", Token: "secret"}, Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.HandleJSON("/stats", func() any { return map[string]int{"ok": 1} })
+
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		admin.server.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// alarmSampleInterval is how often counters are sampled for alarm windows
+	alarmSampleInterval = 10 * time.Second
+	// alarmMinEvents is the minimum number of events in a window before a rate is judged
+	alarmMinEvents = 10
+	// alarmClearRatio is the fraction of the threshold a rate must fall below to clear (hysteresis)
+	alarmClearRatio = 0.5
+)
+
+// AlarmConfig holds error budget thresholds. A zero rate disables that alarm.
+type AlarmConfig struct {
+	Window    time.Duration // Rolling window the rates are computed over
+	StaleRate float64       // Max fraction of tunnel acquisitions hitting a stale connection
+	ErrorRate float64       // Max fraction of connections ending in an error
+}
+
+// alarmSample is a point-in-time copy of the counters alarms are computed from
+type alarmSample struct {
+	at       time.Time
+	acquires uint64 // Pool hits + misses
+	stale    uint64
+	conns    uint64
+	errors   uint64
+}
+
+// rateAlarm tracks one thresholded rate with hysteresis
+type rateAlarm struct {
+	name      string
+	threshold float64
+	active    bool
+}
+
+// AlarmMonitor computes error and stale rates over a rolling window and logs
+// WARN-level alarms when they cross their thresholds
+type AlarmMonitor struct {
+	config  *AlarmConfig
+	stats   *Stats
+	samples []alarmSample
+	stale   rateAlarm
+	errors  rateAlarm
+	log     *logrus.Logger
+}
+
+// NewAlarmMonitor creates an alarm monitor over the given stats
+func NewAlarmMonitor(config *AlarmConfig, stats *Stats, logger *logrus.Logger) *AlarmMonitor {
+	return &AlarmMonitor{
+		config: config,
+		stats:  stats,
+		stale:  rateAlarm{name: "stale rate", threshold: config.StaleRate},
+		errors: rateAlarm{name: "error rate", threshold: config.ErrorRate},
+		log:    logger,
+	}
+}
+
+// Run samples counters until ctx is cancelled
+func (m *AlarmMonitor) Run(ctx context.Context) {
+	m.Observe(time.Now())
+	ticker := time.NewTicker(alarmSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.Observe(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Observe records a sample and evaluates the alarms over the current window
+func (m *AlarmMonitor) Observe(now time.Time) {
+	m.samples = append(m.samples, alarmSample{
+		at:       now,
+		acquires: m.stats.PoolHits.Load() + m.stats.PoolMisses.Load(),
+		stale:    m.stats.PoolStale.Load(),
+		conns:    m.stats.TotalConns.Load(),
+		errors:   m.stats.ConnErrors.Load(),
+	})
+
+	// Keep the newest sample that is at least one window old as the baseline
+	cutoff := now.Add(-m.config.Window)
+	for len(m.samples) > 2 && !m.samples[1].at.After(cutoff) {
+		m.samples = m.samples[1:]
+	}
+
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	span := last.at.Sub(first.at).Round(time.Second)
+	m.evaluate(&m.stale, last.stale-first.stale, last.acquires-first.acquires, span)
+	m.evaluate(&m.errors, last.errors-first.errors, last.conns-first.conns, span)
+}
+
+func (m *AlarmMonitor) evaluate(a *rateAlarm, bad, total uint64, span time.Duration) {
+	if a.threshold <= 0 || total < alarmMinEvents {
+		return
+	}
+	rate := float64(bad) / float64(total)
+
+	switch {
+	case !a.active && rate > a.threshold:
+		a.active = true
+		m.log.Warnf("[ALARM] %s %.1f%% over %v exceeds %.1f%% (%d/%d)",
+			a.name, rate*100, span, a.threshold*100, bad, total)
+	case a.active && rate < a.threshold*alarmClearRatio:
+		a.active = false
+		m.log.Warnf("[ALARM CLEARED] %s back to %.1f%% over %v (%d/%d)",
+			a.name, rate*100, span, bad, total)
+	}
+}
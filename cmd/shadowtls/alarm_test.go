@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlarmMonitorHysteresis(t *testing.T) {
+	stats := NewStats()
+	m := NewAlarmMonitor(&AlarmConfig{Window: time.Minute, StaleRate: 0.2}, stats, Log)
+
+	now := time.Now()
+	m.Observe(now)
+
+	// 5 stale out of 20 acquisitions (25%) raises the alarm
+	stats.PoolHits.Add(20)
+	stats.PoolStale.Add(5)
+	now = now.Add(10 * time.Second)
+	m.Observe(now)
+	if !m.stale.active {
+		t.Fatal("stale alarm should be active at 25%")
+	}
+
+	// Once the stale burst leaves the window, the rate sits at 15%: below
+	// the threshold but above the clear level, so the alarm stays raised
+	now = now.Add(time.Minute)
+	m.Observe(now)
+	stats.PoolHits.Add(20)
+	stats.PoolStale.Add(3)
+	now = now.Add(10 * time.Second)
+	m.Observe(now)
+	if !m.stale.active {
+		t.Fatal("stale alarm should stay active between clear level and threshold")
+	}
+
+	// A clean window drops below the clear level
+	now = now.Add(time.Minute)
+	m.Observe(now)
+	stats.PoolHits.Add(50)
+	now = now.Add(10 * time.Second)
+	m.Observe(now)
+	if m.stale.active {
+		t.Fatal("stale alarm should clear once the rate drops below the clear level")
+	}
+}
+
+func TestAlarmMonitorMinEvents(t *testing.T) {
+	stats := NewStats()
+	m := NewAlarmMonitor(&AlarmConfig{Window: time.Minute, ErrorRate: 0.2}, stats, Log)
+
+	now := time.Now()
+	m.Observe(now)
+	stats.TotalConns.Add(2)
+	stats.ConnErrors.Add(2)
+	m.Observe(now.Add(10 * time.Second))
+	if m.errors.active {
+		t.Error("error alarm should not fire below the minimum event count")
+	}
+}
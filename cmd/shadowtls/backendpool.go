@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// backendPoolBackoff is how long a backend pool worker waits after a failed
+// dial; the tunnel that needed the backend has already been served by a
+// fresh dial, so there is no hurry
+const backendPoolBackoff = time.Second
+
+// newBackendPool keeps size connections to addr open ahead of tunnels. It is
+// the client's ConnPool with a plain TCP factory and its own Stats.
+func newBackendPool(addr string, size int, ttl time.Duration, dials *DialTimeouts) *ConnPool {
+	return NewConnPool(size, ttl, backendPoolBackoff, func(ctx context.Context) (net.Conn, error) {
+		return dials.Dial(ctx, "tcp", addr)
+	}, nil, NewStats())
+}
+
+// pooledBackend takes a ready connection to the primary backend, skipping
+// ones the backend has closed while they waited. Returns false when the
+// pool has none, so the caller dials.
+func (h *forwardHandler) pooledBackend() (net.Conn, bool) {
+	for {
+		pc, ok := h.pool.TryGet()
+		if !ok {
+			return nil, false
+		}
+		if conn, alive := backendAlive(pc.Conn); alive {
+			return conn, true
+		}
+		h.pool.stats.PoolStale.Add(1)
+		pc.Conn.Close()
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// backendAlive polls conn with a short read. A backend that closed the idle
+// connection shows up as EOF or a reset. Data the backend already sent,
+// like an SSH server's banner, is replayed in front of the connection.
+func backendAlive(conn net.Conn) (net.Conn, bool) {
+	buf := make([]byte, 512)
+	// An expired deadline fails before reading, so give the read a moment
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return &prefixConn{Conn: conn, prefix: buf[:n]}, true
+	}
+	return conn, errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	dial := func() (net.Conn, net.Conn) {
+		t.Helper()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, <-accepted
+	}
+
+	silent, peer := dial()
+	defer silent.Close()
+	defer peer.Close()
+	if _, ok := backendAlive(silent); !ok {
+		t.Error("an open, silent backend connection should be alive")
+	}
+
+	closed, peer := dial()
+	defer closed.Close()
+	peer.Close()
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := backendAlive(closed); ok {
+		t.Error("a connection the backend closed should not be alive")
+	}
+
+	// A server-first banner survives the probe
+	banner, peer := dial()
+	defer banner.Close()
+	peer.Write([]byte("SSH-2.0-test\r\n"))
+	peer.Close()
+	time.Sleep(20 * time.Millisecond)
+	conn, ok := backendAlive(banner)
+	if !ok {
+		t.Fatal("a connection with a pending banner should be alive")
+	}
+	if got, _ := io.ReadAll(conn); string(got) != "SSH-2.0-test\r\n" {
+		t.Errorf("read %q after the probe, want the banner", got)
+	}
+}
+
+// Tunnels take pooled backend connections and fall back to a dial when the
+// pool is empty
+func TestForwardPool(t *testing.T) {
+	rig, err := startSoakRig(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rig.stop)
+
+	addr, err := freeLoopbackAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := *rig.server.config
+	sc.ListenAddr = addr
+	sc.ForwardPool = 2
+	sc.ForwardPoolTTL = time.Minute
+	srv := NewServer(&sc)
+	srvErr := rig.run(srv.Run)
+	defer srv.Stop()
+	select {
+	case <-srv.Ready():
+	case err := <-srvErr:
+		t.Fatal(err)
+	}
+
+	cc := *rig.client.config
+	cc.ServerAddr = addr
+	if cc.ListenAddr, err = freeLoopbackAddr(); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(&cc)
+	clientErr := rig.run(client.Run)
+	t.Cleanup(client.Stop)
+	select {
+	case <-client.Ready():
+	case err := <-clientErr:
+		t.Fatal(err)
+	}
+
+	pool := srv.forward.pool
+	deadline := time.Now().Add(10 * time.Second)
+	for avail, _ := pool.Stats(); avail < 2; avail, _ = pool.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatal("backend pool did not fill")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", cc.ListenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conn.Write([]byte("ping"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+			t.Fatalf("echo %d = %q, %v", i, got, err)
+		}
+		conn.Close()
+	}
+	if hits := pool.stats.PoolHits.Load(); hits == 0 {
+		t.Error("no tunnel used a pooled backend connection")
+	}
+	if n := srv.forward.stats.connected.Load(); n != 4 {
+		t.Errorf("%d tunnels connected to the backend, want 4", n)
+	}
+}
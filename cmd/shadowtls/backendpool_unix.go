@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// backendAlive peeks at conn without blocking or consuming anything. A
+// backend that closed the idle connection shows up as EOF or a reset;
+// pending data, like an SSH server's banner, stays where it is.
+func backendAlive(conn net.Conn) (net.Conn, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return conn, true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return conn, false
+	}
+	alive := false
+	var buf [1]byte
+	raw.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+		alive = n > 0 || err == syscall.EAGAIN
+		return true // Don't wait for readability
+	})
+	return conn, alive
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// blackholeThreshold is how many fresh tunnels in a row must accept the
+	// opening write and then never answer before interference is suspected
+	blackholeThreshold = 4
+	// blackholeFreshAge is the pool age under which a silent tunnel counts;
+	// older ones may simply have outlived their session on the server
+	blackholeFreshAge = 30 * time.Second
+	// blackholeProbeTimeout bounds the UDP liveness probe
+	blackholeProbeTimeout = 3 * time.Second
+)
+
+// BlackholeDetector spots the censorship pattern where TCP connections to the
+// server succeed and accept data but nothing ever comes back. Silent
+// verifications of fresh tunnels are correlated; once enough happen in a row,
+// an optional UDP DNS query to a third party tells a blackholed path (UDP
+// still works) from a network that is down altogether (nothing works).
+type BlackholeDetector struct {
+	probe string // UDP DNS server for the liveness probe, empty to skip it
+	log   *logrus.Logger
+
+	mu        sync.Mutex
+	silent    int // Fresh silent tunnels since the last answer
+	probing   bool
+	suspected bool
+	since     time.Time
+	events    uint64
+	total     uint64 // Fresh silent tunnels seen
+
+	// OnChange, if set, is called whenever interference becomes suspected or
+	// clears, so mitigation (SNI rotation, server failover) can be triggered
+	OnChange func(suspected bool)
+}
+
+// BlackholeSnapshot is a point-in-time view of blackhole detection
+type BlackholeSnapshot struct {
+	Suspected bool   // Possible interference right now
+	Events    uint64 // Times interference was suspected
+	Silent    uint64 // Fresh tunnels that took data and never answered
+}
+
+// NewBlackholeDetector creates a detector; probe is a host:port DNS server
+// queried over UDP before interference is declared, empty to skip the probe
+func NewBlackholeDetector(probe string) *BlackholeDetector {
+	return &BlackholeDetector{
+		probe: probe,
+		log:   ModuleLogger("stats"),
+	}
+}
+
+// silentVerify reports whether a failed first-response read means the
+// server never answered, rather than closing or resetting the tunnel
+func silentVerify(n int, err error) bool {
+	var netErr net.Error
+	return n == 0 && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Record reports the verification of a tunnel that accepted the opening
+// write: answered or silent, and how long it sat in the pool
+func (d *BlackholeDetector) Record(answered bool, age time.Duration) {
+	d.mu.Lock()
+	if answered {
+		d.silent = 0
+		cleared := d.suspected
+		d.suspected = false
+		since := d.since
+		onChange := d.OnChange
+		d.mu.Unlock()
+		if cleared {
+			d.log.Warnf("[BLACKHOLE] Server answering again after %v", time.Since(since).Round(time.Second))
+			if onChange != nil {
+				onChange(false)
+			}
+		}
+		return
+	}
+	if age >= blackholeFreshAge {
+		d.mu.Unlock()
+		return
+	}
+	d.total++
+	d.silent++
+	if d.suspected || d.probing || d.silent < blackholeThreshold {
+		d.mu.Unlock()
+		return
+	}
+	if d.probe == "" {
+		d.mu.Unlock()
+		d.declare("")
+		return
+	}
+	d.probing = true
+	d.mu.Unlock()
+	go d.runProbe()
+}
+
+// runProbe sends the UDP liveness probe and declares interference only if
+// the network answers it
+func (d *BlackholeDetector) runProbe() {
+	ctx, cancel := context.WithTimeout(context.Background(), blackholeProbeTimeout)
+	defer cancel()
+	err := probeUDP(ctx, d.probe)
+
+	d.mu.Lock()
+	d.probing = false
+	if err != nil {
+		// Nothing gets through at all: an outage, not a blackhole. Start
+		// counting afresh so a later pattern probes again.
+		d.silent = 0
+		d.mu.Unlock()
+		d.log.Warnf("[BLACKHOLE] %d fresh tunnels got no answer, but the UDP probe to %s failed too (%v): the network looks down",
+			blackholeThreshold, d.probe, err)
+		return
+	}
+	stillSilent := d.silent >= blackholeThreshold
+	d.mu.Unlock()
+	if stillSilent {
+		d.declare(" while UDP to " + d.probe + " works")
+	}
+}
+
+func (d *BlackholeDetector) declare(detail string) {
+	d.mu.Lock()
+	if d.suspected {
+		d.mu.Unlock()
+		return
+	}
+	d.suspected = true
+	d.since = time.Now()
+	d.events++
+	silent := d.silent
+	onChange := d.OnChange
+	d.mu.Unlock()
+
+	d.log.Warnf("[BLACKHOLE] Possible interference: %d fresh tunnels in a row took data and never answered%s",
+		silent, detail)
+	if onChange != nil {
+		onChange(true)
+	}
+}
+
+// Snapshot returns the current detection state. Safe on a nil detector.
+func (d *BlackholeDetector) Snapshot() BlackholeSnapshot {
+	if d == nil {
+		return BlackholeSnapshot{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return BlackholeSnapshot{Suspected: d.suspected, Events: d.events, Silent: d.total}
+}
+
+// probeUDP sends a DNS query for the root name servers to server over UDP
+// and waits for an answer with the same ID
+func probeUDP(ctx context.Context, server string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	id := uint16(rand.Uint32())
+	// Header: ID, RD, one question; then ". IN NS"
+	query := binary.BigEndian.AppendUint16(nil, id)
+	query = append(query, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	query = append(query, 0, 0, 2, 0, 1)
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errors.New("no answer")
+			}
+			return err
+		}
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return nil
+		}
+	}
+}
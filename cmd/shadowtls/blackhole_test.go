@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlackholeDetector(t *testing.T) {
+	d := NewBlackholeDetector("")
+	var changes []bool
+	d.OnChange = func(suspected bool) { changes = append(changes, suspected) }
+
+	// Old pooled tunnels going silent are expired sessions, not a blackhole
+	for range blackholeThreshold * 2 {
+		d.Record(false, time.Minute)
+	}
+	if snap := d.Snapshot(); snap.Suspected || snap.Silent != 0 {
+		t.Fatalf("stale tunnels counted: %+v", snap)
+	}
+
+	// An answer in between resets the run
+	for range blackholeThreshold - 1 {
+		d.Record(false, 0)
+	}
+	d.Record(true, 0)
+	for range blackholeThreshold - 1 {
+		d.Record(false, time.Second)
+	}
+	if d.Snapshot().Suspected {
+		t.Fatal("suspected without enough silent tunnels in a row")
+	}
+
+	d.Record(false, 0)
+	if snap := d.Snapshot(); !snap.Suspected || snap.Events != 1 || snap.Silent != 2*blackholeThreshold-1 {
+		t.Fatalf("snapshot = %+v, want one suspected event", snap)
+	}
+	d.Record(false, 0)
+	if d.Snapshot().Events != 1 {
+		t.Error("a second event while still suspected")
+	}
+
+	d.Record(true, 0)
+	if d.Snapshot().Suspected {
+		t.Error("still suspected after an answer")
+	}
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("OnChange calls %v, want [true false]", changes)
+	}
+}
+
+func TestBlackholeProbe(t *testing.T) {
+	// A fake DNS server echoing the query ID
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			dns.WriteTo(buf[:n], from)
+		}
+	}()
+
+	var suspected atomic.Bool
+	d := NewBlackholeDetector(dns.LocalAddr().String())
+	d.OnChange = suspected.Store
+	for range blackholeThreshold {
+		d.Record(false, 0)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !suspected.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !d.Snapshot().Suspected {
+		t.Fatal("not suspected although the UDP probe was answered")
+	}
+
+	// With the probe unanswered the network is down, not blackholed
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	d = NewBlackholeDetector(silent.LocalAddr().String())
+	for range blackholeThreshold {
+		d.Record(false, 0)
+	}
+	deadline = time.Now().Add(2 * blackholeProbeTimeout)
+	for time.Now().Before(deadline) {
+		d.mu.Lock()
+		done := !d.probing
+		d.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if snap := d.Snapshot(); snap.Suspected {
+		t.Errorf("suspected although the UDP probe went unanswered: %+v", snap)
+	}
+}
+
+func TestSilentVerify(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	if !silentVerify(0, timeout) {
+		t.Error("read timeout not silent")
+	}
+	if silentVerify(0, io.EOF) || silentVerify(0, errors.New("connection reset")) || silentVerify(0, nil) {
+		t.Error("closed tunnel counted as silent")
+	}
+}
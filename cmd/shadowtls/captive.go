@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// captiveFailThreshold is how many consecutive pool connect failures trigger a probe
+	captiveFailThreshold = 3
+	// captiveProbeInterval limits probing and is the re-check period while a portal is up
+	captiveProbeInterval = 15 * time.Second
+	// captiveBodyLimit caps how much of the probe response body is read
+	captiveBodyLimit = 4096
+)
+
+// CaptiveDetector tells a captive portal (hotel or airport Wi-Fi login page)
+// apart from an unreachable server by fetching a plain-HTTP probe URL and
+// comparing the answer with what the real endpoint returns
+type CaptiveDetector struct {
+	url      string
+	expect   string // Expected body substring; empty means expect 204 No Content
+	client   *http.Client
+	interval time.Duration // Minimum time between probes
+	log      *logrus.Logger
+
+	mu        sync.Mutex
+	captive   bool
+	detail    string
+	lastProbe time.Time
+	cleared   chan struct{} // Closed when the portal clears
+
+	// OnChange, if set, is called whenever a portal is detected or clears
+	OnChange func(captive bool)
+}
+
+// NewCaptiveDetector creates a detector probing url. If expect is empty the
+// probe must return 204; otherwise it must return 200 with expect in the body.
+func NewCaptiveDetector(url, expect string) *CaptiveDetector {
+	return &CaptiveDetector{
+		url:    url,
+		expect: expect,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			// Probe directly, never through HTTP_PROXY (which may point at this tunnel)
+			Transport: &http.Transport{},
+			// A portal usually answers with a redirect to its login page; keep it
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		interval: captiveProbeInterval,
+		log:      ModuleLogger("pool"),
+	}
+}
+
+// Captive reports whether a portal is currently detected, with a short
+// description of what the probe saw
+func (d *CaptiveDetector) Captive() (bool, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.captive, d.detail
+}
+
+// Check probes for a portal unless one was probed recently, and returns true
+// if a portal is detected. When a portal is first seen, a background re-check
+// runs every probe interval until it clears or ctx is cancelled.
+func (d *CaptiveDetector) Check(ctx context.Context) bool {
+	d.mu.Lock()
+	if d.captive || time.Since(d.lastProbe) < d.interval {
+		captive := d.captive
+		d.mu.Unlock()
+		return captive
+	}
+	d.lastProbe = time.Now()
+	d.mu.Unlock()
+
+	captive, detail := d.probe(ctx)
+	if !captive {
+		d.log.Debugf("Captive portal probe: %s", detail)
+		return false
+	}
+
+	d.mu.Lock()
+	if d.captive {
+		d.mu.Unlock()
+		return true
+	}
+	d.captive = true
+	d.detail = detail
+	d.cleared = make(chan struct{})
+	onChange := d.OnChange
+	d.mu.Unlock()
+
+	d.log.Warnf("[PORTAL] Captive portal detected (%s): open a browser and log in to the network; pool refill paused", detail)
+	if onChange != nil {
+		onChange(true)
+	}
+	go d.watch(ctx)
+	return true
+}
+
+// Wait blocks until the portal clears or ctx is cancelled. It returns
+// immediately if no portal is detected.
+func (d *CaptiveDetector) Wait(ctx context.Context) {
+	d.mu.Lock()
+	captive, cleared := d.captive, d.cleared
+	d.mu.Unlock()
+	if !captive {
+		return
+	}
+	select {
+	case <-cleared:
+	case <-ctx.Done():
+	}
+}
+
+// watch re-probes until the portal is gone
+func (d *CaptiveDetector) watch(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if captive, _ := d.probe(ctx); captive {
+			continue
+		}
+
+		d.mu.Lock()
+		d.captive = false
+		d.detail = ""
+		d.lastProbe = time.Now()
+		close(d.cleared)
+		onChange := d.OnChange
+		d.mu.Unlock()
+
+		d.log.Warnf("[PORTAL] Captive portal cleared, resuming pool refill")
+		if onChange != nil {
+			onChange(false)
+		}
+		return
+	}
+}
+
+// probe fetches the probe URL. A transport error means no connectivity at
+// all, which is not a portal; any answer other than the expected one is.
+func (d *CaptiveDetector) probe(ctx context.Context) (captive bool, detail string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, fmt.Sprintf("no connectivity: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, captiveBodyLimit))
+
+	if d.expect == "" {
+		if resp.StatusCode == http.StatusNoContent {
+			return false, "ok"
+		}
+	} else if resp.StatusCode == http.StatusOK && strings.Contains(string(body), d.expect) {
+		return false, "ok"
+	}
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		return true, fmt.Sprintf("probe got %s → %s", resp.Status, loc)
+	}
+	return true, fmt.Sprintf("probe got %s instead of the expected response", resp.Status)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCaptiveDetectorNoPortal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d := NewCaptiveDetector(srv.URL, "")
+	if d.Check(context.Background()) {
+		t.Error("204 response should not be treated as a portal")
+	}
+}
+
+func TestCaptiveDetectorExpectBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<HTML><BODY>Success</BODY></HTML>"))
+	}))
+	defer srv.Close()
+
+	if NewCaptiveDetector(srv.URL, "Success").Check(context.Background()) {
+		t.Error("expected body should not be treated as a portal")
+	}
+	if !NewCaptiveDetector(srv.URL, "").Check(context.Background()) {
+		t.Error("200 with a body should be a portal when 204 is expected")
+	}
+}
+
+func TestCaptiveDetectorPortalClears(t *testing.T) {
+	var portal atomic.Bool
+	portal.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if portal.Load() {
+			http.Redirect(w, r, "http://login.hotel.example/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewCaptiveDetector(srv.URL, "")
+	d.interval = 20 * time.Millisecond
+	var changes atomic.Int32
+	d.OnChange = func(bool) { changes.Add(1) }
+
+	if !d.Check(ctx) {
+		t.Fatal("redirect should be detected as a portal")
+	}
+	if captive, detail := d.Captive(); !captive || detail == "" {
+		t.Errorf("Captive() = %v, %q", captive, detail)
+	}
+
+	portal.Store(false)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer waitCancel()
+	d.Wait(waitCtx)
+	if waitCtx.Err() != nil {
+		t.Fatal("Wait did not return after the portal cleared")
+	}
+	if captive, _ := d.Captive(); captive {
+		t.Error("portal should be cleared")
+	}
+	if changes.Load() != 2 {
+		t.Errorf("OnChange called %d times, want 2", changes.Load())
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,30 +24,109 @@ import (
 
 const (
 	verifyTimeout = 5 * time.Second
-	copyBufSize   = 32 * 1024
-	maxRetries    = 3
+	// defaultFirstPacketTimeout is how long to wait for the client's first packet
+	defaultFirstPacketTimeout = 10 * time.Second
+	// defaultFirstPacketMax caps how much of the client's opening burst is buffered for replay
+	defaultFirstPacketMax = 128 * 1024
+	// initialReadGap is how long to wait for the next segment of an opening burst
+	initialReadGap = 20 * time.Millisecond
+	copyBufSize    = 32 * 1024
+	maxRetries     = 3
 )
 
 // ClientConfig holds configuration for the ShadowTLS client
 type ClientConfig struct {
-	ListenAddr    string
-	ServerAddr    string
-	SNI           string
-	Password      string
-	PoolSize      int
-	TTL           time.Duration
-	Backoff       time.Duration
-	Timeout       time.Duration
-	StatsInterval time.Duration
-	Logger        *logrus.Logger
+	ListenAddr     string
+	ServerAddr     string
+	SNI            string
+	Password       string
+	PoolSize       int
+	PoolMax        int    // Grow the pool up to this many tunnels when it keeps running empty, 0 = fixed size
+	PoolRefill     string // Refill policy: "adaptive" or "fixed"
+	TTL            time.Duration
+	TTLAuto        bool // Lower the TTL below the observed server session timeout
+	Backoff        time.Duration
+	Timeout        time.Duration
+	StatsInterval  time.Duration
+	FirstPacket    time.Duration // Wait for the client's first packet, 0 = default
+	FirstPacketMax int           // Buffer at most this much of the opening burst for replay, 0 = default
+	SkipVerify     bool          // Don't wait for the first response before relaying; stale tunnels fail instead of retrying
+	VerifyCoalesce time.Duration // Merge first-response segments arriving this close together, 0 = off
+	Passive        bool          // Don't wait for client data; for server-speaks-first protocols
+	Socks5UDP      bool          // Carry the UDP ASSOCIATE of SOCKS5 apps through the tunnel
+	CaptiveProbe   string        // Captive portal probe URL, empty to disable
+	CaptiveExpect  string        // Expected probe body substring; empty expects 204
+	SystemProxy    bool          // Point OS proxy settings at the listener while running
+	LoopCheck      bool          // Refuse traffic that would route the tunnel through itself
+	StartupJSON    string        // Write the JSON started event here ("-" for stdout), empty to disable
+	HandshakeDebug bool          // Log a metadata transcript of failed handshakes
+	HandshakeLimit int           // Concurrent uTLS handshakes, 0 = unlimited
+	HandshakeRate  float64       // New uTLS handshakes per second, 0 = unlimited
+	HandshakeBurst int           // Handshakes HandshakeRate lets start at once
+	SniffGuard     string        // Explain apps pointed at the listener the wrong way: off, warn or help
+	TraceBytes     int           // Hex-dump this much of each direction of sampled connections, 0 = off
+	TraceSample    int           // Trace one in this many connections
+	MemLimit       int64         // Soft memory cap in bytes for load shedding, 0 to disable
+	SocketBuffer   int           // Cap for tunnel socket buffers sized to the path RTT, 0 = OS defaults
+	RetryHold      time.Duration // Hold connections that find the server down this long for it to recover, 0 = fail at once
+	StormPacing    time.Duration // Spread connections accepted in a reconnect storm over up to this long, 0 = don't pace
+	PingInterval   time.Duration // Ping the server through a pooled tunnel this often, 0 = never
+	BlackholeProbe string        // UDP DNS server that confirms suspected blackholing, empty to skip the probe
+	FailoverAfter  int           // With several servers, consecutive failed dials before switching to the next
+	SNIProbe       time.Duration // Probe each SNI host directly this often and rotate away from failing ones, 0 = never
+	ServerRecheck  time.Duration // How often a preferred server that is down is retried
+	Congestion     string        // TCP congestion control for tunnel sockets (Linux), empty for the system default
+	Admin          *AdminConfig  // JSON admin endpoint, nil to disable
+	StatsPush      *PushConfig   // Remote stats collector, nil to disable
+	History        time.Duration // Stats history kept for the admin endpoint, 0 to disable
+	HistoryStep    time.Duration // Resolution of History
+	Alarms         *AlarmConfig  // Error budget alarms, nil to disable
+	ReloadPolicy   ReloadPolicy  // What happens to open tunnels when server/SNI/password change
+	DrainTimeout   time.Duration // How long open connections may run after SIGINT/SIGTERM, 0 = close them at once
+	Handoff        string        // Unix socket for passing the listener to an upgraded process, empty to disable
+	Expose         *ExposeConfig // Rendezvous name offered to peers, nil to disable
+	Peer           string        // Rendezvous name every connection is carried to, empty for none
+	Mux            int           // Carry connections as streams over this many shared tunnels, 0 = a tunnel each
+	DNS            *DNSConfig    // Local DNS listener resolving through the tunnel, nil to disable
+	Logger         *logrus.Logger
+
+	// Replace pooled and open tunnels at the start of each window
+	Maintenance []MaintenanceWindow
+	// One record per closed connection, nil to disable
+	ConnLog *ConnLogConfig
+	// Check the decoy site's certificate in the handshake, nil to accept any
+	HandshakeCerts *stls.CertPolicy
+	// Cap relayed bytes per second, nil for no limit
+	RateLimit *RateLimitConfig
+
+	// Reload, if set, re-reads the configuration on SIGHUP
+	Reload func() (*ClientConfig, error)
 }
 
 // Client represents a ShadowTLS client instance
 type Client struct {
 	config *ClientConfig
 	stats  *Stats
+	conns  *ConnTable
 	pool   *ConnPool
 	log    *logrus.Logger
+
+	servers  *ServerSet
+	tunnels  *generationTracker
+	loop     *LoopGuard     // nil when loop checks are disabled
+	sockbuf  *SocketBuffers // nil when --socket-buffer-max is 0
+	tracer   *ByteTracer    // nil when --trace-bytes is 0
+	connLog  *ConnLog       // nil without --conn-log
+	mux      *MuxDialer     // nil without --mux
+	drain    *Drainer       // nil without --admin
+	rates    *RateLimits    // nil without --rate-limit-up/--rate-limit-down
+	snis     *SNISet
+	relayLog *logrus.Logger
+	repeat   *RepeatLogger
+	signals  chan os.Signal
+	ready    chan struct{}
+
+	statsEvery chan time.Duration // New --stats-interval from a reload
 }
 
 // NewClient creates a new client instance
@@ -53,104 +138,874 @@ func NewClient(config *ClientConfig) *Client {
 	return &Client{
 		config: config,
 		stats:  NewStats(),
+		conns:  NewConnTable(),
 		log:    logger,
+
+		tunnels:  newGenerationTracker(),
+		relayLog: ModuleLogger("relay"),
+		repeat:   NewRepeatLogger(logger),
+		signals:  make(chan os.Signal, 1),
+		ready:    make(chan struct{}),
+
+		statsEvery: make(chan time.Duration, 1),
+	}
+}
+
+// Ready is closed once the client listens for local connections
+func (c *Client) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Stop shuts the client down as SIGTERM would, making Run return
+func (c *Client) Stop() {
+	select {
+	case c.signals <- syscall.SIGTERM:
+	default:
 	}
 }
 
 func (c *Client) Run() error {
-	client, err := stls.NewClient(c.config.ServerAddr, c.config.SNI, c.config.Password, c.config.Timeout, c.log)
+	if c.config.SkipVerify {
+		c.log.Warn("Tunnel verification disabled (--skip-verify): stale pooled tunnels fail connections instead of being retried; keep --ttl well below the server idle timeout")
+	}
+
+	addrs, err := ParseServerList(c.config.ServerAddr)
+	if err != nil {
+		return withExitCode(ExitConfig, err)
+	}
+	if c.config.LoopCheck {
+		for _, addr := range addrs {
+			if err := CheckSelfDial(c.config.ListenAddr, addr); err != nil {
+				return withExitCode(ExitConfig, err)
+			}
+		}
+		c.loop = NewLoopGuard()
+	}
+	c.sockbuf = NewSocketBuffers(c.config.SocketBuffer, ModuleLogger("pool"))
+	c.rates = NewRateLimits(c.config.RateLimit)
+
+	snis, err := ParseSNIList(c.config.SNI)
 	if err != nil {
-		return fmt.Errorf("failed to create ShadowTLS client: %v", err)
+		return withExitCode(ExitConfig, err)
+	}
+	c.snis = NewSNISet(snis)
+	c.stats.SNIs = c.snis
+	if c.config.SNIProbe > 0 {
+		// Failing handshakes may mean a decoy went away: check at once
+		c.stats.Decoy.OnChange = func(state DecoyState) {
+			if state == DecoyFailing {
+				c.snis.ProbeNow()
+			}
+		}
 	}
 
-	factory := &stls.Factory{
-		Client: client,
+	dialers, err := c.serverDialers(addrs, snis, c.config.Password, c.config.HandshakeCerts)
+	if err != nil {
+		return withExitCode(ExitConfig, fmt.Errorf("failed to create ShadowTLS client: %v", err))
 	}
+	c.servers = NewServerSet(c.config.FailoverAfter, c.config.ServerRecheck)
+	c.servers.SetServers(dialers)
+	c.stats.Servers = c.servers
 
-	c.pool = NewConnPool(c.config.PoolSize, c.config.TTL, c.config.Backoff, factory.Create, c.stats)
+	var refill RefillPolicy
+	refillName := c.config.PoolRefill
+	switch refillName {
+	case "", "adaptive":
+		refillName = "adaptive"
+		refill = NewAdaptiveRefill(c.config.PoolSize, func() bool {
+			return c.stats.Path.Snapshot().Degraded || c.stats.Blackhole.Snapshot().Suspected
+		}, func(limit int) {
+			c.stats.PoolRefill.Store(int64(limit))
+		})
+	case "fixed":
+		refill = NewFixedRefill(c.config.PoolSize)
+	default:
+		return withExitCode(ExitConfig, fmt.Errorf("unknown pool refill policy: %s (use 'adaptive' or 'fixed')", c.config.PoolRefill))
+	}
+	c.stats.PoolRefill.Store(int64(c.config.PoolSize))
+
+	if err := c.config.ReloadPolicy.Validate(); err != nil {
+		return withExitCode(ExitConfig, err)
+	}
+
+	c.stats.Mem = NewMemBudget(c.config.MemLimit)
+	c.stats.Storm = NewStormDetector(c.config.StormPacing)
+	c.stats.Blackhole = NewBlackholeDetector(c.config.BlackholeProbe)
+	c.stats.Blackhole.OnChange = func(suspected bool) {
+		if !suspected {
+			return
+		}
+		// Another server may still get through; the pooled tunnels go to
+		// the silent one, so they are replaced
+		if c.servers.FailOver("looks blackholed") {
+			c.pool.Flush()
+		}
+		// The censor may be matching the SNI: check the hosts now, so
+		// failing ones leave the rotation
+		if c.config.SNIProbe > 0 {
+			c.snis.ProbeNow()
+		}
+	}
+
+	// Queue without bound: waiters are pool workers and local connections,
+	// both already limited, and rejecting them would only drop connections
+	c.stats.Handshakes = NewHandshakeLimiter(c.config.HandshakeLimit, math.MaxInt32, 0)
+	c.stats.HandshakeRate = NewHandshakeRate(c.config.HandshakeRate, c.config.HandshakeBurst)
+	c.pool = NewConnPool(c.config.PoolSize, c.config.TTL, c.config.Backoff, c.limitHandshakes(c.servers.Dial), refill, c.stats)
+	if c.config.CaptiveProbe != "" {
+		captive := NewCaptiveDetector(c.config.CaptiveProbe, c.config.CaptiveExpect)
+		captive.OnChange = c.stats.CaptivePortal.Store
+		c.pool.SetCaptiveDetector(captive)
+	}
+	c.stats.PoolTTL.Store(int64(c.config.TTL))
+	if c.config.TTLAuto {
+		c.pool.SetTTLTuner(NewTTLTuner(c.config.TTL, func(ttl time.Duration) {
+			c.pool.SetTTL(ttl)
+			c.stats.PoolTTL.Store(int64(ttl))
+		}))
+	}
+	if c.config.PoolMax > c.config.PoolSize {
+		c.pool.SetSizer(NewPoolSizer(c.config.PoolSize, c.config.PoolMax, func(size int) {
+			c.resizePool(size)
+			c.stats.PoolResizes.Add(1)
+		}))
+		c.stats.PoolMax.Store(int64(c.config.PoolMax))
+	}
 	c.pool.Start()
+	if c.config.Mux > 0 {
+		c.mux = NewMuxDialer(c.pool, c.stats, c.config.Mux, c.config.VerifyCoalesce)
+		c.stats.Mux = c.mux
+	}
 
-	listener, err := net.Listen("tcp", c.config.ListenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %v", c.config.ListenAddr, err)
+	var listener net.Listener
+	if c.config.Handoff != "" {
+		handoff, err := ReceiveHandoff(c.config.Handoff, c.config.ListenAddr)
+		if err != nil {
+			c.pool.Stop()
+			return err
+		}
+		if handoff != nil {
+			listener = handoff.Listener
+			if err := handoff.Commit(); err != nil {
+				listener.Close()
+				c.pool.Stop()
+				return err
+			}
+			c.log.Infof("Took over listener %s from pid %d (%s)", handoff.State.Listen, handoff.State.PID, handoff.State.Version)
+		}
 	}
+	if listener == nil {
+		listener, err = net.Listen("tcp", c.config.ListenAddr)
+		if err != nil {
+			c.pool.Stop()
+			return withExitCode(ExitBind, fmt.Errorf("failed to listen on %s: %v", c.config.ListenAddr, err))
+		}
+	}
+	var dns *DNSForwarder
+	var dnsUDP net.PacketConn
+	var dnsTCP net.Listener
+	if d := c.config.DNS; d != nil {
+		if dnsUDP, err = net.ListenPacket("udp", d.Listen); err == nil {
+			if dnsTCP, err = net.Listen("tcp", d.Listen); err != nil {
+				dnsUDP.Close()
+			}
+		}
+		if err != nil {
+			listener.Close()
+			c.pool.Stop()
+			return withExitCode(ExitBind, fmt.Errorf("failed to listen for DNS on %s: %v", d.Listen, err))
+		}
+		defer dnsUDP.Close()
+		defer dnsTCP.Close()
+		acquire := func(ctx context.Context, opening []byte) (net.Conn, []byte, error) {
+			tunnel, resp, err := acquireTunnel(ctx, c.pool, c.stats, opening, true, c.config.VerifyCoalesce)
+			if err != nil {
+				return nil, nil, err
+			}
+			return tunnel, resp, nil
+		}
+		upstream := newDNSUpstream(acquire, d.Upstream)
+		defer upstream.Close()
+		dns = NewDNSForwarder(upstream.Exchange, d.CacheSize, ModuleLogger("client"))
+	}
+	close(c.ready)
+	setCrashState(func() string {
+		avail, cap := c.pool.Stats()
+		return c.stats.Snapshot(avail, cap).String() + "\n" + formatConnTable(c.conns.Snapshot())
+	})
 
 	c.log.Infof("shadowtls client started")
 	c.log.Infof("  Listen: %s", c.config.ListenAddr)
-	c.log.Infof("  Server: %s", c.config.ServerAddr)
-	c.log.Infof("  SNI: %s", c.config.SNI)
-	c.log.Infof("  Pool size: %d, TTL: %v, Backoff: %v", c.config.PoolSize, c.config.TTL, c.config.Backoff)
+	if len(addrs) > 1 {
+		c.log.Infof("  Servers: %s (failover after %d failed dials, recheck every %v)",
+			strings.Join(addrs, ", "), c.config.FailoverAfter, c.config.ServerRecheck)
+	} else {
+		c.log.Infof("  Server: %s", c.config.ServerAddr)
+	}
+	switch {
+	case len(snis) > 1 && c.config.SNIProbe > 0:
+		c.log.Infof("  SNI: %s (rotated, probed every %v)", strings.Join(snis, ", "), c.config.SNIProbe)
+	case len(snis) > 1:
+		c.log.Infof("  SNI: %s (rotated)", strings.Join(snis, ", "))
+	case c.config.SNIProbe > 0:
+		c.log.Infof("  SNI: %s (probed every %v)", snis[0], c.config.SNIProbe)
+	default:
+		c.log.Infof("  SNI: %s", snis[0])
+	}
+	if certs := c.config.HandshakeCerts; certs != nil {
+		c.log.Infof("  Handshake certificate: %s", describeCertPolicy(certs))
+	}
+	ttlMode := ""
+	if c.config.TTLAuto {
+		ttlMode = " (auto)"
+	}
+	c.log.Infof("  Pool size: %d, TTL: %v%s, Backoff: %v, Refill: %s", c.config.PoolSize, c.config.TTL, ttlMode, c.config.Backoff, refillName)
+	if c.pool.sizer != nil {
+		c.log.Infof("  Pool max: %d, grown while under %.0f%% of connections find a tunnel ready", c.config.PoolMax, 100*poolSizeGrowBelow)
+	}
+	if c.mux != nil {
+		c.log.Infof("  Mux: connections share up to %d tunnels", c.config.Mux)
+	}
 	if c.config.StatsInterval > 0 {
 		c.log.Infof("  Stats interval: %v", c.config.StatsInterval)
 	}
+	if c.config.MemLimit > 0 {
+		c.log.Infof("  Memory limit: %s", formatBytes(uint64(c.config.MemLimit), true))
+	}
+	if c.config.HandshakeRate > 0 {
+		c.log.Infof("  Handshake rate: %g/s, burst %d", c.config.HandshakeRate, max(c.config.HandshakeBurst, 1))
+	}
+	if c.config.Congestion != "" {
+		c.log.Infof("  TCP congestion control: %s", c.config.Congestion)
+	}
+	if c.sockbuf != nil {
+		c.log.Infof("  Socket buffers: sized to the path RTT, up to %s", formatBytes(uint64(c.config.SocketBuffer), true))
+	}
+	if c.rates != nil {
+		c.log.Infof("  Rate limit: %s", c.rates)
+	}
+
+	// Closed once a successor took over the listener
+	handedOff := make(chan struct{})
+
+	if c.config.SystemProxy {
+		revert, err := ApplySystemProxy(c.config.ListenAddr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to apply system proxy: %v", err)
+		}
+		defer func() {
+			select {
+			case <-handedOff:
+				return // The settings now belong to the successor
+			default:
+			}
+			if err := revert(); err != nil {
+				c.log.Warnf("Failed to restore system proxy settings: %v", err)
+			} else {
+				c.log.Info("System proxy settings restored")
+			}
+		}()
+		c.log.Infof("  System proxy: socks5 %s", localProxyAddr(c.config.ListenAddr))
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
+	var wg sync.WaitGroup // Connection handlers
+	var bg sync.WaitGroup // Goroutines that run until ctx is cancelled
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
-	go func() {
-		for sig := range sigChan {
-			switch sig {
-			case syscall.SIGUSR1:
-				avail, cap := c.pool.Stats()
-				snap := c.stats.Snapshot(avail, cap)
-				fmt.Println(snap.String())
-			case syscall.SIGINT, syscall.SIGTERM:
-				Log.Info("Shutting down...")
-				cancel()
-				listener.Close()
+	// Closed by SIGINT/SIGTERM or a refused password: the accept loop ends
+	// and the shutdown sequence after it takes over
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	stop := func() {
+		quitOnce.Do(func() {
+			close(quit)
+			listener.Close()
+		})
+	}
+	// Closed by a second SIGINT/SIGTERM, which ends a --drain-timeout early
+	hurry := make(chan struct{})
+
+	var adminURL string
+	var admin *AdminServer
+	if c.config.Admin != nil {
+		admin, err = NewAdminServer(c.config.Admin, c.log)
+		if err != nil {
+			listener.Close()
+			cancel()
+			return withExitCode(ExitConfig, err)
+		}
+		admin.HandleJSON("/stats", func() any {
+			avail, cap := c.pool.Stats()
+			return c.stats.Snapshot(avail, cap)
+		})
+		admin.HandleJSON("/conns", func() any {
+			return c.conns.Snapshot()
+		})
+		admin.HandleJSON("/pool", func() any {
+			return c.pool.Status()
+		})
+		admin.HandleJSON("/features", func() any {
+			return CurrentFeatures()
+		})
+		if c.config.History > 0 {
+			history := NewStatsHistory(c.config.History, c.config.HistoryStep)
+			bg.Go(func() {
+				history.Run(ctx, func() StatsSnapshot {
+					avail, cap := c.pool.Stats()
+					return c.stats.Snapshot(avail, cap)
+				})
+			})
+			admin.Handle("/history", history)
+		}
+		c.drain = NewDrainer(func() int { return int(c.stats.ActiveConns.Load()) }, c.log)
+		admin.Handle("/drain", c.drain)
+		if err := admin.Start(); err != nil {
+			listener.Close()
+			cancel()
+			return withExitCode(ExitBind, err)
+		}
+		defer admin.Close()
+		adminURL = admin.URL()
+		c.log.Infof("  Admin: %s", adminURL)
+	}
+
+	if c.config.StatsPush != nil {
+		pusher, err := NewStatsPusher(c.config.StatsPush, func() StatsSnapshot {
+			avail, cap := c.pool.Stats()
+			return c.stats.Snapshot(avail, cap)
+		}, c.log)
+		if err != nil {
+			listener.Close()
+			cancel()
+			return withExitCode(ExitConfig, err)
+		}
+		bg.Go(func() { pusher.Run(ctx) })
+		c.log.Infof("  Stats push: %s every %v", c.config.StatsPush.Target, c.config.StatsPush.Interval)
+	}
+
+	bg.Go(func() { c.stats.Mem.Run(ctx) })
+
+	if c.config.SNIProbe > 0 {
+		bg.Go(func() { c.snis.Run(ctx, c.config.SNIProbe) })
+	}
+
+	if c.config.Alarms != nil {
+		alarms := NewAlarmMonitor(c.config.Alarms, c.stats, c.log)
+		bg.Go(func() { alarms.Run(ctx) })
+	}
+
+	if e := c.config.Expose; e != nil {
+		// Dial through the pool's factory so a reload's new password applies
+		dial := func(ctx context.Context) (net.Conn, error) {
+			return c.pool.factory.Load().dial(ctx)
+		}
+		exposer := NewExposer(e.Name, e.Target, dial, c.config.Backoff, ModuleLogger("rendezvous"))
+		bg.Go(func() { exposer.Run(ctx) })
+		c.log.Infof("  Expose: %q -> %s", e.Name, e.Target)
+	}
+	if c.config.Peer != "" {
+		c.log.Infof("  Peer: %q", c.config.Peer)
+	}
+	if c.config.PingInterval > 0 {
+		bg.Go(func() { c.runPings(ctx, c.config.PingInterval) })
+		c.log.Infof("  Ping interval: %v", c.config.PingInterval)
+	}
+	if dns != nil {
+		bg.Go(func() { dns.ServeUDP(ctx, dnsUDP) })
+		bg.Go(func() { dns.ServeTCP(ctx, dnsTCP) })
+		c.log.Infof("  DNS: %s via %s, cache %d", c.config.DNS.Listen, c.config.DNS.Upstream, c.config.DNS.CacheSize)
+	}
+	if len(c.config.Maintenance) > 0 {
+		bg.Go(func() { c.runMaintenance(ctx, dns) })
+		names := make([]string, len(c.config.Maintenance))
+		for i, w := range c.config.Maintenance {
+			names[i] = w.String()
+		}
+		c.log.Infof("  Maintenance: %s", strings.Join(names, ", "))
+	}
+	if c.config.ConnLog != nil {
+		c.connLog, err = NewConnLog(*c.config.ConnLog, c.log)
+		if err != nil {
+			listener.Close()
+			cancel()
+			return withExitCode(ExitConfig, err)
+		}
+		defer c.connLog.Close()
+		c.log.Infof("  Connection log: %s", c.config.ConnLog.Path)
+	}
+	if c.config.TraceBytes > 0 {
+		c.tracer = NewByteTracer(c.config.TraceBytes, c.config.TraceSample, c.relayLog)
+		c.log.Infof("  Trace: first %d bytes of one in %d connections", c.config.TraceBytes, max(c.config.TraceSample, 1))
+		if !c.relayLog.IsLevelEnabled(logrus.TraceLevel) {
+			c.log.Warnf("--trace-bytes dumps at trace level; enable it with -vvv or --log-levels relay=trace")
+		}
+	}
+
+	bg.Go(func() {
+		ticker := time.NewTicker(rateSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.conns.Sample()
+			case <-ctx.Done():
 				return
 			}
 		}
-	}()
+	})
 
-	if c.config.StatsInterval > 0 {
-		go func() {
-			ticker := time.NewTicker(c.config.StatsInterval)
-			defer ticker.Stop()
-			for {
+	sigChan := c.signals
+	signal.Notify(sigChan, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, userSignals...)...)
+	defer signal.Stop(sigChan)
+	bg.Go(func() {
+		for {
+			var sig os.Signal
+			select {
+			case sig = <-sigChan:
+			case <-ctx.Done():
+				return
+			}
+			switch sig {
+			case syscall.SIGHUP:
+				c.reload()
+			case syscall.SIGINT, syscall.SIGTERM:
 				select {
-				case <-ticker.C:
-					avail, cap := c.pool.Stats()
-					snap := c.stats.Snapshot(avail, cap)
-					snap.Log()
-				case <-ctx.Done():
+				case <-quit:
+					close(hurry)
 					return
+				default:
 				}
+				c.log.Info("Shutting down...")
+				stop()
+				if c.config.DrainTimeout == 0 {
+					return
+				}
+			default:
+				c.userSignal(sig)
 			}
-		}()
+		}
+	})
+
+	// A client whose password never worked exits instead of retrying forever,
+	// so a supervisor sees the misconfiguration
+	authFailed := make(chan error, 1)
+	bg.Go(func() {
+		select {
+		case <-c.pool.AuthRejected():
+			authFailed <- withExitCode(ExitAuth, fmt.Errorf("server refused the first %d handshakes: %s", authRejectThreshold, FailAuth.Describe()))
+			c.log.Error("Shutting down: the server never accepted the password")
+			stop()
+		case <-ctx.Done():
+		}
+	})
+
+	bg.Go(func() { c.logStats(ctx, c.config.StatsInterval) })
+
+	if c.config.StartupJSON != "" {
+		ev := newStartupEvent("client", listener.Addr().String())
+		ev.Server = c.config.ServerAddr
+		ev.ServerIP, ev.ServerIPs = resolveServer(addrs[0])
+		ev.SNI = c.config.SNI
+		ev.Fingerprint = stls.FingerprintName()
+		ev.Pool = &StartupPool{
+			Size:    c.config.PoolSize,
+			Max:     c.config.PoolMax,
+			Refill:  refillName,
+			TTL:     c.config.TTL.String(),
+			Backoff: c.config.Backoff.String(),
+			Timeout: c.config.Timeout.String(),
+		}
+		ev.Admin = adminURL
+		if err := WriteStartupEvent(c.config.StartupJSON, ev); err != nil {
+			c.log.Warnf("%v", err)
+		}
+	}
+
+	if c.config.Handoff != "" {
+		hs, err := ServeHandoff(c.config.Handoff, c.config.ListenAddr, listener, func() {
+			// The successor binds the admin address next, so release it now
+			close(handedOff)
+			if admin != nil {
+				admin.Close()
+			}
+			listener.Close()
+		}, c.log)
+		if err != nil {
+			c.log.Warnf("%v", err)
+		} else {
+			defer hs.Close()
+			c.log.Infof("  Handoff: %s", c.config.Handoff)
+		}
 	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
-			case <-ctx.Done():
+			case <-quit:
+			case <-handedOff:
+				c.log.Info("Handed the listener to a new process")
+				c.tunnels.Retire(c.tunnels.Advance(), c.config.ReloadPolicy, c.log)
 			default:
-				Log.Warnf("Accept error: %v", err)
+				c.repeat.Warnf("Accept error: %v", err)
 				continue
 			}
 			break
 		}
+		if c.drain.Refuse(conn) {
+			continue
+		}
+
+		pace := c.stats.Storm.Accept()
 
 		wg.Add(1)
 		go func(c_conn net.Conn) {
 			defer wg.Done()
+			defer recoverPanic(&c.stats.PanicCount, c.log, "connection handler")
+			if pace > 0 {
+				timer := time.NewTimer(pace)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					c_conn.Close()
+					return
+				}
+			}
 			c.handleConnection(ctx, c_conn)
 		}(conn)
 	}
 
-	Log.Info("Waiting for connections to close...")
-	wg.Wait()
-	c.pool.Stop()
+	seq := newShutdownSequence(c.log)
+	seq.Stage("stop accepting", 0, func() {
+		listener.Close()
+		if dns != nil {
+			dnsUDP.Close()
+			dnsTCP.Close()
+		}
+		if admin != nil {
+			admin.Close()
+		}
+	})
+	c.log.Info("Waiting for connections to close...")
+	select {
+	case <-handedOff:
+		// New connections go to the successor; open ones may run until they
+		// end on their own, or until SIGTERM cuts them short
+		seq.Stage("handed-off connections", 0, func() {
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-quit:
+			}
+		})
+	default:
+	}
+	var cut int
+	if c.config.DrainTimeout > 0 {
+		cut = seq.Drain(c.config.DrainTimeout, &wg, func() int { return int(c.stats.ActiveConns.Load()) }, hurry)
+	}
+	seq.Stage("cancel relays", 0, cancel)
+	if !seq.Stage("connections", shutdownStageTimeout, wg.Wait) {
+		c.log.Warnf("[SHUTDOWN] Closing %d connection(s) still open", c.tunnels.CloseAll())
+		seq.Stage("connections", shutdownStageTimeout, wg.Wait)
+	}
+	if c.mux != nil {
+		seq.Stage("mux", shutdownStageTimeout, c.mux.Close)
+	}
+	seq.Stage("pool", 0, c.pool.Stop) // Bounds its own wait
+	seq.Stage("background", shutdownStageTimeout, bg.Wait)
+	seq.Stage("stats", 0, func() {
+		avail, cap := c.pool.Stats()
+		snap := c.stats.Snapshot(avail, cap)
+		fmt.Println(snap.String())
+		if dns != nil {
+			c.log.Info(dns.Summary())
+		}
+		c.repeat.Flush()
+	})
+	if stuck := seq.Stuck(); len(stuck) > 0 {
+		c.log.Warnf("Shutdown complete in %v, gave up waiting on: %s", seq.Elapsed(), strings.Join(stuck, ", "))
+	} else {
+		c.log.Infof("Shutdown complete in %v", seq.Elapsed())
+	}
+	select {
+	case err := <-authFailed:
+		return err
+	default:
+	}
+	if cut > 0 {
+		return withExitCode(ExitDrain, fmt.Errorf("closed %d connection(s) still open after --drain-timeout %v", cut, c.config.DrainTimeout))
+	}
+	return nil
+}
 
-	avail, cap := c.pool.Stats()
-	snap := c.stats.Snapshot(avail, cap)
-	fmt.Println(snap.String())
+// resizePool moves the pool to size, for a reload or the adaptive sizer
+func (c *Client) resizePool(size int) {
+	c.pool.Resize(size)
+	limit, _ := c.pool.refill.Allowed()
+	c.stats.PoolRefill.Store(int64(limit))
+}
 
-	Log.Info("Shutdown complete")
-	return nil
+// logStats logs the [STATS] line every interval, switching to intervals sent
+// on c.statsEvery by a reload; 0 stops it until one arrives
+func (c *Client) logStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	ticker.Stop()
+	defer ticker.Stop()
+	for {
+		if interval > 0 {
+			ticker.Reset(interval)
+		}
+		select {
+		case <-ticker.C:
+			avail, cap := c.pool.Stats()
+			snap := c.stats.Snapshot(avail, cap)
+			snap.Log()
+			continue
+		case interval = <-c.statsEvery:
+			ticker.Stop()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadPool applies pool size, TTL, backoff and stats interval changes.
+// Workers are added or stopped to match; open connections and the listener
+// are untouched.
+func (c *Client) reloadPool(next *ClientConfig) {
+	cur := c.config
+	if next.PoolSize != cur.PoolSize || next.PoolMax != cur.PoolMax {
+		switch {
+		case next.PoolSize < 1:
+			c.log.Errorf("Reload: ignoring pool size %d, keeping %d", next.PoolSize, cur.PoolSize)
+		case c.pool.sizer != nil:
+			c.log.Infof("Reload: pool size %d-%d → %d-%d", cur.PoolSize, cur.PoolMax, next.PoolSize, max(next.PoolSize, next.PoolMax))
+			cur.PoolSize, cur.PoolMax = next.PoolSize, max(next.PoolSize, next.PoolMax)
+			c.stats.PoolMax.Store(int64(cur.PoolMax))
+			c.pool.sizer.SetRange(cur.PoolSize, cur.PoolMax)
+		default:
+			if next.PoolMax > next.PoolSize {
+				c.log.Warn("Reload: --pool-max takes effect on restart")
+			}
+			if next.PoolSize != cur.PoolSize {
+				c.log.Infof("Reload: pool size %d → %d", cur.PoolSize, next.PoolSize)
+				cur.PoolSize = next.PoolSize
+				c.resizePool(cur.PoolSize)
+			}
+		}
+	}
+	if next.TTL != cur.TTL {
+		if next.TTL <= 0 {
+			c.log.Errorf("Reload: ignoring TTL %v, keeping %v", next.TTL, cur.TTL)
+		} else {
+			c.log.Infof("Reload: TTL %v → %v", cur.TTL, next.TTL)
+			cur.TTL = next.TTL
+			c.pool.ReloadTTL(cur.TTL)
+			c.stats.PoolTTL.Store(int64(c.pool.TTL()))
+		}
+	}
+	if next.Backoff != cur.Backoff {
+		if next.Backoff <= 0 {
+			c.log.Errorf("Reload: ignoring backoff %v, keeping %v", next.Backoff, cur.Backoff)
+		} else {
+			c.log.Infof("Reload: backoff %v → %v", cur.Backoff, next.Backoff)
+			cur.Backoff = next.Backoff
+			c.pool.SetBackoff(cur.Backoff)
+		}
+	}
+	if next.StatsInterval != cur.StatsInterval {
+		if next.StatsInterval < 0 {
+			c.log.Errorf("Reload: ignoring stats interval %v, keeping %v", next.StatsInterval, cur.StatsInterval)
+		} else {
+			c.log.Infof("Reload: stats interval %v → %v", cur.StatsInterval, next.StatsInterval)
+			cur.StatsInterval = next.StatsInterval
+			// Only reload sends, so at most a stale value is waiting
+			select {
+			case <-c.statsEvery:
+			default:
+			}
+			c.statsEvery <- cur.StatsInterval
+		}
+	}
+}
+
+// reload re-reads the configuration, applies pool setting changes and, if
+// the server address, SNI or password changed, switches the pool to the new
+// settings and retires tunnels opened under the old ones according to the
+// reload policy
+func (c *Client) reload() {
+	if c.config.Reload == nil {
+		c.log.Warn("Reload requested but no --config file is in use")
+		return
+	}
+	next, err := c.config.Reload()
+	if err != nil {
+		c.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	if err := next.ReloadPolicy.Validate(); err != nil {
+		c.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	c.config.ReloadPolicy = next.ReloadPolicy
+	c.reloadPool(next)
+	if NewRateLimits(next.RateLimit).String() != c.rates.String() {
+		c.log.Warn("Reload: rate limits take effect on restart")
+	}
+
+	cur := c.config
+	if next.ServerAddr == cur.ServerAddr && next.SNI == cur.SNI && next.Password == cur.Password && next.HandshakeCerts.Equal(cur.HandshakeCerts) {
+		c.log.Info("Reload: tunnel settings unchanged")
+		return
+	}
+
+	addrs, err := ParseServerList(next.ServerAddr)
+	if err != nil {
+		c.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	if c.loop != nil {
+		for _, addr := range addrs {
+			if err := CheckSelfDial(cur.ListenAddr, addr); err != nil {
+				c.log.Errorf("Reload failed, keeping current configuration: %v", err)
+				return
+			}
+		}
+	}
+	snis, err := ParseSNIList(next.SNI)
+	if err != nil {
+		c.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	dialers, err := c.serverDialers(addrs, snis, next.Password, next.HandshakeCerts)
+	if err != nil {
+		c.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	if next.ServerAddr != cur.ServerAddr {
+		c.log.Infof("Reload: server %s → %s", cur.ServerAddr, next.ServerAddr)
+	}
+	if next.SNI != cur.SNI {
+		c.log.Infof("Reload: SNI %s → %s", cur.SNI, next.SNI)
+	}
+	if next.Password != cur.Password {
+		c.log.Info("Reload: password changed")
+	}
+	if !next.HandshakeCerts.Equal(cur.HandshakeCerts) {
+		c.log.Infof("Reload: handshake certificate %s → %s", describeCertPolicy(cur.HandshakeCerts), describeCertPolicy(next.HandshakeCerts))
+	}
+	cur.ServerAddr, cur.SNI, cur.Password = next.ServerAddr, next.SNI, next.Password
+	cur.HandshakeCerts = next.HandshakeCerts
+
+	c.snis.SetHosts(snis)
+	c.servers.SetServers(dialers)
+	c.pool.SetFactory(c.limitHandshakes(c.servers.Dial))
+	old := c.tunnels.Advance()
+	c.tunnels.Retire(old, cur.ReloadPolicy, c.log)
+	if c.mux != nil {
+		c.mux.Flush()
+	}
+}
+
+// serverDialers creates the tunnel dialers for each of addrs. With several
+// SNIs, each dial uses the one the SNI rotation hands out next.
+func (c *Client) serverDialers(addrs, snis []string, password string, certs *stls.CertPolicy) ([]ServerDialer, error) {
+	dialers := make([]ServerDialer, 0, len(addrs))
+	for _, addr := range addrs {
+		factories := make(map[string]*stls.Factory, len(snis))
+		for _, sni := range snis {
+			client, err := c.newTunnelClient(addr, sni, password, certs)
+			if err != nil {
+				return nil, err
+			}
+			factories[sni] = &stls.Factory{Client: client}
+		}
+		dial := factories[snis[0]].Create
+		if len(snis) > 1 {
+			dial = func(ctx context.Context) (net.Conn, error) {
+				f, ok := factories[c.snis.Next()]
+				if !ok {
+					f = factories[snis[0]] // Rotation already switched by a reload
+				}
+				return f.Create(ctx)
+			}
+		}
+		dialers = append(dialers, ServerDialer{Addr: addr, Dial: dial})
+	}
+	return dialers, nil
+}
+
+// newTunnelClient creates the ShadowTLS client for one server configuration,
+// with the loop guard, certificate checks and handshake diagnostics attached
+func (c *Client) newTunnelClient(server, sni, password string, certs *stls.CertPolicy) (*stls.Client, error) {
+	logger := ModuleLogger("shadowtls")
+	client, err := stls.NewClient(server, sni, password, c.config.Timeout, logger)
+	if err != nil {
+		return nil, err
+	}
+	if certs != nil {
+		client.SetCertPolicy(certs)
+	}
+	client.SetDialTrace(c.stats.Decoy.Record)
+	if c.loop != nil || c.sockbuf != nil || c.config.Congestion != "" {
+		client.SetDialCheck(func(conn net.Conn) error {
+			if c.loop != nil {
+				if err := c.loop.CheckDial(conn); err != nil {
+					return err
+				}
+			}
+			c.sockbuf.Tune(conn)
+			if err := setCongestion(conn, c.config.Congestion); err != nil {
+				c.repeat.Warnf("Failed to set congestion control %s: %v", c.config.Congestion, err)
+			}
+			return nil
+		})
+	}
+	if c.config.HandshakeDebug {
+		client.SetHandshakeTranscript(func(t *stls.Transcript, err error) {
+			logger.Warnf("[HANDSHAKE] Handshake with %s (SNI %s) failed: %v\n%s", server, sni, err, t)
+		})
+	}
+	return client, nil
+}
+
+// describeCertPolicy says what the handshake certificate is checked against
+func describeCertPolicy(certs *stls.CertPolicy) string {
+	if certs == nil {
+		return "not checked"
+	}
+	var checks []string
+	if certs.Verify {
+		checks = append(checks, "verified against the system roots")
+	}
+	if len(certs.Pins) > 0 {
+		checks = append(checks, fmt.Sprintf("pinned to %d key(s)", len(certs.Pins)))
+	}
+	return strings.Join(checks, ", ")
+}
+
+// limitHandshakes wraps a dial function so at most HandshakeLimit uTLS
+// handshakes run at once, bounding the CPU spike when the whole pool refills
+// after a network blip, and no more than HandshakeRate start per second
+func (c *Client) limitHandshakes(dial func(ctx context.Context) (net.Conn, error)) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		if err := c.stats.HandshakeRate.Wait(ctx); err != nil {
+			return nil, err
+		}
+		release, err := c.stats.Handshakes.Acquire(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return dial(ctx)
+	}
 }
 
 func (c *Client) handleConnection(ctx context.Context, local net.Conn) {
@@ -160,56 +1015,320 @@ func (c *Client) handleConnection(ctx context.Context, local net.Conn) {
 		c.stats.ConnEnd()
 		c.stats.RecordConnLifetime(time.Since(connStart))
 	}()
+	// The relay, a reload and the cleanup below may each close local; only
+	// the first close reaches the socket
+	local = relaypkg.CloseOnce(local)
 	defer local.Close()
 
-	Log.Debugf("New connection from %s", local.RemoteAddr())
+	var info *ConnInfo
+	var tunnel *PooledConn
+	var reason string
+	if c.connLog != nil {
+		remote := local.RemoteAddr()
+		defer func() {
+			c.connLog.Log(newConnRecord(remote, connStart, info, tunnel, reason))
+		}()
+	}
+
+	info = c.conns.Add(local.RemoteAddr().String())
+	defer c.conns.Remove(info)
+	// Every log line about the connection carries its ID, as in /conns
+	ctx = withConnID(ctx, info.ID)
+	log, relayLog := connLogger(ctx, c.log), connLogger(ctx, c.relayLog)
 
-	// Read initial data from client for replay on stale pool connections.
-	initialBuf := make([]byte, copyBufSize)
-	local.SetReadDeadline(time.Now().Add(10 * time.Second))
-	n, err := local.Read(initialBuf)
-	local.SetReadDeadline(time.Time{})
-	if err != nil || n == 0 {
-		Log.Debugf("No initial data from %s: %v", local.RemoteAddr(), err)
+	if !c.stats.Mem.Acquire(memPerConn) {
+		mem := c.stats.Mem.Snapshot()
+		c.repeat.WarnfContext(ctx, "[SHED] Rejected connection from %s: memory over limit (estimate %s, heap %s, limit %s)", local.RemoteAddr(),
+			formatBytes(uint64(mem.Estimate), true), formatBytes(uint64(mem.Heap), true), formatBytes(uint64(mem.Limit), true))
+		c.stats.ConnErrors.Add(1)
+		reason = CloseShed
+		return
+	}
+	defer c.stats.Mem.Release(memPerConn)
+
+	if c.loop != nil && c.loop.IsOwnDial(local.RemoteAddr()) {
+		c.repeat.WarnfContext(ctx, "[LOOP] Refused connection from %s: it is this client's own dial to the server, redirected back to the listener; exclude the server address from redirect/TUN rules", local.RemoteAddr())
 		c.stats.ConnErrors.Add(1)
+		reason = CloseLoop
 		return
 	}
-	initialData := initialBuf[:n]
+
+	// A per-connection context lets a reload close this tunnel on demand
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	untrack := c.tunnels.Track(func() {
+		cancel()
+		local.Close()
+	})
+	defer untrack()
+
+	// Reads from local go out through the tunnel, writes are what came back
+	local = c.tracer.Wrap(local, "app → server", "server → app")
+	defer local.Close() // A traced conn logs its dumps on close
+
+	log.Debugf("New connection from %s", local.RemoteAddr())
+
+	if c.mux != nil && c.handleMuxed(ctx, local, info, &reason) {
+		return
+	}
+
+	// Read initial data from client for replay on stale pool connections.
+	// A passive listener sends the wake marker instead and uses the server's
+	// banner as the verify response.
+	var initialData []byte
+	opening := passiveWake
+	if !c.config.Passive {
+		timeout := c.config.FirstPacket
+		if timeout <= 0 {
+			timeout = defaultFirstPacketTimeout
+		}
+		limit := c.config.FirstPacketMax
+		if limit <= 0 {
+			limit = defaultFirstPacketMax
+		}
+		data, err := readInitialData(local, timeout, limit)
+		if err != nil {
+			log.Debugf("No initial data from %s within %v: %v", local.RemoteAddr(), timeout, err)
+			c.stats.ConnErrors.Add(1)
+			reason = CloseNoData
+			return
+		}
+		// memPerConn covers one read buffer; account for a larger burst
+		if extra := int64(cap(data) - copyBufSize); extra > 0 {
+			c.stats.Mem.Track(extra)
+			defer c.stats.Mem.Release(extra)
+		}
+		initialData = data
+		opening = initialData
+		if c.config.SniffGuard != SniffOff && c.sniffRefused(ctx, local, initialData) {
+			reason = CloseSniffed
+			return
+		}
+	}
+	if c.config.Peer != "" {
+		opening = append(rendezvousHeader(rendezvousDial, c.config.Peer), opening...)
+	}
 
 	// Get a verified tunnel, retrying stale connections
-	tunnel, firstResponse, err := acquireTunnel(ctx, c.pool, c.stats, initialData)
+	tunnel, firstResponse, err := acquireTunnel(ctx, c.pool, c.stats, opening, !c.config.SkipVerify, c.config.VerifyCoalesce)
+	if err != nil && c.config.RetryHold > 0 {
+		tunnel, firstResponse, err = c.holdForTunnel(ctx, opening, err)
+	}
 	if err != nil {
-		Log.Warnf("Failed to get tunnel: %v", err)
+		c.repeat.WarnfContext(ctx, "Failed to get tunnel: %v", err)
 		c.stats.ConnErrors.Add(1)
+		reason = CloseNoTunnel
 		return
 	}
+	tunnel.Conn = relaypkg.CloseOnce(tunnel.Conn)
 	defer tunnel.Close()
+	info.SetTunnel(tunnel)
+	info.BytesOut.Add(uint64(len(initialData)))
 
 	// Forward the server's first response to the local client
-	local.SetWriteDeadline(time.Now().Add(relaypkg.DefaultWriteTimeout))
-	_, err = local.Write(firstResponse)
-	local.SetWriteDeadline(time.Time{})
-	if err != nil {
-		Log.Debugf("Failed to forward response to client: %v", err)
-		c.stats.ConnErrors.Add(1)
-		return
+	if len(firstResponse) > 0 {
+		local.SetWriteDeadline(time.Now().Add(relaypkg.DefaultWriteTimeout))
+		_, err = local.Write(firstResponse)
+		local.SetWriteDeadline(time.Time{})
+		if err != nil {
+			relayLog.Debugf("Failed to forward response to client: %v", err)
+			c.stats.ConnErrors.Add(1)
+			reason = CloseWriteFailed
+			return
+		}
+		info.BytesIn.Add(uint64(len(firstResponse)))
+	}
+
+	if c.config.Socks5UDP {
+		if handled, r := c.socksUDP(ctx, local, tunnel, initialData, firstResponse, info); handled {
+			reason = r
+			return
+		}
 	}
 
 	// Bidirectional relay
-	bytesOut, bytesIn := relay(ctx, local, tunnel, c.stats)
+	var bytesOut, bytesIn int64
+	up, down := c.rates.ForConn()
+	bytesOut, bytesIn, reason = relay(ctx, local, tunnel, c.stats, info, up, down)
 
-	Log.Infof("Connection closed: %s out, %s in, %v",
+	relayLog.Infof("Connection closed: %s out, %s in, %v",
 		formatBytes(uint64(int64(len(initialData))+bytesOut), true),
 		formatBytes(uint64(int64(len(firstResponse))+bytesIn), true),
 		time.Since(connStart).Round(time.Millisecond))
 }
 
+// sniffRefused reports whether the app's opening shows it was pointed at
+// the listener the wrong way, and explains it if so. It runs before any
+// tunnel is taken, so a misconfigured app doesn't burn pooled tunnels the
+// server would only close.
+func (c *Client) sniffRefused(ctx context.Context, local net.Conn, opening []byte) bool {
+	kind, desc := sniffOpening(opening)
+	if kind == sniffOther {
+		return false
+	}
+	advice := sniffAdvice(kind, c.config.ListenAddr)
+	c.repeat.WarnfContext(ctx, "[SNIFF] %s sent %s; refused without opening a tunnel: %s", local.RemoteAddr(), desc, advice)
+	if c.config.SniffGuard == SniffHelp && kind != sniffTLS {
+		writeSniffHelp(local, advice)
+	}
+	return true
+}
+
+// runPings probes the server through a pooled tunnel every interval. A
+// tunnel that answers goes back to the pool, so the probe also confirms that
+// the tunnels waiting there are usable; one that doesn't is closed.
+func (c *Client) runPings(ctx context.Context, interval time.Duration) {
+	var serverVersion string
+	// legacy is set once a server that predates versioned pings answered an
+	// old-style one; versioned once the server answered a versioned one
+	var legacy, versioned bool
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		tunnel := c.pingTunnel(ctx)
+		if tunnel == nil {
+			continue
+		}
+		rtt, version, err := PingTunnel(tunnel.Conn, verifyTimeout, legacy)
+		if err != nil && !legacy && !versioned {
+			// A server that predates versioned pings forwards them to its
+			// backend; ask it the old way before calling it unresponsive
+			tunnel.Close()
+			if tunnel = c.pingTunnel(ctx); tunnel == nil {
+				continue
+			}
+			if rtt, version, err = PingTunnel(tunnel.Conn, verifyTimeout, true); err == nil {
+				legacy = true
+				c.log.Infof("Server predates versioned pings; its version is unknown")
+			}
+		}
+		if err != nil {
+			tunnel.Close()
+			c.stats.PingFailed.Add(1)
+			c.repeat.Warnf("[PING] Server did not answer (tunnel age %v): %v", tunnel.PoolAge.Round(time.Millisecond), err)
+			continue
+		}
+		versioned = versioned || !legacy
+		c.stats.Pings.Add(1)
+		c.stats.PingRTT.Store(int64(rtt))
+		c.log.Debugf("Ping: %v", rtt.Round(time.Millisecond))
+		if version != serverVersion && version != "" {
+			c.log.Infof("Server version: %s", version)
+			serverVersion = version
+		}
+		c.pool.Put(tunnel)
+	}
+}
+
+// pingTunnel takes a tunnel from the pool to ping through, or returns nil
+// and counts a failed ping if none comes
+func (c *Client) pingTunnel(ctx context.Context) *PooledConn {
+	getCtx, cancel := context.WithTimeout(ctx, c.config.Timeout+verifyTimeout)
+	tunnel, err := c.pool.Get(getCtx)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			c.stats.PingFailed.Add(1)
+			c.repeat.Warnf("[PING] No tunnel to ping the server through: %v", err)
+		}
+		return nil
+	}
+	return tunnel
+}
+
+// holdForTunnel keeps a local connection waiting through a brief server
+// outage instead of failing it. After the first failed acquire it retries
+// whenever a pool worker gets through to the server, or right away if one
+// already has, until RetryHold has passed. Held connections don't dial on
+// their own, so an outage doesn't turn each of them into a retry loop.
+func (c *Client) holdForTunnel(ctx context.Context, opening []byte, err error) (*PooledConn, []byte, error) {
+	if ctx.Err() != nil || errors.Is(err, errCaptivePortal) {
+		return nil, nil, err
+	}
+	c.stats.ConnsHeld.Add(1)
+	connLogger(ctx, c.log).Debugf("No tunnel (%v), holding the connection for up to %v", err, c.config.RetryHold)
+
+	holdCtx, cancel := context.WithTimeout(ctx, c.config.RetryHold)
+	defer cancel()
+	connected := c.pool.Connected()
+	for {
+		// A tunnel pooled before connected was taken wouldn't wake us
+		if avail, _ := c.pool.Stats(); avail == 0 {
+			select {
+			case <-connected:
+			case <-holdCtx.Done():
+				if ctx.Err() != nil {
+					return nil, nil, ctx.Err()
+				}
+				return nil, nil, fmt.Errorf("%v (held %v)", err, c.config.RetryHold)
+			}
+		}
+		connected = c.pool.Connected()
+		tunnel, resp, aerr := acquireTunnel(holdCtx, c.pool, c.stats, opening, !c.config.SkipVerify, c.config.VerifyCoalesce)
+		if aerr == nil {
+			c.stats.ConnsHeldRecovered.Add(1)
+			return tunnel, resp, nil
+		}
+		if errors.Is(aerr, errCaptivePortal) {
+			return nil, nil, aerr
+		}
+		if holdCtx.Err() == nil {
+			err = aerr
+		}
+	}
+}
+
+// readInitialData reads the client's opening burst for replay on a stale
+// tunnel. A message that arrives in several segments (e.g. a big POST or a
+// ClientHello with a post-quantum key share) is collected for as long as more
+// keeps arriving within initialReadGap, up to limit bytes, so verification
+// waits for a reply to the whole message and a retry replays it rather than
+// an arbitrary first chunk.
+func readInitialData(conn net.Conn, timeout time.Duration, limit int) ([]byte, error) {
+	data := make([]byte, 0, min(copyBufSize, limit))
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		end := min(len(data)+copyBufSize, limit)
+		data = slices.Grow(data, end-len(data))
+		n, err := conn.Read(data[len(data):end])
+		data = data[:len(data)+n]
+		if err != nil {
+			if len(data) == 0 {
+				return nil, err
+			}
+			break // Gap expired or client half-closed: the burst is complete
+		}
+		if len(data) >= limit {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(initialReadGap))
+	}
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	return data, nil
+}
+
+// errTunnelsStale is returned when every tunnel tried closed without answering
+var errTunnelsStale = errors.New("pool connections stale")
+
 // acquireTunnel gets a pool connection and verifies it with a full round-trip:
 // write the client's initial data and read the server's response.
 // TCP-dead connections fail on write; app-dead connections (expired ShadowTLS
 // session) fail on read (server silently drops data, no response comes).
-// Retries up to maxRetries times on stale connections.
-func acquireTunnel(ctx context.Context, pool *ConnPool, stats *Stats, initialData []byte) (*PooledConn, []byte, error) {
+// Retries up to maxRetries times on stale connections. Response segments
+// arriving within coalesce of each other are returned as one response.
+// Without verify only the write is checked and no response is read, saving
+// a round trip at the cost of app-dead tunnels failing the connection.
+func acquireTunnel(ctx context.Context, pool *ConnPool, stats *Stats, initialData []byte, verify bool, coalesce time.Duration) (*PooledConn, []byte, error) {
+	log := connLogger(ctx, pool.log)
 	getCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -222,9 +1341,9 @@ func acquireTunnel(ctx context.Context, pool *ConnPool, stats *Stats, initialDat
 		}
 
 		if tunnel.FromPool {
-			Log.Debugf("Tunnel: pooled (age=%v, rtt=%v)", tunnel.PoolAge.Round(time.Millisecond), tunnel.ConnectTime.Round(time.Millisecond))
+			log.Debugf("Tunnel: pooled (age=%v, rtt=%v)", tunnel.PoolAge.Round(time.Millisecond), tunnel.ConnectTime.Round(time.Millisecond))
 		} else {
-			Log.Debugf("Tunnel: new (rtt=%v)", tunnel.ConnectTime.Round(time.Millisecond))
+			log.Debugf("Tunnel: new (rtt=%v)", tunnel.ConnectTime.Round(time.Millisecond))
 		}
 
 		// Write — catches TCP-dead connections
@@ -233,31 +1352,55 @@ func acquireTunnel(ctx context.Context, pool *ConnPool, stats *Stats, initialDat
 		tunnel.SetWriteDeadline(time.Time{})
 		if err != nil {
 			stats.PoolStale.Add(1)
-			Log.Debugf("Stale tunnel (write failed, %d/%d): %v", attempt+1, maxRetries, err)
+			pool.Verified(tunnel, false)
+			log.Debugf("Stale tunnel (write failed, %d/%d): %v", attempt+1, maxRetries, err)
 			tunnel.Close()
 			continue
 		}
+		if !verify {
+			return tunnel, nil, nil
+		}
 
 		// Read — catches app-dead connections (TCP alive, ShadowTLS session expired)
-		tunnel.SetReadDeadline(time.Now().Add(verifyTimeout))
-		n, err := tunnel.Read(respBuf)
-		tunnel.SetReadDeadline(time.Time{})
+		verifyStart := time.Now()
+		n, segments, conn, err := readFirstResponse(tunnel.Conn, respBuf, coalesce)
 		if err != nil || n == 0 {
+			if silentVerify(n, err) {
+				stats.Blackhole.Record(false, tunnel.PoolAge)
+			}
 			stats.PoolStale.Add(1)
-			Log.Debugf("Stale tunnel (no response, %d/%d): %v", attempt+1, maxRetries, err)
+			pool.Verified(tunnel, false)
+			log.Debugf("Stale tunnel (no response, %d/%d): %v", attempt+1, maxRetries, err)
 			tunnel.Close()
 			continue
 		}
+		pool.Verified(tunnel, true)
+		stats.Blackhole.Record(true, tunnel.PoolAge)
+		tunnel.VerifyRTT = time.Since(verifyStart)
+		tunnel.Conn = conn
+		if segments > 1 {
+			stats.VerifySplit.Add(1)
+			log.Debugf("Coalesced %d-segment first response (%d bytes)", segments, n)
+		}
 
 		return tunnel, respBuf[:n], nil
 	}
 
-	return nil, nil, fmt.Errorf("all %d pool connections stale", maxRetries)
+	return nil, nil, fmt.Errorf("all %d %w", maxRetries, errTunnelsStale)
 }
 
 // relay copies data bidirectionally between local and tunnel until one side
-// closes or ctx is cancelled. Returns bytes sent out and received in.
-func relay(ctx context.Context, local, tunnel net.Conn, stats *Stats) (bytesOut, bytesIn int64) {
+// closes or ctx is cancelled, holding each direction to its limiter (up for
+// app → server, down for server → app; nil for no limit). Returns bytes sent
+// out and received in. Per-direction byte counts are also accumulated into
+// info for live rates.
+func relay(ctx context.Context, local, tunnel net.Conn, stats *Stats, info *ConnInfo, up, down *relaypkg.Limiter) (bytesOut, bytesIn int64, reason string) {
+	log := connLogger(ctx, ModuleLogger("relay"))
+	// Either direction and the shutdown watcher may close both sides. Each
+	// is closed once, and the errors those closes cause in the other
+	// direction aren't mistaken for the connection failing.
+	lc, tc := relaypkg.CloseOnce(local), relaypkg.CloseOnce(tunnel)
+
 	// Close both connections on shutdown; connDone prevents this goroutine
 	// from leaking when the connection closes normally before shutdown.
 	connDone := make(chan struct{})
@@ -265,33 +1408,51 @@ func relay(ctx context.Context, local, tunnel net.Conn, stats *Stats) (bytesOut,
 	go func() {
 		select {
 		case <-ctx.Done():
-			local.Close()
-			tunnel.Close()
+			lc.Close()
+			tc.Close()
 		case <-connDone:
 		}
 	}()
 
-	done := make(chan struct{}, 2)
-
-	go func() {
-		n, _ := relaypkg.CopyConn(tunnel, local, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, func(n int) {
-			stats.AddBytes(uint64(n))
-		})
-		bytesOut = n
-		tunnel.Close() // unblock tunnel → local
-		done <- struct{}{}
-	}()
-
-	go func() {
-		n, _ := relaypkg.CopyConn(local, tunnel, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, func(n int) {
+	// The direction that ends first says why the connection closed
+	done := make(chan string, 2)
+	copyDir := func(fromApp bool, dst, src *relaypkg.OnceConn, limit *relaypkg.Limiter, count *atomic.Uint64, total *int64) {
+		var err error
+		defer func() { done <- relayCloseReason(fromApp, err) }()
+		defer recoverPanic(&stats.PanicCount, log, "relay")
+		*total, err = relaypkg.CopyConnLimited(ctx, dst, src, relayBufferSize, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, limit, func(n int) {
 			stats.AddBytes(uint64(n))
+			count.Add(uint64(n))
 		})
-		bytesIn = n
-		local.Close() // unblock local → tunnel
-		done <- struct{}{}
-	}()
+		if src.Expected(err) || dst.Expected(err) || errors.Is(err, context.Canceled) {
+			err = nil // Closed by us, or shut down while waiting on the rate limit
+		}
+		if r := relayCloseReason(fromApp, err); r == CloseAppError || r == CloseServerError {
+			log.Debugf("Relay %s failed: %v", relayDirection(fromApp), err)
+		}
+		dst.Close() // Unblock the other direction
+	}
+	go copyDir(true, tc, lc, up, &info.BytesOut, &bytesOut)
+	go copyDir(false, lc, tc, down, &info.BytesIn, &bytesIn)
 
+	reason = <-done
 	<-done
-	<-done
+	if ctx.Err() != nil {
+		reason = CloseCancelled
+	}
+	if err := tc.CloseError(); err != nil {
+		log.Debugf("Closing tunnel: %v", err)
+	}
+	if err := lc.CloseError(); err != nil {
+		log.Debugf("Closing local connection: %v", err)
+	}
 	return
 }
+
+// relayDirection names a relay direction for logs
+func relayDirection(fromApp bool) string {
+	if fromApp {
+		return "app → server"
+	}
+	return "server → app"
+}
@@ -1,6 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,3 +38,249 @@ func TestNewClient(t *testing.T) {
 		t.Error("Client stats not initialized")
 	}
 }
+
+func TestReadInitialData(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 100*1024)
+	tests := map[string]struct {
+		writes [][]byte
+		limit  int
+		want   int
+	}{
+		"single small packet":      {[][]byte{[]byte("hello")}, 128 * 1024, 5},
+		"burst larger than a read": {[][]byte{big}, 128 * 1024, len(big)},
+		"burst over the cap":       {[][]byte{big}, 64 * 1024, 64 * 1024},
+		"segments within the gap":  {[][]byte{[]byte("GET /"), []byte(" HTTP/1.1")}, 128 * 1024, 14},
+	}
+	for name, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			for i, w := range tt.writes {
+				if i > 0 {
+					time.Sleep(initialReadGap / 4)
+				}
+				client.Write(w)
+			}
+		}()
+		got, err := readInitialData(server, time.Second, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(got) != tt.want {
+			t.Errorf("%s: read %d bytes, want %d", name, len(got), tt.want)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// A pause longer than the gap ends the burst
+func TestReadInitialDataGap(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("first"))
+		time.Sleep(initialReadGap / 4)
+		client.Write([]byte(" second"))
+		time.Sleep(5 * initialReadGap)
+		client.Write([]byte("late"))
+	}()
+	got, err := readInitialData(server, time.Second, 1024)
+	if err != nil || string(got) != "first second" {
+		t.Errorf("read %q, %v; want both segments before the pause", got, err)
+	}
+}
+
+func TestReadInitialDataTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := readInitialData(server, 20*time.Millisecond, 1024); err == nil {
+		t.Error("expected timeout with no data")
+	}
+}
+
+func TestAcquireTunnelSkipVerify(t *testing.T) {
+	// The server side reads the opening but never answers
+	factory := func(ctx context.Context) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go io.Copy(io.Discard, remote)
+		return local, nil
+	}
+	pool := NewConnPool(1, time.Minute, time.Second, factory, nil, NewStats())
+
+	start := time.Now()
+	tunnel, resp, err := acquireTunnel(context.Background(), pool, NewStats(), []byte("hello"), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	if resp != nil {
+		t.Errorf("got response %q without verification", resp)
+	}
+	if elapsed := time.Since(start); elapsed >= verifyTimeout {
+		t.Errorf("acquireTunnel waited %v for a response", elapsed)
+	}
+}
+
+func TestClientLimitHandshakes(t *testing.T) {
+	c := NewClient(&ClientConfig{})
+	c.stats.Handshakes = NewHandshakeLimiter(1, math.MaxInt32, 0)
+
+	var running, peak atomic.Int32
+	dial := c.limitHandshakes(func(ctx context.Context) (net.Conn, error) {
+		n := running.Add(1)
+		if n > peak.Load() {
+			peak.Store(n)
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := dial(context.Background()); err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p != 1 {
+		t.Errorf("%d handshakes ran at once, want 1", p)
+	}
+}
+
+// A connection arriving during an outage waits for the pool to reconnect
+func TestClientHoldForTunnel(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	factory := func(ctx context.Context) (net.Conn, error) {
+		if down.Load() {
+			return nil, errors.New("connection refused")
+		}
+		local, remote := net.Pipe()
+		go io.Copy(io.Discard, remote)
+		return local, nil
+	}
+	c := NewClient(&ClientConfig{RetryHold: 5 * time.Second, SkipVerify: true})
+	c.pool = NewConnPool(1, time.Minute, 20*time.Millisecond, factory, nil, c.stats)
+	c.pool.Start()
+	defer c.pool.Stop()
+
+	_, _, err := acquireTunnel(context.Background(), c.pool, c.stats, []byte("hello"), false, 0)
+	if err == nil {
+		t.Fatal("acquireTunnel succeeded with the server down")
+	}
+	time.AfterFunc(50*time.Millisecond, func() { down.Store(false) })
+	start := time.Now()
+	tunnel, _, err := c.holdForTunnel(context.Background(), []byte("hello"), err)
+	if err != nil {
+		t.Fatalf("holdForTunnel = %v", err)
+	}
+	tunnel.Close()
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("held %v, want a retry as soon as the pool reconnected", waited)
+	}
+	if c.stats.ConnsHeld.Load() != 1 || c.stats.ConnsHeldRecovered.Load() != 1 {
+		t.Errorf("held %d, recovered %d, want 1/1", c.stats.ConnsHeld.Load(), c.stats.ConnsHeldRecovered.Load())
+	}
+
+	// Past the hold window the original error is returned
+	down.Store(true)
+	c.config.RetryHold = 30 * time.Millisecond
+	c.pool.Flush()
+	if _, _, err := c.holdForTunnel(context.Background(), []byte("hello"), errors.New("connection refused")); err == nil {
+		t.Error("holdForTunnel succeeded with the server still down")
+	}
+}
+
+// A held connection waits for the pool instead of dialing on its own
+func TestClientHoldDoesNotDial(t *testing.T) {
+	var dials atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New("connection refused")
+	}
+	c := NewClient(&ClientConfig{RetryHold: 1200 * time.Millisecond, SkipVerify: true})
+	c.pool = NewConnPool(1, time.Minute, time.Hour, factory, nil, c.stats)
+	c.pool.Start()
+	defer c.pool.Stop()
+
+	_, _, err := acquireTunnel(context.Background(), c.pool, c.stats, []byte("hello"), false, 0)
+	if err == nil {
+		t.Fatal("acquireTunnel succeeded with the server down")
+	}
+	time.Sleep(100 * time.Millisecond) // Let the worker's first dial fail
+	before := dials.Load()
+	if _, _, err := c.holdForTunnel(context.Background(), []byte("hello"), err); err == nil {
+		t.Fatal("holdForTunnel succeeded with the server down")
+	}
+	if n := dials.Load() - before; n != 0 {
+		t.Errorf("held connection dialed %d times, want none", n)
+	}
+}
+
+// closeCounter counts Close calls on a connection
+type closeCounter struct {
+	net.Conn
+	closes atomic.Int32
+}
+
+func (c *closeCounter) Close() error {
+	c.closes.Add(1)
+	return c.Conn.Close()
+}
+
+// Both relay directions and the shutdown watcher close the connections;
+// each must reach the socket only once
+func TestRelayClosesOnce(t *testing.T) {
+	for _, cancel := range []bool{false, true} {
+		app, appPeer := net.Pipe()
+		tun, tunPeer := net.Pipe()
+		local, tunnel := &closeCounter{Conn: app}, &closeCounter{Conn: tun}
+		go io.Copy(io.Discard, tunPeer)
+
+		ctx, stop := context.WithCancel(context.Background())
+		type result struct {
+			out    int64
+			reason string
+		}
+		res := make(chan result, 1)
+		go func() {
+			out, _, reason := relay(ctx, local, tunnel, NewStats(), &ConnInfo{}, nil, nil)
+			res <- result{out, reason}
+		}()
+		if _, err := appPeer.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if cancel {
+			stop()
+		} else {
+			appPeer.Close()
+		}
+		r := <-res
+		stop()
+		appPeer.Close()
+		tunPeer.Close()
+
+		want := CloseAppClosed
+		if cancel {
+			want = CloseCancelled
+		}
+		if r.reason != want {
+			t.Errorf("cancel=%v: reason %q, want %q", cancel, r.reason, want)
+		}
+		if !cancel && r.out != 5 {
+			t.Errorf("%d bytes out, want 5", r.out)
+		}
+		if local.closes.Load() != 1 || tunnel.closes.Load() != 1 {
+			t.Errorf("cancel=%v: local closed %d times, tunnel %d; want once each", cancel, local.closes.Load(), tunnel.closes.Load())
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxTrackedClients bounds how many client addresses ClientVersions remembers
+const maxTrackedClients = 10000
+
+// ClientVersions records the version each client reports in its pings, so
+// the server can show which releases its fleet runs and warn about clients
+// older than MinVersion. Clients that don't ping report nothing and aren't
+// seen.
+type ClientVersions struct {
+	minVersion string // Empty to never warn
+	log        *logrus.Logger
+	repeat     *RepeatLogger
+
+	mu      sync.Mutex
+	clients map[string]clientVersion // By client IP
+}
+
+// clientVersion is what one client address reported
+type clientVersion struct {
+	last   string // Version last reported
+	newest string // Newest version ever reported; clients sharing the IP may alternate
+}
+
+// NewClientVersions creates a tracker warning about versions below minVersion
+func NewClientVersions(minVersion string, logger *logrus.Logger) *ClientVersions {
+	return &ClientVersions{
+		minVersion: minVersion,
+		log:        logger,
+		repeat:     NewRepeatLogger(logger),
+		clients:    make(map[string]clientVersion),
+	}
+}
+
+// Observe records the version reported from addr. A client that reports no
+// version predates versioned pings and counts as older than any release.
+func (v *ClientVersions) Observe(addr net.Addr, version string) {
+	if version == "" {
+		version = versionUnknown
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	v.mu.Lock()
+	prev, known := v.clients[ip]
+	if !known && len(v.clients) >= maxTrackedClients {
+		v.mu.Unlock()
+		return
+	}
+	cur := clientVersion{last: version, newest: version}
+	if known && compareReported(version, prev.newest) <= 0 {
+		cur.newest = prev.newest
+	}
+	v.clients[ip] = cur
+	v.mu.Unlock()
+
+	if prev.last == version {
+		return
+	}
+	switch {
+	case !known:
+		v.log.Debugf("[VERSION] Client %s runs %s", ip, version)
+	case cur.newest != prev.newest:
+		v.log.Infof("[VERSION] Client %s upgraded from %s to %s", ip, prev.newest, version)
+	default:
+		// An older or equal release after a newer one is a rollback, or
+		// another client behind the same address
+		v.log.Debugf("[VERSION] Client %s reports %s after %s", ip, version, prev.last)
+	}
+	if v.minVersion != "" && compareReported(version, v.minVersion) < 0 {
+		v.repeat.Warnf("[VERSION] Client %s runs %s, older than --min-client-version %s; upgrade it", ip, version, v.minVersion)
+	}
+}
+
+// Summary lists how many clients run each version, most common first
+func (v *ClientVersions) Summary() string {
+	v.mu.Lock()
+	counts := make(map[string]int)
+	for _, c := range v.clients {
+		counts[c.last]++
+	}
+	v.mu.Unlock()
+	if len(counts) == 0 {
+		return ""
+	}
+	versions := make([]string, 0, len(counts))
+	for version := range counts {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if counts[versions[i]] != counts[versions[j]] {
+			return counts[versions[i]] > counts[versions[j]]
+		}
+		return versions[i] < versions[j]
+	})
+	parts := make([]string, len(versions))
+	for i, version := range versions {
+		parts[i] = fmt.Sprintf("%s ×%d", version, counts[version])
+	}
+	return "Client versions: " + strings.Join(parts, ", ")
+}
+
+// versionUnknown stands for the version of clients that predate versioned pings
+const versionUnknown = "unknown"
+
+// compareReported is compareVersions for reported versions, where
+// versionUnknown is older than everything else
+func compareReported(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == versionUnknown:
+		return -1
+	case b == versionUnknown:
+		return 1
+	}
+	return compareVersions(a, b)
+}
+
+// compareVersions orders release versions like v1.4.2 (the "v" and any
+// "-suffix" are optional). Versions that aren't releases, such as devel
+// builds, compare equal to everything, so they are never flagged as old.
+func compareVersions(a, b string) int {
+	pa, oka := parseVersion(a)
+	pb, okb := parseVersion(b)
+	if !oka || !okb {
+		return 0
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func parseVersion(s string) ([3]int, bool) {
+	var parts [3]int
+	s, _, _ = strings.Cut(strings.TrimPrefix(s, "v"), "-")
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
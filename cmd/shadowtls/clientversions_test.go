@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.4.0", "v1.4.0", 0},
+		{"v1.3.9", "v1.4.0", -1},
+		{"v1.10.0", "v1.9.2", 1},
+		{"1.4", "v1.4.0", 0},
+		{"v1.4.0-rc1", "v1.4.0", 0},
+		{"v2.0.0", "v1.99.99", 1},
+		{"devel-0123456789ab", "v1.4.0", 0},
+		{"unknown", "v1.4.0", 0},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestClientVersions(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	v := NewClientVersions("v1.4.0", logger)
+
+	addr := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+	v.Observe(addr("10.0.0.1:4000"), "v1.4.1")
+	v.Observe(addr("10.0.0.2:4000"), "v1.4.1")
+	v.Observe(addr("10.0.0.3:4000"), "v1.3.0")
+	// A second tunnel from the same client doesn't count twice
+	v.Observe(addr("10.0.0.3:4001"), "v1.3.0")
+
+	if got, want := v.Summary(), "Client versions: v1.4.1 ×2, v1.3.0 ×1"; got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+	if n := strings.Count(out.String(), "older than --min-client-version"); n != 1 {
+		t.Errorf("%d old-version warnings, want 1:\n%s", n, out.String())
+	}
+
+	v.Observe(addr("10.0.0.3:4002"), "v1.4.1")
+	if got, want := v.Summary(), "Client versions: v1.4.1 ×3"; got != want {
+		t.Errorf("after upgrade: summary %q, want %q", got, want)
+	}
+	if !strings.Contains(out.String(), "upgraded from v1.3.0 to v1.4.1") {
+		t.Errorf("upgrade not logged:\n%s", out.String())
+	}
+}
+
+func TestClientVersionsUnknownAndShared(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	v := NewClientVersions("v1.4.0", logger)
+	addr := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+
+	// A client from before versioned pings is older than any minimum
+	v.Observe(addr("10.0.0.1:4000"), "")
+	if !strings.Contains(out.String(), "Client 10.0.0.1 runs unknown, older than --min-client-version") {
+		t.Errorf("unknown version not flagged:\n%s", out.String())
+	}
+
+	// Two clients behind one address alternate; only the first move up is an upgrade
+	v.Observe(addr("10.0.0.2:4000"), "v1.4.0")
+	v.Observe(addr("10.0.0.2:4001"), "v1.5.0")
+	v.Observe(addr("10.0.0.2:4002"), "v1.4.0")
+	v.Observe(addr("10.0.0.2:4003"), "v1.5.0")
+	if n := strings.Count(out.String(), "upgraded"); n != 1 {
+		t.Errorf("%d upgrades logged, want 1:\n%s", n, out.String())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultClockSkewMax is the clock offset above which --clock-check warns
+	DefaultClockSkewMax = 30 * time.Second
+	// clockCheckInterval is how often the clock is re-checked after startup
+	clockCheckInterval = time.Hour
+	// ntpTimeout bounds one NTP query
+	ntpTimeout = 5 * time.Second
+	// ntpEpochOffset is the number of seconds from 1900 (NTP era 0) to 1970
+	ntpEpochOffset = 2208988800
+)
+
+var errBadNTPReply = errors.New("malformed NTP reply")
+
+// ClockCheck compares the local clock with an NTP server at startup and every
+// clockCheckInterval, and warns when they drift apart by more than maxSkew.
+// A badly set clock is a common cause of handshakes that fail for no visible
+// reason, and nothing else in the logs points at it.
+type ClockCheck struct {
+	server  string
+	maxSkew time.Duration
+	query   func(ctx context.Context, server string) (time.Duration, error)
+	log     *logrus.Logger
+
+	skewed bool
+}
+
+// NewClockCheck creates a check against server (host or host:port)
+func NewClockCheck(server string, maxSkew time.Duration, logger *logrus.Logger) *ClockCheck {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	return &ClockCheck{
+		server:  server,
+		maxSkew: maxSkew,
+		query:   QueryNTP,
+		log:     logger,
+	}
+}
+
+// Run checks once, then every clockCheckInterval until ctx is cancelled
+func (c *ClockCheck) Run(ctx context.Context) {
+	c.Check(ctx)
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check queries the server once and logs the outcome. Returns the offset to
+// add to the local clock, or an error when the server could not be asked.
+func (c *ClockCheck) Check(ctx context.Context) (time.Duration, error) {
+	offset, err := c.query(ctx, c.server)
+	if err != nil {
+		c.log.Debugf("Clock check against %s failed: %v", c.server, err)
+		return 0, err
+	}
+	skew := offset
+	if skew < 0 {
+		skew = -skew
+	}
+	switch {
+	case skew > c.maxSkew:
+		dir := "behind"
+		if offset < 0 {
+			dir = "ahead of"
+		}
+		c.log.Warnf("[CLOCK] Local clock is %v %s %s; handshakes may fail until it is corrected (e.g. enable NTP)",
+			skew.Round(time.Second), dir, c.server)
+		c.skewed = true
+	case c.skewed:
+		c.log.Infof("[CLOCK] Local clock back within %v of %s", c.maxSkew, c.server)
+		c.skewed = false
+	default:
+		c.log.Debugf("Clock offset to %s: %v", c.server, offset.Round(time.Millisecond))
+	}
+	return offset, nil
+}
+
+// QueryNTP asks an NTP server (host:port) for the time with a single SNTP
+// request and returns the offset to add to the local clock
+func QueryNTP(ctx context.Context, server string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, ntpTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI 0, version 4, mode 3 (client)
+	sent := time.Now()
+	putNTPTime(req[40:], sent)
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, 48)
+	n, err := conn.Read(reply)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 || reply[0]&0x07 != 4 || !bytes.Equal(reply[24:32], req[40:48]) {
+		return 0, errBadNTPReply
+	}
+	if reply[1] == 0 {
+		return 0, fmt.Errorf("NTP server refused: %q", reply[12:16])
+	}
+	serverRecv := ntpTime(reply[32:])
+	serverSend := ntpTime(reply[40:])
+	return (serverRecv.Sub(sent) + serverSend.Sub(received)) / 2, nil
+}
+
+// putNTPTime writes t as a 64-bit NTP timestamp
+func putNTPTime(b []byte, t time.Time) {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	binary.BigEndian.PutUint64(b, secs<<32|frac)
+}
+
+// ntpTime reads a 64-bit NTP timestamp
+func ntpTime(b []byte) time.Time {
+	v := binary.BigEndian.Uint64(b)
+	secs := int64(v>>32) - ntpEpochOffset
+	nanos := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
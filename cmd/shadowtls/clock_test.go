@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeNTP answers SNTP requests with a clock shifted by offset
+func fakeNTP(t *testing.T, offset time.Duration) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 48)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			reply := make([]byte, 48)
+			reply[0] = 0x24 // version 4, mode 4 (server)
+			reply[1] = 2
+			copy(reply[24:32], buf[40:48])
+			now := time.Now().Add(offset)
+			putNTPTime(reply[32:], now)
+			putNTPTime(reply[40:], now)
+			pc.WriteTo(reply, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestQueryNTP(t *testing.T) {
+	for _, offset := range []time.Duration{0, 90 * time.Second, -time.Hour} {
+		got, err := QueryNTP(context.Background(), fakeNTP(t, offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := got - offset; diff > 100*time.Millisecond || diff < -100*time.Millisecond {
+			t.Errorf("offset %v: got %v", offset, got)
+		}
+	}
+}
+
+func TestNTPTimeRoundTrip(t *testing.T) {
+	now := time.Unix(1760000000, 123456789)
+	b := make([]byte, 8)
+	putNTPTime(b, now)
+	if d := ntpTime(b).Sub(now); d > time.Microsecond || d < -time.Microsecond {
+		t.Errorf("round trip off by %v", d)
+	}
+}
+
+func TestClockCheckWarnsAndClears(t *testing.T) {
+	offset := 2 * time.Minute
+	var fail error
+	c := NewClockCheck("ntp.example", DefaultClockSkewMax, ModuleLogger("stats"))
+	if c.server != "ntp.example:123" {
+		t.Errorf("server = %q, want default port", c.server)
+	}
+	c.query = func(ctx context.Context, server string) (time.Duration, error) { return offset, fail }
+
+	c.Check(context.Background())
+	if !c.skewed {
+		t.Error("2m offset should be flagged")
+	}
+	fail = errors.New("timeout")
+	c.Check(context.Background())
+	if !c.skewed {
+		t.Error("a failed query should not clear the warning")
+	}
+	fail, offset = nil, time.Second
+	c.Check(context.Background())
+	if c.skewed {
+		t.Error("1s offset should clear the warning")
+	}
+}
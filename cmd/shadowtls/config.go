@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadConfigFile applies settings from a JSON config file to fs. Keys are flag
+// names without leading dashes (e.g. "pool-size": 20). Flags given explicitly
+// on the command line take precedence over the file.
+func LoadConfigFile(path string, fs *flag.FlagSet) error {
+	return NewConfigLoader(path, fs).Load()
+}
+
+// ConfigLoader applies a config file to a flag set and can re-apply it on
+// reload. Flags set on the command line are recorded once, when the loader is
+// created, and always keep precedence over the file.
+type ConfigLoader struct {
+	path     string
+	fs       *flag.FlagSet
+	explicit map[string]bool
+	fromFile map[string]bool // Keys applied from the file on the last Load
+	profile  *Profile        // Defaults below the file, nil for none
+
+	passphrase func() (string, error) // Unlocks "enc:v1:" values, nil if none may appear
+}
+
+// NewConfigLoader creates a loader for path; fs must already be parsed
+func NewConfigLoader(path string, fs *flag.FlagSet) *ConfigLoader {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return &ConfigLoader{path: path, fs: fs, explicit: explicit}
+}
+
+// SetProfile makes the profile's values the defaults that the file
+// overrides. Must be called before Load.
+func (l *ConfigLoader) SetProfile(p *Profile) {
+	l.profile = p
+}
+
+// SetPath changes the file later Loads read, e.g. to where it is found once
+// the root directory has changed
+func (l *ConfigLoader) SetPath(path string) {
+	l.path = path
+}
+
+// SetPassphrase sets where the passphrase for encrypted values comes from.
+// It is only called when the file contains such a value.
+func (l *ConfigLoader) SetPassphrase(source func() (string, error)) {
+	l.passphrase = source
+}
+
+// Load reads the config file and applies it. Flags not given on the command
+// line are reset to their defaults first, so keys removed from the file take
+// effect on reload. The file is parsed into a scratch flag set before any
+// flag changes, so on an error of any kind the flags are left untouched.
+func (l *ConfigLoader) Load() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read config %s: %v", l.path, err)
+	}
+
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse config %s: %v", l.path, err)
+	}
+
+	if err := l.validate(values); err != nil {
+		return err
+	}
+	if err := l.decrypt(values); err != nil {
+		return err
+	}
+
+	scratch, err := l.scratch()
+	if err != nil {
+		return err
+	}
+	fromFile := make(map[string]bool)
+	for key, raw := range values {
+		if l.explicit[key] {
+			continue
+		}
+		fromFile[key] = true
+		value, err := configValueString(raw)
+		if err != nil {
+			return fmt.Errorf("config %s: key %q: %v", l.path, key, err)
+		}
+		if err := scratch.Set(key, value); err != nil {
+			return fmt.Errorf("config %s: key %q: %v", l.path, key, err)
+		}
+	}
+
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if !l.explicit[f.Name] {
+			f.Value.Set(scratch.Lookup(f.Name).Value.String())
+		}
+	})
+	l.fromFile = fromFile
+	return nil
+}
+
+// scratch returns a copy of the flag set holding the defaults, for the file
+// to be applied to before the real flags change
+func (l *ConfigLoader) scratch() (*flag.FlagSet, error) {
+	scratch := flag.NewFlagSet(l.fs.Name(), flag.ContinueOnError)
+	var err error
+	l.fs.VisitAll(func(f *flag.Flag) {
+		var current any
+		if getter, ok := f.Value.(flag.Getter); ok {
+			current = getter.Get()
+		}
+		switch current.(type) {
+		case bool:
+			scratch.Bool(f.Name, false, f.Usage)
+		case int:
+			scratch.Int(f.Name, 0, f.Usage)
+		case int64:
+			scratch.Int64(f.Name, 0, f.Usage)
+		case uint:
+			scratch.Uint(f.Name, 0, f.Usage)
+		case uint64:
+			scratch.Uint64(f.Name, 0, f.Usage)
+		case float64:
+			scratch.Float64(f.Name, 0, f.Usage)
+		case time.Duration:
+			scratch.Duration(f.Name, 0, f.Usage)
+		default:
+			scratch.String(f.Name, "", f.Usage)
+		}
+		if e := scratch.Set(f.Name, l.defaultValue(f)); e != nil && err == nil {
+			err = fmt.Errorf("config %s: default for %q: %v", l.path, f.Name, e)
+		}
+	})
+	return scratch, err
+}
+
+// decrypt replaces encrypted string values with their plain text in place
+func (l *ConfigLoader) decrypt(values map[string]any) error {
+	for key, raw := range values {
+		s, ok := raw.(string)
+		if !ok || !isEncryptedValue(s) {
+			continue
+		}
+		if l.passphrase == nil {
+			return fmt.Errorf("config %s: key %q: %v", l.path, key, errNoPassphrase)
+		}
+		passphrase, err := l.passphrase()
+		if err != nil {
+			return fmt.Errorf("config %s: key %q: %v", l.path, key, err)
+		}
+		plain, err := DecryptConfigValue(s, passphrase)
+		if err != nil {
+			return fmt.Errorf("config %s: key %q: %v", l.path, key, err)
+		}
+		values[key] = plain
+	}
+	return nil
+}
+
+// defaultValue is the profile's value for f, or the flag default
+func (l *ConfigLoader) defaultValue(f *flag.Flag) string {
+	if l.profile != nil {
+		if v, ok := l.profile.Flags[f.Name]; ok {
+			return v
+		}
+	}
+	return f.DefValue
+}
+
+// validate checks every key against the flag set: unknown keys (with the
+// closest known name as a suggestion) and values of the wrong JSON type are
+// all reported together, so a typo like "pool_sze" cannot be silently ignored
+func (l *ConfigLoader) validate(values map[string]any) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, key := range keys {
+		f := l.fs.Lookup(key)
+		if f == nil {
+			msg := fmt.Sprintf("unknown key %q", key)
+			if suggestion := l.suggest(key); suggestion != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+			}
+			problems = append(problems, msg)
+			continue
+		}
+		if want := configKind(f); !configKindMatches(want, values[key]) {
+			problems = append(problems, fmt.Sprintf("key %q: expected %s, got %s", key, want, jsonKind(values[key])))
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("config %s: %s", l.path, problems[0])
+	default:
+		return fmt.Errorf("config %s:\n  %s", l.path, strings.Join(problems, "\n  "))
+	}
+}
+
+// suggest returns the flag name closest to key, or "" if nothing is close.
+// Underscores are treated as dashes, the most common spelling slip.
+func (l *ConfigLoader) suggest(key string) string {
+	normalized := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+	best, bestDist := "", -1
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(normalized, f.Name); bestDist < 0 || d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+	if bestDist < 0 || bestDist > max(2, len(normalized)/3) {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// configKind names the JSON type a flag accepts: "boolean", "number" or
+// "string" (durations are strings like "30s"; string flags also take arrays)
+func configKind(f *flag.Flag) string {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "string"
+	}
+	switch getter.Get().(type) {
+	case bool:
+		return "boolean"
+	case time.Duration:
+		return "duration string"
+	case int, int64, uint, uint64, float64:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// ConfigKinds lists every config key of fs with the JSON type it takes, one
+// "key kind" line each, for tools that write config files such as the
+// OpenWrt init script
+func ConfigKinds(fs *flag.FlagSet) string {
+	var b strings.Builder
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&b, "%s %s\n", f.Name, configKind(f))
+	})
+	return b.String()
+}
+
+// configKindMatches reports whether a decoded JSON value fits the kind
+func configKindMatches(kind string, raw any) bool {
+	switch raw.(type) {
+	case bool:
+		return kind == "boolean"
+	case float64:
+		return kind == "number"
+	case string:
+		return kind == "string" || kind == "duration string"
+	case []any:
+		return kind == "string"
+	default:
+		return false
+	}
+}
+
+// jsonKind names the JSON type of a decoded value for error messages
+func jsonKind(raw any) string {
+	switch raw.(type) {
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case nil:
+		return "null"
+	default:
+		return "object"
+	}
+}
+
+// secretFlags are the flags whose values Effective redacts. A new flag that
+// holds a secret must be added here; flags like password-source only name
+// where a secret is kept and are shown.
+var secretFlags = map[string]bool{
+	"password":          true,
+	"upstream-password": true,
+	"admin-token":       true,
+}
+
+// Effective returns the merged configuration, one "name = value (source)"
+// line per flag, where source is cli, file, profile or default. The values
+// of secretFlags are redacted.
+func (l *ConfigLoader) Effective() string {
+	var b strings.Builder
+	l.fs.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		switch {
+		case l.explicit[f.Name]:
+			source = "cli"
+		case l.fromFile[f.Name]:
+			source = "file"
+		case l.profile != nil && l.profile.Flags[f.Name] != "":
+			source = "profile"
+		}
+		value := f.Value.String()
+		if value != "" && secretFlags[f.Name] {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(&b, "  %s = %s (%s)\n", f.Name, value, source)
+	})
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// configValueString converts a JSON value to the string form flag.Set expects.
+// Arrays are joined with commas for list-valued flags.
+func configValueString(raw any) (string, error) {
+	switch v := raw.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", raw)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	poolSize := fs.Int("pool-size", 10, "")
+	ttl := fs.Duration("ttl", 10*time.Second, "")
+	socks5 := fs.Bool("socks5", false, "")
+	server := fs.String("server", "", "")
+	if err := fs.Parse([]string{"--server", "cli.example.com:443"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfig(t, `{"pool-size": 20, "ttl": "30s", "socks5": true, "server": "file.example.com:443"}`)
+	if err := LoadConfigFile(path, fs); err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+
+	if *poolSize != 20 {
+		t.Errorf("pool-size = %d, want 20", *poolSize)
+	}
+	if *ttl != 30*time.Second {
+		t.Errorf("ttl = %v, want 30s", *ttl)
+	}
+	if !*socks5 {
+		t.Error("socks5 should be enabled from config")
+	}
+	if *server != "cli.example.com:443" {
+		t.Errorf("command line should take precedence, got server=%s", *server)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown key": `{"pool-sze": 20}`,
+		"bad value":   `{"pool-size": "many"}`,
+		"bad json":    `{"pool-size": `,
+		"nested":      `{"pool-size": {"n": 1}}`,
+	}
+	for name, content := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Int("pool-size", 10, "")
+		if err := LoadConfigFile(writeConfig(t, content), fs); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestConfigValueStringList(t *testing.T) {
+	got, err := configValueString([]any{"a:443", "b:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a:443,b:443" {
+		t.Errorf("got %q, want %q", got, "a:443,b:443")
+	}
+}
+
+func TestConfigLoaderReload(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	poolSize := fs.Int("pool-size", 10, "")
+	server := fs.String("server", "", "")
+	password := fs.String("password", "", "")
+	ttl := fs.Duration("ttl", time.Minute, "")
+	if err := fs.Parse([]string{"--server", "cli.example.com:443"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfig(t, `{"pool-size": 20, "password": "old", "server": "file.example.com:443"}`)
+	loader := NewConfigLoader(path, fs)
+	if err := loader.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if *poolSize != 20 || *password != "old" {
+		t.Fatalf("first load: pool-size=%d password=%s", *poolSize, *password)
+	}
+
+	// Removed keys revert to defaults; the command line still wins
+	if err := os.WriteFile(path, []byte(`{"password": "new", "server": "file.example.com:443"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if *password != "new" {
+		t.Errorf("password = %s, want new", *password)
+	}
+	if *poolSize != 10 {
+		t.Errorf("pool-size = %d, want default 10 after key removal", *poolSize)
+	}
+	if *server != "cli.example.com:443" {
+		t.Errorf("command line should take precedence on reload, got server=%s", *server)
+	}
+
+	// A broken file leaves the current values alone
+	if err := os.WriteFile(path, []byte(`{"password": `), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(); err == nil {
+		t.Error("expected parse error")
+	}
+	if *password != "new" {
+		t.Errorf("password = %s after failed reload, want new", *password)
+	}
+
+	// So does a file whose values only fail once they are set
+	if err := os.WriteFile(path, []byte(`{"password": "newer", "pool-size": 30, "ttl": "soon"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(); err == nil {
+		t.Error("expected an error for the bad duration")
+	}
+	if *password != "new" || *poolSize != 10 || *ttl != time.Minute {
+		t.Errorf("after failed reload: password=%s pool-size=%d ttl=%v, want new, 10, 1m", *password, *poolSize, *ttl)
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	newFlags := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Int("pool-size", 10, "")
+		fs.Duration("ttl", 10*time.Second, "")
+		fs.Bool("socks5", false, "")
+		fs.String("server", "", "")
+		return fs
+	}
+
+	tests := []struct {
+		content string
+		want    []string // Substrings the error must contain
+	}{
+		{`{"pool_sze": 50}`, []string{`unknown key "pool_sze"`, `did you mean "pool-size"?`}},
+		{`{"pool_size": 50}`, []string{`did you mean "pool-size"?`}},
+		{`{"compression": true}`, []string{`unknown key "compression"`}},
+		{`{"socks5": "yes"}`, []string{`key "socks5": expected boolean, got string`}},
+		{`{"ttl": 30}`, []string{`key "ttl": expected duration string, got number`}},
+		{`{"pool-size": "20"}`, []string{`key "pool-size": expected number, got string`}},
+		{`{"servr": "a:443", "socks5": 1}`, []string{`unknown key "servr"`, `did you mean "server"?`, `key "socks5"`}},
+	}
+	for _, tt := range tests {
+		fs := newFlags()
+		err := LoadConfigFile(writeConfig(t, tt.content), fs)
+		if err == nil {
+			t.Errorf("%s: expected error", tt.content)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q should contain %q", tt.content, err, want)
+			}
+		}
+	}
+
+	// Nothing close enough: no suggestion
+	err := LoadConfigFile(writeConfig(t, `{"compression": true}`), newFlags())
+	if err != nil && strings.Contains(err.Error(), "did you mean") {
+		t.Errorf("unexpected suggestion: %v", err)
+	}
+}
+
+// Config writers learn each key's JSON type from the binary itself
+func TestConfigKinds(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("pool-size", 10, "")
+	fs.Float64("alarm-stale-rate", 0.2, "")
+	fs.Duration("ttl", 10*time.Second, "")
+	fs.Bool("socks5", false, "")
+	fs.String("server", "", "")
+	want := "alarm-stale-rate number\npool-size number\nserver string\nsocks5 boolean\nttl duration string\n"
+	if got := ConfigKinds(fs); got != want {
+		t.Errorf("ConfigKinds:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestConfigEffective(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("pool-size", 10, "")
+	fs.String("password", "", "")
+	fs.String("password-source", "", "")
+	fs.String("admin-token", "", "")
+	fs.String("server", "", "")
+	fs.Bool("socks5", false, "")
+	if err := fs.Parse([]string{"--server", "cli.example.com:443", "--admin-token", "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	loader := NewConfigLoader(writeConfig(t, `{"pool-size": 20, "password": "secret", "password-source": "keychain:shadowtls"}`), fs)
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	got := loader.Effective()
+	for _, want := range []string{
+		"pool-size = 20 (file)",
+		"password = <redacted> (file)",
+		"admin-token = <redacted> (cli)",
+		"password-source = keychain:shadowtls (file)",
+		"server = cli.example.com:443 (cli)",
+		"socks5 = false (default)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("effective config missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "secret") || strings.Contains(got, "hunter2") {
+		t.Errorf("secret leaked into effective config:\n%s", got)
+	}
+}
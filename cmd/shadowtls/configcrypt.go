@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// encryptedPrefix marks a config value sealed with a passphrase
+	encryptedPrefix = "enc:v1:"
+	// ConfigPassphraseEnv holds the passphrase for encrypted config values
+	ConfigPassphraseEnv = "SHADOWTLS_CONFIG_PASSPHRASE"
+
+	configSaltLen = 16
+	// scrypt cost: about 50ms per derivation, paid once per distinct salt
+	configScryptN = 1 << 15
+)
+
+var errNoPassphrase = errors.New("config has encrypted values but no passphrase: set " + ConfigPassphraseEnv + ", use --config-passphrase-file, or run on a terminal to be prompted")
+
+// isEncryptedValue reports whether a config string was written by encrypt-secret
+func isEncryptedValue(s string) bool {
+	return strings.HasPrefix(s, encryptedPrefix)
+}
+
+// configKey derives the AES-256 key for one sealed value
+func configKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, configScryptN, 8, 1, 32)
+}
+
+// EncryptConfigValue seals secret with passphrase into an "enc:v1:" string
+// that may stand in for the plain value in a config file
+func EncryptConfigValue(secret, passphrase string) (string, error) {
+	salt := make([]byte, configSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	gcm, err := configCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := append(append(salt, nonce...), gcm.Seal(nil, nonce, []byte(secret), nil)...)
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptConfigValue opens a value made by EncryptConfigValue. A wrong
+// passphrase and a damaged value give the same error.
+func DecryptConfigValue(value, passphrase string) (string, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(raw) < configSaltLen {
+		return "", errors.New("malformed encrypted value")
+	}
+	salt, rest := raw[:configSaltLen], raw[configSaltLen:]
+	gcm, err := configCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("wrong passphrase or damaged value")
+	}
+	return string(plain), nil
+}
+
+func configCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := configKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PassphraseSource returns a function that finds the config passphrase the
+// first time it is needed and remembers it, so a SIGHUP reload of a daemon
+// doesn't prompt again. It tries file (if set), then ConfigPassphraseEnv,
+// then the terminal.
+func PassphraseSource(file string) func() (string, error) {
+	var cached string
+	return func() (string, error) {
+		if cached != "" {
+			return cached, nil
+		}
+		p, err := findPassphrase(file, "Config passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		cached = p
+		return p, nil
+	}
+}
+
+func findPassphrase(file, prompt string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("read passphrase file: %v", err)
+		}
+		if p := strings.TrimRight(string(data), "\r\n"); p != "" {
+			return p, nil
+		}
+		return "", fmt.Errorf("passphrase file %s is empty", file)
+	}
+	if p := os.Getenv(ConfigPassphraseEnv); p != "" {
+		return p, nil
+	}
+	p, err := readHidden(prompt)
+	if errors.Is(err, errNoTerminal) {
+		return "", errNoPassphrase
+	}
+	return p, err
+}
+
+// runEncryptSecret implements `shadowtls encrypt-secret`: read a secret and
+// print it sealed for use as a config value
+func runEncryptSecret(args []string) int {
+	fs := flag.NewFlagSet("encrypt-secret", flag.ContinueOnError)
+	passFile := fs.String("passphrase-file", "", "Read the passphrase from this file instead of "+ConfigPassphraseEnv+" or a prompt")
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s encrypt-secret [--passphrase-file file] < secret\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Prints the secret sealed with the passphrase, for use as a config value, e.g.:")
+		fmt.Fprintln(os.Stderr, "  \"password\": \"enc:v1:...\"")
+		fmt.Fprintln(os.Stderr, "On a terminal both are prompted for; otherwise the secret is the first line of stdin.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	secret, err := readHidden("Secret to encrypt: ")
+	if errors.Is(err, errNoTerminal) {
+		secret, err = readLine(os.Stdin)
+	}
+	if err == nil && secret == "" {
+		err = errors.New("empty secret")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	passphrase, err := findPassphrase(*passFile, "Passphrase: ")
+	if err == nil && *passFile == "" && os.Getenv(ConfigPassphraseEnv) == "" {
+		var again string
+		if again, err = readHidden("Repeat passphrase: "); err == nil && again != passphrase {
+			err = errors.New("passphrases don't match")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	value, err := EncryptConfigValue(secret, passphrase)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(value)
+	return 0
+}
+
+// readLine reads one line without its line ending
+func readLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConfigValueRoundTrip(t *testing.T) {
+	sealed, err := EncryptConfigValue("hunter2", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedValue(sealed) || strings.Contains(sealed, "hunter2") {
+		t.Fatalf("sealed value %q", sealed)
+	}
+	if got, err := DecryptConfigValue(sealed, "correct horse"); err != nil || got != "hunter2" {
+		t.Errorf("decrypt = %q, %v", got, err)
+	}
+	if _, err := DecryptConfigValue(sealed, "wrong"); err == nil {
+		t.Error("wrong passphrase should fail")
+	}
+	if _, err := DecryptConfigValue(encryptedPrefix+"!!", "correct horse"); err == nil {
+		t.Error("garbage should fail")
+	}
+}
+
+func TestConfigLoaderDecrypts(t *testing.T) {
+	sealed, err := EncryptConfigValue("s3cret", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, fmt.Sprintf(`{"password": %q, "server": "example.com:443"}`, sealed))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	password := fs.String("password", "", "")
+	fs.String("server", "", "")
+	fs.Parse(nil)
+
+	// Without a passphrase source nothing is applied
+	loader := NewConfigLoader(path, fs)
+	if err := loader.Load(); err == nil || *password != "" {
+		t.Fatalf("load without passphrase: err %v, password %q", err, *password)
+	}
+
+	asked := 0
+	loader.SetPassphrase(func() (string, error) {
+		asked++
+		return "pass", nil
+	})
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if *password != "s3cret" {
+		t.Errorf("password = %q, want s3cret", *password)
+	}
+	if asked != 1 {
+		t.Errorf("passphrase asked %d times, want 1", asked)
+	}
+
+	loader.SetPassphrase(func() (string, error) { return "", errors.New("no tty") })
+	if err := loader.Load(); err == nil || !strings.Contains(err.Error(), "no tty") {
+		t.Errorf("err = %v, want the source's error", err)
+	}
+}
+
+func TestPassphraseSourceCaches(t *testing.T) {
+	t.Setenv(ConfigPassphraseEnv, "from-env")
+	source := PassphraseSource("")
+	if p, err := source(); err != nil || p != "from-env" {
+		t.Fatalf("source = %q, %v", p, err)
+	}
+	t.Setenv(ConfigPassphraseEnv, "changed")
+	if p, _ := source(); p != "from-env" {
+		t.Errorf("second call = %q, want the cached passphrase", p)
+	}
+}
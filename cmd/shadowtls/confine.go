@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Confinement is applied once the server's listener is bound: it can lock the
+// process into an empty root directory, drop root for an unprivileged user
+// and, on Linux, sandbox the process, so a bug in the handshake or SOCKS5
+// parsers can't reach the rest of the host
+type Confinement struct {
+	// Change the root directory to Chroot first, empty to keep /. Paths
+	// below are then looked up inside it.
+	Chroot string
+	User   string // Switch to this user (name or uid), empty to stay
+	Group  string // ...and group; defaults to User's primary group
+	// Restrict the filesystem to ReadPaths/WritePaths with Landlock and deny
+	// exec, ptrace, mount and kernel-module syscalls with seccomp
+	Sandbox    bool
+	ReadPaths  []string // Files or directories left readable (config, /etc for DNS)
+	WritePaths []string // Files left writable (log file)
+
+	wd atomic.Pointer[string] // Working directory before the root changed
+}
+
+// Enabled reports whether there is anything to apply
+func (c *Confinement) Enabled() bool {
+	return c != nil && (c.Chroot != "" || c.User != "" || c.Group != "" || c.Sandbox)
+}
+
+// Apply changes root, drops privileges, then enters the sandbox. Any failure
+// is returned so the caller can refuse to serve rather than run less confined
+// than asked.
+func (c *Confinement) Apply(log *logrus.Logger) error {
+	if !c.Enabled() {
+		return nil
+	}
+	// Names are resolved while /etc/passwd is still reachable
+	uid, gid := -1, -1
+	if c.User != "" || c.Group != "" {
+		var err error
+		if uid, gid, err = lookupIDs(c.User, c.Group); err != nil {
+			return err
+		}
+	}
+	if c.Chroot != "" {
+		if _, err := os.Stat(filepath.Join(c.Chroot, "etc", "resolv.conf")); err != nil {
+			log.Warnf("No etc/resolv.conf in %s: hostnames will be resolved through 127.0.0.1:53", c.Chroot)
+		}
+		if wd, err := os.Getwd(); err == nil {
+			c.wd.Store(&wd)
+		}
+		if err := changeRoot(c.Chroot); err != nil {
+			return fmt.Errorf("chroot %s: %v", c.Chroot, err)
+		}
+		log.Infof("Changed root to %s", c.Chroot)
+	}
+	if c.User != "" || c.Group != "" {
+		if err := dropPrivileges(uid, gid); err != nil {
+			return fmt.Errorf("drop privileges to %d:%d: %v", uid, gid, err)
+		}
+		log.Infof("Dropped privileges to uid %d, gid %d", uid, gid)
+	}
+	if c.Sandbox {
+		if err := enterSandbox(c.ReadPaths, c.WritePaths); err != nil {
+			return fmt.Errorf("sandbox: %v", err)
+		}
+		log.Infof("Sandbox: filesystem limited to %d read and %d write paths, exec and ptrace denied", len(c.ReadPaths), len(c.WritePaths))
+	}
+	return nil
+}
+
+// Path returns where path, named as on the command line, is found once Apply
+// has changed the root to Chroot. Files outside Chroot can't be opened from
+// there, so naming one is an error.
+func (c *Confinement) Path(path string) (string, error) {
+	if c == nil || c.Chroot == "" {
+		return path, nil
+	}
+	var wd string
+	if p := c.wd.Load(); p != nil {
+		wd = *p
+	} else if wd, _ = os.Getwd(); wd == "" {
+		wd = "/"
+	}
+	root := c.Chroot
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(wd, root)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(wd, path)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside --chroot %s", path, c.Chroot)
+	}
+	return filepath.Join("/", rel), nil
+}
+
+// lookupIDs resolves user and group names (or numeric ids). With only a user,
+// the group is the user's primary group; with only a group, the uid is kept.
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("unknown user %q", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
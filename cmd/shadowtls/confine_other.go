@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func dropPrivileges(uid, gid int) error {
+	return errors.New("--user/--group are not supported on this platform")
+}
+
+func changeRoot(dir string) error {
+	return errors.New("--chroot is not supported on this platform")
+}
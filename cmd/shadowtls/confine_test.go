@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLookupIDs(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(me.Uid)
+	gid, _ := strconv.Atoi(me.Gid)
+
+	for _, name := range []string{me.Username, me.Uid} {
+		gotUID, gotGID, err := lookupIDs(name, "")
+		if err != nil || gotUID != uid || gotGID != gid {
+			t.Errorf("lookupIDs(%q) = %d, %d, %v; want %d, %d", name, gotUID, gotGID, err, uid, gid)
+		}
+	}
+	if gotUID, gotGID, err := lookupIDs("", me.Gid); err != nil || gotUID != -1 || gotGID != gid {
+		t.Errorf("group only = %d, %d, %v; want -1, %d", gotUID, gotGID, err, gid)
+	}
+	if _, _, err := lookupIDs("no-such-user-shadowtun", ""); err == nil {
+		t.Error("unknown user should fail")
+	}
+}
+
+func TestConfinementDisabled(t *testing.T) {
+	var c *Confinement
+	if c.Enabled() || c.Apply(nil) != nil {
+		t.Error("nil confinement should be a no-op")
+	}
+	if (&Confinement{}).Enabled() {
+		t.Error("empty confinement should be disabled")
+	}
+}
+
+func TestConfinementChrootNeedsDirectory(t *testing.T) {
+	c := &Confinement{Chroot: filepath.Join(t.TempDir(), "missing")}
+	if err := c.Apply(ModuleLogger("server")); err == nil {
+		t.Error("chroot to a missing directory should fail")
+	}
+}
+
+func TestConfinementPath(t *testing.T) {
+	if got, err := (&Confinement{}).Path("/etc/shadowtls.json"); err != nil || got != "/etc/shadowtls.json" {
+		t.Errorf("without chroot = %q, %v; want the path unchanged", got, err)
+	}
+	c := &Confinement{Chroot: "/srv/shadowtun"}
+	for path, want := range map[string]string{
+		"/srv/shadowtun/shadowtls.json":   "/shadowtls.json",
+		"/srv/shadowtun/etc/../users.txt": "/users.txt",
+		"/srv/shadowtun":                  "/",
+	} {
+		if got, err := c.Path(path); err != nil || got != want {
+			t.Errorf("Path(%q) = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	for _, path := range []string{"/etc/shadowtls.json", "/srv/shadowtun-old/x", "/srv/shadowtun/../x"} {
+		if got, err := c.Path(path); err == nil {
+			t.Errorf("Path(%q) = %q, want an error for a path outside the root", path, got)
+		}
+	}
+}
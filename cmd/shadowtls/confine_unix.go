@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// dropPrivileges switches every thread to gid and uid (either may be -1 to
+// keep it) and clears supplementary groups. The group goes first, while the
+// process may still change it.
+func dropPrivileges(uid, gid int) error {
+	if gid >= 0 {
+		if err := syscall.Setgroups(nil); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeRoot makes dir the root directory of the whole process and moves
+// into it, so no path outside dir can be opened, even through "..".
+func changeRoot(dir string) error {
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+	return syscall.Chdir("/")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// congestionSupported reports whether --congestion-control works here
+const congestionSupported = true
+
+// setCongestion selects the TCP congestion control algorithm for conn; other
+// connection types are left alone
+func setCongestion(conn net.Conn, algo string) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok || algo == "" {
+		return nil
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, algo)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// checkCongestion tries algo on a scratch socket, so a missing module or an
+// algorithm this user may not select fails at startup, not on every tunnel
+func checkCongestion(algo string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, algo); err != nil {
+		return fmt.Errorf("--congestion-control %s: %v (load it with modprobe tcp_%s; unprivileged processes also need it in net.ipv4.tcp_allowed_congestion_control)", algo, err, algo)
+	}
+	return nil
+}
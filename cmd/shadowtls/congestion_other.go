@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// congestionSupported reports whether --congestion-control works here
+const congestionSupported = false
+
+// setCongestion is a no-op: TCP_CONGESTION is Linux-only
+func setCongestion(conn net.Conn, algo string) error {
+	return nil
+}
+
+// checkCongestion rejects any algorithm off Linux
+func checkCongestion(algo string) error {
+	return fmt.Errorf("--congestion-control is only supported on Linux")
+}
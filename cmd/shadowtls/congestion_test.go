@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestCongestionControl(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if checkCongestion("bbr") == nil {
+			t.Error("checkCongestion should fail off Linux")
+		}
+		return
+	}
+	// reno is built into every Linux kernel and always allowed
+	if err := checkCongestion("reno"); err != nil {
+		t.Fatalf("checkCongestion(reno) = %v", err)
+	}
+	if checkCongestion("no-such-algorithm") == nil {
+		t.Error("checkCongestion should reject an unknown algorithm")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := setCongestion(conn, "reno"); err != nil {
+		t.Errorf("setCongestion(reno) = %v", err)
+	}
+}
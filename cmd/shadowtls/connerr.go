@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+)
+
+// ConnectFailure is the layer a tunnel dial failed at
+type ConnectFailure int
+
+const (
+	FailOther     ConnectFailure = iota // Anything not classified below
+	FailDNS                             // Server name did not resolve
+	FailRefused                         // TCP connection actively refused
+	FailTimeout                         // TCP connect did not complete in time
+	FailHandshake                       // TLS handshake reset, closed or stalled
+	FailAuth                            // Handshake completed but the server did not authenticate
+	FailIntercept                       // The handshake certificate failed --verify-handshake-cert or --pin-sha256
+	numConnectFailures
+)
+
+// String returns the short name used in stats and metrics
+func (f ConnectFailure) String() string {
+	switch f {
+	case FailDNS:
+		return "dns"
+	case FailRefused:
+		return "refused"
+	case FailTimeout:
+		return "timeout"
+	case FailHandshake:
+		return "handshake"
+	case FailAuth:
+		return "auth"
+	case FailIntercept:
+		return "intercept"
+	}
+	return "other"
+}
+
+// Describe returns a log prefix saying which layer is broken and what to check
+func (f ConnectFailure) Describe() string {
+	switch f {
+	case FailDNS:
+		return "DNS lookup failed, check the server name and resolver"
+	case FailRefused:
+		return "TCP connection refused, nothing is listening on the server port"
+	case FailTimeout:
+		return "TCP connect timed out, the server is unreachable or the port is filtered"
+	case FailHandshake:
+		return "TLS handshake reset, a middlebox may be interfering or the port is not ShadowTLS"
+	case FailAuth:
+		return "authentication failed, check the password and that the server runs ShadowTLS v3"
+	case FailIntercept:
+		return "TLS handshake intercepted, something on the path presented its own certificate for the decoy site"
+	}
+	return "connect failed"
+}
+
+// ClassifyConnectError maps a tunnel dial error to the layer it failed at.
+// Errors from the TCP dial itself come wrapped in a *net.OpError with Op
+// "dial"; everything that fails after that happened during the handshake.
+func ClassifyConnectError(err error) ConnectFailure {
+	if err == nil {
+		return FailOther
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailDNS
+	}
+	var certErr *stls.CertError
+	if errors.As(err, &certErr) {
+		return FailIntercept
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "traffic hijacked") || strings.Contains(msg, "TLS1.3 is not supported") {
+		return FailAuth
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return FailRefused
+		case opErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+			return FailTimeout
+		}
+		return FailOther
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded),
+		strings.Contains(msg, "tls: "):
+		return FailHandshake
+	}
+	return FailOther
+}
+
+// ConnectFailures counts tunnel dial failures per layer
+type ConnectFailures struct {
+	DNS       uint64
+	Refused   uint64
+	Timeout   uint64
+	Handshake uint64
+	Auth      uint64
+	Intercept uint64
+	Other     uint64
+}
+
+// String formats the non-zero counts, e.g. "dns=2 auth=1", or "none"
+func (f ConnectFailures) String() string {
+	var parts []string
+	for _, c := range []struct {
+		kind  ConnectFailure
+		count uint64
+	}{
+		{FailDNS, f.DNS}, {FailRefused, f.Refused}, {FailTimeout, f.Timeout},
+		{FailHandshake, f.Handshake}, {FailAuth, f.Auth}, {FailIntercept, f.Intercept}, {FailOther, f.Other},
+	} {
+		if c.count > 0 {
+			parts = append(parts, c.kind.String()+"="+strconv.FormatUint(c.count, 10))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
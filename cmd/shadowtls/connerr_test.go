@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+)
+
+func TestClassifyConnectError(t *testing.T) {
+	dial := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want ConnectFailure
+	}{
+		{"dns", dial(&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}), FailDNS},
+		{"refused", dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)), FailRefused},
+		{"dial timeout", dial(os.ErrDeadlineExceeded), FailTimeout},
+		{"dial ctx deadline", dial(context.DeadlineExceeded), FailTimeout},
+		{"unreachable", dial(os.NewSyscallError("connect", syscall.ENETUNREACH)), FailOther},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, FailHandshake},
+		{"eof", io.EOF, FailHandshake},
+		{"wrapped eof", fmt.Errorf("handshake: %w", io.ErrUnexpectedEOF), FailHandshake},
+		{"alert", errors.New("remote error: tls: handshake failure"), FailHandshake},
+		{"stalled", context.DeadlineExceeded, FailHandshake},
+		{"hijacked", errors.New("traffic hijacked"), FailAuth},
+		{"tls12", errors.New("TLS1.3 is not supported"), FailAuth},
+		{"intercepted", fmt.Errorf("dial: %w", &stls.CertError{SNI: "example.com", Reason: "matches no pin"}), FailIntercept},
+		{"unknown", errors.New("something else"), FailOther},
+	}
+	for _, tt := range tests {
+		if got := ClassifyConnectError(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyConnectErrorRefusedDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Skip("port unexpectedly accepted a connection")
+	}
+	if got := ClassifyConnectError(err); got != FailRefused {
+		t.Errorf("got %v for %v, want refused", got, err)
+	}
+}
+
+func TestConnectFailuresString(t *testing.T) {
+	if s := (ConnectFailures{}).String(); s != "none" {
+		t.Errorf("empty: got %q", s)
+	}
+	s := ConnectFailures{DNS: 2, Auth: 1}.String()
+	if s != "dns=2 auth=1" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestPoolCountsFailureLayer(t *testing.T) {
+	stats := NewStats()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	pool := NewConnPool(1, time.Minute, 10*time.Millisecond, func(ctx context.Context) (net.Conn, error) {
+		return nil, refused
+	}, nil, stats)
+
+	_, err := pool.Get(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("Get error should name the layer, got %v", err)
+	}
+
+	pool.Start()
+	defer pool.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for stats.ConnectFailed[FailRefused].Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker failure was not counted as refused")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	snap := stats.Snapshot(pool.Stats())
+	if snap.Failures.Refused == 0 || snap.Failures.Other != 0 {
+		t.Errorf("Failures = %+v, PoolFailed = %d", snap.Failures, snap.PoolFailed)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Close reasons recorded in the connection log
+const (
+	CloseAppClosed    = "app_closed"    // The app closed its side
+	CloseServerClosed = "server_closed" // The tunnel closed from the server side
+	CloseAppError     = "app_error"
+	CloseServerError  = "server_error"
+	CloseIdle         = "idle_timeout"
+	CloseCancelled    = "cancelled" // Shutdown, reload or maintenance closed it
+	CloseShed         = "shed"      // Rejected over --mem-limit
+	CloseLoop         = "loop"      // Refused as this client's own dial
+	CloseNoData       = "no_data"   // The app sent nothing within --first-packet-timeout
+	CloseNoTunnel     = "no_tunnel" // No working tunnel to the server
+	CloseSniffed      = "sniffed"   // Refused by --sniff-guard before taking a tunnel
+	CloseWriteFailed  = "app_gone"  // The app left before the server's first response reached it
+	CloseUnknown      = "unknown"
+)
+
+// DefaultConnLogKeep is the default for --conn-log-keep
+const DefaultConnLogKeep = 5
+
+// ConnLogConfig configures the per-connection log
+type ConnLogConfig struct {
+	Path    string // .csv for CSV, anything else for JSON lines
+	MaxSize int64  // Rotate once the file reaches this size, 0 = never
+	Keep    int    // Rotated files kept as Path.1 ... Path.Keep
+}
+
+// ConnRecord is one closed connection
+type ConnRecord struct {
+	ID       uint64    `json:"id"`
+	Remote   string    `json:"remote"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_ms"`
+	BytesOut uint64    `json:"bytes_out"` // App → server
+	BytesIn  uint64    `json:"bytes_in"`  // Server → app
+	Source   string    `json:"source"`    // "pool", "dial", or empty without a tunnel
+	PoolAge  float64   `json:"pool_age_ms"`
+	Connect  float64   `json:"connect_ms"`
+	Verify   float64   `json:"verify_ms"`
+	Reason   string    `json:"reason"`
+}
+
+var connRecordColumns = []string{"id", "remote", "start", "end", "duration_ms", "bytes_out", "bytes_in", "source", "pool_age_ms", "connect_ms", "verify_ms", "reason"}
+
+func (r *ConnRecord) csvRow() []string {
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	return []string{
+		strconv.FormatUint(r.ID, 10), r.Remote,
+		r.Start.Format(time.RFC3339Nano), r.End.Format(time.RFC3339Nano), ms(r.Duration),
+		strconv.FormatUint(r.BytesOut, 10), strconv.FormatUint(r.BytesIn, 10),
+		r.Source, ms(r.PoolAge), ms(r.Connect), ms(r.Verify), r.Reason,
+	}
+}
+
+// newConnRecord builds the record of a connection closing now; info and
+// tunnel are nil if the connection never got that far
+func newConnRecord(remote net.Addr, start time.Time, info *ConnInfo, tunnel *PooledConn, reason string) *ConnRecord {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	end := time.Now()
+	rec := &ConnRecord{
+		Remote:   remote.String(),
+		Start:    start,
+		End:      end,
+		Duration: ms(end.Sub(start)),
+		Reason:   reason,
+	}
+	if info != nil {
+		rec.ID = info.ID
+		rec.BytesOut = info.BytesOut.Load()
+		rec.BytesIn = info.BytesIn.Load()
+	}
+	if tunnel != nil {
+		rec.Source = "dial"
+		if tunnel.FromPool {
+			rec.Source = "pool"
+		}
+		rec.PoolAge = ms(tunnel.PoolAge)
+		rec.Connect = ms(tunnel.ConnectTime)
+		rec.Verify = ms(tunnel.VerifyRTT)
+	}
+	if rec.Reason == "" {
+		rec.Reason = CloseUnknown
+	}
+	return rec
+}
+
+// relayCloseReason says why a relay direction reading from the app (or
+// from the server) ended
+func relayCloseReason(fromApp bool, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CloseIdle
+	case fromApp && (err == nil || errors.Is(err, io.EOF)):
+		return CloseAppClosed
+	case fromApp:
+		return CloseAppError
+	case err == nil || errors.Is(err, io.EOF):
+		return CloseServerClosed
+	default:
+		return CloseServerError
+	}
+}
+
+// ConnLog writes one record per closed connection to a rotating file, for
+// offline analysis separate from the human log stream. A nil ConnLog
+// discards records.
+type ConnLog struct {
+	config ConnLogConfig
+	csv    bool
+	repeat *RepeatLogger
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewConnLog opens (appending to) the log at config.Path
+func NewConnLog(config ConnLogConfig, logger *logrus.Logger) (*ConnLog, error) {
+	l := &ConnLog{
+		config: config,
+		csv:    strings.EqualFold(filepath.Ext(config.Path), ".csv"),
+		repeat: NewRepeatLogger(logger),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ConnLog) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("open connection log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open connection log: %v", err)
+	}
+	l.file, l.size = f, info.Size()
+	if l.csv && l.size == 0 {
+		return l.write(encodeCSV(connRecordColumns))
+	}
+	return nil
+}
+
+// Log appends rec, rotating the file first if it is full
+func (l *ConnLog) Log(rec *ConnRecord) {
+	if l == nil {
+		return
+	}
+	var line []byte
+	if l.csv {
+		line = encodeCSV(rec.csvRow())
+	} else {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return
+		}
+		line = append(data, '\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.config.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.config.MaxSize {
+		if err := l.rotate(); err != nil {
+			l.repeat.Warnf("Connection log: %v", err)
+			if l.file == nil {
+				return
+			}
+		}
+	}
+	if err := l.write(line); err != nil {
+		l.repeat.Warnf("Connection log: %v", err)
+	}
+}
+
+func (l *ConnLog) write(data []byte) error {
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts Path.1 ... Path.Keep-1 up by one, moves Path to Path.1 and
+// starts a new file; with Keep 0 the full file is simply removed
+func (l *ConnLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	path := l.config.Path
+	if l.config.Keep <= 0 {
+		os.Remove(path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", path, l.config.Keep))
+		for i := l.config.Keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			// Keep appending to the full file rather than lose records
+			if oerr := l.open(); oerr != nil {
+				return oerr
+			}
+			return fmt.Errorf("rotate: %v", err)
+		}
+	}
+	return l.open()
+}
+
+// Close closes the file
+func (l *ConnLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func encodeCSV(row []string) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(row)
+	w.Flush()
+	return buf.Bytes()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConnLogJSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conns.jsonl")
+	l, err := NewConnLog(ConnLogConfig{Path: path}, Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := NewConnTable().Add("127.0.0.1:50000")
+	info.BytesOut.Add(100)
+	info.BytesIn.Add(2000)
+	tunnel := &PooledConn{FromPool: true, PoolAge: 3 * time.Second, ConnectTime: 40 * time.Millisecond}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	l.Log(newConnRecord(addr, time.Now().Add(-time.Second), info, tunnel, CloseAppClosed))
+	l.Log(newConnRecord(addr, time.Now(), nil, nil, CloseNoData))
+	l.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []ConnRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec ConnRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("%d records, want 2", len(recs))
+	}
+	r := recs[0]
+	if r.ID != info.ID || r.BytesOut != 100 || r.BytesIn != 2000 || r.Source != "pool" || r.PoolAge != 3000 || r.Reason != CloseAppClosed {
+		t.Errorf("first record = %+v", r)
+	}
+	if r.Duration < 1000 || r.End.Before(r.Start) {
+		t.Errorf("duration %vms from %v to %v", r.Duration, r.Start, r.End)
+	}
+	if r := recs[1]; r.Source != "" || r.Reason != CloseNoData {
+		t.Errorf("record without a tunnel = %+v", r)
+	}
+}
+
+func TestConnLogCSVRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conns.csv")
+	l, err := NewConnLog(ConnLogConfig{Path: path, MaxSize: 300, Keep: 2}, Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	for range 10 {
+		l.Log(newConnRecord(addr, time.Now(), nil, &PooledConn{}, CloseServerClosed))
+	}
+	l.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(rows) < 2 || rows[0][0] != "id" || len(rows[1]) != len(connRecordColumns) {
+			t.Errorf("%s: want a header and records, got %v", name, rows)
+		}
+		if info, _ := os.Stat(name); info.Size() > 300 {
+			t.Errorf("%s: %d bytes, over the 300 byte limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 rotated files: %v", err)
+	}
+}
+
+func TestRelayCloseReason(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		fromApp bool
+		err     error
+		want    string
+	}{
+		{true, io.EOF, CloseAppClosed},
+		{false, io.EOF, CloseServerClosed},
+		{false, nil, CloseServerClosed},
+		{true, timeout, CloseIdle},
+		{true, errors.New("connection reset"), CloseAppError},
+		{false, errors.New("connection reset"), CloseServerError},
+	}
+	for _, tt := range tests {
+		if got := relayCloseReason(tt.fromApp, tt.err); got != tt.want {
+			t.Errorf("relayCloseReason(%v, %v) = %s, want %s", tt.fromApp, tt.err, got, tt.want)
+		}
+	}
+}
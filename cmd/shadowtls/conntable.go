@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rateSampleInterval is how often per-connection throughput is sampled
+	rateSampleInterval = time.Second
+	// rateSmoothing is the EWMA weight given to the newest throughput sample
+	rateSmoothing = 0.3
+)
+
+// ConnTable tracks active connections so individual flows can be inspected live
+type ConnTable struct {
+	mu     sync.Mutex
+	conns  map[uint64]*ConnInfo
+	nextID atomic.Uint64
+}
+
+// ConnInfo holds live measurements for one active connection
+type ConnInfo struct {
+	ID        uint64
+	Remote    string
+	StartedAt time.Time
+
+	BytesOut atomic.Uint64 // local → tunnel
+	BytesIn  atomic.Uint64 // tunnel → local
+
+	// Set once the tunnel is acquired
+	FromPool    bool
+	ConnectTime time.Duration // Tunnel establishment time
+	VerifyRTT   time.Duration // Initial data → first response round trip
+
+	mu         sync.Mutex
+	lastOut    uint64
+	lastIn     uint64
+	lastSample time.Time
+	rateOut    float64 // Smoothed bytes/s local → tunnel
+	rateIn     float64 // Smoothed bytes/s tunnel → local
+}
+
+// ConnSnapshot is a point-in-time view of one active connection
+type ConnSnapshot struct {
+	ID          uint64
+	Remote      string
+	Age         time.Duration
+	BytesOut    uint64
+	BytesIn     uint64
+	RateOut     float64 // bytes/s
+	RateIn      float64 // bytes/s
+	FromPool    bool
+	ConnectTime time.Duration
+	VerifyRTT   time.Duration
+}
+
+// NewConnTable creates an empty connection table
+func NewConnTable() *ConnTable {
+	return &ConnTable{
+		conns: make(map[uint64]*ConnInfo),
+	}
+}
+
+// Add registers a new active connection and returns its entry
+func (t *ConnTable) Add(remote string) *ConnInfo {
+	now := time.Now()
+	info := &ConnInfo{
+		ID:         t.nextID.Add(1),
+		Remote:     remote,
+		StartedAt:  now,
+		lastSample: now,
+	}
+	t.mu.Lock()
+	t.conns[info.ID] = info
+	t.mu.Unlock()
+	return info
+}
+
+// Remove drops a connection from the table
+func (t *ConnTable) Remove(info *ConnInfo) {
+	t.mu.Lock()
+	delete(t.conns, info.ID)
+	t.mu.Unlock()
+}
+
+// SetTunnel records tunnel metadata once a verified tunnel is acquired
+func (info *ConnInfo) SetTunnel(tunnel *PooledConn) {
+	info.mu.Lock()
+	info.FromPool = tunnel.FromPool
+	info.ConnectTime = tunnel.ConnectTime
+	info.VerifyRTT = tunnel.VerifyRTT
+	info.mu.Unlock()
+}
+
+// sample folds the bytes moved since the previous sample into the smoothed rates
+func (info *ConnInfo) sample(now time.Time) {
+	out, in := info.BytesOut.Load(), info.BytesIn.Load()
+
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	elapsed := now.Sub(info.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	instOut := float64(out-info.lastOut) / elapsed
+	instIn := float64(in-info.lastIn) / elapsed
+	info.rateOut += rateSmoothing * (instOut - info.rateOut)
+	info.rateIn += rateSmoothing * (instIn - info.rateIn)
+	info.lastOut, info.lastIn, info.lastSample = out, in, now
+}
+
+// Sample updates the throughput estimate of every active connection
+func (t *ConnTable) Sample() {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, info := range t.conns {
+		info.sample(now)
+	}
+}
+
+// Snapshot returns all active connections, busiest first
+func (t *ConnTable) Snapshot() []ConnSnapshot {
+	now := time.Now()
+	t.mu.Lock()
+	snaps := make([]ConnSnapshot, 0, len(t.conns))
+	for _, info := range t.conns {
+		info.mu.Lock()
+		snaps = append(snaps, ConnSnapshot{
+			ID:          info.ID,
+			Remote:      info.Remote,
+			Age:         now.Sub(info.StartedAt),
+			BytesOut:    info.BytesOut.Load(),
+			BytesIn:     info.BytesIn.Load(),
+			RateOut:     info.rateOut,
+			RateIn:      info.rateIn,
+			FromPool:    info.FromPool,
+			ConnectTime: info.ConnectTime,
+			VerifyRTT:   info.VerifyRTT,
+		})
+		info.mu.Unlock()
+	}
+	t.mu.Unlock()
+
+	sort.Slice(snaps, func(i, j int) bool {
+		ri, rj := snaps[i].RateOut+snaps[i].RateIn, snaps[j].RateOut+snaps[j].RateIn
+		if ri != rj {
+			return ri > rj
+		}
+		return snaps[i].ID < snaps[j].ID
+	})
+	return snaps
+}
+
+// formatConnTable renders active connections as a human-readable table
+func formatConnTable(conns []ConnSnapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "=== Active Connections (%d) ===\n", len(conns))
+	if len(conns) == 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%-6s %-22s %8s %10s %10s %10s %10s %8s %8s %s\n",
+		"ID", "Remote", "Age", "Out", "In", "Out/s", "In/s", "RTT", "Verify", "Source")
+	for _, c := range conns {
+		source := "new"
+		if c.FromPool {
+			source = "pool"
+		}
+		fmt.Fprintf(&b, "%-6d %-22s %8v %10s %10s %10s %10s %8v %8v %s\n",
+			c.ID, c.Remote,
+			c.Age.Round(time.Second),
+			formatBytes(c.BytesOut, true),
+			formatBytes(c.BytesIn, true),
+			formatBytes(uint64(c.RateOut), true),
+			formatBytes(uint64(c.RateIn), true),
+			c.ConnectTime.Round(time.Millisecond),
+			c.VerifyRTT.Round(time.Millisecond),
+			source)
+	}
+	return b.String()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnTableAddRemove(t *testing.T) {
+	table := NewConnTable()
+
+	a := table.Add("127.0.0.1:5000")
+	b := table.Add("127.0.0.1:5001")
+	if a.ID == b.ID {
+		t.Fatal("connection IDs should be unique")
+	}
+	if got := len(table.Snapshot()); got != 2 {
+		t.Fatalf("expected 2 connections, got %d", got)
+	}
+
+	table.Remove(a)
+	snaps := table.Snapshot()
+	if len(snaps) != 1 || snaps[0].ID != b.ID {
+		t.Fatalf("expected only connection %d to remain, got %+v", b.ID, snaps)
+	}
+}
+
+func TestConnInfoSampleRates(t *testing.T) {
+	table := NewConnTable()
+	info := table.Add("127.0.0.1:5000")
+
+	start := info.lastSample
+	info.BytesOut.Add(1000)
+	info.BytesIn.Add(4000)
+	info.sample(start.Add(time.Second))
+
+	if info.rateOut != rateSmoothing*1000 {
+		t.Errorf("rateOut = %v, want %v", info.rateOut, rateSmoothing*1000)
+	}
+	if info.rateIn != rateSmoothing*4000 {
+		t.Errorf("rateIn = %v, want %v", info.rateIn, rateSmoothing*4000)
+	}
+
+	// Idle second decays the rate rather than dropping it to zero
+	info.sample(start.Add(2 * time.Second))
+	if info.rateOut <= 0 || info.rateOut >= rateSmoothing*1000 {
+		t.Errorf("rateOut should decay after idle sample, got %v", info.rateOut)
+	}
+}
+
+func TestConnTableSnapshotOrder(t *testing.T) {
+	table := NewConnTable()
+	slow := table.Add("127.0.0.1:5000")
+	fast := table.Add("127.0.0.1:5001")
+
+	now := slow.lastSample.Add(time.Second)
+	slow.BytesOut.Add(10)
+	fast.BytesIn.Add(10000)
+	slow.sample(now)
+	fast.sample(now)
+
+	snaps := table.Snapshot()
+	if snaps[0].ID != fast.ID {
+		t.Errorf("busiest connection should be listed first, got %+v", snaps)
+	}
+}
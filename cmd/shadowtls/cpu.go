@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cpuSampleInterval is how often process CPU time is sampled
+	cpuSampleInterval = time.Second
+	// cpuSmoothing weighs each new sample against the running average, so a
+	// single busy second does not start shedding
+	cpuSmoothing = 0.5
+)
+
+// CPUGuard samples the process's CPU usage and sheds new handshakes while it
+// is above a threshold. Established relays are never touched: under overload
+// or a handshake flood, existing users keep their throughput and newcomers
+// are turned away before the expensive part. A nil guard never sheds.
+type CPUGuard struct {
+	limit float64 // Fraction of GOMAXPROCS cores, e.g. 0.85
+	procs int
+	usage atomic.Uint64 // math.Float64bits of the smoothed usage
+	shed  atomic.Uint64
+
+	now     func() time.Time
+	cpuTime func() (time.Duration, bool)
+	last    time.Time
+	lastCPU time.Duration
+}
+
+// NewCPUGuard sheds above percent of the cores the process may use. Returns
+// nil if percent is 0 or the platform cannot report process CPU time.
+func NewCPUGuard(percent int) *CPUGuard {
+	if percent <= 0 {
+		return nil
+	}
+	if !cpuLimitSupported {
+		return nil
+	}
+	g := &CPUGuard{
+		limit:   float64(percent) / 100,
+		procs:   runtime.GOMAXPROCS(0),
+		now:     time.Now,
+		cpuTime: processCPUTime,
+	}
+	g.last = g.now()
+	g.lastCPU, _ = g.cpuTime()
+	return g
+}
+
+// Allow reports whether a new handshake may start, counting a shed if not
+func (g *CPUGuard) Allow() bool {
+	if g == nil || g.Usage() <= g.limit {
+		return true
+	}
+	g.shed.Add(1)
+	return false
+}
+
+// Usage returns the smoothed CPU usage as a fraction of the usable cores
+func (g *CPUGuard) Usage() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(g.usage.Load())
+}
+
+// Run samples CPU usage until ctx is cancelled
+func (g *CPUGuard) Run(ctx context.Context) {
+	if g == nil {
+		return
+	}
+	ticker := time.NewTicker(cpuSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.sample()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sample folds the CPU time used since the last sample into the average
+func (g *CPUGuard) sample() {
+	now := g.now()
+	cpu, ok := g.cpuTime()
+	wall := now.Sub(g.last)
+	if !ok || wall <= 0 {
+		return
+	}
+	cur := float64(cpu-g.lastCPU) / float64(wall) / float64(g.procs)
+	g.last, g.lastCPU = now, cpu
+	avg := cpuSmoothing*cur + (1-cpuSmoothing)*g.Usage()
+	g.usage.Store(math.Float64bits(avg))
+}
+
+// CPUSnapshot is a point-in-time view of CPU load shedding
+type CPUSnapshot struct {
+	Usage float64 // Smoothed usage, fraction of usable cores
+	Limit float64 // Shedding threshold, same unit
+	Shed  uint64  // Handshakes rejected above the limit
+}
+
+// Snapshot returns the current state; zero for a nil guard
+func (g *CPUGuard) Snapshot() CPUSnapshot {
+	if g == nil {
+		return CPUSnapshot{}
+	}
+	return CPUSnapshot{Usage: g.Usage(), Limit: g.limit, Shed: g.shed.Load()}
+}
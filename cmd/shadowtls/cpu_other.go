@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// cpuLimitSupported reports whether --cpu-limit can measure CPU use here
+const cpuLimitSupported = false
+
+// processCPUTime is not implemented here, so --cpu-limit has no effect
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeCPUGuard returns a guard driven by a virtual clock and CPU counter
+func fakeCPUGuard(percent, procs int) (*CPUGuard, *time.Time, *time.Duration) {
+	now := time.Unix(0, 0)
+	var cpu time.Duration
+	g := &CPUGuard{
+		limit:   float64(percent) / 100,
+		procs:   procs,
+		now:     func() time.Time { return now },
+		cpuTime: func() (time.Duration, bool) { return cpu, true },
+		last:    now,
+	}
+	return g, &now, &cpu
+}
+
+func TestCPUGuardShed(t *testing.T) {
+	g, now, cpu := fakeCPUGuard(80, 2)
+
+	// One core busy out of two is well under the limit
+	*now = now.Add(time.Second)
+	*cpu += time.Second
+	g.sample()
+	if !g.Allow() {
+		t.Fatalf("usage %.2f should not shed", g.Usage())
+	}
+
+	// Both cores saturated for a while pushes the average over it
+	for i := 0; i < 3; i++ {
+		*now = now.Add(time.Second)
+		*cpu += 2 * time.Second
+		g.sample()
+	}
+	if g.Allow() {
+		t.Fatalf("usage %.2f should shed", g.Usage())
+	}
+
+	// Idle again: the average falls back under the limit
+	for i := 0; i < 3; i++ {
+		*now = now.Add(time.Second)
+		g.sample()
+	}
+	if !g.Allow() {
+		t.Errorf("usage %.2f should no longer shed", g.Usage())
+	}
+	if snap := g.Snapshot(); snap.Shed != 1 {
+		t.Errorf("shed = %d, want 1", snap.Shed)
+	}
+}
+
+func TestCPUGuardNil(t *testing.T) {
+	var g *CPUGuard
+	if !g.Allow() || g.Usage() != 0 {
+		t.Error("a nil guard should never shed")
+	}
+	if NewCPUGuard(0) != nil {
+		t.Error("NewCPUGuard(0) should disable shedding")
+	}
+}
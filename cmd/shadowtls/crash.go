@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// crashState, once a client or server is running, describes its state for
+// a post-mortem: the final stats and what was still connected
+var crashState atomic.Pointer[func() string]
+
+// setCrashState registers what to dump if the process dies abnormally
+func setCrashState(state func() string) {
+	crashState.Store(&state)
+}
+
+// dumpCrashState logs the registered state, and also writes it to stderr
+// when the log goes elsewhere, so it lands next to a panic's stack trace
+func dumpCrashState(reason string) {
+	state := crashState.Load()
+	if state == nil {
+		return
+	}
+	text := fmt.Sprintf("State at %s:\n%s", reason, strings.TrimRight((*state)(), "\n"))
+	Log.Error(text)
+	if out, ok := Log.Out.(*os.File); !ok || out != os.Stderr {
+		io.WriteString(os.Stderr, text+"\n")
+	}
+}
+
+// crashGuard dumps the state when the calling goroutine panics, then lets
+// the panic go on to print its stack and end the process. Deferred at the
+// top of main and of long-lived goroutines that don't recover their own
+// panics.
+func crashGuard() {
+	if r := recover(); r != nil {
+		dumpPanic(r)
+		panic(r)
+	}
+}
+
+// dumpPanic dumps the state for a panic with value r
+func dumpPanic(r any) {
+	dumpCrashState(fmt.Sprintf("panic: %v", r))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpCrashState(t *testing.T) {
+	var buf bytes.Buffer
+	out := Log.Out
+	Log.SetOutput(&buf)
+	defer Log.SetOutput(out)
+	crashState.Store(nil) // Clients and servers from other tests register one
+	defer crashState.Store(nil)
+
+	dumpCrashState("nothing registered")
+	if buf.Len() != 0 {
+		t.Errorf("dumped without a registered state: %q", buf.String())
+	}
+
+	setCrashState(func() string { return "Active connections: 3\n" })
+	dumpCrashState("panic: boom")
+	if got := buf.String(); !strings.Contains(got, "panic: boom") || !strings.Contains(got, "Active connections: 3") {
+		t.Errorf("dump = %q", got)
+	}
+}
+
+func TestCrashGuardRepanics(t *testing.T) {
+	defer crashState.Store(nil)
+	dumped := false
+	setCrashState(func() string { dumped = true; return "" })
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("recovered %v, want the original panic", r)
+		}
+		if !dumped {
+			t.Error("state was not dumped")
+		}
+	}()
+	func() {
+		defer crashGuard()
+		panic("boom")
+	}()
+}
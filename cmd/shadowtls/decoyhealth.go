@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// decoyWindow is how many of the latest dials the verdict is drawn from
+	decoyWindow = 20
+	// decoyMinDials is how many dials of the window must reach a stage
+	// before failures in it are judged
+	decoyMinDials = 4
+	// decoyBaselineDials is how many dials it takes a stage's baseline to
+	// move most of the way to a lasting slowdown, so a throttled decoy stays
+	// flagged for a while before it becomes the new normal
+	decoyBaselineDials = 200
+)
+
+// DecoyState says which side of a tunnel dial is in trouble. The TLS stage
+// of a dial is the handshake the server relays to the SNI host, so it fails
+// or slows down on its own when the camouflage site blocks or throttles the
+// server, while DNS and TCP only involve the server.
+type DecoyState int
+
+const (
+	DecoyOK          DecoyState = iota
+	DecoySlow                   // Handshakes take twice their baseline, TCP connects don't
+	DecoyFailing                // Half the handshakes fail after TCP connected
+	DecoyUnreachable            // Half the dials fail at DNS or TCP: the server is down, not the decoy
+)
+
+// String returns the short name used in stats and metrics
+func (s DecoyState) String() string {
+	switch s {
+	case DecoySlow:
+		return "slow"
+	case DecoyFailing:
+		return "failing"
+	case DecoyUnreachable:
+		return "server unreachable"
+	}
+	return "ok"
+}
+
+// MarshalText makes the state its name in the admin JSON
+func (s DecoyState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// dialOutcome is one dial in the window
+type dialOutcome struct {
+	timing stls.DialTiming
+	failed bool // Failed in timing.Stage; auth failures don't count
+}
+
+// DecoyHealth times the stages of tunnel dials to tell a server that is
+// down from a camouflage site that stopped answering the handshakes the
+// server relays to it
+type DecoyHealth struct {
+	log *logrus.Logger
+
+	mu       sync.Mutex
+	window   []dialOutcome // Ring of the latest decoyWindow dials
+	next     int
+	tcp, tls durationRing // Times of stages that succeeded
+	state    DecoyState
+	events   uint64
+	failed   uint64 // Handshakes that failed after TCP connected
+
+	// OnChange, if set, is called whenever the state changes, so mitigation
+	// (SNI rotation, server failover) can be triggered
+	OnChange func(state DecoyState)
+}
+
+// DecoyHealthSnapshot is a point-in-time view of the dial stages
+type DecoyHealthSnapshot struct {
+	State       DecoyState
+	DNS         time.Duration // Median of the latest dials, 0 for a server given by IP
+	TCP         time.Duration
+	TLS         time.Duration
+	TLSBaseline time.Duration // Fastest median seen, slowly decayed; 0 until there are enough
+	Failed      uint64        // Handshakes that failed after TCP connected
+	Events      uint64        // Times the state turned bad
+}
+
+// NewDecoyHealth creates an empty tracker
+func NewDecoyHealth() *DecoyHealth {
+	return &DecoyHealth{
+		window: make([]dialOutcome, 0, decoyWindow),
+		tcp:    newDurationRing(decoyWindow),
+		tls:    newDurationRing(decoyWindow),
+		log:    ModuleLogger("stats"),
+	}
+}
+
+// Record adds the stage timings of a finished tunnel dial. Cancelled dials
+// say nothing about either side and are ignored.
+func (d *DecoyHealth) Record(t stls.DialTiming, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	o := dialOutcome{timing: t, failed: err != nil && ClassifyConnectError(err) != FailAuth}
+
+	d.mu.Lock()
+	if len(d.window) < decoyWindow {
+		d.window = append(d.window, o)
+	} else {
+		d.window[d.next] = o
+	}
+	d.next = (d.next + 1) % decoyWindow
+	if t.Stage == stls.StageTLS {
+		d.tcp.add(t.TCP)
+		if o.failed {
+			d.failed++
+		} else if err == nil {
+			d.tls.add(t.TLS)
+		}
+	}
+	prev := d.state
+	d.state = d.evaluate()
+	if d.state != prev && d.state != DecoyOK {
+		d.events++
+	}
+	state, onChange := d.state, d.OnChange
+	tlsRecent, tlsBaseline := d.tls.medians()
+	d.mu.Unlock()
+
+	if state == prev {
+		return
+	}
+	switch state {
+	case DecoyOK:
+		d.log.Infof("[DECOY] Tunnel dials healthy again")
+	case DecoySlow:
+		d.log.Warnf("[DECOY] Handshakes relayed to the SNI host take %v, %.1fx the baseline %v, while TCP connects to the server don't: the camouflage site may be throttling the server",
+			tlsRecent.Round(time.Millisecond), float64(tlsRecent)/float64(tlsBaseline), tlsBaseline.Round(time.Millisecond))
+	case DecoyFailing:
+		d.log.Warnf("[DECOY] Most handshakes fail after TCP connects to the server: the camouflage site or a middlebox may be blocking them, try another --sni")
+	case DecoyUnreachable:
+		d.log.Warnf("[DECOY] Most dials fail at DNS or TCP: the server is unreachable, the camouflage site isn't the problem")
+	}
+	if onChange != nil {
+		onChange(state)
+	}
+}
+
+// evaluate judges the window; must be called with d.mu held
+func (d *DecoyHealth) evaluate() DecoyState {
+	var serverFailed, reached, tlsFailed int
+	for _, o := range d.window {
+		switch {
+		case o.timing.Stage != stls.StageTLS:
+			if o.failed {
+				serverFailed++
+			}
+		default:
+			reached++
+			if o.failed {
+				tlsFailed++
+			}
+		}
+	}
+	switch {
+	case len(d.window) >= decoyMinDials && 2*serverFailed >= len(d.window):
+		return DecoyUnreachable
+	case reached >= decoyMinDials && 2*tlsFailed >= reached:
+		return DecoyFailing
+	}
+
+	// Slower handshakes only point at the decoy if the path to the server
+	// itself didn't slow down as much
+	tlsRecent, tlsBaseline := d.tls.medians()
+	tcpRecent, tcpBaseline := d.tcp.medians()
+	if tlsBaseline <= 0 || tcpBaseline <= 0 {
+		return DecoyOK
+	}
+	tlsRatio := float64(tlsRecent) / float64(tlsBaseline)
+	tcpRatio := float64(tcpRecent) / float64(tcpBaseline)
+	switch {
+	case d.state == DecoySlow && tlsRatio > pathRecoverFactor:
+		return DecoySlow
+	case tlsRatio >= pathDegradeFactor && tcpRatio < pathRecoverFactor:
+		return DecoySlow
+	}
+	return DecoyOK
+}
+
+// Snapshot returns the current stage timings and verdict
+func (d *DecoyHealth) Snapshot() DecoyHealthSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var dns []time.Duration
+	for _, o := range d.window {
+		if o.timing.DNS > 0 && o.timing.Stage != stls.StageDNS {
+			dns = append(dns, o.timing.DNS)
+		}
+	}
+	snap := DecoyHealthSnapshot{
+		State:  d.state,
+		Failed: d.failed,
+		Events: d.events,
+	}
+	if len(dns) > 0 {
+		snap.DNS = median(dns)
+	}
+	snap.TCP, _ = d.tcp.medians()
+	snap.TLS, snap.TLSBaseline = d.tls.medians()
+	return snap
+}
+
+// durationRing keeps the latest samples of a duration and a baseline
+// pinned to the fastest median they have had. A slower median pulls the
+// baseline up by 1/decoyBaselineDials of the difference per sample, so a
+// slowdown only becomes the baseline after lasting that many dials.
+type durationRing struct {
+	samples  []time.Duration
+	next     int
+	baseline time.Duration
+}
+
+func newDurationRing(size int) durationRing {
+	return durationRing{samples: make([]time.Duration, 0, size)}
+}
+
+func (r *durationRing) add(d time.Duration) {
+	if len(r.samples) < cap(r.samples) {
+		r.samples = append(r.samples, d)
+	} else {
+		r.samples[r.next] = d
+	}
+	r.next = (r.next + 1) % cap(r.samples)
+	if len(r.samples) < cap(r.samples) {
+		return
+	}
+	m := median(r.samples)
+	if r.baseline == 0 || m < r.baseline {
+		r.baseline = m
+	} else {
+		r.baseline += (m - r.baseline) / decoyBaselineDials
+	}
+}
+
+// medians returns the median of the samples and the baseline; baseline is
+// 0 until the ring has filled once
+func (r *durationRing) medians() (recent, baseline time.Duration) {
+	if len(r.samples) == 0 {
+		return 0, 0
+	}
+	return median(r.samples), r.baseline
+}
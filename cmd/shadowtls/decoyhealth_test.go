@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+)
+
+// dialed is the timing of a dial that got through TCP in tcp and spent tls
+// on the handshake
+func dialed(tcp, tls time.Duration) stls.DialTiming {
+	return stls.DialTiming{DNS: time.Millisecond, TCP: tcp, TLS: tls, Stage: stls.StageTLS}
+}
+
+func TestDecoyHealthFailing(t *testing.T) {
+	d := NewDecoyHealth()
+	var changes []DecoyState
+	d.OnChange = func(state DecoyState) { changes = append(changes, state) }
+
+	for range decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 60*time.Millisecond), nil)
+	}
+	if snap := d.Snapshot(); snap.State != DecoyOK || snap.TCP != 20*time.Millisecond || snap.TLS != 60*time.Millisecond {
+		t.Fatalf("healthy dials: %+v", snap)
+	}
+
+	// The server accepts TCP but the handshake it relays gets reset
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	for range decoyWindow / 2 {
+		d.Record(dialed(20*time.Millisecond, 5*time.Millisecond), reset)
+	}
+	if snap := d.Snapshot(); snap.State != DecoyFailing || snap.Failed != decoyWindow/2 {
+		t.Fatalf("handshakes reset after TCP: %+v, want failing", snap)
+	}
+
+	// Wrong passwords and cancelled dials are not the decoy's fault
+	d = NewDecoyHealth()
+	for range decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 60*time.Millisecond), errors.New("traffic hijacked"))
+		d.Record(stls.DialTiming{Stage: stls.StageTCP}, context.Canceled)
+	}
+	if snap := d.Snapshot(); snap.State != DecoyOK || snap.Failed != 0 {
+		t.Errorf("auth failures and cancelled dials: %+v, want ok", snap)
+	}
+
+	if len(changes) != 1 || changes[0] != DecoyFailing {
+		t.Errorf("OnChange calls = %v, want [failing]", changes)
+	}
+}
+
+// Dials failing before the handshake blame the server, not the decoy
+func TestDecoyHealthUnreachable(t *testing.T) {
+	d := NewDecoyHealth()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	for range decoyMinDials {
+		d.Record(stls.DialTiming{TCP: time.Millisecond, Stage: stls.StageTCP}, refused)
+	}
+	if snap := d.Snapshot(); snap.State != DecoyUnreachable || snap.Failed != 0 {
+		t.Errorf("refused connects: %+v, want server unreachable", snap)
+	}
+
+	d = NewDecoyHealth()
+	for range decoyMinDials {
+		d.Record(stls.DialTiming{DNS: time.Millisecond, Stage: stls.StageDNS}, &net.DNSError{Err: "no such host", IsNotFound: true})
+	}
+	if snap := d.Snapshot(); snap.State != DecoyUnreachable {
+		t.Errorf("failed lookups: %+v, want server unreachable", snap)
+	}
+}
+
+// Handshakes slowing down flag the decoy only while TCP connects don't
+func TestDecoyHealthSlow(t *testing.T) {
+	d := NewDecoyHealth()
+	for range 3 * decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 60*time.Millisecond), nil)
+	}
+	for range decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 200*time.Millisecond), nil)
+	}
+	snap := d.Snapshot()
+	if snap.State != DecoySlow || snap.TLSBaseline > 70*time.Millisecond || snap.TLS != 200*time.Millisecond {
+		t.Fatalf("slower handshakes: %+v, want slow against a 60ms baseline", snap)
+	}
+	for range decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 60*time.Millisecond), nil)
+	}
+	if snap := d.Snapshot(); snap.State != DecoyOK || snap.Events != 1 {
+		t.Errorf("handshakes back to normal: %+v, want ok after one event", snap)
+	}
+
+	// A lasting slowdown stays flagged well past the window before the
+	// baseline follows it
+	d = NewDecoyHealth()
+	for range 3 * decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 60*time.Millisecond), nil)
+	}
+	for range 5 * decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 200*time.Millisecond), nil)
+	}
+	if snap := d.Snapshot(); snap.State != DecoySlow {
+		t.Errorf("slow for five windows: %+v, want still slow", snap)
+	}
+	for range 4 * decoyBaselineDials {
+		d.Record(dialed(20*time.Millisecond, 200*time.Millisecond), nil)
+	}
+	if snap := d.Snapshot(); snap.State != DecoyOK || snap.TLSBaseline < 150*time.Millisecond {
+		t.Errorf("slow for %d dials: %+v, want ok against a raised baseline", 4*decoyBaselineDials, snap)
+	}
+
+	// The whole path slowing down is the network, not the decoy
+	d = NewDecoyHealth()
+	for range 3 * decoyWindow {
+		d.Record(dialed(20*time.Millisecond, 60*time.Millisecond), nil)
+	}
+	for range decoyWindow {
+		d.Record(dialed(80*time.Millisecond, 200*time.Millisecond), nil)
+	}
+	if snap := d.Snapshot(); snap.State != DecoyOK {
+		t.Errorf("TCP and handshakes both slower: %+v, want ok", snap)
+	}
+}
+
+func TestDecoyStateJSON(t *testing.T) {
+	text, _ := DecoyUnreachable.MarshalText()
+	if string(text) != "server unreachable" {
+		t.Errorf("MarshalText = %q", text)
+	}
+}
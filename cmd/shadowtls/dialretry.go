@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/iprw/shadowtun/pkg/socks5"
+)
+
+// dialRetry retries SOCKS5 target dials that fail in a way that may clear up
+// within seconds, such as a service restarting or a resolver hiccup. Other
+// failures are returned at once.
+type dialRetry struct {
+	dial    socks5.DialFunc
+	retries int
+	backoff time.Duration // Before the first retry, doubling after each
+	logger  *logrus.Logger
+
+	recovered atomic.Uint64 // Dials that succeeded after a retry
+	exhausted atomic.Uint64 // Transient failures that outlasted every retry
+	permanent atomic.Uint64 // Failures not worth retrying
+}
+
+// isTransientDial reports errors a retry may fix: a refused or reset
+// connection, or a DNS failure other than a name that doesn't exist
+func isTransientDial(err error) bool {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return true
+	case errors.As(err, &dnsErr):
+		return !dnsErr.IsNotFound && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+	}
+	return false
+}
+
+func (r *dialRetry) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	wait := r.backoff
+	for attempt := 0; ; attempt++ {
+		conn, err := r.dial(ctx, network, addr)
+		if err == nil {
+			if attempt > 0 {
+				r.recovered.Add(1)
+				r.logger.Debugf("Dial to %s succeeded after %d retries", addr, attempt)
+			}
+			return conn, nil
+		}
+		if !isTransientDial(err) {
+			r.permanent.Add(1)
+			return nil, err
+		}
+		if attempt >= r.retries {
+			r.exhausted.Add(1)
+			return nil, err
+		}
+		r.logger.Debugf("Dial to %s failed, retrying in %v (%d/%d): %v", addr, wait, attempt+1, r.retries, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			r.exhausted.Add(1)
+			return nil, err
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingDial fails with err the first failures times, then connects
+func failingDial(failures int, err error, calls *int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		*calls++
+		if *calls <= failures {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	refused := fmt.Errorf("connect: %w", syscall.ECONNREFUSED)
+	for _, tt := range []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantOK    bool
+	}{
+		{"refused during a restart", 2, refused, 3, true},
+		{"refused for good", 5, refused, 4, false},
+		{"temporary DNS failure", 1, &net.DNSError{Err: "server misbehaving", IsTemporary: true}, 2, true},
+		{"unknown name", 1, &net.DNSError{Err: "no such host", IsNotFound: true}, 1, false},
+		{"unreachable", 1, syscall.EHOSTUNREACH, 1, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			r := &dialRetry{dial: failingDial(tt.failures, tt.err, &calls), retries: 3, backoff: time.Millisecond, logger: ModuleLogger("socks5")}
+			conn, err := r.Dial(context.Background(), "tcp", "example.com:80")
+			if (err == nil) != tt.wantOK {
+				t.Fatalf("Dial = %v, want success %v", err, tt.wantOK)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d dials, want %d", calls, tt.wantCalls)
+			}
+			recovered, exhausted, permanent := r.recovered.Load(), r.exhausted.Load(), r.permanent.Load()
+			switch {
+			case tt.wantOK && recovered != 1,
+				!tt.wantOK && tt.wantCalls > 1 && exhausted != 1,
+				!tt.wantOK && tt.wantCalls == 1 && permanent != 1:
+				t.Errorf("recovered %d, exhausted %d, permanent %d", recovered, exhausted, permanent)
+			}
+		})
+	}
+}
+
+// A closed connection stops the backoff instead of waiting it out
+func TestDialRetryCancelled(t *testing.T) {
+	calls := 0
+	r := &dialRetry{dial: failingDial(10, syscall.ECONNREFUSED, &calls), retries: 3, backoff: time.Hour, logger: ModuleLogger("socks5")}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.Dial(ctx, "tcp", "example.com:80"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Dial = %v, want the last dial error", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("backoff outlived the context")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DialTimeoutRule bounds dials to destinations matching a pattern
+type DialTimeoutRule struct {
+	Pattern string // As written, for logs
+	Timeout time.Duration
+
+	host string     // Exact host, "*" for any, ".example.com" for a domain and its subdomains
+	cidr *net.IPNet // Instead of host, for IP targets in a network
+	port string     // Empty for any
+}
+
+// matches reports whether the rule covers host and port; host is lowercase
+func (r *DialTimeoutRule) matches(host, port string) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+	switch {
+	case r.cidr != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && r.cidr.Contains(ip)
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "."):
+		return host == r.host[1:] || strings.HasSuffix(host, r.host)
+	}
+	return host == r.host
+}
+
+// ParseDialTimeouts parses --dial-timeout: comma-separated [dest=]duration
+// entries. dest is a host or IP, *.domain, a CIDR network, :port, or one of
+// those with a port; an entry without dest is the default for destinations
+// no rule matches. The default rule is always last, so it never shadows
+// the others.
+func ParseDialTimeouts(spec string) ([]DialTimeoutRule, error) {
+	var rules []DialTimeoutRule
+	var fallback *DialTimeoutRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		dest, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			dest, value = "", entry
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("--dial-timeout %q: want a positive duration such as 5s", entry)
+		}
+		dest = strings.TrimSpace(dest)
+		if ok && dest == "" {
+			return nil, fmt.Errorf("--dial-timeout %q: empty destination", entry)
+		}
+		if !ok {
+			if fallback != nil {
+				return nil, fmt.Errorf("--dial-timeout %q: a default is already set", entry)
+			}
+			fallback = &DialTimeoutRule{Pattern: "*", Timeout: d, host: "*"}
+			continue
+		}
+		rule, err := parseDialTimeoutDest(dest)
+		if err != nil {
+			return nil, fmt.Errorf("--dial-timeout %q: %v", entry, err)
+		}
+		rule.Timeout = d
+		rules = append(rules, rule)
+	}
+	if fallback != nil {
+		rules = append(rules, *fallback)
+	}
+	return rules, nil
+}
+
+func parseDialTimeoutDest(dest string) (DialTimeoutRule, error) {
+	rule := DialTimeoutRule{Pattern: dest}
+	host := dest
+	if h, p, err := net.SplitHostPort(dest); err == nil {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return rule, fmt.Errorf("invalid port %q", p)
+		}
+		host, rule.port = h, p
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case host == "" && rule.port == "":
+		return rule, errors.New("empty destination")
+	case host == "" || host == "*":
+		rule.host = "*"
+	case strings.Contains(host, "/"):
+		_, cidr, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, fmt.Errorf("invalid network %q", host)
+		}
+		rule.cidr = cidr
+	case strings.HasPrefix(host, "*."):
+		rule.host = host[1:]
+	case strings.Contains(host, "*"):
+		return rule, fmt.Errorf("%q: only a leading *. is allowed", host)
+	default:
+		rule.host = host
+	}
+	return rule, nil
+}
+
+// formatDialTimeouts renders rules for the startup log
+func formatDialTimeouts(rules []DialTimeoutRule) string {
+	parts := make([]string, len(rules))
+	for i, r := range rules {
+		parts[i] = r.Pattern + "=" + r.Timeout.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DialTimeouts dials SOCKS5 and --forward targets, each within the timeout
+// of the first rule matching it. Without a match the dial is only bounded
+// by the caller's context and the OS. Rules can be swapped while dials run.
+type DialTimeouts struct {
+	rules  atomic.Pointer[[]DialTimeoutRule]
+	dialer net.Dialer
+
+	timeouts atomic.Uint64 // Dials cut off by a rule
+}
+
+// NewDialTimeouts creates a dialer applying rules
+func NewDialTimeouts(rules []DialTimeoutRule) *DialTimeouts {
+	d := &DialTimeouts{}
+	d.Set(rules)
+	return d
+}
+
+// Set replaces the rules, e.g. on reload
+func (d *DialTimeouts) Set(rules []DialTimeoutRule) {
+	d.rules.Store(&rules)
+}
+
+// Timeout returns the timeout for addr (host:port), 0 if no rule matches
+func (d *DialTimeouts) Timeout(addr string) time.Duration {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range *d.rules.Load() {
+		if r.matches(host, port) {
+			return r.Timeout
+		}
+	}
+	return 0
+}
+
+// Dial connects to addr within its timeout. Safe on a nil DialTimeouts,
+// which dials without one.
+func (d *DialTimeouts) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	timeout := d.Timeout(addr)
+	if timeout <= 0 {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := d.dialer.DialContext(dialCtx, network, addr)
+	if err != nil && ctx.Err() == nil && dialCtx.Err() != nil {
+		d.timeouts.Add(1)
+		return nil, fmt.Errorf("%w (--dial-timeout %v)", err, timeout)
+	}
+	return conn, err
+}
+
+// TimedOut returns how many dials a rule cut off. Safe on a nil DialTimeouts.
+func (d *DialTimeouts) TimedOut() uint64 {
+	if d == nil {
+		return 0
+	}
+	return d.timeouts.Load()
+}
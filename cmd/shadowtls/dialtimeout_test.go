@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseDialTimeouts(t *testing.T) {
+	rules, err := ParseDialTimeouts("5s, :22=30s, *.Corp.Example=20s, 10.0.0.0/8:443=1s, [fd00::1]=2s, db.local:5432=3s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDialTimeouts(rules)
+	for addr, want := range map[string]time.Duration{
+		"example.com:443":      5 * time.Second, // The default, though written first
+		"example.com:22":       30 * time.Second,
+		"corp.example:80":      20 * time.Second,
+		"git.CORP.example.:80": 20 * time.Second,
+		"notcorp.example:80":   5 * time.Second,
+		"10.1.2.3:443":         time.Second,
+		"10.1.2.3:80":          5 * time.Second,
+		"[fd00::1]:8080":       2 * time.Second,
+		"db.local:5432":        3 * time.Second,
+		"db.local:5433":        5 * time.Second,
+	} {
+		if got := d.Timeout(addr); got != want {
+			t.Errorf("Timeout(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	// Without a default, unmatched destinations get no timeout
+	rules, _ = ParseDialTimeouts(":22=30s")
+	if got := NewDialTimeouts(rules).Timeout("example.com:443"); got != 0 {
+		t.Errorf("unmatched Timeout = %v, want 0", got)
+	}
+
+	for _, bad := range []string{"fast", "0s", ":22=-1s", "5s,10s", "a*b.com=1s", ":70000=1s", "10.0.0.0/33=1s", "=1s"} {
+		if _, err := ParseDialTimeouts(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestDialTimeoutsCutsOffDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	rules, _ := ParseDialTimeouts("127.0.0.1=30ms")
+	d := NewDialTimeouts(rules)
+	// Stall the dial before it connects, as an unanswered SYN would
+	d.dialer.Control = func(network, address string, c syscall.RawConn) error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}
+	start := time.Now()
+	_, err = d.Dial(context.Background(), "tcp", ln.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "--dial-timeout 30ms") {
+		t.Fatalf("Dial = %v, want cut off by the rule", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial took %v", elapsed)
+	}
+	if n := d.TimedOut(); n != 1 {
+		t.Errorf("TimedOut = %d, want 1", n)
+	}
+
+	// Other destinations are left alone
+	d.dialer.Control = nil
+	conn, err := d.Dial(context.Background(), "tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDNSUpstream is the resolver --dns-listen queries through the tunnel
+	DefaultDNSUpstream = "1.1.1.1:53"
+	// DefaultDNSCache is how many answers the DNS forwarder keeps
+	DefaultDNSCache = 1024
+	// dnsTimeout bounds one query through the tunnel, handshake included
+	dnsTimeout = 5 * time.Second
+	// dnsMaxTTL caps how long an answer is cached, whatever its TTL says
+	dnsMaxTTL = time.Hour
+	// dnsHeaderLen is the fixed DNS message header
+	dnsHeaderLen = 12
+	// dnsUDPSize is the UDP payload a client without EDNS accepts
+	dnsUDPSize = 512
+	// dnsTypeOPT is the EDNS pseudo-record, whose TTL field holds flags
+	dnsTypeOPT = 41
+	// dnsMaxInflight bounds the UDP queries resolved at once; more get a
+	// SERVFAIL reply
+	dnsMaxInflight = 64
+	// dnsMaxTCPConns bounds the TCP connections served at once; more are
+	// closed right after accept
+	dnsMaxTCPConns = 64
+	// dnsPipelineIdle closes the upstream tunnel after this long without an
+	// answer, before resolvers close theirs
+	dnsPipelineIdle = 10 * time.Second
+	// dnsStallTimeout gives up on an upstream tunnel that answered nothing
+	// this long after a query: the resolver may have closed it, which a
+	// tunnel can't pass on
+	dnsStallTimeout = 2 * time.Second
+)
+
+var (
+	errBadDNSMessage = errors.New("malformed DNS message")
+	errDNSPipeline   = errors.New("DNS upstream connection closed")
+)
+
+// DNSConfig enables the client's local DNS listener
+type DNSConfig struct {
+	Listen    string // UDP and TCP address answering queries
+	Upstream  string // Resolver the server connects to, host:port
+	CacheSize int    // Answers kept, 0 to disable caching
+}
+
+// DNSForwarder answers DNS queries from local apps by sending them over TCP
+// to a resolver reached through the tunnel, so lookups leave from the server
+// and never from the local network. Answers are cached for their TTL.
+type DNSForwarder struct {
+	exchange func(ctx context.Context, query []byte) ([]byte, error)
+	cache    *dnsCache
+	log      *logrus.Logger
+	repeat   *RepeatLogger
+	inflight chan struct{} // UDP queries being resolved
+	tcpConns chan struct{} // TCP connections being served
+
+	queries  atomic.Uint64
+	hits     atomic.Uint64
+	failures atomic.Uint64
+	shed     atomic.Uint64 // UDP queries and TCP connections refused over the limits
+}
+
+// NewDNSForwarder creates a forwarder that resolves cache misses with exchange
+func NewDNSForwarder(exchange func(ctx context.Context, query []byte) ([]byte, error), cacheSize int, logger *logrus.Logger) *DNSForwarder {
+	return &DNSForwarder{
+		exchange: exchange,
+		cache:    newDNSCache(cacheSize),
+		log:      logger,
+		repeat:   NewRepeatLogger(logger),
+		inflight: make(chan struct{}, dnsMaxInflight),
+		tcpConns: make(chan struct{}, dnsMaxTCPConns),
+	}
+}
+
+// Resolve answers one query from the cache or through exchange
+func (f *DNSForwarder) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	f.queries.Add(1)
+	key, err := dnsQuestionKey(query)
+	if err != nil {
+		f.failures.Add(1)
+		return nil, err
+	}
+	if resp := f.cache.get(key, time.Now()); resp != nil {
+		f.hits.Add(1)
+		// The client's query ID, and its question with the name's case as
+		// it asked, which resolvers randomizing the case check
+		copy(resp[:2], query[:2])
+		copy(resp[dnsHeaderLen:], query[dnsHeaderLen:dnsHeaderLen+len(key)])
+		return resp, nil
+	}
+	resp, err := f.exchange(ctx, query)
+	if err != nil {
+		f.failures.Add(1)
+		return nil, err
+	}
+	// Only an answer to the question asked can stand in for it later
+	if ttl, ok := dnsCacheTTL(resp); ok {
+		if rkey, err := dnsQuestionKey(resp); err == nil && rkey == key {
+			f.cache.put(key, resp, ttl, time.Now())
+		}
+	}
+	return resp, nil
+}
+
+// ServeUDP answers queries on pc until it is closed. At most dnsMaxInflight
+// are resolved at once, so a burst of queries can't open a tunnel each.
+func (f *DNSForwarder) ServeUDP(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				f.repeat.Warnf("DNS read error: %v", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		select {
+		case f.inflight <- struct{}{}:
+		default:
+			f.shed.Add(1)
+			f.repeat.Warnf("[SHED] DNS query from %s refused: %d queries already in flight", addr, dnsMaxInflight)
+			if resp := dnsServFail(query); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+			continue
+		}
+		go func() {
+			defer crashGuard()
+			defer func() { <-f.inflight }()
+			resp, err := f.Resolve(ctx, query)
+			if err != nil {
+				f.repeat.Warnf("DNS query from %s failed: %v", addr, err)
+				resp = dnsServFail(query)
+				if resp == nil {
+					return
+				}
+			}
+			if limit := dnsUDPLimit(query); len(resp) > limit {
+				resp = dnsTruncated(resp) // The client retries over TCP
+			}
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+// ServeTCP answers length-prefixed queries on connections from l until it
+// is closed. At most dnsMaxTCPConns connections are served at once.
+func (f *DNSForwarder) ServeTCP(ctx context.Context, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				f.repeat.Warnf("DNS accept error: %v", err)
+			}
+			return
+		}
+		select {
+		case f.tcpConns <- struct{}{}:
+		default:
+			f.shed.Add(1)
+			f.repeat.Warnf("[SHED] DNS connection from %s refused: %d connections already open", conn.RemoteAddr(), dnsMaxTCPConns)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer crashGuard()
+			defer func() { <-f.tcpConns }()
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(2 * dnsTimeout))
+				query, err := readDNSTCP(conn)
+				if err != nil {
+					return
+				}
+				resp, err := f.Resolve(ctx, query)
+				if err != nil {
+					f.repeat.Warnf("DNS query from %s failed: %v", conn.RemoteAddr(), err)
+					if resp = dnsServFail(query); resp == nil {
+						return
+					}
+				}
+				if err := writeDNSTCP(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Flush drops all cached answers and reports how many there were
+func (f *DNSForwarder) Flush() int {
+	f.cache.mu.Lock()
+	defer f.cache.mu.Unlock()
+	n := len(f.cache.entries)
+	clear(f.cache.entries)
+	return n
+}
+
+// Summary describes the forwarder's counters for the shutdown log
+func (f *DNSForwarder) Summary() string {
+	return fmt.Sprintf("DNS: %d queries, %d from cache, %d failed, %d shed", f.queries.Load(), f.hits.Load(), f.failures.Load(), f.shed.Load())
+}
+
+// dnsUpstream sends queries over TCP to a resolver reached through one
+// tunnel, using the server's SOCKS5 mode. Queries are pipelined on the
+// connection: each gets an ID of its own and waits for the answer carrying
+// it, since a resolver may answer out of order. The tunnel is opened on the
+// first query, and again once it fails or goes idle.
+type dnsUpstream struct {
+	acquire  func(ctx context.Context, opening []byte) (net.Conn, []byte, error)
+	upstream string
+
+	mu      sync.Mutex
+	pipe    *dnsPipeline  // nil until connected
+	dialing chan struct{} // Closed when the dial in progress ends, nil if none
+	closed  bool
+}
+
+func newDNSUpstream(acquire func(ctx context.Context, opening []byte) (net.Conn, []byte, error), upstream string) *dnsUpstream {
+	return &dnsUpstream{acquire: acquire, upstream: upstream}
+}
+
+// Exchange sends query and returns the answer. A query lost because the
+// connection closed or stalled under it, as happens when a resolver closes
+// an idle one, is sent once more on a new one.
+func (u *dnsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderLen {
+		return nil, errBadDNSMessage
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		pipe, err := u.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := pipe.exchange(ctx, query, attempt == 0)
+		if !errors.Is(err, errDNSPipeline) || attempt > 0 {
+			return resp, err
+		}
+	}
+}
+
+// Close closes the tunnel; later queries fail
+func (u *dnsUpstream) Close() {
+	u.mu.Lock()
+	u.closed = true
+	pipe := u.pipe
+	u.mu.Unlock()
+	if pipe != nil {
+		pipe.fail(errDNSPipeline)
+	}
+}
+
+// get returns the open connection, dialing it if there is none. Queries
+// arriving during the dial wait for it instead of dialing their own.
+func (u *dnsUpstream) get(ctx context.Context) (*dnsPipeline, error) {
+	for {
+		u.mu.Lock()
+		if u.closed {
+			u.mu.Unlock()
+			return nil, errDNSPipeline
+		}
+		if u.pipe != nil && u.pipe.alive() {
+			pipe := u.pipe
+			u.mu.Unlock()
+			return pipe, nil
+		}
+		if wait := u.dialing; wait != nil {
+			u.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		wait := make(chan struct{})
+		u.dialing = wait
+		u.mu.Unlock()
+
+		pipe, err := u.dial(ctx)
+		u.mu.Lock()
+		u.dialing = nil
+		if err == nil {
+			if u.closed {
+				pipe.fail(errDNSPipeline)
+				pipe, err = nil, errDNSPipeline
+			} else {
+				u.pipe = pipe
+			}
+		}
+		u.mu.Unlock()
+		close(wait)
+		return pipe, err
+	}
+}
+
+// dial opens a tunnel with a SOCKS5 greeting, which also verifies it, and
+// connects it to the upstream resolver
+func (u *dnsUpstream) dial(ctx context.Context) (*dnsPipeline, error) {
+	tunnel, greeting, err := u.acquire(ctx, []byte{0x05, 0x01, 0x00})
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	tunnel.SetDeadline(deadline)
+	if len(greeting) < 2 || greeting[0] != 0x05 || greeting[1] != 0x00 {
+		tunnel.Close()
+		return nil, errors.New("server did not answer as SOCKS5 (needs --socks5)")
+	}
+	if err := socks5Connect(tunnel, u.upstream); err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	tunnel.SetDeadline(time.Time{})
+	p := &dnsPipeline{conn: tunnel, pending: make(map[uint16]chan []byte), done: make(chan struct{})}
+	go p.readLoop()
+	return p, nil
+}
+
+// dnsPipeline is one connection to the upstream resolver and the queries
+// waiting for an answer on it
+type dnsPipeline struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte // By the ID sent upstream
+	nextID  uint16
+	err     error
+
+	lastRead atomic.Int64  // When an answer last arrived, Unix nanoseconds
+	done     chan struct{} // Closed once the connection failed
+	doneOnce sync.Once
+}
+
+func (p *dnsPipeline) alive() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// exchange sends query with an ID of the connection's and waits for the
+// answer, which gets the query's own ID back. With stall set, a connection
+// that answers nothing for dnsStallTimeout is closed.
+func (p *dnsPipeline) exchange(ctx context.Context, query []byte, stall bool) ([]byte, error) {
+	answer := make(chan []byte, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return nil, p.err
+	}
+	if len(p.pending) >= 1<<16-1 {
+		p.mu.Unlock()
+		return nil, errors.New("too many DNS queries in flight")
+	}
+	for p.pending[p.nextID] != nil {
+		p.nextID++
+	}
+	id := p.nextID
+	p.nextID++
+	p.pending[id] = answer
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg, id)
+	p.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	p.conn.SetWriteDeadline(deadline)
+	err := writeDNSTCP(p.conn, msg)
+	p.writeMu.Unlock()
+	if err != nil {
+		p.fail(fmt.Errorf("%w: %v", errDNSPipeline, err))
+		return nil, errDNSPipeline
+	}
+
+	sent := time.Now().UnixNano()
+	var stalled <-chan time.Time
+	if stall {
+		timer := time.NewTimer(dnsStallTimeout)
+		defer timer.Stop()
+		stalled = timer.C
+	}
+	for {
+		select {
+		case resp := <-answer:
+			copy(resp[:2], query[:2])
+			return resp, nil
+		case <-p.done:
+			return nil, p.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-stalled:
+			if p.lastRead.Load() < sent {
+				p.fail(fmt.Errorf("%w: no answer for %v", errDNSPipeline, dnsStallTimeout))
+				return nil, p.err
+			}
+		}
+	}
+}
+
+// readLoop hands each answer to the query waiting for its ID, until the
+// connection fails or no answer arrived for dnsPipelineIdle
+func (p *dnsPipeline) readLoop() {
+	defer crashGuard()
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(dnsPipelineIdle))
+		resp, err := readDNSTCP(p.conn)
+		if err == nil && len(resp) < dnsHeaderLen {
+			err = errBadDNSMessage
+		}
+		if err != nil {
+			p.fail(fmt.Errorf("%w: %v", errDNSPipeline, err))
+			return
+		}
+		p.lastRead.Store(time.Now().UnixNano())
+		p.mu.Lock()
+		answer := p.pending[binary.BigEndian.Uint16(resp)]
+		p.mu.Unlock()
+		if answer != nil {
+			select {
+			case answer <- resp:
+			default: // A duplicate answer
+			}
+		}
+	}
+}
+
+// fail closes the connection and fails the queries waiting on it
+func (p *dnsPipeline) fail(err error) {
+	p.doneOnce.Do(func() {
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		p.conn.Close()
+		close(p.done)
+	})
+}
+
+// socks5Connect sends a CONNECT request for target and reads the reply
+func socks5Connect(conn net.Conn, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("bad port in %q", target)
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4, 262)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 connect to %s refused (code %d)", target, reply[1])
+	}
+	var addrLen int
+	switch reply[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		addrLen = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS5 reply with address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	_, err := w.Write(binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg))))
+	if err == nil {
+		_, err = w.Write(msg)
+	}
+	return err
+}
+
+// dnsQuestionKey identifies a query by its (case-folded) name, type and class
+func dnsQuestionKey(msg []byte) (string, error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", errBadDNSMessage
+	}
+	end, err := skipDNSName(msg, dnsHeaderLen)
+	if err != nil || end+4 > len(msg) {
+		return "", errBadDNSMessage
+	}
+	return strings.ToLower(string(msg[dnsHeaderLen:end])) + string(msg[end:end+4]), nil
+}
+
+// skipDNSName returns the offset just past the name at off
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errBadDNSMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0: // Compression pointer ends the name
+			if off+2 > len(msg) {
+				return 0, errBadDNSMessage
+			}
+			return off + 2, nil
+		case n&0xc0 != 0:
+			return 0, errBadDNSMessage
+		}
+		off += 1 + n
+	}
+}
+
+// walkDNSRecords calls fn with the type and TTL offset of every resource
+// record after the question section
+func walkDNSRecords(msg []byte, fn func(rrType uint16, ttlOff int)) error {
+	if len(msg) < dnsHeaderLen {
+		return errBadDNSMessage
+	}
+	off := dnsHeaderLen
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		end, err := skipDNSName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = end + 4
+	}
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < records; i++ {
+		end, err := skipDNSName(msg, off)
+		if err != nil || end+10 > len(msg) {
+			return errBadDNSMessage
+		}
+		rdLen := int(binary.BigEndian.Uint16(msg[end+8:]))
+		if end+10+rdLen > len(msg) {
+			return errBadDNSMessage
+		}
+		fn(binary.BigEndian.Uint16(msg[end:]), end+4)
+		off = end + 10 + rdLen
+	}
+	return nil
+}
+
+// dnsCacheTTL returns how long resp may be cached: the lowest record TTL.
+// Only successful answers and NXDOMAIN with at least one record are cached.
+func dnsCacheTTL(resp []byte) (time.Duration, bool) {
+	if len(resp) < dnsHeaderLen || resp[2]&0x02 != 0 { // Truncated
+		return 0, false
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 && rcode != 3 {
+		return 0, false
+	}
+	minTTL := uint32(dnsMaxTTL / time.Second)
+	seen := false
+	err := walkDNSRecords(resp, func(rrType uint16, ttlOff int) {
+		if rrType == dnsTypeOPT {
+			return
+		}
+		seen = true
+		minTTL = min(minTTL, binary.BigEndian.Uint32(resp[ttlOff:]))
+	})
+	if err != nil || !seen || minTTL == 0 {
+		return 0, false
+	}
+	return time.Duration(minTTL) * time.Second, true
+}
+
+// dnsUDPLimit is the largest UDP response the client of query accepts
+func dnsUDPLimit(query []byte) int {
+	limit := dnsUDPSize
+	walkDNSRecords(query, func(rrType uint16, ttlOff int) {
+		if rrType == dnsTypeOPT {
+			// The OPT record's class, just before the TTL, is the payload size
+			limit = max(limit, int(binary.BigEndian.Uint16(query[ttlOff-2:])))
+		}
+	})
+	return limit
+}
+
+// dnsTruncated keeps only the header and question of resp, with TC set
+func dnsTruncated(resp []byte) []byte {
+	out := append([]byte(nil), resp[:dnsHeaderLen]...)
+	if end, err := skipDNSName(resp, dnsHeaderLen); err == nil && end+4 <= len(resp) {
+		out = append(out, resp[dnsHeaderLen:end+4]...)
+		binary.BigEndian.PutUint16(out[4:], 1)
+	} else {
+		binary.BigEndian.PutUint16(out[4:], 0)
+	}
+	clear(out[6:dnsHeaderLen])
+	out[2] |= 0x02
+	return out
+}
+
+// dnsServFail builds a SERVFAIL reply to query, or nil if it can't be parsed
+func dnsServFail(query []byte) []byte {
+	if _, err := dnsQuestionKey(query); err != nil {
+		return nil
+	}
+	resp := dnsTruncated(query)
+	resp[2] = resp[2]&^0x02 | 0x80 // QR, keep opcode and RD
+	resp[3] = 0x80 | 2             // RA, SERVFAIL
+	return resp
+}
+
+// dnsCache holds answers until their TTL runs out
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	resp    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{size: size, entries: make(map[string]dnsCacheEntry)}
+}
+
+// get returns a copy of the cached answer with TTLs lowered by its age
+func (c *dnsCache) get(key string, now time.Time) []byte {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	resp := append([]byte(nil), e.resp...)
+	age := uint32(now.Sub(e.stored) / time.Second)
+	walkDNSRecords(resp, func(rrType uint16, ttlOff int) {
+		if rrType != dnsTypeOPT {
+			ttl := binary.BigEndian.Uint32(resp[ttlOff:])
+			binary.BigEndian.PutUint32(resp[ttlOff:], ttl-min(ttl, age))
+		}
+	})
+	return resp
+}
+
+// put caches resp for ttl. When full, expired answers go first, then
+// arbitrary ones.
+func (c *dnsCache) put(key string, resp []byte, ttl time.Duration, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dnsCacheEntry{resp: append([]byte(nil), resp...), stored: now, expires: now.Add(ttl)}
+}
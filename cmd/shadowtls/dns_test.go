@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iprw/shadowtun/pkg/socks5"
+	"github.com/sirupsen/logrus"
+)
+
+// dnsQuery builds a query for name with type A
+func dnsQuery(id uint16, name string) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range bytes.Split([]byte(name), []byte(".")) {
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1)
+}
+
+// dnsAnswer answers query with one A record of ttl seconds, its name compressed
+func dnsAnswer(query []byte, ttl uint32) []byte {
+	resp := append([]byte(nil), query...)
+	resp[2], resp[3] = 0x81, 0x80
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	resp = append(resp, 0xc0, dnsHeaderLen, 0, 1, 0, 1)
+	resp = binary.BigEndian.AppendUint32(resp, ttl)
+	return append(resp, 0, 4, 192, 0, 2, 1)
+}
+
+func answerTTL(t *testing.T, resp []byte) uint32 {
+	t.Helper()
+	var ttl uint32
+	if err := walkDNSRecords(resp, func(_ uint16, off int) { ttl = binary.BigEndian.Uint32(resp[off:]) }); err != nil {
+		t.Fatal(err)
+	}
+	return ttl
+}
+
+func TestDNSForwarderCache(t *testing.T) {
+	exchanges := 0
+	f := NewDNSForwarder(func(ctx context.Context, query []byte) ([]byte, error) {
+		exchanges++
+		return dnsAnswer(query, 300), nil
+	}, 16, logrus.New())
+
+	first, err := f.Resolve(context.Background(), dnsQuery(1, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Names are case-insensitive; the answer carries the new query's ID
+	second, err := f.Resolve(context.Background(), dnsQuery(2, "EXAMPLE.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exchanges != 1 {
+		t.Errorf("%d exchanges, want 1", exchanges)
+	}
+	if binary.BigEndian.Uint16(first) != 1 || binary.BigEndian.Uint16(second) != 2 {
+		t.Errorf("IDs %d, %d, want 1, 2", binary.BigEndian.Uint16(first), binary.BigEndian.Uint16(second))
+	}
+	// ...and its question, spelled as the client spelled it
+	if q := dnsQuery(2, "EXAMPLE.com"); !bytes.Equal(second[dnsHeaderLen:len(q)], q[dnsHeaderLen:]) {
+		t.Errorf("cached answer's question %q, want %q", second[dnsHeaderLen:len(q)], q[dnsHeaderLen:])
+	}
+	if f.hits.Load() != 1 {
+		t.Errorf("%d cache hits, want 1", f.hits.Load())
+	}
+
+	// Cached TTLs count down and the entry expires with them
+	key, _ := dnsQuestionKey(dnsQuery(1, "example.com"))
+	now := time.Now()
+	if resp := f.cache.get(key, now.Add(100*time.Second)); resp == nil || answerTTL(t, resp) > 200 {
+		t.Errorf("TTL not lowered after 100s: %v", resp)
+	}
+	if resp := f.cache.get(key, now.Add(301*time.Second)); resp != nil {
+		t.Error("answer served past its TTL")
+	}
+}
+
+// Queries beyond dnsMaxInflight get a SERVFAIL instead of a tunnel each
+func TestDNSServeUDPShed(t *testing.T) {
+	release := make(chan struct{})
+	f := NewDNSForwarder(func(ctx context.Context, query []byte) ([]byte, error) {
+		<-release
+		return dnsAnswer(query, 300), nil
+	}, 0, logrus.New())
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go f.ServeUDP(context.Background(), pc)
+
+	app, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	for i := range dnsMaxInflight + 1 {
+		app.Write(dnsQuery(uint16(i), "example.com"))
+	}
+	app.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, err := app.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, rcode := binary.BigEndian.Uint16(buf), buf[3]&0x0f; id != dnsMaxInflight || rcode != 2 || n < dnsHeaderLen {
+		t.Errorf("first reply is query %d with rcode %d, want SERVFAIL for query %d", id, rcode, dnsMaxInflight)
+	}
+	if n := f.shed.Load(); n != 1 {
+		t.Errorf("shed %d, want 1", n)
+	}
+
+	close(release)
+	for range dnsMaxInflight {
+		if _, err := app.Read(buf); err != nil {
+			t.Fatalf("queries in flight not answered: %v", err)
+		}
+	}
+}
+
+// Connections beyond dnsMaxTCPConns are closed instead of served
+func TestDNSServeTCPShed(t *testing.T) {
+	f := NewDNSForwarder(func(ctx context.Context, query []byte) ([]byte, error) {
+		return dnsAnswer(query, 300), nil
+	}, 0, logrus.New())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go f.ServeTCP(context.Background(), l)
+
+	for range dnsMaxTCPConns {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// An answer means the connection holds a slot
+		writeDNSTCP(conn, dnsQuery(1, "example.com"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := readDNSTCP(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extra, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+	extra.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := extra.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection over the limit: read %v, want EOF", err)
+	}
+	if n := f.shed.Load(); n != 1 {
+		t.Errorf("shed %d, want 1", n)
+	}
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	query := dnsQuery(1, "example.com")
+	if ttl, ok := dnsCacheTTL(dnsAnswer(query, 60)); !ok || ttl != time.Minute {
+		t.Errorf("ttl %v, %v; want 1m", ttl, ok)
+	}
+	if ttl, _ := dnsCacheTTL(dnsAnswer(query, 86400)); ttl != dnsMaxTTL {
+		t.Errorf("ttl %v not capped at %v", ttl, dnsMaxTTL)
+	}
+	if _, ok := dnsCacheTTL(dnsServFail(query)); ok {
+		t.Error("SERVFAIL cached")
+	}
+	if _, ok := dnsCacheTTL(dnsAnswer(query, 0)); ok {
+		t.Error("TTL 0 cached")
+	}
+}
+
+func TestDNSTruncation(t *testing.T) {
+	query := dnsQuery(7, "example.com")
+	if got := dnsUDPLimit(query); got != dnsUDPSize {
+		t.Errorf("limit %d without EDNS, want %d", got, dnsUDPSize)
+	}
+	edns := append(append([]byte(nil), query...), 0, 0, dnsTypeOPT, 0x10, 0x00, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(edns[10:], 1)
+	if got := dnsUDPLimit(edns); got != 4096 {
+		t.Errorf("limit %d with EDNS 4096", got)
+	}
+
+	tc := dnsTruncated(dnsAnswer(query, 60))
+	if tc[2]&0x02 == 0 || binary.BigEndian.Uint16(tc[6:]) != 0 || len(tc) != len(query) {
+		t.Errorf("truncated reply %x", tc)
+	}
+	if _, err := dnsQuestionKey(tc); err != nil {
+		t.Errorf("truncated reply lost its question: %v", err)
+	}
+}
+
+// TestDNSUpstream resolves through the server's SOCKS5 handler to a resolver
+// answering over TCP, as queries through a real tunnel would: concurrent
+// queries share one tunnel, and a connection the resolver closed is
+// replaced
+func TestDNSUpstream(t *testing.T) {
+	resolver, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := resolver.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readDNSTCP(conn)
+					if err != nil {
+						return
+					}
+					writeDNSTCP(conn, dnsAnswer(query, 60))
+				}
+			}()
+		}
+	}()
+
+	handler := socks5.NewHandler("", "", logrus.New())
+	var acquired atomic.Int32
+	acquire := func(ctx context.Context, opening []byte) (net.Conn, []byte, error) {
+		acquired.Add(1)
+		client, server := net.Pipe()
+		go handler.Handle(ctx, server)
+		client.Write(opening)
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(client, greeting); err != nil {
+			return nil, nil, err
+		}
+		return client, greeting, nil
+	}
+	up := newDNSUpstream(acquire, resolver.Addr().String())
+	defer up.Close()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			resp, err := up.Exchange(context.Background(), dnsQuery(uint16(100+i), "example.com"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if binary.BigEndian.Uint16(resp) != uint16(100+i) || answerTTL(t, resp) != 60 {
+				t.Errorf("unexpected answer %x", resp)
+			}
+		})
+	}
+	wg.Wait()
+	if n := acquired.Load(); n != 1 {
+		t.Errorf("%d tunnels for 8 queries, want 1", n)
+	}
+
+	// The resolver drops the idle connection; the next query opens another
+	(<-conns).Close()
+	time.Sleep(50 * time.Millisecond)
+	resp, err := up.Exchange(context.Background(), dnsQuery(9, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(resp) != 9 || acquired.Load() != 2 {
+		t.Errorf("answer %x after %d tunnels, want ID 9 after 2", resp, acquired.Load())
+	}
+}
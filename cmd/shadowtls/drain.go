@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// drainPollInterval is how often `shadowtls drain --wait` checks the count
+const drainPollInterval = time.Second
+
+// DrainStatus is what the admin /drain endpoint reports
+type DrainStatus struct {
+	Draining  bool      `json:"draining"`
+	Since     time.Time `json:"since,omitzero"`
+	Remaining int       `json:"remaining"` // Connections still relaying
+	Refused   uint64    `json:"refused"`   // New connections turned away while draining
+}
+
+// Drainer turns new connections away ahead of planned maintenance while
+// open ones finish, and reports how many are left
+type Drainer struct {
+	active  func() int
+	onStart func() // Called when draining starts, nil for nothing
+	log     *logrus.Logger
+
+	mu      sync.Mutex
+	since   time.Time // Zero when not draining
+	refused atomic.Uint64
+}
+
+// NewDrainer creates a drainer counting open connections with active
+func NewDrainer(active func() int, logger *logrus.Logger) *Drainer {
+	return &Drainer{active: active, log: logger}
+}
+
+// Start stops new connections; it reports false if already draining
+func (d *Drainer) Start() bool {
+	d.mu.Lock()
+	if !d.since.IsZero() {
+		d.mu.Unlock()
+		return false
+	}
+	d.since = time.Now()
+	d.mu.Unlock()
+	if d.onStart != nil {
+		d.onStart()
+	}
+	d.log.Infof("[DRAIN] Draining: refusing new connections, %d still open", d.active())
+	return true
+}
+
+// Stop accepts connections again; it reports false if not draining
+func (d *Drainer) Stop() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since.IsZero() {
+		return false
+	}
+	d.log.Infof("[DRAIN] Accepting connections again after %v, %d refused meanwhile", time.Since(d.since).Round(time.Second), d.refused.Load())
+	d.since = time.Time{}
+	return true
+}
+
+// Refuse closes conn if draining and reports whether it did
+func (d *Drainer) Refuse(conn net.Conn) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	draining := !d.since.IsZero()
+	d.mu.Unlock()
+	if !draining {
+		return false
+	}
+	conn.Close()
+	d.refused.Add(1)
+	d.log.Debugf("[DRAIN] Refused connection from %s", conn.RemoteAddr())
+	return true
+}
+
+// Status reports whether the drainer is draining and what is left
+func (d *Drainer) Status() DrainStatus {
+	d.mu.Lock()
+	since := d.since
+	d.mu.Unlock()
+	return DrainStatus{Draining: !since.IsZero(), Since: since, Remaining: d.active(), Refused: d.refused.Load()}
+}
+
+// ServeHTTP implements /drain: GET reports the status, POST starts draining
+// and DELETE resumes accepting; both answer with the new status
+func (d *Drainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		d.Start()
+	case http.MethodDelete:
+		d.Stop()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(d.Status())
+}
+
+// runDrain implements `shadowtls drain`: ask a running client or server to
+// drain through its admin endpoint, and optionally wait until it is empty
+func runDrain(args []string) int {
+	fs := flag.NewFlagSet("drain", flag.ContinueOnError)
+	admin := fs.String("admin", "127.0.0.1:9090", "Admin endpoint of the running process (addr:port or URL)")
+	token := fs.String("admin-token", "", "Bearer token of the admin endpoint")
+	resume := fs.Bool("resume", false, "Accept new connections again instead of draining")
+	status := fs.Bool("status", false, "Only print the drain status")
+	wait := fs.Duration("wait", 0, "Wait up to this long for the open connections to finish, 0 to return at once")
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s drain [--admin addr:port] [--admin-token t] [--wait 10m | --resume | --status]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Stops a running client or server started with --admin from accepting new")
+		fmt.Fprintln(os.Stderr, "connections while open ones finish. With --wait, exits 0 once none are left")
+		fmt.Fprintln(os.Stderr, "and 1 if some still are when the wait is over.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	url := *admin
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	url = strings.TrimSuffix(url, "/") + "/drain"
+	method := http.MethodPost
+	switch {
+	case *status:
+		method = http.MethodGet
+	case *resume:
+		method = http.MethodDelete
+	}
+
+	st, err := drainRequest(method, url, *token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printDrainStatus(st)
+	if method != http.MethodPost || *wait <= 0 {
+		return 0
+	}
+
+	deadline := time.Now().Add(*wait)
+	for st.Remaining > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+		if st, err = drainRequest(http.MethodGet, url, *token); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printDrainStatus(st)
+	}
+	if st.Remaining > 0 {
+		return 1
+	}
+	return 0
+}
+
+func drainRequest(method, url, token string) (DrainStatus, error) {
+	var st DrainStatus
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return st, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return st, fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return st, json.NewDecoder(resp.Body).Decode(&st)
+}
+
+func printDrainStatus(st DrainStatus) {
+	if !st.Draining {
+		fmt.Printf("Accepting connections, %d open\n", st.Remaining)
+		return
+	}
+	fmt.Printf("Draining for %v: %d connections left, %d refused\n", time.Since(st.Since).Round(time.Second), st.Remaining, st.Refused)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDrainerRefusesWhileDraining(t *testing.T) {
+	var open atomic.Int64
+	open.Store(3)
+	d := NewDrainer(func() int { return int(open.Load()) }, Log)
+	started := 0
+	d.onStart = func() { started++ }
+
+	a, b := net.Pipe()
+	defer b.Close()
+	if d.Refuse(a) {
+		t.Fatal("refused a connection before draining")
+	}
+	if !d.Start() || d.Start() {
+		t.Fatal("Start should report true once, then false")
+	}
+	if started != 1 {
+		t.Errorf("onStart called %d times, want 1", started)
+	}
+	if !d.Refuse(a) {
+		t.Fatal("accepted a connection while draining")
+	}
+	if _, err := a.Write([]byte("x")); err == nil {
+		t.Error("refused connection was not closed")
+	}
+
+	open.Store(1)
+	st := d.Status()
+	if !st.Draining || st.Remaining != 1 || st.Refused != 1 || st.Since.IsZero() {
+		t.Errorf("status = %+v", st)
+	}
+
+	if !d.Stop() || d.Stop() {
+		t.Fatal("Stop should report true once, then false")
+	}
+	c, e := net.Pipe()
+	defer c.Close()
+	defer e.Close()
+	if d.Refuse(c) {
+		t.Error("refused a connection after resuming")
+	}
+	if st := d.Status(); st.Draining || !st.Since.IsZero() {
+		t.Errorf("status after Stop = %+v", st)
+	}
+
+	var none *Drainer
+	if none.Refuse(c) {
+		t.Error("nil drainer refused a connection")
+	}
+}
+
+func TestDrainerServeHTTP(t *testing.T) {
+	d := NewDrainer(func() int { return 2 }, Log)
+	do := func(method string) (int, DrainStatus) {
+		rec := httptest.NewRecorder()
+		d.ServeHTTP(rec, httptest.NewRequest(method, "/drain", nil))
+		var st DrainStatus
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+				t.Fatalf("%s: %v", method, err)
+			}
+		}
+		return rec.Code, st
+	}
+
+	if code, st := do(http.MethodGet); code != http.StatusOK || st.Draining || st.Remaining != 2 {
+		t.Errorf("GET = %d %+v", code, st)
+	}
+	if code, st := do(http.MethodPost); code != http.StatusOK || !st.Draining {
+		t.Errorf("POST = %d %+v", code, st)
+	}
+	if code, st := do(http.MethodDelete); code != http.StatusOK || st.Draining {
+		t.Errorf("DELETE = %d %+v", code, st)
+	}
+	if code, _ := do(http.MethodPut); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", code)
+	}
+}
+
+func TestRunDrain(t *testing.T) {
+	var open atomic.Int64
+	d := NewDrainer(func() int { return int(open.Load()) }, Log)
+	admin, err := NewAdminServer(&AdminConfig{Addr: "127.0.0.1:0", Token: "secret"}, Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Handle("/drain", d)
+	srv := httptest.NewServer(admin.server.Handler)
+	defer srv.Close()
+
+	if code := runDrain([]string{"--admin", srv.URL, "--status"}); code != 1 {
+		t.Errorf("without the token: exit %d, want 1", code)
+	}
+	if code := runDrain([]string{"--admin", srv.URL, "--admin-token", "secret", "--wait", "1m"}); code != 0 {
+		t.Errorf("drain with nothing open: exit %d, want 0", code)
+	}
+	if !d.Status().Draining {
+		t.Error("drain command did not start draining")
+	}
+	if code := runDrain([]string{"--admin", srv.URL, "--admin-token", "secret", "--resume"}); code != 0 {
+		t.Errorf("resume: exit %d, want 0", code)
+	}
+	if d.Status().Draining {
+		t.Error("--resume did not stop draining")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// proxyEnvNoProxy lists destinations that must never go through the tunnel
+const proxyEnvNoProxy = "localhost,127.0.0.1,::1"
+
+// runEnv implements `shadowtls env`: print shell lines that point proxy
+// environment variables at the local listener
+func runEnv(args []string) int {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	shell := fs.String("shell", "bash", "Shell syntax: bash, fish or powershell")
+	listen := fs.String("listen", "127.0.0.1:1080", "Client listen address")
+	unset := fs.Bool("unset", false, "Print lines that remove the variables instead")
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s env [--shell bash|fish|powershell] [--listen addr:port] [--unset]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Prints proxy environment variables for the local listener, e.g.:")
+		fmt.Fprintln(os.Stderr, "  eval \"$(shadowtls env)\"")
+		fmt.Fprintln(os.Stderr, "  shadowtls env --shell fish | source")
+		fmt.Fprintln(os.Stderr, "  shadowtls env --shell powershell | Invoke-Expression")
+		fmt.Fprintln(os.Stderr, "The server must run with --socks5.")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := writeProxyEnv(os.Stdout, *shell, *listen, *unset); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// writeProxyEnv writes the proxy variables for listen in the given shell syntax
+func writeProxyEnv(w io.Writer, shell, listen string, unset bool) error {
+	proxy := "socks5h://" + localProxyAddr(listen)
+	vars := [][2]string{
+		{"ALL_PROXY", proxy},
+		{"HTTP_PROXY", proxy},
+		{"HTTPS_PROXY", proxy},
+		{"NO_PROXY", proxyEnvNoProxy},
+	}
+
+	for _, v := range vars {
+		for _, name := range []string{v[0], strings.ToLower(v[0])} {
+			var line string
+			switch shell {
+			case "bash", "sh", "zsh":
+				if unset {
+					line = fmt.Sprintf("unset %s", name)
+				} else {
+					line = fmt.Sprintf("export %s='%s'", name, v[1])
+				}
+			case "fish":
+				if unset {
+					line = fmt.Sprintf("set -e %s", name)
+				} else {
+					line = fmt.Sprintf("set -gx %s '%s'", name, v[1])
+				}
+			case "powershell", "pwsh":
+				// Environment variables are case-insensitive on Windows
+				if name != v[0] {
+					continue
+				}
+				if unset {
+					line = fmt.Sprintf("Remove-Item Env:%s -ErrorAction SilentlyContinue", name)
+				} else {
+					line = fmt.Sprintf("$env:%s = '%s'", name, v[1])
+				}
+			default:
+				return fmt.Errorf("unknown shell: %s (use bash, fish or powershell)", shell)
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	return nil
+}
+
+// localProxyAddr turns a listen address into one clients can connect to:
+// wildcard or empty hosts become the loopback address
+func localProxyAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteProxyEnv(t *testing.T) {
+	tests := map[string]string{
+		"bash":       "export ALL_PROXY='socks5h://127.0.0.1:1080'",
+		"fish":       "set -gx https_proxy 'socks5h://127.0.0.1:1080'",
+		"powershell": "$env:NO_PROXY = 'localhost,127.0.0.1,::1'",
+	}
+	for shell, want := range tests {
+		var b bytes.Buffer
+		if err := writeProxyEnv(&b, shell, "0.0.0.0:1080", false); err != nil {
+			t.Fatalf("%s: %v", shell, err)
+		}
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%s output missing %q:\n%s", shell, want, b.String())
+		}
+	}
+
+	var b bytes.Buffer
+	if err := writeProxyEnv(&b, "bash", "127.0.0.1:1080", true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "unset http_proxy") {
+		t.Errorf("unset output: %s", b.String())
+	}
+
+	if err := writeProxyEnv(&b, "tcsh", "127.0.0.1:1080", false); err == nil {
+		t.Error("expected error for unknown shell")
+	}
+}
+
+func TestLocalProxyAddr(t *testing.T) {
+	tests := map[string]string{
+		"0.0.0.0:1080":   "127.0.0.1:1080",
+		":1080":          "127.0.0.1:1080",
+		"[::]:1080":      "127.0.0.1:1080",
+		"10.0.0.5:1080":  "10.0.0.5:1080",
+		"127.0.0.1:7000": "127.0.0.1:7000",
+	}
+	for in, want := range tests {
+		if got := localProxyAddr(in); got != want {
+			t.Errorf("localProxyAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
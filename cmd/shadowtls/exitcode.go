@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Process exit codes, one per failure class, so a supervisor can react to
+// each differently, e.g. stop restarting on a bad config with systemd's
+// RestartPreventExitStatus=3 5
+const (
+	ExitRuntime = 1 // Fatal error while running
+	ExitUsage   = 2 // Mode or password missing; the usage text was printed
+	ExitConfig  = 3 // Invalid flags, config file, secrets or confinement
+	ExitBind    = 4 // A listener could not be bound
+	ExitAuth    = 5 // The server rejected the password on every attempt since startup
+	ExitDrain   = 6 // --drain-timeout ran out and open connections were closed
+)
+
+// exitCodeError tags an error returned by Server.Run or Client.Run with the
+// exit code it should end the process with
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string { return e.err.Error() }
+func (e *exitCodeError) Unwrap() error { return e.err }
+
+// withExitCode tags err with code
+func withExitCode(code int, err error) error {
+	return &exitCodeError{code: code, err: err}
+}
+
+// exitCode is the code err was tagged with, ExitRuntime if none
+func exitCode(err error) int {
+	var e *exitCodeError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return ExitRuntime
+}
+
+// exitWith logs a fatal message and ends the process with code. A runtime
+// failure also dumps the client or server state for a post-mortem.
+func exitWith(code int, format string, args ...any) {
+	Log.Logf(logrus.FatalLevel, format, args...)
+	if code == ExitRuntime {
+		dumpCrashState("fatal error")
+	}
+	Log.Exit(code)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	bind := withExitCode(ExitBind, errors.New("address in use"))
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{errors.New("boom"), ExitRuntime},
+		{bind, ExitBind},
+		{fmt.Errorf("server: %w", bind), ExitBind},
+	} {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+	if bind.Error() != "address in use" {
+		t.Errorf("tagging changed the message: %q", bind.Error())
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultFailoverAfter is the default for --failover-after
+	DefaultFailoverAfter = 3
+	// DefaultFailoverRecheck is the default for --failover-recheck
+	DefaultFailoverRecheck = 30 * time.Second
+)
+
+// ParseServerList splits --server into its comma-separated addresses, in
+// order of preference
+func ParseServerList(s string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("server %q: %v", addr, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// ServerDialer dials tunnels to one server
+type ServerDialer struct {
+	Addr string
+	Dial func(ctx context.Context) (net.Conn, error)
+}
+
+// upstreamServer is a server and its health
+type upstreamServer struct {
+	ServerDialer
+	failures  int // Consecutive failed dials
+	down      bool
+	downSince time.Time
+	nextCheck time.Time // When a down server preferred over the active one is tried again
+}
+
+// ServerSet dials the active one of several servers. A server is marked down
+// after a run of failed dials and the next one takes over. Dials to down
+// servers listed before the active one are retried every recheck interval,
+// and the first that succeeds makes its server active again, so the set
+// returns to the preferred server once it is reachable.
+type ServerSet struct {
+	after   int
+	recheck time.Duration
+	log     *logrus.Logger
+
+	mu        sync.Mutex
+	servers   []*upstreamServer
+	active    int
+	failovers uint64
+}
+
+// ServerSetSnapshot is a point-in-time view of the servers
+type ServerSetSnapshot struct {
+	Servers   int
+	Active    string
+	Down      []string
+	Failovers uint64 // Switches between servers, either way
+}
+
+// NewServerSet creates a set that fails over after after consecutive failed
+// dials and retries preferred servers every recheck; zero values take the
+// defaults
+func NewServerSet(after int, recheck time.Duration) *ServerSet {
+	if after <= 0 {
+		after = DefaultFailoverAfter
+	}
+	if recheck <= 0 {
+		recheck = DefaultFailoverRecheck
+	}
+	return &ServerSet{
+		after:   after,
+		recheck: recheck,
+		log:     ModuleLogger("pool"),
+	}
+}
+
+// SetServers replaces the servers, e.g. on reload, forgetting their health
+// and making the first one active
+func (s *ServerSet) SetServers(dialers []ServerDialer) {
+	servers := make([]*upstreamServer, len(dialers))
+	for i, d := range dialers {
+		servers[i] = &upstreamServer{ServerDialer: d}
+	}
+	s.mu.Lock()
+	s.servers = servers
+	s.active = 0
+	s.mu.Unlock()
+}
+
+// Dial opens a tunnel to the active server, or to a preferred server that is
+// due a recheck
+func (s *ServerSet) Dial(ctx context.Context) (net.Conn, error) {
+	if srv := s.dueRecheck(time.Now()); srv != nil {
+		conn, err := srv.Dial(ctx)
+		if err == nil {
+			s.succeeded(srv)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		s.log.Debugf("Server %s still unreachable: %v", srv.Addr, err)
+	}
+
+	s.mu.Lock()
+	srv := s.servers[s.active]
+	s.mu.Unlock()
+	conn, err := srv.Dial(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.failed(srv, err)
+		}
+		return nil, err
+	}
+	s.succeeded(srv)
+	return conn, nil
+}
+
+// dueRecheck claims the first down server preferred over the active one
+// whose recheck is due, so only one dial rechecks it
+func (s *ServerSet) dueRecheck(now time.Time) *upstreamServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, srv := range s.servers[:s.active] {
+		if srv.down && !now.Before(srv.nextCheck) {
+			srv.nextCheck = now.Add(s.recheck)
+			return srv
+		}
+	}
+	return nil
+}
+
+func (s *ServerSet) failed(srv *upstreamServer, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv.failures++
+	if len(s.servers) == 1 || srv.failures < s.after {
+		return
+	}
+	active := s.servers[s.active] == srv
+	if srv.down {
+		// Every server is down and this one is active again: keep cycling
+		// so each gets its turn
+		if active {
+			srv.failures = 0
+			s.active = s.next()
+			s.log.Debugf("All servers down, trying %s", s.servers[s.active].Addr)
+		}
+		return
+	}
+	srv.down = true
+	srv.downSince = time.Now()
+	srv.nextCheck = srv.downSince.Add(s.recheck)
+	if !active {
+		s.log.Warnf("[FAILOVER] Server %s down after %d failed dials: %v", srv.Addr, srv.failures, err)
+		return
+	}
+	srv.failures = 0
+	s.active = s.next()
+	s.failovers++
+	s.log.Warnf("[FAILOVER] Server %s down after %d failed dials (%v); switching to %s",
+		srv.Addr, s.after, err, s.servers[s.active].Addr)
+}
+
+// FailOver marks the active server down and switches to the next one, as a
+// run of failed dials would, for trouble dials can't see such as a path
+// that takes data and never answers. It is rechecked like any down server.
+// Reports false if there is no other server to switch to.
+func (s *ServerSet) FailOver(reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.servers) < 2 {
+		return false
+	}
+	srv := s.servers[s.active]
+	srv.failures = 0
+	if !srv.down {
+		srv.down = true
+		srv.downSince = time.Now()
+	}
+	srv.nextCheck = time.Now().Add(s.recheck)
+	s.active = s.next()
+	s.failovers++
+	s.log.Warnf("[FAILOVER] Server %s %s; switching to %s", srv.Addr, reason, s.servers[s.active].Addr)
+	return true
+}
+
+// next is the server after the active one that isn't down, or simply the
+// next one if all are
+func (s *ServerSet) next() int {
+	for i := range len(s.servers) - 1 {
+		j := (s.active + 1 + i) % len(s.servers)
+		if !s.servers[j].down {
+			return j
+		}
+	}
+	return (s.active + 1) % len(s.servers)
+}
+
+func (s *ServerSet) succeeded(srv *upstreamServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	srv.failures = 0
+	if !srv.down {
+		return
+	}
+	srv.down = false
+	i := slices.Index(s.servers, srv)
+	if i < 0 {
+		return // Replaced by a reload meanwhile
+	}
+	if i >= s.active {
+		s.log.Warnf("[FAILOVER] Server %s reachable again after %v", srv.Addr, time.Since(srv.downSince).Round(time.Second))
+		return
+	}
+	s.log.Warnf("[FAILOVER] Server %s reachable again after %v; switching back from %s",
+		srv.Addr, time.Since(srv.downSince).Round(time.Second), s.servers[s.active].Addr)
+	s.active = i
+	s.failovers++
+}
+
+// Snapshot returns the active server and the ones marked down. Safe on a nil set.
+func (s *ServerSet) Snapshot() ServerSetSnapshot {
+	if s == nil {
+		return ServerSetSnapshot{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := ServerSetSnapshot{Servers: len(s.servers), Failovers: s.failovers}
+	if len(s.servers) > 0 {
+		snap.Active = s.servers[s.active].Addr
+	}
+	for _, srv := range s.servers {
+		if srv.down {
+			snap.Down = append(snap.Down, srv.Addr)
+		}
+	}
+	return snap
+}
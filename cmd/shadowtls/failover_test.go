@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer counts dials and fails them while down is set
+type fakeServer struct {
+	down  atomic.Bool
+	dials atomic.Int32
+}
+
+func (f *fakeServer) dial(ctx context.Context) (net.Conn, error) {
+	f.dials.Add(1)
+	if f.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	a, b := net.Pipe()
+	b.Close()
+	return a, nil
+}
+
+func TestServerSetFailover(t *testing.T) {
+	var primary, backup fakeServer
+	s := NewServerSet(2, time.Hour)
+	s.SetServers([]ServerDialer{{"a:443", primary.dial}, {"b:443", backup.dial}})
+	ctx := context.Background()
+
+	if conn, err := s.Dial(ctx); err != nil || primary.dials.Load() != 1 {
+		t.Fatalf("first dial: %v, %d dials to the primary", err, primary.dials.Load())
+	} else {
+		conn.Close()
+	}
+
+	// Failed dials up to the threshold stay on the primary
+	primary.down.Store(true)
+	for range 2 {
+		if _, err := s.Dial(ctx); err == nil {
+			t.Fatal("dial to a down server succeeded")
+		}
+	}
+	snap := s.Snapshot()
+	if snap.Active != "b:443" || len(snap.Down) != 1 || snap.Down[0] != "a:443" || snap.Failovers != 1 {
+		t.Fatalf("after the threshold: %+v, want b active and a down", snap)
+	}
+	if _, err := s.Dial(ctx); err != nil || backup.dials.Load() != 1 {
+		t.Fatalf("dial after failover: %v, %d dials to the backup", err, backup.dials.Load())
+	}
+
+	// No recheck until it is due
+	if primary.dials.Load() != 3 {
+		t.Errorf("%d dials to the primary, want no recheck yet", primary.dials.Load())
+	}
+	primary.down.Store(false)
+	s.mu.Lock()
+	s.servers[0].nextCheck = time.Now()
+	s.mu.Unlock()
+	if _, err := s.Dial(ctx); err != nil || primary.dials.Load() != 4 {
+		t.Fatalf("recheck: %v, %d dials to the primary", err, primary.dials.Load())
+	}
+	snap = s.Snapshot()
+	if snap.Active != "a:443" || len(snap.Down) != 0 || snap.Failovers != 2 {
+		t.Errorf("after recovery: %+v, want a active again", snap)
+	}
+}
+
+// Trouble dials can't see fails over on request, and the server is
+// rechecked like one that refused dials
+func TestServerSetFailOver(t *testing.T) {
+	var primary, backup fakeServer
+	s := NewServerSet(2, time.Hour)
+	s.SetServers([]ServerDialer{{"a:443", primary.dial}})
+	if s.FailOver("looks blackholed") {
+		t.Error("a single server failed over")
+	}
+
+	s.SetServers([]ServerDialer{{"a:443", primary.dial}, {"b:443", backup.dial}})
+	if !s.FailOver("looks blackholed") {
+		t.Fatal("no failover with a backup")
+	}
+	snap := s.Snapshot()
+	if snap.Active != "b:443" || len(snap.Down) != 1 || snap.Down[0] != "a:443" || snap.Failovers != 1 {
+		t.Fatalf("after FailOver: %+v, want b active and a down", snap)
+	}
+	if conn, err := s.Dial(context.Background()); err != nil || backup.dials.Load() != 1 || primary.dials.Load() != 0 {
+		t.Fatalf("dial after FailOver: %v, %d dials to the backup, %d to the primary", err, backup.dials.Load(), primary.dials.Load())
+	} else {
+		conn.Close()
+	}
+}
+
+func TestServerSetAllDown(t *testing.T) {
+	var a, b fakeServer
+	a.down.Store(true)
+	b.down.Store(true)
+	s := NewServerSet(1, time.Hour)
+	s.SetServers([]ServerDialer{{"a:443", a.dial}, {"b:443", b.dial}})
+	for range 4 {
+		s.Dial(context.Background())
+	}
+	// With both down the set keeps cycling rather than stopping on one
+	if snap := s.Snapshot(); len(snap.Down) != 2 || a.dials.Load() == 0 || b.dials.Load() == 0 {
+		t.Errorf("snapshot %+v with %d/%d dials", snap, a.dials.Load(), b.dials.Load())
+	}
+
+	// A later server coming back is used without switching the order back
+	b.down.Store(false)
+	for range 2 {
+		s.Dial(context.Background())
+	}
+	if snap := s.Snapshot(); snap.Active != "b:443" || len(snap.Down) != 1 {
+		t.Errorf("after b recovered: %+v", snap)
+	}
+}
+
+func TestServerSetCancelledDial(t *testing.T) {
+	var a, b fakeServer
+	a.down.Store(true)
+	s := NewServerSet(1, time.Hour)
+	s.SetServers([]ServerDialer{{"a:443", a.dial}, {"b:443", b.dial}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Dial(ctx)
+	if snap := s.Snapshot(); snap.Active != "a:443" || len(snap.Down) != 0 {
+		t.Errorf("a cancelled dial counted as a failure: %+v", snap)
+	}
+}
+
+func TestParseServerList(t *testing.T) {
+	addrs, err := ParseServerList("a.example.com:443, 10.0.0.1:8443")
+	if err != nil || len(addrs) != 2 || addrs[1] != "10.0.0.1:8443" {
+		t.Errorf("ParseServerList = %v, %v", addrs, err)
+	}
+	for _, bad := range []string{"a.example.com", "a:443,", "a:443,,b:443"} {
+		if _, err := ParseServerList(bad); err == nil {
+			t.Errorf("ParseServerList(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+)
+
+// Features describes what this binary supports, so fleet tooling can check
+// capabilities before pushing configs that depend on them
+type Features struct {
+	Version     string   `json:"version"`
+	GoVersion   string   `json:"go_version"`
+	Platform    string   `json:"platform"`
+	Protocol    string   `json:"protocol"`
+	Fingerprint string   `json:"fingerprint"` // uTLS ClientHello fingerprint
+	Transports  []string `json:"transports"`
+	TUN         bool     `json:"tun"`    // Built-in TUN device; without it use tunnel.sh + tun2socks
+	Splice      bool     `json:"splice"` // Zero-copy relay (relay is a buffered userspace copy)
+	Bridge      bool     `json:"bridge"` // Server --upstream chaining to a second ShadowTLS hop
+	Rendezvous  bool     `json:"rendezvous"`
+	Mux         bool     `json:"mux"` // --mux streams over shared tunnels
+	DNS         bool     `json:"dns"` // Client --dns-listen forwarder
+	SystemProxy bool     `json:"system_proxy"`
+	CPULimit    bool     `json:"cpu_limit"` // Server --cpu-limit load shedding
+	Congestion  bool     `json:"congestion_control"`
+	Sandbox     bool     `json:"sandbox"`  // Server --sandbox (Landlock and seccomp)
+	Keychain    string   `json:"keychain"` // Store read by --password-source keychain:
+	PAM         bool     `json:"pam"`      // Server --socks5-auth pam (-tags with_pam)
+	LogTargets  []string `json:"log_targets"`
+	StatsPush   []string `json:"stats_push"`
+}
+
+// CurrentFeatures reports the capabilities of this build on this platform
+func CurrentFeatures() Features {
+	logTargets := []string{"stdout", "stderr", "file"}
+	if syslogSupported {
+		logTargets = append(logTargets, "syslog")
+	}
+	if journaldSupported {
+		logTargets = append(logTargets, "journald")
+	}
+	return Features{
+		Version:     Version(),
+		GoVersion:   runtime.Version(),
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Protocol:    "shadowtls-v3",
+		Fingerprint: stls.FingerprintName(),
+		Transports:  []string{"tcp"},
+		TUN:         false,
+		Splice:      false,
+		Bridge:      true,
+		Rendezvous:  true,
+		Mux:         true,
+		DNS:         true,
+		SystemProxy: systemProxySupported,
+		CPULimit:    cpuLimitSupported,
+		Congestion:  congestionSupported,
+		Sandbox:     sandboxSupported,
+		Keychain:    keychainBackend,
+		PAM:         pamSupported,
+		LogTargets:  logTargets,
+		StatsPush:   []string{"statsd", "graphite", "influx", "influx-udp"},
+	}
+}
+
+// notCompiled is the error for an optional subsystem left out of this build,
+// either because the platform lacks it or a no_* build tag excluded it
+func notCompiled(feature, tag string) error {
+	return fmt.Errorf("%s is not compiled into this binary (unsupported platform or built with -tags %s)", feature, tag)
+}
+
+// notOptedIn is the error for an opt-in subsystem this binary was built
+// without
+func notOptedIn(feature, tag string) error {
+	return fmt.Errorf("%s is not compiled into this binary (build with -tags %s)", feature, tag)
+}
+
+// printVersion writes the version line, or the full feature set as JSON
+func printVersion(w io.Writer, asJSON bool) error {
+	f := CurrentFeatures()
+	if !asJSON {
+		_, err := fmt.Fprintf(w, "shadowtls %s (%s %s, %s)\n", f.Version, f.GoVersion, f.Platform, f.Fingerprint)
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
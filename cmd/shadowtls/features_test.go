@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestPrintVersionJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := printVersion(&b, true); err != nil {
+		t.Fatal(err)
+	}
+	var f Features
+	if err := json.Unmarshal(b.Bytes(), &f); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, b.String())
+	}
+	if f.Version == "" || f.Fingerprint == "" {
+		t.Errorf("missing version or fingerprint: %+v", f)
+	}
+	if !slices.Contains(f.Transports, "tcp") {
+		t.Errorf("transports = %v, want tcp", f.Transports)
+	}
+	if !slices.Contains(f.LogTargets, "file") {
+		t.Errorf("log targets = %v, want file", f.LogTargets)
+	}
+}
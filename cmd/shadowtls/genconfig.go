@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// genVars is the vars file of `shadowtls genconfig`: one output file per
+// node, each rendered with common merged with the node's own values
+type genVars struct {
+	Common map[string]any   `json:"common"`
+	Nodes  []map[string]any `json:"nodes"`
+}
+
+// genFuncs are the template helpers available besides text/template's own
+var genFuncs = template.FuncMap{
+	// json renders a value as JSON, quoting and escaping strings
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// derive turns a master secret and a label into a stable per-node password
+	"derive": func(secret, label any) (string, error) {
+		s, l := fmt.Sprint(secret), fmt.Sprint(label)
+		if s == "" {
+			return "", errors.New("derive: empty secret")
+		}
+		mac := hmac.New(sha256.New, []byte(s))
+		mac.Write([]byte("shadowtun genconfig\x00" + l))
+		return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+	},
+	// add sums integers, e.g. a base port and the node index
+	"add": func(a ...any) (int64, error) {
+		var sum int64
+		for _, v := range a {
+			switch n := v.(type) {
+			case int:
+				sum += int64(n)
+			case json.Number:
+				i, err := n.Int64()
+				if err != nil {
+					return 0, fmt.Errorf("add: %v is not an integer", n)
+				}
+				sum += i
+			default:
+				return 0, fmt.Errorf("add: %v is not a number", v)
+			}
+		}
+		return sum, nil
+	},
+}
+
+// GenFile is one rendered config
+type GenFile struct {
+	Name string
+	Data []byte
+}
+
+// GenerateConfigs renders tmpl once per node in vars. Each node sees the
+// common values overridden by its own, plus "index" (0-based position).
+// name is itself a template giving each file's path; outputs named *.json
+// must parse as JSON objects, so they load with --config.
+func GenerateConfigs(tmpl, name string, vars []byte) ([]GenFile, error) {
+	var v genVars
+	dec := json.NewDecoder(bytes.NewReader(vars))
+	dec.DisallowUnknownFields()
+	dec.UseNumber() // Keep 1000000 from rendering as 1e+06
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to parse vars: %v", err)
+	}
+	if len(v.Nodes) == 0 {
+		return nil, errors.New("vars have no nodes")
+	}
+
+	body, err := template.New("template").Funcs(genFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+	naming, err := template.New("name").Funcs(genFuncs).Option("missingkey=error").Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --name: %v", err)
+	}
+
+	files := make([]GenFile, 0, len(v.Nodes))
+	seen := make(map[string]int)
+	for i, node := range v.Nodes {
+		data := make(map[string]any, len(v.Common)+len(node)+1)
+		for k, val := range v.Common {
+			data[k] = val
+		}
+		for k, val := range node {
+			data[k] = val
+		}
+		data["index"] = i
+
+		var nb bytes.Buffer
+		if err := naming.Execute(&nb, data); err != nil {
+			return nil, fmt.Errorf("node %d: name: %v", i, err)
+		}
+		path := filepath.Clean(strings.TrimSpace(nb.String()))
+		if nb.Len() == 0 || !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("node %d: name %q is not a relative path inside the output directory", i, nb.String())
+		}
+		if j, dup := seen[path]; dup {
+			return nil, fmt.Errorf("nodes %d and %d are both named %s", j, i, path)
+		}
+		seen[path] = i
+
+		var out bytes.Buffer
+		if err := body.Execute(&out, data); err != nil {
+			return nil, fmt.Errorf("node %d (%s): %v", i, path, err)
+		}
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			var obj map[string]any
+			if err := json.Unmarshal(out.Bytes(), &obj); err != nil {
+				return nil, fmt.Errorf("node %d (%s): output is not a JSON config: %v", i, path, err)
+			}
+		}
+		files = append(files, GenFile{Name: path, Data: out.Bytes()})
+	}
+	return files, nil
+}
+
+// runGenConfig implements `shadowtls genconfig`: expand one template into a
+// config file per node
+func runGenConfig(args []string) int {
+	fs := flag.NewFlagSet("genconfig", flag.ContinueOnError)
+	tmplPath := fs.String("template", "", "Template file (Go text/template syntax)")
+	varsPath := fs.String("vars", "", "JSON vars file: {\"common\": {...}, \"nodes\": [{...}, ...]}")
+	outDir := fs.String("out", ".", "Directory to write the generated files to")
+	name := fs.String("name", "{{.name}}.json", "File name template for each node")
+	dryRun := fs.Bool("dry-run", false, "Render and check everything, but only list the files")
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s genconfig --template <file> --vars <vars.json> [--out dir] [--name tmpl]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Renders the template once per node in the vars file. Node values override")
+		fmt.Fprintln(os.Stderr, "\"common\"; {{.index}} is the node's position. Besides text/template built-ins,")
+		fmt.Fprintln(os.Stderr, "templates can use {{json .x}}, {{add .base_port .index}} and")
+		fmt.Fprintln(os.Stderr, "{{derive .master .name}} (a stable per-node password from one secret).")
+		fmt.Fprintln(os.Stderr, "Files named *.json must be valid JSON objects. Nothing is written if any node fails.")
+		fmt.Fprintln(os.Stderr, "")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *tmplPath == "" || *varsPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	tmpl, err := os.ReadFile(*tmplPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read template: %v\n", err)
+		return 1
+	}
+	vars, err := os.ReadFile(*varsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read vars: %v\n", err)
+		return 1
+	}
+	files, err := GenerateConfigs(string(tmpl), *name, vars)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, f := range files {
+		path := filepath.Join(*outDir, f.Name)
+		if *dryRun {
+			fmt.Println(path)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// Configs carry passwords
+		if err := os.WriteFile(path, f.Data, 0o600); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(path)
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const genTemplate = `{
+  "mode": "server",
+  "listen": ":{{add .base_port .index}}",
+  "password": {{json (derive .master .name)}},
+  "handshake": {{json .handshake}},
+  "forward": "127.0.0.1:1080"
+}`
+
+func TestGenerateConfigs(t *testing.T) {
+	vars := `{
+  "common": {"master": "fleet-secret", "base_port": 8443, "handshake": "www.google.com:443"},
+  "nodes": [
+    {"name": "fra1"},
+    {"name": "ams1", "handshake": "www.microsoft.com:443"}
+  ]
+}`
+	files, err := GenerateConfigs(genTemplate, "servers/{{.name}}.json", []byte(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "servers/fra1.json" || files[1].Name != "servers/ams1.json" {
+		t.Fatalf("files = %+v", files)
+	}
+
+	var fra, ams map[string]string
+	if err := json.Unmarshal(files[0].Data, &fra); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(files[1].Data, &ams); err != nil {
+		t.Fatal(err)
+	}
+	if fra["listen"] != ":8443" || ams["listen"] != ":8444" {
+		t.Errorf("listen = %q, %q, want :8443 and :8444", fra["listen"], ams["listen"])
+	}
+	if fra["handshake"] != "www.google.com:443" || ams["handshake"] != "www.microsoft.com:443" {
+		t.Errorf("node values should override common: %q, %q", fra["handshake"], ams["handshake"])
+	}
+	if len(fra["password"]) != 32 || fra["password"] == ams["password"] {
+		t.Errorf("derived passwords %q, %q should be distinct per node", fra["password"], ams["password"])
+	}
+
+	again, err := GenerateConfigs(genTemplate, "servers/{{.name}}.json", []byte(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again[0].Data) != string(files[0].Data) {
+		t.Error("output is not reproducible across runs")
+	}
+}
+
+func TestGenerateConfigsErrors(t *testing.T) {
+	tests := []struct {
+		desc, tmpl, name, vars, want string
+	}{
+		{"missing var", genTemplate, "{{.name}}.json", `{"nodes": [{"name": "a", "base_port": 1}]}`, "master"},
+		{"no nodes", genTemplate, "{{.name}}.json", `{"common": {}}`, "no nodes"},
+		{"unknown section", genTemplate, "{{.name}}.json", `{"node": []}`, "unknown field"},
+		{"duplicate name", `{}`, "{{.name}}.json", `{"nodes": [{"name": "a"}, {"name": "a"}]}`, "both named a.json"},
+		{"escaping name", `{}`, "../{{.name}}.json", `{"nodes": [{"name": "a"}]}`, "not a relative path"},
+		{"invalid json", `{"listen": {{.port}}`, "{{.name}}.json", `{"nodes": [{"name": "a", "port": 1}]}`, "not a JSON config"},
+	}
+	for _, tt := range tests {
+		_, err := GenerateConfigs(tt.tmpl, tt.name, []byte(tt.vars))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.desc, err, tt.want)
+		}
+	}
+
+	// Other extensions are not checked, e.g. for YAML or env files
+	if _, err := GenerateConfigs(`port: {{.port}}`, "{{.name}}.yaml", []byte(`{"nodes": [{"name": "a", "port": 1}]}`)); err != nil {
+		t.Errorf("yaml output: %v", err)
+	}
+}
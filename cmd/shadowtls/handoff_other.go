@@ -0,0 +1,41 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errHandoffUnsupported = errors.New("--handoff is not supported on this platform")
+
+// handoffState is sent with the listener FD from a running client to its
+// successor
+type handoffState struct {
+	Version string `json:"version"`
+	PID     int    `json:"pid"`
+	Listen  string `json:"listen"`
+}
+
+type Handoff struct {
+	Listener net.Listener
+	State    handoffState
+}
+
+func ReceiveHandoff(path, listenAddr string) (*Handoff, error) {
+	return nil, errHandoffUnsupported
+}
+
+func (h *Handoff) Commit() error {
+	return errHandoffUnsupported
+}
+
+type HandoffServer struct{}
+
+func ServeHandoff(path, listenAddr string, listener net.Listener, onHandoff func(), log *logrus.Logger) (*HandoffServer, error) {
+	return nil, errHandoffUnsupported
+}
+
+func (s *HandoffServer) Close() {}
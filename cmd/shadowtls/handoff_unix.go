@@ -0,0 +1,248 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	handoffDialTimeout  = 2 * time.Second  // Waiting for a predecessor to answer
+	handoffReadyTimeout = 30 * time.Second // Successor setup before the predecessor gives up
+	handoffReady        = "ready\n"
+)
+
+// handoffState is sent with the listener FD from a running client to its
+// successor
+type handoffState struct {
+	Version string `json:"version"`
+	PID     int    `json:"pid"`
+	Listen  string `json:"listen"`
+}
+
+// Handoff is the successor side of an upgrade: the listener inherited from
+// the predecessor and the connection used to tell it to step down
+type Handoff struct {
+	Listener net.Listener
+	State    handoffState
+	conn     *net.UnixConn
+}
+
+// ReceiveHandoff asks a client already serving on the handoff socket at path
+// for its listener. It returns nil without error when nobody answers, so the
+// caller binds normally. The predecessor keeps accepting until Commit.
+func ReceiveHandoff(path, listenAddr string) (*Handoff, error) {
+	c, err := net.DialTimeout("unix", path, handoffDialTimeout)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("handoff %s: %v", path, err)
+	}
+	conn := c.(*net.UnixConn)
+	conn.SetReadDeadline(time.Now().Add(handoffDialTimeout))
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handoff %s: read state: %v", path, err)
+	}
+	file, err := parseRights(oob[:oobn])
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handoff %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var state handoffState
+	if err := json.Unmarshal(buf[:n], &state); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handoff %s: bad state: %v", path, err)
+	}
+	if state.Listen != listenAddr {
+		// Declining leaves the predecessor running untouched
+		conn.Close()
+		return nil, fmt.Errorf("handoff %s: predecessor listens on %s, not %s", path, state.Listen, listenAddr)
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handoff %s: inherit listener: %v", path, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	return &Handoff{Listener: listener, State: state, conn: conn}, nil
+}
+
+// parseRights extracts the single FD passed in a control message
+func parseRights(oob []byte) (*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("parse control message: %v", err)
+	}
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil || len(fds) == 0 {
+			continue
+		}
+		for _, fd := range fds[1:] {
+			syscall.Close(fd)
+		}
+		return os.NewFile(uintptr(fds[0]), "listener"), nil
+	}
+	return nil, errors.New("no listener descriptor received")
+}
+
+// Commit tells the predecessor to stop accepting and waits until it has
+// released the handoff socket, so the caller can serve it next
+func (h *Handoff) Commit() error {
+	defer h.conn.Close()
+	if _, err := h.conn.Write([]byte(handoffReady)); err != nil {
+		return fmt.Errorf("handoff: %v", err)
+	}
+	// The predecessor closes its end after removing the socket file
+	h.conn.SetReadDeadline(time.Now().Add(handoffDialTimeout))
+	h.conn.Read(make([]byte, 1))
+	return nil
+}
+
+// HandoffServer is the predecessor side: it hands the listener to any
+// successor that connects and calls onHandoff once one takes over
+type HandoffServer struct {
+	ul        *net.UnixListener
+	path      string
+	closeOnce sync.Once
+	listener  *net.TCPListener
+	state     handoffState
+	onHandoff func()
+	log       *logrus.Logger
+}
+
+// ServeHandoff offers listener, bound for listenAddr, on the unix socket at
+// path, replacing a stale socket file left by a crashed process
+func ServeHandoff(path, listenAddr string, listener net.Listener, onHandoff func(), log *logrus.Logger) (*HandoffServer, error) {
+	tl, ok := listener.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("handoff: listener is %T, not TCP", listener)
+	}
+	if c, err := net.DialTimeout("unix", path, handoffDialTimeout); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("handoff socket %s is in use by another process", path)
+	}
+	os.Remove(path)
+
+	ul, err := listenPrivateUnix(path)
+	if err != nil {
+		return nil, fmt.Errorf("handoff: %v", err)
+	}
+
+	s := &HandoffServer{
+		ul:       ul,
+		path:     path,
+		listener: tl,
+		state: handoffState{
+			Version: Version(),
+			PID:     os.Getpid(),
+			Listen:  listenAddr,
+		},
+		onHandoff: onHandoff,
+		log:       log,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// listenPrivateUnix binds a unix socket at path that only this user can
+// connect to. It is bound in a new 0700 directory, made private there and
+// then renamed into place, so no other user can reach it in between and
+// take the listener.
+func listenPrivateUnix(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".handoff-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would unlink tmp on Close; Close removes path instead
+	ul.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0o600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ul.Close()
+		return nil, err
+	}
+	return ul, nil
+}
+
+// Close stops offering the listener and removes the socket file. After a
+// handoff the file belongs to the successor and is left alone.
+func (s *HandoffServer) Close() {
+	s.closeOnce.Do(func() {
+		s.ul.Close()
+		os.Remove(s.path)
+	})
+}
+
+func (s *HandoffServer) serve() {
+	for {
+		conn, err := s.ul.AcceptUnix()
+		if err != nil {
+			return
+		}
+		if s.offer(conn) {
+			// Release everything before the successor's Commit returns
+			s.Close()
+			s.onHandoff()
+			conn.Close()
+			return
+		}
+		conn.Close()
+	}
+}
+
+// offer sends the listener to one successor and reports whether it took over
+func (s *HandoffServer) offer(conn *net.UnixConn) bool {
+	raw, err := s.listener.SyscallConn()
+	if err != nil {
+		s.log.Warnf("Handoff: %v", err)
+		return false
+	}
+	state, _ := json.Marshal(s.state)
+	// Control rather than File: File().Fd() would switch the shared socket to blocking mode
+	var sendErr error
+	if err := raw.Control(func(fd uintptr) {
+		_, _, sendErr = conn.WriteMsgUnix(state, syscall.UnixRights(int(fd)), nil)
+	}); err != nil {
+		sendErr = err
+	}
+	if sendErr != nil {
+		s.log.Warnf("Handoff: send listener: %v", sendErr)
+		return false
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != handoffReady {
+		s.log.Warnf("Handoff: successor did not take over, keep serving")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReceiveHandoffNoPredecessor(t *testing.T) {
+	h, err := ReceiveHandoff(filepath.Join(t.TempDir(), "handoff.sock"), "127.0.0.1:1080")
+	if h != nil || err != nil {
+		t.Errorf("ReceiveHandoff = %v, %v, want nil, nil", h, err)
+	}
+}
+
+func TestHandoffListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	handedOff := make(chan struct{})
+	hs, err := ServeHandoff(path, addr, l, func() {
+		close(handedOff)
+		l.Close()
+	}, ModuleLogger("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket file %v, %v; want mode 0600", info, err)
+	}
+
+	if _, err := ServeHandoff(path, addr, l, func() {}, ModuleLogger("client")); err == nil {
+		t.Error("second ServeHandoff on a live socket should fail")
+	}
+	// A successor configured for another address declines and changes nothing
+	if h, err := ReceiveHandoff(path, "127.0.0.1:1"); h != nil || err == nil {
+		t.Fatalf("mismatched ReceiveHandoff = %v, %v, want an error", h, err)
+	}
+
+	h, err := ReceiveHandoff(path, addr)
+	if err != nil || h == nil {
+		t.Fatalf("ReceiveHandoff = %v, %v", h, err)
+	}
+	defer h.Listener.Close()
+	if err := h.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handedOff:
+	default:
+		t.Fatal("Commit returned before the predecessor stepped down")
+	}
+
+	// The inherited listener serves the same address
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := h.Listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	// The socket path is free for the successor to serve next
+	hs2, err := ServeHandoff(path, addr, h.Listener, func() {}, ModuleLogger("client"))
+	if err != nil {
+		t.Fatalf("successor ServeHandoff: %v", err)
+	}
+	// The predecessor's deferred Close leaves the successor's socket alone
+	hs.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("predecessor Close removed the successor's socket: %v", err)
+	}
+	hs2.Close()
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 0 {
+		t.Errorf("left behind %v after Close", entries)
+	}
+}
+
+// An upgrade keeps the old process's open connection alive while new
+// connections go to the successor
+func TestClientHandoff(t *testing.T) {
+	rig, err := startSoakRig(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rig.stop()
+
+	cfg := *rig.client.config
+	rig.client.Stop()
+	cfg.Handoff = filepath.Join(t.TempDir(), "handoff.sock")
+	cfg.ReloadPolicy = ReloadPolicy{Mode: ReloadDrain}
+
+	// start runs a client; the channel receives Run's result when it returns
+	start := func() (*Client, <-chan error, error) {
+		c := NewClient(&cfg)
+		done := make(chan error, 1)
+		go func() { done <- c.Run() }()
+		select {
+		case <-c.Ready():
+			return c, done, nil
+		case err := <-done:
+			return nil, nil, err
+		case <-time.After(10 * time.Second):
+			t.Fatal("client did not start")
+		}
+		return nil, nil, nil
+	}
+	echo := func(conn net.Conn, msg string) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+			t.Fatalf("echo %q = %q, %v", msg, buf, err)
+		}
+	}
+
+	old, oldDone, err := start()
+	for i := 0; old == nil && i < 50; i++ {
+		// The rig client may hold the port for a moment after Stop
+		time.Sleep(50 * time.Millisecond)
+		old, oldDone, err = start()
+	}
+	if old == nil {
+		t.Fatalf("old client did not start: %v", err)
+	}
+	defer old.Stop()
+
+	flow, err := net.Dial("tcp", rig.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flow.Close()
+	echo(flow, "before")
+
+	next, nextDone, err := start()
+	if next == nil {
+		t.Fatalf("successor did not start: %v", err)
+	}
+	defer func() {
+		next.Stop()
+		<-nextDone
+	}()
+
+	fresh, err := net.Dial("tcp", rig.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(fresh, "fresh")
+	fresh.Close()
+	if n := next.stats.TotalConns.Load(); n != 1 {
+		t.Errorf("successor handled %d connections, want the new one", n)
+	}
+
+	// The old process drains: its open flow still works, then it exits
+	echo(flow, "after")
+	flow.Close()
+	select {
+	case err := <-oldDone:
+		if err != nil {
+			t.Errorf("old client Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("old client did not exit after draining")
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	shadowtls "github.com/metacubex/sing-shadowtls"
+	M "github.com/metacubex/sing/common/metadata"
+)
+
+// handshakeSlotTimeout bounds how long one connection can hold a handshake
+// slot; connections that stall mid-handshake never finish it, so their slot
+// is released by this timeout
+const handshakeSlotTimeout = 10 * time.Second
+
+// errHandshakeQueueFull is returned when too many handshakes are waiting
+var errHandshakeQueueFull = errors.New("handshake queue full")
+
+// errHandshakeSourceBusy is returned when one source already holds or waits
+// for its share of handshake slots
+var errHandshakeSourceBusy = errors.New("too many handshakes from this source")
+
+// HandshakeLimiter bounds concurrent handshakes so a burst of new connections
+// cannot starve established ones of CPU. Waiters beyond the queue depth are
+// rejected immediately. A connection that sends nothing holds its slot until
+// handshakeSlotTimeout, so each source may also only hold or wait for a few
+// slots at once; otherwise a few hundred idle connections from one host
+// would fill the queue and lock everyone else out. A nil limiter imposes no
+// limit.
+type HandshakeLimiter struct {
+	slots     chan struct{}
+	maxQueue  int64
+	perSource int
+
+	mu      sync.Mutex
+	sources map[netip.Prefix]int // Slots held or waited for per source
+
+	queued         atomic.Int64
+	acquired       atomic.Uint64
+	completed      atomic.Uint64
+	rejected       atomic.Uint64
+	sourceRejected atomic.Uint64
+	waitTotal      atomic.Int64 // Nanoseconds spent waiting for a slot
+}
+
+// NewHandshakeLimiter allows concurrency handshakes at once with up to queue
+// more waiting, and at most perSource of those from one source (0 for no
+// per-source bound). Returns nil (no limit) if concurrency is 0.
+func NewHandshakeLimiter(concurrency, queue, perSource int) *HandshakeLimiter {
+	if concurrency <= 0 {
+		return nil
+	}
+	return &HandshakeLimiter{
+		slots:     make(chan struct{}, concurrency),
+		maxQueue:  int64(queue),
+		perSource: perSource,
+		sources:   make(map[netip.Prefix]int),
+	}
+}
+
+// handshakeSource groups connections by the source they count against:
+// their IPv4 address, or the /64 of an IPv6 one, since a single host can
+// usually pick any address in its /64. ok is false for an address without
+// an IP, such as a unix socket's.
+func handshakeSource(addr net.Addr) (src netip.Prefix, ok bool) {
+	tcp, isTCP := addr.(*net.TCPAddr)
+	if !isTCP {
+		return netip.Prefix{}, false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, 32), true
+	}
+	src, err := ip.Prefix(64)
+	return src, err == nil
+}
+
+// Acquire waits for a handshake slot for a connection from src, nil if it
+// has no source to bound. The returned release is safe to call more than
+// once. The slot is also freed automatically after handshakeSlotTimeout, but
+// the connection keeps counting against its source until release, so a
+// source's stalled connections can't outlast the timeout to take more.
+func (l *HandshakeLimiter) Acquire(ctx context.Context, src net.Addr) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	leave, err := l.enter(src)
+	if err != nil {
+		return nil, err
+	}
+	free, err := l.acquire(ctx)
+	if err != nil {
+		leave()
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		free()
+		once.Do(leave)
+	}, nil
+}
+
+// enter counts a slot held or waited for against src, failing once src has
+// perSource of them. The returned leave gives it back.
+func (l *HandshakeLimiter) enter(addr net.Addr) (leave func(), err error) {
+	src, ok := handshakeSource(addr)
+	if l.perSource <= 0 || !ok {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sources[src] >= l.perSource {
+		l.sourceRejected.Add(1)
+		return nil, errHandshakeSourceBusy
+	}
+	l.sources[src]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.sources[src]--; l.sources[src] == 0 {
+			delete(l.sources, src)
+		}
+	}, nil
+}
+
+// acquire waits for a slot without regard to the source
+func (l *HandshakeLimiter) acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if l.queued.Add(1) > l.maxQueue {
+			l.queued.Add(-1)
+			l.rejected.Add(1)
+			return nil, errHandshakeQueueFull
+		}
+		start := time.Now()
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.queued.Add(-1)
+			return nil, ctx.Err()
+		}
+		l.queued.Add(-1)
+		l.waitTotal.Add(int64(time.Since(start)))
+	}
+	l.acquired.Add(1)
+
+	var once sync.Once
+	timer := time.AfterFunc(handshakeSlotTimeout, func() {
+		once.Do(func() { <-l.slots })
+	})
+	return func() {
+		once.Do(func() {
+			timer.Stop()
+			<-l.slots
+			l.completed.Add(1)
+		})
+	}, nil
+}
+
+// HandshakeSnapshot is a point-in-time view of handshake limiting
+type HandshakeSnapshot struct {
+	Active         int           // Handshakes holding a slot
+	Queued         int64         // Handshakes waiting for a slot
+	Completed      uint64        // Slots released by a finished handshake
+	Rejected       uint64        // Connections refused with the queue full
+	SourceRejected uint64        // Connections refused with their source's share taken
+	AvgWait        time.Duration // Mean wait for a slot
+}
+
+// Snapshot returns the current state; zero for a nil limiter
+func (l *HandshakeLimiter) Snapshot() HandshakeSnapshot {
+	if l == nil {
+		return HandshakeSnapshot{}
+	}
+	snap := HandshakeSnapshot{
+		Active:    len(l.slots),
+		Queued:    l.queued.Load(),
+		Completed: l.completed.Load(),
+		Rejected:  l.rejected.Load(),
+	}
+	snap.SourceRejected = l.sourceRejected.Load()
+	if n := l.acquired.Load(); n > 0 {
+		snap.AvgWait = time.Duration(l.waitTotal.Load() / int64(n))
+	}
+	return snap
+}
+
+// HandshakeRate spaces out new tunnel handshakes with a token bucket, so a
+// burst of connections never shows up as a spike of simultaneous TLS
+// handshakes to the camouflage SNI. A nil rate imposes no limit.
+type HandshakeRate struct {
+	interval time.Duration // Between tokens
+	burst    int
+
+	mu  sync.Mutex
+	tat time.Time // When the bucket would be full again
+
+	delayed    atomic.Uint64
+	delayTotal atomic.Int64 // Nanoseconds spent waiting for a token
+}
+
+// NewHandshakeRate allows perSecond handshakes on average, burst at once.
+// Returns nil (no limit) if perSecond is 0.
+func NewHandshakeRate(perSecond float64, burst int) *HandshakeRate {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &HandshakeRate{
+		interval: time.Duration(float64(time.Second) / perSecond),
+		burst:    max(burst, 1),
+	}
+}
+
+// Wait blocks until a handshake may start
+func (r *HandshakeRate) Wait(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	now := time.Now()
+	t := r.tat
+	if t.Before(now) {
+		t = now
+	}
+	wait := t.Sub(now) - time.Duration(r.burst-1)*r.interval
+	r.tat = t.Add(r.interval)
+	r.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	r.delayed.Add(1)
+	r.delayTotal.Add(int64(wait))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Hand the unused token back
+		r.mu.Lock()
+		r.tat = r.tat.Add(-r.interval)
+		r.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// HandshakeRateSnapshot is a point-in-time view of handshake pacing
+type HandshakeRateSnapshot struct {
+	Delayed  uint64        // Handshakes that waited for a token
+	AvgDelay time.Duration // Mean wait of those
+}
+
+// Snapshot returns the counters; zero for a nil rate
+func (r *HandshakeRate) Snapshot() HandshakeRateSnapshot {
+	if r == nil {
+		return HandshakeRateSnapshot{}
+	}
+	snap := HandshakeRateSnapshot{Delayed: r.delayed.Load()}
+	if snap.Delayed > 0 {
+		snap.AvgDelay = time.Duration(r.delayTotal.Load() / int64(snap.Delayed))
+	}
+	return snap
+}
+
+// handshakeDoneKey carries the func a connection runs once it authenticates
+// in its context: it releases the handshake slot and lifts the session timeout
+type handshakeDoneKey struct{}
+
+// handshakeDoneHandler runs the handshake done func once the ShadowTLS
+// service hands over an authenticated connection, before the long-lived
+// relay starts
+type handshakeDoneHandler struct {
+	shadowtls.Handler
+}
+
+func (h handshakeDoneHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if done, ok := ctx.Value(handshakeDoneKey{}).(func()); ok {
+		done()
+	}
+	return h.Handler.NewConnection(ctx, conn, metadata)
+}
+
+// tlsRecordApplicationData is the TLS record type that carries the client
+// Finished in TLS 1.3, and everything after it
+const tlsRecordApplicationData = 23
+
+// The record and handshake types of a ClientHello
+const (
+	tlsRecordHandshake = 22
+	tlsClientHello     = 1
+)
+
+// handshakeWatchConn calls done when the client sends its first application
+// data record, i.e. once its side of the TLS handshake is complete. Pooled
+// client tunnels stay idle after that until they are used, and must not hold
+// a handshake slot while they wait for their first authenticated frame. If
+// hello is set, it is first called with the client's first record, its
+// ClientHello.
+type handshakeWatchConn struct {
+	net.Conn
+	hello  func(frame []byte)
+	done   func()
+	fired  bool
+	first  []byte // The first record while it arrives
+	hdr    [5]byte
+	hdrLen int
+	body   int // Bytes left in the current record body
+}
+
+func (c *handshakeWatchConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.fired {
+		c.scan(p[:n])
+	}
+	return n, err
+}
+
+// scan follows record boundaries through b
+func (c *handshakeWatchConn) scan(b []byte) {
+	for len(b) > 0 {
+		if c.body > 0 {
+			k := min(c.body, len(b))
+			c.body -= k
+			c.capture(b[:k])
+			b = b[k:]
+			continue
+		}
+		k := copy(c.hdr[c.hdrLen:], b)
+		c.hdrLen += k
+		b = b[k:]
+		if c.hdrLen < len(c.hdr) {
+			return
+		}
+		c.hdrLen = 0
+		c.body = int(c.hdr[3])<<8 | int(c.hdr[4])
+		if c.hello != nil {
+			c.first = append(make([]byte, 0, len(c.hdr)+c.body), c.hdr[:]...)
+			c.capture(nil)
+		}
+		if c.hdr[0] == tlsRecordApplicationData {
+			c.fired = true
+			c.done()
+			return
+		}
+	}
+}
+
+// capture collects b into the first record and hands it to hello once complete
+func (c *handshakeWatchConn) capture(b []byte) {
+	if c.first == nil {
+		return
+	}
+	c.first = append(c.first, b...)
+	if c.body == 0 {
+		hello, frame := c.hello, c.first
+		c.hello, c.first = nil, nil
+		hello(frame)
+	}
+}
+
+// ShadowTLS v3 ClientHello layout: the session ID follows the record and
+// handshake headers, version and random, and its last bytes are an HMAC
+const (
+	tlsSessionIDIndex = 5 + 1 + 3 + 2 + 32 // Index of the session ID length
+	tlsSessionIDSize  = 32
+	clientHelloHMAC   = 4
+)
+
+// clientHelloAuthenticated reports whether frame, a client's first record,
+// is a ShadowTLS v3 ClientHello signed with password. The service checks the
+// same before it decides between relaying a client and handing a visitor to
+// the handshake server.
+func clientHelloAuthenticated(frame []byte, password string) bool {
+	const hmacIndex = tlsSessionIDIndex + 1 + tlsSessionIDSize - clientHelloHMAC
+	if len(frame) < tlsSessionIDIndex+1+tlsSessionIDSize || frame[0] != tlsRecordHandshake || frame[5] != tlsClientHello ||
+		frame[tlsSessionIDIndex] != tlsSessionIDSize {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(password))
+	mac.Write(frame[5:hmacIndex])
+	mac.Write(make([]byte, clientHelloHMAC))
+	mac.Write(frame[hmacIndex+clientHelloHMAC:])
+	return hmac.Equal(frame[hmacIndex:hmacIndex+clientHelloHMAC], mac.Sum(nil)[:clientHelloHMAC])
+}
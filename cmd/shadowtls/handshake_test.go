@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+	M "github.com/metacubex/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	l := NewHandshakeLimiter(1, 1, 0)
+
+	release, err := l.Acquire(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second handshake queues behind the first
+	got := make(chan func(), 1)
+	go func() {
+		r, err := l.Acquire(context.Background(), nil)
+		if err != nil {
+			t.Error(err)
+			close(got)
+			return
+		}
+		got <- r
+	}()
+	deadline := time.Now().Add(time.Second)
+	for l.Snapshot().Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("second handshake never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// With one running and one queued, the third is rejected
+	if _, err := l.Acquire(context.Background(), nil); !errors.Is(err, errHandshakeQueueFull) {
+		t.Errorf("third Acquire: got %v, want queue full", err)
+	}
+
+	release()
+	release() // Releasing twice must not free a second slot
+	select {
+	case r := <-got:
+		r()
+	case <-time.After(time.Second):
+		t.Fatal("queued handshake did not get the released slot")
+	}
+
+	snap := l.Snapshot()
+	if snap.Active != 0 || snap.Queued != 0 || snap.Completed != 2 || snap.Rejected != 1 {
+		t.Errorf("snapshot = %+v, want 0 active, 0 queued, 2 completed, 1 rejected", snap)
+	}
+}
+
+func TestHandshakeLimiterCancel(t *testing.T) {
+	l := NewHandshakeLimiter(1, 10, 0)
+	release, _ := l.Acquire(context.Background(), nil)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+	if q := l.Snapshot().Queued; q != 0 {
+		t.Errorf("cancelled waiter still counted as queued: %d", q)
+	}
+}
+
+// Idle connections from one source can't take the slots and queue from
+// everyone else
+func TestHandshakeLimiterPerSource(t *testing.T) {
+	l := NewHandshakeLimiter(1, 10, 2)
+	attacker := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	neighbour := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000}
+	sameSlash64 := &net.TCPAddr{IP: net.ParseIP("2001:db8::ffff"), Port: 2000}
+
+	release, err := l.Acquire(context.Background(), attacker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Acquire(ctx, attacker)
+	deadline := time.Now().Add(time.Second)
+	for l.Snapshot().Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("second handshake never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.Acquire(context.Background(), attacker); !errors.Is(err, errHandshakeSourceBusy) {
+		t.Errorf("third Acquire from one source: got %v, want source busy", err)
+	}
+
+	// Other sources still queue; an IPv6 /64 counts as one source
+	go l.Acquire(ctx, neighbour)
+	for l.Snapshot().Queued != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("other source never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go l.Acquire(ctx, sameSlash64)
+	for l.Snapshot().Queued != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("second address of the /64 never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.Acquire(context.Background(), neighbour); !errors.Is(err, errHandshakeSourceBusy) {
+		t.Errorf("third Acquire from one /64: got %v, want source busy", err)
+	}
+
+	// Releasing gives the source its share back
+	release()
+	cancel()
+	for l.Snapshot().Queued != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled waiters still queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		r, err := l.Acquire(context.Background(), attacker)
+		if err == nil {
+			r()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("source still busy after its handshakes ended: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := l.Snapshot().SourceRejected; n != 2 {
+		t.Errorf("SourceRejected = %d, want 2", n)
+	}
+
+	// Connections without an IP address aren't bounded per source
+	unix := &net.UnixAddr{Name: "@", Net: "unix"}
+	for i := 0; i < 3; i++ {
+		r, err := l.Acquire(context.Background(), unix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r()
+	}
+}
+
+func TestHandshakeLimiterNil(t *testing.T) {
+	l := NewHandshakeLimiter(0, 0, 0)
+	if l != nil {
+		t.Fatal("zero concurrency should disable the limiter")
+	}
+	release, err := l.Acquire(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if snap := l.Snapshot(); snap != (HandshakeSnapshot{}) {
+		t.Errorf("nil limiter snapshot = %+v", snap)
+	}
+}
+
+type chunkConn struct {
+	net.Conn
+	chunks [][]byte
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return n, nil
+}
+
+func TestHandshakeWatchConn(t *testing.T) {
+	rec := func(typ byte, n int) []byte {
+		return append([]byte{typ, 3, 3, byte(n >> 8), byte(n)}, make([]byte, n)...)
+	}
+	var stream []byte
+	stream = append(stream, rec(22, 600)...) // ClientHello
+	stream = append(stream, rec(20, 1)...)   // ChangeCipherSpec
+	stream = append(stream, rec(23, 53)...)  // Finished
+
+	// Split at awkward points, including inside the record headers
+	var chunks [][]byte
+	for _, cut := range []int{3, 300, 304, 4} {
+		chunks = append(chunks, stream[:cut])
+		stream = stream[cut:]
+	}
+	chunks = append(chunks, stream)
+
+	fired := 0
+	var hellos [][]byte
+	conn := &handshakeWatchConn{Conn: nil, done: func() { fired++ }}
+	conn.hello = func(frame []byte) { hellos = append(hellos, frame) }
+	conn.Conn = &chunkConn{chunks: chunks}
+	buf := make([]byte, 1024)
+	for i := 0; i < 4; i++ {
+		conn.Read(buf)
+		if fired != 0 {
+			t.Fatalf("done fired during handshake records (read %d)", i)
+		}
+	}
+	conn.Read(buf)
+	if fired != 1 {
+		t.Fatalf("done fired %d times after the first application data record, want 1", fired)
+	}
+	if len(hellos) != 1 || !bytes.Equal(hellos[0], rec(22, 600)) {
+		t.Errorf("hello got %d frames, want the ClientHello record once", len(hellos))
+	}
+}
+
+// A real client's ClientHello verifies with its password and no other
+func TestClientHelloAuthenticated(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := stls.NewClient(l.Addr().String(), "www.example.com", "secret", 5*time.Second, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Dial(context.Background())
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	frame := make(chan []byte, 1)
+	conn := &handshakeWatchConn{Conn: c, hello: func(b []byte) { frame <- b }, done: func() {}}
+	buf := make([]byte, 1024)
+	for len(frame) == 0 {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hello := <-frame
+	if !clientHelloAuthenticated(hello, "secret") {
+		t.Error("ClientHello not authenticated with the client's password")
+	}
+	if clientHelloAuthenticated(hello, "other") {
+		t.Error("ClientHello authenticated with another password")
+	}
+	if clientHelloAuthenticated(hello[:40], "secret") {
+		t.Error("truncated ClientHello authenticated")
+	}
+}
+
+func TestHandshakeRate(t *testing.T) {
+	r := NewHandshakeRate(20, 2) // A token every 50ms
+	ctx := context.Background()
+
+	start := time.Now()
+	for range 2 {
+		if err := r.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Errorf("burst of 2 took %v, want no wait", elapsed)
+	}
+	for range 2 {
+		if err := r.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("4 handshakes took %v, want about 100ms past the burst", elapsed)
+	}
+	if snap := r.Snapshot(); snap.Delayed != 2 || snap.AvgDelay <= 0 {
+		t.Errorf("snapshot = %+v, want 2 delayed", snap)
+	}
+
+	// A cancelled wait gives its token back
+	r.mu.Lock()
+	before := r.tat
+	r.mu.Unlock()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := r.Wait(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait = %v", err)
+	}
+	r.mu.Lock()
+	after := r.tat
+	r.mu.Unlock()
+	if !after.Equal(before) {
+		t.Errorf("bucket moved %v after a cancelled wait, want the token back", after.Sub(before))
+	}
+}
+
+func TestHandshakeRateNil(t *testing.T) {
+	r := NewHandshakeRate(0, 4)
+	if r != nil {
+		t.Fatal("zero rate should disable pacing")
+	}
+	if err := r.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if snap := r.Snapshot(); snap != (HandshakeRateSnapshot{}) {
+		t.Errorf("nil rate snapshot = %+v", snap)
+	}
+}
+
+type deadlineRecorder struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *deadlineRecorder) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+type recordingHandler struct {
+	sawDeadline time.Time
+	conn        *deadlineRecorder
+}
+
+func (h *recordingHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.sawDeadline = h.conn.deadline
+	return nil
+}
+
+func (h *recordingHandler) NewError(ctx context.Context, err error) {}
+
+// The session timeout must be lifted before the relay starts, or every
+// long-lived connection would be cut after --session-timeout
+func TestHandshakeDoneHandlerLiftsSessionTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := &deadlineRecorder{Conn: a}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	released := false
+	ctx := context.WithValue(context.Background(), handshakeDoneKey{}, func() {
+		released = true
+		conn.SetDeadline(time.Time{})
+	})
+	inner := &recordingHandler{conn: conn}
+	if err := (handshakeDoneHandler{inner}).NewConnection(ctx, conn, M.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if !released {
+		t.Error("handshake done func was not called")
+	}
+	if !inner.sawDeadline.IsZero() {
+		t.Errorf("handler saw deadline %v, want none", inner.sawDeadline)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHistoryKeep and DefaultHistoryInterval are the defaults for
+	// --stats-history and --stats-history-interval: a day at one-minute
+	// resolution, a few hundred KB
+	DefaultHistoryKeep     = 24 * time.Hour
+	DefaultHistoryInterval = time.Minute
+)
+
+// StatsHistory keeps the pushed metrics of recent stats snapshots in a ring,
+// so short-term history is available from the admin endpoint without any
+// monitoring infrastructure
+type StatsHistory struct {
+	interval time.Duration
+	names    []string // Metric names, in snapshotMetrics order
+
+	mu     sync.Mutex
+	times  []time.Time
+	values [][]float64 // values[i][j] is metric j at times[i]
+	next   int         // Ring slot written next
+	full   bool
+}
+
+// StatsSeries is a columnar time series: Series[name][i] was taken at Times[i]
+type StatsSeries struct {
+	Interval string               `json:"interval"`
+	Times    []int64              `json:"times"` // Unix seconds
+	Series   map[string][]float64 `json:"series"`
+}
+
+// NewStatsHistory keeps keep worth of samples taken every interval
+func NewStatsHistory(keep, interval time.Duration) *StatsHistory {
+	size := max(int(keep/interval), 1)
+	var names []string
+	for _, m := range snapshotMetrics(StatsSnapshot{}) {
+		names = append(names, m.name)
+	}
+	return &StatsHistory{
+		interval: interval,
+		names:    names,
+		times:    make([]time.Time, size),
+		values:   make([][]float64, size),
+	}
+}
+
+// Record stores snap as taken at now, overwriting the oldest sample when full
+func (h *StatsHistory) Record(now time.Time, snap StatsSnapshot) {
+	metrics := snapshotMetrics(snap)
+	values := make([]float64, len(metrics))
+	for i, m := range metrics {
+		values[i] = m.value
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.times[h.next] = now
+	h.values[h.next] = values
+	h.next = (h.next + 1) % len(h.times)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Run records a snapshot every interval until ctx is done
+func (h *StatsHistory) Run(ctx context.Context, snapshot func() StatsSnapshot) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.Record(now, snapshot())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Query returns the samples taken at or after since, oldest first, limited
+// to the named metrics or all of them if names is empty
+func (h *StatsHistory) Query(since time.Time, names []string) (StatsSeries, error) {
+	index := make(map[string]int, len(h.names))
+	for i, name := range h.names {
+		index[name] = i
+	}
+	if len(names) == 0 {
+		names = h.names
+	}
+	cols := make([]int, len(names))
+	for i, name := range names {
+		col, ok := index[name]
+		if !ok {
+			return StatsSeries{}, fmt.Errorf("unknown metric %q", name)
+		}
+		cols[i] = col
+	}
+
+	out := StatsSeries{
+		Interval: h.interval.String(),
+		Times:    []int64{},
+		Series:   make(map[string][]float64, len(names)),
+	}
+	for _, name := range names {
+		out.Series[name] = []float64{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	start, n := 0, h.next
+	if h.full {
+		start, n = h.next, len(h.times)
+	}
+	for k := range n {
+		i := (start + k) % len(h.times)
+		if h.times[i].Before(since) {
+			continue
+		}
+		out.Times = append(out.Times, h.times[i].Unix())
+		for j, name := range names {
+			out.Series[name] = append(out.Series[name], h.values[i][cols[j]])
+		}
+	}
+	return out, nil
+}
+
+// ServeHTTP implements GET /history?since=1h&metrics=conns_active,pool_hit_rate;
+// since is a duration back from now or an RFC 3339 time, and metrics use
+// the pushed metric names
+func (h *StatsHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+			since = t
+		} else {
+			http.Error(w, fmt.Sprintf("bad since %q: want a duration like 1h or an RFC 3339 time", s), http.StatusBadRequest)
+			return
+		}
+	}
+	var names []string
+	if s := r.URL.Query().Get("metrics"); s != "" {
+		names = strings.Split(s, ",")
+	}
+	series, err := h.Query(since, names)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsHistoryRing(t *testing.T) {
+	h := NewStatsHistory(3*time.Minute, time.Minute)
+	start := time.Unix(1700000000, 0)
+	for i := range 5 {
+		h.Record(start.Add(time.Duration(i)*time.Minute), StatsSnapshot{ActiveConns: int64(i)})
+	}
+
+	series, err := h.Query(time.Time{}, []string{"conns_active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the newest three survive, oldest first
+	if len(series.Times) != 3 || series.Times[0] != start.Add(2*time.Minute).Unix() {
+		t.Fatalf("times = %v", series.Times)
+	}
+	if got := series.Series["conns_active"]; len(got) != 3 || got[0] != 2 || got[2] != 4 {
+		t.Errorf("conns_active = %v, want [2 3 4]", got)
+	}
+	if len(series.Series) != 1 {
+		t.Errorf("%d series, want only the one asked for", len(series.Series))
+	}
+
+	series, _ = h.Query(start.Add(4*time.Minute), nil)
+	if len(series.Times) != 1 || len(series.Series) != len(snapshotMetrics(StatsSnapshot{})) {
+		t.Errorf("since the last sample: %d times, %d series", len(series.Times), len(series.Series))
+	}
+
+	if _, err := h.Query(time.Time{}, []string{"no_such_metric"}); err == nil {
+		t.Error("unknown metric accepted")
+	}
+}
+
+func TestStatsHistoryServeHTTP(t *testing.T) {
+	h := NewStatsHistory(time.Hour, time.Minute)
+	now := time.Now()
+	h.Record(now.Add(-2*time.Hour), StatsSnapshot{TotalConns: 1})
+	h.Record(now.Add(-time.Minute), StatsSnapshot{TotalConns: 7})
+
+	get := func(query string) (int, StatsSeries) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history?"+query, nil))
+		var series StatsSeries
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &series); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, series
+	}
+
+	code, series := get("since=1h&metrics=conns_total")
+	if code != http.StatusOK || len(series.Times) != 1 || series.Series["conns_total"][0] != 7 {
+		t.Errorf("since=1h: %d %+v", code, series)
+	}
+	if series.Interval != "1m0s" {
+		t.Errorf("interval = %q", series.Interval)
+	}
+	if code, series = get("since=" + now.Add(-3*time.Hour).Format(time.RFC3339)); code != http.StatusOK || len(series.Times) != 2 {
+		t.Errorf("RFC 3339 since: %d, %d samples", code, len(series.Times))
+	}
+	for _, bad := range []string{"since=yesterday", "metrics=bogus"} {
+		if code, _ := get(bad); code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", bad, code)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// keychainScheme prefixes a --password-source naming an OS keychain entry
+	keychainScheme = "keychain:"
+	// defaultKeychainAccount is the account used when the source names none
+	defaultKeychainAccount = "password"
+)
+
+// ResolvePasswordSource fetches the tunnel password a --password-source
+// points at. The only form is keychain:<service>[/<account>], looked up in the
+// platform's keychain (see keychainBackend).
+func ResolvePasswordSource(source string) (string, error) {
+	rest, ok := strings.CutPrefix(source, keychainScheme)
+	if !ok {
+		return "", fmt.Errorf("unsupported password source %q (want keychain:<service>[/<account>])", source)
+	}
+	service, account, _ := strings.Cut(rest, "/")
+	if service == "" {
+		return "", fmt.Errorf("password source %q names no service", source)
+	}
+	if account == "" {
+		account = defaultKeychainAccount
+	}
+	secret, err := keychainLookup(service, account)
+	if err != nil {
+		return "", fmt.Errorf("%s lookup of %s/%s: %v", keychainBackend, service, account, err)
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s entry %s/%s is empty", keychainBackend, service, account)
+	}
+	return secret, nil
+}
+
+// errKeychainUnsupported is returned where no keychain is wired up
+var errKeychainUnsupported = errors.New("no keychain support on this platform")
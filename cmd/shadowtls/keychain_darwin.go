@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keychainBackend names the store --password-source keychain: reads
+const keychainBackend = "macOS Keychain"
+
+// keychainLookup reads a generic password item with the security tool, the
+// same item `security add-generic-password -s <service> -a <account> -w`
+// creates. The first read may show a Keychain access prompt.
+func keychainLookup(service, account string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,40 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keychainBackend names the store --password-source keychain: reads
+const keychainBackend = "Secret Service"
+
+// keychainLookup reads an item from the freedesktop Secret Service (GNOME
+// Keyring, KWallet) with secret-tool, matching the attributes
+// `secret-tool store --label=shadowtun service <service> account <account>`
+// sets. Needs a running session bus and an unlocked collection.
+func keychainLookup(service, account string) (string, error) {
+	path, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return "", fmt.Errorf("%w: secret-tool not found (install libsecret-tools)", errKeychainUnsupported)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, "lookup", "service", service, "account", account)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && stderr.Len() == 0 {
+			return "", errors.New("no such item")
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestResolvePasswordSourceSyntax(t *testing.T) {
+	for _, source := range []string{"file:/etc/pw", "keychain:", "keychain:/acct"} {
+		if _, err := ResolvePasswordSource(source); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+// secret-tool is stood in for by a script answering one item
+func TestResolvePasswordSourceSecretService(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("Secret Service backend only")
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+[ "$1 $2 $3 $4 $5" = "lookup service shadowtun account password" ] && printf 'from-keyring\n' && exit 0
+[ "$3" = "locked" ] && echo "collection is locked" >&2
+exit 1
+`
+	if err := os.WriteFile(filepath.Join(dir, "secret-tool"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	if got, err := ResolvePasswordSource("keychain:shadowtun"); err != nil || got != "from-keyring" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := ResolvePasswordSource("keychain:other"); err == nil || !strings.Contains(err.Error(), "no such item") {
+		t.Errorf("missing item: err = %v", err)
+	}
+	if _, err := ResolvePasswordSource("keychain:locked"); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("locked keyring: err = %v, want secret-tool's message", err)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := ResolvePasswordSource("keychain:shadowtun"); err == nil || !strings.Contains(err.Error(), "secret-tool not found") {
+		t.Errorf("no secret-tool: err = %v", err)
+	}
+}
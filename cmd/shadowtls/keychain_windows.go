@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// keychainBackend names the store --password-source keychain: reads
+const keychainBackend = "Windows Credential Manager"
+
+var (
+	advapi32      = windows.NewLazySystemDLL("advapi32.dll")
+	procCredReadW = advapi32.NewProc("CredReadW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+const credTypeGeneric = 1
+
+// credential mirrors the leading fields of CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+}
+
+// keychainLookup reads the generic credential named <service>, as created by
+// `cmdkey /generic:<service> /user:<account> /pass`. Credential Manager keys
+// entries by target name only, so the account is not checked.
+func keychainLookup(service, account string) (string, error) {
+	target, err := windows.UTF16PtrFromString(service)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	return decodeCredentialBlob(blob), nil
+}
+
+// decodeCredentialBlob turns a credential blob into a string. cmdkey and the
+// Control Panel store UTF-16LE; a blob without NUL bytes is taken as UTF-8,
+// which some other tools store.
+func decodeCredentialBlob(blob []byte) string {
+	if len(blob)%2 != 0 || bytes.IndexByte(blob, 0) < 0 {
+		return string(blob)
+	}
+	units := make([]uint16, len(blob)/2)
+	for i := range units {
+		units[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// leakGrowthSamples is how many consecutive increases count as monotonic growth
+	leakGrowthSamples = 5
+	// leakMinGrowth is the minimum total increase over those samples worth flagging
+	leakMinGrowth = 50
+	// leakTopStacks is how many stack groups are included in the summary
+	leakTopStacks = 5
+)
+
+// LeakWatch samples the goroutine count and flags sustained monotonic growth
+// with a summary of the most common stacks, which is how relay or pool
+// goroutine leaks show up long before memory runs out
+type LeakWatch struct {
+	interval time.Duration
+	samples  []int
+	count    func() int
+	log      *logrus.Logger
+}
+
+// NewLeakWatch creates a watchdog sampling every interval
+func NewLeakWatch(interval time.Duration, logger *logrus.Logger) *LeakWatch {
+	return &LeakWatch{
+		interval: interval,
+		count:    runtime.NumGoroutine,
+		log:      logger,
+	}
+}
+
+// Run samples until ctx is cancelled
+func (w *LeakWatch) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Observe()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Observe takes one sample and warns if the recent samples grew monotonically.
+// Returns true when growth was flagged.
+func (w *LeakWatch) Observe() bool {
+	w.samples = append(w.samples, w.count())
+	if len(w.samples) > leakGrowthSamples+1 {
+		w.samples = w.samples[1:]
+	}
+	if len(w.samples) <= leakGrowthSamples {
+		return false
+	}
+
+	for i := 1; i < len(w.samples); i++ {
+		if w.samples[i] <= w.samples[i-1] {
+			return false
+		}
+	}
+	first, last := w.samples[0], w.samples[len(w.samples)-1]
+	if last-first < leakMinGrowth {
+		return false
+	}
+
+	w.log.Warnf("[LEAK] Goroutines grew %d → %d over %v without a drop; top stacks: %s",
+		first, last, time.Duration(leakGrowthSamples)*w.interval, summarizeGoroutines(leakTopStacks))
+	// Start over so continued growth is reported once per window, not every tick
+	w.samples = w.samples[:0]
+	return true
+}
+
+// goroutineGroup is a set of goroutines sharing the same stack
+type goroutineGroup struct {
+	count int
+	frame string // Innermost frame from this module, else first non-runtime frame
+	own   bool   // frame belongs to this module
+}
+
+// summarizeGoroutines returns the top n stack groups as "count× frame" pairs
+func summarizeGoroutines(n int) string {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return "unavailable: " + err.Error()
+	}
+	groups := parseGoroutineProfile(buf.Bytes())
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].count > groups[j].count })
+	if len(groups) > n {
+		groups = groups[:n]
+	}
+	parts := make([]string, 0, len(groups))
+	for _, g := range groups {
+		parts = append(parts, fmt.Sprintf("%d× %s", g.count, g.frame))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseGoroutineProfile parses the debug=1 goroutine profile, where each
+// group starts with "N @ 0x..." followed by "#\t0x...\tfunc+0x..\tfile:line" frames
+func parseGoroutineProfile(profile []byte) []goroutineGroup {
+	var groups []goroutineGroup
+	var cur *goroutineGroup
+	scanner := bufio.NewScanner(bytes.NewReader(profile))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if countStr, _, ok := strings.Cut(line, " @ "); ok {
+			if count, err := strconv.Atoi(countStr); err == nil {
+				groups = append(groups, goroutineGroup{count: count})
+				cur = &groups[len(groups)-1]
+				continue
+			}
+		}
+		if cur == nil || cur.own || !strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		fn, _, _ := strings.Cut(fields[2], "+")
+		frame := fmt.Sprintf("%s (%s)", fn, filepath.Base(fields[3]))
+		switch {
+		case strings.HasPrefix(fn, "main.") || strings.HasPrefix(fn, "github.com/iprw/shadowtun/"):
+			cur.frame, cur.own = frame, true
+		case cur.frame == "" && !isRuntimeFrame(fn):
+			cur.frame = frame
+		}
+	}
+	for i := range groups {
+		if groups[i].frame == "" {
+			groups[i].frame = "runtime"
+		}
+	}
+	return groups
+}
+
+// isRuntimeFrame reports whether fn is scheduler/blocking plumbing that
+// says nothing about who owns the goroutine
+func isRuntimeFrame(fn string) bool {
+	for _, prefix := range []string{"runtime.", "internal/", "sync.", "time.", "net.", "io.", "syscall."} {
+		if strings.HasPrefix(fn, prefix) {
+			return true
+		}
+	}
+	return false
+}
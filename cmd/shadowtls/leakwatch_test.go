@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakWatchFlagsMonotonicGrowth(t *testing.T) {
+	counts := []int{100, 120, 150, 180, 200, 260}
+	i := 0
+	w := NewLeakWatch(time.Second, Log)
+	w.count = func() int {
+		n := counts[i]
+		i++
+		return n
+	}
+
+	for range counts[:len(counts)-1] {
+		if w.Observe() {
+			t.Fatal("flagged before enough samples")
+		}
+	}
+	if !w.Observe() {
+		t.Fatal("monotonic growth of 160 goroutines should be flagged")
+	}
+}
+
+func TestLeakWatchIgnoresFluctuation(t *testing.T) {
+	counts := []int{100, 300, 250, 400, 500, 600, 700}
+	i := 0
+	w := NewLeakWatch(time.Second, Log)
+	w.count = func() int {
+		n := counts[i]
+		i++
+		return n
+	}
+	for range counts[:6] {
+		if w.Observe() {
+			t.Fatal("a drop within the window should prevent flagging")
+		}
+	}
+}
+
+func TestParseGoroutineProfile(t *testing.T) {
+	profile := `goroutine profile: total 42
+40 @ 0x43e 0x44f 0x4a1
+#	0x43e	runtime.gopark+0x10	/usr/lib/go/src/runtime/proc.go:398
+#	0x44f	net.(*conn).Read+0x20	/usr/lib/go/src/net/net.go:179
+#	0x4a1	main.relay.func2+0x30	/src/cmd/shadowtls/client.go:412
+
+2 @ 0x43e 0x500
+#	0x43e	runtime.gopark+0x10	/usr/lib/go/src/runtime/proc.go:398
+#	0x500	github.com/metacubex/sing/common.Foo+0x5	/mod/sing/common/foo.go:10
+`
+	groups := parseGoroutineProfile([]byte(profile))
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+	if groups[0].count != 40 || !strings.HasPrefix(groups[0].frame, "main.relay.func2 (client.go:412)") {
+		t.Errorf("group 0 = %+v", groups[0])
+	}
+	if groups[1].frame != "github.com/metacubex/sing/common.Foo (foo.go:10)" {
+		t.Errorf("group 1 = %+v", groups[1])
+	}
+	if s := summarizeGoroutines(3); s == "" {
+		t.Error("live summary should not be empty")
+	}
+}
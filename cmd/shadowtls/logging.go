@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -55,3 +58,127 @@ func ParseVerbosity(args []string) (int, []string) {
 	}
 	return verbosity, filtered
 }
+
+// Modules that accept per-module level overrides
+var knownModules = []string{"client", "server", "pool", "relay", "socks5", "shadowtls", "stats"}
+
+var (
+	moduleMu      sync.Mutex
+	moduleLevels  = map[string]logrus.Level{}
+	moduleLoggers = map[string]*logrus.Logger{}
+)
+
+// moduleHook tags every entry with the module that logged it
+type moduleHook struct {
+	module string
+}
+
+func (h moduleHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h moduleHook) Fire(entry *logrus.Entry) error {
+	entry.Data["module"] = h.module
+	return nil
+}
+
+// ParseModuleLevels parses a spec like "pool=debug,relay=warn,socks5=info"
+func ParseModuleLevels(spec string) (map[string]logrus.Level, error) {
+	levels := make(map[string]logrus.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		module, levelName, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level %q (want module=level)", part)
+		}
+		module = strings.TrimSpace(module)
+		if !isKnownModule(module) {
+			return nil, fmt.Errorf("unknown log module %q (known: %s)", module, strings.Join(knownModules, ", "))
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(levelName))
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %v", module, err)
+		}
+		levels[module] = level
+	}
+	return levels, nil
+}
+
+func isKnownModule(name string) bool {
+	for _, m := range knownModules {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetModuleLevels installs per-module level overrides. Must be called before
+// the affected module loggers are created.
+func SetModuleLevels(levels map[string]logrus.Level) {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+	for module, level := range levels {
+		moduleLevels[module] = level
+	}
+}
+
+// ModuleLogger returns the logger for a component. It shares output, format
+// and hooks with Log, tags entries with a module field, and uses the module's
+// level override if one is set (otherwise the global level).
+func ModuleLogger(module string) *logrus.Logger {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+
+	if l, ok := moduleLoggers[module]; ok {
+		return l
+	}
+
+	l := logrus.New()
+	l.SetOutput(Log.Out)
+	l.SetFormatter(Log.Formatter)
+	l.SetReportCaller(Log.ReportCaller)
+	l.ExitFunc = Log.ExitFunc
+	for level, hooks := range Log.Hooks {
+		l.Hooks[level] = append([]logrus.Hook(nil), hooks...)
+	}
+	l.AddHook(moduleHook{module: module})
+
+	l.SetLevel(Log.GetLevel())
+	if level, ok := moduleLevels[module]; ok {
+		l.SetLevel(level)
+	}
+
+	moduleLoggers[module] = l
+	return l
+}
+
+// connIDKey carries the ID of the connection a context belongs to, so the
+// log lines about it can be told apart from those of other connections
+type connIDKey struct{}
+
+// withConnID returns ctx tagged with the ID of its connection
+func withConnID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// connLogger returns l with a conn field holding the ID of the connection
+// ctx belongs to, or l itself for a context outside any connection
+func connLogger(ctx context.Context, l *logrus.Logger) logrus.FieldLogger {
+	if id, ok := ctx.Value(connIDKey{}).(uint64); ok {
+		return l.WithField("conn", id)
+	}
+	return l
+}
+
+// connEntry is connLogger as an entry, for logging at a level chosen at run
+// time
+func connEntry(ctx context.Context, l *logrus.Logger) *logrus.Entry {
+	if id, ok := ctx.Value(connIDKey{}).(uint64); ok {
+		return l.WithField("conn", id)
+	}
+	return logrus.NewEntry(l)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseVerbosity(t *testing.T) {
+	verbosity, args := ParseVerbosity([]string{"--mode", "client", "-vvv", "--version"})
+	if verbosity != 3 {
+		t.Errorf("verbosity = %d, want 3", verbosity)
+	}
+	if strings.Join(args, " ") != "--mode client --version" {
+		t.Errorf("filtered args = %v", args)
+	}
+}
+
+func TestParseModuleLevels(t *testing.T) {
+	levels, err := ParseModuleLevels("pool=debug, relay=warn,socks5=info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]logrus.Level{
+		"pool":   logrus.DebugLevel,
+		"relay":  logrus.WarnLevel,
+		"socks5": logrus.InfoLevel,
+	}
+	for module, level := range want {
+		if levels[module] != level {
+			t.Errorf("%s = %v, want %v", module, levels[module], level)
+		}
+	}
+
+	for _, bad := range []string{"pool", "pol=debug", "pool=loud"} {
+		if _, err := ParseModuleLevels(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestModuleLoggerLevelAndField(t *testing.T) {
+	var buf bytes.Buffer
+	oldOut, oldLevel := Log.Out, Log.GetLevel()
+	Log.SetOutput(&buf)
+	Log.SetLevel(logrus.WarnLevel)
+	defer func() {
+		Log.SetOutput(oldOut)
+		Log.SetLevel(oldLevel)
+	}()
+
+	// Drop any logger cached by earlier tests so it picks up this setup
+	delete(moduleLoggers, "stats")
+	SetModuleLevels(map[string]logrus.Level{"stats": logrus.DebugLevel})
+	defer delete(moduleLevels, "stats")
+	defer delete(moduleLoggers, "stats")
+
+	l := ModuleLogger("stats")
+	if ModuleLogger("stats") != l {
+		t.Error("ModuleLogger should return the same logger per module")
+	}
+
+	l.Debug("module debug line")
+	out := buf.String()
+	if !strings.Contains(out, "module debug line") {
+		t.Fatalf("debug line should pass module override, got %q", out)
+	}
+	if !strings.Contains(out, "module=stats") {
+		t.Errorf("entry should carry module field, got %q", out)
+	}
+}
+
+func TestConnLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+
+	connLogger(context.Background(), l).Warn("outside")
+	if strings.Contains(buf.String(), "conn=") {
+		t.Errorf("line outside a connection carries a conn field: %q", buf.String())
+	}
+	buf.Reset()
+
+	ctx, cancel := context.WithCancel(withConnID(context.Background(), 42))
+	defer cancel()
+	connLogger(ctx, l).Warn("inside")
+	if !strings.Contains(buf.String(), "conn=42") {
+		t.Errorf("line for connection 42 should carry its ID, got %q", buf.String())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RepeatWindow is how long identical log lines are collapsed; 0 disables suppression
+var RepeatWindow = time.Minute
+
+// RepeatLogger collapses bursts of identical log lines. The first occurrence of
+// a message (keyed by its format string) is logged immediately; repeats within
+// the window are counted and summarized as "(repeated N times in last 1m0s)".
+// Lines logged with a connection's context carry its conn field; a summary
+// carries that of the last repeat.
+type RepeatLogger struct {
+	log    *logrus.Logger
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*repeatEntry
+}
+
+type repeatEntry struct {
+	level      logrus.Level
+	last       string        // Most recent formatted message
+	entry      *logrus.Entry // ...and the logger with its fields
+	suppressed int
+	timer      *time.Timer
+}
+
+// NewRepeatLogger creates a repeat-suppressing wrapper around logger using RepeatWindow
+func NewRepeatLogger(logger *logrus.Logger) *RepeatLogger {
+	return &RepeatLogger{
+		log:     logger,
+		window:  RepeatWindow,
+		entries: make(map[string]*repeatEntry),
+	}
+}
+
+// Warnf logs at warn level with repeat suppression
+func (r *RepeatLogger) Warnf(format string, args ...any) {
+	r.Logf(logrus.WarnLevel, format, args...)
+}
+
+// Debugf logs at debug level with repeat suppression
+func (r *RepeatLogger) Debugf(format string, args ...any) {
+	r.Logf(logrus.DebugLevel, format, args...)
+}
+
+// WarnfContext is Warnf tagged with the conn ID of ctx, if any
+func (r *RepeatLogger) WarnfContext(ctx context.Context, format string, args ...any) {
+	r.LogfContext(ctx, logrus.WarnLevel, format, args...)
+}
+
+// Logf logs at level unless the same format was logged within the window
+func (r *RepeatLogger) Logf(level logrus.Level, format string, args ...any) {
+	r.LogfContext(context.Background(), level, format, args...)
+}
+
+// LogfContext is Logf tagged with the conn ID of ctx, if any
+func (r *RepeatLogger) LogfContext(ctx context.Context, level logrus.Level, format string, args ...any) {
+	if !r.log.IsLevelEnabled(level) {
+		return
+	}
+	entry := connEntry(ctx, r.log)
+	if r.window <= 0 {
+		entry.Logf(level, format, args...)
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+
+	r.mu.Lock()
+	if e, ok := r.entries[format]; ok {
+		e.suppressed++
+		e.last, e.entry = msg, entry
+		r.mu.Unlock()
+		return
+	}
+	e := &repeatEntry{level: level, last: msg, entry: entry}
+	e.timer = time.AfterFunc(r.window, func() { r.flush(format) })
+	r.entries[format] = e
+	r.mu.Unlock()
+
+	entry.Log(level, msg)
+}
+
+// flush emits the summary for one key when its window ends. If repeats were
+// seen, a new window opens so a continuing burst keeps collapsing.
+func (r *RepeatLogger) flush(format string) {
+	r.mu.Lock()
+	e, ok := r.entries[format]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	suppressed, last, level, entry := e.suppressed, e.last, e.level, e.entry
+	if suppressed == 0 {
+		delete(r.entries, format)
+	} else {
+		e.suppressed = 0
+		e.timer.Reset(r.window)
+	}
+	r.mu.Unlock()
+
+	if suppressed > 0 {
+		entry.Logf(level, "%s (repeated %d times in last %v)", last, suppressed, r.window)
+	}
+}
+
+// Flush emits pending summaries immediately, e.g. on shutdown
+func (r *RepeatLogger) Flush() {
+	r.mu.Lock()
+	entries := r.entries
+	r.entries = make(map[string]*repeatEntry)
+	r.mu.Unlock()
+
+	for _, e := range entries {
+		e.timer.Stop()
+		if e.suppressed > 0 {
+			e.entry.Logf(e.level, "%s (repeated %d times in last %v)", e.last, e.suppressed, r.window)
+		}
+	}
+}
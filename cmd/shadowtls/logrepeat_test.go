@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRepeatLoggerCollapses(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+
+	r := NewRepeatLogger(logger)
+	r.window = time.Hour
+
+	for i := 0; i < 5; i++ {
+		r.Warnf("Pool connect failed: %v", i)
+	}
+	r.Warnf("Accept error: %v", "boom")
+
+	if got := strings.Count(buf.String(), "Pool connect failed"); got != 1 {
+		t.Fatalf("expected 1 pool line before flush, got %d:\n%s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "Accept error") {
+		t.Error("distinct message should not be suppressed")
+	}
+
+	r.Flush()
+	if !strings.Contains(buf.String(), "Pool connect failed: 4 (repeated 4 times in last 1h0m0s)") {
+		t.Errorf("missing repeat summary:\n%s", buf.String())
+	}
+}
+
+// Lines about a connection carry its ID, and a summary that of the last repeat
+func TestRepeatLoggerConnID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+
+	r := NewRepeatLogger(logger)
+	r.window = time.Hour
+	for id := uint64(1); id <= 3; id++ {
+		r.WarnfContext(withConnID(context.Background(), id), "Failed to get tunnel: %v", "refused")
+	}
+	if !strings.Contains(buf.String(), "conn=1") {
+		t.Errorf("first line should carry conn=1:\n%s", buf.String())
+	}
+	buf.Reset()
+	r.Flush()
+	if !strings.Contains(buf.String(), "repeated 2 times") || !strings.Contains(buf.String(), "conn=3") {
+		t.Errorf("summary should carry the last repeat's conn=3:\n%s", buf.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes and reads
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRepeatLoggerWindowFlush(t *testing.T) {
+	var buf syncBuffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+
+	r := NewRepeatLogger(logger)
+	r.window = 10 * time.Millisecond
+	r.Warnf("Pool connect failed: %v", 1)
+	r.Warnf("Pool connect failed: %v", 2)
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(buf.String(), "repeated 1 times") {
+		if time.Now().After(deadline) {
+			t.Fatalf("summary not emitted after window:\n%s", buf.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogIdentifier is the program name reported to syslog and journald
+const syslogIdentifier = "shadowtls"
+
+// SetLogTarget directs Log to stdout, stderr, a file, syslog or journald.
+// Must be called after InitLogging and before module loggers are created.
+func SetLogTarget(target, file string) error {
+	switch target {
+	case "", "stdout":
+		Log.SetOutput(os.Stdout)
+	case "stderr":
+		Log.SetOutput(os.Stderr)
+	case "file":
+		if file == "" {
+			return fmt.Errorf("--log-target file requires --log-file")
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		Log.SetOutput(f)
+		disableColors()
+	case "syslog":
+		hook, err := newSyslogHook()
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		Log.AddHook(hook)
+		Log.SetOutput(io.Discard)
+	case "journald":
+		hook, err := newJournaldHook()
+		if err != nil {
+			return fmt.Errorf("failed to connect to journald: %v", err)
+		}
+		Log.AddHook(hook)
+		Log.SetOutput(io.Discard)
+	default:
+		return fmt.Errorf("unknown log target: %s (use stdout, stderr, file, syslog or journald)", target)
+	}
+	return nil
+}
+
+func disableColors() {
+	if tf, ok := Log.Formatter.(*logrus.TextFormatter); ok {
+		tf.DisableColors = true
+	}
+}
+
+// plainMessage renders an entry as "message key=value ..." for system loggers,
+// which add their own timestamp and priority
+func plainMessage(entry *logrus.Entry) string {
+	if len(entry.Data) == 0 {
+		return entry.Message
+	}
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(entry.Message)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, entry.Data[k])
+	}
+	return b.String()
+}
+
+// syslogPriority maps logrus levels to syslog severities (RFC 5424)
+func syslogPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
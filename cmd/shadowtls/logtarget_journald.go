@@ -0,0 +1,86 @@
+//go:build linux && !no_journald
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journaldSupported reports whether the journald log target is available
+const journaldSupported = true
+
+// journaldSocket is the systemd-journald native protocol socket
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldHook sends entries to journald using the native protocol, so the
+// priority, module and other fields become structured journal fields
+type journaldHook struct {
+	conn *net.UnixConn
+}
+
+func newJournaldHook() (logrus.Hook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHook{conn: conn}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(syslogPriority(entry.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", syslogIdentifier)
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	for k, v := range entry.Data {
+		writeJournalField(&b, journalFieldName(k), fmt.Sprint(v))
+	}
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+// writeJournalField encodes one field; values containing newlines use the
+// length-prefixed binary form
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName converts a logrus field key to a valid journal field name
+// (uppercase letters, digits and underscores, not starting with an underscore)
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "F_" + name
+	}
+	return name
+}
@@ -0,0 +1,12 @@
+//go:build !linux || no_journald
+
+package main
+
+import "github.com/sirupsen/logrus"
+
+// journaldSupported reports whether the journald log target is available
+const journaldSupported = false
+
+func newJournaldHook() (logrus.Hook, error) {
+	return nil, notCompiled("journald (Linux only)", "no_journald")
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9 || no_syslog
+
+package main
+
+import "github.com/sirupsen/logrus"
+
+// syslogSupported reports whether the syslog log target is available
+const syslogSupported = false
+
+func newSyslogHook() (logrus.Hook, error) {
+	return nil, notCompiled("syslog", "no_syslog")
+}
@@ -0,0 +1,45 @@
+//go:build !windows && !plan9 && !no_syslog
+
+package main
+
+import (
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogSupported reports whether the syslog log target is available
+const syslogSupported = true
+
+// syslogHook forwards entries to the local syslog daemon with mapped priorities
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+func newSyslogHook() (logrus.Hook, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, syslogIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogHook{w: w}, nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	msg := plainMessage(entry)
+	switch syslogPriority(entry.Level) {
+	case 2:
+		return h.w.Crit(msg)
+	case 3:
+		return h.w.Err(msg)
+	case 4:
+		return h.w.Warning(msg)
+	case 6:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPlainMessage(t *testing.T) {
+	entry := &logrus.Entry{
+		Message: "Pool connect failed",
+		Data:    logrus.Fields{"module": "pool", "attempt": 2},
+	}
+	if got, want := plainMessage(entry), "Pool connect failed attempt=2 module=pool"; got != want {
+		t.Errorf("plainMessage = %q, want %q", got, want)
+	}
+}
+
+func TestSyslogPriority(t *testing.T) {
+	tests := map[logrus.Level]int{
+		logrus.FatalLevel: 2,
+		logrus.ErrorLevel: 3,
+		logrus.WarnLevel:  4,
+		logrus.InfoLevel:  6,
+		logrus.TraceLevel: 7,
+	}
+	for level, want := range tests {
+		if got := syslogPriority(level); got != want {
+			t.Errorf("syslogPriority(%v) = %d, want %d", level, got, want)
+		}
+	}
+}
+
+func TestSetLogTargetErrors(t *testing.T) {
+	if err := SetLogTarget("file", ""); err == nil {
+		t.Error("file target without path should fail")
+	}
+	if err := SetLogTarget("carrier-pigeon", ""); err == nil {
+		t.Error("unknown target should fail")
+	}
+}
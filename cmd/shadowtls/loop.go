@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loopDialWindow is how long a tunnel dial's local address is remembered. A
+// redirected dial reaches the listener within milliseconds, so a short window
+// avoids false matches when the ephemeral port is later reused.
+const loopDialWindow = 10 * time.Second
+
+// loopInterfaceRefresh is how long the TUN interface addresses are cached;
+// listing interfaces on every dial is slow on hosts with many of them
+const loopInterfaceRefresh = 30 * time.Second
+
+// tunInterfacePrefixes are interface names used by TUN drivers
+var tunInterfacePrefixes = []string{"tun", "utun", "wintun"}
+
+// LoopGuard refuses traffic that would route the tunnel through itself: a
+// server-bound dial leaving via a TUN interface (TUN capturing our own
+// packets), or a tunnel dial redirected back onto the local listener
+// (transparent proxy rules that also match the server)
+type LoopGuard struct {
+	mu    sync.Mutex
+	dials map[string]time.Time // Local address of recent tunnel dials → dial time
+
+	tunMu    sync.Mutex
+	tunAddrs map[netip.Addr]string // Address → TUN interface owning it
+	tunAt    time.Time             // When tunAddrs was listed
+}
+
+// NewLoopGuard creates a loop guard
+func NewLoopGuard() *LoopGuard {
+	return &LoopGuard{
+		dials: make(map[string]time.Time),
+	}
+}
+
+// CheckDial runs on every TCP connection to the server before the handshake.
+// It fails dials that leave through a TUN interface and remembers the local
+// address so a redirected copy arriving at the listener can be recognized.
+func (g *LoopGuard) CheckDial(conn net.Conn) error {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	if iface := g.tunInterfaceFor(local.AddrPort().Addr().Unmap()); iface != "" {
+		return fmt.Errorf("routing loop: connection to server %s leaves through tunnel interface %s; "+
+			"add a bypass route for the server (tunnel.sh does this), or pass --loop-check=false if %s is an intended upstream VPN",
+			conn.RemoteAddr(), iface, iface)
+	}
+
+	now := time.Now()
+	g.mu.Lock()
+	for addr, at := range g.dials {
+		if now.Sub(at) > loopDialWindow {
+			delete(g.dials, addr)
+		}
+	}
+	g.dials[local.String()] = now
+	g.mu.Unlock()
+	return nil
+}
+
+// IsOwnDial reports whether an incoming connection on the listener is one of
+// our own recent tunnel dials that was redirected back
+func (g *LoopGuard) IsOwnDial(remote net.Addr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	at, ok := g.dials[remote.String()]
+	return ok && time.Since(at) <= loopDialWindow
+}
+
+// CheckSelfDial refuses a server address that points at the client's own listener
+func CheckSelfDial(listen, server string) error {
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil
+	}
+	serverHost, serverPort, err := net.SplitHostPort(server)
+	if err != nil || serverPort != listenPort {
+		return nil
+	}
+
+	ips, err := net.LookupIP(serverHost)
+	if err != nil {
+		return nil // Resolution problems surface when dialing
+	}
+	listenIP := net.ParseIP(listenHost)
+	wildcard := listenHost == "" || (listenIP != nil && listenIP.IsUnspecified())
+	for _, ip := range ips {
+		if (wildcard && isLocalIP(ip)) || (listenIP != nil && listenIP.Equal(ip)) {
+			return fmt.Errorf("routing loop: --server %s is this client's own listener %s", server, listen)
+		}
+	}
+	return nil
+}
+
+// isLocalIP reports whether ip is a loopback address or assigned to this host
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunInterfaceFor returns the name of the TUN interface owning ip, or "".
+// The interfaces are listed at most every loopInterfaceRefresh, so a TUN
+// brought up later is noticed within that.
+func (g *LoopGuard) tunInterfaceFor(ip netip.Addr) string {
+	g.tunMu.Lock()
+	defer g.tunMu.Unlock()
+	if g.tunAddrs == nil || time.Since(g.tunAt) > loopInterfaceRefresh {
+		g.tunAddrs, g.tunAt = listTunAddrs(), time.Now()
+	}
+	return g.tunAddrs[ip]
+}
+
+// listTunAddrs maps the addresses of TUN interfaces to their names
+func listTunAddrs() map[netip.Addr]string {
+	tunAddrs := make(map[netip.Addr]string)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return tunAddrs
+	}
+	for _, iface := range ifaces {
+		if !isTunInterface(iface) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				if ip, ok := netip.AddrFromSlice(ipnet.IP); ok {
+					tunAddrs[ip.Unmap()] = iface.Name
+				}
+			}
+		}
+	}
+	return tunAddrs
+}
+
+// isTunInterface reports whether iface is a TUN device: run by the Linux
+// tun driver, or named like one (macOS utun, wintun). Point-to-point alone
+// doesn't tell: PPPoE and WireGuard links are point-to-point too, and a
+// server reached through them is no loop.
+func isTunInterface(iface net.Interface) bool {
+	if iface.Flags&net.FlagLoopback != 0 {
+		return false
+	}
+	if isTunDriver(iface.Name) {
+		return true
+	}
+	name := strings.ToLower(iface.Name)
+	for _, prefix := range tunInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
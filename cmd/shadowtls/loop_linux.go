@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// isTunDriver reports whether the tun driver runs the interface name; only
+// its devices have tun_flags in sysfs, whatever they are called
+func isTunDriver(name string) bool {
+	_, err := os.Stat("/sys/class/net/" + name + "/tun_flags")
+	return err == nil
+}
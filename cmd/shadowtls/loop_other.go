@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// isTunDriver can't ask the driver here; TUN devices are known by name
+func isTunDriver(name string) bool {
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCheckSelfDial(t *testing.T) {
+	tests := []struct {
+		listen, server string
+		loop           bool
+	}{
+		{"127.0.0.1:1080", "127.0.0.1:1080", true},
+		{"0.0.0.0:1080", "127.0.0.1:1080", true},
+		{"127.0.0.1:1080", "localhost:1080", true},
+		{"127.0.0.1:1080", "127.0.0.1:8443", false},
+		{"127.0.0.1:1080", "192.0.2.10:1080", false},
+	}
+	for _, tt := range tests {
+		err := CheckSelfDial(tt.listen, tt.server)
+		if (err != nil) != tt.loop {
+			t.Errorf("CheckSelfDial(%s, %s) = %v, want loop=%v", tt.listen, tt.server, err, tt.loop)
+		}
+	}
+}
+
+func TestLoopGuardIsOwnDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	g := NewLoopGuard()
+	if g.IsOwnDial(peer.RemoteAddr()) {
+		t.Fatal("unknown connection reported as own dial")
+	}
+	if err := g.CheckDial(conn); err != nil {
+		t.Fatalf("loopback dial should pass: %v", err)
+	}
+	if !g.IsOwnDial(peer.RemoteAddr()) {
+		t.Error("redirected own dial not recognized")
+	}
+}
+
+func TestIsTunInterface(t *testing.T) {
+	tests := []struct {
+		iface net.Interface
+		want  bool
+	}{
+		{net.Interface{Name: "tun0", Flags: net.FlagUp}, true},
+		{net.Interface{Name: "wg0", Flags: net.FlagUp | net.FlagPointToPoint}, false},
+		{net.Interface{Name: "ppp0", Flags: net.FlagUp | net.FlagPointToPoint}, false},
+		{net.Interface{Name: "utun3", Flags: net.FlagUp}, true},
+		{net.Interface{Name: "eth0", Flags: net.FlagUp | net.FlagBroadcast}, false},
+		{net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback}, false},
+	}
+	for _, tt := range tests {
+		if got := isTunInterface(tt.iface); got != tt.want {
+			t.Errorf("isTunInterface(%s) = %v, want %v", tt.iface.Name, got, tt.want)
+		}
+	}
+}
+
+// The TUN addresses are listed once per refresh, not on every dial
+func TestLoopGuardCachesInterfaces(t *testing.T) {
+	g := NewLoopGuard()
+	ip := netip.MustParseAddr("10.99.0.2")
+	g.tunAddrs, g.tunAt = map[netip.Addr]string{ip: "tun9"}, time.Now()
+	if got := g.tunInterfaceFor(ip); got != "tun9" {
+		t.Errorf("cached lookup = %q, want tun9", got)
+	}
+	g.tunAt = time.Now().Add(-2 * loopInterfaceRefresh)
+	if got := g.tunInterfaceFor(ip); got != "" {
+		t.Errorf("stale cache still used: %q", got)
+	}
+}
@@ -1,13 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"runtime"
+	"strings"
 	"time"
+
+	"github.com/sirupsen/logrus"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+	"github.com/iprw/shadowtun/pkg/socks5"
 )
 
 func main() {
+	defer crashGuard()
+
+	if len(os.Args) > 1 && os.Args[1] == "env" {
+		os.Exit(runEnv(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(runSoak(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "genconfig" {
+		os.Exit(runGenConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-secret" {
+		os.Exit(runEncryptSecret(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "drain" {
+		os.Exit(runDrain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		os.Exit(runUpdate(os.Args[2:]))
+	}
+
 	// Parse verbosity first (before flag.Parse to count -v flags)
 	// This removes -v, -vv, -vvv from args so flag.Parse doesn't complain
 	verbosity, filteredArgs := ParseVerbosity(os.Args[1:])
@@ -15,108 +46,852 @@ func main() {
 
 	// Mode selection
 	mode := flag.String("mode", "", "Operation mode: server or client")
+	showVersion := flag.Bool("version", false, "Print version and exit")
+	versionJSON := flag.Bool("json", false, "With --version, print version and supported features as JSON")
+	configPath := flag.String("config", "", "JSON config file; keys are flag names")
+	configKinds := flag.Bool("config-kinds", false, "Print each config file key and the JSON type it takes, then exit")
+	configPassFile := flag.String("config-passphrase-file", "", "File holding the passphrase for encrypted config values (default: $"+ConfigPassphraseEnv+" or a prompt)")
+	logLevels := flag.String("log-levels", "", "Per-module log levels, e.g. pool=debug,relay=warn")
+	logTarget := flag.String("log-target", "stdout", "Log target: stdout, stderr, file, syslog or journald")
+	logFile := flag.String("log-file", "", "Log file path for --log-target file")
+	logSuppress := flag.Duration("log-suppress", time.Minute, "Collapse repeated warnings within this window, 0 to disable")
 
 	// Common flags
 	listen := flag.String("listen", "", "Listen address")
 	password := flag.String("password", "", "Shared password for authentication")
+	passwordSource := flag.String("password-source", "", "Fetch the password from the OS keychain instead: keychain:<service>[/<account>]")
+	startupJSON := flag.String("startup-json", "", "Write a JSON \"started\" event to this file once listening (- for stdout)")
+	clockCheck := flag.String("clock-check", "", "NTP server (host[:port]) to compare the local clock with at startup and hourly; empty to disable")
+	clockSkewMax := flag.Duration("clock-skew-max", DefaultClockSkewMax, "Warn when the local clock is off from --clock-check by more than this")
+	traceBytes := flag.Int("trace-bytes", 0, "Hex-dump the first N bytes of each direction of sampled connections as relayed (after decryption) at trace level, 0 to disable")
+	traceSample := flag.Int("trace-sample", DefaultTraceSample, "With --trace-bytes, trace one in this many connections")
+	leakWatch := flag.Duration("leak-watch", time.Minute, "Goroutine leak watchdog sample interval when stats debug logging is on (-vv), 0 to disable")
+	handshakeWorkers := flag.Int("handshake-workers", 4*runtime.NumCPU(), "Concurrent ShadowTLS handshakes, 0 for no limit")
+	handshakeRate := flag.Float64("handshake-rate", 0, "New tunnel handshakes per second across pool refills and on-demand dials, 0 for no limit (client mode)")
+	handshakeBurst := flag.Int("handshake-burst", 4, "Handshakes --handshake-rate lets start at once (client mode)")
+	rateLimitUp := flag.String("rate-limit-up", "", "Cap app → server traffic at this many bytes per second, e.g. 1MB, empty for no limit (client mode)")
+	rateLimitDown := flag.String("rate-limit-down", "", "Cap server → app traffic at this many bytes per second, e.g. 4MB, empty for no limit (client mode)")
+	rateLimitPerConn := flag.Bool("rate-limit-per-conn", false, "Apply --rate-limit-up/--rate-limit-down to each connection instead of sharing them across all (client mode)")
+	handshakeQueue := flag.Int("handshake-queue", 256, "Handshakes allowed to wait for a slot before new connections are rejected (server mode)")
+	handshakePerSource := flag.Int("handshake-per-source", 64, "Handshakes one client address (IPv6 /64) may run or queue at once, 0 for no limit (server mode)")
+	memLimit := flag.String("mem-limit", "", "Soft memory cap (e.g. 48MB); new connections are rejected above it")
+	cpuLimit := flag.Int("cpu-limit", 0, "Reject new handshakes while process CPU use is above this percent of the usable cores, 0 to disable (server mode)")
+	profile := flag.String("profile", "", "Hardware preset for buffer, pool, handshake and logging defaults: small-router, vps or desktop")
+	bufferSize := flag.String("buffer-size", "32KB", "Relay copy buffer per connection direction")
+	socketBufferMax := flag.String("socket-buffer-max", "0", "Raise tunnel socket buffers to the path's bandwidth-delay product, up to this size (e.g. 8MB); 0 keeps OS defaults")
+	congestion := flag.String("congestion-control", "", "TCP congestion control for tunnel sockets, e.g. bbr or cubic (Linux); empty for the system default")
+	reloadPolicy := flag.String("reload-policy", ReloadGrace, "On SIGHUP password/server change: grace, drain or kill open tunnels")
+	reloadGrace := flag.Duration("reload-grace", 30*time.Second, "How long old tunnels may run after a reload with --reload-policy grace")
+	drainTimeout := flag.Duration("drain-timeout", 0, "On SIGINT/SIGTERM, let open connections finish for up to this long before closing them; 0 closes them at once")
 
 	// Server flags
 	forward := flag.String("forward", "", "Backend address to forward to (server mode)")
+	forwardFallback := flag.String("forward-fallback", "", "Secondary backend used when --forward can't be reached (server mode)")
+	forwardRetries := flag.Int("forward-retries", 0, "Extra attempts over the backends before dropping a tunnel (server mode)")
+	forwardBackoff := flag.Duration("forward-backoff", 200*time.Millisecond, "Wait before the first backend retry, doubling after each (server mode)")
+	forwardPool := flag.Int("forward-pool", 0, "Backend connections to keep open ahead of tunnels, 0 for none (server mode)")
+	forwardPoolTTL := flag.Duration("forward-pool-ttl", 30*time.Second, "Replace pooled backend connections idle this long (server mode)")
 	socks5Mode := flag.Bool("socks5", false, "Run SOCKS5 proxy instead of port forward (server mode)")
+	socks5UDP := flag.Bool("socks5-udp", false, "Carry SOCKS5 UDP ASSOCIATE through the tunnel: the server accepts it, the client bridges apps' UDP onto it; both ends need it")
+	socks5Auth := flag.String("socks5-auth", "", "Require SOCKS5 username/password checked by htpasswd:<file>, exec:<command>, pam[:<service>] or an http(s):// URL (server mode)")
+	socks5AuthCache := flag.Duration("socks5-auth-cache", time.Minute, "Remember credentials --socks5-auth accepted this long, 0 to ask the backend every time (server mode)")
+	socks5Retries := flag.Int("socks5-dial-retries", 0, "Retry SOCKS5 target dials that were refused or hit a transient DNS failure this many times (server mode)")
+	socks5Backoff := flag.Duration("socks5-dial-backoff", 200*time.Millisecond, "Wait before the first SOCKS5 dial retry, doubling after each (server mode)")
+	socks5Reply := flag.String("socks5-reply-addr", "", "Public IP[:port] reported in SOCKS5 replies when the server is behind NAT, IPv6 as [ip]:port (server mode)")
+	upstream := flag.String("upstream", "", "Bridge to this second-hop ShadowTLS server instead of --forward (server mode)")
+	upstreamSNI := flag.String("upstream-sni", "", "SNI for the second-hop handshake (server mode)")
+	upstreamPassword := flag.String("upstream-password", "", "Password of the second-hop server, default --password (server mode)")
+	rendezvous := flag.Bool("rendezvous", false, "Relay between clients that --expose and --peer the same name (server mode, experimental)")
+	minClientVersion := flag.String("min-client-version", "", "Warn when a client reports a version older than this in its pings, e.g. v1.4.0; clients without --ping-interval report none and aren't checked (server mode)")
 	handshake := flag.String("handshake", "", "TLS handshake server (server mode)")
 	wildcardSNI := flag.Bool("wildcard-sni", false, "Use client's SNI as handshake server (server mode)")
+	sessionTimeout := flag.Duration("session-timeout", defaultSessionTimeout, "Drop authenticated clients without a first frame this long after their ClientHello, i.e. idle pooled tunnels; 0 to never (server mode)")
+	firstFrameTimeout := flag.Duration("first-frame-timeout", 0, "Drop tunnels that finish the handshake but send no first frame within this long, 0 to leave it to --session-timeout (server mode)")
+	idleTimeout := flag.Duration("idle-timeout", relaypkg.DefaultIdleTimeout, "Close relayed connections idle this long (server mode)")
+	dialTimeout := flag.String("dial-timeout", "", "Dial timeouts for SOCKS5 and --forward targets, comma-separated [dest=]duration; dest is a host, *.domain, CIDR or :port, optionally with a port, e.g. \"5s,:22=30s\" (server mode)")
+	chroot := flag.String("chroot", "", "Change the root directory to this (ideally empty) directory once the listener is bound; needs --user (server mode)")
+	runAsUser := flag.String("user", "", "Switch to this user once the listener is bound, e.g. to serve port 443 without staying root (server mode)")
+	runAsGroup := flag.String("group", "", "Switch to this group once bound, default --user's primary group (server mode)")
+	sandbox := flag.Bool("sandbox", false, "Once bound, limit file access to the config and /etc and deny exec and ptrace with Landlock and seccomp (server mode, Linux)")
+	socks5Timeout := flag.Duration("socks5-timeout", socks5.DefaultNegotiationTimeout, "Close SOCKS5 clients that don't complete greeting, auth and request within this long, 0 to never (server mode)")
 
 	// Client flags
-	server := flag.String("server", "", "ShadowTLS server address (client mode)")
-	sni := flag.String("sni", "", "SNI for TLS handshake (client mode)")
+	server := flag.String("server", "", "ShadowTLS server address, or a comma-separated list to fail over between in order of preference (client mode)")
+	failoverAfter := flag.Int("failover-after", DefaultFailoverAfter, "With several --server addresses, switch to the next after this many failed dials in a row (client mode)")
+	failoverRecheck := flag.Duration("failover-recheck", DefaultFailoverRecheck, "Retry a preferred server that is down this often, switching back once it answers (client mode)")
+	sni := flag.String("sni", "", "SNI for TLS handshake; several comma-separated hosts are rotated across new tunnels (client mode)")
+	sniProbe := flag.Duration("sni-probe", 0, "Probe each --sni host with a direct TLS handshake this often and rotate away from failing ones, 0 to disable (client mode)")
 	poolSize := flag.Int("pool-size", 10, "Connection pool size (client mode)")
+	poolMax := flag.Int("pool-max", 0, "Grow the pool up to this size while connections keep finding it empty, shrinking back to --pool-size when idle; 0 keeps it fixed (client mode)")
+	poolRefill := flag.String("pool-refill", "adaptive", "Pool refill policy: adaptive or fixed (client mode)")
 	ttl := flag.Duration("ttl", 10*time.Second, "Connection TTL (client mode)")
+	ttlAuto := flag.Bool("ttl-auto", false, "Lower the TTL below the server session timeout learned from stale tunnels; --ttl is the maximum (client mode)")
 	backoff := flag.Duration("backoff", 5*time.Second, "Backoff on failure (client mode)")
 	timeout := flag.Duration("timeout", 10*time.Second, "Connection timeout (client mode)")
+	blackholeProbe := flag.String("blackhole-probe", "", "DNS server (host:port) queried over UDP to confirm that silent tunnels mean interference rather than an outage, empty to skip (client mode)")
+	pingInterval := flag.Duration("ping-interval", 0, "Ping the server through a pooled tunnel this often to check it end to end, 0 to disable; needs a server from this release (client mode)")
+	retryHold := flag.Duration("retry-hold", 0, "Keep new connections waiting this long for an unreachable server to come back before failing them, 0 to fail at once (client mode)")
+	stormPacing := flag.Duration("storm-pacing", DefaultStormPacing, "Spread local connections accepted during a reconnect storm over up to this long, 0 to only report storms (client mode)")
+	firstPacket := flag.Duration("first-packet-timeout", 10*time.Second, "Wait for the local client's first packet (client mode)")
+	firstPacketMax := flag.String("first-packet-max", "128KB", "Buffer at most this much of the client's opening burst for replay (client mode)")
+	handshakeDebug := flag.Bool("handshake-debug", false, "Log record/extension metadata of failed handshakes to diagnose middleboxes (client mode)")
+	verifyHandshakeCert := flag.Bool("verify-handshake-cert", false, "Fail dials whose decoy certificate doesn't verify for --sni against the system roots, a sign of interception (client mode)")
+	pinSHA256 := flag.String("pin-sha256", "", "Comma-separated SHA-256 public key pins; the decoy certificate chain must match one (client mode)")
+	skipVerify := flag.Bool("skip-verify", false, "Relay without waiting for the server's first response; saves a round trip, stale tunnels fail instead of retrying (client mode)")
+	verifyCoalesce := flag.Duration("verify-coalesce", defaultVerifyCoalesce, "Merge segments of the server's first response arriving this close together, 0 to disable (client mode)")
+	sniffGuard := flag.String("sniff-guard", SniffOff, "Refuse plain HTTP or TLS sent straight to the listener before taking a tunnel: warn, help (also answer HTTP with a page on what to fix) or off (client mode)")
+	passive := flag.Bool("passive", false, "Don't wait for local client data, for server-speaks-first protocols (client mode)")
 	statsInterval := flag.Duration("stats-interval", 10*time.Second, "Stats interval, 0 to disable (client mode)")
+	captiveProbe := flag.String("captive-probe", "", "HTTP URL probed for captive portals after connect failures, e.g. http://connectivitycheck.gstatic.com/generate_204; off by default (client mode)")
+	captiveExpect := flag.String("captive-expect", "", "Body text the captive probe must return; empty expects 204 (client mode)")
+	systemProxy := flag.Bool("apply-system-proxy", false, "Set OS proxy settings to the listener while running, revert on exit (client mode)")
+	loopCheck := flag.Bool("loop-check", true, "Refuse traffic that would route the tunnel through itself (client mode)")
+	expose := flag.String("expose", "", "Offer name=host:port to clients dialing the name with --peer (client mode, needs server --rendezvous)")
+	dnsListen := flag.String("dns-listen", "", "Answer DNS queries on this UDP/TCP address by resolving them through the tunnel; needs server --socks5 (client mode)")
+	dnsUpstream := flag.String("dns-upstream", DefaultDNSUpstream, "Resolver the server queries for --dns-listen, host:port (client mode)")
+	maintenance := flag.String("maintenance", "", "Windows in which to replace all tunnels, e.g. \"03:00/15m\" or \"sun 04:00/1h\", comma-separated, local time (client mode)")
+	dnsCache := flag.Int("dns-cache", DefaultDNSCache, "DNS answers cached for --dns-listen, 0 to disable (client mode)")
+	mux := flag.Bool("mux", false, "Carry many connections as streams over each tunnel; client and server both need it")
+	muxTunnels := flag.Int("mux-tunnels", DefaultMuxTunnels, "Tunnels shared by all connections with --mux (client mode)")
+	peer := flag.String("peer", "", "Carry every connection to the client exposing this name (client mode, needs server --rendezvous)")
+	handoff := flag.String("handoff", "", "Unix socket for zero-downtime upgrades: a new client started with the same path takes over the listener (client mode)")
+	admin := flag.String("admin", "", "Address for the JSON admin endpoint: stats, connections and drain (client); drain (server)")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin endpoint")
+	adminCert := flag.String("admin-tls-cert", "", "TLS certificate for the admin endpoint")
+	adminKey := flag.String("admin-tls-key", "", "TLS private key for the admin endpoint")
+	adminClientCA := flag.String("admin-client-ca", "", "CA bundle for admin client certificates (mTLS)")
+	statsPush := flag.String("stats-push", "", "Push stats to statsd://, graphite://, influx:// or influx-udp:// (client mode)")
+	connLog := flag.String("conn-log", "", "Write one record per closed connection to this file: CSV if it ends in .csv, else JSON lines (client mode)")
+	connLogMaxSize := flag.String("conn-log-max-size", "10MB", "Rotate --conn-log at this size, 0 to never rotate (client mode)")
+	connLogKeep := flag.Int("conn-log-keep", DefaultConnLogKeep, "Rotated --conn-log files to keep (client mode)")
+	statsHistory := flag.Duration("stats-history", DefaultHistoryKeep, "How much stats history the admin endpoint keeps for /history, 0 to keep none (client mode)")
+	statsHistoryInterval := flag.Duration("stats-history-interval", DefaultHistoryInterval, "Resolution of --stats-history (client mode)")
+	statsPushInterval := flag.Duration("stats-push-interval", 10*time.Second, "Stats push interval (client mode)")
+	statsPushPrefix := flag.String("stats-push-prefix", "shadowtls", "Metric prefix or influx measurement for pushed stats (client mode)")
+	alarmWindow := flag.Duration("alarm-window", 5*time.Minute, "Rolling window for error budget alarms, 0 to disable (client mode)")
+	alarmStaleRate := flag.Float64("alarm-stale-rate", 0.2, "Stale tunnel fraction that raises an alarm, 0 to disable (client mode)")
+	alarmErrorRate := flag.Float64("alarm-error-rate", 0.2, "Connection error fraction that raises an alarm, 0 to disable (client mode)")
 
 	flag.Parse()
 
+	if *configKinds {
+		fmt.Print(ConfigKinds(flag.CommandLine))
+		return
+	}
+	if *showVersion {
+		if err := printVersion(os.Stdout, *versionJSON); err != nil {
+			exitWith(ExitRuntime, "%v", err)
+		}
+		return
+	}
+
+	var prof *Profile
+	if *profile != "" {
+		p, err := LookupProfile(*profile)
+		if err != nil {
+			exitWith(ExitConfig, "%v", err)
+		}
+		prof = p
+	}
+
+	var loader *ConfigLoader
+	if *configPath != "" {
+		loader = NewConfigLoader(*configPath, flag.CommandLine)
+		loader.SetProfile(prof)
+		loader.SetPassphrase(PassphraseSource(*configPassFile))
+		if err := loader.Load(); err != nil {
+			exitWith(ExitConfig, "%v", err)
+		}
+		// The profile may also come from the file; it then has to be
+		// applied below the file's other keys
+		if prof == nil && *profile != "" {
+			p, err := LookupProfile(*profile)
+			if err != nil {
+				exitWith(ExitConfig, "%v", err)
+			}
+			prof = p
+			loader.SetProfile(prof)
+			if err := loader.Load(); err != nil {
+				exitWith(ExitConfig, "%v", err)
+			}
+		}
+	} else if prof != nil {
+		if err := prof.Apply(flag.CommandLine); err != nil {
+			exitWith(ExitConfig, "%v", err)
+		}
+	}
+
 	// Initialize logging with parsed verbosity
 	InitLogging(verbosity)
+	if err := SetLogTarget(*logTarget, *logFile); err != nil {
+		exitWith(ExitConfig, "%v", err)
+	}
+	if *logLevels != "" {
+		levels, err := ParseModuleLevels(*logLevels)
+		if err != nil {
+			exitWith(ExitConfig, "Invalid --log-levels: %v", err)
+		}
+		SetModuleLevels(levels)
+	}
+	RepeatWindow = *logSuppress
+	if prof != nil {
+		Log.Infof("Profile: %s (%s)", prof.Name, prof.About)
+	}
+	if loader != nil {
+		Log.Debugf("Effective config from %s:\n%s", *configPath, loader.Effective())
+	}
+	if statsLog := ModuleLogger("stats"); *leakWatch > 0 && statsLog.IsLevelEnabled(logrus.DebugLevel) {
+		go NewLeakWatch(*leakWatch, statsLog).Run(context.Background())
+	}
+	if *clockCheck != "" {
+		go NewClockCheck(*clockCheck, *clockSkewMax, Log).Run(context.Background())
+	}
+
+	// applyPasswordSource fills --password from --password-source; it runs
+	// again on every reload so a rotated keychain entry is picked up. Once a
+	// server's --sandbox or --chroot has cut off the keychain tools, reloads
+	// reuse the secret fetched at startup.
+	var sourced, sourcedFrom string
+	keepSourced := false
+	applyPasswordSource := func() error {
+		if *passwordSource == "" {
+			return nil
+		}
+		if *password != "" {
+			return fmt.Errorf("--password and --password-source are mutually exclusive")
+		}
+		if keepSourced {
+			if *passwordSource != sourcedFrom {
+				return fmt.Errorf("--password-source can't change on reload under --sandbox or --chroot")
+			}
+			*password = sourced
+			return nil
+		}
+		p, err := ResolvePasswordSource(*passwordSource)
+		if err != nil {
+			return err
+		}
+		*password = p
+		sourced, sourcedFrom = p, *passwordSource
+		return nil
+	}
+	if err := applyPasswordSource(); err != nil {
+		exitWith(ExitConfig, "%v", err)
+	}
 
 	if *mode == "" || *password == "" {
-		fmt.Fprintf(os.Stderr, "Usage: %s --mode <server|client> --password <secret> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s --mode <server|client> --password <secret> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s env [--shell bash|fish|powershell] [--listen addr:port] [--unset]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s soak [--duration 5m] [--short-flows 32] [--bulk-flows 2] (see soak --help)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s genconfig --template <file> --vars <vars.json> [--out dir] (see genconfig --help)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s encrypt-secret [--passphrase-file file] (see encrypt-secret --help)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s drain [--admin addr:port] [--wait dur | --resume] (see drain --help)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s update --url <manifest> --key <pubkey> [--restart cmd] (see update --help)\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "  --version [--json]       Print version (with --json: supported features) and exit")
+		fmt.Fprintln(os.Stderr, "  --password-source <src>  Read the password from the OS keychain: keychain:<service>[/<account>]")
+		fmt.Fprintln(os.Stderr, "  --config <file>          JSON config file, keys are flag names (command line wins)")
+		fmt.Fprintln(os.Stderr, "  --config-kinds           Print each config key and its JSON type (boolean, number, ...) and exit")
+		fmt.Fprintln(os.Stderr, "  --config-passphrase-file <file>  Passphrase for \"enc:v1:\" config values (default: $"+ConfigPassphraseEnv+" or prompt)")
+		fmt.Fprintln(os.Stderr, "  --log-target <target>    stdout, stderr, file, syslog or journald (default: stdout)")
+		fmt.Fprintln(os.Stderr, "  --log-file <path>        Log file for --log-target file")
+		fmt.Fprintln(os.Stderr, "  --log-levels <spec>      Per-module levels, e.g. pool=debug,relay=warn")
+		fmt.Fprintf(os.Stderr, "                           (modules: %s)\n", strings.Join(knownModules, ", "))
+		fmt.Fprintln(os.Stderr, "  --log-suppress <dur>     Collapse repeated warnings within this window (default: 1m, 0=disable)")
+		fmt.Fprintln(os.Stderr, "  --startup-json <file>    Write a JSON \"started\" event with the resolved config once listening (-=stdout)")
+		fmt.Fprintln(os.Stderr, "  --clock-check <host>     Warn when the local clock drifts from this NTP server (e.g. pool.ntp.org, default: off)")
+		fmt.Fprintln(os.Stderr, "  --clock-skew-max <dur>   Clock offset that triggers the warning (default: 30s)")
+		fmt.Fprintln(os.Stderr, "  --trace-bytes <n>        Hex-dump the first n relayed bytes each way of sampled connections (default: 0=off)")
+		fmt.Fprintln(os.Stderr, "  --trace-sample <n>       Trace one in n connections (default: 10, 1=all)")
+		fmt.Fprintln(os.Stderr, "  --leak-watch <dur>       With -vv, warn on sustained goroutine growth (default: 1m samples, 0=disable)")
+		fmt.Fprintln(os.Stderr, "  --handshake-workers <n>  Concurrent handshakes (client pool refills, server accepts), 0=unlimited (default: 4 per CPU)")
+		fmt.Fprintln(os.Stderr, "  --mem-limit <size>       Soft memory cap, e.g. 48MB; shed new connections above it (default: none)")
+		fmt.Fprintf(os.Stderr, "  --profile <name>         Hardware preset: %s (flags and config override it)\n", strings.Join(profileNames(), ", "))
+		fmt.Fprintln(os.Stderr, "  --buffer-size <size>     Relay copy buffer per connection direction (default: 32KB)")
+		fmt.Fprintln(os.Stderr, "  --socket-buffer-max <size> Size tunnel socket buffers for high-latency links, up to this (default: 0=OS)")
+		fmt.Fprintln(os.Stderr, "  --congestion-control <a> TCP congestion control for tunnels, e.g. bbr or cubic (Linux, default: system)")
+		fmt.Fprintln(os.Stderr, "  --reload-policy <p>      Open tunnels after a SIGHUP password/server change: grace, drain or kill (default: grace)")
+		fmt.Fprintln(os.Stderr, "  --reload-grace <dur>     Grace period before old tunnels are closed (default: 30s)")
+		fmt.Fprintln(os.Stderr, "  --drain-timeout <dur>    On shutdown, let open connections finish this long, then close them and exit 6 (default: 0=close at once)")
+		fmt.Fprintln(os.Stderr, "  --mux                    Carry many connections as streams over each tunnel (client and server)")
+		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Server mode options:")
 		fmt.Fprintln(os.Stderr, "  --listen <addr:port>     Listen address (e.g., 0.0.0.0:8443)")
 		fmt.Fprintln(os.Stderr, "  --forward <addr:port>    Backend to forward traffic to")
+		fmt.Fprintln(os.Stderr, "  --forward-fallback <addr:port> Secondary backend when --forward is unreachable")
+		fmt.Fprintln(os.Stderr, "  --forward-retries <n>    Extra rounds over the backends before dropping a tunnel (default: 0)")
+		fmt.Fprintln(os.Stderr, "  --forward-backoff <dur>  Wait before the first retry, doubling after each (default: 200ms)")
+		fmt.Fprintln(os.Stderr, "  --forward-pool <n>       Backend connections kept open ahead of tunnels (default: 0)")
+		fmt.Fprintln(os.Stderr, "  --forward-pool-ttl <dur> Replace pooled backend connections idle this long (default: 30s)")
 		fmt.Fprintln(os.Stderr, "  --socks5                 Run SOCKS5 proxy instead of port forward")
+		fmt.Fprintln(os.Stderr, "  --socks5-reply-addr <ip[:port]> Public address reported in SOCKS5 replies behind NAT")
+		fmt.Fprintln(os.Stderr, "  --socks5-udp             Accept SOCKS5 UDP ASSOCIATE carried through the tunnel by clients run with --socks5-udp")
+		fmt.Fprintln(os.Stderr, "  --socks5-auth <backend>  Require SOCKS5 credentials: htpasswd:<file>, exec:<command>, pam[:<service>] or http(s)://<url>")
+		fmt.Fprintln(os.Stderr, "  --socks5-auth-cache <dur> Remember credentials the auth backend accepted this long (default: 1m)")
+		fmt.Fprintln(os.Stderr, "  --socks5-dial-retries <n> Retry targets that refuse or fail DNS transiently, e.g. while restarting (default: 0)")
+		fmt.Fprintln(os.Stderr, "  --socks5-dial-backoff <dur> Wait before the first retry, doubling after each (default: 200ms)")
+		fmt.Fprintln(os.Stderr, "  --upstream <addr:port>   Bridge: carry connections to a second ShadowTLS server instead")
+		fmt.Fprintln(os.Stderr, "  --upstream-sni <host>    SNI for the second hop (required with --upstream)")
+		fmt.Fprintln(os.Stderr, "  --upstream-password <pw> Second-hop password (default: --password); dial timeout is --timeout")
+		fmt.Fprintln(os.Stderr, "  --rendezvous             Relay between clients using --expose and --peer (experimental)")
+		fmt.Fprintln(os.Stderr, "  --min-client-version <v> Warn about clients older than this (only clients run with --ping-interval report one)")
+		fmt.Fprintln(os.Stderr, "  --admin <addr:port>      Serve /drain for shadowtls drain (with the --admin-* options below)")
 		fmt.Fprintln(os.Stderr, "  --handshake <host:port>  TLS server for handshake camouflage")
 		fmt.Fprintln(os.Stderr, "  --wildcard-sni           Use client's SNI as handshake server")
+		fmt.Fprintln(os.Stderr, "  --cpu-limit <percent>    Shed new handshakes above this CPU use, keeping open relays (default: 0=off)")
+		fmt.Fprintln(os.Stderr, "  --handshake-queue <n>    Handshakes waiting for a slot before rejecting (default: 256)")
+		fmt.Fprintln(os.Stderr, "  --handshake-per-source <n> Handshakes running or queued per client address (default: 64, 0=unlimited)")
+		fmt.Fprintln(os.Stderr, "  --session-timeout <dur>  Drop tunnels that stay idle before their first frame (default: 2m, 0=never)")
+		fmt.Fprintln(os.Stderr, "  --first-frame-timeout <dur> Drop tunnels silent this long after the handshake (default: 0=--session-timeout)")
+		fmt.Fprintln(os.Stderr, "  --idle-timeout <dur>     Close relayed connections idle this long (default: 5m)")
+		fmt.Fprintln(os.Stderr, "  --dial-timeout <rules>   Backend dial timeouts by destination, e.g. \"5s,:22=30s,*.lan=1s\" (default: OS limit)")
+		fmt.Fprintln(os.Stderr, "  --chroot <dir>           Change root to this directory after binding --listen (needs root and --user)")
+		fmt.Fprintln(os.Stderr, "  --user <name>            Drop root for this user after binding --listen")
+		fmt.Fprintln(os.Stderr, "  --group <name>           ...and this group (default: the user's primary group)")
+		fmt.Fprintln(os.Stderr, "  --sandbox                After binding, restrict files and syscalls with Landlock and seccomp (Linux)")
+		fmt.Fprintln(os.Stderr, "  --socks5-timeout <dur>   Deadline for a SOCKS5 client's greeting, auth and request (default: 10s, 0=never)")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Client mode options:")
 		fmt.Fprintln(os.Stderr, "  --listen <addr:port>     Listen address (default: 127.0.0.1:1080)")
-		fmt.Fprintln(os.Stderr, "  --server <addr:port>     ShadowTLS server address")
-		fmt.Fprintln(os.Stderr, "  --sni <hostname>         SNI for TLS handshake")
+		fmt.Fprintln(os.Stderr, "  --server <addr:port>     ShadowTLS server address, or a comma-separated failover list")
+		fmt.Fprintln(os.Stderr, "  --failover-after <n>     Failed dials in a row before switching to the next server (default: 3)")
+		fmt.Fprintln(os.Stderr, "  --failover-recheck <dur> Retry a preferred server that is down this often (default: 30s)")
+		fmt.Fprintln(os.Stderr, "  --sni <hostname>         SNI for TLS handshake; comma-separated hosts are rotated (needs --wildcard-sni)")
+		fmt.Fprintln(os.Stderr, "  --sni-probe <dur>        Probe each SNI host directly and take failing ones out of rotation (default: 0=off)")
 		fmt.Fprintln(os.Stderr, "  --pool-size <n>          Connection pool size (default: 10)")
+		fmt.Fprintln(os.Stderr, "  --pool-max <n>           Grow the pool up to n under bursts, back to --pool-size when idle (default: 0, fixed)")
+		fmt.Fprintln(os.Stderr, "  --pool-refill <policy>   adaptive (back off on failures/rising RTT) or fixed (default: adaptive)")
 		fmt.Fprintln(os.Stderr, "  --ttl <duration>         Connection TTL (default: 10s)")
+		fmt.Fprintln(os.Stderr, "  --ttl-auto               Learn the server session timeout and keep the TTL below it (--ttl is the maximum)")
 		fmt.Fprintln(os.Stderr, "  --backoff <duration>     Retry backoff (default: 5s)")
 		fmt.Fprintln(os.Stderr, "  --timeout <duration>     Connection timeout (default: 10s)")
+		fmt.Fprintln(os.Stderr, "  --ping-interval <dur>    Ping the server through a pooled tunnel to measure RTT and liveness (default: 0=off)")
+		fmt.Fprintln(os.Stderr, "  --blackhole-probe <addr> UDP DNS server that confirms suspected blackholing, e.g. 9.9.9.9:53")
+		fmt.Fprintln(os.Stderr, "  --retry-hold <dur>       Hold connections through a brief server outage, e.g. 10s (default: 0=fail at once)")
+		fmt.Fprintln(os.Stderr, "  --handshake-rate <n>     Start at most n tunnel handshakes per second, e.g. 2 (default: 0=unlimited)")
+		fmt.Fprintln(os.Stderr, "  --handshake-burst <n>    ...but up to this many at once (default: 4)")
+		fmt.Fprintln(os.Stderr, "  --rate-limit-up <size>   Cap app → server bytes per second, e.g. 1MB (default: unlimited)")
+		fmt.Fprintln(os.Stderr, "  --rate-limit-down <size> Cap server → app bytes per second, e.g. 4MB (default: unlimited)")
+		fmt.Fprintln(os.Stderr, "  --rate-limit-per-conn    Give each connection the full rate limits instead of sharing them")
+		fmt.Fprintln(os.Stderr, "  --storm-pacing <dur>     Delay connections in a reconnect storm by up to this, e.g. 500ms (default: 0=off)")
+		fmt.Fprintln(os.Stderr, "  --first-packet-timeout <dur> Wait for the local client's first packet (default: 10s)")
+		fmt.Fprintln(os.Stderr, "  --first-packet-max <size> Opening burst buffered for stale-tunnel replay (default: 128KB)")
+		fmt.Fprintln(os.Stderr, "  --handshake-debug        Log a metadata transcript (records, extensions, timing) of failed handshakes")
+		fmt.Fprintln(os.Stderr, "  --verify-handshake-cert  Fail dials whose decoy certificate doesn't verify for --sni (detects interception)")
+		fmt.Fprintln(os.Stderr, "  --pin-sha256 <pins>      Base64 or hex SPKI SHA-256 pins, comma-separated; the decoy chain must match one")
+		fmt.Fprintln(os.Stderr, "  --skip-verify            Don't wait for the server's first response (faster start, stale tunnels fail)")
+		fmt.Fprintln(os.Stderr, "  --verify-coalesce <dur>  Merge a first response split across segments within this gap (default: 0=off)")
+		fmt.Fprintln(os.Stderr, "  --sniff-guard <mode>     Refuse and explain apps that send plain HTTP/TLS to the listener: warn, help or off (default: off)")
+		fmt.Fprintln(os.Stderr, "  --passive                Don't wait for client data (SSH/SMTP and other server-speaks-first protocols)")
 		fmt.Fprintln(os.Stderr, "  --stats-interval <dur>   Stats logging interval (default: 10s, 0=disable)")
+		fmt.Fprintln(os.Stderr, "  --captive-probe <url>    Detect captive portals after connect failures by fetching url (default: off)")
+		fmt.Fprintln(os.Stderr, "  --captive-expect <text>  Probe body to expect instead of a 204 (e.g. Success for captive.apple.com)")
+		fmt.Fprintln(os.Stderr, "  --apply-system-proxy     Point OS proxy settings at the listener, revert on exit (needs server --socks5)")
+		fmt.Fprintln(os.Stderr, "  --loop-check=false       Allow server traffic via a TUN interface (e.g. an upstream VPN)")
+		fmt.Fprintln(os.Stderr, "  --expose <name=host:port> Let clients with --peer <name> reach host:port from here")
+		fmt.Fprintln(os.Stderr, "  --peer <name>            Carry connections to the client exposing <name> (server needs --rendezvous)")
+		fmt.Fprintln(os.Stderr, "  --mux-tunnels <n>        Tunnels shared by all connections with --mux (default: 2)")
+		fmt.Fprintln(os.Stderr, "  --dns-listen <addr:port> Resolve DNS through the tunnel for local apps, e.g. 127.0.0.1:5353 (needs server --socks5)")
+		fmt.Fprintln(os.Stderr, "  --socks5-udp             Carry SOCKS5 apps' UDP ASSOCIATE through the tunnel (needs server --socks5 --socks5-udp)")
+		fmt.Fprintln(os.Stderr, "  --dns-upstream <addr>    Resolver queried from the server (default: 1.1.1.1:53)")
+		fmt.Fprintln(os.Stderr, "  --dns-cache <n>          DNS answers to cache (default: 1024, 0=off)")
+		fmt.Fprintln(os.Stderr, "  --maintenance <windows>  Replace pooled and open tunnels at e.g. \"03:00/15m\" or \"sun 04:00/1h\" (local time)")
+		fmt.Fprintln(os.Stderr, "  --handoff <path>         Unix socket for upgrades; a new client on the same path takes over the listener")
+		fmt.Fprintln(os.Stderr, "  --admin <addr:port>      Serve /stats, /conns, /pool and /history as JSON, and /drain (see shadowtls drain)")
+		fmt.Fprintln(os.Stderr, "  --admin-token <token>    Require 'Authorization: Bearer <token>' (needed off loopback)")
+		fmt.Fprintln(os.Stderr, "  --admin-tls-cert <file>  Serve the admin endpoint over HTTPS (with --admin-tls-key)")
+		fmt.Fprintln(os.Stderr, "  --admin-client-ca <file> Require client certificates signed by this CA (mTLS)")
+		fmt.Fprintln(os.Stderr, "  --conn-log <file>        Record each closed connection (bytes, durations, pool source, close reason); .csv or JSON lines")
+		fmt.Fprintln(os.Stderr, "  --conn-log-max-size <size> Rotate it at this size (default: 10MB, 0=never)")
+		fmt.Fprintln(os.Stderr, "  --conn-log-keep <n>      Rotated files to keep as <file>.1 ... (default: 5)")
+		fmt.Fprintln(os.Stderr, "  --stats-history <dur>    Stats history served at /history (default: 24h, 0=off)")
+		fmt.Fprintln(os.Stderr, "  --stats-history-interval <dur> Resolution of that history (default: 1m)")
+		fmt.Fprintln(os.Stderr, "  --stats-push <url>       Push stats to statsd://, graphite://, influx:// or influx-udp://")
+		fmt.Fprintln(os.Stderr, "  --stats-push-interval <dur> Stats push interval (default: 10s)")
+		fmt.Fprintln(os.Stderr, "  --stats-push-prefix <s>  Metric prefix / influx measurement (default: shadowtls)")
+		fmt.Fprintln(os.Stderr, "  --alarm-window <dur>     Rolling window for WARN alarms (default: 5m, 0=disable)")
+		fmt.Fprintln(os.Stderr, "  --alarm-stale-rate <f>   Alarm when stale tunnels exceed this fraction (default: 0.2)")
+		fmt.Fprintln(os.Stderr, "  --alarm-error-rate <f>   Alarm when connection errors exceed this fraction (default: 0.2)")
 		fmt.Fprintln(os.Stderr, "  -v, -vv, -vvv            Log verbosity (info/debug/trace)")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Examples:")
 		fmt.Fprintln(os.Stderr, "  Server: shadowtls --mode server --listen 0.0.0.0:8443 --socks5 --handshake www.google.com:443 --password secret")
 		fmt.Fprintln(os.Stderr, "  Client: shadowtls --mode client --server example.com:8443 --sni www.google.com --password secret -vvv")
-		os.Exit(1)
+		os.Exit(ExitUsage)
+	}
+
+	var memLimitBytes int64
+	if *memLimit != "" {
+		n, err := ParseSize(*memLimit)
+		if err != nil {
+			exitWith(ExitConfig, "Invalid --mem-limit: %v", err)
+		}
+		memLimitBytes = n
+	}
+	firstPacketMaxBytes, err := ParseSize(*firstPacketMax)
+	if err != nil {
+		exitWith(ExitConfig, "Invalid --first-packet-max: %v", err)
+	}
+	bufferSizeBytes, err := ParseSize(*bufferSize)
+	if err != nil || bufferSizeBytes < 1024 || bufferSizeBytes > 1024*1024 {
+		exitWith(ExitConfig, "Invalid --buffer-size %q: must be between 1KB and 1MB", *bufferSize)
+	}
+	setRelayBufferSize(int(bufferSizeBytes))
+	socketBufferBytes, err := ParseSize(*socketBufferMax)
+	if err != nil || socketBufferBytes > 1<<30 {
+		exitWith(ExitConfig, "Invalid --socket-buffer-max %q: must be a size up to 1GB", *socketBufferMax)
+	}
+	if *congestion != "" {
+		if err := checkCongestion(*congestion); err != nil {
+			exitWith(ExitConfig, "%v", err)
+		}
+	}
+	if *drainTimeout < 0 {
+		exitWith(ExitConfig, "Invalid --drain-timeout %v: cannot be negative", *drainTimeout)
+	}
+
+	policy := func() ReloadPolicy {
+		return ReloadPolicy{Mode: *reloadPolicy, Grace: *reloadGrace}
+	}
+	adminConfig := func() *AdminConfig {
+		if *admin == "" {
+			return nil
+		}
+		return &AdminConfig{
+			Addr:     *admin,
+			Token:    *adminToken,
+			TLSCert:  *adminCert,
+			TLSKey:   *adminKey,
+			ClientCA: *adminClientCA,
+		}
 	}
 
 	switch *mode {
 	case "server":
-		if *listen == "" {
-			Log.Fatal("Server mode requires --listen")
+		// The running server's confinement; files re-read on reload are
+		// looked up inside its --chroot
+		var confined *Confinement
+		buildServerConfig := func() (*ServerConfig, error) {
+			if *listen == "" {
+				return nil, fmt.Errorf("server mode requires --listen")
+			}
+			if *forward == "" && !*socks5Mode && *upstream == "" && !*rendezvous {
+				return nil, fmt.Errorf("server mode requires --forward, --socks5, --upstream or --rendezvous")
+			}
+			if *forwardFallback != "" && *forward == "" {
+				return nil, fmt.Errorf("--forward-fallback requires --forward")
+			}
+			if *forwardRetries < 0 || *forwardBackoff < 0 {
+				return nil, fmt.Errorf("--forward-retries and --forward-backoff cannot be negative")
+			}
+			if *socks5Retries < 0 || *socks5Backoff < 0 {
+				return nil, fmt.Errorf("--socks5-dial-retries and --socks5-dial-backoff cannot be negative")
+			}
+			if *socks5Retries > 0 && !*socks5Mode {
+				return nil, fmt.Errorf("--socks5-dial-retries requires --socks5")
+			}
+			if *forwardPool < 0 || *forwardPoolTTL <= 0 {
+				return nil, fmt.Errorf("--forward-pool cannot be negative and --forward-pool-ttl must be positive")
+			}
+			if *forwardPool > 0 && *forward == "" {
+				return nil, fmt.Errorf("--forward-pool requires --forward")
+			}
+			var upstreamConfig *UpstreamConfig
+			if *upstream != "" {
+				if *forward != "" || *socks5Mode {
+					return nil, fmt.Errorf("--upstream cannot be combined with --forward or --socks5")
+				}
+				if *upstreamSNI == "" {
+					return nil, fmt.Errorf("--upstream requires --upstream-sni")
+				}
+				upstreamConfig = &UpstreamConfig{
+					Server:   *upstream,
+					SNI:      *upstreamSNI,
+					Password: *upstreamPassword,
+					Timeout:  *timeout,
+				}
+				if upstreamConfig.Password == "" {
+					upstreamConfig.Password = *password
+				}
+			}
+			var replyAddr *net.TCPAddr
+			if *socks5Reply != "" {
+				addr, err := parseReplyAddr(*socks5Reply)
+				if err != nil {
+					return nil, err
+				}
+				replyAddr = addr
+			}
+			if *socks5UDP && !*socks5Mode {
+				return nil, fmt.Errorf("--socks5-udp needs --socks5")
+			}
+			var socksAuth socks5.Authenticator
+			if *socks5Auth != "" {
+				if !*socks5Mode {
+					return nil, fmt.Errorf("--socks5-auth needs --socks5")
+				}
+				if *sandbox && strings.HasPrefix(*socks5Auth, "exec:") {
+					return nil, fmt.Errorf("--socks5-auth exec: can't run commands under --sandbox")
+				}
+				if isPAMAuth(*socks5Auth) && (*sandbox || *chroot != "") {
+					return nil, fmt.Errorf("--socks5-auth pam needs the PAM modules and helpers, which --sandbox and --chroot cut off")
+				}
+				spec := *socks5Auth
+				if path, ok := strings.CutPrefix(spec, "htpasswd:"); ok && confined != nil {
+					if path, err = confined.Path(path); err != nil {
+						return nil, fmt.Errorf("--socks5-auth: %v", err)
+					}
+					spec = "htpasswd:" + path
+				}
+				auth, err := parseSocksAuth(spec, *socks5AuthCache)
+				if err != nil {
+					return nil, err
+				}
+				socksAuth = auth
+			}
+			if *handshake == "" && !*wildcardSNI {
+				return nil, fmt.Errorf("server mode requires --handshake or --wildcard-sni")
+			}
+			if *password == "" {
+				return nil, fmt.Errorf("server mode requires --password")
+			}
+			if *cpuLimit < 0 || *cpuLimit > 100 {
+				return nil, fmt.Errorf("--cpu-limit must be between 0 and 100")
+			}
+			if *firstFrameTimeout < 0 {
+				return nil, fmt.Errorf("--first-frame-timeout cannot be negative")
+			}
+			dialTimeouts, err := ParseDialTimeouts(*dialTimeout)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := parseVersion(*minClientVersion); *minClientVersion != "" && !ok {
+				return nil, fmt.Errorf("invalid --min-client-version %q (want e.g. v1.4.0)", *minClientVersion)
+			}
+			if *sandbox && !sandboxSupported {
+				return nil, fmt.Errorf("--sandbox is only supported on Linux")
+			}
+			if *chroot != "" && *runAsUser == "" {
+				return nil, fmt.Errorf("--chroot needs --user: a process still running as root can leave the chroot")
+			}
+			confine := &Confinement{Chroot: *chroot, User: *runAsUser, Group: *runAsGroup, Sandbox: *sandbox}
+			if confine.Sandbox {
+				// /etc keeps DNS resolution (resolv.conf, hosts, nsswitch) working
+				confine.ReadPaths = []string{"/etc"}
+				// The sandbox is entered inside --chroot, where only files
+				// under it can be named
+				if path, err := confine.Path(*configPath); *configPath != "" && err == nil {
+					confine.ReadPaths = append(confine.ReadPaths, path)
+				}
+				if path, ok := strings.CutPrefix(*socks5Auth, "htpasswd:"); ok {
+					if path, err := confine.Path(path); err == nil {
+						confine.ReadPaths = append(confine.ReadPaths, path)
+					}
+				}
+				if *logTarget == "file" {
+					confine.WritePaths = []string{*logFile}
+				}
+			}
+			return &ServerConfig{
+				ListenAddr:         *listen,
+				ForwardAddr:        *forward,
+				ForwardFallback:    *forwardFallback,
+				ForwardRetries:     *forwardRetries,
+				ForwardBackoff:     *forwardBackoff,
+				ForwardPool:        *forwardPool,
+				ForwardPoolTTL:     *forwardPoolTTL,
+				Handshake:          *handshake,
+				Password:           *password,
+				WildcardSNI:        *wildcardSNI,
+				Socks5Mode:         *socks5Mode,
+				Socks5Reply:        replyAddr,
+				Socks5UDP:          *socks5UDP,
+				Socks5Auth:         socksAuth,
+				Upstream:           upstreamConfig,
+				Rendezvous:         *rendezvous,
+				Mux:                *mux,
+				DialTimeouts:       dialTimeouts,
+				Socks5Retries:      *socks5Retries,
+				Socks5Backoff:      *socks5Backoff,
+				ReloadPolicy:       policy(),
+				DrainTimeout:       *drainTimeout,
+				StartupJSON:        *startupJSON,
+				MemLimit:           memLimitBytes,
+				CPULimit:           *cpuLimit,
+				SocketBufferMax:    int(socketBufferBytes),
+				Congestion:         *congestion,
+				Confine:            confine,
+				TraceBytes:         *traceBytes,
+				TraceSample:        *traceSample,
+				HandshakeWorkers:   *handshakeWorkers,
+				HandshakeQueue:     *handshakeQueue,
+				HandshakePerSource: *handshakePerSource,
+				SessionTimeout:     *sessionTimeout,
+				IdleTimeout:        *idleTimeout,
+				Socks5Timeout:      *socks5Timeout,
+				Logger:             ModuleLogger("server"),
+
+				FirstFrameTimeout: *firstFrameTimeout,
+				MinClientVersion:  *minClientVersion,
+				Admin:             adminConfig(),
+			}, nil
 		}
-		if *forward == "" && !*socks5Mode {
-			Log.Fatal("Server mode requires --forward or --socks5")
+		serverConfig, err := buildServerConfig()
+		if err != nil {
+			exitWith(ExitConfig, "%v", err)
 		}
+		confined = serverConfig.Confine
+		keepSourced = confined.Sandbox || confined.Chroot != ""
 		if *forward != "" && *socks5Mode {
 			Log.Warn("Both --forward and --socks5 set; --socks5 takes precedence")
 		}
-		if *handshake == "" && !*wildcardSNI {
-			Log.Fatal("Server mode requires --handshake or --wildcard-sni")
+		if isPAMAuth(*socks5Auth) && *runAsUser != "" {
+			Log.Warnf("--socks5-auth pam with --user %s: pam_unix can only check that user's own password once root is dropped", *runAsUser)
 		}
-		serverConfig := &ServerConfig{
-			ListenAddr:  *listen,
-			ForwardAddr: *forward,
-			Handshake:   *handshake,
-			Password:    *password,
-			WildcardSNI: *wildcardSNI,
-			Socks5Mode:  *socks5Mode,
-			Logger:      Log,
+		if _, err := confined.Path(*configPath); loader != nil && err != nil {
+			Log.Warnf("SIGHUP reloads will fail: config file %v", err)
+		}
+		if loader != nil {
+			serverConfig.Reload = func() (*ServerConfig, error) {
+				path, err := confined.Path(*configPath)
+				if err != nil {
+					return nil, fmt.Errorf("config file can't be re-read: %v", err)
+				}
+				loader.SetPath(path)
+				if err := loader.Load(); err != nil {
+					return nil, err
+				}
+				if err := applyPasswordSource(); err != nil {
+					return nil, err
+				}
+				return buildServerConfig()
+			}
 		}
 		server := NewServer(serverConfig)
 		if err := server.Run(); err != nil {
-			Log.Fatalf("Server error: %v", err)
+			exitWith(exitCode(err), "Server error: %v", err)
 		}
 	case "client":
-		if *server == "" || *sni == "" {
-			Log.Fatal("Client mode requires --server and --sni")
-		}
-		if *listen == "" {
-			*listen = "127.0.0.1:1080"
-		}
-		clientConfig := &ClientConfig{
-			ListenAddr:    *listen,
-			ServerAddr:    *server,
-			SNI:           *sni,
-			Password:      *password,
-			PoolSize:      *poolSize,
-			TTL:           *ttl,
-			Backoff:       *backoff,
-			Timeout:       *timeout,
-			StatsInterval: *statsInterval,
-			Logger:        Log,
+		buildClientConfig := func() (*ClientConfig, error) {
+			if *server == "" || *sni == "" {
+				return nil, fmt.Errorf("client mode requires --server and --sni")
+			}
+			if *password == "" {
+				return nil, fmt.Errorf("client mode requires --password")
+			}
+			if *listen == "" {
+				*listen = "127.0.0.1:1080"
+			}
+			var exposeConfig *ExposeConfig
+			if *expose != "" {
+				name, target, ok := strings.Cut(*expose, "=")
+				if !ok || name == "" || target == "" {
+					return nil, fmt.Errorf("--expose must be name=host:port, got %q", *expose)
+				}
+				if len(name) > 255 {
+					return nil, fmt.Errorf("--expose name is longer than 255 bytes")
+				}
+				exposeConfig = &ExposeConfig{Name: name, Target: target}
+			}
+			if len(*peer) > 255 {
+				return nil, fmt.Errorf("--peer name is longer than 255 bytes")
+			}
+			if *poolMax != 0 && *poolMax < *poolSize {
+				return nil, fmt.Errorf("--pool-max %d is below --pool-size %d", *poolMax, *poolSize)
+			}
+			muxSize := 0
+			if *mux {
+				switch {
+				case *muxTunnels < 1:
+					return nil, fmt.Errorf("--mux-tunnels must be at least 1")
+				case *peer != "":
+					return nil, fmt.Errorf("--mux can't be combined with --peer")
+				case *passive:
+					return nil, fmt.Errorf("--mux can't be combined with --passive")
+				}
+				muxSize = *muxTunnels
+			}
+			var pushConfig *PushConfig
+			if *statsPush != "" {
+				pushConfig = &PushConfig{
+					Target:   *statsPush,
+					Prefix:   *statsPushPrefix,
+					Interval: *statsPushInterval,
+				}
+			}
+			var connLogConfig *ConnLogConfig
+			if *connLog != "" {
+				maxSize, err := ParseSize(*connLogMaxSize)
+				if err != nil {
+					return nil, fmt.Errorf("invalid --conn-log-max-size: %v", err)
+				}
+				if *connLogKeep < 0 {
+					return nil, fmt.Errorf("invalid --conn-log-keep %d: cannot be negative", *connLogKeep)
+				}
+				connLogConfig = &ConnLogConfig{Path: *connLog, MaxSize: maxSize, Keep: *connLogKeep}
+			}
+			if *statsHistory < 0 || *statsHistory > 0 && (*statsHistoryInterval <= 0 || *statsHistoryInterval > *statsHistory) {
+				return nil, fmt.Errorf("invalid --stats-history %v / --stats-history-interval %v: the interval must be positive and within the history", *statsHistory, *statsHistoryInterval)
+			}
+			if *handshakeRate < 0 || *handshakeBurst < 1 {
+				return nil, fmt.Errorf("invalid --handshake-rate %g / --handshake-burst %d: want a rate of at least 0 and a burst of at least 1", *handshakeRate, *handshakeBurst)
+			}
+			if *stormPacing < 0 {
+				return nil, fmt.Errorf("invalid --storm-pacing %v: cannot be negative", *stormPacing)
+			}
+			if _, err := ParseSNIList(*sni); err != nil {
+				return nil, fmt.Errorf("invalid --sni: %v", err)
+			}
+			if *socks5UDP && *passive {
+				return nil, fmt.Errorf("--socks5-udp needs the app to speak first; it can't be used with --passive")
+			}
+			if *sniProbe < 0 {
+				return nil, fmt.Errorf("invalid --sni-probe %v: cannot be negative", *sniProbe)
+			}
+			var rateLimit *RateLimitConfig
+			if *rateLimitUp != "" || *rateLimitDown != "" {
+				parseRate := func(name, value string) (int64, error) {
+					if value == "" {
+						return 0, nil
+					}
+					n, err := ParseSize(value)
+					if err != nil || n <= 0 {
+						return 0, fmt.Errorf("invalid --%s %q: want a positive size per second, e.g. 1MB", name, value)
+					}
+					return n, nil
+				}
+				up, err := parseRate("rate-limit-up", *rateLimitUp)
+				if err != nil {
+					return nil, err
+				}
+				down, err := parseRate("rate-limit-down", *rateLimitDown)
+				if err != nil {
+					return nil, err
+				}
+				rateLimit = &RateLimitConfig{Up: up, Down: down, PerConn: *rateLimitPerConn}
+			}
+			if _, err := ParseServerList(*server); err != nil {
+				return nil, fmt.Errorf("invalid --server: %v", err)
+			}
+			if *failoverAfter < 1 || *failoverRecheck <= 0 {
+				return nil, fmt.Errorf("invalid --failover-after %d / --failover-recheck %v: both must be positive", *failoverAfter, *failoverRecheck)
+			}
+			if *blackholeProbe != "" {
+				if _, _, err := net.SplitHostPort(*blackholeProbe); err != nil {
+					return nil, fmt.Errorf("invalid --blackhole-probe %q: %v", *blackholeProbe, err)
+				}
+			}
+			maintenanceWindows, err := ParseMaintenanceWindows(*maintenance)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --maintenance: %v", err)
+			}
+			switch *sniffGuard {
+			case SniffOff, SniffWarn, SniffHelp:
+			default:
+				return nil, fmt.Errorf("invalid --sniff-guard %q (use warn, help or off)", *sniffGuard)
+			}
+			var dnsConfig *DNSConfig
+			if *dnsListen != "" {
+				if _, _, err := net.SplitHostPort(*dnsUpstream); err != nil {
+					return nil, fmt.Errorf("invalid --dns-upstream %q: %v", *dnsUpstream, err)
+				}
+				dnsConfig = &DNSConfig{Listen: *dnsListen, Upstream: *dnsUpstream, CacheSize: *dnsCache}
+			}
+			var certs *stls.CertPolicy
+			if *verifyHandshakeCert || *pinSHA256 != "" {
+				pins, err := stls.ParsePins(*pinSHA256)
+				if err != nil {
+					return nil, fmt.Errorf("invalid --pin-sha256: %v", err)
+				}
+				certs = &stls.CertPolicy{Verify: *verifyHandshakeCert, Pins: pins}
+			}
+			var alarmConfig *AlarmConfig
+			if *alarmWindow > 0 && (*alarmStaleRate > 0 || *alarmErrorRate > 0) {
+				alarmConfig = &AlarmConfig{
+					Window:    *alarmWindow,
+					StaleRate: *alarmStaleRate,
+					ErrorRate: *alarmErrorRate,
+				}
+			}
+			return &ClientConfig{
+				ListenAddr:     *listen,
+				ServerAddr:     *server,
+				SNI:            *sni,
+				Password:       *password,
+				PoolSize:       *poolSize,
+				PoolMax:        *poolMax,
+				PoolRefill:     *poolRefill,
+				TTL:            *ttl,
+				TTLAuto:        *ttlAuto,
+				Backoff:        *backoff,
+				Timeout:        *timeout,
+				RetryHold:      *retryHold,
+				StormPacing:    *stormPacing,
+				PingInterval:   *pingInterval,
+				BlackholeProbe: *blackholeProbe,
+				FailoverAfter:  *failoverAfter,
+				SNIProbe:       *sniProbe,
+				ServerRecheck:  *failoverRecheck,
+				FirstPacket:    *firstPacket,
+				FirstPacketMax: int(firstPacketMaxBytes),
+				SkipVerify:     *skipVerify,
+				VerifyCoalesce: *verifyCoalesce,
+				Passive:        *passive,
+				Socks5UDP:      *socks5UDP,
+				SniffGuard:     *sniffGuard,
+				Maintenance:    maintenanceWindows,
+				StatsInterval:  *statsInterval,
+				CaptiveProbe:   *captiveProbe,
+				CaptiveExpect:  *captiveExpect,
+				SystemProxy:    *systemProxy,
+				LoopCheck:      *loopCheck,
+				Admin:          adminConfig(),
+				StatsPush:      pushConfig,
+				ConnLog:        connLogConfig,
+				History:        *statsHistory,
+				HistoryStep:    *statsHistoryInterval,
+				Alarms:         alarmConfig,
+				ReloadPolicy:   policy(),
+				DrainTimeout:   *drainTimeout,
+				Handoff:        *handoff,
+				Expose:         exposeConfig,
+				Peer:           *peer,
+				Mux:            muxSize,
+				DNS:            dnsConfig,
+				StartupJSON:    *startupJSON,
+				MemLimit:       memLimitBytes,
+				SocketBuffer:   int(socketBufferBytes),
+				Congestion:     *congestion,
+				HandshakeLimit: *handshakeWorkers,
+				HandshakeRate:  *handshakeRate,
+				HandshakeBurst: *handshakeBurst,
+				HandshakeDebug: *handshakeDebug,
+				HandshakeCerts: certs,
+				RateLimit:      rateLimit,
+				TraceBytes:     *traceBytes,
+				TraceSample:    *traceSample,
+				Logger:         ModuleLogger("client"),
+			}, nil
+		}
+		clientConfig, err := buildClientConfig()
+		if err != nil {
+			exitWith(ExitConfig, "%v", err)
+		}
+		if loader != nil {
+			clientConfig.Reload = func() (*ClientConfig, error) {
+				if err := loader.Load(); err != nil {
+					return nil, err
+				}
+				if err := applyPasswordSource(); err != nil {
+					return nil, err
+				}
+				return buildClientConfig()
+			}
 		}
 		client := NewClient(clientConfig)
 		if err := client.Run(); err != nil {
-			Log.Fatalf("Client error: %v", err)
+			exitWith(exitCode(err), "Client error: %v", err)
 		}
 	default:
-		Log.Fatalf("Unknown mode: %s (use 'server' or 'client')", *mode)
+		exitWith(ExitUsage, "Unknown mode: %s (use 'server' or 'client')", *mode)
 	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// MaintenanceWindow is a recurring period of local time, daily or weekly, at
+// whose start the client replaces its tunnels
+type MaintenanceWindow struct {
+	Daily    bool
+	Weekday  time.Weekday // Only when not Daily
+	Hour     int
+	Minute   int
+	Duration time.Duration // Open tunnels may finish until the window ends
+}
+
+// ParseMaintenanceWindows parses a comma-separated list of windows written as
+// "[day ]HH:MM/duration", e.g. "03:00/15m" or "sun 04:00/1h"
+func ParseMaintenanceWindows(spec string) ([]MaintenanceWindow, error) {
+	var windows []MaintenanceWindow
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		w := MaintenanceWindow{Daily: true}
+		if day, rest, ok := strings.Cut(part, " "); ok {
+			wd, known := weekdayNames[strings.ToLower(day)]
+			if !known {
+				return nil, fmt.Errorf("maintenance window %q: unknown day %q (use sun..sat)", part, day)
+			}
+			w.Daily, w.Weekday = false, wd
+			part = strings.TrimSpace(rest)
+		}
+		clock, dur, ok := strings.Cut(part, "/")
+		if !ok {
+			return nil, fmt.Errorf("maintenance window %q: want HH:MM/duration", part)
+		}
+		start, err := time.Parse("15:04", clock)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %q: bad start time %q", part, clock)
+		}
+		w.Hour, w.Minute = start.Hour(), start.Minute()
+		if w.Duration, err = time.ParseDuration(dur); err != nil || w.Duration <= 0 || w.Duration > 24*time.Hour {
+			return nil, fmt.Errorf("maintenance window %q: duration must be between 1s and 24h", part)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func (w MaintenanceWindow) String() string {
+	day := "daily"
+	if !w.Daily {
+		day = strings.ToLower(w.Weekday.String()[:3])
+	}
+	return fmt.Sprintf("%s %02d:%02d/%v", day, w.Hour, w.Minute, w.Duration)
+}
+
+// Next returns the first start of the window after now, in now's location
+func (w MaintenanceWindow) Next(now time.Time) time.Time {
+	for i := 0; ; i++ {
+		start := time.Date(now.Year(), now.Month(), now.Day()+i, w.Hour, w.Minute, 0, 0, now.Location())
+		if start.After(now) && (w.Daily || start.Weekday() == w.Weekday) {
+			return start
+		}
+	}
+}
+
+// nextMaintenance returns the window starting soonest after now
+func nextMaintenance(windows []MaintenanceWindow, now time.Time) (time.Time, MaintenanceWindow) {
+	var next time.Time
+	var window MaintenanceWindow
+	for _, w := range windows {
+		if start := w.Next(now); next.IsZero() || start.Before(next) {
+			next, window = start, w
+		}
+	}
+	return next, window
+}
+
+// runMaintenance cycles the tunnels at the start of every maintenance window
+// until ctx is done. dns may be nil.
+func (c *Client) runMaintenance(ctx context.Context, dns *DNSForwarder) {
+	for {
+		next, w := nextMaintenance(c.config.Maintenance, time.Now())
+		c.log.Debugf("[MAINT] Next maintenance window: %s", next.Format("Mon 2006-01-02 15:04 MST"))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			c.maintain(w, dns)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// maintain replaces the pooled tunnels, so new ones are dialed with a fresh
+// lookup of the server, and retires the open ones: by the end of the window
+// with --reload-policy grace, at once with kill, or whenever they end with drain
+func (c *Client) maintain(w MaintenanceWindow, dns *DNSForwarder) {
+	flushed := c.pool.Flush()
+	c.log.Infof("[MAINT] Maintenance window %s: replaced %d pooled tunnel(s)", w, flushed)
+	if dns != nil {
+		if n := dns.Flush(); n > 0 {
+			c.log.Infof("[MAINT] Dropped %d cached DNS answer(s)", n)
+		}
+	}
+	policy := c.config.ReloadPolicy
+	if policy.Mode == "" || policy.Mode == ReloadGrace {
+		policy = ReloadPolicy{Mode: ReloadGrace, Grace: w.Duration}
+	}
+	c.tunnels.Retire(c.tunnels.Advance(), policy, c.log)
+	if c.mux != nil {
+		c.mux.Flush()
+	}
+}
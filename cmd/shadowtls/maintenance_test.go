@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	windows, err := ParseMaintenanceWindows("03:00/15m, sun 04:30/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 2 {
+		t.Fatalf("%d windows, want 2", len(windows))
+	}
+	if got := windows[0].String(); got != "daily 03:00/15m0s" {
+		t.Errorf("first window = %s", got)
+	}
+	if got := windows[1].String(); got != "sun 04:30/1h0m0s" {
+		t.Errorf("second window = %s", got)
+	}
+	if windows, err := ParseMaintenanceWindows(""); err != nil || len(windows) != 0 {
+		t.Errorf("empty spec = %v, %v", windows, err)
+	}
+
+	for _, bad := range []string{"03:00", "25:00/1m", "03:00/0s", "03:00/48h", "someday 03:00/1m", "03:00/soon"} {
+		if _, err := ParseMaintenanceWindows(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestMaintenanceWindowNext(t *testing.T) {
+	loc := time.FixedZone("test", 2*3600)
+	now := time.Date(2026, 3, 4, 10, 0, 0, 0, loc) // A Wednesday
+	windows, _ := ParseMaintenanceWindows("03:00/15m,12:00/5m,sun 01:00/1h")
+
+	want := []time.Time{
+		time.Date(2026, 3, 5, 3, 0, 0, 0, loc),  // Tomorrow, as today's has passed
+		time.Date(2026, 3, 4, 12, 0, 0, 0, loc), // Later today
+		time.Date(2026, 3, 8, 1, 0, 0, 0, loc),  // Next Sunday
+	}
+	for i, w := range windows {
+		if got := w.Next(now); !got.Equal(want[i]) {
+			t.Errorf("%s: next = %v, want %v", w, got, want[i])
+		}
+	}
+	if got := windows[1].Next(want[1]); !got.Equal(want[1].AddDate(0, 0, 1)) {
+		t.Errorf("next after a start = %v, want the day after", got)
+	}
+
+	next, w := nextMaintenance(windows, now)
+	if !next.Equal(want[1]) || w != windows[1] {
+		t.Errorf("soonest = %s at %v, want %s", w, next, windows[1])
+	}
+}
+
+func TestMaintainCyclesTunnels(t *testing.T) {
+	var dials atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		local, remote := net.Pipe()
+		go io.Copy(io.Discard, remote)
+		return local, nil
+	}
+	c := NewClient(&ClientConfig{ReloadPolicy: ReloadPolicy{Mode: ReloadKill}})
+	c.pool = NewConnPool(1, time.Minute, 10*time.Millisecond, factory, nil, c.stats)
+	c.pool.Start()
+	defer c.pool.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if avail, _ := c.pool.Stats(); avail == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pool did not fill")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var closed atomic.Bool
+	c.tunnels.Track(func() { closed.Store(true) })
+
+	dns := NewDNSForwarder(func(ctx context.Context, query []byte) ([]byte, error) {
+		return dnsAnswer(query, 300), nil
+	}, 16, logrus.New())
+	if _, err := dns.Resolve(context.Background(), dnsQuery(1, "example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	c.maintain(MaintenanceWindow{Daily: true, Hour: 3, Duration: time.Minute}, dns)
+	if !closed.Load() {
+		t.Error("open tunnel not retired with --reload-policy kill")
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for dials.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("pool did not redial after the maintenance window")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := dns.Flush(); n != 0 {
+		t.Errorf("%d DNS answers left in the cache", n)
+	}
+}
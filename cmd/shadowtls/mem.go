@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+)
+
+// memPerConn approximates one relayed connection: the initial-data and
+// verify buffers, two relay copy buffers, TLS record buffers and the relay
+// goroutine stacks. Updated by setRelayBufferSize.
+var memPerConn int64 = connMemEstimate(relaypkg.DefaultBufferSize)
+
+// relayBufferSize is the copy buffer of each relay direction, set from
+// --buffer-size by setRelayBufferSize
+var relayBufferSize = relaypkg.DefaultBufferSize
+
+// connMemEstimate returns memPerConn for relay copy buffers of size bytes
+func connMemEstimate(size int) int64 {
+	return int64(2*copyBufSize + 2*size + 64*1024)
+}
+
+// setRelayBufferSize sets the relay copy buffer size for the whole process
+func setRelayBufferSize(size int) {
+	relayBufferSize = size
+	memPerConn = connMemEstimate(size)
+}
+
+const (
+	// memPerPooled approximates an idle pooled tunnel (TLS state and buffers)
+	memPerPooled = 40 * 1024
+	// memSampleInterval is how often the runtime heap size is sampled
+	memSampleInterval = time.Second
+)
+
+// MemBudget keeps an approximate account of memory held by buffers and
+// connection state and sheds new connections above a soft limit, so small
+// routers refuse work before the OOM killer takes the whole process
+type MemBudget struct {
+	limit int64 // 0 = unlimited
+	used  atomic.Int64
+	heap  atomic.Int64 // Latest runtime heap sample
+	shed  atomic.Uint64
+}
+
+// NewMemBudget creates a budget with a soft limit in bytes (0 disables shedding).
+// A non-zero limit is also applied as the Go runtime soft memory limit so the
+// GC works harder before the cap is reached.
+func NewMemBudget(limit int64) *MemBudget {
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+	}
+	m := &MemBudget{limit: limit}
+	m.sample()
+	return m
+}
+
+// Acquire reserves n bytes for a new connection. It returns false, and
+// counts a shed, if the estimate or the live heap would exceed the limit.
+func (m *MemBudget) Acquire(n int64) bool {
+	if m.limit <= 0 {
+		m.used.Add(n)
+		return true
+	}
+	// Check and reserve in one step, so concurrent connections can't all
+	// pass the check before any of them is counted
+	for {
+		used := m.used.Load()
+		if used+n > m.limit || m.heap.Load() > m.limit {
+			m.shed.Add(1)
+			return false
+		}
+		if m.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// Track accounts n bytes that cannot be refused (e.g. an already dialed
+// pool connection); pass a negative n to release them
+func (m *MemBudget) Track(n int64) {
+	m.used.Add(n)
+}
+
+// Release returns n bytes reserved with Acquire or Track
+func (m *MemBudget) Release(n int64) {
+	m.used.Add(-n)
+}
+
+// Run samples the runtime heap until ctx is cancelled
+func (m *MemBudget) Run(ctx context.Context) {
+	ticker := time.NewTicker(memSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sample()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sample reads the heap size via runtime/metrics, which unlike
+// runtime.ReadMemStats does not stop the world
+func (m *MemBudget) sample() {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		m.heap.Store(int64(samples[0].Value.Uint64()))
+	}
+}
+
+// MemSnapshot is a point-in-time view of memory accounting
+type MemSnapshot struct {
+	Estimate int64  // Accounted buffers and connection state
+	Heap     int64  // Live heap objects
+	Limit    int64  // Soft limit, 0 = unlimited
+	Shed     uint64 // Connections rejected over the limit
+}
+
+// Snapshot returns the current accounting
+func (m *MemBudget) Snapshot() MemSnapshot {
+	return MemSnapshot{
+		Estimate: m.used.Load(),
+		Heap:     m.heap.Load(),
+		Limit:    m.limit,
+		Shed:     m.shed.Load(),
+	}
+}
+
+// ParseSize parses a byte size such as "64MB", "512k" or "1048576".
+// Units are binary (1k = 1024).
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 64MB, 512k)", s)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMemBudgetShed(t *testing.T) {
+	m := &MemBudget{limit: 3 * memPerConn}
+	for i := 0; i < 3; i++ {
+		if !m.Acquire(memPerConn) {
+			t.Fatalf("acquire %d should fit under the limit", i)
+		}
+	}
+	if m.Acquire(memPerConn) {
+		t.Fatal("acquire over the limit should be shed")
+	}
+	m.Release(memPerConn)
+	if !m.Acquire(memPerConn) {
+		t.Error("acquire should succeed after a release")
+	}
+
+	snap := m.Snapshot()
+	if snap.Shed != 1 || snap.Estimate != 3*memPerConn {
+		t.Errorf("snapshot = %+v, want shed=1 estimate=%d", snap, 3*memPerConn)
+	}
+}
+
+// Connections racing for the last of the budget never overshoot it
+func TestMemBudgetConcurrent(t *testing.T) {
+	m := &MemBudget{limit: 10 * memPerConn}
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Go(func() { m.Acquire(memPerConn) })
+	}
+	wg.Wait()
+	if snap := m.Snapshot(); snap.Estimate != 10*memPerConn || snap.Shed != 90 {
+		t.Errorf("snapshot = %+v, want estimate=%d shed=90", snap, 10*memPerConn)
+	}
+}
+
+func TestMemBudgetHeapOverLimit(t *testing.T) {
+	m := &MemBudget{limit: 1 << 20}
+	m.heap.Store(2 << 20)
+	if m.Acquire(1) {
+		t.Error("live heap over the limit should shed")
+	}
+}
+
+func TestMemBudgetUnlimited(t *testing.T) {
+	m := &MemBudget{}
+	m.heap.Store(1 << 40)
+	if !m.Acquire(1 << 40) {
+		t.Error("no limit should never shed")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1048576": 1 << 20,
+		"64MB":    64 << 20,
+		"64MiB":   64 << 20,
+		"512k":    512 << 10,
+		"1.5G":    3 << 29,
+		"100B":    100,
+	}
+	for in, want := range tests {
+		got, err := ParseSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "lots", "-5MB"} {
+		if _, err := ParseSize(bad); err == nil {
+			t.Errorf("ParseSize(%q) should fail", bad)
+		}
+	}
+}
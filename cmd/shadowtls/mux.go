@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	shadowtls "github.com/metacubex/sing-shadowtls"
+	M "github.com/metacubex/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+
+	"github.com/iprw/shadowtun/pkg/mux"
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+)
+
+// muxHello opens a tunnel that carries mux streams instead of one
+// connection, and the server answers muxAck before the first frame. The two
+// differ so a server without --mux relaying to an echo backend isn't taken
+// for one that accepts.
+var (
+	muxHello = []byte("\x00shadowtun-mux\x01")
+	muxAck   = []byte("\x00shadowtun-mux-ok\x01")
+)
+
+// DefaultMuxTunnels is the default for --mux-tunnels
+const DefaultMuxTunnels = 2
+
+// errMuxRefused is returned when the server answers the hello with anything
+// but the echo, e.g. because it runs without --mux
+var errMuxRefused = errors.New("server does not accept mux tunnels (start it with --mux)")
+
+// MuxDialer spreads local connections over a few mux sessions, each on its
+// own tunnel, opening a stream per connection. Sessions are established from
+// the pool as needed, up to the configured number; a stream goes to the one
+// carrying the fewest.
+type MuxDialer struct {
+	pool     *ConnPool
+	stats    *Stats
+	size     int
+	coalesce time.Duration
+	log      *logrus.Logger
+
+	dialMu   sync.Mutex // Serializes establishing sessions
+	mu       sync.Mutex
+	sessions []*mux.Session
+	growing  bool
+	retired  uint64 // Streams opened on sessions since closed
+
+	established atomic.Uint64
+	failed      atomic.Uint64
+	refused     atomic.Bool // The server answered without mux; cleared by Flush
+}
+
+// MuxSnapshot is a point-in-time view of the mux sessions
+type MuxSnapshot struct {
+	Sessions    int    // Live sessions, each one tunnel
+	Streams     int    // Connections carried right now
+	Opened      uint64 // Streams opened in total
+	Established uint64 // Sessions established in total
+	Failed      uint64 // Attempts to establish a session that failed
+}
+
+// NewMuxDialer creates a dialer keeping up to size sessions on tunnels from pool
+func NewMuxDialer(pool *ConnPool, stats *Stats, size int, coalesce time.Duration) *MuxDialer {
+	return &MuxDialer{
+		pool:     pool,
+		stats:    stats,
+		size:     max(size, 1),
+		coalesce: coalesce,
+		log:      ModuleLogger("pool"),
+	}
+}
+
+// Open opens a stream for one local connection, establishing a session
+// first if none is up. It returns errMuxRefused while the server doesn't
+// speak mux, and the caller carries the connection on a tunnel of its own.
+func (m *MuxDialer) Open(ctx context.Context) (net.Conn, error) {
+	for range maxRetries {
+		if m.refused.Load() {
+			return nil, errMuxRefused
+		}
+		sess := m.pick()
+		if sess == nil {
+			var err error
+			if sess, err = m.first(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if st, err := sess.OpenStream(); err == nil {
+			return st, nil
+		}
+		// The session died since it was picked; the next pick skips it
+	}
+	return nil, fmt.Errorf("mux: no session would open a stream")
+}
+
+// pick returns the live session with the fewest streams, nil if there is
+// none, starting another in the background while below size
+func (m *MuxDialer) pick() *mux.Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	var best *mux.Session
+	for _, s := range m.sessions {
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	if best != nil && len(m.sessions) < m.size && !m.growing {
+		m.growing = true
+		go m.grow()
+	}
+	return best
+}
+
+// prune drops sessions that ended; m.mu must be held
+func (m *MuxDialer) prune() {
+	live := m.sessions[:0]
+	for _, s := range m.sessions {
+		if s.Err() == nil {
+			live = append(live, s)
+			continue
+		}
+		m.retired += s.Opened()
+		m.log.Debugf("Mux session ended after %d streams: %v", s.Opened(), s.Err())
+	}
+	clear(m.sessions[len(live):])
+	m.sessions = live
+}
+
+// first establishes a session for a connection that found none up, unless
+// a concurrent caller did meanwhile
+func (m *MuxDialer) first(ctx context.Context) (*mux.Session, error) {
+	m.dialMu.Lock()
+	defer m.dialMu.Unlock()
+	if sess := m.pick(); sess != nil {
+		return sess, nil
+	}
+	return m.establish(ctx)
+}
+
+// grow adds one session without holding up any connection
+func (m *MuxDialer) grow() {
+	defer func() {
+		m.mu.Lock()
+		m.growing = false
+		m.mu.Unlock()
+	}()
+	m.dialMu.Lock()
+	defer m.dialMu.Unlock()
+	ctx, cancel := context.WithTimeout(m.pool.ctx, 30*time.Second)
+	defer cancel()
+	if _, err := m.establish(ctx); err != nil {
+		m.log.Debugf("Extra mux session not established: %v", err)
+	}
+}
+
+// establish turns a pooled tunnel into a session; m.dialMu must be held
+func (m *MuxDialer) establish(ctx context.Context) (*mux.Session, error) {
+	tunnel, resp, err := acquireTunnel(ctx, m.pool, m.stats, muxHello, true, m.coalesce)
+	if err != nil {
+		m.failed.Add(1)
+		return nil, err
+	}
+	if !bytes.HasPrefix(resp, muxAck) {
+		m.failed.Add(1)
+		tunnel.Close()
+		if m.refused.CompareAndSwap(false, true) {
+			m.log.Warnf("[MUX] %v; carrying each connection on its own tunnel until the next reload", errMuxRefused)
+		}
+		return nil, errMuxRefused
+	}
+	conn := net.Conn(tunnel.Conn)
+	if rest := resp[len(muxAck):]; len(rest) > 0 {
+		conn = &prefixConn{Conn: conn, prefix: bytes.Clone(rest)}
+	}
+	sess := mux.Client(conn, mux.Config{OnPanic: dumpPanic})
+	m.established.Add(1)
+
+	m.mu.Lock()
+	m.sessions = append(m.sessions, sess)
+	n := len(m.sessions)
+	m.mu.Unlock()
+	m.log.Debugf("Mux session %d/%d up (connect %v)", n, m.size, tunnel.ConnectTime.Round(time.Millisecond))
+	return sess, nil
+}
+
+// Flush stops new streams on the current sessions, e.g. once a reload
+// changed the server. Each is closed when its last stream ends, unless
+// retire closes the streams sooner.
+func (m *MuxDialer) Flush() {
+	old := m.detach()
+	m.refused.Store(false)
+	for _, s := range old {
+		go closeWhenIdle(s)
+	}
+}
+
+// detach takes the current sessions out of use
+func (m *MuxDialer) detach() []*mux.Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.sessions
+	m.sessions = nil
+	for _, s := range old {
+		m.retired += s.Opened()
+	}
+	return old
+}
+
+// closeWhenIdle closes sess once it carries no stream
+func closeWhenIdle(sess *mux.Session) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for sess.NumStreams() > 0 {
+		select {
+		case <-ticker.C:
+		case <-sess.Done():
+			return
+		}
+	}
+	sess.Close()
+}
+
+// Close ends every session and the streams on them
+func (m *MuxDialer) Close() {
+	for _, s := range m.detach() {
+		s.Close()
+	}
+}
+
+// Snapshot returns the sessions' state. Safe on a nil dialer.
+func (m *MuxDialer) Snapshot() MuxSnapshot {
+	if m == nil {
+		return MuxSnapshot{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	snap := MuxSnapshot{
+		Sessions:    len(m.sessions),
+		Opened:      m.retired,
+		Established: m.established.Load(),
+		Failed:      m.failed.Load(),
+	}
+	for _, s := range m.sessions {
+		snap.Streams += s.NumStreams()
+		snap.Opened += s.Opened()
+	}
+	return snap
+}
+
+// handleMuxed carries one local connection on a stream, reporting false
+// without touching local when the server doesn't speak mux
+func (c *Client) handleMuxed(ctx context.Context, local net.Conn, info *ConnInfo, reason *string) bool {
+	start := time.Now()
+	stream, err := c.mux.Open(ctx)
+	if errors.Is(err, errMuxRefused) {
+		return false
+	}
+	if err != nil {
+		c.repeat.WarnfContext(ctx, "Failed to open mux stream: %v", err)
+		c.stats.ConnErrors.Add(1)
+		*reason = CloseNoTunnel
+		return true
+	}
+	conn := relaypkg.CloseOnce(stream)
+	defer conn.Close()
+	if c.config.Socks5UDP {
+		if handled, r := c.socksUDP(ctx, local, conn, nil, nil, info); handled {
+			*reason = r
+			return true
+		}
+	}
+
+	var bytesOut, bytesIn int64
+	up, down := c.rates.ForConn()
+	bytesOut, bytesIn, *reason = relay(ctx, local, conn, c.stats, info, up, down)
+	connLogger(ctx, c.relayLog).Infof("Connection closed: %s out, %s in, %v (mux)",
+		formatBytes(uint64(bytesOut), true), formatBytes(uint64(bytesIn), true),
+		time.Since(start).Round(time.Millisecond))
+	return true
+}
+
+// muxHandler answers the mux hello and hands every stream of the session
+// to next as a connection of its own. Other tunnels pass through.
+type muxHandler struct {
+	next   shadowtls.Handler
+	logger *logrus.Logger
+	ids    *atomic.Uint64 // Source of conn IDs for streams, nil to share the session's
+	panics *atomic.Uint64 // Counts panics recovered in stream handlers
+
+	sessions atomic.Int64  // Open right now
+	total    atomic.Uint64 // Sessions accepted
+	streams  atomic.Uint64 // Streams accepted
+}
+
+func (h *muxHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	first, err := readFirstFrame(conn)
+	if err != nil {
+		return fmt.Errorf("read first frame: %v", err)
+	}
+	if !bytes.HasPrefix(first, muxHello) {
+		return h.next.NewConnection(ctx, &prefixConn{Conn: conn, prefix: first}, metadata)
+	}
+	conn.SetWriteDeadline(time.Now().Add(passiveWakePeek))
+	_, err = conn.Write(muxAck)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("answer mux hello: %v", err)
+	}
+
+	sess := mux.Server(&prefixConn{Conn: conn, prefix: first[len(muxHello):]}, mux.Config{OnPanic: dumpPanic})
+	defer sess.Close()
+	h.total.Add(1)
+	h.sessions.Add(1)
+	defer h.sessions.Add(-1)
+	log := connLogger(ctx, h.logger)
+	log.Debugf("Mux session from %s", conn.RemoteAddr())
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			log.Debugf("Mux session from %s ended after %d streams: %v", conn.RemoteAddr(), sess.Opened(), err)
+			return nil
+		}
+		h.streams.Add(1)
+		// Each stream is a connection of its own in the logs
+		stCtx := ctx
+		if h.ids != nil {
+			id := h.ids.Add(1)
+			log.Debugf("Mux stream %d is conn %d", st.ID(), id)
+			stCtx = withConnID(ctx, id)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer st.Close()
+			// A panic on one stream must not take the session's others down
+			defer recoverPanic(h.panics, connLogger(stCtx, h.logger), "mux stream handler")
+			if err := h.next.NewConnection(stCtx, st, metadata); err != nil {
+				h.next.NewError(stCtx, err)
+			}
+		}()
+	}
+}
+
+func (h *muxHandler) NewError(ctx context.Context, err error) {
+	h.next.NewError(ctx, err)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	M "github.com/metacubex/sing/common/metadata"
+)
+
+type echoHandler struct{}
+
+func (echoHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+func (echoHandler) NewError(ctx context.Context, err error) {}
+
+// panicHandler panics on streams that open with "panic" and echoes the rest
+type panicHandler struct{}
+
+func (panicHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	if string(b) == "panic" {
+		panic("stream handler")
+	}
+	conn.Write(b)
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+func (panicHandler) NewError(ctx context.Context, err error) {}
+
+// muxPool returns a pool whose tunnels end in h, counting the dials
+func muxPool(h *muxHandler, dials *atomic.Int32) *ConnPool {
+	factory := func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			h.NewConnection(context.Background(), remote, M.Metadata{})
+		}()
+		return local, nil
+	}
+	return NewConnPool(1, time.Minute, time.Second, factory, nil, NewStats())
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != msg {
+		t.Fatalf("echo = %q, %v, want %q", got, err, msg)
+	}
+}
+
+// Connections become streams spread over at most the configured tunnels
+func TestMuxDialerSharesTunnels(t *testing.T) {
+	h := &muxHandler{next: echoHandler{}, logger: ModuleLogger("server")}
+	var dials atomic.Int32
+	m := NewMuxDialer(muxPool(h, &dials), NewStats(), 2, 0)
+	defer m.Close()
+
+	var streams []net.Conn
+	for range 6 {
+		st, err := m.Open(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, st, "hello")
+		streams = append(streams, st)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Snapshot().Sessions < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// The second session took the stream opened after it came up
+	st, err := m.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, st, "again")
+	streams = append(streams, st)
+
+	snap := m.Snapshot()
+	if snap.Sessions != 2 || snap.Streams != 7 || snap.Opened != 7 {
+		t.Errorf("snapshot %+v, want 2 sessions carrying 7 streams", snap)
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("%d tunnels dialed, want 2", n)
+	}
+	if n := h.streams.Load(); n != 7 {
+		t.Errorf("server accepted %d streams, want 7", n)
+	}
+	for _, st := range streams {
+		st.Close()
+	}
+
+	// After a flush new streams go to new sessions, old streams keep working
+	m.Flush()
+	if _, err := m.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Errorf("%d tunnels dialed after the flush, want 3", n)
+	}
+}
+
+// A server without --mux gets tunnels per connection until the next flush
+func TestMuxDialerRefused(t *testing.T) {
+	var dials atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			remote.Read(make([]byte, 64))
+			remote.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		}()
+		return local, nil
+	}
+	m := NewMuxDialer(NewConnPool(1, time.Minute, time.Second, factory, nil, NewStats()), NewStats(), 2, 0)
+	for range 2 {
+		if _, err := m.Open(context.Background()); !errors.Is(err, errMuxRefused) {
+			t.Fatalf("Open = %v, want errMuxRefused", err)
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("%d tunnels dialed, want 1 before giving up on mux", n)
+	}
+	m.Flush()
+	m.Open(context.Background())
+	if n := dials.Load(); n != 2 {
+		t.Errorf("%d tunnels dialed, want mux retried after a flush", n)
+	}
+	if snap := m.Snapshot(); snap.Failed != 2 || snap.Established != 0 {
+		t.Errorf("snapshot %+v, want 2 failed sessions", snap)
+	}
+}
+
+// Tunnels that don't open with the hello reach the next handler intact
+func TestMuxHandlerPassesTunnels(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	next := &firstReadHandler{got: make(chan []byte, 1)}
+	h := &muxHandler{next: next, logger: ModuleLogger("server")}
+	go h.NewConnection(context.Background(), server, M.Metadata{})
+
+	client.Write([]byte("GET / HTTP/1.1\r\n"))
+	select {
+	case got := <-next.got:
+		if !bytes.Equal(got, []byte("GET / HTTP/1.1\r\n")) {
+			t.Errorf("next handler got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first frame never reached the next handler")
+	}
+	if n := h.total.Load(); n != 0 {
+		t.Errorf("%d mux sessions counted for a plain tunnel", n)
+	}
+}
+
+// A panic on one stream is recovered and the session's other streams go on
+func TestMuxHandlerRecoversStreamPanic(t *testing.T) {
+	var panics atomic.Uint64
+	h := &muxHandler{next: panicHandler{}, logger: ModuleLogger("server"), panics: &panics}
+	var dials atomic.Int32
+	m := NewMuxDialer(muxPool(h, &dials), NewStats(), 1, 0)
+	defer m.Close()
+
+	alive, err := m.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, alive, "hello")
+	bad, err := m.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Write([]byte("panic"))
+	bad.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err == nil {
+		t.Error("panicking stream wasn't closed")
+	}
+	if n := panics.Load(); n != 1 {
+		t.Errorf("%d panics counted, want 1", n)
+	}
+	roundTrip(t, alive, "still")
+}
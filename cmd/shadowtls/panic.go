@@ -0,0 +1,18 @@
+package main
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recoverPanic logs a panic with its stack and counts it instead of letting
+// it crash the process. Use it directly as a deferred call at the top of a
+// goroutine: defer recoverPanic(&stats.PanicCount, log, "connection handler")
+func recoverPanic(counter *atomic.Uint64, logger logrus.FieldLogger, what string) {
+	if r := recover(); r != nil {
+		counter.Add(1)
+		logger.Errorf("Panic in %s: %v\n%s", what, r, debug.Stack())
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// passiveWake is sent by a passive client in place of the first packet. The
+// ShadowTLS server only hands a tunnel to the handler once an authenticated
+// client frame arrives, so server-speaks-first protocols (SSH, SMTP) need a
+// frame to start the backend dial; the forward handler strips this marker.
+var passiveWake = []byte("\x00shadowtun-wake\x00")
+
+// passiveWakePeek bounds how long the server waits for the first frame when
+// checking for the wake marker; the frame is already buffered by then
+const passiveWakePeek = 5 * time.Second
+
+// stripPassiveWake reads the first frame from conn and drops a leading wake
+// marker. Any other bytes read are returned so they can be sent to the backend.
+func stripPassiveWake(conn net.Conn) ([]byte, error) {
+	first, err := readFirstFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimPrefix(first, passiveWake), nil
+}
+
+// readFirstFrame reads the first frame from conn as is. A bridge passes the
+// wake marker on so the last hop strips it.
+func readFirstFrame(conn net.Conn) ([]byte, error) {
+	buf := make([]byte, copyBufSize)
+	conn.SetReadDeadline(time.Now().Add(passiveWakePeek))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
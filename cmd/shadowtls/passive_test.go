@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestStripPassiveWake(t *testing.T) {
+	tests := map[string]struct {
+		frame []byte
+		want  []byte
+	}{
+		"wake only":      {passiveWake, []byte{}},
+		"wake then data": {append(append([]byte{}, passiveWake...), "SSH-2.0-x\r\n"...), []byte("SSH-2.0-x\r\n")},
+		"regular data":   {[]byte("GET / HTTP/1.1\r\n"), []byte("GET / HTTP/1.1\r\n")},
+	}
+	for name, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(tt.frame)
+		}()
+		got, err := stripPassiveWake(server)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", name, got, tt.want)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// pathWindowSamples is how many connect RTT samples are kept in total
+	pathWindowSamples = 200
+	// pathRecentSamples is how many of the newest samples form the recent median
+	pathRecentSamples = 20
+	// pathDegradeFactor is how far the recent median must rise above baseline to flag degradation
+	pathDegradeFactor = 2.0
+	// pathRecoverFactor is the ratio the recent median must fall back under to clear degradation
+	pathRecoverFactor = 1.5
+)
+
+// PathHealth watches the connect RTT distribution for sudden shifts (e.g. the
+// median doubling), which often indicate throttling or interference on the path
+type PathHealth struct {
+	mu       sync.Mutex
+	samples  []time.Duration // Ring buffer of connect RTTs
+	next     int
+	degraded bool
+	events   uint64
+	recent   time.Duration
+	baseline time.Duration
+	log      *logrus.Logger
+
+	// OnChange, if set, is called whenever the path flips between healthy and
+	// degraded, so mitigation (SNI rotation, server failover) can be triggered
+	OnChange func(degraded bool, recent, baseline time.Duration)
+}
+
+// PathHealthSnapshot is a point-in-time view of path health
+type PathHealthSnapshot struct {
+	Score    int // 0-100, baseline/recent median ratio
+	Degraded bool
+	Events   uint64 // Number of degradation events seen
+	Recent   time.Duration
+	Baseline time.Duration
+}
+
+// NewPathHealth creates an empty path health tracker
+func NewPathHealth() *PathHealth {
+	return &PathHealth{
+		samples: make([]time.Duration, 0, pathWindowSamples),
+		log:     ModuleLogger("stats"),
+	}
+}
+
+// Record adds a connect RTT sample and re-evaluates path health
+func (p *PathHealth) Record(d time.Duration) {
+	p.mu.Lock()
+	if len(p.samples) < pathWindowSamples {
+		p.samples = append(p.samples, d)
+	} else {
+		p.samples[p.next] = d
+	}
+	p.next = (p.next + 1) % pathWindowSamples
+
+	changed, degraded, recent, baseline := p.evaluate()
+	onChange := p.OnChange
+	p.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if degraded {
+		p.log.Warnf("[PATH] Connect RTT median %v is %.1fx the baseline %v: possible throttling or interference",
+			recent.Round(time.Millisecond), float64(recent)/float64(baseline), baseline.Round(time.Millisecond))
+	} else {
+		p.log.Warnf("[PATH] Connect RTT median back to %v (baseline %v)",
+			recent.Round(time.Millisecond), baseline.Round(time.Millisecond))
+	}
+	if onChange != nil {
+		onChange(degraded, recent, baseline)
+	}
+}
+
+// evaluate recomputes medians; must be called with p.mu held
+func (p *PathHealth) evaluate() (changed, degraded bool, recent, baseline time.Duration) {
+	n := len(p.samples)
+	if n < 2*pathRecentSamples {
+		return false, p.degraded, 0, 0
+	}
+
+	// Order samples oldest → newest
+	ordered := make([]time.Duration, 0, n)
+	if n == pathWindowSamples {
+		ordered = append(ordered, p.samples[p.next:]...)
+		ordered = append(ordered, p.samples[:p.next]...)
+	} else {
+		ordered = append(ordered, p.samples...)
+	}
+
+	p.recent = median(ordered[n-pathRecentSamples:])
+	p.baseline = median(ordered[:n-pathRecentSamples])
+	if p.baseline <= 0 {
+		return false, p.degraded, p.recent, p.baseline
+	}
+
+	ratio := float64(p.recent) / float64(p.baseline)
+	switch {
+	case !p.degraded && ratio >= pathDegradeFactor:
+		p.degraded = true
+		p.events++
+		changed = true
+	case p.degraded && ratio <= pathRecoverFactor:
+		p.degraded = false
+		changed = true
+	}
+	return changed, p.degraded, p.recent, p.baseline
+}
+
+// Snapshot returns the current path health
+func (p *PathHealth) Snapshot() PathHealthSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snap := PathHealthSnapshot{
+		Score:    100,
+		Degraded: p.degraded,
+		Events:   p.events,
+		Recent:   p.recent,
+		Baseline: p.baseline,
+	}
+	if p.recent > p.baseline && p.recent > 0 {
+		snap.Score = int(100 * float64(p.baseline) / float64(p.recent))
+	}
+	return snap
+}
+
+// median returns the median of samples without modifying them
+func median(samples []time.Duration) time.Duration {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathHealthDetectsShift(t *testing.T) {
+	p := NewPathHealth()
+	var changes []bool
+	p.OnChange = func(degraded bool, recent, baseline time.Duration) {
+		changes = append(changes, degraded)
+	}
+
+	for i := 0; i < 100; i++ {
+		p.Record(50 * time.Millisecond)
+	}
+	if snap := p.Snapshot(); snap.Degraded || snap.Score != 100 {
+		t.Fatalf("steady RTT should be healthy, got %+v", snap)
+	}
+
+	for i := 0; i < pathRecentSamples; i++ {
+		p.Record(150 * time.Millisecond)
+	}
+	snap := p.Snapshot()
+	if !snap.Degraded {
+		t.Fatalf("tripled median should flag degradation, got %+v", snap)
+	}
+	if snap.Score >= 50 {
+		t.Errorf("score should drop below 50, got %d", snap.Score)
+	}
+
+	for i := 0; i < pathRecentSamples; i++ {
+		p.Record(50 * time.Millisecond)
+	}
+	if snap := p.Snapshot(); snap.Degraded || snap.Events != 1 {
+		t.Fatalf("path should recover with one recorded event, got %+v", snap)
+	}
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("OnChange calls = %v, want [true false]", changes)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	if got := median([]time.Duration{3, 1, 2}); got != 2 {
+		t.Errorf("odd median = %v, want 2", got)
+	}
+	if got := median([]time.Duration{4, 1, 3, 2}); got != 2 {
+		t.Errorf("even median = %v, want 2", got)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	shadowtls "github.com/metacubex/sing-shadowtls"
+	M "github.com/metacubex/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// pingMagic starts a liveness probe frame, followed by pingNonceLen bytes the
+// server echoes after pongMagic. The ShadowTLS service only hands a tunnel to
+// the handler once an authenticated frame arrives, so only clients holding
+// the password get an answer; to anyone else the server is the handshake site.
+//
+// versionPingMagic and versionPongMagic start the same frames with the
+// sender's version after the nonce, as one length byte and the string.
+// They have magics of their own so either side can tell them from the
+// frames of releases before them: a server from before versioned pings
+// doesn't answer one, and such a client is answered without a version.
+var (
+	pingMagic        = []byte("\x00shadowtun-ping\x00")
+	pongMagic        = []byte("\x00shadowtun-pong\x00")
+	versionPingMagic = []byte("\x00shadowtun-ping\x01")
+	versionPongMagic = []byte("\x00shadowtun-pong\x01")
+)
+
+const pingNonceLen = 8
+
+// errNotPong is returned when a ping gets something other than its answer,
+// e.g. from a server that predates pings and forwarded it to the backend
+var errNotPong = errors.New("unexpected answer to ping")
+
+// pingFrame builds a frame of magic and nonce, followed by this build's
+// version unless the frame is a legacy one
+func pingFrame(magic, nonce []byte) []byte {
+	frame := append(append([]byte{}, magic...), nonce...)
+	if bytes.Equal(magic, pingMagic) || bytes.Equal(magic, pongMagic) {
+		return frame
+	}
+	v := Version()
+	if len(v) > 255 {
+		v = v[:255]
+	}
+	return append(append(frame, byte(len(v))), v...)
+}
+
+// parsePing splits a ping frame into its nonce and the sender's version,
+// returning what followed it. legacy is set for a frame without a version.
+// ok is false if frame doesn't start with a ping.
+func parsePing(frame []byte) (nonce []byte, version string, rest []byte, legacy, ok bool) {
+	n := len(pingMagic) + pingNonceLen
+	switch {
+	case len(frame) < n:
+		return nil, "", frame, false, false
+	case bytes.HasPrefix(frame, pingMagic):
+		return frame[len(pingMagic):n], "", frame[n:], true, true
+	case !bytes.HasPrefix(frame, versionPingMagic) || len(frame) < n+1:
+		return nil, "", frame, false, false
+	}
+	nonce, rest = frame[len(versionPingMagic):n], frame[n:]
+	v := int(rest[0])
+	if len(rest) < 1+v {
+		return nil, "", frame, false, false
+	}
+	return nonce, string(rest[1 : 1+v]), rest[1+v:], false, true
+}
+
+// PingTunnel sends a probe through an unused tunnel and waits for the echo,
+// returning the round trip and the server's version, empty if its answer
+// carried none. legacy sends the probe without this build's version, for a
+// server that predates versioned pings. The tunnel stays unused: the server
+// keeps waiting for its first real frame, so a tunnel that answered can
+// carry a connection.
+func PingTunnel(conn net.Conn, timeout time.Duration, legacy bool) (time.Duration, string, error) {
+	nonce := make([]byte, pingNonceLen)
+	rand.Read(nonce)
+	magic := versionPingMagic
+	if legacy {
+		magic = pingMagic
+	}
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(pingFrame(magic, nonce)); err != nil {
+		return 0, "", err
+	}
+	reply := make([]byte, len(pongMagic)+pingNonceLen)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, "", err
+	}
+	if !bytes.Equal(reply[len(pongMagic):], nonce) {
+		return 0, "", errNotPong
+	}
+	rtt := time.Since(start)
+	switch {
+	case bytes.HasPrefix(reply, pongMagic):
+		return rtt, "", nil
+	case !bytes.HasPrefix(reply, versionPongMagic):
+		return 0, "", errNotPong
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return 0, "", err
+	}
+	version = make([]byte, version[0])
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return 0, "", err
+	}
+	return rtt, string(version), nil
+}
+
+// pingHandler answers probes at the start of a tunnel, then hands it, with
+// whatever followed the probes, to next. Between probes the tunnel may sit
+// idle for up to idle.
+type pingHandler struct {
+	next     shadowtls.Handler
+	idle     time.Duration
+	logger   *logrus.Logger
+	versions *ClientVersions // nil to ignore the versions clients report
+	answered atomic.Uint64
+}
+
+func (h *pingHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	first, err := readFirstFrame(conn)
+	if err != nil {
+		return fmt.Errorf("read first frame: %v", err)
+	}
+	for {
+		nonce, version, rest, legacy, ok := parsePing(first)
+		if !ok {
+			break
+		}
+		if h.versions != nil {
+			h.versions.Observe(conn.RemoteAddr(), version)
+		}
+		// A client that sent no version expects exactly the pong it knows
+		pong := versionPongMagic
+		if legacy {
+			pong = pongMagic
+		}
+		conn.SetWriteDeadline(time.Now().Add(passiveWakePeek))
+		_, err := conn.Write(pingFrame(pong, nonce))
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			return fmt.Errorf("answer ping: %v", err)
+		}
+		h.answered.Add(1)
+		connEntry(ctx, h.logger).Tracef("Answered ping from %s (%s)", conn.RemoteAddr(), version)
+		if first = rest; len(first) > 0 {
+			break
+		}
+		if first, err = readFrameWithin(conn, h.idle); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil // Probe tunnel closed by the client
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errRelayIdle
+			}
+			return err
+		}
+	}
+	return h.next.NewConnection(ctx, &prefixConn{Conn: conn, prefix: first}, metadata)
+}
+
+func (h *pingHandler) NewError(ctx context.Context, err error) {
+	h.next.NewError(ctx, err)
+}
+
+// readFrameWithin reads the next frame, waiting at most timeout
+func readFrameWithin(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, copyBufSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	M "github.com/metacubex/sing/common/metadata"
+)
+
+type firstReadHandler struct {
+	got chan []byte
+}
+
+func (h *firstReadHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	h.got <- buf[:n]
+	return nil
+}
+
+func (h *firstReadHandler) NewError(ctx context.Context, err error) {}
+
+// Pings are answered in place, and the first real frame still reaches the
+// next handler intact
+func TestPingHandlerAnswersThenPasses(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	next := &firstReadHandler{got: make(chan []byte, 1)}
+	h := &pingHandler{next: next, idle: time.Second, logger: ModuleLogger("server")}
+	done := make(chan error, 1)
+	go func() { done <- h.NewConnection(context.Background(), server, M.Metadata{}) }()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := PingTunnel(client, time.Second, false); err != nil {
+			t.Fatalf("ping %d: %v", i, err)
+		}
+	}
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-next.got:
+		if !bytes.Equal(got, []byte("GET / HTTP/1.1\r\n")) {
+			t.Errorf("next handler got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first frame never reached the next handler")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("handler: %v", err)
+	}
+	if n := h.answered.Load(); n != 2 {
+		t.Errorf("answered = %d, want 2", n)
+	}
+}
+
+// A tunnel closed after its ping is a clean end, not an error
+func TestPingHandlerProbeOnly(t *testing.T) {
+	client, server := net.Pipe()
+	h := &pingHandler{next: &firstReadHandler{got: make(chan []byte, 1)}, idle: time.Second, logger: ModuleLogger("server")}
+	done := make(chan error, 1)
+	go func() { done <- h.NewConnection(context.Background(), server, M.Metadata{}) }()
+
+	if _, _, err := PingTunnel(client, time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := <-done; err != nil {
+		t.Errorf("handler: %v", err)
+	}
+}
+
+// A server that predates pings relays the probe to its backend; whatever
+// comes back is not mistaken for an answer
+func TestPingTunnelRejectsOtherReply(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		buf := make([]byte, 64)
+		server.Read(buf)
+		io.WriteString(server, "HTTP/1.1 400 Bad Request\r\n")
+		server.Close()
+	}()
+	if _, _, err := PingTunnel(client, time.Second, false); err != errNotPong {
+		t.Errorf("err = %v, want errNotPong", err)
+	}
+}
+
+// Pings carry the client's version to the server and the server's back
+func TestPingExchangesVersions(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	versions := NewClientVersions("", ModuleLogger("server"))
+	h := &pingHandler{next: &firstReadHandler{got: make(chan []byte, 1)}, idle: time.Second, logger: ModuleLogger("server"), versions: versions}
+	go h.NewConnection(context.Background(), server, M.Metadata{})
+
+	_, version, err := PingTunnel(client, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Version() {
+		t.Errorf("server version %q, want %q", version, Version())
+	}
+	if got, want := versions.Summary(), "Client versions: "+Version()+" ×1"; got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+}
+
+// A client that predates versioned pings gets exactly the pong it knows,
+// and its first real frame still reaches the next handler
+func TestPingHandlerAnswersLegacyPing(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	next := &firstReadHandler{got: make(chan []byte, 1)}
+	versions := NewClientVersions("", ModuleLogger("server"))
+	h := &pingHandler{next: next, idle: time.Second, logger: ModuleLogger("server"), versions: versions}
+	go h.NewConnection(context.Background(), server, M.Metadata{})
+
+	nonce := []byte("12345678")
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write(append(append([]byte{}, pingMagic...), nonce...)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(pongMagic)+pingNonceLen)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte{}, pongMagic...), nonce...); !bytes.Equal(reply, want) {
+		t.Errorf("reply %q, want %q", reply, want)
+	}
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-next.got:
+		if !bytes.Equal(got, []byte("GET / HTTP/1.1\r\n")) {
+			t.Errorf("next handler got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first frame never reached the next handler")
+	}
+	if got, want := versions.Summary(), "Client versions: unknown ×1"; got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+}
+
+// A server that predates versioned pings answers only legacy ones, and its
+// pong is accepted without a version
+func TestPingTunnelLegacyServer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		buf := make([]byte, len(pingMagic)+pingNonceLen)
+		if _, err := io.ReadFull(server, buf); err != nil || !bytes.HasPrefix(buf, pingMagic) {
+			server.Close()
+			return
+		}
+		server.Write(append(append([]byte{}, pongMagic...), buf[len(pingMagic):]...))
+	}()
+	_, version, err := PingTunnel(client, time.Second, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		t.Errorf("version %q, want none", version)
+	}
+}
@@ -1,154 +1,683 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
+// errCaptivePortal fails Get while a captive portal blocks the network
+var errCaptivePortal = errors.New("captive portal detected")
+
+// authRejectThreshold is how many handshakes in a row the server must refuse,
+// without ever accepting one, before the password is taken to be wrong
+const authRejectThreshold = 5
+
 // ConnPool maintains a pool of pre-established connections
 type ConnPool struct {
-	size    int
-	ttl     time.Duration
-	backoff time.Duration
-	factory func(ctx context.Context) (net.Conn, error)
+	size    atomic.Int32
+	ttl     atomic.Int64 // time.Duration, lowered by the tuner
+	backoff atomic.Int64 // time.Duration
+	factory atomic.Pointer[poolFactory]
+	refill  RefillPolicy
+	captive *CaptiveDetector
+	tuner   *TTLTuner
+	sizer   *PoolSizer
 
-	connections chan *pooledConn
+	connections atomic.Pointer[chan *pooledConn] // Idle tunnels, replaced by Resize
+	resized     atomic.Pointer[chan struct{}]    // Closed by Resize to move workers to the new channel
+	mu          sync.Mutex                       // Serializes Resize
+	running     []bool                           // Workers running, by id
 	ctx         context.Context
 	cancel      context.CancelFunc
 	wg          sync.WaitGroup
 	stopped     atomic.Bool
+	failStreak  atomic.Int32                  // Consecutive worker connect failures
+	wake        atomic.Pointer[chan struct{}] // Closed by Flush to cut worker backoff short
+	connected   atomic.Pointer[chan struct{}] // Closed when a worker connects, for callers waiting out an outage
+	dialing     atomic.Int32                  // Dials in flight, by workers and by Get
 
-	stats *Stats
+	// The tunnels in connections, for Status; a channel can't be inspected
+	idleMu  sync.Mutex
+	idleSet map[*pooledConn]struct{}
+
+	// Auth failures before the first successful connect; authRejected is
+	// closed once there have been authRejectThreshold of them in a row
+	everConnected atomic.Bool
+	authStreak    atomic.Int32
+	authRejected  chan struct{}
+	authOnce      sync.Once
+
+	stats  *Stats
+	log    *logrus.Logger
+	repeat *RepeatLogger
 }
 
 type pooledConn struct {
 	net.Conn
 	createdAt   time.Time
 	connectTime time.Duration // How long it took to establish
+	generation  uint64        // Factory generation that created it
+	popped      bool          // Taken out of the pool; guarded by ConnPool.idleMu
 }
 
-// NewConnPool creates a new connection pool
-func NewConnPool(size int, ttl, backoff time.Duration, factory func(ctx context.Context) (net.Conn, error), stats *Stats) *ConnPool {
+// poolFactory is a dial function tagged with the generation it belongs to
+type poolFactory struct {
+	dial       func(ctx context.Context) (net.Conn, error)
+	generation uint64
+}
+
+// NewConnPool creates a new connection pool. A nil refill policy keeps all
+// workers active.
+func NewConnPool(size int, ttl, backoff time.Duration, factory func(ctx context.Context) (net.Conn, error), refill RefillPolicy, stats *Stats) *ConnPool {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &ConnPool{
-		size:        size,
-		ttl:         ttl,
-		backoff:     backoff,
-		factory:     factory,
-		connections: make(chan *pooledConn, size),
-		ctx:         ctx,
-		cancel:      cancel,
-		stats:       stats,
+	if refill == nil {
+		refill = NewFixedRefill(size)
+	}
+	p := &ConnPool{
+		refill:       refill,
+		authRejected: make(chan struct{}),
+		idleSet:      make(map[*pooledConn]struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		stats:        stats,
+		log:          ModuleLogger("pool"),
+		repeat:       NewRepeatLogger(ModuleLogger("pool")),
 	}
+	p.size.Store(int32(size))
+	p.ttl.Store(int64(ttl))
+	p.backoff.Store(int64(backoff))
+	connections := make(chan *pooledConn, size)
+	p.connections.Store(&connections)
+	resized := make(chan struct{})
+	p.resized.Store(&resized)
+	p.factory.Store(&poolFactory{dial: factory})
+	wake := make(chan struct{})
+	p.wake.Store(&wake)
+	connected := make(chan struct{})
+	p.connected.Store(&connected)
+	return p
+}
+
+// Connected returns a channel closed the next time a worker establishes a
+// connection, i.e. once the server is reachable again after an outage
+func (p *ConnPool) Connected() <-chan struct{} {
+	return *p.connected.Load()
+}
+
+// AuthRejected returns a channel closed when the server has refused the
+// handshake authRejectThreshold times in a row and never accepted one, i.e.
+// the password or server is wrong rather than the network flaky
+func (p *ConnPool) AuthRejected() <-chan struct{} {
+	return p.authRejected
+}
+
+// TTL returns how long an idle connection stays usable
+func (p *ConnPool) TTL() time.Duration {
+	return time.Duration(p.ttl.Load())
+}
+
+// SetTTL changes the idle connection TTL. Pooled connections older than the
+// new TTL are dropped when they reach Get.
+func (p *ConnPool) SetTTL(ttl time.Duration) {
+	p.ttl.Store(int64(ttl))
+}
+
+// Backoff returns how long a worker waits after a failed dial
+func (p *ConnPool) Backoff() time.Duration {
+	return time.Duration(p.backoff.Load())
+}
+
+// SetBackoff changes the wait after a failed dial, from the next failure on
+func (p *ConnPool) SetBackoff(backoff time.Duration) {
+	p.backoff.Store(int64(backoff))
+}
+
+// Size returns how many idle tunnels the pool keeps
+func (p *ConnPool) Size() int {
+	return int(p.size.Load())
+}
+
+// Resize changes how many idle tunnels the pool keeps, starting or stopping
+// workers to match. Idle tunnels beyond a smaller size are closed; tunnels in
+// use are not affected.
+func (p *ConnPool) Resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if size < 1 || size == p.Size() || p.stopped.Load() {
+		return
+	}
+	old := p.idle()
+	next := make(chan *pooledConn, size)
+	p.connections.Store(&next)
+	p.size.Store(int32(size))
+	closed := p.rehome(old)
+	p.refill.Resize(size)
+	resized := make(chan struct{})
+	close(*p.resized.Swap(&resized))
+	p.startWorkers()
+	p.log.Debugf("Pool resized to %d, closed %d idle connection(s)", size, closed)
+}
+
+// idle returns the channel of idle tunnels
+func (p *ConnPool) idle() chan *pooledConn {
+	return *p.connections.Load()
+}
+
+// rehome moves tunnels left in a channel replaced by Resize to the current
+// one, closing those that don't fit. Returns the number closed.
+func (p *ConnPool) rehome(old chan *pooledConn) int {
+	closed := 0
+	for {
+		cur := p.idle()
+		if old == cur {
+			return closed
+		}
+		select {
+		case pc := <-old:
+			select {
+			case cur <- pc:
+			default:
+				p.popped(pc)
+				p.stats.Mem.Release(memPerPooled)
+				pc.Conn.Close()
+				closed++
+			}
+		default:
+			return closed
+		}
+	}
+}
+
+// ReloadTTL applies a newly configured TTL; with a tuner it becomes the
+// tuner's maximum instead
+func (p *ConnPool) ReloadTTL(ttl time.Duration) {
+	if p.tuner != nil {
+		p.tuner.SetMax(ttl)
+		return
+	}
+	p.SetTTL(ttl)
+}
+
+// SetTTLTuner lets verification outcomes reported through Verified tune the
+// TTL. The tuner's onChange should call SetTTL. Must be called before Start.
+func (p *ConnPool) SetTTLTuner(t *TTLTuner) {
+	p.tuner = t
+}
+
+// SetSizer lets the share of connections finding the pool empty grow and
+// shrink it. The sizer's onChange should call Resize. Must be called before
+// Start.
+func (p *ConnPool) SetSizer(s *PoolSizer) {
+	p.sizer = s
+}
+
+// observeHit reports to the sizer whether a connection found a tunnel ready
+func (p *ConnPool) observeHit(hit bool) {
+	if p.sizer != nil {
+		p.sizer.Observe(hit)
+	}
+}
+
+// Verified reports whether a tunnel from Get passed verification, so the TTL
+// tuner can learn at which pool age the server expires sessions
+func (p *ConnPool) Verified(tunnel *PooledConn, ok bool) {
+	if p.tuner != nil && tunnel.FromPool {
+		p.tuner.Observe(tunnel.PoolAge, !ok)
+	}
+}
+
+// SetFactory replaces the dial function, e.g. after the server address or
+// password changed on reload. Idle connections from the old factory are
+// closed now; ones still being dialed are discarded when they reach Get.
+func (p *ConnPool) SetFactory(factory func(ctx context.Context) (net.Conn, error)) {
+	old := p.factory.Load()
+	p.factory.Store(&poolFactory{dial: factory, generation: old.generation + 1})
+	p.log.Debugf("Pool factory replaced, closed %d idle connection(s)", p.closeIdle())
+}
+
+// Flush drops every idle tunnel and any still being dialed, and wakes
+// workers waiting out a connect backoff so the pool refills right away.
+// Used after a network change, when tunnels on the old uplink are dead
+// even though they have not expired. Returns the number of tunnels closed.
+func (p *ConnPool) Flush() int {
+	old := p.factory.Load()
+	p.factory.Store(&poolFactory{dial: old.dial, generation: old.generation + 1})
+	p.failStreak.Store(0)
+	wake := make(chan struct{})
+	close(*p.wake.Swap(&wake))
+	return p.closeIdle()
+}
+
+// closeIdle closes all connections currently waiting in the pool
+func (p *ConnPool) closeIdle() int {
+	closed := 0
+	for {
+		select {
+		case pc := <-p.idle():
+			p.popped(pc)
+			p.stats.Mem.Release(memPerPooled)
+			pc.Conn.Close()
+			closed++
+			continue
+		default:
+		}
+		return closed
+	}
+}
+
+// SetCaptiveDetector enables captive portal probing after repeated connect
+// failures; while a portal is detected workers pause and Get fails fast.
+// Must be called before Start.
+func (p *ConnPool) SetCaptiveDetector(d *CaptiveDetector) {
+	p.captive = d
 }
 
 // Start begins the pool workers
 func (p *ConnPool) Start() {
-	for i := 0; i < p.size; i++ {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startWorkers()
+	if p.sizer != nil {
 		p.wg.Add(1)
-		go p.worker(i)
+		go func() {
+			defer p.wg.Done()
+			p.sizer.Run(p.ctx)
+		}()
 	}
 }
 
-// Stop gracefully shuts down the pool
+// startWorkers starts the workers below the pool size that aren't running;
+// must be called with p.mu held
+func (p *ConnPool) startWorkers() {
+	size := p.Size()
+	for len(p.running) < size {
+		p.running = append(p.running, false)
+	}
+	for id := range size {
+		if !p.running[id] {
+			p.running[id] = true
+			p.wg.Add(1)
+			go p.worker(id)
+		}
+	}
+}
+
+// retire reports whether worker id is beyond the pool size after a Resize,
+// and if so marks it stopped
+func (p *ConnPool) retire(id int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id < p.Size() {
+		return false
+	}
+	p.running[id] = false
+	return true
+}
+
+// Stop cancels the workers, waits up to shutdownStageTimeout for them and
+// closes the idle tunnels. Safe to call more than once.
 func (p *ConnPool) Stop() {
 	p.stopped.Store(true)
 	p.cancel()
 
-	// Wait for workers with timeout
 	done := make(chan struct{})
 	go func() {
 		p.wg.Wait()
 		close(done)
 	}()
-
+	timer := time.NewTimer(shutdownStageTimeout)
 	select {
 	case <-done:
-		// Workers finished
-	case <-time.After(5 * time.Second):
-		Log.Warn("Pool shutdown timed out, forcing close")
+	case <-timer.C:
+		p.log.Warnf("Pool workers still dialing after %v, closing idle tunnels anyway", shutdownStageTimeout)
 	}
+	timer.Stop()
 
-	// Drain remaining connections
+	p.drainIdle()
+	p.repeat.Flush()
+}
+
+// drainIdle closes the tunnels waiting in the pool and returns how many
+func (p *ConnPool) drainIdle() int {
+	n := 0
 	for {
 		select {
-		case pc := <-p.connections:
-			if pc != nil {
-				pc.Conn.Close()
+		case pc := <-p.idle():
+			if pc == nil {
+				continue
 			}
+			p.popped(pc)
+			p.stats.Mem.Release(memPerPooled)
+			pc.Conn.Close()
+			n++
 		default:
-			goto drained
+			return n
 		}
 	}
-drained:
 }
 
 // Stats returns pool statistics
 func (p *ConnPool) Stats() (available int, capacity int) {
-	return len(p.connections), p.size
+	return len(p.idle()), p.Size()
+}
+
+// Pool states reported by Status
+const (
+	PoolOK           = "ok"
+	PoolFailing      = "failing"       // The last worker dials failed; workers back off between tries
+	PoolCaptive      = "captive"       // Paused until a captive portal lets traffic through
+	PoolAuthRejected = "auth-rejected" // The server refused every handshake so far
+	PoolStopped      = "stopped"
+)
+
+// PoolStatus is a point-in-time view of the pool
+type PoolStatus struct {
+	State      string        // PoolOK, PoolFailing, PoolCaptive, PoolAuthRejected or PoolStopped
+	Size       int           // Idle tunnels the pool keeps
+	Available  int           // Idle tunnels ready now
+	Dialing    int           // Dials in flight, by workers and by connections that found the pool empty
+	Workers    int           // Workers the refill policy lets dial
+	FailStreak int           // Consecutive failed worker dials
+	TTL        time.Duration // Current, possibly lowered by --ttl-auto
+	Backoff    time.Duration // Wait after a failed dial
+	Generation uint64        // Bumped when the pool is flushed or the server changes
+	Idle       []IdleTunnel  // Oldest first
+}
+
+// IdleTunnel describes one tunnel waiting in the pool
+type IdleTunnel struct {
+	Age         time.Duration
+	ConnectTime time.Duration
+	Expired     bool // Past the TTL, closed when Get reaches it
+	Superseded  bool // Dialed before the last flush or server change, closed when Get reaches it
 }
 
-// worker maintains one connection slot in the pool
+// Status returns the pool's state, including every idle tunnel
+func (p *ConnPool) Status() PoolStatus {
+	now := time.Now()
+	ttl := p.TTL()
+	generation := p.factory.Load().generation
+	st := PoolStatus{
+		State:      PoolOK,
+		Size:       p.Size(),
+		Available:  len(p.idle()),
+		Dialing:    int(p.dialing.Load()),
+		FailStreak: int(p.failStreak.Load()),
+		TTL:        ttl,
+		Backoff:    p.Backoff(),
+		Generation: generation,
+	}
+	allowed, _ := p.refill.Allowed()
+	st.Workers = min(allowed, st.Size)
+
+	p.idleMu.Lock()
+	for pc := range p.idleSet {
+		age := now.Sub(pc.createdAt)
+		st.Idle = append(st.Idle, IdleTunnel{
+			Age:         age,
+			ConnectTime: pc.connectTime,
+			Expired:     age > ttl,
+			Superseded:  pc.generation != generation,
+		})
+	}
+	p.idleMu.Unlock()
+	slices.SortFunc(st.Idle, func(a, b IdleTunnel) int {
+		return cmp.Compare(b.Age, a.Age)
+	})
+
+	captive := false
+	if p.captive != nil {
+		captive, _ = p.captive.Captive()
+	}
+	select {
+	case <-p.authRejected:
+		st.State = PoolAuthRejected
+	default:
+		switch {
+		case p.stopped.Load():
+			st.State = PoolStopped
+		case captive:
+			st.State = PoolCaptive
+		case st.FailStreak > 0:
+			st.State = PoolFailing
+		}
+	}
+	return st
+}
+
+// pooled records pc as waiting in the pool, unless Get already took it
+func (p *ConnPool) pooled(pc *pooledConn) {
+	p.idleMu.Lock()
+	if !pc.popped {
+		p.idleSet[pc] = struct{}{}
+	}
+	p.idleMu.Unlock()
+}
+
+// popped records pc as taken out of the pool
+func (p *ConnPool) popped(pc *pooledConn) {
+	p.idleMu.Lock()
+	pc.popped = true
+	delete(p.idleSet, pc)
+	p.idleMu.Unlock()
+}
+
+// worker maintains one connection slot in the pool, restarting its loop if
+// it panics so one bad dial cannot silently shrink the pool
 func (p *ConnPool) worker(id int) {
 	defer p.wg.Done()
 
-	for {
-		// Check for shutdown
-		if p.stopped.Load() || p.ctx.Err() != nil {
+	for !p.runWorker(id) {
+		p.log.Warnf("Worker %d restarted after panic", id)
+		select {
+		case <-time.After(p.Backoff()):
+		case <-p.ctx.Done():
 			return
 		}
+	}
+}
+
+// runWorker is the worker loop. Returns true on shutdown, false after a recovered panic.
+func (p *ConnPool) runWorker(id int) (done bool) {
+	defer recoverPanic(&p.stats.PanicCount, p.log, "pool worker")
+
+	for {
+		// Check for shutdown, or a Resize that removed this worker
+		if p.stopped.Load() || p.ctx.Err() != nil || p.retire(id) {
+			return true
+		}
+
+		// Park while the refill policy has shed this worker
+		if !p.admit(id) {
+			return true
+		}
 
 		// Create connection with timeout derived from pool context
 		connCtx, connCancel := context.WithTimeout(p.ctx, 30*time.Second)
+		factory := p.factory.Load()
 		start := time.Now()
-		conn, err := p.factory(connCtx)
+		conn, err := p.dial(connCtx, factory)
 		connectTime := time.Since(start)
 		connCancel()
 
 		if err != nil {
 			if p.stopped.Load() || p.ctx.Err() != nil {
-				return // Shutting down
+				return true // Shutting down; p.dial counted it as cancelled
 			}
+			kind := ClassifyConnectError(err)
 			p.stats.PoolFailed.Add(1)
-			Log.Warnf("Pool connect failed: %v", err)
+			p.stats.ConnectFailed[kind].Add(1)
+			p.refill.Observe(err, connectTime)
+			// Keyed per layer so repeat suppression doesn't hide a change of cause
+			p.repeat.Warnf("Pool connect failed: "+kind.Describe()+": %v", err)
+			if kind != FailAuth {
+				p.authStreak.Store(0)
+			} else if !p.everConnected.Load() && p.authStreak.Add(1) >= authRejectThreshold {
+				p.authOnce.Do(func() { close(p.authRejected) })
+			}
+			// Repeated failures may mean a captive portal rather than a dead server
+			streak := p.failStreak.Add(1)
+			if p.captive != nil && streak >= captiveFailThreshold && p.captive.Check(p.ctx) {
+				p.captive.Wait(p.ctx)
+				p.failStreak.Store(0)
+				continue
+			}
 			// Backoff before retry
 			select {
-			case <-time.After(p.backoff):
+			case <-time.After(p.Backoff()):
+			case <-*p.wake.Load():
 			case <-p.ctx.Done():
-				return
+				return true
 			}
 			continue
 		}
 
+		p.failStreak.Store(0)
+		p.everConnected.Store(true)
+		connected := make(chan struct{})
+		close(*p.connected.Swap(&connected))
 		p.stats.PoolCreated.Add(1)
 		p.stats.RecordConnectTime(connectTime)
+		p.refill.Observe(nil, connectTime)
 
 		pc := &pooledConn{
 			Conn:        conn,
 			createdAt:   time.Now(),
 			connectTime: connectTime,
+			generation:  factory.generation,
 		}
 
 		// Try to add to pool with timeout
+		p.stats.Mem.Track(memPerPooled)
+		if !p.offer(id, pc) {
+			return true
+		}
+	}
+}
+
+// offer adds a new tunnel to the pool, waiting up to the TTL for room and
+// following the pool to a new channel if it is resized meanwhile. Returns
+// false on shutdown.
+func (p *ConnPool) offer(id int, pc *pooledConn) bool {
+	full := time.NewTimer(p.TTL())
+	defer full.Stop()
+	for {
+		resized := *p.resized.Load()
+		conns := p.idle()
 		select {
-		case p.connections <- pc:
-			Log.Tracef("Worker %d: connection pooled", id)
+		case conns <- pc:
+			p.pooled(pc)
+			p.log.Tracef("Worker %d: connection pooled", id)
 			// Successfully added, loop to create next connection
 			// The connection will be cleaned up by Get() or Stop()
+			p.rehome(conns)
+			return true
 
-		case <-time.After(p.ttl):
+		case <-resized:
+			continue
+
+		case <-full.C:
 			// Pool is full and stayed full, discard this connection
+			p.stats.Mem.Release(memPerPooled)
 			p.stats.PoolDiscarded.Add(1)
-			conn.Close()
+			pc.Conn.Close()
+			return true
 
 		case <-p.ctx.Done():
-			conn.Close()
+			p.stats.Mem.Release(memPerPooled)
+			pc.Conn.Close()
+			return false
+		}
+	}
+}
+
+// admit blocks while the refill policy excludes worker id. Returns false on shutdown.
+func (p *ConnPool) admit(id int) bool {
+	for {
+		allowed, changed := p.refill.Allowed()
+		if id < allowed {
+			return true
+		}
+		if p.retire(id) {
+			return false
+		}
+		p.log.Tracef("Worker %d: parked (refill limit %d)", id, allowed)
+		select {
+		case <-changed:
+		case <-*p.resized.Load():
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+}
+
+// dial runs factory. A dial abandoned because ctx was cancelled by Stop is
+// counted in PoolCancelled instead of being mistaken for a failure, and a
+// connection that completes after that is closed at once. A caller that
+// gives up doesn't cancel the dial; see dialFor. A dial that ran out of
+// time is a failure: the server didn't answer.
+func (p *ConnPool) dial(ctx context.Context, factory *poolFactory) (net.Conn, error) {
+	p.dialing.Add(1)
+	defer p.dialing.Add(-1)
+	conn, err := factory.dial(ctx)
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		return conn, err
+	}
+	if err == nil {
+		conn.Close()
+		err = ctx.Err()
+	}
+	p.stats.PoolCancelled.Add(1)
+	p.log.Tracef("Dial abandoned: %v", err)
+	return nil, err
+}
+
+// dialFor dials a tunnel for Get. If the caller gives up first, typically
+// because its local connection closed while the handshake ran, the dial
+// still finishes and the tunnel, which nothing was written to, goes to the
+// pool for the next connection instead of being thrown away.
+func (p *ConnPool) dialFor(ctx context.Context, factory *poolFactory) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	dialCtx, cancel := context.WithTimeout(p.ctx, 30*time.Second)
+	start := time.Now()
+	go func() {
+		defer cancel()
+		conn, err := p.dial(dialCtx, factory)
+		done <- result{conn, err}
+	}()
+	// adopt pools a tunnel the caller no longer wants
+	adopt := func(r result) {
+		if r.err != nil {
 			return
 		}
+		connectTime := time.Since(start)
+		p.everConnected.Store(true)
+		p.stats.RecordConnectTime(connectTime)
+		p.Put(&PooledConn{Conn: r.conn, ConnectTime: connectTime, createdAt: time.Now(), generation: factory.generation})
+	}
+	select {
+	case r := <-done:
+		if r.err != nil || ctx.Err() == nil {
+			return r.conn, r.err
+		}
+		adopt(r)
+	case <-ctx.Done():
+		go func() { adopt(<-done) }()
 	}
+	return nil, ctx.Err()
 }
 
 // PooledConn wraps a connection with metadata
@@ -157,6 +686,10 @@ type PooledConn struct {
 	PoolAge     time.Duration // How long it sat in the pool
 	ConnectTime time.Duration // How long it took to establish
 	FromPool    bool          // True if from pool, false if newly created
+	VerifyRTT   time.Duration // Initial data → first response round trip
+
+	createdAt  time.Time
+	generation uint64
 }
 
 // Get retrieves a connection from the pool.
@@ -166,12 +699,72 @@ func (p *ConnPool) Get(ctx context.Context) (*PooledConn, error) {
 	waitStart := time.Now()
 
 	// Try to get from pool first, discarding expired connections
+	if tunnel := p.take(waitStart); tunnel != nil {
+		p.observeHit(true)
+		return tunnel, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Pool empty, create new connection with context
+	if p.captive != nil {
+		if captive, detail := p.captive.Captive(); captive {
+			return nil, fmt.Errorf("%w (%s), log in to the network first", errCaptivePortal, detail)
+		}
+	}
+	p.stats.PoolMisses.Add(1)
+	p.observeHit(false)
+	start := time.Now()
+	factory := p.factory.Load()
+	conn, err := p.dialFor(ctx, factory)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %v", ClassifyConnectError(err).Describe(), err)
+	}
+	connectTime := time.Since(start)
+	p.everConnected.Store(true)
+	p.stats.RecordConnectTime(connectTime)
+	p.stats.RecordPoolWait(time.Since(waitStart))
+	return &PooledConn{
+		Conn:        conn,
+		PoolAge:     0,
+		ConnectTime: connectTime,
+		FromPool:    false,
+		createdAt:   time.Now(),
+		generation:  factory.generation,
+	}, nil
+}
+
+// TryGet returns a pooled connection if one is ready, without dialing
+func (p *ConnPool) TryGet() (*PooledConn, bool) {
+	if tunnel := p.take(time.Now()); tunnel != nil {
+		p.observeHit(true)
+		return tunnel, true
+	}
+	p.stats.PoolMisses.Add(1)
+	p.observeHit(false)
+	return nil, false
+}
+
+// take pops the first usable pooled connection, closing expired ones and
+// ones from a superseded factory on the way. Returns nil if none is left.
+func (p *ConnPool) take(waitStart time.Time) *PooledConn {
 	for {
 		select {
-		case pc := <-p.connections:
+		case pc := <-p.idle():
+			p.popped(pc)
+			p.stats.Mem.Release(memPerPooled)
 			poolAge := time.Since(pc.createdAt)
 
-			if poolAge <= p.ttl {
+			if pc.generation != p.factory.Load().generation {
+				// Dialed with a superseded config, close and try next
+				pc.Conn.Close()
+				continue
+			}
+			if poolAge <= p.TTL() {
 				p.stats.PoolHits.Add(1)
 				p.stats.RecordPoolAge(poolAge)
 				p.stats.RecordPoolWait(time.Since(waitStart))
@@ -180,33 +773,50 @@ func (p *ConnPool) Get(ctx context.Context) (*PooledConn, error) {
 					PoolAge:     poolAge,
 					ConnectTime: pc.connectTime,
 					FromPool:    true,
-				}, nil
+					createdAt:   pc.createdAt,
+					generation:  pc.generation,
+				}
 			}
 			// Connection expired, close and try next
 			p.stats.PoolExpired.Add(1)
 			pc.Conn.Close()
 			continue
 
-		case <-ctx.Done():
-			return nil, ctx.Err()
-
 		default:
-			// Pool empty, create new connection with context
-			p.stats.PoolMisses.Add(1)
-			start := time.Now()
-			conn, err := p.factory(ctx)
-			if err != nil {
-				return nil, err
-			}
-			connectTime := time.Since(start)
-			p.stats.RecordConnectTime(connectTime)
-			p.stats.RecordPoolWait(time.Since(waitStart))
-			return &PooledConn{
-				Conn:        conn,
-				PoolAge:     0,
-				ConnectTime: connectTime,
-				FromPool:    false,
-			}, nil
+			return nil
 		}
 	}
 }
+
+// Put offers a tunnel to the pool and reports whether it was kept. It keeps
+// the tunnel only if it could have been dialed by a pool worker just now:
+// the pool is running, the tunnel is from the current factory, younger than
+// the TTL, and there is room. Anything else is closed. Put can't tell whether
+// a tunnel carried data, so callers must only offer tunnels nothing was
+// written to; once the opening is written the server has bound the tunnel to
+// a backend session.
+func (p *ConnPool) Put(tunnel *PooledConn) bool {
+	if p.stopped.Load() || tunnel.generation != p.factory.Load().generation || time.Since(tunnel.createdAt) > p.TTL() {
+		tunnel.Conn.Close()
+		return false
+	}
+	p.stats.Mem.Track(memPerPooled)
+	conns := p.idle()
+	pc := &pooledConn{
+		Conn:        tunnel.Conn,
+		createdAt:   tunnel.createdAt,
+		connectTime: tunnel.ConnectTime,
+		generation:  tunnel.generation,
+	}
+	select {
+	case conns <- pc:
+		p.pooled(pc)
+		p.stats.PoolReturned.Add(1)
+		p.rehome(conns)
+		return true
+	default:
+		p.stats.Mem.Release(memPerPooled)
+		tunnel.Conn.Close()
+		return false
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnPoolSetFactory(t *testing.T) {
+	dialer := func(tag string) func(ctx context.Context) (net.Conn, error) {
+		return func(ctx context.Context) (net.Conn, error) {
+			a, b := net.Pipe()
+			b.Close()
+			return &taggedConn{Conn: a, tag: tag}, nil
+		}
+	}
+
+	pool := NewConnPool(2, time.Minute, time.Second, dialer("old"), nil, NewStats())
+	idle, _ := dialer("old")(context.Background())
+	pool.idle() <- &pooledConn{Conn: idle, createdAt: time.Now()}
+	stale, _ := dialer("old")(context.Background())
+
+	pool.SetFactory(dialer("new"))
+	if avail, _ := pool.Stats(); avail != 0 {
+		t.Errorf("idle connections should be closed on factory change, %d left", avail)
+	}
+
+	// A connection dialed by the old factory that lands late is discarded
+	pool.idle() <- &pooledConn{Conn: stale, createdAt: time.Now()}
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if tag := conn.Conn.(*taggedConn).tag; tag != "new" {
+		t.Errorf("got connection from %s factory, want new", tag)
+	}
+}
+
+type taggedConn struct {
+	net.Conn
+	tag string
+}
+
+func TestConnPoolFlush(t *testing.T) {
+	var calls atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		if calls.Add(1) == 1 {
+			return nil, errors.New("network is unreachable")
+		}
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+
+	stats := NewStats()
+	pool := NewConnPool(1, time.Minute, time.Hour, factory, nil, stats)
+	idle, _ := net.Pipe()
+	pool.idle() <- &pooledConn{Conn: idle, createdAt: time.Now()}
+	pool.Start()
+	defer pool.Stop()
+
+	for stats.PoolFailed.Load() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := pool.Flush(); n != 1 {
+		t.Errorf("Flush closed %d tunnels, want the 1 idle one", n)
+	}
+
+	// The worker was in an hour-long backoff; Flush must cut it short
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if avail, _ := pool.Stats(); avail == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pool did not refill after Flush")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnPoolWorkerPanicRestart(t *testing.T) {
+	var calls atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		if calls.Add(1) == 1 {
+			panic("factory exploded")
+		}
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+
+	stats := NewStats()
+	pool := NewConnPool(1, time.Minute, 10*time.Millisecond, factory, nil, stats)
+	pool.Start()
+	defer pool.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if avail, _ := pool.Stats(); avail == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker did not refill the pool after panicking")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := stats.PanicCount.Load(); n != 1 {
+		t.Errorf("PanicCount = %d, want 1", n)
+	}
+}
+
+func TestConnPoolPut(t *testing.T) {
+	factory := func(ctx context.Context) (net.Conn, error) {
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+	stats := NewStats()
+	pool := NewConnPool(1, time.Minute, time.Second, factory, nil, stats)
+
+	tunnel, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pool.Put(tunnel) {
+		t.Fatal("clean tunnel should be returned to the pool")
+	}
+	if avail, _ := pool.Stats(); avail != 1 || stats.PoolReturned.Load() != 1 {
+		t.Errorf("available=%d returned=%d, want 1 and 1", avail, stats.PoolReturned.Load())
+	}
+	again, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Conn != tunnel.Conn || !again.FromPool {
+		t.Error("Get should hand out the returned tunnel")
+	}
+
+	// A tunnel from before a factory change is closed, not pooled
+	pool.SetFactory(factory)
+	if pool.Put(again) {
+		t.Error("tunnel from a superseded factory should not be pooled")
+	}
+
+	// Expired tunnels are closed
+	expired, _ := pool.Get(context.Background())
+	expired.createdAt = time.Now().Add(-2 * time.Minute)
+	if pool.Put(expired) {
+		t.Error("expired tunnel should not be pooled")
+	}
+}
+
+// A connection that goes away while its tunnel is being dialed leaves the
+// tunnel to the next one, instead of aborting the handshake
+func TestConnPoolGetAbandoned(t *testing.T) {
+	release := make(chan struct{})
+	factory := func(ctx context.Context) (net.Conn, error) {
+		<-release
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+	stats := NewStats()
+	pool := NewConnPool(1, time.Minute, time.Second, factory, nil, stats)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan error, 1)
+	go func() {
+		_, _, err := acquireTunnel(ctx, pool, stats, []byte("hello"), false, 0)
+		got <- err
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.dialing.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("no dial started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel() // The app closed its connection mid-handshake
+	if err := <-got; !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquireTunnel: %v, want cancelled", err)
+	}
+
+	close(release)
+	for {
+		if avail, _ := pool.Stats(); avail == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned dial never reached the pool")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := stats.PoolReturned.Load(); n != 1 {
+		t.Errorf("PoolReturned = %d, want 1", n)
+	}
+	tunnel, err := pool.Get(context.Background())
+	if err != nil || !tunnel.FromPool {
+		t.Errorf("next Get: %v, from pool %v; want the abandoned tunnel", err, tunnel != nil && tunnel.FromPool)
+	}
+}
+
+func TestConnPoolAuthRejected(t *testing.T) {
+	var calls atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		calls.Add(1)
+		return nil, errors.New("traffic hijacked")
+	}
+	pool := NewConnPool(1, time.Minute, time.Millisecond, factory, nil, NewStats())
+	pool.Start()
+	defer pool.Stop()
+
+	select {
+	case <-pool.AuthRejected():
+	case <-time.After(2 * time.Second):
+		t.Fatal("AuthRejected not closed after repeated auth failures")
+	}
+	if n := calls.Load(); n < authRejectThreshold {
+		t.Errorf("rejected after %d attempts, want at least %d", n, authRejectThreshold)
+	}
+}
+
+// Once the password has worked, later auth failures are a server-side change
+// and the client keeps retrying
+func TestConnPoolAuthRejectedAfterSuccess(t *testing.T) {
+	var calls atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		if calls.Add(1) == 1 {
+			a, b := net.Pipe()
+			b.Close()
+			return a, nil
+		}
+		return nil, errors.New("traffic hijacked")
+	}
+	pool := NewConnPool(1, time.Minute, time.Millisecond, factory, nil, NewStats())
+	pool.Start()
+	defer pool.Stop()
+	// The one tunnel that works may go to a worker, reaching Get through the pool
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := pool.Get(context.Background())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for calls.Load() < 3*authRejectThreshold {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-pool.AuthRejected():
+		t.Error("AuthRejected closed although the password worked before")
+	default:
+	}
+}
+
+func TestConnPoolResize(t *testing.T) {
+	var dials atomic.Int32
+	factory := func(ctx context.Context) (net.Conn, error) {
+		dials.Add(1)
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+	waitAvail := func(pool *ConnPool, want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if avail, _ := pool.Stats(); avail == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				avail, _ := pool.Stats()
+				t.Fatalf("%d idle connections, want %d", avail, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	pool := NewConnPool(2, time.Minute, time.Second, factory, nil, NewStats())
+	pool.Start()
+	defer pool.Stop()
+	waitAvail(pool, 2)
+
+	pool.Resize(4)
+	waitAvail(pool, 4)
+	if _, capacity := pool.Stats(); capacity != 4 {
+		t.Errorf("capacity = %d after growing, want 4", capacity)
+	}
+
+	// Shrinking closes the surplus idle tunnels and retires their workers
+	pool.Resize(1)
+	if avail, capacity := pool.Stats(); avail != 1 || capacity != 1 {
+		t.Errorf("after shrinking: %d/%d, want 1/1", avail, capacity)
+	}
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitAvail(pool, 1)
+	time.Sleep(50 * time.Millisecond)
+	if avail, _ := pool.Stats(); avail != 1 {
+		t.Errorf("%d idle connections, retired workers still refilling", avail)
+	}
+	pool.mu.Lock()
+	running := 0
+	for _, r := range pool.running {
+		if r {
+			running++
+		}
+	}
+	pool.mu.Unlock()
+	if running != 1 {
+		t.Errorf("%d workers running, want 1", running)
+	}
+}
+
+func TestConnPoolStatus(t *testing.T) {
+	factory := func(ctx context.Context) (net.Conn, error) {
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+	pool := NewConnPool(2, time.Minute, time.Hour, factory, nil, NewStats())
+	pool.Start()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(pool.Status().Idle) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	st := pool.Status()
+	if st.State != PoolOK || st.Size != 2 || st.Available != 2 || st.Workers != 2 || len(st.Idle) != 2 {
+		t.Fatalf("status %+v, want a full healthy pool", st)
+	}
+	if st.Idle[0].Age < st.Idle[1].Age {
+		t.Errorf("idle tunnels not oldest first: %+v", st.Idle)
+	}
+
+	tunnel, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The worker refills the slot; the taken tunnel is no longer listed
+	time.Sleep(20 * time.Millisecond)
+	st = pool.Status()
+	if len(st.Idle) != st.Available {
+		t.Errorf("%d idle tunnels listed, %d available", len(st.Idle), st.Available)
+	}
+
+	pool.Flush()
+	pool.Put(tunnel) // From before the flush, so closed rather than kept
+	for _, idle := range pool.Status().Idle {
+		if idle.Superseded {
+			t.Errorf("superseded tunnel still listed: %+v", idle)
+		}
+	}
+	pool.Stop()
+	if st := pool.Status(); st.State != PoolStopped || len(st.Idle) != 0 {
+		t.Errorf("status after Stop %+v", st)
+	}
+}
+
+func TestConnPoolStatusFailing(t *testing.T) {
+	pool := NewConnPool(1, time.Minute, time.Hour, func(ctx context.Context) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}, nil, NewStats())
+	pool.Start()
+	defer pool.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Status().State != PoolFailing && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if st := pool.Status(); st.State != PoolFailing || st.FailStreak != 1 || st.Dialing != 0 {
+		t.Errorf("status %+v, want failing after one refused dial", st)
+	}
+}
+
+// Dials abandoned by Stop are counted apart from failures, and a tunnel
+// completed after its caller gave up is pooled rather than closed
+func TestConnPoolDialCancelled(t *testing.T) {
+	stats := NewStats()
+	ctx, cancel := context.WithCancel(context.Background())
+	dialed := make(chan *closeCounter, 1)
+	pool := NewConnPool(1, time.Minute, time.Second, func(context.Context) (net.Conn, error) {
+		cancel() // The caller gives up while the handshake completes
+		a, b := net.Pipe()
+		b.Close()
+		late := &closeCounter{Conn: a}
+		dialed <- late
+		return late, nil
+	}, nil, stats)
+	if _, err := pool.Get(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Get = %v, want context.Canceled", err)
+	}
+	// The tunnel completed after the caller gave up serves the next one
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if avail, _ := pool.Stats(); avail == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel completed after the caller gave up was not pooled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := (<-dialed).closes.Load(); n != 0 {
+		t.Errorf("pooled late tunnel closed %d times", n)
+	}
+
+	// A worker dialing when the pool stops
+	dialing := make(chan struct{})
+	pool.SetFactory(func(ctx context.Context) (net.Conn, error) {
+		close(dialing)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	pool.Start()
+	<-dialing
+	pool.Stop()
+
+	if n := stats.PoolCancelled.Load(); n != 1 {
+		t.Errorf("PoolCancelled = %d, want 1", n)
+	}
+	if n := stats.PoolFailed.Load(); n != 0 {
+		t.Errorf("PoolFailed = %d, want 0 with no dial failing on its own", n)
+	}
+}
+
+// A dial that runs out of time is a failure, not a cancellation
+func TestConnPoolDialTimeout(t *testing.T) {
+	stats := NewStats()
+	pool := NewConnPool(1, time.Minute, time.Second, func(ctx context.Context) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, nil, stats)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get = %v, want context.DeadlineExceeded", err)
+	}
+	if n := stats.PoolCancelled.Load(); n != 0 {
+		t.Errorf("PoolCancelled = %d for a dial that timed out", n)
+	}
+}
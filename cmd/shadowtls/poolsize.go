@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	poolSizeWindow    = 20               // Connections per hit rate sample
+	poolSizeGrowBelow = 0.8              // Grow when fewer than this share of a sample found a tunnel ready
+	poolSizeQuiet     = time.Minute      // Time without an empty pool before shrinking a step
+	poolSizeCheck     = 10 * time.Second // How often the pool is checked for a quiet spell
+)
+
+// PoolSizer grows the pool toward a maximum (--pool-max) when connections
+// keep finding it empty, and shrinks it back toward the configured size once
+// they stop. A pool that runs dry in a burst sends connections to a cold
+// handshake; one kept at the burst size holds idle tunnels the rest of the day.
+type PoolSizer struct {
+	mu       sync.Mutex
+	min      int
+	max      int
+	size     int
+	gets     int // Connections in the current sample
+	hits     int // ...that found a tunnel ready
+	lastMiss time.Time
+	lastStep time.Time // Last growth or shrink
+	onChange func(size int)
+	resize   sync.Mutex // Serializes onChange, so the pool ends at the latest size
+	log      *logrus.Logger
+}
+
+// NewPoolSizer creates a sizer starting at lo and growing up to hi. onChange,
+// if set, is called with the new size whenever it moves, and should resize
+// the pool.
+func NewPoolSizer(lo, hi int, onChange func(size int)) *PoolSizer {
+	now := time.Now()
+	return &PoolSizer{
+		min:      lo,
+		max:      max(lo, hi),
+		size:     lo,
+		lastMiss: now,
+		lastStep: now,
+		onChange: onChange,
+		log:      ModuleLogger("pool"),
+	}
+}
+
+// Size returns the current size
+func (s *PoolSizer) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Max returns the size the pool may grow to
+func (s *PoolSizer) Max() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+// SetRange changes the sizes the pool moves between, e.g. on reload. A size
+// outside the new range is moved to its nearest end.
+func (s *PoolSizer) SetRange(lo, hi int) {
+	s.mu.Lock()
+	old := s.size
+	s.min, s.max = lo, max(lo, hi)
+	s.size = min(max(s.size, s.min), s.max)
+	size := s.size
+	s.mu.Unlock()
+
+	if size != old {
+		s.notify()
+	}
+}
+
+// Observe records whether a connection found a tunnel ready in the pool
+func (s *PoolSizer) Observe(hit bool) {
+	s.mu.Lock()
+	old := s.size
+	s.gets++
+	if hit {
+		s.hits++
+	} else {
+		s.lastMiss = time.Now()
+	}
+	var rate float64
+	if s.gets >= poolSizeWindow {
+		rate = float64(s.hits) / float64(s.gets)
+		if rate < poolSizeGrowBelow && s.size < s.max {
+			// Grow by half, so a burst is met within a few samples
+			s.size = min(s.size+max(1, s.size/2), s.max)
+			s.lastStep = time.Now()
+		}
+		s.gets, s.hits = 0, 0
+	}
+	size := s.size
+	s.mu.Unlock()
+
+	if size == old {
+		return
+	}
+	s.log.Infof("Only %.0f%% of the last %d connections found a pooled tunnel, growing the pool %d → %d", 100*rate, poolSizeWindow, old, size)
+	s.notify()
+}
+
+// Tick shrinks the pool a step toward its configured size once it has gone
+// poolSizeQuiet without running empty. Halving the distance each step lets a
+// pool grown for a long burst come down within minutes.
+func (s *PoolSizer) Tick(now time.Time) {
+	s.mu.Lock()
+	old := s.size
+	if s.size > s.min && now.Sub(s.lastMiss) >= poolSizeQuiet && now.Sub(s.lastStep) >= poolSizeQuiet {
+		s.size -= max(1, (s.size-s.min)/2)
+		s.lastStep = now
+	}
+	size := s.size
+	s.mu.Unlock()
+
+	if size == old {
+		return
+	}
+	s.log.Debugf("Pool not emptied for %v, shrinking it %d → %d", poolSizeQuiet, old, size)
+	s.notify()
+}
+
+// notify passes the current size to onChange. The size is read under the
+// resize lock: two changes racing to report would otherwise be able to apply
+// their sizes in the wrong order and leave the pool at the older one.
+func (s *PoolSizer) notify() {
+	if s.onChange == nil {
+		return
+	}
+	s.resize.Lock()
+	defer s.resize.Unlock()
+	s.onChange(s.Size())
+}
+
+// Run calls Tick every poolSizeCheck until ctx is cancelled
+func (s *PoolSizer) Run(ctx context.Context) {
+	ticker := time.NewTicker(poolSizeCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.Tick(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolSizerGrowsOnMisses(t *testing.T) {
+	var sizes []int
+	s := NewPoolSizer(4, 8, func(size int) { sizes = append(sizes, size) })
+
+	// A sample where most connections found a tunnel leaves the size alone
+	for i := range poolSizeWindow {
+		s.Observe(i%10 != 0)
+	}
+	if len(sizes) != 0 {
+		t.Fatalf("grew to %v at a 90%% hit rate", sizes)
+	}
+
+	// A burst grows it by half per sample, up to the maximum
+	for range 3 * poolSizeWindow {
+		s.Observe(false)
+	}
+	if !slices.Equal(sizes, []int{6, 8}) {
+		t.Errorf("sizes %v, want 6 then capped at 8", sizes)
+	}
+	if s.Size() != 8 {
+		t.Errorf("Size = %d, want 8", s.Size())
+	}
+}
+
+func TestPoolSizerShrinksWhenQuiet(t *testing.T) {
+	s := NewPoolSizer(2, 32, nil)
+	for range 10 * poolSizeWindow {
+		s.Observe(false)
+	}
+	if s.Size() != 32 {
+		t.Fatalf("Size = %d after a long burst, want 32", s.Size())
+	}
+
+	now := time.Now()
+	s.Tick(now.Add(poolSizeQuiet / 2))
+	if s.Size() != 32 {
+		t.Errorf("shrank to %d before the pool was quiet for %v", s.Size(), poolSizeQuiet)
+	}
+	var steps []int
+	for i := 1; i <= 6; i++ {
+		s.Tick(now.Add(time.Duration(i) * poolSizeQuiet))
+		steps = append(steps, s.Size())
+	}
+	if want := []int{17, 10, 6, 4, 3, 2}; !slices.Equal(steps, want) {
+		t.Errorf("shrank through %v, want %v", steps, want)
+	}
+}
+
+func TestPoolSizerSetRange(t *testing.T) {
+	var resized int
+	s := NewPoolSizer(4, 16, func(size int) { resized = size })
+	for range 2 * poolSizeWindow {
+		s.Observe(false)
+	}
+	s.SetRange(2, 5)
+	if s.Size() != 5 || resized != 5 || s.Max() != 5 {
+		t.Errorf("Size %d, resized to %d, Max %d; want all 5", s.Size(), resized, s.Max())
+	}
+	s.SetRange(6, 3)
+	if s.Size() != 6 || s.Max() != 6 {
+		t.Errorf("Size %d, Max %d; a maximum below the minimum should pin both to 6", s.Size(), s.Max())
+	}
+}
+
+// Changes racing each other still leave the pool at the latest size
+func TestPoolSizerResizeOrder(t *testing.T) {
+	var mu sync.Mutex
+	var last int
+	s := NewPoolSizer(1, 1, func(size int) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		last = size
+		mu.Unlock()
+	})
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Go(func() { s.SetRange(1+i%7, 1+i%7) })
+	}
+	wg.Wait()
+	if last != s.Size() {
+		t.Errorf("pool resized to %d last, want the current size %d", last, s.Size())
+	}
+}
+
+// Connections that find the pool empty make it keep more tunnels ready
+func TestConnPoolSizerResizes(t *testing.T) {
+	factory := func(ctx context.Context) (net.Conn, error) {
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+	p := NewConnPool(1, time.Minute, time.Second, factory, nil, NewStats())
+	p.SetSizer(NewPoolSizer(1, 3, p.Resize))
+	defer p.Stop()
+	// Not started, so every Get finds the pool empty
+	for range poolSizeWindow {
+		tunnel, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnel.Close()
+	}
+	if p.Size() != 2 {
+		t.Errorf("pool size %d after a sample of misses, want 2", p.Size())
+	}
+}
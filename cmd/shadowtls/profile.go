@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Profile is a named set of flag defaults for a class of hardware. Flags
+// given on the command line or in the config file override it.
+type Profile struct {
+	Name  string
+	About string
+	Flags map[string]string
+}
+
+// profiles are the --profile presets
+var profiles = []Profile{
+	{
+		Name:  "small-router",
+		About: "MIPS/ARM routers with 64-128MB RAM and one slow core",
+		Flags: map[string]string{
+			"buffer-size":       "8KB",
+			"pool-size":         "2",
+			"pool-refill":       "adaptive",
+			"handshake-workers": "1",
+			"handshake-queue":   "16",
+			"first-packet-max":  "32KB",
+			"stats-interval":    "0",
+			"log-suppress":      "10m",
+			"leak-watch":        "0",
+		},
+	},
+	{
+		Name:  "vps",
+		About: "Small cloud servers with 1-2 vCPUs, running unattended",
+		Flags: map[string]string{
+			"buffer-size":       "32KB",
+			"pool-size":         "10",
+			"handshake-workers": "8",
+			"handshake-queue":   "256",
+			"stats-interval":    "5m",
+			"log-suppress":      "5m",
+		},
+	},
+	{
+		Name:  "desktop",
+		About: "Laptops and desktops, favoring throughput and latency",
+		Flags: map[string]string{
+			"buffer-size":    "64KB",
+			"pool-size":      "16",
+			"stats-interval": "1m",
+			"log-suppress":   "1m",
+		},
+	},
+}
+
+// profileNames returns the preset names, e.g. for usage text
+func profileNames() []string {
+	names := make([]string, len(profiles))
+	for i, p := range profiles {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// LookupProfile returns the preset called name
+func LookupProfile(name string) (*Profile, error) {
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return &profiles[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown profile: %s (use %s)", name, strings.Join(profileNames(), ", "))
+}
+
+// Apply sets the profile's flags on fs, skipping flags given on the command
+// line. Use ConfigLoader.SetProfile instead when a config file is loaded.
+func (p *Profile) Apply(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, name := range p.flagNames() {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, p.Flags[name]); err != nil {
+			return fmt.Errorf("profile %s: %s: %v", p.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// flagNames returns the profile's flag names in a stable order
+func (p *Profile) flagNames() []string {
+	names := make([]string, 0, len(p.Flags))
+	for name := range p.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+func profileFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("buffer-size", "32KB", "")
+	fs.Int("pool-size", 10, "")
+	fs.String("pool-refill", "eager", "")
+	fs.Int("handshake-workers", 4, "")
+	fs.Int("handshake-queue", 64, "")
+	fs.String("first-packet-max", "16KB", "")
+	fs.Duration("stats-interval", 0, "")
+	fs.Duration("log-suppress", 0, "")
+	fs.Duration("leak-watch", 0, "")
+	return fs
+}
+
+func TestLookupProfile(t *testing.T) {
+	for _, name := range profileNames() {
+		p, err := LookupProfile(name)
+		if err != nil || p.Name != name {
+			t.Fatalf("LookupProfile(%q) = %v, %v", name, p, err)
+		}
+		// Every preset value must be accepted by the flag it targets
+		if err := p.Apply(profileFlags()); err != nil {
+			t.Errorf("profile %s: %v", name, err)
+		}
+	}
+
+	_, err := LookupProfile("mainframe")
+	if err == nil || !strings.Contains(err.Error(), "small-router") {
+		t.Errorf("unknown profile error = %v, want the list of presets", err)
+	}
+}
+
+func TestProfileApplyKeepsExplicitFlags(t *testing.T) {
+	fs := profileFlags()
+	if err := fs.Parse([]string{"--pool-size", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := LookupProfile("small-router")
+	if err := p.Apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("pool-size").Value.String(); got != "5" {
+		t.Errorf("pool-size = %s, want the command-line 5", got)
+	}
+	if got := fs.Lookup("buffer-size").Value.String(); got != "8KB" {
+		t.Errorf("buffer-size = %s, want the profile's 8KB", got)
+	}
+}
+
+func TestConfigLoaderProfile(t *testing.T) {
+	fs := profileFlags()
+	if err := fs.Parse([]string{"--handshake-workers", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := LookupProfile("small-router")
+	path := writeConfig(t, `{"pool-size": 4}`)
+	loader := NewConfigLoader(path, fs)
+	loader.SetProfile(p)
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := loader.Effective()
+	for _, want := range []string{
+		"pool-size = 4 (file)",
+		"handshake-workers = 3 (cli)",
+		"buffer-size = 8KB (profile)",
+		"pool-refill = adaptive (profile)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("effective config missing %q:\n%s", want, got)
+		}
+	}
+
+	// A reload whose file drops a key falls back to the profile, not the flag default
+	if err := os.WriteFile(path, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("pool-size").Value.String(); got != "2" {
+		t.Errorf("pool-size = %s after the file dropped it, want the profile's 2", got)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PushConfig holds configuration for pushing stats to a remote collector
+type PushConfig struct {
+	Target   string        // statsd://host:port, graphite://host:port, influx://host:port/write?db=name or influx-udp://host:port
+	Prefix   string        // Metric name prefix (statsd/graphite) or measurement name (influx)
+	Interval time.Duration // How often to push
+}
+
+// StatsPusher periodically sends key metrics to a statsd, Graphite or InfluxDB endpoint
+type StatsPusher struct {
+	config   *PushConfig
+	target   *url.URL
+	hostname string
+	snapshot func() StatsSnapshot
+	client   *http.Client
+	log      *logrus.Logger
+}
+
+// metric is a single named value taken from a snapshot
+type metric struct {
+	name  string
+	value float64
+}
+
+// NewStatsPusher validates the push target and creates a pusher
+func NewStatsPusher(config *PushConfig, snapshot func() StatsSnapshot, logger *logrus.Logger) (*StatsPusher, error) {
+	target, err := url.Parse(config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stats push target %s: %v", config.Target, err)
+	}
+	switch target.Scheme {
+	case "statsd", "graphite", "influx", "influx-udp":
+	default:
+		return nil, fmt.Errorf("unsupported stats push scheme %q (use statsd, graphite, influx or influx-udp)", target.Scheme)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("stats push target %s has no host", config.Target)
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("stats push interval must be positive")
+	}
+
+	hostname, _ := os.Hostname()
+	return &StatsPusher{
+		config:   config,
+		target:   target,
+		hostname: hostname,
+		snapshot: snapshot,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		log:      logger,
+	}, nil
+}
+
+// Run pushes metrics every interval until ctx is cancelled
+func (p *StatsPusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Push(ctx, p.snapshot()); err != nil {
+				p.log.Debugf("Stats push to %s failed: %v", p.target.Host, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Push sends one snapshot to the configured collector
+func (p *StatsPusher) Push(ctx context.Context, snap StatsSnapshot) error {
+	metrics := snapshotMetrics(snap)
+	now := time.Now()
+
+	switch p.target.Scheme {
+	case "statsd":
+		return p.sendPacket("udp", p.formatStatsd(metrics))
+	case "graphite":
+		return p.sendPacket("tcp", p.formatGraphite(metrics, now))
+	case "influx-udp":
+		return p.sendPacket("udp", p.formatInflux(metrics, now))
+	case "influx":
+		return p.postInflux(ctx, p.formatInflux(metrics, now))
+	}
+	return nil
+}
+
+func (p *StatsPusher) sendPacket(network string, payload []byte) error {
+	conn, err := net.DialTimeout(network, p.target.Host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(payload)
+	return err
+}
+
+func (p *StatsPusher) postInflux(ctx context.Context, payload []byte) error {
+	u := *p.target
+	u.Scheme = "http"
+	if u.Path == "" {
+		u.Path = "/write"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *StatsPusher) formatStatsd(metrics []metric) []byte {
+	var b bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "%s.%s:%s|g\n", p.config.Prefix, m.name, formatMetricValue(m.value))
+	}
+	return b.Bytes()
+}
+
+func (p *StatsPusher) formatGraphite(metrics []metric, now time.Time) []byte {
+	var b bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "%s.%s %s %d\n", p.config.Prefix, m.name, formatMetricValue(m.value), now.Unix())
+	}
+	return b.Bytes()
+}
+
+func (p *StatsPusher) formatInflux(metrics []metric, now time.Time) []byte {
+	fields := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		fields = append(fields, m.name+"="+formatMetricValue(m.value))
+	}
+	host := strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(p.hostname)
+	return []byte(fmt.Sprintf("%s,host=%s %s %d\n", p.config.Prefix, host, strings.Join(fields, ","), now.UnixNano()))
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// snapshotMetrics selects the key metrics pushed to collectors
+func snapshotMetrics(snap StatsSnapshot) []metric {
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	return []metric{
+		{"uptime_seconds", snap.Uptime.Seconds()},
+		{"conns_active", float64(snap.ActiveConns)},
+		{"conns_peak", float64(snap.PeakConns)},
+		{"conns_total", float64(snap.TotalConns)},
+		{"conns_errors", float64(snap.ConnErrors)},
+		{"panics", float64(snap.Panics)},
+		{"conns_held", float64(snap.Held)},
+		{"conns_held_recovered", float64(snap.HeldOK)},
+		{"bytes_total", float64(snap.TotalBytes)},
+		{"pool_size", float64(snap.PoolSize)},
+		{"pool_available", float64(snap.PoolAvailable)},
+		{"pool_refill", float64(snap.PoolRefill)},
+		{"pool_ttl_ms", ms(snap.PoolTTL)},
+		{"pool_max", float64(snap.PoolMax)},
+		{"pool_resizes", float64(snap.PoolResizes)},
+		{"captive_portal", boolMetric(snap.CaptivePortal)},
+		{"pool_created", float64(snap.PoolCreated)},
+		{"pool_hits", float64(snap.PoolHits)},
+		{"pool_misses", float64(snap.PoolMisses)},
+		{"pool_hit_rate", snap.PoolHitRate},
+		{"pool_expired", float64(snap.PoolExpired)},
+		{"pool_failed", float64(snap.PoolFailed)},
+		{"pool_cancelled", float64(snap.PoolCancelled)},
+		{"pool_failed_dns", float64(snap.Failures.DNS)},
+		{"pool_failed_refused", float64(snap.Failures.Refused)},
+		{"pool_failed_timeout", float64(snap.Failures.Timeout)},
+		{"pool_failed_handshake", float64(snap.Failures.Handshake)},
+		{"pool_failed_auth", float64(snap.Failures.Auth)},
+		{"pool_failed_intercept", float64(snap.Failures.Intercept)},
+		{"pool_stale", float64(snap.PoolStale)},
+		{"pool_returned", float64(snap.PoolReturned)},
+		{"verify_split", float64(snap.VerifySplit)},
+		{"pool_wait_avg_ms", ms(snap.PoolAvgWait)},
+		{"connect_time_avg_ms", ms(snap.AvgConnectTime)},
+		{"conn_lifetime_avg_ms", ms(snap.AvgConnLifetime)},
+		{"pool_age_avg_ms", ms(snap.AvgPoolAge)},
+		{"mem_estimate_bytes", float64(snap.Mem.Estimate)},
+		{"mem_heap_bytes", float64(snap.Mem.Heap)},
+		{"mem_shed", float64(snap.Mem.Shed)},
+		{"handshakes_active", float64(snap.Handshakes.Active)},
+		{"handshakes_waiting", float64(snap.Handshakes.Queued)},
+		{"handshakes_rate_delayed", float64(snap.HandshakeRate.Delayed)},
+		{"ping_rtt_ms", ms(snap.PingRTT)},
+		{"ping_failed", float64(snap.PingFailed)},
+		{"path_score", float64(snap.Path.Score)},
+		{"path_events", float64(snap.Path.Events)},
+		{"dial_dns_ms", ms(snap.Decoy.DNS)},
+		{"dial_tcp_ms", ms(snap.Decoy.TCP)},
+		{"dial_tls_ms", ms(snap.Decoy.TLS)},
+		{"dial_tls_baseline_ms", ms(snap.Decoy.TLSBaseline)},
+		{"decoy_state", float64(snap.Decoy.State)},
+		{"decoy_tls_failed", float64(snap.Decoy.Failed)},
+		{"decoy_events", float64(snap.Decoy.Events)},
+		{"storms", float64(snap.Storm.Storms)},
+		{"storm_active", boolMetric(snap.Storm.Active)},
+		{"storm_paced", float64(snap.Storm.Paced)},
+		{"blackhole_suspected", boolMetric(snap.Blackhole.Suspected)},
+		{"blackhole_events", float64(snap.Blackhole.Events)},
+		{"blackhole_silent", float64(snap.Blackhole.Silent)},
+		{"servers_down", float64(len(snap.Servers.Down))},
+		{"server_failovers", float64(snap.Servers.Failovers)},
+		{"sni_hosts", float64(snap.SNI.Hosts)},
+		{"sni_down", float64(len(snap.SNI.Down))},
+		{"sni_removals", float64(snap.SNI.Removals)},
+		{"mux_sessions", float64(snap.Mux.Sessions)},
+		{"mux_streams", float64(snap.Mux.Streams)},
+	}
+}
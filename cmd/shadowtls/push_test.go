@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Each format pushes one line per metric, with durations in milliseconds
+// and flags as 0 or 1
+func TestPushFormats(t *testing.T) {
+	snap := StatsSnapshot{
+		ActiveConns:   3,
+		PoolHitRate:   0.75,
+		PoolTTL:       1500 * time.Millisecond,
+		CaptivePortal: true,
+	}
+	metrics := snapshotMetrics(snap)
+	now := time.Unix(1700000000, 5)
+	p := &StatsPusher{config: &PushConfig{Prefix: "shadowtls"}, hostname: "gw 1"}
+
+	for _, tt := range []struct {
+		name  string
+		out   []byte
+		lines int
+		want  []string
+	}{
+		{"statsd", p.formatStatsd(metrics), len(metrics), []string{
+			"shadowtls.conns_active:3|g",
+			"shadowtls.pool_hit_rate:0.75|g",
+			"shadowtls.pool_ttl_ms:1500|g",
+			"shadowtls.captive_portal:1|g",
+			"shadowtls.storm_active:0|g",
+		}},
+		{"graphite", p.formatGraphite(metrics, now), len(metrics), []string{
+			"shadowtls.conns_active 3 1700000000",
+			"shadowtls.pool_hit_rate 0.75 1700000000",
+			"shadowtls.pool_ttl_ms 1500 1700000000",
+			"shadowtls.captive_portal 1 1700000000",
+		}},
+		{"influx", p.formatInflux(metrics, now), 1, nil},
+	} {
+		lines := strings.Split(strings.TrimSuffix(string(tt.out), "\n"), "\n")
+		if len(lines) != tt.lines {
+			t.Errorf("%s: %d lines, want %d", tt.name, len(lines), tt.lines)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains("\n"+string(tt.out), "\n"+want+"\n") {
+				t.Errorf("%s: missing line %q", tt.name, want)
+			}
+		}
+	}
+
+	influx := string(p.formatInflux(metrics, now))
+	if !strings.HasPrefix(influx, `shadowtls,host=gw\ 1 uptime_seconds=0,conns_active=3,`) || !strings.HasSuffix(influx, " 1700000000000000005\n") {
+		t.Errorf("influx line = %q", influx)
+	}
+	for _, field := range []string{",pool_hit_rate=0.75,", ",pool_ttl_ms=1500,", ",captive_portal=1,"} {
+		if !strings.Contains(influx, field) {
+			t.Errorf("influx line missing %q", field)
+		}
+	}
+}
+
+// Every pushed metric has a name of its own
+func TestPushMetricNamesUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, m := range snapshotMetrics(StatsSnapshot{}) {
+		if seen[m.name] {
+			t.Errorf("metric %s pushed twice", m.name)
+		}
+		seen[m.name] = true
+	}
+}
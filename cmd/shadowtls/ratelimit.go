@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+)
+
+// RateLimitConfig caps the bytes per second the client relays, so bulk
+// transfers through the tunnel leave room on a constrained uplink
+type RateLimitConfig struct {
+	Up      int64 // App → server bytes per second, 0 = unlimited
+	Down    int64 // Server → app bytes per second, 0 = unlimited
+	PerConn bool  // Give each connection the full rates instead of sharing them
+}
+
+// RateLimits hands out the limiters each relayed connection copies through
+type RateLimits struct {
+	config   RateLimitConfig
+	up, down *relaypkg.Limiter // Shared by all connections, unless PerConn
+}
+
+// NewRateLimits returns the limits for config, or nil if config is nil or
+// limits nothing
+func NewRateLimits(config *RateLimitConfig) *RateLimits {
+	if config == nil || config.Up <= 0 && config.Down <= 0 {
+		return nil
+	}
+	r := &RateLimits{config: *config}
+	if !config.PerConn {
+		r.up, r.down = relaypkg.NewLimiter(config.Up), relaypkg.NewLimiter(config.Down)
+	}
+	return r
+}
+
+// ForConn returns the limiters for a new connection; nil ones don't limit
+func (r *RateLimits) ForConn() (up, down *relaypkg.Limiter) {
+	if r == nil {
+		return nil, nil
+	}
+	if r.config.PerConn {
+		return relaypkg.NewLimiter(r.config.Up), relaypkg.NewLimiter(r.config.Down)
+	}
+	return r.up, r.down
+}
+
+// String describes the limits for the startup log
+func (r *RateLimits) String() string {
+	if r == nil {
+		return "none"
+	}
+	rate := func(n int64) string {
+		if n <= 0 {
+			return "unlimited"
+		}
+		return formatBytes(uint64(n), true) + "/s"
+	}
+	scope := "shared by all connections"
+	if r.config.PerConn {
+		scope = "per connection"
+	}
+	return fmt.Sprintf("up %s, down %s, %s", rate(r.config.Up), rate(r.config.Down), scope)
+}
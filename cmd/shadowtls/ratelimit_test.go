@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestRateLimits(t *testing.T) {
+	if r := NewRateLimits(nil); r != nil {
+		t.Error("NewRateLimits(nil) limits something")
+	}
+	if r := NewRateLimits(&RateLimitConfig{PerConn: true}); r != nil {
+		t.Error("NewRateLimits without rates limits something")
+	}
+	var none *RateLimits
+	if up, down := none.ForConn(); up != nil || down != nil {
+		t.Error("nil RateLimits handed out limiters")
+	}
+
+	shared := NewRateLimits(&RateLimitConfig{Up: 1 << 20})
+	up1, down1 := shared.ForConn()
+	up2, _ := shared.ForConn()
+	if up1 == nil || up1 != up2 {
+		t.Error("shared limits gave connections different up limiters")
+	}
+	if up1.Rate() != 1<<20 || down1 != nil {
+		t.Errorf("up %d B/s, down %v; want 1MB/s up and no down limit", up1.Rate(), down1)
+	}
+
+	perConn := NewRateLimits(&RateLimitConfig{Up: 1 << 20, Down: 4 << 20, PerConn: true})
+	up1, down1 = perConn.ForConn()
+	up2, _ = perConn.ForConn()
+	if up1 == up2 {
+		t.Error("per-connection limits shared an up limiter")
+	}
+	if down1.Rate() != 4<<20 {
+		t.Errorf("per-connection down rate %d, want 4MB/s", down1.Rate())
+	}
+	if got, want := perConn.String(), "up 1.0MB/s, down 4.0MB/s, per connection"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RefillPolicy decides how many pool workers may keep refilling the pool.
+// Workers whose index is at or above the allowed count park until it grows.
+type RefillPolicy interface {
+	// Allowed returns the number of active workers and a channel that is
+	// closed the next time that number changes
+	Allowed() (int, <-chan struct{})
+	// Observe reports the outcome of a refill dial
+	Observe(err error, connectTime time.Duration)
+	// Resize changes the pool size the policy works within
+	Resize(size int)
+}
+
+// FixedRefill keeps every worker active regardless of dial outcomes
+type FixedRefill struct {
+	size atomic.Int32
+}
+
+// NewFixedRefill creates a policy that always allows size workers
+func NewFixedRefill(size int) *FixedRefill {
+	f := &FixedRefill{}
+	f.size.Store(int32(size))
+	return f
+}
+
+// Allowed returns the fixed pool size; the channel never fires, the pool
+// wakes parked workers itself when resized
+func (f *FixedRefill) Allowed() (int, <-chan struct{}) {
+	return int(f.size.Load()), nil
+}
+
+// Observe is a no-op for the fixed policy
+func (f *FixedRefill) Observe(err error, connectTime time.Duration) {}
+
+// Resize allows size workers from now on
+func (f *FixedRefill) Resize(size int) {
+	f.size.Store(int32(size))
+}
+
+// AdaptiveRefill is an AIMD admission controller: each connect failure halves
+// the number of refilling workers, successes on a degraded path (rising RTT)
+// shed one worker, and a full round of healthy successes adds one back.
+type AdaptiveRefill struct {
+	mu       sync.Mutex
+	max      int
+	limit    int
+	streak   int // Healthy successes since the last increase
+	changed  chan struct{}
+	degraded func() bool
+	onChange func(limit int)
+	log      *logrus.Logger
+}
+
+// NewAdaptiveRefill creates an adaptive policy starting at max workers.
+// degraded reports whether the path currently shows rising RTT; onChange, if
+// set, is called with the new limit whenever it moves.
+func NewAdaptiveRefill(max int, degraded func() bool, onChange func(limit int)) *AdaptiveRefill {
+	return &AdaptiveRefill{
+		max:      max,
+		limit:    max,
+		changed:  make(chan struct{}),
+		degraded: degraded,
+		onChange: onChange,
+		log:      ModuleLogger("pool"),
+	}
+}
+
+// Allowed returns the current worker limit
+func (a *AdaptiveRefill) Allowed() (int, <-chan struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit, a.changed
+}
+
+// Observe adjusts the limit from a dial outcome
+func (a *AdaptiveRefill) Observe(err error, connectTime time.Duration) {
+	degraded := err == nil && a.degraded != nil && a.degraded()
+
+	a.mu.Lock()
+	old := a.limit
+	switch {
+	case err != nil:
+		a.limit = max(1, a.limit/2)
+		a.streak = 0
+	case degraded:
+		a.limit = max(1, a.limit-1)
+		a.streak = 0
+	default:
+		a.streak++
+		if a.streak >= a.limit && a.limit < a.max {
+			a.limit++
+			a.streak = 0
+		}
+	}
+	limit := a.limit
+	if limit != old {
+		close(a.changed)
+		a.changed = make(chan struct{})
+	}
+	a.mu.Unlock()
+
+	if limit != old {
+		reason := "recovering"
+		if err != nil {
+			reason = "connect failure"
+		} else if degraded {
+			reason = "rising RTT"
+		}
+		a.log.Debugf("Pool refill limit %d → %d (%s)", old, limit, reason)
+		if a.onChange != nil {
+			a.onChange(limit)
+		}
+	}
+}
+
+// Resize changes the maximum. A limit at the old maximum follows it up; one
+// held down by failures stays where it is, within the new maximum.
+func (a *AdaptiveRefill) Resize(size int) {
+	a.mu.Lock()
+	old := a.limit
+	if a.limit >= a.max || a.limit > size {
+		a.limit = size
+	}
+	a.max = size
+	a.streak = 0
+	limit := a.limit
+	if limit != old {
+		close(a.changed)
+		a.changed = make(chan struct{})
+	}
+	a.mu.Unlock()
+
+	if limit != old && a.onChange != nil {
+		a.onChange(limit)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveRefillAIMD(t *testing.T) {
+	degraded := false
+	a := NewAdaptiveRefill(8, func() bool { return degraded }, nil)
+
+	limit, changed := a.Allowed()
+	if limit != 8 {
+		t.Fatalf("initial limit = %d, want 8", limit)
+	}
+
+	a.Observe(errors.New("refused"), 0)
+	if limit, _ := a.Allowed(); limit != 4 {
+		t.Fatalf("limit after failure = %d, want 4", limit)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("changed channel should be closed after the limit moves")
+	}
+
+	a.Observe(errors.New("refused"), 0)
+	a.Observe(errors.New("refused"), 0)
+	a.Observe(errors.New("refused"), 0)
+	if limit, _ := a.Allowed(); limit != 1 {
+		t.Fatalf("limit should floor at 1, got %d", limit)
+	}
+
+	// Recovery needs a full round of successes per step
+	a.Observe(nil, 50*time.Millisecond)
+	if limit, _ := a.Allowed(); limit != 2 {
+		t.Fatalf("limit after 1 success at limit 1 = %d, want 2", limit)
+	}
+	a.Observe(nil, 50*time.Millisecond)
+	if limit, _ := a.Allowed(); limit != 2 {
+		t.Fatalf("limit should hold until a full round succeeds, got %d", limit)
+	}
+	a.Observe(nil, 50*time.Millisecond)
+	if limit, _ := a.Allowed(); limit != 3 {
+		t.Fatalf("limit after 2 successes at limit 2 = %d, want 3", limit)
+	}
+
+	degraded = true
+	a.Observe(nil, 500*time.Millisecond)
+	if limit, _ := a.Allowed(); limit != 2 {
+		t.Fatalf("success on degraded path should shed a worker, got %d", limit)
+	}
+}
+
+func TestAdaptiveRefillCapsAtMax(t *testing.T) {
+	a := NewAdaptiveRefill(2, nil, nil)
+	for i := 0; i < 10; i++ {
+		a.Observe(nil, time.Millisecond)
+	}
+	if limit, _ := a.Allowed(); limit != 2 {
+		t.Errorf("limit should not exceed max, got %d", limit)
+	}
+}
+
+func TestAdaptiveRefillResize(t *testing.T) {
+	var changes []int
+	a := NewAdaptiveRefill(4, nil, func(limit int) { changes = append(changes, limit) })
+
+	// A limit at the maximum follows it
+	a.Resize(6)
+	if limit, _ := a.Allowed(); limit != 6 {
+		t.Fatalf("limit = %d after growing, want 6", limit)
+	}
+
+	// One held down by failures stays, unless above the new maximum
+	a.Observe(errors.New("refused"), 0)
+	a.Resize(8)
+	if limit, _ := a.Allowed(); limit != 3 {
+		t.Fatalf("limit = %d after growing a degraded pool, want 3", limit)
+	}
+	a.Resize(2)
+	if limit, _ := a.Allowed(); limit != 2 {
+		t.Fatalf("limit = %d after shrinking, want 2", limit)
+	}
+	if len(changes) != 3 || changes[0] != 6 || changes[1] != 3 || changes[2] != 2 {
+		t.Errorf("onChange calls = %v", changes)
+	}
+
+	f := NewFixedRefill(2)
+	f.Resize(5)
+	if limit, _ := f.Allowed(); limit != 5 {
+		t.Errorf("fixed limit = %d after resize, want 5", limit)
+	}
+}
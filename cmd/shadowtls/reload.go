@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reload policies for connections established under a superseded config
+const (
+	ReloadGrace = "grace" // Let old connections finish, force-close after the grace period
+	ReloadDrain = "drain" // Let old connections finish, however long they take
+	ReloadKill  = "kill"  // Close old connections immediately
+)
+
+// ReloadPolicy controls what happens to established connections when the
+// password or server address changes on reload
+type ReloadPolicy struct {
+	Mode  string
+	Grace time.Duration // Only for ReloadGrace
+}
+
+// Validate checks the policy mode; an empty mode means ReloadGrace
+func (p ReloadPolicy) Validate() error {
+	switch p.Mode {
+	case "", ReloadGrace, ReloadDrain, ReloadKill:
+		return nil
+	default:
+		return fmt.Errorf("unknown reload policy: %s (use grace, drain or kill)", p.Mode)
+	}
+}
+
+// generationTracker tracks active connections by config generation so the
+// ones created under an old password/server can be retired deterministically
+type generationTracker struct {
+	mu    sync.Mutex
+	gen   uint64
+	conns map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	gen   uint64
+	close func()
+	once  sync.Once
+}
+
+func newGenerationTracker() *generationTracker {
+	return &generationTracker{
+		conns: make(map[*trackedConn]struct{}),
+	}
+}
+
+// Len returns how many connections are tracked
+func (t *generationTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Track registers a connection under the current generation. close must
+// tear the connection down; the returned func unregisters it.
+func (t *generationTracker) Track(close func()) (untrack func()) {
+	tc := &trackedConn{close: close}
+	t.mu.Lock()
+	tc.gen = t.gen
+	t.conns[tc] = struct{}{}
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, tc)
+		t.mu.Unlock()
+	}
+}
+
+// Advance starts a new generation and returns the previous one
+func (t *generationTracker) Advance() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gen++
+	return t.gen - 1
+}
+
+// closeOlder closes every connection from a generation at or below gen and
+// returns how many were closed
+func (t *generationTracker) closeOlder(gen uint64) int {
+	t.mu.Lock()
+	var victims []*trackedConn
+	for tc := range t.conns {
+		if tc.gen <= gen {
+			victims = append(victims, tc)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, tc := range victims {
+		tc.once.Do(tc.close)
+	}
+	return len(victims)
+}
+
+// CloseAll closes every tracked connection and returns how many were closed
+func (t *generationTracker) CloseAll() int {
+	return t.closeOlder(math.MaxUint64)
+}
+
+// count returns the number of connections from a generation at or below gen
+func (t *generationTracker) count(gen uint64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for tc := range t.conns {
+		if tc.gen <= gen {
+			n++
+		}
+	}
+	return n
+}
+
+// Retire applies the reload policy to connections from generation gen and older
+func (t *generationTracker) Retire(gen uint64, policy ReloadPolicy, logger *logrus.Logger) {
+	remaining := t.count(gen)
+	if remaining == 0 {
+		return
+	}
+
+	switch policy.Mode {
+	case ReloadKill:
+		n := t.closeOlder(gen)
+		logger.Infof("Reload: closed %d connection(s) using the old configuration", n)
+	case ReloadDrain:
+		logger.Infof("Reload: %d connection(s) using the old configuration will drain naturally", remaining)
+	default:
+		logger.Infof("Reload: %d connection(s) using the old configuration have %v to finish", remaining, policy.Grace)
+		time.AfterFunc(policy.Grace, func() {
+			if n := t.closeOlder(gen); n > 0 {
+				logger.Infof("Reload: grace period over, closed %d remaining old connection(s)", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGenerationTrackerKill(t *testing.T) {
+	tr := newGenerationTracker()
+	var closedOld, closedNew atomic.Int32
+	tr.Track(func() { closedOld.Add(1) })
+	old := tr.Advance()
+	tr.Track(func() { closedNew.Add(1) })
+
+	tr.Retire(old, ReloadPolicy{Mode: ReloadKill}, Log)
+	if closedOld.Load() != 1 {
+		t.Errorf("old connection closed %d times, want 1", closedOld.Load())
+	}
+	if closedNew.Load() != 0 {
+		t.Error("new-generation connection should stay open")
+	}
+}
+
+func TestGenerationTrackerGrace(t *testing.T) {
+	tr := newGenerationTracker()
+	var finished, lingering atomic.Int32
+	untrack := tr.Track(func() { finished.Add(1) })
+	tr.Track(func() { lingering.Add(1) })
+	old := tr.Advance()
+
+	tr.Retire(old, ReloadPolicy{Mode: ReloadGrace, Grace: 50 * time.Millisecond}, Log)
+	untrack() // Finished within the grace period
+	if lingering.Load() != 0 {
+		t.Fatal("connection closed before the grace period ended")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for lingering.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lingering.Load() != 1 {
+		t.Error("lingering connection should be closed after the grace period")
+	}
+	if finished.Load() != 0 {
+		t.Error("connection that finished in time should not be closed")
+	}
+}
+
+func TestGenerationTrackerDrain(t *testing.T) {
+	tr := newGenerationTracker()
+	var closed atomic.Int32
+	tr.Track(func() { closed.Add(1) })
+	tr.Retire(tr.Advance(), ReloadPolicy{Mode: ReloadDrain}, Log)
+	time.Sleep(20 * time.Millisecond)
+	if closed.Load() != 0 {
+		t.Error("drain policy should not close connections")
+	}
+}
+
+func TestReloadPolicyValidate(t *testing.T) {
+	for _, mode := range []string{"", ReloadGrace, ReloadDrain, ReloadKill} {
+		if err := (ReloadPolicy{Mode: mode}).Validate(); err != nil {
+			t.Errorf("%q: unexpected error: %v", mode, err)
+		}
+	}
+	if err := (ReloadPolicy{Mode: "linger"}).Validate(); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	shadowtls "github.com/metacubex/sing-shadowtls"
+	M "github.com/metacubex/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+)
+
+// rendezvousMagic starts the first frame of a rendezvous tunnel, followed by
+// an op byte, a name length byte and the name. A dial may carry the peer's
+// first data after the name.
+var rendezvousMagic = []byte("\x00shadowtun-rv\x00")
+
+const (
+	rendezvousListen = 'L' // Wait under a name for a peer to dial it
+	rendezvousDial   = 'D' // Connect to a peer waiting under a name
+
+	rendezvousPing  = 0x00 // Server → listener keepalive, holds the NAT mapping open
+	rendezvousMatch = 0x01 // Server → listener: a peer dialed, relay starts after this byte
+
+	rendezvousPingInterval = 30 * time.Second
+	rendezvousWait         = 5 * time.Second // How long a dial waits for a free listener
+	rendezvousQueue        = 64              // Waiting listeners per name
+	rendezvousSlots        = 4               // Listener tunnels an exposing client keeps open
+)
+
+// rendezvousHeader builds the opening of a rendezvous tunnel
+func rendezvousHeader(op byte, name string) []byte {
+	h := make([]byte, 0, len(rendezvousMagic)+2+len(name))
+	h = append(h, rendezvousMagic...)
+	return append(append(h, op, byte(len(name))), name...)
+}
+
+// parseRendezvous splits a first frame into op, name and trailing data.
+// ok is false for frames that are not rendezvous requests.
+func parseRendezvous(frame []byte) (op byte, name string, rest []byte, ok bool) {
+	if !bytes.HasPrefix(frame, rendezvousMagic) {
+		return 0, "", nil, false
+	}
+	frame = frame[len(rendezvousMagic):]
+	if len(frame) < 2 || len(frame) < 2+int(frame[1]) || frame[1] == 0 {
+		return 0, "", nil, false
+	}
+	n := int(frame[1])
+	return frame[0], string(frame[2 : 2+n]), frame[2+n:], true
+}
+
+// RendezvousHub pairs tunnels from clients dialing a name with tunnels from
+// a client exposing it. Traffic is relayed through the server; the peers
+// never connect to each other directly.
+type RendezvousHub struct {
+	mu     sync.Mutex
+	queues map[string]*rvQueue
+	log    *logrus.Logger
+}
+
+// rvQueue holds the listeners waiting under one name. It is dropped once no
+// Listen or Dial uses it, so names that were only dialed don't pile up.
+type rvQueue struct {
+	peers chan *rvPeer
+	users int // Listen and Dial calls holding the queue
+}
+
+// rvPeer is a listener tunnel waiting under a name
+type rvPeer struct {
+	conn  net.Conn
+	state atomic.Int32 // rvWaiting, rvMatched or rvGone
+	match chan rvMatch
+}
+
+const (
+	rvWaiting = iota
+	rvMatched
+	rvGone
+)
+
+// rvMatch hands a dialing tunnel to a listener; done is closed when the
+// relay between them ends
+type rvMatch struct {
+	conn net.Conn
+	data []byte
+	done chan struct{}
+	log  logrus.FieldLogger // Tagged with the dialing tunnel's conn ID
+}
+
+// NewRendezvousHub creates an empty hub
+func NewRendezvousHub(log *logrus.Logger) *RendezvousHub {
+	return &RendezvousHub{queues: make(map[string]*rvQueue), log: log}
+}
+
+// queue returns the queue for name, creating it if needed; release it when done
+func (h *RendezvousHub) queue(name string) *rvQueue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q, ok := h.queues[name]
+	if !ok {
+		q = &rvQueue{peers: make(chan *rvPeer, rendezvousQueue)}
+		h.queues[name] = q
+	}
+	q.users++
+	return q
+}
+
+// release drops a queue no one uses any more. Listeners still in it have all
+// returned, so they are gone and nothing waits on them.
+func (h *RendezvousHub) release(name string, q *rvQueue) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if q.users--; q.users == 0 {
+		delete(h.queues, name)
+	}
+}
+
+// Waiting returns the number of listener tunnels queued under name, including
+// ones that disconnected and were not collected yet
+func (h *RendezvousHub) Waiting(name string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if q := h.queues[name]; q != nil {
+		return len(q.peers)
+	}
+	return 0
+}
+
+// Listen queues conn under name and blocks until a peer dials it and the
+// relay ends, or the listener goes away
+func (h *RendezvousHub) Listen(ctx context.Context, name string, conn net.Conn) error {
+	p := &rvPeer{conn: conn, match: make(chan rvMatch, 1)}
+	q := h.queue(name)
+	defer h.release(name, q)
+	select {
+	case q.peers <- p:
+	default:
+		return fmt.Errorf("rendezvous %q: too many waiting listeners", name)
+	}
+
+	// Listeners send nothing until matched, so a read returning early means
+	// the listener went away. Once matched, its result is the first data the
+	// exposing client sent back. A read deadline can't interrupt it instead:
+	// the tunnel treats a timed-out read as fatal.
+	first := make(chan readResult, 1)
+	go func() {
+		defer crashGuard()
+		buf := make([]byte, copyBufSize)
+		n, err := conn.Read(buf)
+		first <- readResult{data: buf[:n], err: err}
+	}()
+	ping := time.NewTicker(rendezvousPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case m := <-p.match:
+			defer close(m.done)
+			return h.relay(name, &pendingConn{Conn: conn, pending: first}, m)
+		case <-first:
+			return h.abandon(p, conn)
+		case <-ctx.Done():
+			return h.abandon(p, conn)
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(relaypkg.DefaultWriteTimeout))
+			_, err := conn.Write([]byte{rendezvousPing})
+			conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				return h.abandon(p, conn)
+			}
+		}
+	}
+}
+
+// abandon marks a listener gone and closes it; a dialer that matched it
+// concurrently is released so its client can retry
+func (h *RendezvousHub) abandon(p *rvPeer, conn net.Conn) error {
+	conn.Close()
+	if p.state.CompareAndSwap(rvWaiting, rvGone) {
+		return nil
+	}
+	m := <-p.match
+	close(m.done)
+	return nil
+}
+
+// relay starts the match on the listener tunnel and copies both ways
+func (h *RendezvousHub) relay(name string, listener net.Conn, m rvMatch) error {
+	opening := append([]byte{rendezvousMatch}, bytes.TrimPrefix(m.data, passiveWake)...)
+	listener.SetWriteDeadline(time.Now().Add(relaypkg.DefaultWriteTimeout))
+	_, err := listener.Write(opening)
+	listener.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("rendezvous %q: start relay: %v", name, err)
+	}
+	m.log.Debugf("Rendezvous %q: relaying %s ↔ %s", name, m.conn.RemoteAddr(), listener.RemoteAddr())
+
+	done := make(chan struct{}, 2)
+	go func() {
+		defer crashGuard()
+		relaypkg.CopyConn(listener, m.conn, relayBufferSize, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
+		listener.Close() // Tunnels can't half-close; end the other direction too
+		done <- struct{}{}
+	}()
+	go func() {
+		defer crashGuard()
+		relaypkg.CopyConn(m.conn, listener, relayBufferSize, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
+		m.conn.Close()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return nil
+}
+
+// Dial pairs conn with a listener waiting under name, waiting briefly for
+// one to be free, and blocks until the relay ends
+func (h *RendezvousHub) Dial(ctx context.Context, name string, conn net.Conn, data []byte) error {
+	q := h.queue(name)
+	defer h.release(name, q)
+	timer := time.NewTimer(rendezvousWait)
+	defer timer.Stop()
+	for {
+		select {
+		case p := <-q.peers:
+			if !p.state.CompareAndSwap(rvWaiting, rvMatched) {
+				continue // Listener left while queued
+			}
+			m := rvMatch{conn: conn, data: data, done: make(chan struct{}), log: connLogger(ctx, h.log)}
+			p.match <- m
+			<-m.done
+			return nil
+		case <-timer.C:
+			return fmt.Errorf("rendezvous %q: no peer is listening", name)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// rendezvousHandler answers rendezvous tunnels and passes all others, with
+// their first frame intact, to next (nil to refuse them)
+type rendezvousHandler struct {
+	next   shadowtls.Handler
+	hub    *RendezvousHub
+	logger *logrus.Logger
+}
+
+func (h *rendezvousHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	first, err := readFirstFrame(conn)
+	if err != nil {
+		return fmt.Errorf("read first frame: %v", err)
+	}
+	op, name, rest, ok := parseRendezvous(first)
+	if !ok {
+		if h.next == nil {
+			return errors.New("not a rendezvous tunnel and no --forward, --socks5 or --upstream is set")
+		}
+		return h.next.NewConnection(ctx, &prefixConn{Conn: conn, prefix: first}, metadata)
+	}
+	switch op {
+	case rendezvousListen:
+		connLogger(ctx, h.logger).Debugf("Rendezvous %q: listener from %s", name, conn.RemoteAddr())
+		return h.hub.Listen(ctx, name, conn)
+	case rendezvousDial:
+		if err := h.hub.Dial(ctx, name, conn, rest); err != nil {
+			connLogger(ctx, h.logger).Warnf("%v", err)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("rendezvous %q: unknown op %q", name, op)
+}
+
+func (h *rendezvousHandler) NewError(ctx context.Context, err error) {
+	connLogger(ctx, h.logger).Warnf("Rendezvous handler error: %v", err)
+}
+
+// prefixConn replays bytes already read from Conn before reading more
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// ExposeConfig names a local service reachable by peers through the server
+type ExposeConfig struct {
+	Name   string // Rendezvous name, 1-255 bytes
+	Target string // Local host:port peers are relayed to
+}
+
+// Exposer keeps listener tunnels registered under a name on the server and
+// relays each matched one to a local target, e.g. a NAS on the home network
+type Exposer struct {
+	name    string
+	target  string
+	dial    func(ctx context.Context) (net.Conn, error)
+	backoff time.Duration
+	log     *logrus.Logger
+	active  atomic.Int64
+}
+
+// NewExposer creates an exposer; dial opens a tunnel to the server
+func NewExposer(name, target string, dial func(ctx context.Context) (net.Conn, error), backoff time.Duration, log *logrus.Logger) *Exposer {
+	return &Exposer{name: name, target: target, dial: dial, backoff: backoff, log: log}
+}
+
+// Run keeps rendezvousSlots listeners registered until ctx is done
+func (e *Exposer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < rendezvousSlots; i++ {
+		wg.Add(1)
+		go func() {
+			defer crashGuard()
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := e.serveOne(ctx, &wg); err != nil && ctx.Err() == nil {
+					e.log.Warnf("Expose %q: %v", e.name, err)
+					select {
+					case <-time.After(e.backoff):
+					case <-ctx.Done():
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// serveOne registers one listener tunnel, waits for a peer and starts the
+// relay in the background, so the slot can register again right away
+func (e *Exposer) serveOne(ctx context.Context, wg *sync.WaitGroup) error {
+	tunnel, err := e.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() { tunnel.Close() })
+	if _, err := tunnel.Write(rendezvousHeader(rendezvousListen, e.name)); err != nil {
+		stop()
+		tunnel.Close()
+		return fmt.Errorf("register: %v", err)
+	}
+
+	b := make([]byte, 1)
+	for {
+		// Missing two pings means the server or the path is gone
+		tunnel.SetReadDeadline(time.Now().Add(2*rendezvousPingInterval + relaypkg.DefaultWriteTimeout))
+		if _, err := io.ReadFull(tunnel, b); err != nil {
+			stop()
+			tunnel.Close()
+			return fmt.Errorf("wait for peer: %v", err)
+		}
+		if b[0] == rendezvousMatch {
+			break
+		}
+	}
+	tunnel.SetReadDeadline(time.Time{})
+
+	wg.Add(1)
+	go func() {
+		defer crashGuard()
+		defer wg.Done()
+		defer stop()
+		defer tunnel.Close()
+		local, err := net.Dial("tcp", e.target)
+		if err != nil {
+			e.log.Warnf("Expose %q: connect to %s: %v", e.name, e.target, err)
+			return
+		}
+		defer local.Close()
+		e.active.Add(1)
+		defer e.active.Add(-1)
+		e.log.Debugf("Expose %q: peer connected, relaying to %s", e.name, e.target)
+
+		done := make(chan struct{}, 2)
+		go func() {
+			defer crashGuard()
+			relaypkg.CopyConn(local, tunnel, relayBufferSize, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
+			local.Close()
+			done <- struct{}{}
+		}()
+		go func() {
+			defer crashGuard()
+			relaypkg.CopyConn(tunnel, local, relayBufferSize, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
+			tunnel.Close()
+			done <- struct{}{}
+		}()
+		<-done
+		<-done
+	}()
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseRendezvous(t *testing.T) {
+	frame := append(rendezvousHeader(rendezvousDial, "nas"), "hello"...)
+	op, name, rest, ok := parseRendezvous(frame)
+	if !ok || op != rendezvousDial || name != "nas" || string(rest) != "hello" {
+		t.Errorf("parseRendezvous = %q, %q, %q, %v", op, name, rest, ok)
+	}
+
+	for _, frame := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\n"),
+		rendezvousMagic,
+		append(append([]byte{}, rendezvousMagic...), rendezvousListen, 0),
+		append(append([]byte{}, rendezvousMagic...), rendezvousListen, 9, 'a'),
+	} {
+		if _, _, _, ok := parseRendezvous(frame); ok {
+			t.Errorf("parseRendezvous(%q) accepted a non-rendezvous frame", frame)
+		}
+	}
+}
+
+func TestPrefixConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		b.Write([]byte(" world"))
+		b.Close()
+	}()
+	got, err := io.ReadAll(&prefixConn{Conn: a, prefix: []byte("hello")})
+	if err != nil || string(got) != "hello world" {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+// A peer client reaches a service behind the exposing client, while tunnels
+// that aren't rendezvous requests still reach --forward
+// Queues go away with the last listener or dialer using them
+func TestRendezvousHubDropsQueues(t *testing.T) {
+	hub := NewRendezvousHub(logrus.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, peer := net.Pipe()
+	defer peer.Close()
+	listened := make(chan error, 1)
+	go func() { listened <- hub.Listen(ctx, "nas", listener) }()
+	for hub.Waiting("nas") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-listened
+
+	// Dialing a name no one listens on fails and leaves nothing behind
+	dialCtx, stop := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer stop()
+	dialer, _ := net.Pipe()
+	if err := hub.Dial(dialCtx, "nobody", dialer, nil); err == nil {
+		t.Error("dial to a name without listeners succeeded")
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if n := len(hub.queues); n != 0 {
+		t.Errorf("%d queues left, want none", n)
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	rig, err := startSoakRig(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run in reverse, so clients started below stop before the rig
+	t.Cleanup(rig.stop)
+
+	// The exposed service answers in upper case, unlike the rig's echo backend
+	nas, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rig.listeners = append(rig.listeners, nas)
+	go serveSoak(nas, func(c net.Conn) {
+		buf := make([]byte, 1024)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return
+			}
+			c.Write(bytes.ToUpper(buf[:n]))
+		}
+	})
+
+	hubAddr, err := freeLoopbackAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := *rig.server.config
+	sc.ListenAddr = hubAddr
+	sc.Rendezvous = true
+	hub := NewServer(&sc)
+	hubErr := rig.run(hub.Run)
+	defer hub.Stop()
+	select {
+	case <-hub.Ready():
+	case err := <-hubErr:
+		t.Fatal(err)
+	}
+
+	// startClient runs a copy of the rig client against the hub
+	startClient := func(edit func(*ClientConfig)) *ClientConfig {
+		cfg := *rig.client.config
+		cfg.ServerAddr = hubAddr
+		if cfg.ListenAddr, err = freeLoopbackAddr(); err != nil {
+			t.Fatal(err)
+		}
+		edit(&cfg)
+		c := NewClient(&cfg)
+		cErr := rig.run(c.Run)
+		t.Cleanup(c.Stop)
+		select {
+		case <-c.Ready():
+		case err := <-cErr:
+			t.Fatal(err)
+		}
+		return &cfg
+	}
+	startClient(func(cfg *ClientConfig) {
+		cfg.PoolSize = 0
+		cfg.Expose = &ExposeConfig{Name: "nas", Target: nas.Addr().String()}
+	})
+	peer := startClient(func(cfg *ClientConfig) { cfg.Peer = "nas" })
+	plain := startClient(func(cfg *ClientConfig) {})
+
+	exchange := func(addr, msg string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read from %s: %v", addr, err)
+		}
+		return string(got)
+	}
+
+	// The exposer registers in the background; wait for its listeners
+	deadline := time.Now().Add(10 * time.Second)
+	for hub.handler.(*rendezvousHandler).hub.Waiting("nas") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("exposer did not register")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := exchange(peer.ListenAddr, "hello nas"); got != "HELLO NAS" {
+			t.Errorf("peer got %q, want the exposed service's reply", got)
+		}
+	}
+	if got := exchange(plain.ListenAddr, "hello echo"); got != "hello echo" {
+		t.Errorf("plain client got %q, want the forward backend's echo", got)
+	}
+}
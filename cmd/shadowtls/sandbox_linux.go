@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxSupported reports whether --sandbox works here
+const sandboxSupported = true
+
+// landlockFileAccess are the rights that apply to a file rather than a directory
+const landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// sandboxAllowedSyscalls are all the relay needs once the sandbox is up:
+// sockets, reading and writing files, memory, time, signals and threads.
+// Anything else, such as exec, ptrace, mount, unshare or loading kernel
+// modules, fails with EPERM. Calls that only exist on some architectures
+// are in sandboxArchSyscalls.
+var sandboxAllowedSyscalls = []uintptr{
+	// Sockets
+	unix.SYS_SOCKET, unix.SYS_SOCKETPAIR, unix.SYS_BIND, unix.SYS_LISTEN,
+	unix.SYS_ACCEPT4, unix.SYS_CONNECT, unix.SYS_SHUTDOWN,
+	unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME, unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKOPT,
+	unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG,
+	unix.SYS_SENDMMSG, unix.SYS_RECVMMSG, unix.SYS_SPLICE, unix.SYS_SENDFILE,
+	// Polling
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT, unix.SYS_EPOLL_PWAIT2,
+	unix.SYS_EVENTFD2, unix.SYS_PIPE2, unix.SYS_PPOLL, unix.SYS_PSELECT6,
+	// Files; Landlock decides which paths
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV,
+	unix.SYS_PREAD64, unix.SYS_PWRITE64, unix.SYS_OPENAT, unix.SYS_CLOSE,
+	unix.SYS_FSTAT, unix.SYS_STATX, unix.SYS_LSEEK, unix.SYS_GETDENTS64,
+	unix.SYS_FCNTL, unix.SYS_DUP, unix.SYS_DUP3, unix.SYS_IOCTL,
+	unix.SYS_FACCESSAT, unix.SYS_FACCESSAT2, unix.SYS_READLINKAT,
+	unix.SYS_RENAMEAT2, unix.SYS_UNLINKAT, unix.SYS_MKDIRAT,
+	unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_FTRUNCATE, unix.SYS_FLOCK, unix.SYS_FCHMOD,
+	unix.SYS_GETCWD, unix.SYS_STATFS, unix.SYS_FSTATFS,
+	// Memory
+	unix.SYS_MUNMAP, unix.SYS_MREMAP, unix.SYS_MADVISE, unix.SYS_MPROTECT,
+	unix.SYS_BRK, unix.SYS_MINCORE,
+	// Signals
+	unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN,
+	unix.SYS_SIGALTSTACK, unix.SYS_KILL, unix.SYS_TKILL, unix.SYS_TGKILL,
+	// Threads and time
+	unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_FUTEX, unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY, unix.SYS_SET_ROBUST_LIST, unix.SYS_RSEQ, unix.SYS_RESTART_SYSCALL,
+	unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_GETRES,
+	unix.SYS_GETTIMEOFDAY, unix.SYS_TIMER_CREATE, unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_DELETE,
+	unix.SYS_SETITIMER, unix.SYS_GETITIMER,
+	// Process information
+	unix.SYS_GETPID, unix.SYS_GETTID, unix.SYS_GETPPID,
+	unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+	unix.SYS_PRLIMIT64, unix.SYS_GETRUSAGE, unix.SYS_UNAME, unix.SYS_SYSINFO, unix.SYS_GETRANDOM,
+}
+
+// sandboxCloneNamespaces are the clone flags that would create namespaces;
+// clone is only allowed without them, as the runtime starts threads
+const sandboxCloneNamespaces = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// enterSandbox sets no_new_privs, restricts the filesystem with Landlock and
+// installs the seccomp allowlist, on every thread of the process
+func enterSandbox(readPaths, writePaths []string) error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return errors.New("needs a binary built with CGO_ENABLED=0")
+		}
+		return fmt.Errorf("no_new_privs: %v", errno)
+	}
+	if err := landlock(readPaths, writePaths); err != nil {
+		return fmt.Errorf("landlock: %v", err)
+	}
+	if err := seccompAllow(append(sandboxAllowedSyscalls, sandboxArchSyscalls...)); err != nil {
+		return fmt.Errorf("seccomp: %v", err)
+	}
+	return nil
+}
+
+// landlockRulesetAttr is struct landlock_ruleset_attr up to handled_access_fs
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr is struct landlock_path_beneath_attr (packed; the
+// kernel reads the first 12 bytes)
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+	_             int32
+}
+
+// landlockAccessFor returns the filesystem rights the running kernel's
+// Landlock ABI knows, or 0 if Landlock is off
+func landlockAccessFor() uint64 {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	access := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1) // ABI 1
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return access
+}
+
+// landlock denies all filesystem access except reading readPaths and
+// writing writePaths. Already open files, such as the log, keep working.
+func landlock(readPaths, writePaths []string) error {
+	handled := landlockAccessFor()
+	if handled == 0 {
+		return errors.New("not enabled in this kernel (5.13+ with lsm=landlock)")
+	}
+	attr := landlockRulesetAttr{handledAccessFS: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer unix.Close(int(fd))
+
+	add := func(path string, access uint64) error {
+		f, err := os.OpenFile(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && !info.IsDir() {
+			access &= landlockFileAccess
+		}
+		rule := landlockPathBeneathAttr{allowedAccess: access & handled, parentFd: int32(f.Fd())}
+		if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("%s: %v", path, errno)
+		}
+		return nil
+	}
+	for _, p := range readPaths {
+		if err := add(p, unix.LANDLOCK_ACCESS_FS_READ_FILE|unix.LANDLOCK_ACCESS_FS_READ_DIR); err != nil {
+			return err
+		}
+	}
+	for _, p := range writePaths {
+		if err := add(p, unix.LANDLOCK_ACCESS_FS_WRITE_FILE|unix.LANDLOCK_ACCESS_FS_READ_FILE); err != nil {
+			return err
+		}
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// seccompAllow installs a filter on all threads that fails every syscall but
+// the given ones with EPERM. Calls made under another ABI, such as x32 or
+// 32-bit calls on a 64-bit kernel, are refused.
+func seccompAllow(nrs []uintptr) error {
+	if seccompArch == 0 {
+		return fmt.Errorf("no filter for %s", runtime.GOARCH)
+	}
+	const (
+		ldW   = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge   = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		jset  = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+		ret   = unix.BPF_RET | unix.BPF_K
+		deny  = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+		allow = unix.SECCOMP_RET_ALLOW
+	)
+	prog := []unix.SockFilter{
+		{Code: ldW, K: 4}, // seccomp_data.arch
+		{Code: jeq, Jt: 1, K: seccompArch},
+		{Code: ret, K: deny},
+		{Code: ldW, K: 0}, // seccomp_data.nr
+	}
+	if seccompArch == unix.AUDIT_ARCH_X86_64 {
+		// x32 calls share the arch and set bit 30 of the number
+		prog = append(prog, unix.SockFilter{Code: jge, Jf: 1, K: 0x40000000}, unix.SockFilter{Code: ret, K: deny})
+	}
+	prog = append(prog,
+		unix.SockFilter{Code: jeq, Jf: 4, K: unix.SYS_CLONE},
+		unix.SockFilter{Code: ldW, K: seccompCloneFlags},
+		unix.SockFilter{Code: jset, Jf: 1, K: sandboxCloneNamespaces},
+		unix.SockFilter{Code: ret, K: deny},
+		unix.SockFilter{Code: ret, K: allow},
+	)
+	for _, nr := range nrs {
+		prog = append(prog, unix.SockFilter{Code: jeq, Jf: 1, K: uint32(nr)}, unix.SockFilter{Code: ret, K: allow})
+	}
+	prog = append(prog, unix.SockFilter{Code: ret, K: deny})
+
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&fprog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
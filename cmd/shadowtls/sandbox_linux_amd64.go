@@ -0,0 +1,17 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	seccompArch       = unix.AUDIT_ARCH_X86_64
+	seccompCloneFlags = 16 // Low word of the first argument
+)
+
+// sandboxArchSyscalls are allowed besides sandboxAllowedSyscalls
+var sandboxArchSyscalls = []uintptr{
+	// Calls the runtime still makes by their older names
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_GETDENTS, unix.SYS_DUP2, unix.SYS_PIPE,
+	unix.SYS_POLL, unix.SYS_ACCESS, unix.SYS_READLINK, unix.SYS_RENAME, unix.SYS_RENAMEAT,
+	unix.SYS_UNLINK, unix.SYS_MKDIR, unix.SYS_EPOLL_CREATE, unix.SYS_EPOLL_WAIT,
+	unix.SYS_NEWFSTATAT, unix.SYS_MMAP, unix.SYS_GETRLIMIT, unix.SYS_ACCEPT, unix.SYS_SELECT,
+}
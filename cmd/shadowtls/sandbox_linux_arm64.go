@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	seccompArch       = unix.AUDIT_ARCH_AARCH64
+	seccompCloneFlags = 16 // Low word of the first argument
+)
+
+// sandboxArchSyscalls are allowed besides sandboxAllowedSyscalls
+var sandboxArchSyscalls = []uintptr{
+	unix.SYS_NEWFSTATAT, unix.SYS_MMAP, unix.SYS_GETRLIMIT, unix.SYS_ACCEPT, unix.SYS_RENAMEAT,
+}
@@ -0,0 +1,22 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	seccompArch       = unix.AUDIT_ARCH_MIPSEL
+	seccompCloneFlags = 16 // Low word of the first argument
+)
+
+// sandboxArchSyscalls are allowed besides sandboxAllowedSyscalls
+var sandboxArchSyscalls = []uintptr{
+	// Calls the runtime still makes by their older names
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_GETDENTS, unix.SYS_DUP2, unix.SYS_PIPE,
+	unix.SYS_POLL, unix.SYS_ACCESS, unix.SYS_READLINK, unix.SYS_RENAME, unix.SYS_RENAMEAT,
+	unix.SYS_UNLINK, unix.SYS_MKDIR, unix.SYS_EPOLL_CREATE, unix.SYS_EPOLL_WAIT,
+	// 64-bit file offsets and times on a 32-bit kernel
+	unix.SYS_FSTATAT64, unix.SYS_STAT64, unix.SYS_FSTAT64, unix.SYS_LSTAT64, unix.SYS__LLSEEK,
+	unix.SYS_FCNTL64, unix.SYS_FTRUNCATE64, unix.SYS_STATFS64, unix.SYS_FSTATFS64, unix.SYS_MMAP2,
+	unix.SYS_FUTEX_TIME64, unix.SYS_CLOCK_NANOSLEEP_TIME64, unix.SYS_CLOCK_GETTIME64,
+	unix.SYS_CLOCK_GETRES_TIME64, unix.SYS_TIMER_SETTIME64, unix.SYS_PPOLL_TIME64, unix.SYS_PSELECT6_TIME64, unix.SYS_SENDFILE64,
+	unix.SYS_ACCEPT, unix.SYS_MMAP, unix.SYS_GETRLIMIT, unix.SYS_SIGRETURN, unix.SYS__NEWSELECT,
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The sandbox can't be undone, so it is entered in a child copy of the test
+// binary, which reports what still works through its exit code
+func TestSandbox(t *testing.T) {
+	if dir := os.Getenv("SHADOWTUN_SANDBOX_CHILD"); dir != "" {
+		sandboxChild(dir)
+		return
+	}
+	if landlockAccessFor() == 0 {
+		t.Skip("Landlock not enabled in this kernel")
+	}
+	allowed, denied := t.TempDir(), t.TempDir()
+	for _, dir := range []string{allowed, denied} {
+		if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$")
+	cmd.Env = append(os.Environ(), "SHADOWTUN_SANDBOX_CHILD="+allowed+string(filepath.ListSeparator)+denied)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 3 {
+		t.Skip("sandbox unavailable: ", string(out))
+	}
+	if err != nil {
+		t.Fatalf("child: %v\n%s", err, out)
+	}
+}
+
+func sandboxChild(dirs string) {
+	allowed, denied := filepath.SplitList(dirs)[0], filepath.SplitList(dirs)[1]
+	if err := enterSandbox([]string{allowed}, nil); err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(3)
+	}
+	if _, err := os.ReadFile(filepath.Join(allowed, "f")); err != nil {
+		os.Stderr.WriteString("allowed read failed: " + err.Error())
+		os.Exit(1)
+	}
+	if _, err := os.ReadFile(filepath.Join(denied, "f")); err == nil {
+		os.Stderr.WriteString("read outside the sandbox succeeded")
+		os.Exit(1)
+	}
+	if err := syscall.Exec("/bin/true", []string{"true"}, nil); !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EACCES) {
+		os.Stderr.WriteString("exec not denied: " + err.Error())
+		os.Exit(1)
+	}
+	// Calls off the allowlist fail, including under the x32 ABI and clones
+	// into new namespaces
+	if _, _, errno := syscall.RawSyscall(unix.SYS_UMASK, 0o22, 0, 0); errno != syscall.EPERM {
+		os.Stderr.WriteString("umask not denied: " + errno.Error())
+		os.Exit(1)
+	}
+	if runtime.GOARCH == "amd64" {
+		if _, _, errno := syscall.RawSyscall(0x40000000|unix.SYS_GETPID, 0, 0, 0); errno != syscall.EPERM {
+			os.Stderr.WriteString("x32 call not denied: " + errno.Error())
+			os.Exit(1)
+		}
+	}
+	if err := unix.Unshare(unix.CLONE_NEWUSER); !errors.Is(err, syscall.EPERM) {
+		os.Stderr.WriteString("unshare not denied")
+		os.Exit(1)
+	}
+
+	// The relay still works: threads, the GC and loopback TCP
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Stderr.WriteString("listen: " + err.Error())
+		os.Exit(1)
+	}
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	c, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		os.Stderr.WriteString("dial: " + err.Error())
+		os.Exit(1)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		os.Stderr.WriteString("write: " + err.Error())
+		os.Exit(1)
+	}
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		os.Stderr.WriteString("echo failed")
+		os.Exit(1)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			runtime.LockOSThread() // Forces new threads
+			_ = make([]byte, 1<<20)
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond)
+		})
+	}
+	wg.Wait()
+	os.Exit(0)
+}
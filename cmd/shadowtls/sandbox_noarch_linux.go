@@ -0,0 +1,11 @@
+//go:build !(386 || amd64 || arm || arm64 || mips || mipsle || ppc64le || riscv64 || s390x)
+
+package main
+
+// No seccomp filter is written for this architecture; --sandbox fails
+const (
+	seccompArch       = 0
+	seccompCloneFlags = 0
+)
+
+var sandboxArchSyscalls []uintptr
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// sandboxSupported reports whether --sandbox works here
+const sandboxSupported = false
+
+func enterSandbox(readPaths, writePaths []string) error {
+	return errors.New("only supported on Linux")
+}
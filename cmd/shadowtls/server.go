@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	shadowtls "github.com/metacubex/sing-shadowtls"
 	M "github.com/metacubex/sing/common/metadata"
@@ -19,44 +27,162 @@ import (
 	"github.com/iprw/shadowtun/pkg/socks5"
 )
 
+// errRelayIdle ends a relay that saw no traffic for the idle timeout
+var errRelayIdle = errors.New("relay idle timeout")
+
 type forwardHandler struct {
-	forward string
-	logger  *logrus.Logger
+	forward  string
+	upstream *stls.Client // Next ShadowTLS hop instead of a plain backend, nil for none
+	idle     time.Duration
+	logger   *logrus.Logger
+	repeat   *RepeatLogger
+
+	// Plain backend failover: a secondary address tried when forward
+	// fails, and extra rounds over both with doubling backoff
+	fallback string
+	retries  int
+	backoff  time.Duration
+	stats    backendStats
+	pool     *ConnPool     // Ready connections to forward, nil for none
+	dials    *DialTimeouts // Applies --dial-timeout, nil for no limit
+}
+
+// backendStats counts plain backend dials for the shutdown summary
+type backendStats struct {
+	connected atomic.Uint64 // Tunnels that reached a backend
+	retried   atomic.Uint64 // ...of which only after a failed round
+	failover  atomic.Uint64 // ...of which through the fallback
+	failed    atomic.Uint64 // Tunnels dropped with every attempt failed
+	errors    atomic.Uint64 // Individual failed dials
+}
+
+// dialBackend connects to forward, then fallback, for 1+retries rounds,
+// sleeping backoff (doubling each round) in between. ctx ends the wait.
+func (h *forwardHandler) dialBackend(ctx context.Context) (net.Conn, string, error) {
+	addrs := []string{h.forward}
+	if h.fallback != "" {
+		addrs = append(addrs, h.fallback)
+	}
+	var err error
+	wait := h.backoff
+	for round := 0; ; round++ {
+		for i, addr := range addrs {
+			var backend net.Conn
+			if backend, err = h.dials.Dial(ctx, "tcp", addr); err == nil {
+				h.stats.connected.Add(1)
+				if round > 0 {
+					h.stats.retried.Add(1)
+				}
+				if i > 0 {
+					h.stats.failover.Add(1)
+					h.repeat.WarnfContext(ctx, "Backend %s unreachable, using fallback %s", h.forward, addr)
+				}
+				return backend, addr, nil
+			}
+			h.stats.errors.Add(1)
+			h.repeat.WarnfContext(ctx, "Failed to connect to backend %s: %v", addr, err)
+		}
+		if round >= h.retries {
+			break
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			h.stats.failed.Add(1)
+			return nil, "", ctx.Err()
+		}
+		wait *= 2
+	}
+	h.stats.failed.Add(1)
+	return nil, "", err
 }
 
 func (h *forwardHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	h.logger.Debugf("New authenticated connection from %s", conn.RemoteAddr())
+	log := connLogger(ctx, h.logger)
+	log.Debugf("New authenticated connection from %s", conn.RemoteAddr())
 
-	backend, err := net.Dial("tcp", h.forward)
-	if err != nil {
-		h.logger.Warnf("Failed to connect to backend %s: %v", h.forward, err)
-		return err
+	var first []byte
+	var backend net.Conn
+	var err error
+	if h.upstream != nil {
+		// Read before dialing: the next hop only sees the tunnel once data arrives
+		if first, err = readFirstFrame(conn); err != nil {
+			return fmt.Errorf("read first frame: %v", err)
+		}
+		backend, err = h.upstream.Dial(ctx)
+		if err != nil {
+			kind := ClassifyConnectError(err)
+			h.repeat.WarnfContext(ctx, "Failed to connect to upstream %s: "+kind.Describe()+": %v", h.forward, err)
+			return err
+		}
+	} else {
+		// A passive client opens with a wake marker instead of real data
+		if first, err = stripPassiveWake(conn); err != nil {
+			return fmt.Errorf("read first frame: %v", err)
+		}
+		if h.pool != nil {
+			if pooled, ok := h.pooledBackend(); ok {
+				h.stats.connected.Add(1)
+				backend = pooled
+			}
+		}
+		if backend == nil {
+			var addr string
+			if backend, addr, err = h.dialBackend(ctx); err != nil {
+				return err
+			}
+			log.Debugf("Connected to backend %s", addr)
+		}
 	}
-	defer backend.Close()
+	// Each direction may close a side to unblock the other; the cleanup here
+	// closes whatever is left, so every close reaches the socket once
+	backendConn, tunnel := relaypkg.CloseOnce(backend), relaypkg.CloseOnce(conn)
+	defer func() {
+		backendConn.Close()
+		if err := backendConn.CloseError(); err != nil {
+			log.Debugf("Closing backend connection: %v", err)
+		}
+	}()
 
-	h.logger.Debugf("Connected to backend %s", h.forward)
+	if len(first) > 0 {
+		backend.SetWriteDeadline(time.Now().Add(relaypkg.DefaultWriteTimeout))
+		_, err = backend.Write(first)
+		backend.SetWriteDeadline(time.Time{})
+		if err != nil {
+			return fmt.Errorf("write first frame to backend: %v", err)
+		}
+	}
 
 	var wg sync.WaitGroup
+	var idled atomic.Bool
 	wg.Add(2)
 
-	go func() {
+	copyDir := func(dst, src *relaypkg.OnceConn, dir string) {
 		defer wg.Done()
-		relaypkg.CopyConn(backend, conn, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
-		if tc, ok := backend.(*net.TCPConn); ok {
-			tc.CloseWrite()
+		defer crashGuard()
+		_, err := relaypkg.CopyConn(dst, src, relayBufferSize, h.idle, relaypkg.DefaultWriteTimeout, nil)
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded) && !src.ReadsExpired():
+			idled.Store(true)
+		case errors.Is(err, os.ErrDeadlineExceeded):
+		case err != nil && !errors.Is(err, io.EOF) && !src.Expected(err) && !dst.Expected(err):
+			log.Debugf("Relay %s for %s failed: %v", dir, conn.RemoteAddr(), err)
 		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		relaypkg.CopyConn(conn, backend, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
-		if tc, ok := conn.(*net.TCPConn); ok {
-			tc.CloseWrite()
+		if dst.CloseWrite() != nil && h.upstream != nil {
+			// Neither tunnel can pass the half-close on, so the other
+			// direction would wait for data that never comes; give it a
+			// moment for replies in flight instead of cutting them off
+			dst.ExpireReads(time.Now().Add(relaypkg.DefaultHalfCloseGrace))
 		}
-	}()
+	}
+	go copyDir(backendConn, tunnel, "client → backend")
+	go copyDir(tunnel, backendConn, "backend → client")
 
 	wg.Wait()
-	h.logger.Debugf("Connection from %s closed", conn.RemoteAddr())
+	log.Debugf("Connection from %s closed", conn.RemoteAddr())
+	if idled.Load() {
+		return errRelayIdle
+	}
 	return nil
 }
 
@@ -70,10 +196,11 @@ type socks5Handler struct {
 }
 
 func (h *socks5Handler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	h.logger.Debugf("New SOCKS5 connection from %s", conn.RemoteAddr())
+	log := connLogger(ctx, h.logger)
+	log.Debugf("New SOCKS5 connection from %s", conn.RemoteAddr())
 	err := h.handler.Handle(ctx, conn)
 	if err != nil {
-		h.logger.Warnf("SOCKS5 error from %s: %v", conn.RemoteAddr(), err)
+		log.Warnf("SOCKS5 error from %s: %v", conn.RemoteAddr(), err)
 	}
 	return err
 }
@@ -82,21 +209,220 @@ func (h *socks5Handler) NewError(ctx context.Context, err error) {
 	h.logger.Warnf("SOCKS5 handler error: %v", err)
 }
 
+// defaultSessionTimeout bounds how long a connection may wait for its first
+// authenticated frame, well above the client's default pool TTL
+const defaultSessionTimeout = 2 * time.Minute
+
+// Connection phases, for telling apart where a connection timed out
+const (
+	phaseHandshake int32 = iota // Accepted, TLS handshake in progress
+	phaseDecoy                  // ClientHello without the password, relayed to the handshake server
+	phaseWaiting                // Handshake done, no authenticated frame yet
+	phaseRelay                  // Authenticated, handed to the handler
+)
+
+// closeStats counts how server connections ended, for the shutdown summary
+type closeStats struct {
+	unauthenticated atomic.Uint64 // Never authenticated: probes, visitors of the handshake server
+	sessionTimeout  atomic.Uint64 // Stalled in the handshake past SessionTimeout
+	firstFrame      atomic.Uint64 // Finished the handshake, then sent no authenticated frame in time
+	idle            atomic.Uint64 // Relay closed after IdleTimeout without traffic
+	closed          atomic.Uint64 // Relay ended by either side
+}
+
+// formatTimeout renders a timeout where 0 means none
+func formatTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "never"
+	}
+	return d.String()
+}
+
+// UpstreamConfig is the outbound ShadowTLS hop of a bridge: connections
+// accepted by the server are carried through a fresh tunnel to this server
+type UpstreamConfig struct {
+	Server   string
+	SNI      string
+	Password string
+	Timeout  time.Duration
+}
+
+// parseReplyAddr parses --socks5-reply-addr: an IPv4 or IPv6 address with an
+// optional port, 0 or missing to keep the real bound port. An IPv6 address
+// with a port is written in brackets, [2001:db8::1]:443.
+func parseReplyAddr(s string) (*net.TCPAddr, error) {
+	host, port := s, "0"
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || addr.Zone() != "" {
+		return nil, fmt.Errorf("--socks5-reply-addr: %q is not an IP address", host)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return nil, fmt.Errorf("--socks5-reply-addr: invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: addr.Unmap().AsSlice(), Port: n}, nil
+}
+
+// parseSocksAuth parses --socks5-auth into its backend, behind a cache of
+// answers unless cache is 0
+func parseSocksAuth(spec string, cache time.Duration) (socks5.Authenticator, error) {
+	var auth socks5.Authenticator
+	switch kind, arg, _ := strings.Cut(spec, ":"); kind {
+	case "htpasswd":
+		htpasswd, err := socks5.LoadHtpasswd(arg)
+		if err != nil {
+			return nil, fmt.Errorf("--socks5-auth: %w", err)
+		}
+		auth = htpasswd
+	case "exec":
+		command, err := socks5.NewExecAuth(strings.Fields(arg))
+		if err != nil {
+			return nil, fmt.Errorf("--socks5-auth: %w", err)
+		}
+		auth = command
+	case "pam":
+		if arg == "" {
+			arg = "login"
+		}
+		pam, err := newPAMAuth(arg)
+		if err != nil {
+			return nil, fmt.Errorf("--socks5-auth: %w", err)
+		}
+		auth = pam
+	case "http", "https":
+		if u, err := url.Parse(spec); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("--socks5-auth %q: not a valid URL", spec)
+		}
+		auth = socks5.NewHTTPAuth(spec)
+	default:
+		return nil, fmt.Errorf("--socks5-auth %q: want htpasswd:<file>, exec:<command>, pam[:<service>] or an http(s):// URL", spec)
+	}
+	if cache > 0 {
+		auth = socks5.NewCachedAuth(auth, cache)
+	}
+	return auth, nil
+}
+
+// isPAMAuth reports whether --socks5-auth selects PAM
+func isPAMAuth(spec string) bool {
+	return spec == "pam" || strings.HasPrefix(spec, "pam:")
+}
+
 // ServerConfig holds configuration for the ShadowTLS server
 type ServerConfig struct {
-	ListenAddr  string
-	ForwardAddr string
-	Handshake   string
-	Password    string
-	WildcardSNI bool
-	Socks5Mode  bool
-	Logger      *logrus.Logger
+	ListenAddr   string
+	ForwardAddr  string
+	Handshake    string
+	Password     string
+	WildcardSNI  bool
+	Socks5Mode   bool
+	Socks5Reply  *net.TCPAddr // Public address for SOCKS5 replies behind NAT (port 0 keeps the real one), nil for none
+	Socks5UDP    bool         // Accept UDP ASSOCIATE with the datagrams carried through the tunnel
+	ReloadPolicy ReloadPolicy // What happens to open connections when the password changes
+	StartupJSON  string       // Write the JSON started event here ("-" for stdout), empty to disable
+	MemLimit     int64        // Soft memory cap in bytes for load shedding, 0 to disable
+	CPULimit     int          // Process CPU percent of usable cores above which handshakes are shed, 0 to disable
+	// Raise tunnel socket buffers to the path's bandwidth-delay product, up
+	// to SocketBufferMax bytes (0 = OS defaults)
+	SocketBufferMax int
+	// TCP congestion control for tunnel sockets (Linux), empty for the system default
+	Congestion string
+	// Privilege drop and sandbox entered once the listener is bound, nil for none
+	Confine *Confinement
+	// Let open connections run this long after SIGINT/SIGTERM before closing
+	// them (0 = close them at once)
+	DrainTimeout time.Duration
+	// Hex-dump the first TraceBytes of each direction of one in TraceSample
+	// decrypted tunnels (0 = off)
+	TraceBytes  int
+	TraceSample int
+	// If ForwardAddr refuses a connection, try ForwardFallback (empty for
+	// none), then retry both ForwardRetries more times, waiting
+	// ForwardBackoff before the first retry and twice as long each time after
+	ForwardFallback string
+	ForwardRetries  int
+	ForwardBackoff  time.Duration
+	// Keep ForwardPool connections to ForwardAddr open ahead of tunnels
+	// (0 = none), each for at most ForwardPoolTTL
+	ForwardPool    int
+	ForwardPoolTTL time.Duration
+	// Chain to a second ShadowTLS server instead of ForwardAddr, nil for none
+	Upstream *UpstreamConfig
+	// Pair client tunnels that expose and dial a name (--expose/--peer)
+	Rendezvous bool
+	// Check SOCKS5 usernames and passwords with this backend, nil for no
+	// authentication
+	Socks5Auth socks5.Authenticator
+	// Retry SOCKS5 target dials that were refused or hit a transient DNS
+	// failure up to Socks5Retries times, waiting Socks5Backoff before the
+	// first retry and twice as long each time after
+	Socks5Retries int
+	Socks5Backoff time.Duration
+	// Accept tunnels carrying many connections as mux streams (--mux)
+	Mux bool
+	// Dial timeouts for SOCKS5 and forward targets, first match wins; targets
+	// no rule matches wait as long as the OS lets them
+	DialTimeouts []DialTimeoutRule
+	// Concurrent ShadowTLS handshakes (0 = unlimited), how many more may wait
+	// and how many of those one source may hold (0 = no per-source bound)
+	HandshakeWorkers   int
+	HandshakeQueue     int
+	HandshakePerSource int
+	// Clients whose ClientHello carries the password and that haven't sent
+	// their first frame within SessionTimeout of it are dropped (0 = never);
+	// this is how long an idle pooled client tunnel survives. Visitors are
+	// left to the handshake server's timeouts. Relays idle for IdleTimeout are closed,
+	// SOCKS5 clients that don't send a request within Socks5Timeout too (0 = never).
+	SessionTimeout time.Duration
+	IdleTimeout    time.Duration
+	Socks5Timeout  time.Duration
+	Logger         *logrus.Logger
+	// Once the client finishes its TLS handshake, the first authenticated
+	// frame must arrive within FirstFrameTimeout (0 = SessionTimeout still applies)
+	FirstFrameTimeout time.Duration
+	// Warn about clients whose pings report a version older than this, empty for none
+	MinClientVersion string
+	// JSON admin endpoint (drain control), nil to disable
+	Admin *AdminConfig
+
+	// Reload, if set, re-reads the configuration on SIGHUP
+	Reload func() (*ServerConfig, error)
 }
 
 // Server represents a ShadowTLS server instance
 type Server struct {
 	config *ServerConfig
 	log    *logrus.Logger
+	repeat *RepeatLogger
+
+	handler shadowtls.Handler
+	socks   *socks5.Handler
+	forward *forwardHandler // Plain --forward relay, nil otherwise
+	pings   *pingHandler
+	mux     *muxHandler // nil without --mux
+	dials   *DialTimeouts
+	retry   *dialRetry      // SOCKS5 target dial retries, nil without --socks5-dial-retries
+	clients *ClientVersions // Versions reported in client pings
+	service atomic.Pointer[shadowtls.Service]
+	secret  atomic.Pointer[string] // Password of the current service
+	conns   *generationTracker
+	connIDs atomic.Uint64      // Last ID given to an accepted connection
+	waiting *generationTracker // Connections not relaying yet: handshaking or pooled by a client
+	drain   *Drainer           // nil without --admin
+	mem     *MemBudget
+	cpu     *CPUGuard // nil when --cpu-limit is off
+	sockbuf *SocketBuffers
+	panics  atomic.Uint64 // Recovered panics in connection handlers
+	closes  closeStats
+
+	handshakes *HandshakeLimiter
+	signals    chan os.Signal
+	ready      chan struct{}
 }
 
 // NewServer creates a new server instance
@@ -106,8 +432,31 @@ func NewServer(config *ServerConfig) *Server {
 		logger = Log // Fallback to global logger
 	}
 	return &Server{
-		config: config,
-		log:    logger,
+		config:  config,
+		log:     logger,
+		repeat:  NewRepeatLogger(logger),
+		conns:   newGenerationTracker(),
+		waiting: newGenerationTracker(),
+		mem:     NewMemBudget(config.MemLimit),
+		cpu:     NewCPUGuard(config.CPULimit),
+		sockbuf: NewSocketBuffers(config.SocketBufferMax, logger),
+
+		handshakes: NewHandshakeLimiter(config.HandshakeWorkers, config.HandshakeQueue, config.HandshakePerSource),
+		signals:    make(chan os.Signal, 1),
+		ready:      make(chan struct{}),
+	}
+}
+
+// Ready is closed once the server listens for tunnel connections
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Stop shuts the server down as SIGTERM would, making Run return
+func (s *Server) Stop() {
+	select {
+	case s.signals <- syscall.SIGTERM:
+	default:
 	}
 }
 
@@ -116,6 +465,8 @@ func (s *Server) Run() error {
 	s.log.Infof("Starting ShadowTLS v3 server on %s", s.config.ListenAddr)
 	if s.config.Socks5Mode {
 		s.log.Infof("Mode: SOCKS5 proxy")
+	} else if up := s.config.Upstream; up != nil {
+		s.log.Infof("Bridging to ShadowTLS server: %s (SNI %s)", up.Server, up.SNI)
 	} else {
 		s.log.Infof("Forwarding to: %s", s.config.ForwardAddr)
 	}
@@ -124,96 +475,574 @@ func (s *Server) Run() error {
 	} else if s.config.Handshake != "" {
 		s.log.Infof("Handshake server: %s", s.config.Handshake)
 	}
+	if s.config.IdleTimeout <= 0 {
+		s.config.IdleTimeout = relaypkg.DefaultIdleTimeout
+	}
+	s.log.Infof("Session timeout: %s (keep client --ttl below it), relay idle timeout: %v", formatTimeout(s.config.SessionTimeout), s.config.IdleTimeout)
+	if s.config.FirstFrameTimeout > 0 {
+		s.log.Infof("First frame timeout: %v after the handshake", s.config.FirstFrameTimeout)
+	}
 
-	var handler shadowtls.Handler
+	if err := s.config.ReloadPolicy.Validate(); err != nil {
+		return withExitCode(ExitConfig, err)
+	}
+
+	s.dials = NewDialTimeouts(s.config.DialTimeouts)
+	if len(s.config.DialTimeouts) > 0 {
+		s.log.Infof("Dial timeouts: %s", formatDialTimeouts(s.config.DialTimeouts))
+	}
 	if s.config.Socks5Mode {
-		handler = &socks5Handler{
-			handler: socks5.NewHandler("", "", s.log),
-			logger:  s.log,
+		socksLog := ModuleLogger("socks5")
+		socksHandler := socks5.NewHandler("", "", socksLog)
+		socksHandler.SetIdleTimeout(s.config.IdleTimeout)
+		socksHandler.SetBufferSize(relayBufferSize)
+		socksHandler.SetNegotiationTimeout(s.config.Socks5Timeout)
+		socksHandler.SetDialer(s.dials.Dial)
+		if s.config.Socks5Retries > 0 {
+			s.retry = &dialRetry{dial: s.dials.Dial, retries: s.config.Socks5Retries, backoff: s.config.Socks5Backoff, logger: socksLog}
+			socksHandler.SetDialer(s.retry.Dial)
+			s.log.Infof("SOCKS5 target dials: up to %d retries on refused connections and DNS failures, backoff %v", s.config.Socks5Retries, s.config.Socks5Backoff)
 		}
+		socksHandler.SetAccounting(func(r socks5.ConnectRecord) {
+			target := r.Target
+			if r.Domain != "" {
+				target += " (" + r.Resolved + ")"
+			}
+			socksLog.Infof("SOCKS5 closed %s: %s out, %s in, %v", target,
+				formatBytes(uint64(r.BytesUp), true), formatBytes(uint64(r.BytesDown), true),
+				r.Duration.Round(time.Millisecond))
+		})
+		if r := s.config.Socks5Reply; r != nil {
+			socksHandler.SetReplyAddr(r.IP, r.Port)
+			if r.Port != 0 {
+				s.log.Infof("SOCKS5 replies report bound address %s", r)
+			} else {
+				s.log.Infof("SOCKS5 replies report bound address %s with the real port", r.IP)
+			}
+		}
+		if s.config.Socks5Auth != nil {
+			socksHandler.SetAuthenticator(s.config.Socks5Auth)
+			s.log.Infof("SOCKS5 auth: %v", s.config.Socks5Auth)
+		}
+		if s.config.Socks5UDP {
+			socksHandler.EnableUDP()
+			s.log.Infof("SOCKS5 UDP ASSOCIATE enabled for clients run with --socks5-udp")
+		}
+		s.handler = &socks5Handler{
+			handler: socksHandler,
+			logger:  socksLog,
+		}
+		s.socks = socksHandler
 	} else {
-		handler = &forwardHandler{
+		relayLog := ModuleLogger("relay")
+		handler := &forwardHandler{
 			forward: s.config.ForwardAddr,
-			logger:  s.log,
+			idle:    s.config.IdleTimeout,
+			logger:  relayLog,
+			repeat:  NewRepeatLogger(relayLog),
+
+			fallback: s.config.ForwardFallback,
+			retries:  s.config.ForwardRetries,
+			backoff:  s.config.ForwardBackoff,
+			dials:    s.dials,
+		}
+		if up := s.config.Upstream; up != nil {
+			if err := CheckSelfDial(s.config.ListenAddr, up.Server); err != nil {
+				return withExitCode(ExitConfig, fmt.Errorf("routing loop: --upstream %s is this server's own listener", up.Server))
+			}
+			client, err := stls.NewClient(up.Server, up.SNI, up.Password, up.Timeout, ModuleLogger("shadowtls"))
+			if err != nil {
+				return withExitCode(ExitConfig, fmt.Errorf("failed to create upstream client: %v", err))
+			}
+			handler.forward = up.Server
+			handler.upstream = client
+		}
+		s.handler = handler
+		if s.config.ForwardAddr == "" && s.config.Upstream == nil {
+			s.handler = nil // Rendezvous only
+		} else if s.config.Upstream == nil {
+			s.forward = handler
+			if handler.fallback != "" {
+				s.log.Infof("Backend fallback: %s", handler.fallback)
+			}
+			if handler.retries > 0 {
+				s.log.Infof("Backend retries: %d, backoff from %v", handler.retries, handler.backoff)
+			}
+			if n := s.config.ForwardPool; n > 0 {
+				handler.pool = newBackendPool(s.config.ForwardAddr, n, s.config.ForwardPoolTTL, s.dials)
+				handler.pool.Start()
+				defer handler.pool.Stop()
+				s.log.Infof("Backend pool: %d connections, TTL %v", n, s.config.ForwardPoolTTL)
+			}
 		}
 	}
-
-	config := shadowtls.ServiceConfig{
-		Version: 3,
-		Users: []shadowtls.User{
-			{Name: "default", Password: s.config.Password},
-		},
-		StrictMode: false,
-		Handler:    handler,
-		Logger:     &stls.Logger{L: s.log},
+	if s.config.Rendezvous {
+		rvLog := ModuleLogger("rendezvous")
+		s.handler = &rendezvousHandler{next: s.handler, hub: NewRendezvousHub(rvLog), logger: rvLog}
+		s.log.Infof("Rendezvous enabled: clients may expose and dial names")
 	}
-
-	if s.config.Handshake != "" {
-		handshakeHost, handshakePort := stls.ParseHostPort(s.config.Handshake)
-		config.Handshake = shadowtls.HandshakeConfig{
-			Server: stls.MakeSocksaddr(handshakeHost, handshakePort),
-			Dialer: N.SystemDialer,
-		}
-	} else {
-		config.Handshake = shadowtls.HandshakeConfig{
-			Dialer: N.SystemDialer,
+	next := s.handler
+	if s.config.TraceBytes > 0 {
+		relayLog := ModuleLogger("relay")
+		next = &traceHandler{next: next, tracer: NewByteTracer(s.config.TraceBytes, s.config.TraceSample, relayLog)}
+		s.log.Infof("Tracing the first %d bytes of one in %d connections", s.config.TraceBytes, max(s.config.TraceSample, 1))
+		if !relayLog.IsLevelEnabled(logrus.TraceLevel) {
+			s.log.Warnf("--trace-bytes dumps at trace level; enable it with -vvv or --log-levels relay=trace")
 		}
 	}
-
-	if s.config.WildcardSNI {
-		config.WildcardSNI = shadowtls.WildcardSNIAuthed
+	if s.config.Mux {
+		s.mux = &muxHandler{next: next, logger: ModuleLogger("server"), ids: &s.connIDs, panics: &s.panics}
+		next = s.mux
+		s.log.Infof("Mux enabled: a tunnel may carry many connections")
+	}
+	// Pings are answered ahead of everything else, rendezvous included
+	s.clients = NewClientVersions(s.config.MinClientVersion, ModuleLogger("server"))
+	s.pings = &pingHandler{next: next, idle: s.config.IdleTimeout, logger: ModuleLogger("server"), versions: s.clients}
+	if s.config.MinClientVersion != "" {
+		s.log.Infof("Minimum client version: %s", s.config.MinClientVersion)
 	}
 
-	service, err := shadowtls.NewService(config)
+	service, err := s.newService(s.config.Password)
 	if err != nil {
-		return fmt.Errorf("failed to create ShadowTLS service: %v", err)
+		return withExitCode(ExitConfig, err)
 	}
+	s.service.Store(service)
+	password := s.config.Password
+	s.secret.Store(&password)
 
 	listener, err := net.Listen("tcp", s.config.ListenAddr)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %v", s.config.ListenAddr, err)
+		return withExitCode(ExitBind, fmt.Errorf("failed to listen on %s: %v", s.config.ListenAddr, err))
 	}
 	defer listener.Close()
+	close(s.ready)
+	setCrashState(func() string {
+		return fmt.Sprintf("Active connections: %d\n%s", s.conns.Len(), strings.Join(s.summary(), "\n"))
+	})
 
 	s.log.Infof("Server listening on %s", s.config.ListenAddr)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
+	var wg sync.WaitGroup // Connection handlers
+	var bg sync.WaitGroup // Goroutines that run until ctx is cancelled
+
+	// Closed by SIGINT/SIGTERM: the accept loop ends and the shutdown
+	// sequence after it takes over
+	quit := make(chan struct{})
+	// Closed by a second SIGINT/SIGTERM, which ends a --drain-timeout early
+	hurry := make(chan struct{})
+
+	if s.config.MemLimit > 0 {
+		s.log.Infof("Memory limit: %s", formatBytes(uint64(s.config.MemLimit), true))
+	}
+	bg.Go(func() { s.mem.Run(ctx) })
+	if s.cpu != nil {
+		s.log.Infof("CPU limit: %d%% of %d cores, new handshakes are shed above it", s.config.CPULimit, s.cpu.procs)
+		bg.Go(func() { s.cpu.Run(ctx) })
+	} else if s.config.CPULimit > 0 {
+		s.log.Warnf("--cpu-limit is not supported on this platform, ignoring it")
+	}
+	if s.config.Congestion != "" {
+		s.log.Infof("TCP congestion control: %s", s.config.Congestion)
+	}
+	if s.sockbuf != nil {
+		s.log.Infof("Socket buffers: sized to the path RTT, up to %s", formatBytes(uint64(s.config.SocketBufferMax), true))
+	}
+	if s.config.HandshakeWorkers > 0 {
+		s.log.Infof("Handshake limit: %d concurrent, %d queued, %d per source", s.config.HandshakeWorkers, s.config.HandshakeQueue, s.config.HandshakePerSource)
+	}
+
+	sigChan := s.signals
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	bg.Go(func() {
+		for {
+			select {
+			case sig := <-sigChan:
+				if sig == syscall.SIGHUP {
+					s.reload()
+					continue
+				}
+				select {
+				case <-quit:
+					close(hurry)
+					return
+				default:
+				}
+				s.log.Info("Shutting down...")
+				close(quit)
+				listener.Close()
+				if s.config.DrainTimeout == 0 {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		s.log.Info("Shutting down...")
+	var admin *AdminServer
+	if s.config.Admin != nil {
+		admin, err = NewAdminServer(s.config.Admin, s.log)
+		if err != nil {
+			cancel()
+			return withExitCode(ExitConfig, err)
+		}
+		admin.HandleJSON("/features", func() any {
+			return CurrentFeatures()
+		})
+		s.drain = NewDrainer(s.conns.Len, s.log)
+		// Tunnels a client holds in its pool would otherwise carry new
+		// connections; closing them sends the client elsewhere
+		s.drain.onStart = func() {
+			if n := s.waiting.CloseAll(); n > 0 {
+				s.log.Infof("[DRAIN] Closed %d tunnel(s) not relaying yet", n)
+			}
+		}
+		admin.Handle("/drain", s.drain)
+		if err := admin.Start(); err != nil {
+			cancel()
+			return withExitCode(ExitBind, err)
+		}
+		defer admin.Close()
+		s.log.Infof("Admin: %s", admin.URL())
+	}
+
+	if s.config.StartupJSON != "" {
+		ev := newStartupEvent("server", listener.Addr().String())
+		ev.Socks5 = s.config.Socks5Mode
+		if up := s.config.Upstream; up != nil {
+			ev.Upstream = up.Server
+		} else if !s.config.Socks5Mode {
+			ev.Forward = s.config.ForwardAddr
+		}
+		ev.Handshake = s.config.Handshake
+		ev.WildcardSNI = s.config.WildcardSNI
+		ev.SessionTimeout = formatTimeout(s.config.SessionTimeout)
+		ev.IdleTimeout = s.config.IdleTimeout.String()
+		if s.config.FirstFrameTimeout > 0 {
+			ev.FirstFrameTimeout = s.config.FirstFrameTimeout.String()
+		}
+		if err := WriteStartupEvent(s.config.StartupJSON, ev); err != nil {
+			s.log.Warnf("%v", err)
+		}
+	}
+
+	// Everything that needs root or arbitrary files is done by now
+	if err := s.config.Confine.Apply(s.log); err != nil {
 		cancel()
-		listener.Close()
-	}()
+		return withExitCode(ExitConfig, err)
+	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
-			case <-ctx.Done():
+			case <-quit:
 			default:
-				s.log.Warnf("Accept error: %v", err)
+				s.repeat.Warnf("Accept error: %v", err)
 				continue
 			}
 			break
 		}
+		if s.drain.Refuse(conn) {
+			continue
+		}
+		// Every log line about the connection carries its ID
+		connCtx := withConnID(ctx, s.connIDs.Add(1))
+
+		// Cheapest check first: under CPU pressure a new connection goes
+		// to the handshake server before it costs a handshake of ours
+		if !s.cpu.Allow() {
+			cpu := s.cpu.Snapshot()
+			s.repeat.WarnfContext(connCtx, "[SHED] Rejected connection from %s: CPU over limit (%.0f%%, limit %.0f%%)", conn.RemoteAddr(), 100*cpu.Usage, 100*cpu.Limit)
+			s.goShed(connCtx, &wg, conn)
+			continue
+		}
+		if !s.mem.Acquire(memPerConn) {
+			mem := s.mem.Snapshot()
+			s.repeat.WarnfContext(connCtx, "[SHED] Rejected connection from %s: memory over limit (estimate %s, heap %s, limit %s)", conn.RemoteAddr(),
+				formatBytes(uint64(mem.Estimate), true), formatBytes(uint64(mem.Heap), true), formatBytes(uint64(mem.Limit), true))
+			s.goShed(connCtx, &wg, conn)
+			continue
+		}
 
 		wg.Add(1)
 		go func(c net.Conn) {
 			defer wg.Done()
-			defer c.Close()
-			err := service.NewConnection(ctx, c, M.Metadata{})
+			defer s.mem.Release(memPerConn)
+			// A drain, a reload and the cleanup here may all close c; the
+			// socket is closed by whichever comes first
+			closeConn := sync.OnceValue(c.Close)
+			defer closeConn()
+			defer recoverPanic(&s.panics, s.log, "connection handler")
+			untrack := s.conns.Track(func() { closeConn() })
+			defer untrack()
+			unwait := s.waiting.Track(func() { closeConn() })
+			defer unwait()
+			s.sockbuf.Tune(c)
+			if err := setCongestion(c, s.config.Congestion); err != nil {
+				s.repeat.Warnf("Failed to set congestion control %s: %v", s.config.Congestion, err)
+			}
+
+			// Bound the CPU-heavy handshake phase; the slot is released as
+			// soon as the connection authenticates
+			release, err := s.handshakes.Acquire(ctx, c.RemoteAddr())
 			if err != nil {
-				s.log.Warnf("Connection error from %s: %v", c.RemoteAddr(), err)
+				switch {
+				case errors.Is(err, errHandshakeQueueFull):
+					hs := s.handshakes.Snapshot()
+					s.repeat.WarnfContext(connCtx, "[SHED] Rejected connection from %s: %v (%d in progress, %d queued)", c.RemoteAddr(), err, hs.Active, hs.Queued)
+				case errors.Is(err, errHandshakeSourceBusy):
+					s.repeat.WarnfContext(connCtx, "[SHED] Rejected connection from %s: %v (--handshake-per-source %d)", c.RemoteAddr(), err, s.config.HandshakePerSource)
+				default:
+					return // Shutting down
+				}
+				s.shed(connCtx, c)
+				return
+			}
+			defer release()
+
+			var phase atomic.Int32
+			connCtx := context.WithValue(connCtx, handshakeDoneKey{}, func() {
+				unwait()
+				release()
+				c.SetDeadline(time.Time{})
+				phase.Store(phaseRelay)
+			})
+
+			// The deadline covers the rest of the handshake and the wait for
+			// the first authenticated frame, and is lifted once the relay
+			// starts. It only applies to clients with the password: anyone
+			// else is relayed to the handshake server and must meet its
+			// timeouts, not ours, or closing them would give the server away.
+			secret := *s.secret.Load()
+			hello := func(frame []byte) {
+				if !clientHelloAuthenticated(frame, secret) {
+					phase.Store(phaseDecoy)
+				} else if s.config.SessionTimeout > 0 {
+					c.SetDeadline(time.Now().Add(s.config.SessionTimeout))
+				}
+			}
+			// Free the slot as soon as the TLS handshake is over; a pooled
+			// tunnel may then sit idle for a long time before its first frame
+			tunnel := &handshakeWatchConn{Conn: c, hello: hello, done: func() {
+				release()
+				if phase.CompareAndSwap(phaseHandshake, phaseWaiting) && s.config.FirstFrameTimeout > 0 {
+					c.SetDeadline(time.Now().Add(s.config.FirstFrameTimeout))
+				}
+			}}
+
+			err = s.service.Load().NewConnection(connCtx, tunnel, M.Metadata{})
+			log := connLogger(connCtx, s.log)
+			timedOut := errors.Is(err, os.ErrDeadlineExceeded)
+			switch p := phase.Load(); {
+			case p == phaseHandshake && timedOut:
+				s.closes.sessionTimeout.Add(1)
+				log.Debugf("Session from %s timed out in the handshake (--session-timeout %v)", c.RemoteAddr(), s.config.SessionTimeout)
+				return
+			case p == phaseWaiting && timedOut:
+				s.closes.firstFrame.Add(1)
+				log.Debugf("Session from %s timed out before its first frame (%s)", c.RemoteAddr(), s.firstFrameLimit())
+				return
+			case p != phaseRelay:
+				s.closes.unauthenticated.Add(1)
+			case errors.Is(err, errRelayIdle):
+				s.closes.idle.Add(1)
+				log.Debugf("Relay from %s closed after %v idle", c.RemoteAddr(), s.config.IdleTimeout)
+				return
+			default:
+				s.closes.closed.Add(1)
+			}
+			if err != nil && ctx.Err() == nil {
+				s.repeat.WarnfContext(connCtx, "Connection error from %s: %v", c.RemoteAddr(), err)
 			}
 		}(conn)
 	}
 
+	seq := newShutdownSequence(s.log)
+	seq.Stage("stop accepting", 0, func() {
+		listener.Close()
+		if admin != nil {
+			admin.Close()
+		}
+	})
 	s.log.Info("Waiting for connections to close...")
-	wg.Wait()
-	s.log.Info("Shutdown complete")
+	var cut int
+	if s.config.DrainTimeout > 0 {
+		cut = seq.Drain(s.config.DrainTimeout, &wg, s.conns.Len, hurry)
+	}
+	seq.Stage("cancel relays", 0, cancel)
+	if !seq.Stage("connections", shutdownStageTimeout, wg.Wait) {
+		s.log.Warnf("[SHUTDOWN] Closing %d connection(s) still open", s.conns.CloseAll())
+		seq.Stage("connections", shutdownStageTimeout, wg.Wait)
+	}
+	if s.forward != nil && s.forward.pool != nil {
+		seq.Stage("backend pool", 0, s.forward.pool.Stop) // Bounds its own wait
+	}
+	seq.Stage("background", shutdownStageTimeout, bg.Wait)
+	seq.Stage("stats", 0, func() {
+		for _, line := range s.summary() {
+			s.log.Info(line)
+		}
+		if n := s.panics.Load(); n > 0 {
+			s.log.Warnf("Recovered %d panic(s) in connection handlers", n)
+		}
+		s.repeat.Flush()
+	})
+	if stuck := seq.Stuck(); len(stuck) > 0 {
+		s.log.Warnf("Shutdown complete in %v, gave up waiting on: %s", seq.Elapsed(), strings.Join(stuck, ", "))
+	} else {
+		s.log.Infof("Shutdown complete in %v", seq.Elapsed())
+	}
+	if cut > 0 {
+		return withExitCode(ExitDrain, fmt.Errorf("closed %d connection(s) still open after --drain-timeout %v", cut, s.config.DrainTimeout))
+	}
 	return nil
 }
+
+// firstFrameLimit names the timeout bounding the wait for a first frame
+func (s *Server) firstFrameLimit() string {
+	if s.config.FirstFrameTimeout > 0 {
+		return fmt.Sprintf("--first-frame-timeout %v", s.config.FirstFrameTimeout)
+	}
+	return fmt.Sprintf("--session-timeout %v", s.config.SessionTimeout)
+}
+
+// summary describes what the server did, one line per subsystem, for the
+// shutdown log and crash dumps
+func (s *Server) summary() []string {
+	var lines []string
+	if s.handshakes != nil {
+		hs := s.handshakes.Snapshot()
+		lines = append(lines, fmt.Sprintf("Handshakes: %d completed, %d rejected with the queue full, %d over --handshake-per-source, avg slot wait %v",
+			hs.Completed, hs.Rejected, hs.SourceRejected, hs.AvgWait.Round(time.Millisecond)))
+	}
+	if s.cpu != nil {
+		lines = append(lines, fmt.Sprintf("CPU: %d connections shed over the limit", s.cpu.Snapshot().Shed))
+	}
+	if s.socks != nil {
+		st := s.socks.Stats()
+		lines = append(lines, fmt.Sprintf("SOCKS5: %d connects, %d target dial failures, %d negotiation timeouts, %d refused, %d malformed",
+			st.Connects, st.DialErrors, st.NegotiationTimeouts, st.NegotiationErrors, st.Malformed))
+		if r := s.retry; r != nil {
+			lines = append(lines, fmt.Sprintf("SOCKS5 dial retries: %d connected after a retry, %d failed after every retry, %d failed without one",
+				r.recovered.Load(), r.exhausted.Load(), r.permanent.Load()))
+		}
+		if s.config.Socks5UDP {
+			lines = append(lines, fmt.Sprintf("SOCKS5 UDP: %d associations, %d targets, %d datagrams dropped",
+				st.UDPAssociations, st.UDPSessions, st.UDPDropped))
+		}
+	}
+	if f := s.forward; f != nil {
+		st := &f.stats
+		lines = append(lines, fmt.Sprintf("Backend: %d connected (%d after a retry, %d via fallback), %d dropped, %d failed dials",
+			st.connected.Load(), st.retried.Load(), st.failover.Load(), st.failed.Load(), st.errors.Load()))
+		if f.pool != nil {
+			ps := f.pool.stats
+			lines = append(lines, fmt.Sprintf("Backend pool: %d hits, %d misses, %d created, %d expired, %d closed by the backend, %d failed dials",
+				ps.PoolHits.Load(), ps.PoolMisses.Load(), ps.PoolCreated.Load(), ps.PoolExpired.Load(), ps.PoolStale.Load(), ps.PoolFailed.Load()))
+		}
+	}
+	if m := s.mux; m != nil && m.total.Load() > 0 {
+		lines = append(lines, fmt.Sprintf("Mux: %d sessions (%d open), %d streams", m.total.Load(), m.sessions.Load(), m.streams.Load()))
+	}
+	if n := s.dials.TimedOut(); n > 0 {
+		lines = append(lines, fmt.Sprintf("Dial timeouts: %d dials cut off by --dial-timeout", n))
+	}
+	if n := s.pings.answered.Load(); n > 0 {
+		lines = append(lines, fmt.Sprintf("Pings: %d answered", n))
+	}
+	if line := s.clients.Summary(); line != "" {
+		lines = append(lines, line)
+	}
+	cs := &s.closes
+	lines = append(lines, fmt.Sprintf("Connections: %d relayed and closed, %d idle past --idle-timeout, %d silent after the handshake, %d stalled in the handshake, %d unauthenticated",
+		cs.closed.Load(), cs.idle.Load(), cs.firstFrame.Load(), cs.sessionTimeout.Load(), cs.unauthenticated.Load()))
+	return lines
+}
+
+// newService creates a ShadowTLS v3 service for password
+func (s *Server) newService(password string) (*shadowtls.Service, error) {
+	config := shadowtls.ServiceConfig{
+		Version: 3,
+		Users: []shadowtls.User{
+			{Name: "default", Password: password},
+		},
+		StrictMode: false,
+		Handler:    handshakeDoneHandler{s.pings},
+		Logger:     &stls.Logger{L: ModuleLogger("shadowtls")},
+	}
+
+	if s.config.Handshake != "" {
+		handshakeHost, handshakePort := stls.ParseHostPort(s.config.Handshake)
+		config.Handshake = shadowtls.HandshakeConfig{
+			Server: stls.MakeSocksaddr(handshakeHost, handshakePort),
+			Dialer: N.SystemDialer,
+		}
+	} else {
+		config.Handshake = shadowtls.HandshakeConfig{
+			Dialer: N.SystemDialer,
+		}
+	}
+
+	if s.config.WildcardSNI {
+		config.WildcardSNI = shadowtls.WildcardSNIAuthed
+	}
+
+	service, err := shadowtls.NewService(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ShadowTLS service: %v", err)
+	}
+	return service, nil
+}
+
+// reload re-reads the configuration and, if the password changed, swaps in a
+// new service and retires connections authenticated with the old password
+// according to the reload policy
+func (s *Server) reload() {
+	if s.config.Reload == nil {
+		s.log.Warn("Reload requested but no --config file is in use")
+		return
+	}
+	next, err := s.config.Reload()
+	if err != nil {
+		s.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	if err := next.ReloadPolicy.Validate(); err != nil {
+		s.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	s.config.ReloadPolicy = next.ReloadPolicy
+	if f, t := formatDialTimeouts(s.config.DialTimeouts), formatDialTimeouts(next.DialTimeouts); f != t {
+		s.config.DialTimeouts = next.DialTimeouts
+		s.dials.Set(next.DialTimeouts)
+		s.log.Infof("Reload: dial timeouts %q → %q", f, t)
+	}
+	if s.socks != nil {
+		// Re-read even if unchanged: the htpasswd file may have new users
+		s.config.Socks5Auth = next.Socks5Auth
+		s.socks.SetAuthenticator(next.Socks5Auth)
+		if next.Socks5Auth != nil {
+			s.log.Infof("Reload: SOCKS5 auth: %v", next.Socks5Auth)
+		}
+	}
+
+	if next.Password == s.config.Password {
+		s.log.Info("Reload: password unchanged")
+		return
+	}
+	service, err := s.newService(next.Password)
+	if err != nil {
+		s.log.Errorf("Reload failed, keeping current configuration: %v", err)
+		return
+	}
+	s.config.Password = next.Password
+	s.secret.Store(&next.Password)
+	s.service.Store(service)
+	s.log.Info("Reload: password changed")
+
+	old := s.conns.Advance()
+	s.conns.Retire(old, s.config.ReloadPolicy, s.log)
+}
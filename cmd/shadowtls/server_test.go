@@ -1,7 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	M "github.com/metacubex/sing/common/metadata"
 )
 
 func TestNewServer(t *testing.T) {
@@ -41,3 +51,213 @@ func TestNewServerSocks5(t *testing.T) {
 		t.Error("Server should be in SOCKS5 mode")
 	}
 }
+
+func TestParseReplyAddr(t *testing.T) {
+	for in, want := range map[string]string{
+		"203.0.113.7":        "203.0.113.7:0",
+		"203.0.113.7:8443":   "203.0.113.7:8443",
+		"2001:db8::1":        "[2001:db8::1]:0",
+		"[2001:db8::1]":      "[2001:db8::1]:0",
+		"[2001:db8::1]:443":  "[2001:db8::1]:443",
+		"::ffff:203.0.113.7": "203.0.113.7:0",
+	} {
+		addr, err := parseReplyAddr(in)
+		if err != nil || addr.String() != want {
+			t.Errorf("parseReplyAddr(%q) = %v, %v, want %s", in, addr, err, want)
+		}
+	}
+	for _, in := range []string{"example.com", "fe80::1%eth0", "[2001:db8::1]:x", "203.0.113.7:x", "203.0.113.7:70000"} {
+		if _, err := parseReplyAddr(in); err == nil {
+			t.Errorf("parseReplyAddr(%q) should fail", in)
+		}
+	}
+}
+
+func TestParseSocksAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("alice:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for spec, want := range map[string]string{
+		"htpasswd:" + path:           "htpasswd " + path + " (1 users)",
+		"exec:/usr/local/bin/check":  "exec /usr/local/bin/check",
+		"https://auth.example/check": "http https://auth.example/check",
+	} {
+		auth, err := parseSocksAuth(spec, 0)
+		if err != nil || fmt.Sprint(auth) != want {
+			t.Errorf("parseSocksAuth(%q) = %v, %v, want %s", spec, auth, err, want)
+		}
+	}
+	if auth, err := parseSocksAuth("htpasswd:"+path, time.Minute); err != nil || fmt.Sprint(auth) != "htpasswd "+path+" (1 users), cached for 1m0s" {
+		t.Errorf("cached backend = %v, %v", auth, err)
+	}
+	if _, err := parseSocksAuth("pam", 0); (err == nil) != pamSupported {
+		t.Errorf("parseSocksAuth(pam) = %v with pamSupported %v", err, pamSupported)
+	}
+	for _, spec := range []string{"alice:secret", "exec:", "htpasswd:" + path + ".missing", "http://"} {
+		if _, err := parseSocksAuth(spec, 0); err == nil {
+			t.Errorf("parseSocksAuth(%q) should fail", spec)
+		}
+	}
+}
+
+func TestDialBackend(t *testing.T) {
+	// A closed listener's port refuses connections
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	go func() {
+		for {
+			c, err := live.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	newHandler := func(forward, fallback string, retries int) *forwardHandler {
+		return &forwardHandler{
+			forward:  forward,
+			logger:   Log,
+			repeat:   NewRepeatLogger(Log),
+			fallback: fallback,
+			retries:  retries,
+			backoff:  time.Millisecond,
+		}
+	}
+
+	h := newHandler(deadAddr, live.Addr().String(), 0)
+	conn, addr, err := h.dialBackend(context.Background())
+	if err != nil || addr != live.Addr().String() {
+		t.Fatalf("dialBackend = %v, %v, want the fallback", addr, err)
+	}
+	conn.Close()
+	if h.stats.connected.Load() != 1 || h.stats.failover.Load() != 1 || h.stats.errors.Load() != 1 {
+		t.Errorf("stats after failover: %d connected, %d failover, %d errors",
+			h.stats.connected.Load(), h.stats.failover.Load(), h.stats.errors.Load())
+	}
+
+	h = newHandler(deadAddr, "", 2)
+	if _, _, err := h.dialBackend(context.Background()); err == nil {
+		t.Fatal("dialBackend to a refused port succeeded")
+	}
+	if h.stats.errors.Load() != 3 || h.stats.failed.Load() != 1 {
+		t.Errorf("stats after retries: %d errors, want 3; %d failed, want 1", h.stats.errors.Load(), h.stats.failed.Load())
+	}
+
+	// A cancelled tunnel stops waiting for the next round
+	h = newHandler(deadAddr, "", 5)
+	h.backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := h.dialBackend(ctx); err != context.DeadlineExceeded {
+		t.Errorf("dialBackend with an expired context = %v", err)
+	}
+}
+
+// A bridge carries client connections through a second ShadowTLS hop
+func TestServerBridge(t *testing.T) {
+	rig, err := startSoakRig(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rig.stop()
+
+	bridgeAddr, err := freeLoopbackAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hop2 := rig.server.config
+	bridge := NewServer(&ServerConfig{
+		ListenAddr:   bridgeAddr,
+		Handshake:    hop2.Handshake,
+		Password:     "first-hop",
+		ReloadPolicy: ReloadPolicy{Mode: ReloadGrace},
+		Upstream: &UpstreamConfig{
+			Server:   hop2.ListenAddr,
+			SNI:      "localhost",
+			Password: hop2.Password,
+			Timeout:  5 * time.Second,
+		},
+		Logger: ModuleLogger("server"),
+	})
+	bridgeErr := rig.run(bridge.Run)
+	defer bridge.Stop()
+	select {
+	case <-bridge.Ready():
+	case err := <-bridgeErr:
+		t.Fatal(err)
+	}
+
+	cfg := *rig.client.config
+	cfg.ListenAddr, err = freeLoopbackAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerAddr = bridgeAddr
+	cfg.Password = "first-hop"
+	client := NewClient(&cfg)
+	clientErr := rig.run(client.Run)
+	defer client.Stop()
+	select {
+	case <-client.Ready():
+	case err := <-clientErr:
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", cfg.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	msg := []byte("through two hops")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != string(msg) {
+		t.Fatalf("echo = %q, %v", got, err)
+	}
+}
+
+// A relay that goes quiet reports errRelayIdle so it is counted apart from
+// connections closed by either side
+func TestForwardHandlerIdle(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(io.Discard, c)
+	}()
+
+	client, tunnel := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("hello"))
+
+	h := &forwardHandler{
+		forward: backend.Addr().String(),
+		idle:    50 * time.Millisecond,
+		logger:  Log,
+		repeat:  NewRepeatLogger(Log),
+	}
+	if err := h.NewConnection(context.Background(), tunnel, M.Metadata{}); !errors.Is(err, errRelayIdle) {
+		t.Errorf("NewConnection on an idle relay = %v, want errRelayIdle", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+)
+
+// shed hands a connection turned away under load to the handshake server
+// instead of closing it. A real TLS server would still answer, so a close
+// right after accept would give the server away to an active prober. Nothing
+// is parsed or authenticated, so it costs only the copy. With --wildcard-sni
+// and no --handshake there is no server to send it to and it is closed.
+func (s *Server) shed(ctx context.Context, c net.Conn) {
+	if s.config.Handshake == "" {
+		return
+	}
+	host, port := stls.ParseHostPort(s.config.Handshake)
+	decoy, err := s.dials.Dial(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		connLogger(ctx, s.log).Debugf("Shed connection from %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	defer decoy.Close()
+
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		relaypkg.CopyConn(dst, src, relayBufferSize, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Go(func() { pipe(decoy, c) })
+	pipe(c, decoy)
+	wg.Wait()
+}
+
+// goShed sheds c in the background, tracked like any other connection so
+// shutdown waits for it or closes it
+func (s *Server) goShed(ctx context.Context, wg *sync.WaitGroup, c net.Conn) {
+	wg.Go(func() {
+		closeConn := sync.OnceValue(c.Close)
+		defer closeConn()
+		untrack := s.conns.Track(func() { closeConn() })
+		defer untrack()
+		s.shed(ctx, c)
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A shed connection reaches the handshake server instead of being closed
+func TestServerShed(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	go func() {
+		c, err := decoy.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		c.Write(bytes.ToUpper(b))
+	}()
+
+	s := NewServer(&ServerConfig{Handshake: decoy.Addr().String(), Logger: ModuleLogger("server")})
+	client, conn := tcpPair(t)
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	done := make(chan struct{})
+	go func() {
+		s.shed(context.Background(), conn)
+		close(done)
+	}()
+
+	client.Write([]byte("hello"))
+	client.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(client)
+	if err != nil || string(got) != "HELLO" {
+		t.Errorf("read %q, %v; want the handshake server's HELLO", got, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shed didn't return once both sides closed")
+	}
+
+	// Without a handshake server there is nowhere to send it
+	s = NewServer(&ServerConfig{WildcardSNI: true, Logger: ModuleLogger("server")})
+	s.shed(context.Background(), conn) // Returns at once
+}
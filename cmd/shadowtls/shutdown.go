@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownStageTimeout bounds each shutdown stage that waits on goroutines
+const shutdownStageTimeout = 5 * time.Second
+
+// shutdownSequence runs the teardown at the end of Run one stage at a time:
+// stop accepting, cancel and wait for relays, stop the pool, wait for
+// background goroutines, then log the final stats. Each stage is logged, and
+// one that outlives its timeout is left behind so the rest still run.
+type shutdownSequence struct {
+	log   *logrus.Logger
+	start time.Time
+	stuck []string // Stages that timed out
+}
+
+func newShutdownSequence(logger *logrus.Logger) *shutdownSequence {
+	return &shutdownSequence{log: logger, start: time.Now()}
+}
+
+// Stage runs fn, waiting at most timeout for it (0 waits as long as it
+// takes), and reports whether it finished
+func (s *shutdownSequence) Stage(name string, timeout time.Duration, fn func()) bool {
+	start := time.Now()
+	if timeout <= 0 {
+		fn()
+		s.log.Debugf("[SHUTDOWN] %s: done in %v", name, time.Since(start).Round(time.Millisecond))
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		s.log.Debugf("[SHUTDOWN] %s: done in %v", name, time.Since(start).Round(time.Millisecond))
+		return true
+	case <-timer.C:
+		s.log.Warnf("[SHUTDOWN] %s: still running after %v, moving on", name, timeout)
+		s.stuck = append(s.stuck, name)
+		return false
+	}
+}
+
+// Drain lets the connection handlers in wg finish on their own for up to
+// timeout, or until hurry is closed by a second signal, and returns how many
+// connections, counted by open, were still running when it stopped waiting
+func (s *shutdownSequence) Drain(timeout time.Duration, wg *sync.WaitGroup, open func() int, hurry <-chan struct{}) int {
+	start := time.Now()
+	s.log.Infof("[SHUTDOWN] Draining %d connection(s) for up to %v", open(), timeout)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		s.log.Infof("[SHUTDOWN] Drain: all connections ended in %v", time.Since(start).Round(time.Millisecond))
+		return 0
+	case <-hurry:
+		s.log.Info("[SHUTDOWN] Drain: cut short by a second signal")
+	case <-timer.C:
+	}
+	n := open()
+	if n > 0 {
+		s.log.Warnf("[SHUTDOWN] Drain: closing %d connection(s) still open after %v", n, time.Since(start).Round(time.Millisecond))
+	}
+	return n
+}
+
+// Stuck returns the stages that timed out
+func (s *shutdownSequence) Stuck() []string {
+	return s.stuck
+}
+
+// Elapsed returns the time since the sequence started
+func (s *shutdownSequence) Elapsed() time.Duration {
+	return time.Since(s.start).Round(time.Millisecond)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stage that outlives its timeout is skipped, not waited on forever
+func TestShutdownSequenceMovesOn(t *testing.T) {
+	seq := newShutdownSequence(ModuleLogger("client"))
+	var order []string
+	if !seq.Stage("first", 0, func() { order = append(order, "first") }) {
+		t.Error("unbounded stage reported stuck")
+	}
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	if seq.Stage("stuck", 20*time.Millisecond, func() { <-release }) {
+		t.Error("blocked stage reported done")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stuck stage held the sequence for %v", elapsed)
+	}
+	seq.Stage("last", time.Second, func() { order = append(order, "last") })
+
+	if !slices.Equal(order, []string{"first", "last"}) {
+		t.Errorf("stages ran %v", order)
+	}
+	if stuck := seq.Stuck(); !slices.Equal(stuck, []string{"stuck"}) {
+		t.Errorf("Stuck = %v", stuck)
+	}
+}
+
+// Connections that end within --drain-timeout aren't cut; the rest are
+// counted once it runs out, or at once on a second signal
+func TestShutdownSequenceDrain(t *testing.T) {
+	seq := newShutdownSequence(ModuleLogger("client"))
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	count := func() int {
+		select {
+		case <-release:
+			return 0
+		default:
+			return 1
+		}
+	}
+	wg.Go(func() { <-release })
+	time.AfterFunc(20*time.Millisecond, func() { close(release) })
+	if n := seq.Drain(time.Second, &wg, count, nil); n != 0 {
+		t.Errorf("Drain = %d with every connection ending in time", n)
+	}
+
+	held := make(chan struct{})
+	defer close(held)
+	wg.Go(func() { <-held })
+	start := time.Now()
+	if n := seq.Drain(20*time.Millisecond, &wg, func() int { return 1 }, nil); n != 1 {
+		t.Errorf("Drain = %d after the timeout, want 1 cut", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Drain waited %v past a 20ms timeout", elapsed)
+	}
+
+	hurry := make(chan struct{})
+	close(hurry)
+	start = time.Now()
+	if n := seq.Drain(time.Minute, &wg, func() int { return 1 }, hurry); n != 1 {
+		t.Errorf("Drain = %d after a second signal, want 1 cut", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("a second signal left Drain waiting %v", elapsed)
+	}
+}
+
+// Once Run returns, the client and server have stopped every goroutine they
+// started, including relays still open when shutdown began
+func TestRunLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	rig, err := startSoakRig(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := net.Dial("tcp", rig.addr)
+	if err != nil {
+		rig.stop()
+		t.Fatal(err)
+	}
+	roundTrip(t, done, "closed before shutdown")
+	done.Close()
+	open, err := net.Dial("tcp", rig.addr)
+	if err != nil {
+		rig.stop()
+		t.Fatal(err)
+	}
+	defer open.Close()
+	roundTrip(t, open, "open across shutdown")
+
+	start := time.Now()
+	rig.stop()
+	if elapsed := time.Since(start); elapsed > shutdownStageTimeout {
+		t.Errorf("shutdown took %v with one open relay", elapsed)
+	}
+
+	// Goroutines already told to exit may need a moment to get there
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after Run returned, %d before; top stacks: %s", n, before, summarizeGoroutines(leakTopStacks))
+	}
+}
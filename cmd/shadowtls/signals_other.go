@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// userSignals is empty: there is no SIGUSR1 or SIGUSR2 to act on
+var userSignals []os.Signal
+
+func (c *Client) userSignal(sig os.Signal) {}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// userSignals are the signals a client acts on besides stop and reload
+var userSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
+
+// userSignal handles one of userSignals
+func (c *Client) userSignal(sig os.Signal) {
+	switch sig {
+	case syscall.SIGUSR2:
+		// Network changed (e.g. OpenWrt WAN hotplug): pooled tunnels are dead
+		c.log.Infof("Network change signalled, flushed %d pooled tunnel(s)", c.pool.Flush())
+	case syscall.SIGUSR1:
+		avail, cap := c.pool.Stats()
+		snap := c.stats.Snapshot(avail, cap)
+		fmt.Println(snap.String())
+		fmt.Println(formatConnTable(c.conns.Snapshot()))
+	}
+}
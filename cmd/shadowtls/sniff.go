@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+)
+
+// Sniff guard modes for --sniff-guard
+const (
+	SniffOff  = "off"  // Don't look at the opening bytes
+	SniffWarn = "warn" // Refuse HTTP and TLS openings and log what the app sent
+	SniffHelp = "help" // ...and answer HTTP clients with a page saying what to fix
+)
+
+// sniffKind is what an app's opening bytes look like
+type sniffKind int
+
+const (
+	sniffOther     sniffKind = iota // SOCKS5 or anything else relayed as is
+	sniffHTTP                       // A plain HTTP request: the app connected directly
+	sniffHTTPProxy                  // An HTTP proxy request: the app uses the listener as an HTTP proxy
+	sniffTLS                        // A TLS ClientHello: the app connected directly over HTTPS
+)
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE", "CONNECT"}
+
+// sniffOpening recognizes the openings of apps pointed at the listener the
+// wrong way, and describes them for the log
+func sniffOpening(data []byte) (sniffKind, string) {
+	if len(data) >= 3 && data[0] == 0x16 && data[1] == 0x03 {
+		return sniffTLS, "a TLS ClientHello"
+	}
+	line, _, _ := bytes.Cut(data, []byte("\r\n"))
+	method, rest, ok := strings.Cut(string(line), " ")
+	if !ok || !strings.HasSuffix(rest, " HTTP/1.0") && !strings.HasSuffix(rest, " HTTP/1.1") {
+		return sniffOther, ""
+	}
+	target := rest[:len(rest)-len(" HTTP/1.1")]
+	for _, m := range httpMethods {
+		if method != m {
+			continue
+		}
+		if len(target) > 64 {
+			target = target[:64] + "..."
+		}
+		if method == "CONNECT" || !strings.HasPrefix(target, "/") {
+			return sniffHTTPProxy, fmt.Sprintf("an HTTP proxy request (%s %s)", method, target)
+		}
+		return sniffHTTP, fmt.Sprintf("plain HTTP (%s %s)", method, target)
+	}
+	return sniffOther, ""
+}
+
+// sniffAdvice says what to change for an app whose opening was refused
+func sniffAdvice(kind sniffKind, listen string) string {
+	proxy := "socks5://" + localProxyAddr(listen)
+	if kind == sniffHTTPProxy {
+		return fmt.Sprintf("the listener is a SOCKS5 proxy (with server --socks5), not an HTTP proxy: set the app's proxy to %s", proxy)
+	}
+	return fmt.Sprintf("with server --socks5 the listener is a SOCKS5 proxy: set it as the app's proxy (%s) instead of connecting to it directly; if the server --forwards to an HTTP or TLS service, run the client with --sniff-guard off", proxy)
+}
+
+// writeSniffHelp answers an HTTP client with a page explaining the mistake
+func writeSniffHelp(conn net.Conn, advice string) {
+	body := "shadowtls: this listener doesn't accept plain HTTP.\n\n" +
+		strings.ToUpper(advice[:1]) + advice[1:] + ".\n"
+	conn.SetWriteDeadline(time.Now().Add(relaypkg.DefaultWriteTimeout))
+	fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
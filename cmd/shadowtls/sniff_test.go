@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSniffOpening(t *testing.T) {
+	tests := []struct {
+		data string
+		kind sniffKind
+		desc string
+	}{
+		{"GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", sniffHTTP, "plain HTTP (GET /index.html)"},
+		{"POST /api HTTP/1.0\r\n", sniffHTTP, "plain HTTP (POST /api)"},
+		{"GET http://example.com/ HTTP/1.1\r\n", sniffHTTPProxy, "an HTTP proxy request (GET http://example.com/)"},
+		{"CONNECT example.com:443 HTTP/1.1\r\n", sniffHTTPProxy, "an HTTP proxy request (CONNECT example.com:443)"},
+		{"\x16\x03\x01\x02\x00\x01", sniffTLS, "a TLS ClientHello"},
+		{"\x05\x01\x00", sniffOther, ""},
+		{"SSH-2.0-OpenSSH_9.6\r\n", sniffOther, ""},
+		{"FETCH / HTTP/1.1\r\n", sniffOther, ""},
+		{"GET /", sniffOther, ""},
+	}
+	for _, tt := range tests {
+		kind, desc := sniffOpening([]byte(tt.data))
+		if kind != tt.kind || desc != tt.desc {
+			t.Errorf("sniffOpening(%q) = %v, %q; want %v, %q", tt.data, kind, desc, tt.kind, tt.desc)
+		}
+	}
+}
+
+func TestSniffAdvice(t *testing.T) {
+	if a := sniffAdvice(sniffHTTPProxy, "0.0.0.0:1080"); !strings.Contains(a, "not an HTTP proxy") || !strings.Contains(a, "socks5://127.0.0.1:1080") {
+		t.Errorf("proxy advice: %s", a)
+	}
+	if a := sniffAdvice(sniffHTTP, "127.0.0.1:1080"); !strings.Contains(a, "instead of connecting to it directly") {
+		t.Errorf("direct advice: %s", a)
+	}
+}
+
+func TestWriteSniffHelp(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		writeSniffHelp(server, sniffAdvice(sniffHTTP, "127.0.0.1:1080"))
+		server.Close()
+	}()
+	page, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(page), "HTTP/1.1 502 Bad Gateway\r\n") || !strings.Contains(string(page), "With server --socks5") {
+		t.Errorf("help page:\n%s", page)
+	}
+}
+
+func TestSniffRefused(t *testing.T) {
+	c := NewClient(&ClientConfig{ListenAddr: "127.0.0.1:1080", SniffGuard: SniffHelp})
+	for _, tt := range []struct {
+		data    string
+		refused bool
+		page    bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n", true, true},
+		{"\x16\x03\x01\x02\x00\x01", true, false},
+		{"\x05\x01\x00", false, false},
+	} {
+		client, server := net.Pipe()
+		done := make(chan bool, 1)
+		go func() {
+			done <- c.sniffRefused(context.Background(), server, []byte(tt.data))
+			server.Close()
+		}()
+		page, _ := io.ReadAll(client)
+		if refused := <-done; refused != tt.refused {
+			t.Errorf("sniffRefused(%q) = %v, want %v", tt.data, refused, tt.refused)
+		}
+		if (len(page) > 0) != tt.page {
+			t.Errorf("sniffRefused(%q) wrote %q", tt.data, page)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	stls "github.com/iprw/shadowtun/pkg/shadowtls"
+	utls "github.com/refraction-networking/utls"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sniProbeFailures is how many probes in a row a host must fail before
+	// it is taken out of the rotation
+	sniProbeFailures = 2
+	// sniProbeTimeout bounds one probe
+	sniProbeTimeout = 10 * time.Second
+)
+
+// ParseSNIList splits --sni into its comma-separated host names
+func ParseSNIList(s string) ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(s, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" || strings.ContainsAny(host, ":/ ") {
+			return nil, fmt.Errorf("invalid SNI %q: want a host name", host)
+		}
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// sniHost is a camouflage host and the result of its probes
+type sniHost struct {
+	name     string
+	failures int // Consecutive failed probes
+	down     bool
+}
+
+// SNISet rotates new tunnels across several camouflage hosts. With probing
+// on, each host gets a TLS handshake of its own every interval, straight
+// from the client rather than through the server. A host that fails
+// sniProbeFailures probes in a row is taken out of the rotation until a
+// probe succeeds again, so a decommissioned camouflage domain stops being
+// used instead of failing every tunnel given it.
+type SNISet struct {
+	log   *logrus.Logger
+	probe func(ctx context.Context, host string) error
+
+	mu       sync.Mutex
+	hosts    []*sniHost
+	next     int
+	removals uint64
+	wake     chan struct{}
+}
+
+// SNISetSnapshot is a point-in-time view of the rotation
+type SNISetSnapshot struct {
+	Hosts    int
+	Down     []string // Hosts taken out of the rotation
+	Removals uint64   // Times a host was taken out
+}
+
+// NewSNISet creates a rotation over hosts, all of them healthy
+func NewSNISet(hosts []string) *SNISet {
+	s := &SNISet{
+		log:   ModuleLogger("pool"),
+		probe: probeSNI,
+		wake:  make(chan struct{}, 1),
+	}
+	s.SetHosts(hosts)
+	return s
+}
+
+// SetHosts replaces the hosts, e.g. on reload. Hosts that stay keep their
+// health.
+func (s *SNISet) SetHosts(names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts := make([]*sniHost, len(names))
+	for i, name := range names {
+		j := slices.IndexFunc(s.hosts, func(h *sniHost) bool { return h.name == name })
+		if j >= 0 {
+			hosts[i] = s.hosts[j]
+		} else {
+			hosts[i] = &sniHost{name: name}
+		}
+	}
+	s.hosts = hosts
+	s.next = 0
+}
+
+// Next returns the host for the next tunnel: the healthy hosts take turns,
+// and if none is healthy all of them do
+func (s *SNISet) Next() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for range s.hosts {
+		h := s.hosts[s.next%len(s.hosts)]
+		s.next++
+		if !h.down {
+			return h.name
+		}
+	}
+	h := s.hosts[s.next%len(s.hosts)]
+	s.next++
+	return h.name
+}
+
+// Run probes every host each interval until ctx is done, and right away
+// when ProbeNow asks for it
+func (s *SNISet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Probe(ctx)
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ProbeNow asks Run to probe the hosts now instead of at the next interval,
+// e.g. when handshakes start failing
+func (s *SNISet) ProbeNow() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Probe checks every host at once and updates the rotation
+func (s *SNISet) Probe(ctx context.Context) {
+	s.mu.Lock()
+	hosts := slices.Clone(s.hosts)
+	s.mu.Unlock()
+
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Go(func() {
+			probeCtx, cancel := context.WithTimeout(ctx, sniProbeTimeout)
+			defer cancel()
+			errs[i] = s.probe(probeCtx, h.name)
+		})
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	for i, h := range hosts {
+		s.record(h, errs[i])
+	}
+}
+
+// record applies the result of one probe of h and logs what it changed
+func (s *SNISet) record(h *sniHost, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		h.failures = 0
+		if h.down {
+			h.down = false
+			s.log.Infof("[SNI] %s answers probes again, back in rotation", h.name)
+		}
+		return
+	}
+	h.failures++
+	if h.down || h.failures < sniProbeFailures {
+		s.log.Debugf("[SNI] Probe of %s failed: %v", h.name, err)
+		return
+	}
+	h.down = true
+	s.removals++
+	healthy := 0
+	for _, o := range s.hosts {
+		if !o.down {
+			healthy++
+		}
+	}
+	switch {
+	case healthy > 0:
+		s.log.Warnf("[SNI] %s failed %d probes in a row (%v); removed from rotation, %d host(s) left", h.name, h.failures, err, healthy)
+	case len(s.hosts) == 1:
+		s.log.Warnf("[SNI] %s failed %d probes in a row (%v); it is the only --sni, replace it if the site is gone", h.name, h.failures, err)
+	default:
+		s.log.Warnf("[SNI] %s failed %d probes in a row (%v); every host is failing, rotating through all of them", h.name, h.failures, err)
+	}
+}
+
+// Snapshot returns the rotation state; zero for a nil set
+func (s *SNISet) Snapshot() SNISetSnapshot {
+	if s == nil {
+		return SNISetSnapshot{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := SNISetSnapshot{Hosts: len(s.hosts), Removals: s.removals}
+	for _, h := range s.hosts {
+		if h.down {
+			snap.Down = append(snap.Down, h.name)
+		}
+	}
+	return snap
+}
+
+// probeSNI makes a TLS 1.3 handshake with host on port 443 and checks its
+// certificate, as a healthy decoy for ShadowTLS v3 must complete. It sends
+// the same uTLS ClientHello as the tunnels, so to the network and the host
+// a probe looks like one more tunnel handshake rather than a Go client.
+// The probe leaves from the client's network, not the server's: a host the
+// client's network blocks is reported down even if the server can reach it.
+func probeSNI(ctx context.Context, host string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, "443"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	uconn := utls.UClient(conn, &utls.Config{ServerName: host, MinVersion: utls.VersionTLS13}, stls.Fingerprint)
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	if v := uconn.ConnectionState().Version; v != utls.VersionTLS13 {
+		return fmt.Errorf("negotiated TLS version %#04x, not TLS 1.3", v)
+	}
+	return nil
+}
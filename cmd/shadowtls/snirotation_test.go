@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSNIList(t *testing.T) {
+	hosts, err := ParseSNIList(" a.example.com, b.example.com,a.example.com")
+	if err != nil || !slices.Equal(hosts, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("ParseSNIList = %v, %v", hosts, err)
+	}
+	for _, s := range []string{"", "a.com,,b.com", "a.com:443", "https://a.com"} {
+		if _, err := ParseSNIList(s); err == nil {
+			t.Errorf("ParseSNIList(%q) accepted", s)
+		}
+	}
+}
+
+// fakeProbes makes the hosts in down fail their probes
+type fakeProbes struct {
+	mu   sync.Mutex
+	down map[string]bool
+	runs int
+}
+
+func (f *fakeProbes) probe(ctx context.Context, host string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs++
+	if f.down[host] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (f *fakeProbes) set(host string, down bool) {
+	f.mu.Lock()
+	f.down[host] = down
+	f.mu.Unlock()
+}
+
+// rotation returns the next n hosts handed out
+func rotation(s *SNISet, n int) []string {
+	var got []string
+	for range n {
+		got = append(got, s.Next())
+	}
+	return got
+}
+
+func TestSNISetRotation(t *testing.T) {
+	s := NewSNISet([]string{"a", "b", "c"})
+	probes := &fakeProbes{down: map[string]bool{}}
+	s.probe = probes.probe
+	ctx := context.Background()
+
+	if got := rotation(s, 4); !slices.Equal(got, []string{"a", "b", "c", "a"}) {
+		t.Errorf("rotation = %v, want every host in turn", got)
+	}
+
+	// One failed probe isn't enough to drop a host
+	probes.set("b", true)
+	s.Probe(ctx)
+	if snap := s.Snapshot(); len(snap.Down) != 0 {
+		t.Fatalf("down after one failed probe: %v", snap.Down)
+	}
+	s.Probe(ctx)
+	if snap := s.Snapshot(); !slices.Equal(snap.Down, []string{"b"}) || snap.Removals != 1 {
+		t.Fatalf("after %d failed probes: %+v, want b out of rotation", sniProbeFailures, snap)
+	}
+	if got := rotation(s, 4); slices.Contains(got, "b") {
+		t.Errorf("rotation = %v, still hands out b", got)
+	}
+
+	// A reload keeps what the probes found about hosts that stay
+	s.SetHosts([]string{"b", "c"})
+	if got := rotation(s, 2); !slices.Equal(got, []string{"c", "c"}) {
+		t.Errorf("rotation after reload = %v, want only c", got)
+	}
+
+	// With every host failing, all of them are used rather than none
+	probes.set("c", true)
+	s.Probe(ctx)
+	s.Probe(ctx)
+	if got := rotation(s, 2); !slices.Contains(got, "b") || !slices.Contains(got, "c") {
+		t.Errorf("rotation with every host down = %v, want both", got)
+	}
+
+	probes.set("b", false)
+	s.Probe(ctx)
+	if snap := s.Snapshot(); !slices.Equal(snap.Down, []string{"c"}) {
+		t.Errorf("after b recovered: down %v, want only c", snap.Down)
+	}
+}
+
+// Run probes at once, then every interval or when asked to
+func TestSNISetRun(t *testing.T) {
+	s := NewSNISet([]string{"a"})
+	probes := &fakeProbes{down: map[string]bool{}}
+	s.probe = probes.probe
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, time.Hour)
+		close(done)
+	}()
+
+	runs := func() int {
+		probes.mu.Lock()
+		defer probes.mu.Unlock()
+		return probes.runs
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runs() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.ProbeNow()
+	for runs() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runs(); n != 2 {
+		t.Errorf("%d probes, want one at start and one from ProbeNow", n)
+	}
+	cancel()
+	<-done
+}
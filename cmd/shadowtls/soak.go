@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+)
+
+const (
+	soakLatencySamples = 10000            // Short flow latencies kept for percentiles
+	soakFlowTimeout    = 30 * time.Second // Deadline for one flow
+	soakSettle         = 2 * time.Second  // Wait for connections to wind down before the final sample
+)
+
+// SoakConfig describes a soak run
+type SoakConfig struct {
+	Duration     time.Duration
+	ShortFlows   int           // Concurrent request/response flows
+	BulkFlows    int           // Concurrent bulk transfer flows
+	ShortMax     int           // Largest short request in bytes
+	BulkSize     int64         // Bytes echoed per bulk flow before it reconnects
+	PoolSize     int           // Client pool size
+	Report       time.Duration // Progress line interval, 0 to disable
+	MaxErrorRate float64       // Failed flow fraction above which the run fails
+}
+
+// SoakReport holds the stability metrics of a soak run
+type SoakReport struct {
+	Duration    time.Duration
+	ShortOK     uint64
+	ShortFailed uint64
+	BulkOK      uint64
+	BulkFailed  uint64
+	Mismatches  uint64 // Flows that got different bytes back
+	Bytes       uint64 // Payload bytes echoed back intact
+	LatencyP50  time.Duration
+	LatencyP99  time.Duration
+
+	GoroutinesStart int
+	GoroutinesPeak  int
+	GoroutinesEnd   int
+	HeapStart       uint64
+	HeapPeak        uint64
+	HeapEnd         uint64
+
+	// Client tunnel stats at the end of the run
+	Tunnel StatsSnapshot
+}
+
+// ErrorRate is the fraction of flows that failed
+func (r *SoakReport) ErrorRate() float64 {
+	total := r.ShortOK + r.ShortFailed + r.BulkOK + r.BulkFailed
+	if total == 0 {
+		return 0
+	}
+	return float64(r.ShortFailed+r.BulkFailed) / float64(total)
+}
+
+// Passed reports whether the run met the stability criteria of cfg
+func (r *SoakReport) Passed(cfg SoakConfig) bool {
+	return r.Mismatches == 0 && r.Tunnel.Panics == 0 && r.ShortOK+r.BulkOK > 0 && r.ErrorRate() <= cfg.MaxErrorRate
+}
+
+// String formats the report for the terminal
+func (r *SoakReport) String() string {
+	return fmt.Sprintf(`
+=== Soak Report ===
+Duration: %v
+
+Flows:
+  Short: %d ok, %d failed (latency p50=%v p99=%v)
+  Bulk:  %d ok, %d failed
+  Mismatched payloads: %d
+  Bytes echoed: %s
+  Error rate: %.3f%%
+
+Tunnel:
+  Pool created: %d, failed: %d (%s), stale: %d
+  Connection errors: %d, panics: %d
+
+Resources:
+  Goroutines: start=%d peak=%d end=%d (%+d)
+  Heap:       start=%s peak=%s end=%s (%+.1f%%)
+`,
+		r.Duration.Round(time.Second),
+		r.ShortOK, r.ShortFailed, r.LatencyP50.Round(time.Microsecond), r.LatencyP99.Round(time.Microsecond),
+		r.BulkOK, r.BulkFailed,
+		r.Mismatches,
+		formatBytes(r.Bytes, false),
+		r.ErrorRate()*100,
+		r.Tunnel.PoolCreated, r.Tunnel.PoolFailed, r.Tunnel.Failures, r.Tunnel.PoolStale,
+		r.Tunnel.ConnErrors, r.Tunnel.Panics,
+		r.GoroutinesStart, r.GoroutinesPeak, r.GoroutinesEnd, r.GoroutinesEnd-r.GoroutinesStart,
+		formatBytes(r.HeapStart, true), formatBytes(r.HeapPeak, true), formatBytes(r.HeapEnd, true),
+		growth(r.HeapStart, r.HeapEnd),
+	)
+}
+
+// growth returns the change from a to b in percent
+func growth(a, b uint64) float64 {
+	if a == 0 {
+		return 0
+	}
+	return (float64(b) - float64(a)) / float64(a) * 100
+}
+
+// runSoak implements `shadowtls soak`: push synthetic traffic through an
+// in-process client/server pair and report stability metrics
+func runSoak(args []string) int {
+	verbosity, args := ParseVerbosity(args)
+	fs := flag.NewFlagSet("soak", flag.ContinueOnError)
+	duration := fs.Duration("duration", 5*time.Minute, "How long to generate traffic")
+	shortFlows := fs.Int("short-flows", 32, "Concurrent short request/response flows")
+	bulkFlows := fs.Int("bulk-flows", 2, "Concurrent bulk transfer flows")
+	shortMax := fs.String("short-max", "4KB", "Largest short request")
+	bulkSize := fs.String("bulk-size", "16MB", "Bytes echoed per bulk flow before it reconnects")
+	poolSize := fs.Int("pool-size", 10, "Client pool size")
+	report := fs.Duration("report", 10*time.Second, "Progress line interval, 0 to disable")
+	maxErrors := fs.Float64("max-error-rate", 0.001, "Failed flow fraction above which the run fails")
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s soak [--duration 5m] [--short-flows 32] [--bulk-flows 2] [options]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Runs a client, server, handshake server and echo backend in this process and")
+		fmt.Fprintln(os.Stderr, "pushes many short flows plus a few bulk flows through them. Exits non-zero if")
+		fmt.Fprintln(os.Stderr, "any payload comes back corrupted, a panic is recovered, or too many flows fail.")
+		fmt.Fprintln(os.Stderr, "Run it on the target hardware before a release.")
+		fmt.Fprintln(os.Stderr, "")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	InitLogging(verbosity)
+
+	cfg := SoakConfig{
+		Duration:     *duration,
+		ShortFlows:   *shortFlows,
+		BulkFlows:    *bulkFlows,
+		PoolSize:     *poolSize,
+		Report:       *report,
+		MaxErrorRate: *maxErrors,
+	}
+	n, err := ParseSize(*shortMax)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --short-max: %v\n", err)
+		return 2
+	}
+	cfg.ShortMax = int(n)
+	if cfg.BulkSize, err = ParseSize(*bulkSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --bulk-size: %v\n", err)
+		return 2
+	}
+
+	r, err := RunSoak(cfg, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(r.String())
+	if !r.Passed(cfg) {
+		fmt.Println("FAIL")
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+}
+
+// RunSoak runs the soak described by cfg, writing progress lines to out
+func RunSoak(cfg SoakConfig, out io.Writer) (*SoakReport, error) {
+	rig, err := startSoakRig(cfg.PoolSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rig.stop()
+
+	var (
+		r       SoakReport
+		latency = newReservoir(soakLatencySamples)
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+		counts  struct{ shortOK, shortFailed, bulkOK, bulkFailed, mismatches, bytes atomic.Uint64 }
+	)
+
+	// Measure the baseline with the pool full, as it will be at the end
+	for warm := time.Now().Add(soakFlowTimeout); time.Now().Before(warm); time.Sleep(50 * time.Millisecond) {
+		if avail, size := rig.client.pool.Stats(); avail == size {
+			break
+		}
+	}
+	var mon resourceMonitor
+	r.GoroutinesStart, r.HeapStart = mon.sample(true)
+
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	for i := 0; i < cfg.ShortFlows; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				d, err := soakShort(rig.addr, rng, cfg.ShortMax)
+				switch {
+				case err == errSoakMismatch:
+					counts.mismatches.Add(1)
+					counts.shortFailed.Add(1)
+				case err != nil:
+					counts.shortFailed.Add(1)
+				default:
+					counts.shortOK.Add(1)
+					latency.add(d)
+				}
+			}
+		}(int64(i))
+	}
+	for i := 0; i < cfg.BulkFlows; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				n, err := soakBulk(rig.addr, rng, cfg.BulkSize)
+				counts.bytes.Add(uint64(n))
+				switch {
+				case err == errSoakMismatch:
+					counts.mismatches.Add(1)
+					counts.bulkFailed.Add(1)
+				case err != nil:
+					counts.bulkFailed.Add(1)
+				default:
+					counts.bulkOK.Add(1)
+				}
+			}
+		}(int64(1000 + i))
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	sampleTicker := time.NewTicker(time.Second)
+	defer sampleTicker.Stop()
+	var reportC <-chan time.Time
+	if cfg.Report > 0 {
+		reportTicker := time.NewTicker(cfg.Report)
+		defer reportTicker.Stop()
+		reportC = reportTicker.C
+	}
+wait:
+	for {
+		select {
+		case <-sampleTicker.C:
+			mon.sample(false)
+		case <-reportC:
+			g, heap := mon.sample(false)
+			fmt.Fprintf(out, "[SOAK] %v short=%d/%d bulk=%d/%d mismatch=%d goroutines=%d heap=%s\n",
+				time.Since(start).Round(time.Second),
+				counts.shortOK.Load(), counts.shortOK.Load()+counts.shortFailed.Load(),
+				counts.bulkOK.Load(), counts.bulkOK.Load()+counts.bulkFailed.Load(),
+				counts.mismatches.Load(), g, formatBytes(heap, true))
+		case <-done:
+			break wait
+		}
+	}
+	r.Duration = time.Since(start)
+
+	// Let closed flows unwind through both relays before the final sample
+	time.Sleep(soakSettle)
+	r.GoroutinesEnd, r.HeapEnd = mon.sample(true)
+	r.GoroutinesPeak, r.HeapPeak = mon.peakGoroutines, mon.peakHeap
+
+	r.ShortOK, r.ShortFailed = counts.shortOK.Load(), counts.shortFailed.Load()
+	r.BulkOK, r.BulkFailed = counts.bulkOK.Load(), counts.bulkFailed.Load()
+	r.Mismatches = counts.mismatches.Load()
+	r.Bytes = counts.bytes.Load()
+	r.LatencyP50, r.LatencyP99 = latency.percentile(0.5), latency.percentile(0.99)
+	r.Tunnel = rig.client.stats.Snapshot(0, cfg.PoolSize)
+	return &r, nil
+}
+
+var errSoakMismatch = errors.New("echoed payload differs")
+
+// soakShort sends one random request of up to max bytes and reads the echo
+func soakShort(addr string, rng *rand.Rand, max int) (time.Duration, error) {
+	req := make([]byte, 1+rng.Intn(max))
+	rng.Read(req)
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, soakFlowTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(soakFlowTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, len(req))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(req, resp) {
+		return 0, errSoakMismatch
+	}
+	return time.Since(start), nil
+}
+
+// soakBulk streams size random bytes and checks the echo. Returns the
+// number of bytes that came back.
+func soakBulk(addr string, rng *rand.Rand, size int64) (int64, error) {
+	conn, err := net.DialTimeout("tcp", addr, soakFlowTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(soakFlowTimeout + time.Duration(size/(1<<20))*time.Second))
+
+	sent := sha256.New()
+	writeErr := make(chan error, 1)
+	seed := rng.Int63()
+	go func() {
+		gen := rand.New(rand.NewSource(seed))
+		buf := make([]byte, 32*1024)
+		for left := size; left > 0; {
+			chunk := buf[:min(int64(len(buf)), left)]
+			gen.Read(chunk)
+			sent.Write(chunk)
+			if _, err := conn.Write(chunk); err != nil {
+				writeErr <- err
+				return
+			}
+			left -= int64(len(chunk))
+		}
+		writeErr <- nil
+	}()
+
+	got := sha256.New()
+	n, err := io.CopyN(got, conn, size)
+	if err != nil {
+		return n, err
+	}
+	if err := <-writeErr; err != nil {
+		return n, err
+	}
+	if !bytes.Equal(sent.Sum(nil), got.Sum(nil)) {
+		return n, errSoakMismatch
+	}
+	return n, nil
+}
+
+// soakRig is an in-process echo backend, TLS handshake server, ShadowTLS
+// server and client, wired together on loopback
+type soakRig struct {
+	addr      string // Client listen address
+	client    *Client
+	server    *Server
+	listeners []net.Listener
+	runs      sync.WaitGroup
+}
+
+func startSoakRig(poolSize int) (*soakRig, error) {
+	rig := &soakRig{}
+	ok := false
+	defer func() {
+		if !ok {
+			rig.stop()
+		}
+	}()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	rig.listeners = append(rig.listeners, echo)
+	go serveSoak(echo, func(c net.Conn) {
+		relaypkg.CopyConn(c, c, relayBufferSize, relaypkg.DefaultIdleTimeout, relaypkg.DefaultWriteTimeout, nil)
+	})
+
+	cert, err := selfSignedCert("localhost")
+	if err != nil {
+		return nil, err
+	}
+	hs, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	rig.listeners = append(rig.listeners, hs)
+	go serveSoak(hs, func(c net.Conn) {
+		c.SetDeadline(time.Now().Add(soakFlowTimeout))
+		io.Copy(io.Discard, c)
+	})
+
+	serverAddr, err := freeLoopbackAddr()
+	if err != nil {
+		return nil, err
+	}
+	clientAddr, err := freeLoopbackAddr()
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 16)
+	crand.Read(secret)
+	password := hex.EncodeToString(secret)
+
+	rig.server = NewServer(&ServerConfig{
+		ListenAddr:       serverAddr,
+		ForwardAddr:      echo.Addr().String(),
+		Handshake:        hs.Addr().String(),
+		Password:         password,
+		ReloadPolicy:     ReloadPolicy{Mode: ReloadGrace},
+		HandshakeWorkers: 4 * runtime.NumCPU(),
+		HandshakeQueue:   256,
+		SessionTimeout:   defaultSessionTimeout,
+		Logger:           ModuleLogger("server"),
+	})
+	serverErr := rig.run(rig.server.Run)
+	select {
+	case <-rig.server.Ready():
+	case err := <-serverErr:
+		return nil, fmt.Errorf("soak server: %v", err)
+	}
+
+	rig.client = NewClient(&ClientConfig{
+		ListenAddr:     clientAddr,
+		ServerAddr:     serverAddr,
+		SNI:            "localhost",
+		Password:       password,
+		PoolSize:       poolSize,
+		PoolRefill:     "adaptive",
+		TTL:            10 * time.Second,
+		Backoff:        500 * time.Millisecond,
+		Timeout:        10 * time.Second,
+		VerifyCoalesce: defaultVerifyCoalesce,
+		HandshakeLimit: 4 * runtime.NumCPU(),
+		ReloadPolicy:   ReloadPolicy{Mode: ReloadGrace},
+		Logger:         ModuleLogger("client"),
+	})
+	clientErr := rig.run(rig.client.Run)
+	select {
+	case <-rig.client.Ready():
+	case err := <-clientErr:
+		return nil, fmt.Errorf("soak client: %v", err)
+	}
+	rig.addr = clientAddr
+	ok = true
+	return rig, nil
+}
+
+// run starts fn in the background; its error, if any, is sent on the channel
+func (r *soakRig) run(fn func() error) <-chan error {
+	errc := make(chan error, 1)
+	r.runs.Add(1)
+	go func() {
+		defer r.runs.Done()
+		if err := fn(); err != nil {
+			errc <- err
+		}
+	}()
+	return errc
+}
+
+func (r *soakRig) stop() {
+	if r.client != nil {
+		r.client.Stop()
+	}
+	if r.server != nil {
+		r.server.Stop()
+	}
+	for _, l := range r.listeners {
+		l.Close()
+	}
+	r.runs.Wait()
+}
+
+// serveSoak accepts connections on l until it is closed
+func serveSoak(l net.Listener, handle func(net.Conn)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			handle(c)
+		}()
+	}
+}
+
+// freeLoopbackAddr returns a loopback address with a currently unused port
+func freeLoopbackAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// selfSignedCert creates a throwaway certificate for the handshake server
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// resourceMonitor tracks goroutine and heap peaks across samples
+type resourceMonitor struct {
+	peakGoroutines int
+	peakHeap       uint64
+}
+
+// sample records the current goroutine count and live heap, collecting
+// garbage first when gc is set so the heap reflects retained memory
+func (m *resourceMonitor) sample(gc bool) (goroutines int, heap uint64) {
+	if gc {
+		runtime.GC()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	goroutines = runtime.NumGoroutine()
+	m.peakGoroutines = max(m.peakGoroutines, goroutines)
+	m.peakHeap = max(m.peakHeap, ms.HeapAlloc)
+	return goroutines, ms.HeapAlloc
+}
+
+// reservoir keeps a uniform random sample of durations
+type reservoir struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	seen    int
+	rng     *rand.Rand
+}
+
+func newReservoir(size int) *reservoir {
+	return &reservoir{samples: make([]time.Duration, 0, size), rng: rand.New(rand.NewSource(1))}
+}
+
+func (r *reservoir) add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen++
+	if len(r.samples) < cap(r.samples) {
+		r.samples = append(r.samples, d)
+	} else if i := r.rng.Intn(r.seen); i < len(r.samples) {
+		r.samples[i] = d
+	}
+}
+
+// percentile returns the p-th (0..1) sampled duration, 0 without samples
+func (r *reservoir) percentile(p float64) time.Duration {
+	r.mu.Lock()
+	sorted := slices.Sorted(slices.Values(r.samples))
+	r.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(int(p*float64(len(sorted))), len(sorted)-1)]
+}
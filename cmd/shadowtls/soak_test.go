@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRunSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping soak in short mode")
+	}
+	cfg := SoakConfig{
+		Duration:     time.Second,
+		ShortFlows:   4,
+		BulkFlows:    1,
+		ShortMax:     2048,
+		BulkSize:     1 << 20,
+		PoolSize:     4,
+		MaxErrorRate: 0,
+	}
+	r, err := RunSoak(cfg, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ShortOK == 0 || r.BulkOK == 0 {
+		t.Errorf("no traffic got through: %+v", r)
+	}
+	if !r.Passed(cfg) {
+		t.Errorf("soak failed:%s", r.String())
+	}
+	if r.Tunnel.PoolCreated == 0 {
+		t.Error("tunnel stats not collected")
+	}
+}
+
+func TestReservoirPercentile(t *testing.T) {
+	r := newReservoir(100)
+	if r.percentile(0.5) != 0 {
+		t.Error("empty reservoir should report 0")
+	}
+	for i := 1; i <= 1000; i++ {
+		r.add(time.Duration(i) * time.Millisecond)
+	}
+	if len(r.samples) != 100 {
+		t.Fatalf("kept %d samples, want 100", len(r.samples))
+	}
+	if p := r.percentile(0.5); p < 300*time.Millisecond || p > 700*time.Millisecond {
+		t.Errorf("p50 = %v, want roughly 500ms", p)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sockBufRate is the link rate socket buffers are sized for: at 100 Mbit/s a
+// 200ms path needs 2.5MB in flight, far above typical OS defaults. The cap
+// keeps slower links from buffering more than they can use.
+const sockBufRate = 100_000_000 / 8
+
+// SocketBuffers raises SO_SNDBUF/SO_RCVBUF on tunnel connections to the
+// bandwidth-delay product of their path, up to a cap. Long intercontinental
+// paths otherwise stall on a full window well below line rate. A nil
+// SocketBuffers leaves the OS defaults alone.
+type SocketBuffers struct {
+	max    int
+	limits sockBufLimits
+	log    *logrus.Logger
+}
+
+// sockBufLimits are the OS bounds on one direction's socket buffer
+type sockBufLimits struct {
+	// Autotuning grows a buffer up to autoRcv/autoSnd on its own, as long as
+	// no size was set explicitly; zero if the OS doesn't autotune
+	autoRcv, autoSnd int
+	// An explicit size is capped at maxRcv/maxSnd without privileges; zero
+	// if the cap is unknown
+	maxRcv, maxSnd int
+}
+
+// NewSocketBuffers sizes buffers up to max bytes; returns nil if max is 0.
+// The OS limits are read here, before any chroot hides them.
+func NewSocketBuffers(max int, logger *logrus.Logger) *SocketBuffers {
+	if max <= 0 {
+		return nil
+	}
+	return &SocketBuffers{max: max, limits: socketBufferLimits(), log: logger}
+}
+
+// plan returns the receive and send buffer sizes to set for a path that
+// needs want bytes, 0 to leave a direction alone. Setting a size turns off
+// Linux's autotuning for good, so a direction is only taken over when
+// autotuning can't reach want; an explicit size then only helps if it ends
+// above the autotuning ceiling, which needs forced (privileged) sizes or a
+// high enough rmem_max/wmem_max.
+func (b *SocketBuffers) plan(want int, forced bool) (rcv, snd int) {
+	pick := func(auto, max int) int {
+		switch {
+		case auto == 0:
+			return want
+		case want <= auto:
+			return 0
+		case forced || max == 0:
+			return want
+		}
+		// Linux doubles the capped request; below the ceiling it would only
+		// shrink the buffer autotuning would have grown
+		if 2*min(want, max) <= auto {
+			return 0
+		}
+		return want
+	}
+	return pick(b.limits.autoRcv, b.limits.maxRcv), pick(b.limits.autoSnd, b.limits.maxSnd)
+}
+
+// bufferFor returns the buffer size for a path with rtt, 0 if it is unknown
+func (b *SocketBuffers) bufferFor(rtt time.Duration) int {
+	if rtt <= 0 {
+		return b.max
+	}
+	return int(min(int64(b.max), int64(rtt.Seconds()*sockBufRate)))
+}
+
+// Tune sizes conn's buffers from its measured RTT. Connections that are not
+// plain TCP, and directions autotuning already covers, are left alone.
+func (b *SocketBuffers) Tune(conn net.Conn) {
+	if b == nil {
+		return
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	rtt, _ := socketRTT(tc)
+	want := b.bufferFor(rtt)
+	rcv, snd, known := socketBufferSizes(tc)
+	setRcv, setSnd := b.plan(want, canForceSocketBuffers())
+	if known && rcv >= want {
+		setRcv = 0
+	}
+	if known && snd >= want {
+		setSnd = 0
+	}
+	if setRcv == 0 && setSnd == 0 {
+		return
+	}
+	setSocketBuffers(tc, setRcv, setSnd)
+	if b.log.IsLevelEnabled(logrus.DebugLevel) {
+		rcv, snd, known = socketBufferSizes(tc)
+		effective := "unknown"
+		if known {
+			effective = "rcv " + formatBytes(uint64(rcv), true) + ", snd " + formatBytes(uint64(snd), true)
+		}
+		b.log.Debugf("Socket buffers for %s: rtt %v, requested %s, effective %s",
+			conn.RemoteAddr(), rtt.Round(time.Millisecond), formatBytes(uint64(want), true), effective)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketRTT reads the kernel's smoothed RTT estimate, which is known on both
+// ends once the TCP handshake completes
+func socketRTT(conn *net.TCPConn) (time.Duration, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var info *unix.TCPInfo
+	raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || info.Rtt == 0 {
+		return 0, false
+	}
+	return time.Duration(info.Rtt) * time.Microsecond, true
+}
+
+// socketBufferSizes reads back the effective buffer sizes. Linux doubles the
+// requested value for bookkeeping and caps it at net.core.{r,w}mem_max.
+func socketBufferSizes(conn *net.TCPConn) (rcv, snd int, ok bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var rerr, serr error
+	raw.Control(func(fd uintptr) {
+		rcv, rerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		snd, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	return rcv, snd, rerr == nil && serr == nil
+}
+
+// socketBufferLimits reads the autotuning ceilings, the last field of
+// net.ipv4.tcp_rmem and tcp_wmem, and net.core.rmem_max/wmem_max
+func socketBufferLimits() sockBufLimits {
+	return sockBufLimits{
+		autoRcv: readSysctlInt("/proc/sys/net/ipv4/tcp_rmem"),
+		autoSnd: readSysctlInt("/proc/sys/net/ipv4/tcp_wmem"),
+		maxRcv:  readSysctlInt("/proc/sys/net/core/rmem_max"),
+		maxSnd:  readSysctlInt("/proc/sys/net/core/wmem_max"),
+	}
+}
+
+// readSysctlInt returns the last number in a sysctl file, 0 if unreadable
+func readSysctlInt(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(fields[len(fields)-1])
+	return n
+}
+
+// forceSocketBuffers remembers whether SO_RCVBUFFORCE worked, i.e. whether
+// the process has CAP_NET_ADMIN; it is probed once on a throwaway socket
+var forceSocketBuffers = sync.OnceValue(func() bool {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, 1<<20) == nil
+})
+
+// canForceSocketBuffers reports whether sizes may go past rmem_max/wmem_max
+func canForceSocketBuffers() bool {
+	return forceSocketBuffers()
+}
+
+// setSocketBuffers sets the receive and send buffers, 0 leaving one alone,
+// past rmem_max/wmem_max when the process may force them
+func setSocketBuffers(conn *net.TCPConn, rcv, snd int) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rcvOpt, sndOpt := unix.SO_RCVBUF, unix.SO_SNDBUF
+	if canForceSocketBuffers() {
+		rcvOpt, sndOpt = unix.SO_RCVBUFFORCE, unix.SO_SNDBUFFORCE
+	}
+	raw.Control(func(fd uintptr) {
+		if rcv > 0 {
+			unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, rcvOpt, rcv)
+		}
+		if snd > 0 {
+			unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, sndOpt, snd)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// socketRTT is unknown without TCP_INFO, so buffers are raised to the cap
+func socketRTT(conn *net.TCPConn) (time.Duration, bool) {
+	return 0, false
+}
+
+// socketBufferSizes can't read back effective sizes here
+func socketBufferSizes(conn *net.TCPConn) (rcv, snd int, ok bool) {
+	return 0, 0, false
+}
+
+// socketBufferLimits is unknown here; buffers don't autotune as far as we know
+func socketBufferLimits() sockBufLimits {
+	return sockBufLimits{}
+}
+
+// canForceSocketBuffers reports false: there is no forced size here
+func canForceSocketBuffers() bool {
+	return false
+}
+
+// setSocketBuffers sets the receive and send buffers, 0 leaving one alone
+func setSocketBuffers(conn *net.TCPConn, rcv, snd int) {
+	if rcv > 0 {
+		conn.SetReadBuffer(rcv)
+	}
+	if snd > 0 {
+		conn.SetWriteBuffer(snd)
+	}
+}
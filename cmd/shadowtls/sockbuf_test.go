@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocketBuffersSize(t *testing.T) {
+	b := NewSocketBuffers(4<<20, Log)
+	tests := []struct {
+		rtt  time.Duration
+		want int
+	}{
+		{200 * time.Millisecond, 2_500_000}, // Intercontinental: the full product
+		{10 * time.Millisecond, 125_000},
+		{time.Second, 4 << 20}, // Capped
+		{0, 4 << 20},           // Unknown RTT: the cap
+	}
+	for _, tt := range tests {
+		if got := b.bufferFor(tt.rtt); got != tt.want {
+			t.Errorf("bufferFor(%v) = %d, want %d", tt.rtt, got, tt.want)
+		}
+	}
+	if NewSocketBuffers(0, Log) != nil {
+		t.Error("a zero cap should disable tuning")
+	}
+}
+
+// A direction is only taken over from autotuning when an explicit size can
+// end above the ceiling autotuning would reach
+func TestSocketBuffersPlan(t *testing.T) {
+	linux := sockBufLimits{autoRcv: 6 << 20, autoSnd: 4 << 20, maxRcv: 208 << 10, maxSnd: 208 << 10}
+	tests := []struct {
+		name     string
+		limits   sockBufLimits
+		want     int
+		forced   bool
+		rcv, snd int
+	}{
+		{"autotuning reaches it", linux, 2_500_000, false, 0, 0},
+		{"rmem_max too low", linux, 8 << 20, false, 0, 0},
+		{"forced past the ceiling", linux, 8 << 20, true, 8 << 20, 8 << 20},
+		{"raised rmem_max", sockBufLimits{autoRcv: 6 << 20, autoSnd: 4 << 20, maxRcv: 16 << 20, maxSnd: 16 << 20}, 5 << 20, false, 0, 5 << 20},
+		{"no autotuning", sockBufLimits{}, 2_500_000, false, 2_500_000, 2_500_000},
+	}
+	for _, tt := range tests {
+		b := &SocketBuffers{max: 16 << 20, limits: tt.limits}
+		if rcv, snd := b.plan(tt.want, tt.forced); rcv != tt.rcv || snd != tt.snd {
+			t.Errorf("%s: plan(%d) = %d, %d; want %d, %d", tt.name, tt.want, rcv, snd, tt.rcv, tt.snd)
+		}
+	}
+}
+
+func TestSocketBuffersTune(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Loopback RTT is tiny, so the cap decides nothing and the OS default
+	// stays; tuning must not shrink it either
+	before, _, known := socketBufferSizes(conn.(*net.TCPConn))
+	NewSocketBuffers(1<<20, Log).Tune(conn)
+	after, _, _ := socketBufferSizes(conn.(*net.TCPConn))
+	if known && after < before {
+		t.Errorf("receive buffer shrank from %d to %d", before, after)
+	}
+}
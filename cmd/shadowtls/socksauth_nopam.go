@@ -0,0 +1,12 @@
+//go:build !linux || !cgo || !with_pam
+
+package main
+
+import "github.com/iprw/shadowtun/pkg/socks5"
+
+// pamSupported reports whether --socks5-auth pam is available
+const pamSupported = false
+
+func newPAMAuth(service string) (socks5.Authenticator, error) {
+	return nil, notOptedIn("PAM authentication (Linux only, needs cgo and libpam)", "with_pam")
+}
@@ -0,0 +1,131 @@
+//go:build linux && cgo && with_pam
+
+package main
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+// answerPassword answers hidden prompts with the password passed as appdata
+// and everything else with nothing
+static int answerPassword(int n, const struct pam_message **msg, struct pam_response **resp, void *appdata) {
+	struct pam_response *r = calloc(n, sizeof(struct pam_response));
+	if (r == NULL) {
+		return PAM_BUF_ERR;
+	}
+	for (int i = 0; i < n; i++) {
+		if (msg[i]->msg_style != PAM_PROMPT_ECHO_OFF) {
+			continue;
+		}
+		r[i].resp = strdup((const char *)appdata);
+		if (r[i].resp == NULL) {
+			for (int j = 0; j < i; j++) {
+				free(r[j].resp);
+			}
+			free(r);
+			return PAM_BUF_ERR;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+}
+
+// checkPassword authenticates user with password through service and checks
+// the account is usable, leaving PAM's description of a failure in errbuf
+static int checkPassword(const char *service, const char *user, const char *password, char *errbuf, size_t errlen) {
+	struct pam_conv conv = { answerPassword, (void *)password };
+	pam_handle_t *h = NULL;
+	int rc = pam_start(service, user, &conv, &h);
+	if (rc != PAM_SUCCESS) {
+		snprintf(errbuf, errlen, "pam_start: %s", pam_strerror(h, rc));
+		return rc;
+	}
+	rc = pam_authenticate(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	if (rc == PAM_SUCCESS) {
+		rc = pam_acct_mgmt(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	if (rc != PAM_SUCCESS) {
+		snprintf(errbuf, errlen, "%s", pam_strerror(h, rc));
+	}
+	pam_end(h, rc);
+	return rc;
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/iprw/shadowtun/pkg/socks5"
+)
+
+// pamSupported reports whether --socks5-auth pam is available
+const pamSupported = true
+
+// pamAuth checks SOCKS5 credentials against system accounts through a PAM
+// service
+type pamAuth struct {
+	service string
+}
+
+func newPAMAuth(service string) (socks5.Authenticator, error) {
+	return &pamAuth{service: service}, nil
+}
+
+// Authenticate runs the PAM conversation. PAM can't be interrupted, so when
+// ctx ends first the check finishes in the background and is ignored.
+func (p *pamAuth) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	// C strings end at the first NUL, which would check a different user
+	if strings.ContainsRune(username, 0) || strings.ContainsRune(password, 0) {
+		return false, nil
+	}
+	type result struct {
+		ok  bool
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ok, err := p.check(username, password)
+		done <- result{ok, err}
+	}()
+	select {
+	case r := <-done:
+		return r.ok, r.err
+	case <-ctx.Done():
+		return false, fmt.Errorf("PAM: %w", ctx.Err())
+	}
+}
+
+func (p *pamAuth) check(username, password string) (bool, error) {
+	service := C.CString(p.service)
+	defer C.free(unsafe.Pointer(service))
+	user := C.CString(username)
+	defer C.free(unsafe.Pointer(user))
+	pass := C.CString(password)
+	defer func() {
+		C.memset(unsafe.Pointer(pass), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(pass))
+	}()
+
+	var errbuf [256]C.char
+	rc := C.checkPassword(service, user, pass, &errbuf[0], C.size_t(len(errbuf)))
+	switch rc {
+	case C.PAM_SUCCESS:
+		return true, nil
+	case C.PAM_AUTH_ERR, C.PAM_USER_UNKNOWN, C.PAM_MAXTRIES, C.PAM_PERM_DENIED,
+		C.PAM_ACCT_EXPIRED, C.PAM_NEW_AUTHTOK_REQD, C.PAM_CRED_INSUFFICIENT:
+		return false, nil
+	default:
+		return false, fmt.Errorf("PAM service %s: %s", p.service, C.GoString(&errbuf[0]))
+	}
+}
+
+func (p *pamAuth) String() string {
+	return "PAM service " + p.service
+}
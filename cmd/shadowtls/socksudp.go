@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	relaypkg "github.com/iprw/shadowtun/pkg/relay"
+	"github.com/iprw/shadowtun/pkg/socks5"
+)
+
+// socksUDP follows the SOCKS5 negotiation an app runs with the server's
+// --socks5 handler and takes over a UDP ASSOCIATE. The app is given a UDP
+// port on the listener's address; its datagrams are carried to the server
+// framed on the tunnel (see socks5.UDPOverStreamHost), so they never leave
+// it and the server opens no UDP port of its own. greeting and method are
+// the greeting and method selection already exchanged, nil for those still
+// to come. Any other request is passed on unchanged and handled is false,
+// leaving the relay to the caller.
+func (c *Client) socksUDP(ctx context.Context, local, tunnel net.Conn, greeting, method []byte, info *ConnInfo) (handled bool, reason string) {
+	log := connLogger(ctx, c.relayLog)
+	deadline := time.Now().Add(socks5.DefaultNegotiationTimeout)
+	local.SetReadDeadline(deadline)
+	tunnel.SetReadDeadline(deadline)
+	defer func() {
+		if !handled {
+			local.SetReadDeadline(time.Time{})
+			tunnel.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	// pass reads one message with read from src and writes it to dst
+	pass := func(src, dst net.Conn, read func(io.Reader) ([]byte, error)) ([]byte, error) {
+		msg, err := read(src)
+		if err != nil {
+			return nil, err
+		}
+		_, err = dst.Write(msg)
+		return msg, err
+	}
+	fail := func(err error) (bool, string) {
+		log.Debugf("SOCKS5 negotiation through the tunnel failed: %v", err)
+		return true, CloseAppError
+	}
+
+	var err error
+	if greeting == nil {
+		if greeting, err = pass(local, tunnel, socks5.ReadGreeting); err != nil {
+			return fail(err)
+		}
+	}
+	// An opening that isn't exactly a greeting isn't SOCKS5, or runs ahead
+	// of the server's answers; either way it is only relayed
+	if len(greeting) < 2 || greeting[0] != socks5.Version || len(greeting) != 2+int(greeting[1]) {
+		return false, ""
+	}
+	if method == nil {
+		if method, err = pass(tunnel, local, readN(2)); err != nil {
+			return fail(err)
+		}
+	}
+	if len(method) != 2 || method[0] != socks5.Version {
+		return false, ""
+	}
+	switch method[1] {
+	case socks5.AuthNone:
+	case socks5.AuthPassword:
+		if _, err := pass(local, tunnel, socks5.ReadAuthRequest); err != nil {
+			return fail(err)
+		}
+		status, err := pass(tunnel, local, readN(2))
+		if err != nil {
+			return fail(err)
+		}
+		if status[1] != 0 {
+			return false, "" // Refused; the server closes the tunnel
+		}
+	default:
+		return false, ""
+	}
+
+	request, err := socks5.ReadAddrMessage(local)
+	if err != nil {
+		return fail(err)
+	}
+	if request[1] != socks5.CmdUDPAssociate {
+		if _, err := tunnel.Write(request); err != nil {
+			return fail(err)
+		}
+		return false, ""
+	}
+
+	// The app sends its datagrams to the address it reached the listener on
+	ip := net.IPv4(127, 0, 0, 1)
+	if addr, ok := local.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		local.Write(socks5.AppendReply(nil, socks5.RepGeneralFailure, netip.AddrPort{}))
+		return fail(fmt.Errorf("udp associate: %w", err))
+	}
+	defer udp.Close()
+
+	if _, err := tunnel.Write(socks5.AppendUDPOverStreamRequest(nil)); err != nil {
+		return fail(err)
+	}
+	reply, err := socks5.ReadAddrMessage(tunnel)
+	if err != nil {
+		return fail(err)
+	}
+	if reply[1] != socks5.RepSuccess {
+		local.Write(reply)
+		c.repeat.WarnfContext(ctx, "Server refused a SOCKS5 UDP ASSOCIATE (reply %d); it needs --socks5-udp", reply[1])
+		return true, CloseServerClosed
+	}
+	bound := udp.LocalAddr().(*net.UDPAddr).AddrPort()
+	if _, err := local.Write(socks5.AppendReply(nil, socks5.RepSuccess, bound)); err != nil {
+		return fail(err)
+	}
+	local.SetReadDeadline(time.Time{})
+	tunnel.SetReadDeadline(time.Time{})
+
+	log.Debugf("SOCKS5 UDP ASSOCIATE from %s on %s", local.RemoteAddr(), bound)
+	start := time.Now()
+	var up, down atomic.Uint64
+	reason = c.bridgeUDP(ctx, local, tunnel, udp, info, &up, &down)
+	log.Infof("UDP association closed: %d datagrams out, %d in, %v",
+		up.Load(), down.Load(), time.Since(start).Round(time.Millisecond))
+	return true, reason
+}
+
+// bridgeUDP relays the datagrams of an association between the app's UDP
+// socket and frames on the tunnel until the app's control connection or the
+// tunnel closes, or no datagram from the app arrives within the idle
+// timeout. Only datagrams from the app's IP are relayed; the first one
+// fixes its port.
+func (c *Client) bridgeUDP(ctx context.Context, local, tunnel net.Conn, udp *net.UDPConn, info *ConnInfo, up, down *atomic.Uint64) string {
+	var appIP netip.Addr
+	if addr, ok := local.RemoteAddr().(*net.TCPAddr); ok {
+		appIP = addr.AddrPort().Addr().Unmap()
+	}
+	var app atomic.Pointer[net.UDPAddr]
+	limitUp, limitDown := c.rates.ForConn()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan string, 3)
+	go func() {
+		<-ctx.Done()
+		udp.Close()
+		tunnel.Close()
+		local.Close()
+	}()
+
+	// The association lives as long as the app's control connection
+	go func() {
+		_, err := io.Copy(io.Discard, local)
+		if err != nil {
+			done <- CloseAppError
+		} else {
+			done <- CloseAppClosed
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 0xffff)
+		for {
+			datagram, err := socks5.ReadUDPFrame(tunnel, buf)
+			if err != nil {
+				done <- CloseServerClosed
+				return
+			}
+			to := app.Load()
+			if to == nil {
+				continue
+			}
+			if err := limitDown.Wait(ctx, len(datagram)); err != nil {
+				done <- CloseCancelled
+				return
+			}
+			if _, err := udp.WriteToUDP(datagram, to); err == nil {
+				down.Add(1)
+				info.BytesIn.Add(uint64(len(datagram)))
+				c.stats.AddBytes(uint64(len(datagram)))
+			}
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 2+0xffff)
+		for {
+			udp.SetReadDeadline(time.Now().Add(relaypkg.DefaultIdleTimeout))
+			n, from, err := udp.ReadFromUDP(buf[2:])
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				done <- CloseIdle
+				return
+			}
+			if err != nil {
+				done <- CloseAppError
+				return
+			}
+			if to := app.Load(); to != nil && to.AddrPort() != from.AddrPort() {
+				continue
+			} else if to == nil {
+				if !sameApp(appIP, from) {
+					continue
+				}
+				app.Store(from)
+			}
+			if err := limitUp.Wait(ctx, n); err != nil {
+				done <- CloseCancelled
+				return
+			}
+			binary.BigEndian.PutUint16(buf, uint16(n))
+			tunnel.SetWriteDeadline(time.Now().Add(relaypkg.DefaultWriteTimeout))
+			if _, err := tunnel.Write(buf[:2+n]); err != nil {
+				done <- CloseServerError
+				return
+			}
+			up.Add(1)
+			info.BytesOut.Add(uint64(n))
+			c.stats.AddBytes(uint64(n))
+		}
+	}()
+
+	reason := <-done
+	if ctx.Err() != nil {
+		reason = CloseCancelled
+	}
+	cancel()
+	return reason
+}
+
+// sameApp reports whether a datagram from addr comes from the app at ip,
+// the source of its control connection. An app on a unix socket listener
+// must be local.
+func sameApp(ip netip.Addr, addr *net.UDPAddr) bool {
+	if !ip.IsValid() {
+		return addr.IP.IsLoopback()
+	}
+	return ip == addr.AddrPort().Addr().Unmap()
+}
+
+// readN returns a reader of n-byte messages
+func readN(n int) func(io.Reader) ([]byte, error) {
+	return func(r io.Reader) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iprw/shadowtun/pkg/socks5"
+	"github.com/sirupsen/logrus"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// An app's UDP ASSOCIATE gets a local UDP port, and its datagrams reach the
+// target through the tunnel rather than a UDP port of the server
+func TestSocksUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	handler := socks5.NewHandler("", "", quiet)
+	handler.EnableUDP()
+	tunnel, server := net.Pipe()
+	defer tunnel.Close()
+	go handler.Handle(context.Background(), server)
+
+	c := NewClient(&ClientConfig{Socks5UDP: true, Logger: quiet})
+	c.relayLog = quiet
+	app, local := tcpPair(t)
+	app.SetDeadline(time.Now().Add(10 * time.Second))
+	done := make(chan string, 1)
+	go func() {
+		handled, reason := c.socksUDP(context.Background(), local, tunnel, nil, nil, c.conns.Add("app"))
+		if !handled {
+			reason = "not handled"
+		}
+		done <- reason
+	}()
+
+	app.Write([]byte{socks5.Version, 1, socks5.AuthNone})
+	if method, err := readN(2)(app); err != nil || method[1] != socks5.AuthNone {
+		t.Fatalf("method selection %v, %v", method, err)
+	}
+	app.Write([]byte{socks5.Version, socks5.CmdUDPAssociate, 0, socks5.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	reply, err := socks5.ReadAddrMessage(app)
+	if err != nil || reply[1] != 0 || reply[3] != socks5.AtypIPv4 {
+		t.Fatalf("reply %v, %v; want success with an IPv4 address", reply, err)
+	}
+	bound := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+	if !bound.IP.IsLoopback() || bound.Port == 0 {
+		t.Fatalf("bound %v, want a port on the listener's address", bound)
+	}
+
+	udp, err := net.DialUDP("udp", nil, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(10 * time.Second))
+	target := echo.LocalAddr().(*net.UDPAddr).AddrPort()
+	header := []byte{0, 0, 0, socks5.AtypIPv4, 127, 0, 0, 1}
+	header = binary.BigEndian.AppendUint16(header, target.Port())
+	if _, err := udp.Write(append(header, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], append(header, "HELLO"...)) {
+		t.Errorf("reply datagram %q, want the echo's header and HELLO", buf[:n])
+	}
+	if s := handler.Stats(); s.UDPAssociations != 1 || s.UDPSessions != 1 {
+		t.Errorf("server stats %+v, want the association carried to it", s)
+	}
+
+	app.Close()
+	if reason := <-done; reason != CloseAppClosed {
+		t.Errorf("association ended with %q, want %q", reason, CloseAppClosed)
+	}
+}
+
+// Other commands pass through untouched for the relay to carry
+func TestSocksUDPPassesConnect(t *testing.T) {
+	c := NewClient(&ClientConfig{Socks5UDP: true})
+	app, local := tcpPair(t)
+	tunnel, server := net.Pipe()
+	defer tunnel.Close()
+	defer server.Close()
+
+	request := []byte{socks5.Version, 1, 0, socks5.AtypDomain, 3, 'a', '.', 'b', 0, 80}
+	go app.Write(request)
+	got := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, len(request))
+		io.ReadFull(server, b)
+		got <- b
+	}()
+
+	greeting := []byte{socks5.Version, 1, socks5.AuthNone}
+	method := []byte{socks5.Version, socks5.AuthNone}
+	if handled, _ := c.socksUDP(context.Background(), local, tunnel, greeting, method, nil); handled {
+		t.Fatal("CONNECT was taken over")
+	}
+	if b := <-got; !bytes.Equal(b, request) {
+		t.Errorf("server got %v, want the request %v", b, request)
+	}
+
+	// An opening that isn't a lone greeting is left alone
+	if handled, _ := c.socksUDP(context.Background(), local, tunnel, []byte("GET / HTTP/1.1\r\n"), nil, nil); handled {
+		t.Error("HTTP opening was taken over")
+	}
+}
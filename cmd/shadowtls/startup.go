@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// StartupEvent is the machine-readable "started" record written once the
+// listener is up, so deployment tooling can verify the resolved configuration
+type StartupEvent struct {
+	Event   string    `json:"event"` // Always "started"
+	Time    time.Time `json:"time"`
+	Version string    `json:"version"`
+	Mode    string    `json:"mode"`
+	PID     int       `json:"pid"`
+	Listen  []string  `json:"listen"`
+
+	// Client mode
+	Server      string       `json:"server,omitempty"`
+	ServerIPs   []string     `json:"server_ips,omitempty"` // All resolved addresses
+	ServerIP    string       `json:"server_ip,omitempty"`  // Address the dialer tries first
+	SNI         string       `json:"sni,omitempty"`
+	Fingerprint string       `json:"fingerprint,omitempty"`
+	Pool        *StartupPool `json:"pool,omitempty"`
+	Admin       string       `json:"admin,omitempty"`
+
+	// Server mode
+	Forward     string `json:"forward,omitempty"`
+	Upstream    string `json:"upstream,omitempty"` // Next ShadowTLS hop of a bridge
+	Socks5      bool   `json:"socks5,omitempty"`
+	Handshake   string `json:"handshake,omitempty"`
+	WildcardSNI bool   `json:"wildcard_sni,omitempty"`
+
+	// Server timeouts
+	SessionTimeout    string `json:"session_timeout,omitempty"`
+	IdleTimeout       string `json:"idle_timeout,omitempty"`
+	FirstFrameTimeout string `json:"first_frame_timeout,omitempty"`
+}
+
+// StartupPool describes the client connection pool parameters
+type StartupPool struct {
+	Size    int    `json:"size"`
+	Max     int    `json:"max,omitempty"`
+	Refill  string `json:"refill"`
+	TTL     string `json:"ttl"`
+	Backoff string `json:"backoff"`
+	Timeout string `json:"timeout"`
+}
+
+// newStartupEvent fills in the fields common to both modes
+func newStartupEvent(mode string, listen ...string) StartupEvent {
+	return StartupEvent{
+		Event:   "started",
+		Time:    time.Now().UTC(),
+		Version: Version(),
+		Mode:    mode,
+		PID:     os.Getpid(),
+		Listen:  listen,
+	}
+}
+
+// resolveServer looks up the server host as the dialer will. The first
+// address is the one tried first; lookup failures leave both empty.
+func resolveServer(server string) (chosen string, all []string) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), []string{ip.String()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return "", nil
+	}
+	for _, addr := range addrs {
+		all = append(all, addr.IP.String())
+	}
+	return all[0], all
+}
+
+// WriteStartupEvent writes ev as a single JSON line to path, or stdout for "-"
+func WriteStartupEvent(path string, ev StartupEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write startup event to %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStartupEvent(t *testing.T) {
+	ev := newStartupEvent("client", "127.0.0.1:1080")
+	ev.Server = "192.0.2.1:443"
+	ev.ServerIP, ev.ServerIPs = resolveServer(ev.Server)
+	ev.Pool = &StartupPool{Size: 10, Refill: "adaptive", TTL: "10s", Backoff: "5s", Timeout: "10s"}
+
+	path := filepath.Join(t.TempDir(), "started.json")
+	if err := WriteStartupEvent(path, ev); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", data, err)
+	}
+	if got["event"] != "started" || got["mode"] != "client" {
+		t.Errorf("event/mode = %v/%v", got["event"], got["mode"])
+	}
+	if got["server_ip"] != "192.0.2.1" {
+		t.Errorf("server_ip = %v, want 192.0.2.1", got["server_ip"])
+	}
+	if pool, ok := got["pool"].(map[string]any); !ok || pool["size"] != float64(10) {
+		t.Errorf("pool = %v", got["pool"])
+	}
+	if _, ok := got["forward"]; ok {
+		t.Error("server-only fields should be omitted in client mode")
+	}
+}
@@ -33,18 +33,37 @@ type Stats struct {
 	PoolCreated   atomic.Uint64 // Connections created by pool workers
 	PoolExpired   atomic.Uint64 // Connections expired (TTL) when retrieved from pool
 	PoolFailed    atomic.Uint64 // Connection creation failures
+	PoolCancelled atomic.Uint64 // Dials abandoned on shutdown, not counted in PoolFailed
 	PoolDiscarded atomic.Uint64 // Connections discarded by workers (pool full for TTL duration)
 	PoolStale     atomic.Uint64 // Connections that failed write/read verification
+	VerifySplit   atomic.Uint64 // First responses that arrived split and were merged
 	PoolWaitTime  atomic.Int64  // Total time spent waiting for pool (nanoseconds)
 	PoolWaitCount atomic.Uint64 // Number of pool waits
 	PoolHits      atomic.Uint64 // Got connection from pool
+	PoolReturned  atomic.Uint64 // Unused tunnels put back into the pool
 	PoolMisses    atomic.Uint64 // Had to create new connection (pool empty)
+	PoolRefill    atomic.Int64  // Workers currently allowed to refill the pool
+	PoolTTL       atomic.Int64  // Current idle connection TTL (nanoseconds)
+	PoolMax       atomic.Int64  // Size adaptive sizing may grow the pool to (--pool-max), 0 = fixed
+	PoolResizes   atomic.Uint64 // Times adaptive sizing grew or shrank the pool
+	CaptivePortal atomic.Bool   // A captive portal is blocking the network
+
+	// Pool worker connect failures by layer, indexed by ConnectFailure
+	ConnectFailed [numConnectFailures]atomic.Uint64
 
 	// Connection stats
-	ActiveConns atomic.Int64  // Currently active connections
-	TotalConns  atomic.Uint64 // Total connections handled
-	TotalBytes  atomic.Uint64 // Total bytes transferred
-	ConnErrors  atomic.Uint64 // Connection errors during relay
+	ActiveConns        atomic.Int64  // Currently active connections
+	TotalConns         atomic.Uint64 // Total connections handled
+	TotalBytes         atomic.Uint64 // Total bytes transferred
+	ConnErrors         atomic.Uint64 // Connection errors during relay
+	ConnsHeld          atomic.Uint64 // Connections held for the server to recover (--retry-hold)
+	ConnsHeldRecovered atomic.Uint64 // ...of which got a tunnel in time
+
+	// In-band pings through pooled tunnels (--ping-interval)
+	Pings      atomic.Uint64
+	PingFailed atomic.Uint64
+	PingRTT    atomic.Int64  // Last answered round trip (nanoseconds)
+	PanicCount atomic.Uint64 // Recovered panics in pool workers and connection handlers
 
 	// Timing stats (stored as nanoseconds)
 	ConnectTimeTotal atomic.Int64  // Total connection establishment time
@@ -64,6 +83,36 @@ type Stats struct {
 	PoolAgeMin   atomic.Int64  // Minimum pool age
 	PoolAgeMax   atomic.Int64  // Maximum pool age
 
+	// Connect RTT distribution shift detection
+	Path *PathHealth
+
+	// Dial stage timings, telling a down server from a blocking decoy
+	Decoy *DecoyHealth
+
+	// Reconnect storm detection and pacing
+	Storm *StormDetector
+
+	// Detection of tunnels that take data and never answer
+	Blackhole *BlackholeDetector
+
+	// Server failover, nil until the client starts
+	Servers *ServerSet
+
+	// SNI rotation, nil until the client starts
+	SNIs *SNISet
+
+	// Stream multiplexing, nil without --mux
+	Mux *MuxDialer
+
+	// Approximate memory held by buffers and connection state
+	Mem *MemBudget
+
+	// Concurrent handshake limit, nil when unlimited
+	Handshakes *HandshakeLimiter
+
+	// New handshakes per second limit, nil when unlimited
+	HandshakeRate *HandshakeRate
+
 	// Start time
 	startTime time.Time
 
@@ -74,6 +123,11 @@ type Stats struct {
 // NewStats creates a new stats tracker
 func NewStats() *Stats {
 	s := &Stats{
+		Path:      NewPathHealth(),
+		Decoy:     NewDecoyHealth(),
+		Storm:     NewStormDetector(0),
+		Blackhole: NewBlackholeDetector(""),
+		Mem:       NewMemBudget(0),
 		startTime: time.Now(),
 	}
 	// Initialize min values to max int64
@@ -90,6 +144,7 @@ func (s *Stats) RecordConnectTime(d time.Duration) {
 	s.ConnectTimeCount.Add(1)
 	atomicMin(&s.ConnectTimeMin, ns)
 	atomicMax(&s.ConnectTimeMax, ns)
+	s.Path.Record(d)
 }
 
 // RecordConnLifetime records how long a connection was used
@@ -143,10 +198,18 @@ type StatsSnapshot struct {
 	PoolCreated   uint64
 	PoolExpired   uint64
 	PoolFailed    uint64
+	PoolCancelled uint64
 	PoolDiscarded uint64
 	PoolStale     uint64
+	VerifySplit   uint64
 	PoolHits      uint64
+	PoolReturned  uint64
 	PoolMisses    uint64
+	PoolRefill    int64
+	PoolTTL       time.Duration
+	PoolMax       int64
+	PoolResizes   uint64
+	CaptivePortal bool
 	PoolHitRate   float64
 	PoolAvgWait   time.Duration
 
@@ -156,6 +219,14 @@ type StatsSnapshot struct {
 	TotalConns  uint64
 	TotalBytes  uint64
 	ConnErrors  uint64
+	Panics      uint64
+	Held        uint64
+	HeldOK      uint64
+
+	// Pings
+	Pings      uint64
+	PingFailed uint64
+	PingRTT    time.Duration
 
 	// Connection timing
 	AvgConnectTime time.Duration
@@ -171,6 +242,37 @@ type StatsSnapshot struct {
 	AvgPoolAge time.Duration
 	MinPoolAge time.Duration
 	MaxPoolAge time.Duration
+
+	// Path health
+	Path PathHealthSnapshot
+
+	// Dial stages
+	Decoy DecoyHealthSnapshot
+
+	// Reconnect storms
+	Storm StormSnapshot
+
+	// Blackholing
+	Blackhole BlackholeSnapshot
+
+	// Server failover
+	Servers ServerSetSnapshot
+
+	// SNI rotation
+	SNI SNISetSnapshot
+
+	// Stream multiplexing
+	Mux MuxSnapshot
+
+	// Memory accounting
+	Mem MemSnapshot
+
+	// Handshake limiting
+	Handshakes    HandshakeSnapshot
+	HandshakeRate HandshakeRateSnapshot
+
+	// Connect failures by layer
+	Failures ConnectFailures
 }
 
 // Snapshot creates a stats snapshot
@@ -182,15 +284,48 @@ func (s *Stats) Snapshot(poolAvail, poolSize int) StatsSnapshot {
 		PoolCreated:   s.PoolCreated.Load(),
 		PoolExpired:   s.PoolExpired.Load(),
 		PoolFailed:    s.PoolFailed.Load(),
+		PoolCancelled: s.PoolCancelled.Load(),
 		PoolDiscarded: s.PoolDiscarded.Load(),
 		PoolStale:     s.PoolStale.Load(),
+		VerifySplit:   s.VerifySplit.Load(),
 		PoolHits:      s.PoolHits.Load(),
+		PoolReturned:  s.PoolReturned.Load(),
 		PoolMisses:    s.PoolMisses.Load(),
+		PoolRefill:    s.PoolRefill.Load(),
+		PoolTTL:       time.Duration(s.PoolTTL.Load()),
+		PoolMax:       s.PoolMax.Load(),
+		PoolResizes:   s.PoolResizes.Load(),
+		CaptivePortal: s.CaptivePortal.Load(),
 		ActiveConns:   s.ActiveConns.Load(),
 		PeakConns:     s.peakActiveConns.Load(),
 		TotalConns:    s.TotalConns.Load(),
 		TotalBytes:    s.TotalBytes.Load(),
 		ConnErrors:    s.ConnErrors.Load(),
+		Panics:        s.PanicCount.Load(),
+		Held:          s.ConnsHeld.Load(),
+		HeldOK:        s.ConnsHeldRecovered.Load(),
+		Pings:         s.Pings.Load(),
+		PingFailed:    s.PingFailed.Load(),
+		PingRTT:       time.Duration(s.PingRTT.Load()),
+		Path:          s.Path.Snapshot(),
+		Decoy:         s.Decoy.Snapshot(),
+		Storm:         s.Storm.Snapshot(),
+		Blackhole:     s.Blackhole.Snapshot(),
+		Servers:       s.Servers.Snapshot(),
+		SNI:           s.SNIs.Snapshot(),
+		Mux:           s.Mux.Snapshot(),
+		Mem:           s.Mem.Snapshot(),
+		Handshakes:    s.Handshakes.Snapshot(),
+		HandshakeRate: s.HandshakeRate.Snapshot(),
+		Failures: ConnectFailures{
+			DNS:       s.ConnectFailed[FailDNS].Load(),
+			Refused:   s.ConnectFailed[FailRefused].Load(),
+			Timeout:   s.ConnectFailed[FailTimeout].Load(),
+			Handshake: s.ConnectFailed[FailHandshake].Load(),
+			Auth:      s.ConnectFailed[FailAuth].Load(),
+			Intercept: s.ConnectFailed[FailIntercept].Load(),
+			Other:     s.ConnectFailed[FailOther].Load(),
+		},
 	}
 
 	// Calculate hit rate
@@ -251,37 +386,116 @@ func (snap StatsSnapshot) String() string {
 			snap.MaxPoolAge.Round(time.Millisecond))
 	}
 
+	pingStr := "n/a"
+	if snap.Pings+snap.PingFailed > 0 {
+		pingStr = fmt.Sprintf("last=%v ok=%d failed=%d", snap.PingRTT.Round(time.Millisecond), snap.Pings, snap.PingFailed)
+	}
+
+	pathStr := fmt.Sprintf("score=%d", snap.Path.Score)
+	if snap.Path.Baseline > 0 {
+		pathStr += fmt.Sprintf(" recent=%v baseline=%v",
+			snap.Path.Recent.Round(time.Millisecond),
+			snap.Path.Baseline.Round(time.Millisecond))
+	}
+	if snap.Path.Degraded {
+		pathStr += " DEGRADED"
+	}
+	pathStr += fmt.Sprintf(" events=%d", snap.Path.Events)
+
+	stagesStr := "n/a"
+	if snap.Decoy.TCP > 0 || snap.Decoy.Failed > 0 {
+		stagesStr = fmt.Sprintf("dns=%v tcp=%v tls=%v", snap.Decoy.DNS.Round(time.Millisecond),
+			snap.Decoy.TCP.Round(time.Millisecond), snap.Decoy.TLS.Round(time.Millisecond))
+		if snap.Decoy.TLSBaseline > 0 {
+			stagesStr += fmt.Sprintf(" (baseline %v)", snap.Decoy.TLSBaseline.Round(time.Millisecond))
+		}
+		stagesStr += fmt.Sprintf(" decoy=%s tls_failed=%d events=%d", snap.Decoy.State, snap.Decoy.Failed, snap.Decoy.Events)
+	}
+
+	memStr := fmt.Sprintf("estimate=%s heap=%s", formatBytes(uint64(snap.Mem.Estimate), true), formatBytes(uint64(snap.Mem.Heap), true))
+	if snap.Mem.Limit > 0 {
+		memStr += fmt.Sprintf(" limit=%s shed=%d", formatBytes(uint64(snap.Mem.Limit), true), snap.Mem.Shed)
+	}
+
+	stormStr := fmt.Sprintf("%d (%d connections paced)", snap.Storm.Storms, snap.Storm.Paced)
+	if snap.Storm.Active {
+		stormStr += " ACTIVE"
+	}
+
+	poolStatus := ""
+	if snap.CaptivePortal {
+		poolStatus = "\n  CAPTIVE PORTAL: log in to the network to resume"
+	}
+	if snap.PoolMax > 0 {
+		poolStatus += fmt.Sprintf("\n  Adaptive size: up to %d, resized %d times", snap.PoolMax, snap.PoolResizes)
+	}
+	if snap.Servers.Servers > 1 {
+		poolStatus += fmt.Sprintf("\n  Server: %s of %d, %d failovers", snap.Servers.Active, snap.Servers.Servers, snap.Servers.Failovers)
+		if len(snap.Servers.Down) > 0 {
+			poolStatus += ", down: " + strings.Join(snap.Servers.Down, ", ")
+		}
+	}
+	if snap.SNI.Hosts > 1 || len(snap.SNI.Down) > 0 {
+		poolStatus += fmt.Sprintf("\n  SNI: %d hosts, %d removals", snap.SNI.Hosts, snap.SNI.Removals)
+		if len(snap.SNI.Down) > 0 {
+			poolStatus += ", out of rotation: " + strings.Join(snap.SNI.Down, ", ")
+		}
+	}
+	if snap.Mux.Established > 0 || snap.Mux.Failed > 0 {
+		poolStatus += fmt.Sprintf("\n  Mux: %d sessions carrying %d streams, %d opened, %d sessions failed", snap.Mux.Sessions, snap.Mux.Streams, snap.Mux.Opened, snap.Mux.Failed)
+	}
+	if snap.Blackhole.Suspected {
+		poolStatus += "\n  POSSIBLE INTERFERENCE: new tunnels take data but the server never answers"
+	}
+
 	return fmt.Sprintf(`
 === Tunnel Statistics ===
 Uptime: %v
 
 Pool:
-  Size: %d, Available: %d
-  Created: %d, Reused: %d (%.1f%% hit rate)
-  Expired: %d, Failed: %d, Discarded: %d, Stale: %d
-  Avg wait: %v
+  Size: %d, Available: %d, Refilling: %d, TTL: %v%s
+  Created: %d, Reused: %d (%.1f%% hit rate), Returned: %d
+  Expired: %d, Failed: %d, Cancelled: %d, Discarded: %d, Stale: %d (%d fresh ones silent, %d blackhole events)
+  Failures: %s
+  Avg wait: %v, Handshakes: %d running, %d waiting (avg slot wait %v), %d paced by --handshake-rate (avg %v)
 
 Connections:
   Active: %d, Peak: %d, Total: %d
-  Errors: %d
+  Errors: %d, Panics: %d, Split greetings merged: %d
+  Held for the server: %d (%d recovered)
+  Reconnect storms: %s
   Bytes transferred: %s
+  Memory: %s
 
 Timing:
   Connect RTT:   %s
   Conn lifetime: %s
   Pool age:      %s
+  Ping:          %s
+  Path health:   %s
+  Dial stages:   %s
 `,
 		snap.Uptime.Round(time.Second),
-		snap.PoolSize, snap.PoolAvailable,
-		snap.PoolCreated, snap.PoolHits, snap.PoolHitRate,
-		snap.PoolExpired, snap.PoolFailed, snap.PoolDiscarded, snap.PoolStale,
+		snap.PoolSize, snap.PoolAvailable, snap.PoolRefill, snap.PoolTTL.Round(time.Millisecond), poolStatus,
+		snap.PoolCreated, snap.PoolHits, snap.PoolHitRate, snap.PoolReturned,
+		snap.PoolExpired, snap.PoolFailed, snap.PoolCancelled, snap.PoolDiscarded, snap.PoolStale,
+		snap.Blackhole.Silent, snap.Blackhole.Events,
+		snap.Failures,
 		snap.PoolAvgWait.Round(time.Millisecond),
+		snap.Handshakes.Active, snap.Handshakes.Queued, snap.Handshakes.AvgWait.Round(time.Millisecond),
+		snap.HandshakeRate.Delayed, snap.HandshakeRate.AvgDelay.Round(time.Millisecond),
 		snap.ActiveConns, snap.PeakConns, snap.TotalConns,
-		snap.ConnErrors,
+		snap.ConnErrors, snap.Panics, snap.VerifySplit,
+		snap.Held, snap.HeldOK,
+		stormStr,
 		formatBytes(snap.TotalBytes, false),
+		memStr,
 		rttStr,
 		lifetimeStr,
 		poolAgeStr,
+		pingStr,
+		pathStr,
+		stagesStr,
 	)
 }
 
@@ -300,21 +514,60 @@ func (snap StatsSnapshot) Log() {
 
 	// Only show non-zero problem counters
 	var problems string
-	parts := make([]string, 0, 3)
+	parts := make([]string, 0, 5)
 	if snap.ConnErrors > 0 {
 		parts = append(parts, fmt.Sprintf("err=%d", snap.ConnErrors))
 	}
+	if snap.Panics > 0 {
+		parts = append(parts, fmt.Sprintf("panic=%d", snap.Panics))
+	}
+	if snap.Held > 0 {
+		parts = append(parts, fmt.Sprintf("held=%d/%d", snap.HeldOK, snap.Held))
+	}
 	if snap.PoolStale > 0 {
 		parts = append(parts, fmt.Sprintf("stale=%d", snap.PoolStale))
 	}
 	if snap.PoolFailed > 0 {
 		parts = append(parts, fmt.Sprintf("fail=%d", snap.PoolFailed))
 	}
+	if snap.PingFailed > 0 {
+		parts = append(parts, fmt.Sprintf("ping_fail=%d", snap.PingFailed))
+	}
+	if snap.Path.Degraded {
+		parts = append(parts, fmt.Sprintf("path=%d", snap.Path.Score))
+	}
+	if snap.Decoy.State != DecoyOK {
+		parts = append(parts, "decoy="+strings.ReplaceAll(snap.Decoy.State.String(), " ", "_"))
+	}
+	if snap.CaptivePortal {
+		parts = append(parts, "portal")
+	}
+	if snap.Storm.Active {
+		parts = append(parts, "storm")
+	}
+	if snap.Blackhole.Suspected {
+		parts = append(parts, "blackhole")
+	}
+	if len(snap.Servers.Down) > 0 {
+		parts = append(parts, fmt.Sprintf("down=%d/%d", len(snap.Servers.Down), snap.Servers.Servers))
+	}
+	if len(snap.SNI.Down) > 0 {
+		parts = append(parts, fmt.Sprintf("sni_down=%d/%d", len(snap.SNI.Down), snap.SNI.Hosts))
+	}
+	if snap.Mux.Established > 0 {
+		parts = append(parts, fmt.Sprintf("mux=%d/%d", snap.Mux.Streams, snap.Mux.Sessions))
+	}
+	if snap.Mem.Shed > 0 {
+		parts = append(parts, fmt.Sprintf("shed=%d", snap.Mem.Shed))
+	}
+	if snap.PoolRefill < int64(snap.PoolSize) {
+		parts = append(parts, fmt.Sprintf("refill=%d/%d", snap.PoolRefill, snap.PoolSize))
+	}
 	if len(parts) > 0 {
 		problems = " [" + strings.Join(parts, " ") + "]"
 	}
 
-	Log.Infof("[STATS] active=%d peak=%d total=%d pool=%d/%d hit=%.0f%% rtt=%v life=%v age=%v bytes=%s (%s)%s",
+	ModuleLogger("stats").Infof("[STATS] active=%d peak=%d total=%d pool=%d/%d hit=%.0f%% rtt=%v life=%v age=%v bytes=%s (%s)%s",
 		snap.ActiveConns, snap.PeakConns, snap.TotalConns,
 		snap.PoolAvailable, snap.PoolSize,
 		snap.PoolHitRate,
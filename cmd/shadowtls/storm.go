@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// stormWindow is the period over which local accepts are counted
+	stormWindow = time.Second
+	// stormMinAccepts is the smallest burst per window that counts as a storm
+	stormMinAccepts = 50
+	// stormFactor is how far above the usual accept rate a window must be
+	stormFactor = 5.0
+	// stormQuietWindows is how many calm windows in a row end a storm
+	stormQuietWindows = 3
+	// stormBaselineWeight is the weight of each calm window in the baseline average
+	stormBaselineWeight = 0.1
+
+	// DefaultStormPacing is the default for --storm-pacing: off, since the
+	// delay also falls on connections a warm pool could serve at once
+	DefaultStormPacing = 0
+)
+
+// StormDetector spots reconnect storms, when many local apps reconnect at once
+// (e.g. after a tunnel blip), and spreads the connections accepted during one
+// over a random delay so the pool and server aren't hit all at once
+type StormDetector struct {
+	spread time.Duration // Longest pacing delay, 0 to only detect
+	log    *logrus.Logger
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int     // Accepts in the current window
+	baseline    float64 // Average accepts per calm window
+	active      bool
+	quiet       int // Calm windows since the storm peaked
+	started     time.Time
+	stormConns  uint64 // Accepts during the current storm
+	storms      uint64
+	paced       uint64
+}
+
+// StormSnapshot is a point-in-time view of storm detection
+type StormSnapshot struct {
+	Active bool
+	Storms uint64 // Storms seen
+	Paced  uint64 // Connections delayed by pacing
+}
+
+// NewStormDetector creates a detector pacing storm connections over up to spread
+func NewStormDetector(spread time.Duration) *StormDetector {
+	return &StormDetector{
+		spread: spread,
+		log:    ModuleLogger("stats"),
+	}
+}
+
+// Accept records a new local connection and returns how long to wait before
+// serving it: zero outside a storm
+func (d *StormDetector) Accept() time.Duration {
+	return d.accept(time.Now())
+}
+
+func (d *StormDetector) accept(now time.Time) time.Duration {
+	d.mu.Lock()
+	d.roll(now)
+	d.count++
+	if !d.active && d.count >= d.threshold() {
+		d.active = true
+		d.quiet = 0
+		d.started = now
+		d.stormConns = uint64(d.count)
+		d.storms++
+		d.log.Warnf("[STORM] Reconnect storm: %d local connections in %v (usually %.1f); pacing new ones over up to %v",
+			d.count, stormWindow, d.baseline, d.spread)
+	} else if d.active {
+		d.stormConns++
+	}
+	pace := d.active && d.spread > 0
+	if pace {
+		d.paced++
+	}
+	d.mu.Unlock()
+
+	if !pace {
+		return 0
+	}
+	return rand.N(d.spread)
+}
+
+// threshold is the accept count that makes a window a storm
+func (d *StormDetector) threshold() int {
+	return max(stormMinAccepts, int(math.Ceil(stormFactor*d.baseline)))
+}
+
+// roll closes the windows that ended before now
+func (d *StormDetector) roll(now time.Time) {
+	if d.windowStart.IsZero() {
+		d.windowStart = now
+		return
+	}
+	elapsed := int(now.Sub(d.windowStart) / stormWindow)
+	if elapsed <= 0 {
+		return
+	}
+	d.closeWindow(d.count)
+	// Windows without any accept are calm; the ones past the first few
+	// change nothing more worth a loop
+	for range min(elapsed-1, 100) {
+		d.closeWindow(0)
+	}
+	d.count = 0
+	d.windowStart = d.windowStart.Add(time.Duration(elapsed) * stormWindow)
+}
+
+func (d *StormDetector) closeWindow(count int) {
+	if !d.active {
+		d.baseline += stormBaselineWeight * (float64(count) - d.baseline)
+		return
+	}
+	if count >= d.threshold() {
+		d.quiet = 0
+		return
+	}
+	if d.quiet++; d.quiet >= stormQuietWindows {
+		d.active = false
+		d.log.Warnf("[STORM] Reconnect storm over after %v: %d local connections",
+			d.windowStart.Add(stormWindow).Sub(d.started).Round(time.Second), d.stormConns)
+	}
+}
+
+// Snapshot returns the current storm state and counters
+func (d *StormDetector) Snapshot() StormSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(time.Now())
+	return StormSnapshot{Active: d.active, Storms: d.storms, Paced: d.paced}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStormDetector(t *testing.T) {
+	d := NewStormDetector(100 * time.Millisecond)
+	now := time.Now()
+
+	// A steady trickle sets the baseline and is never paced
+	for i := range 30 {
+		for range 3 {
+			if pace := d.accept(now.Add(time.Duration(i) * stormWindow)); pace != 0 {
+				t.Fatalf("paced %v outside a storm", pace)
+			}
+		}
+	}
+	if snap := d.Snapshot(); snap.Active || snap.Storms != 0 {
+		t.Fatalf("storm reported for a steady rate: %+v", snap)
+	}
+
+	// A burst well above it is a storm; connections from then on are paced
+	burst := now.Add(30 * stormWindow)
+	paced := 0
+	for range stormMinAccepts + 10 {
+		pace := d.accept(burst)
+		if pace < 0 || pace >= 100*time.Millisecond {
+			t.Fatalf("pace %v outside [0, spread)", pace)
+		}
+		if pace > 0 {
+			paced++
+		}
+	}
+	snap := d.Snapshot()
+	if !snap.Active || snap.Storms != 1 {
+		t.Fatalf("burst not reported as a storm: %+v", snap)
+	}
+	if snap.Paced != 11 || paced == 0 {
+		t.Errorf("paced %d (%d with a delay), want 11", snap.Paced, paced)
+	}
+
+	// Calm windows end it
+	d.accept(burst.Add(stormQuietWindows * stormWindow))
+	if d.accept(burst.Add((stormQuietWindows+1)*stormWindow)) != 0 || d.Snapshot().Active {
+		t.Error("storm still active after calm windows")
+	}
+}
+
+func TestStormDetectorWithoutPacing(t *testing.T) {
+	d := NewStormDetector(0)
+	now := time.Now()
+	for range stormMinAccepts * 2 {
+		if pace := d.accept(now); pace != 0 {
+			t.Fatalf("paced %v with pacing off", pace)
+		}
+	}
+	if snap := d.Snapshot(); !snap.Active || snap.Paced != 0 {
+		t.Errorf("snapshot = %+v, want an active storm with nothing paced", snap)
+	}
+}
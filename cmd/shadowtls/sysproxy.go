@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// ApplySystemProxy points the OS proxy settings at the SOCKS listener and
+// returns a func that restores the previous settings
+func ApplySystemProxy(listen string) (revert func() error, err error) {
+	host, port, err := net.SplitHostPort(localProxyAddr(listen))
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %v", listen, err)
+	}
+	return applySystemProxy(host, port)
+}
+
+// runCommand runs an external tool and returns its trimmed output
+func runCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
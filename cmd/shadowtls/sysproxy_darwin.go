@@ -0,0 +1,77 @@
+//go:build !no_sysproxy
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// systemProxySupported reports whether --apply-system-proxy works on this platform
+const systemProxySupported = true
+
+// macSocksProxy is one network service's SOCKS proxy setting
+type macSocksProxy struct {
+	service string
+	enabled bool
+	server  string
+	port    string
+}
+
+// applySystemProxy sets the SOCKS proxy of every enabled network service via networksetup
+func applySystemProxy(host, port string) (func() error, error) {
+	out, err := runCommand("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []macSocksProxy
+	lines := strings.Split(out, "\n")
+	for _, service := range lines[1:] { // First line is an explanatory header
+		service = strings.TrimSpace(service)
+		if service == "" || strings.HasPrefix(service, "*") { // "*" marks disabled services
+			continue
+		}
+		prev := macSocksProxy{service: service}
+		if cur, err := runCommand("networksetup", "-getsocksfirewallproxy", service); err == nil {
+			for _, line := range strings.Split(cur, "\n") {
+				key, value, _ := strings.Cut(line, ":")
+				switch strings.TrimSpace(key) {
+				case "Enabled":
+					prev.enabled = strings.TrimSpace(value) == "Yes"
+				case "Server":
+					prev.server = strings.TrimSpace(value)
+				case "Port":
+					prev.port = strings.TrimSpace(value)
+				}
+			}
+		}
+		if _, err := runCommand("networksetup", "-setsocksfirewallproxy", service, host, port); err != nil {
+			revertMacProxies(saved)
+			return nil, err
+		}
+		saved = append(saved, prev)
+		if _, err := runCommand("networksetup", "-setsocksfirewallproxystate", service, "on"); err != nil {
+			revertMacProxies(saved)
+			return nil, err
+		}
+	}
+
+	return func() error { return revertMacProxies(saved) }, nil
+}
+
+func revertMacProxies(saved []macSocksProxy) error {
+	var errs []error
+	for _, prev := range saved {
+		if prev.enabled && prev.server != "" {
+			if _, err := runCommand("networksetup", "-setsocksfirewallproxy", prev.service, prev.server, prev.port); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if _, err := runCommand("networksetup", "-setsocksfirewallproxystate", prev.service, "off"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
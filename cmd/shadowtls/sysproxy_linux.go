@@ -0,0 +1,57 @@
+//go:build !no_sysproxy
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// systemProxySupported reports whether --apply-system-proxy works on this platform
+const systemProxySupported = true
+
+// gnomeProxyKeys are the gsettings keys changed, in the order they are applied
+var gnomeProxyKeys = [][2]string{
+	{"org.gnome.system.proxy.socks", "host"},
+	{"org.gnome.system.proxy.socks", "port"},
+	{"org.gnome.system.proxy", "mode"},
+}
+
+// applySystemProxy sets the GNOME SOCKS proxy via gsettings. Values are saved
+// in their GVariant text form so they can be written back verbatim.
+func applySystemProxy(host, port string) (func() error, error) {
+	if _, err := exec.LookPath("gsettings"); err != nil {
+		return nil, fmt.Errorf("gsettings not found: only GNOME proxy settings are supported on Linux")
+	}
+
+	saved := make([]string, len(gnomeProxyKeys))
+	for i, key := range gnomeProxyKeys {
+		value, err := runCommand("gsettings", "get", key[0], key[1])
+		if err != nil {
+			return nil, err
+		}
+		saved[i] = value
+	}
+
+	values := []string{host, port, "manual"}
+	for i, key := range gnomeProxyKeys {
+		if _, err := runCommand("gsettings", "set", key[0], key[1], values[i]); err != nil {
+			revertGnomeProxy(saved)
+			return nil, err
+		}
+	}
+
+	return func() error { return revertGnomeProxy(saved) }, nil
+}
+
+func revertGnomeProxy(saved []string) error {
+	var errs []error
+	for i := len(gnomeProxyKeys) - 1; i >= 0; i-- {
+		key := gnomeProxyKeys[i]
+		if _, err := runCommand("gsettings", "set", key[0], key[1], saved[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,10 @@
+//go:build (!darwin && !linux && !windows) || no_sysproxy
+
+package main
+
+// systemProxySupported reports whether --apply-system-proxy works on this platform
+const systemProxySupported = false
+
+func applySystemProxy(host, port string) (func() error, error) {
+	return nil, notCompiled("system proxy configuration", "no_sysproxy")
+}
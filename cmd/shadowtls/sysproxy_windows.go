@@ -0,0 +1,61 @@
+//go:build !no_sysproxy
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// systemProxySupported reports whether --apply-system-proxy works on this platform
+const systemProxySupported = true
+
+// winInetKey holds the per-user WinINET proxy settings
+const winInetKey = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// applySystemProxy sets the WinINET SOCKS proxy in the registry. Programs
+// read the values when they start or when settings are refreshed.
+func applySystemProxy(host, port string) (func() error, error) {
+	prevEnable, hadEnable := queryRegValue("ProxyEnable")
+	prevServer, hadServer := queryRegValue("ProxyServer")
+
+	if _, err := runCommand("reg", "add", winInetKey, "/v", "ProxyServer", "/t", "REG_SZ", "/d", "socks="+host+":"+port, "/f"); err != nil {
+		return nil, err
+	}
+	if _, err := runCommand("reg", "add", winInetKey, "/v", "ProxyEnable", "/t", "REG_DWORD", "/d", "1", "/f"); err != nil {
+		restoreRegValue("ProxyServer", "REG_SZ", prevServer, hadServer)
+		return nil, err
+	}
+
+	return func() error {
+		return errors.Join(
+			restoreRegValue("ProxyEnable", "REG_DWORD", prevEnable, hadEnable),
+			restoreRegValue("ProxyServer", "REG_SZ", prevServer, hadServer),
+		)
+	}, nil
+}
+
+// queryRegValue reads a value from winInetKey; output lines look like
+// "    ProxyEnable    REG_DWORD    0x1"
+func queryRegValue(name string) (string, bool) {
+	out, err := runCommand("reg", "query", winInetKey, "/v", name)
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == name {
+			return strings.Join(fields[2:], " "), true
+		}
+	}
+	return "", false
+}
+
+func restoreRegValue(name, typ, value string, existed bool) error {
+	if !existed {
+		_, err := runCommand("reg", "delete", winInetKey, "/v", name, "/f")
+		return err
+	}
+	_, err := runCommand("reg", "add", winInetKey, "/v", name, "/t", typ, "/d", value, "/f")
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	shadowtls "github.com/metacubex/sing-shadowtls"
+	M "github.com/metacubex/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTraceSample is how many connections --trace-bytes skips between
+// traced ones unless --trace-sample says otherwise
+const DefaultTraceSample = 10
+
+// ByteTracer hex-dumps the first bytes of both directions of one in every
+// `every` relayed connections, as seen at the relay (after the tunnel's
+// decryption). It shows what a local app and the remote service actually
+// said to each other when they disagree about the protocol.
+type ByteTracer struct {
+	limit int
+	every uint64
+	seen  atomic.Uint64
+	log   *logrus.Logger
+}
+
+// NewByteTracer traces limit bytes per direction of one in every every connections
+func NewByteTracer(limit, every int, logger *logrus.Logger) *ByteTracer {
+	if every < 1 {
+		every = 1
+	}
+	return &ByteTracer{limit: limit, every: uint64(every), log: logger}
+}
+
+// Wrap returns conn unchanged unless this connection is sampled and the
+// logger is at trace level. A sampled one records what is read from it
+// (labelled readLabel) and written to it (writeLabel), and logs each dump
+// once limit bytes were seen or on Close.
+func (t *ByteTracer) Wrap(conn net.Conn, readLabel, writeLabel string) net.Conn {
+	if t == nil || t.limit <= 0 || !t.log.IsLevelEnabled(logrus.TraceLevel) || (t.seen.Add(1)-1)%t.every != 0 {
+		return conn
+	}
+	name := conn.RemoteAddr().String()
+	return &tracedConn{
+		Conn:  conn,
+		read:  &traceDump{limit: t.limit, label: name + " " + readLabel, log: t.log},
+		write: &traceDump{limit: t.limit, label: name + " " + writeLabel, log: t.log},
+	}
+}
+
+// traceDump collects the first limit bytes of one direction
+type traceDump struct {
+	mu     sync.Mutex
+	limit  int
+	label  string
+	log    *logrus.Logger
+	buf    []byte
+	logged bool
+}
+
+func (d *traceDump) add(p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.logged {
+		return
+	}
+	d.buf = append(d.buf, p[:min(len(p), d.limit-len(d.buf))]...)
+	if len(d.buf) >= d.limit {
+		d.flushLocked()
+	}
+}
+
+func (d *traceDump) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushLocked()
+}
+
+func (d *traceDump) flushLocked() {
+	if d.logged {
+		return
+	}
+	d.logged = true
+	if len(d.buf) == 0 {
+		d.log.Tracef("[TRACE] %s: no data", d.label)
+		return
+	}
+	d.log.Tracef("[TRACE] %s: first %d bytes\n%s", d.label, len(d.buf), strings.TrimSuffix(hex.Dump(d.buf), "\n"))
+	d.buf = nil
+}
+
+// tracedConn feeds reads and writes to their dumps
+type tracedConn struct {
+	net.Conn
+	read, write *traceDump
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.read.add(p[:n])
+	}
+	return n, err
+}
+
+func (c *tracedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.write.add(p[:n])
+	}
+	return n, err
+}
+
+// CloseWrite passes a half-close on, so a traced connection ends the same
+// way as any other
+func (c *tracedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *tracedConn) Close() error {
+	c.flush()
+	return c.Conn.Close()
+}
+
+// flush logs whatever was seen so far in both directions
+func (c *tracedConn) flush() {
+	c.read.flush()
+	c.write.flush()
+}
+
+// traceHandler traces the decrypted tunnel of sampled server connections
+type traceHandler struct {
+	next   shadowtls.Handler
+	tracer *ByteTracer
+}
+
+func (h *traceHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	traced := h.tracer.Wrap(conn, "client → backend", "backend → client")
+	if tc, ok := traced.(*tracedConn); ok {
+		defer tc.flush() // The relay may end without closing conn
+	}
+	return h.next.NewConnection(ctx, traced, metadata)
+}
+
+func (h *traceHandler) NewError(ctx context.Context, err error) {
+	h.next.NewError(ctx, err)
+}
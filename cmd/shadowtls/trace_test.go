@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestByteTracerDumpsFirstBytes(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetLevel(logrus.TraceLevel)
+	tracer := NewByteTracer(4, 1, logger)
+
+	a, b := net.Pipe()
+	defer b.Close()
+	traced := tracer.Wrap(a, "in", "out")
+	go func() {
+		b.Write([]byte("hello"))
+		io.ReadAll(b)
+	}()
+	buf := make([]byte, 16)
+	if n, err := traced.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+	traced.Write([]byte("OK"))
+	traced.Close()
+
+	logged := out.String()
+	if !strings.Contains(logged, "in: first 4 bytes") || !strings.Contains(logged, "68 65 6c 6c") || strings.Contains(logged, "6c 6c 6f") {
+		t.Errorf("read dump missing or over the limit:\n%s", logged)
+	}
+	if !strings.Contains(logged, "out: first 2 bytes") || !strings.Contains(logged, "4f 4b") {
+		t.Errorf("write dump missing:\n%s", logged)
+	}
+	if strings.Count(logged, "[TRACE]") != 2 {
+		t.Errorf("want one dump per direction:\n%s", logged)
+	}
+}
+
+func TestByteTracerSamples(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.TraceLevel)
+	tracer := NewByteTracer(16, 3, logger)
+	traced := 0
+	for i := 0; i < 9; i++ {
+		a, b := net.Pipe()
+		if _, ok := tracer.Wrap(a, "in", "out").(*tracedConn); ok {
+			traced++
+		}
+		a.Close()
+		b.Close()
+	}
+	if traced != 3 {
+		t.Errorf("traced %d of 9 connections, want 3", traced)
+	}
+
+	var off *ByteTracer
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if off.Wrap(a, "in", "out") != a {
+		t.Error("a nil tracer wrapped the connection")
+	}
+	if NewByteTracer(16, 1, logrus.New()).Wrap(a, "in", "out") != a {
+		t.Error("wrapped the connection below trace level")
+	}
+}
+
+// A traced connection half-closes like the one it wraps
+func TestTracedConnCloseWrite(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.TraceLevel)
+	tracer := NewByteTracer(16, 1, logger)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	traced := tracer.Wrap(conn, "in", "out").(*tracedConn)
+	defer traced.Close()
+
+	traced.Write([]byte("bye"))
+	if err := traced.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(peer); err != nil || string(got) != "bye" {
+		t.Errorf("peer read %q, %v; want the data then EOF", got, err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := tracer.Wrap(a, "in", "out").(*tracedConn).CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseWrite on a pipe = %v, want ErrUnsupported", err)
+	}
+}
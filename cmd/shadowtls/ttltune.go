@@ -0,0 +1,135 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ttlTuneSamples  = 8                // Recent stale pool ages kept
+	ttlTuneMinStale = 3                // Stale samples needed before lowering the TTL
+	ttlTuneWindow   = 10 * time.Minute // Stale samples older than this are forgotten
+	ttlTuneMargin   = 0.8              // TTL is set to this fraction of the observed expiry
+	ttlTuneFloor    = time.Second      // Never tune the TTL below this
+	ttlTuneBurst    = time.Minute      // Stale samples this close to the first count as one burst
+	ttlTuneMaxDrop  = 0.5              // One burst lowers the TTL to no less than this fraction
+	ttlTuneRecover  = 5 * time.Minute  // Stale-free time before probing a longer TTL
+	ttlTuneStep     = 1.1              // Growth factor when probing a longer TTL
+)
+
+// TTLTuner learns the server's session timeout from verification outcomes of
+// pooled tunnels. When tunnels of a similar age keep failing verification,
+// the server is expiring them, so the TTL is lowered to a margin below the
+// median stale age. Samples expire after ttlTuneWindow, and one burst of
+// stale tunnels, such as a network outage killing the whole pool, can at most
+// halve the TTL. After a stale-free period it grows back toward the
+// configured TTL in small steps, in case the server timeout was raised.
+type TTLTuner struct {
+	mu        sync.Mutex
+	max       time.Duration
+	ttl       time.Duration
+	stale     []ttlSample // Ring of recent stale ages
+	lastStale time.Time
+	burst     time.Time     // First stale sample of the current burst
+	burstTTL  time.Duration // TTL when the current burst began
+	lastRaise time.Time
+	onChange  func(ttl time.Duration)
+	log       *logrus.Logger
+}
+
+// ttlSample is the pool age of a stale tunnel and when it was seen
+type ttlSample struct {
+	at  time.Time
+	age time.Duration
+}
+
+// NewTTLTuner creates a tuner starting at, and never exceeding, max.
+// onChange, if set, is called with the new TTL whenever it moves.
+func NewTTLTuner(max time.Duration, onChange func(ttl time.Duration)) *TTLTuner {
+	now := time.Now()
+	return &TTLTuner{
+		max:       max,
+		ttl:       max,
+		lastStale: now,
+		lastRaise: now,
+		onChange:  onChange,
+		log:       ModuleLogger("pool"),
+	}
+}
+
+// TTL returns the current tuned TTL
+func (t *TTLTuner) TTL() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ttl
+}
+
+// SetMax changes the configured TTL. A TTL that wasn't lowered follows it;
+// a lowered one stays, within the new maximum.
+func (t *TTLTuner) SetMax(max time.Duration) {
+	t.mu.Lock()
+	old := t.ttl
+	if t.ttl >= t.max || t.ttl > max {
+		t.ttl = max
+	}
+	t.max = max
+	ttl := t.ttl
+	t.mu.Unlock()
+
+	if ttl != old && t.onChange != nil {
+		t.onChange(ttl)
+	}
+}
+
+// Observe records the verification outcome of a tunnel that sat in the pool for age
+func (t *TTLTuner) Observe(age time.Duration, stale bool) {
+	t.mu.Lock()
+	old := t.ttl
+	now := time.Now()
+	var expiry time.Duration
+	if stale {
+		t.lastStale = now
+		t.stale = slices.DeleteFunc(t.stale, func(s ttlSample) bool { return now.Sub(s.at) > ttlTuneWindow })
+		if len(t.stale) == ttlTuneSamples {
+			t.stale = t.stale[1:]
+		}
+		t.stale = append(t.stale, ttlSample{now, age})
+		if now.Sub(t.burst) > ttlTuneBurst {
+			t.burst, t.burstTTL = now, t.ttl
+		}
+		if len(t.stale) >= ttlTuneMinStale {
+			ages := make([]time.Duration, len(t.stale))
+			for i, s := range t.stale {
+				ages[i] = s.age
+			}
+			slices.Sort(ages)
+			expiry = ages[len(ages)/2]
+			target := max(time.Duration(float64(expiry)*ttlTuneMargin), time.Duration(float64(t.burstTTL)*ttlTuneMaxDrop), ttlTuneFloor)
+			if target < t.ttl {
+				t.ttl = target
+			}
+		}
+	} else if t.ttl < t.max && now.Sub(t.lastStale) >= ttlTuneRecover && now.Sub(t.lastRaise) >= ttlTuneRecover {
+		t.lastRaise = now
+		t.ttl = min(time.Duration(float64(t.ttl)*ttlTuneStep), t.max)
+		// Old samples describe the shorter timeout; relearn if it comes back
+		t.stale = t.stale[:0]
+	}
+	ttl := t.ttl
+	t.mu.Unlock()
+
+	if ttl == old {
+		return
+	}
+	if ttl < old {
+		t.log.Infof("Pooled tunnels go stale after ~%v, lowering TTL %v → %v", expiry.Round(time.Millisecond), old, ttl.Round(time.Millisecond))
+	} else {
+		t.log.Debugf("No stale tunnels for %v, raising TTL %v → %v", ttlTuneRecover, old.Round(time.Millisecond), ttl.Round(time.Millisecond))
+	}
+	if t.onChange != nil {
+		t.onChange(ttl)
+	}
+}
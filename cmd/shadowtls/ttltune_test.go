@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLTunerLowersBelowExpiry(t *testing.T) {
+	var changed []time.Duration
+	tuner := NewTTLTuner(60*time.Second, func(ttl time.Duration) { changed = append(changed, ttl) })
+
+	// One stale tunnel could be a random drop, not the server timeout
+	tuner.Observe(20*time.Second, true)
+	tuner.Observe(5*time.Second, false)
+	if ttl := tuner.TTL(); ttl != 60*time.Second {
+		t.Fatalf("TTL moved after a single stale sample: %v", ttl)
+	}
+
+	tuner.Observe(21*time.Second, true)
+	tuner.Observe(19*time.Second, true)
+	if ttl := tuner.TTL(); ttl != 30*time.Second {
+		t.Errorf("TTL = %v, want 30s (one burst only halves it)", ttl)
+	}
+
+	// The next burst takes it the rest of the way
+	tuner.mu.Lock()
+	tuner.burst = time.Now().Add(-ttlTuneBurst - time.Second)
+	tuner.mu.Unlock()
+	tuner.Observe(20*time.Second, true)
+	if ttl := tuner.TTL(); ttl != 16*time.Second {
+		t.Errorf("TTL = %v, want 16s (80%% of the 20s median)", ttl)
+	}
+	if len(changed) != 2 || changed[0] != 30*time.Second || changed[1] != 16*time.Second {
+		t.Errorf("onChange calls = %v", changed)
+	}
+
+	// Stale tunnels at an even older age never raise it
+	for i := 0; i < 3; i++ {
+		tuner.Observe(40*time.Second, true)
+	}
+	if ttl := tuner.TTL(); ttl != 16*time.Second {
+		t.Errorf("TTL = %v after older stale samples, want 16s", ttl)
+	}
+}
+
+func TestTTLTunerFloor(t *testing.T) {
+	tuner := NewTTLTuner(1500*time.Millisecond, nil)
+	for i := 0; i < 3; i++ {
+		tuner.Observe(100*time.Millisecond, true)
+	}
+	if ttl := tuner.TTL(); ttl != ttlTuneFloor {
+		t.Errorf("TTL = %v, want floor %v", ttl, ttlTuneFloor)
+	}
+}
+
+func TestTTLTunerForgetsOldSamples(t *testing.T) {
+	tuner := NewTTLTuner(10*time.Second, nil)
+	tuner.Observe(5*time.Second, true)
+	tuner.Observe(5*time.Second, true)
+	past := time.Now().Add(-ttlTuneWindow - time.Second)
+	tuner.mu.Lock()
+	for i := range tuner.stale {
+		tuner.stale[i].at = past
+	}
+	tuner.mu.Unlock()
+
+	// Two stale tunnels from long ago and one now are not three recent ones
+	tuner.Observe(5*time.Second, true)
+	if ttl := tuner.TTL(); ttl != 10*time.Second {
+		t.Errorf("TTL = %v, want 10s with only one recent sample", ttl)
+	}
+	if n := len(tuner.stale); n != 1 {
+		t.Errorf("%d stale samples kept, want 1", n)
+	}
+}
+
+func TestTTLTunerRecovers(t *testing.T) {
+	tuner := NewTTLTuner(8*time.Second, nil)
+	for i := 0; i < 3; i++ {
+		tuner.Observe(5*time.Second, true)
+	}
+	if ttl := tuner.TTL(); ttl != 4*time.Second {
+		t.Fatalf("TTL = %v, want 4s", ttl)
+	}
+
+	// A success right after the stale burst doesn't raise it yet
+	tuner.Observe(time.Second, false)
+	if ttl := tuner.TTL(); ttl != 4*time.Second {
+		t.Fatalf("TTL raised too early: %v", ttl)
+	}
+
+	past := time.Now().Add(-ttlTuneRecover)
+	tuner.mu.Lock()
+	tuner.lastStale, tuner.lastRaise = past, past
+	tuner.mu.Unlock()
+	tuner.Observe(time.Second, false)
+	if ttl := tuner.TTL(); ttl != 4400*time.Millisecond {
+		t.Errorf("TTL = %v after a stale-free period, want 4.4s", ttl)
+	}
+	if n := len(tuner.stale); n != 0 {
+		t.Errorf("%d stale samples kept after raising, want 0", n)
+	}
+}
+
+func TestConnPoolVerifiedTunesTTL(t *testing.T) {
+	pool := NewConnPool(1, 30*time.Second, time.Second, nil, nil, NewStats())
+	pool.SetTTLTuner(NewTTLTuner(30*time.Second, pool.SetTTL))
+
+	fresh := &PooledConn{PoolAge: 0, FromPool: false}
+	for i := 0; i < 3; i++ {
+		pool.Verified(fresh, false)
+	}
+	if ttl := pool.TTL(); ttl != 30*time.Second {
+		t.Fatalf("fresh tunnels tuned the TTL to %v", ttl)
+	}
+
+	pooled := &PooledConn{PoolAge: 10 * time.Second, FromPool: true}
+	for i := 0; i < 3; i++ {
+		pool.Verified(pooled, false)
+	}
+	if ttl := pool.TTL(); ttl != 15*time.Second {
+		t.Errorf("pool TTL = %v, want 15s", ttl)
+	}
+}
+
+func TestTTLTunerSetMax(t *testing.T) {
+	var changed []time.Duration
+	tuner := NewTTLTuner(10*time.Second, func(ttl time.Duration) { changed = append(changed, ttl) })
+
+	tuner.SetMax(20 * time.Second)
+	if ttl := tuner.TTL(); ttl != 20*time.Second {
+		t.Fatalf("TTL = %v, want it to follow the new maximum", ttl)
+	}
+
+	// A tuned TTL stays put unless the new maximum is below it
+	for i := 0; i < 3; i++ {
+		tuner.Observe(5*time.Second, true)
+	}
+	tuner.SetMax(30 * time.Second)
+	if ttl := tuner.TTL(); ttl != 10*time.Second {
+		t.Fatalf("TTL = %v, want the tuned 10s", ttl)
+	}
+	tuner.SetMax(3 * time.Second)
+	if ttl := tuner.TTL(); ttl != 3*time.Second {
+		t.Errorf("TTL = %v, want the new 3s maximum", ttl)
+	}
+	if len(changed) != 3 {
+		t.Errorf("onChange calls = %v", changed)
+	}
+}
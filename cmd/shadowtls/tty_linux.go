@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNoTerminal = errors.New("stdin is not a terminal")
+
+// readHidden prompts on stderr and reads a line from the terminal on stdin
+// with echo turned off
+func readHidden(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", errNoTerminal
+	}
+	quiet := *old
+	quiet.Lflag &^= unix.ECHO
+	quiet.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &quiet); err != nil {
+		return "", err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, old)
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := readLine(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	return line, err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoTerminal = errors.New("passphrase prompt is only supported on Linux")
+
+// readHidden can't turn off terminal echo here; passphrases come from the
+// environment or a file instead
+func readHidden(prompt string) (string, error) {
+	return "", errNoTerminal
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// UpdateURLEnv and UpdateKeyEnv configure `shadowtls update` when its
+	// --url and --key flags are not given
+	UpdateURLEnv = "SHADOWTLS_UPDATE_URL"
+	UpdateKeyEnv = "SHADOWTLS_UPDATE_KEY"
+
+	// maxManifestSize and maxBinarySize bound what an update downloads
+	maxManifestSize = 1 << 20
+	maxBinarySize   = 256 << 20
+)
+
+// ReleaseManifest describes the latest release. It is signed as a whole, and
+// each binary is pinned by its SHA-256, so the signature covers the binaries.
+// An old manifest replayed to hold a client back is refused once Expires
+// has passed.
+type ReleaseManifest struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]ReleaseBinary `json:"binaries"`         // Keyed by GOOS/GOARCH
+	Expires  time.Time                `json:"expires,omitzero"` // Zero never expires
+}
+
+// ReleaseBinary is one platform's build; URL may be relative to the manifest
+type ReleaseBinary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// Updater fetches a signed manifest and replaces a binary with the release
+// it names
+type Updater struct {
+	ManifestURL string
+	PublicKey   ed25519.PublicKey
+	Client      *http.Client
+}
+
+// Check fetches the manifest at ManifestURL and verifies it against the
+// signature at ManifestURL + ".sig"
+func (u *Updater) Check() (*ReleaseManifest, error) {
+	data, err := u.fetch(u.ManifestURL, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("fetch manifest: %v", err)
+	}
+	sigText, err := u.fetch(u.ManifestURL+".sig", 1024)
+	if err != nil {
+		return nil, fmt.Errorf("fetch signature: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil || !ed25519.Verify(u.PublicKey, data, sig) {
+		return nil, errors.New("manifest signature does not match the update key")
+	}
+	var m ReleaseManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %v", err)
+	}
+	if m.Version == "" {
+		return nil, errors.New("manifest has no version")
+	}
+	if !m.Expires.IsZero() && time.Now().After(m.Expires) {
+		return nil, fmt.Errorf("manifest for %s expired at %s", m.Version, m.Expires.Format(time.RFC3339))
+	}
+	return &m, nil
+}
+
+// Install downloads this platform's binary from m, checks its hash and
+// atomically replaces path with it
+func (u *Updater) Install(m *ReleaseManifest, path string) error {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	bin, ok := m.Binaries[platform]
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s", m.Version, platform)
+	}
+	want, err := hex.DecodeString(bin.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("release %s: bad sha256 for %s", m.Version, platform)
+	}
+	base, err := url.Parse(u.ManifestURL)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(bin.URL)
+	if err != nil {
+		return fmt.Errorf("release %s: bad url for %s: %v", m.Version, platform, err)
+	}
+	data, err := u.fetch(base.ResolveReference(ref).String(), maxBinarySize)
+	if err != nil {
+		return fmt.Errorf("download binary: %v", err)
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], want) {
+		return errors.New("downloaded binary does not match the manifest's sha256")
+	}
+	return replaceFile(path, data)
+}
+
+func (u *Updater) fetch(rawURL string, limit int64) ([]byte, error) {
+	client := u.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s: larger than %s", rawURL, formatBytes(uint64(limit), true))
+	}
+	return data, nil
+}
+
+// replaceFile writes data next to path and renames it over path, keeping
+// path's permissions, so path always holds either the old or the new binary
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".shadowtls-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// A running executable can be renamed but not replaced
+		old := path + ".old"
+		os.Remove(old)
+		if err := os.Rename(path, old); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parseUpdateKey decodes a base64 Ed25519 public key
+func parseUpdateKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("update key must be a base64 Ed25519 public key (see update keygen)")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// newerRelease reports whether release is a later version than current.
+// A development build or an unparsable version is never older, so it is
+// only replaced with --force.
+func newerRelease(release, current string) bool {
+	return compareVersions(release, current) > 0
+}
+
+// exitUpdateAvailable is what `update --check` exits with when there is a
+// newer release, apart from 1 for errors; dnf check-update uses the same
+const exitUpdateAvailable = 100
+
+// runUpdate implements `shadowtls update`: replace this binary with the
+// latest signed release, and `update keygen` / `update sign` to publish one
+func runUpdate(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "keygen":
+			return runUpdateKeygen()
+		case "sign":
+			return runUpdateSign(args[1:])
+		}
+	}
+
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	manifestURL := fs.String("url", os.Getenv(UpdateURLEnv), "Release manifest URL (default: $"+UpdateURLEnv+")")
+	keyText := fs.String("key", os.Getenv(UpdateKeyEnv), "Base64 Ed25519 public key the manifest is signed with (default: $"+UpdateKeyEnv+")")
+	checkOnly := fs.Bool("check", false, "Only report whether an update is available (exit 0 up to date, 100 available, 1 on errors)")
+	force := fs.Bool("force", false, "Install even if the release is not newer than this binary")
+	binary := fs.String("binary", "", "Binary to replace (default: this executable)")
+	restart := fs.String("restart", "", "Command to run after replacing the binary, e.g. \"systemctl restart shadowtls\"; quote arguments with spaces")
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s update --url <manifest> --key <pubkey> [--check] [--force] [--restart cmd]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s update keygen\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s update sign --key-file <private key> <manifest.json>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Fetches the manifest and <manifest>.sig, verifies the signature, downloads the")
+		fmt.Fprintln(os.Stderr, "binary for this platform, checks its sha256 and atomically replaces this one.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var restartCmd []string
+	if *restart != "" {
+		var err error
+		if restartCmd, err = splitCommand(*restart); err == nil && len(restartCmd) == 0 {
+			err = errors.New("empty command")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --restart %q: %v\n", *restart, err)
+			return 2
+		}
+	}
+	if *manifestURL == "" || *keyText == "" {
+		fmt.Fprintln(os.Stderr, "update needs --url and --key (or $"+UpdateURLEnv+" and $"+UpdateKeyEnv+")")
+		return 2
+	}
+	key, err := parseUpdateKey(*keyText)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	u := &Updater{ManifestURL: *manifestURL, PublicKey: key}
+	m, err := u.Check()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	current := Version()
+	if !*force && !newerRelease(m.Version, current) {
+		if m.Version == current {
+			fmt.Printf("Up to date (%s)\n", current)
+		} else {
+			fmt.Printf("Not updating: release %s is not newer than %s (--force installs it)\n", m.Version, current)
+		}
+		return 0
+	}
+	if *checkOnly {
+		fmt.Printf("Update available: %s (running %s)\n", m.Version, current)
+		return exitUpdateAvailable
+	}
+
+	path := *binary
+	if path == "" {
+		if path, err = os.Executable(); err == nil {
+			path, err = filepath.EvalSymlinks(path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "locate this binary: %v\n", err)
+			return 1
+		}
+	}
+	if err := u.Install(m, path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Updated %s from %s to %s\n", path, current, m.Version)
+
+	if restartCmd != nil {
+		out, err := runCommand(restartCmd[0], restartCmd[1:]...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restart: %v\n", err)
+			return 1
+		}
+		if out != "" {
+			fmt.Println(out)
+		}
+	}
+	return 0
+}
+
+// splitCommand splits a command line into words the way a POSIX shell
+// would, without expanding anything: single quotes keep everything, double
+// quotes keep all but \" and \\, and a backslash outside quotes escapes the
+// next character
+func splitCommand(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += 1 + end
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			word.WriteByte(s[i])
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runUpdateKeygen prints a new signing key pair
+func runUpdateKeygen() int {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Public key (for --key):      %s\n", base64.StdEncoding.EncodeToString(pub))
+	fmt.Printf("Private key (keep offline): %s\n", base64.StdEncoding.EncodeToString(priv.Seed()))
+	return 0
+}
+
+// runUpdateSign prints the signature to publish as <manifest>.sig
+func runUpdateSign(args []string) int {
+	fs := flag.NewFlagSet("update sign", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "File holding the base64 private key from update keygen")
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyFile == "" || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s update sign --key-file <private key> <manifest.json> > manifest.json.sig\n", os.Args[0])
+		return 2
+	}
+	keyText, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyText)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		fmt.Fprintln(os.Stderr, "private key must be the base64 key printed by update keygen")
+		return 1
+	}
+	manifest, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var m ReleaseManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is not a release manifest: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	if m.Expires.IsZero() {
+		fmt.Fprintln(os.Stderr, "Warning: the manifest has no \"expires\"; a replayed copy stays valid forever")
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(seed), manifest)))
+	return 0
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// releaseServer serves a manifest for binary signed with priv
+func releaseServer(t *testing.T, priv ed25519.PrivateKey, binary []byte) *httptest.Server {
+	return releaseServerExpiring(t, priv, binary, time.Time{})
+}
+
+// releaseServerExpiring serves a manifest for binary, valid until expires
+func releaseServerExpiring(t *testing.T, priv ed25519.PrivateKey, binary []byte, expires time.Time) *httptest.Server {
+	t.Helper()
+	sum := sha256.Sum256(binary)
+	manifest, _ := json.Marshal(ReleaseManifest{
+		Version: "v9.9.9",
+		Binaries: map[string]ReleaseBinary{
+			runtime.GOOS + "/" + runtime.GOARCH: {URL: "bin/shadowtls", SHA256: hex.EncodeToString(sum[:])},
+		},
+		Expires: expires,
+	})
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/release/manifest.json", func(w http.ResponseWriter, r *http.Request) { w.Write(manifest) })
+	mux.HandleFunc("/release/manifest.json.sig", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(sig + "\n")) })
+	mux.HandleFunc("/release/bin/shadowtls", func(w http.ResponseWriter, r *http.Request) { w.Write(binary) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUpdaterInstall(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := releaseServer(t, priv, []byte("new binary"))
+
+	path := filepath.Join(t.TempDir(), "shadowtls")
+	if err := os.WriteFile(path, []byte("old binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	u := &Updater{ManifestURL: srv.URL + "/release/manifest.json", PublicKey: pub}
+	m, err := u.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != "v9.9.9" {
+		t.Errorf("version %q", m.Version)
+	}
+	if err := u.Install(m, path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	info, _ := os.Stat(path)
+	if string(data) != "new binary" || info.Mode().Perm() != 0o755 {
+		t.Errorf("replaced with %q, mode %v", data, info.Mode())
+	}
+	if left, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".shadowtls-update-*")); len(left) > 0 {
+		t.Errorf("temp files left: %v", left)
+	}
+}
+
+func TestUpdaterRejects(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	srv := releaseServer(t, priv, []byte("new binary"))
+	manifestURL := srv.URL + "/release/manifest.json"
+
+	if _, err := (&Updater{ManifestURL: manifestURL, PublicKey: otherPub}).Check(); err == nil {
+		t.Error("manifest signed by another key accepted")
+	}
+
+	u := &Updater{ManifestURL: manifestURL, PublicKey: pub}
+	m, err := u.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := m.Binaries[runtime.GOOS+"/"+runtime.GOARCH]
+	bin.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	m.Binaries[runtime.GOOS+"/"+runtime.GOARCH] = bin
+
+	path := filepath.Join(t.TempDir(), "shadowtls")
+	os.WriteFile(path, []byte("old binary"), 0o755)
+	if err := u.Install(m, path); err == nil {
+		t.Error("binary with the wrong hash installed")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old binary" {
+		t.Errorf("binary changed to %q after a failed update", data)
+	}
+}
+
+// A signed manifest is refused once it expires, so an old one can't be
+// replayed to hold clients on a vulnerable release
+func TestUpdaterRejectsExpired(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	expired := releaseServerExpiring(t, priv, []byte("new binary"), time.Now().Add(-time.Hour))
+	if _, err := (&Updater{ManifestURL: expired.URL + "/release/manifest.json", PublicKey: pub}).Check(); err == nil {
+		t.Error("expired manifest accepted")
+	}
+	valid := releaseServerExpiring(t, priv, []byte("new binary"), time.Now().Add(time.Hour))
+	if _, err := (&Updater{ManifestURL: valid.URL + "/release/manifest.json", PublicKey: pub}).Check(); err != nil {
+		t.Errorf("unexpired manifest: %v", err)
+	}
+}
+
+// Only a later release replaces the running binary
+func TestNewerRelease(t *testing.T) {
+	for _, tt := range []struct {
+		release, current string
+		want             bool
+	}{
+		{"v1.5.0", "v1.4.2", true},
+		{"v1.4.2", "v1.4.2", false},
+		{"v1.4.1", "v1.4.2", false},
+		{"v1.5.0", "devel-abc1234", false},
+		{"garbage", "v1.4.2", false},
+	} {
+		if got := newerRelease(tt.release, tt.current); got != tt.want {
+			t.Errorf("newerRelease(%q, %q) = %v, want %v", tt.release, tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestParseUpdateKey(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := parseUpdateKey(base64.StdEncoding.EncodeToString(pub) + "\n"); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseUpdateKey("c2hvcnQ="); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+// --restart keeps quoted arguments together and refuses bad quoting
+func TestSplitCommand(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"systemctl restart shadowtls", []string{"systemctl", "restart", "shadowtls"}},
+		{"  sh  -c 'kill -HUP $(pidof shadowtls)' ", []string{"sh", "-c", "kill -HUP $(pidof shadowtls)"}},
+		{`/opt/my\ app/run "a \"b\" c" x''y`, []string{"/opt/my app/run", `a "b" c`, "xy"}},
+		{`""`, []string{""}},
+		{"", nil},
+	} {
+		got, err := splitCommand(tt.in)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("splitCommand(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{`sh -c 'x`, `echo "x`, `echo x\`} {
+		if _, err := splitCommand(in); err == nil {
+			t.Errorf("splitCommand(%q) accepted", in)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultVerifyCoalesce is how long to wait for further segments of the
+// server's first response after the first one arrives. Waiting delays every
+// first response, so it is off unless asked for.
+const defaultVerifyCoalesce time.Duration = 0
+
+// readResult is the outcome of a background tunnel read
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// readFirstResponse reads the server's first response into buf for
+// verification. Segments that follow each other within gap are coalesced, so a greeting
+// the server sent as several records reaches the local client in one write.
+//
+// The extra reads run in the background rather than with a short deadline:
+// a ShadowTLS read that times out mid-record sends an alert and kills the
+// session. A read still pending when the gap expires is handed over through
+// the returned conn, whose first Read delivers its result.
+func readFirstResponse(conn net.Conn, buf []byte, gap time.Duration) (n, segments int, wrapped net.Conn, err error) {
+	conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+	n, err = conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || n == 0 {
+		return n, 0, conn, err
+	}
+	segments = 1
+
+	for gap > 0 && n < len(buf) {
+		pending := make(chan readResult, 1)
+		go func(size int) {
+			b := make([]byte, size)
+			m, err := conn.Read(b)
+			pending <- readResult{data: b[:m], err: err}
+		}(len(buf) - n)
+
+		select {
+		case r := <-pending:
+			n += copy(buf[n:], r.data)
+			if len(r.data) > 0 {
+				segments++
+			}
+			if r.err != nil {
+				// Deliver the error on the next read, after the data
+				ch := make(chan readResult, 1)
+				ch <- readResult{err: r.err}
+				return n, segments, &pendingConn{Conn: conn, pending: ch}, nil
+			}
+		case <-time.After(gap):
+			return n, segments, &pendingConn{Conn: conn, pending: pending}, nil
+		}
+	}
+	return n, segments, conn, nil
+}
+
+// pendingConn is a tunnel with a background read in flight; the first Read
+// returns that read's result before reading from the connection again
+type pendingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	pending chan readResult
+	buf     []byte
+	err     error
+}
+
+func (c *pendingConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending != nil {
+		r := <-c.pending
+		c.pending = nil
+		c.buf, c.err = r.data, r.err
+	}
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadFirstResponseCoalesces(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		remote.Write([]byte("220 mail.example.com"))
+		time.Sleep(time.Millisecond)
+		remote.Write([]byte(" ESMTP ready\r\n"))
+	}()
+
+	buf := make([]byte, 1024)
+	n, segments, _, err := readFirstResponse(local, buf, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "220 mail.example.com ESMTP ready\r\n" {
+		t.Errorf("got %q, want the whole greeting", got)
+	}
+	if segments != 2 {
+		t.Errorf("segments = %d, want 2", segments)
+	}
+	remote.Close()
+}
+
+func TestReadFirstResponseHandsOverPendingRead(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go remote.Write([]byte("hello"))
+
+	buf := make([]byte, 1024)
+	n, segments, conn, err := readFirstResponse(local, buf, 10*time.Millisecond)
+	if err != nil || string(buf[:n]) != "hello" || segments != 1 {
+		t.Fatalf("got %q segments=%d err=%v", buf[:n], segments, err)
+	}
+
+	// Data arriving after the gap is not lost: the in-flight read delivers it
+	go func() {
+		remote.Write([]byte("later"))
+		remote.Close()
+	}()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "later" {
+		t.Errorf("got %q after the gap, want %q", got, "later")
+	}
+}
+
+func TestReadFirstResponseDisabled(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go remote.Write([]byte("hello"))
+
+	buf := make([]byte, 1024)
+	_, _, conn, err := readFirstResponse(local, buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != local {
+		t.Error("with coalescing off the tunnel should be returned unwrapped")
+	}
+}
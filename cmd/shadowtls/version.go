@@ -0,0 +1,39 @@
+package main
+
+import "runtime/debug"
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version string
+
+// Version returns the build version. Without -ldflags it falls back to the
+// module version (go install) or the VCS revision baked in by go build.
+func Version() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "-dirty"
+			}
+		}
+	}
+	if revision != "" {
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		return "devel-" + revision + modified
+	}
+	return "devel"
+}
@@ -0,0 +1,245 @@
+package mobile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/iprw/shadowtun/pkg/relay"
+	"github.com/iprw/shadowtun/pkg/shadowtls"
+)
+
+const (
+	// DefaultListen is the local address used when Config.Listen is empty.
+	DefaultListen = "127.0.0.1:1080"
+
+	// DefaultTimeoutMillis is the tunnel dial timeout used when
+	// Config.TimeoutMillis is zero.
+	DefaultTimeoutMillis = 10000
+)
+
+// Config holds the client settings. All fields are plain values so gomobile
+// can expose the struct to Java and Swift.
+type Config struct {
+	Server   string // ShadowTLS server address, host:port
+	SNI      string // Camouflage server name for the TLS handshake
+	Password string // Shared password
+	Listen   string // Local listen address, DefaultListen if empty
+
+	TimeoutMillis     int64 // Tunnel dial timeout, DefaultTimeoutMillis if zero
+	IdleTimeoutMillis int64 // Close relayed connections idle this long, relay.DefaultIdleTimeout if zero
+
+	// LogLevel is a logrus level name (error, warn, info, debug); empty means warn.
+	LogLevel string
+}
+
+// Stats is a snapshot of client counters.
+type Stats struct {
+	Active    int64 // Connections being relayed now
+	Total     int64 // Connections accepted since Start
+	Failed    int64 // Connections dropped because the tunnel could not be dialed
+	BytesUp   int64 // Bytes sent to the server
+	BytesDown int64 // Bytes received from the server
+}
+
+// Client is an embeddable ShadowTLS client for mobile apps. It listens
+// locally and carries every accepted connection through its own tunnel to
+// the server, which runs in SOCKS5 or forward mode. Exported methods use only
+// types gomobile can bind (no channels, interfaces or net types), so an
+// Android VPN service can point tun2socks at ListenAddr without running a
+// separate binary.
+//
+// Tunnel connections must not be routed back into the app's own VPN. On
+// Android exclude the app with VpnService.Builder.addDisallowedApplication.
+type Client struct {
+	config Config
+	tunnel *shadowtls.Client
+	idle   time.Duration
+	log    *logrus.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	active    atomic.Int64
+	total     atomic.Int64
+	failed    atomic.Int64
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+}
+
+// NewClient validates config and prepares a client. Call Start to begin listening.
+func NewClient(config *Config) (*Client, error) {
+	if config == nil || config.Server == "" || config.SNI == "" || config.Password == "" {
+		return nil, errors.New("server, SNI and password are required")
+	}
+	cfg := *config
+	if cfg.Listen == "" {
+		cfg.Listen = DefaultListen
+	}
+	if cfg.TimeoutMillis <= 0 {
+		cfg.TimeoutMillis = DefaultTimeoutMillis
+	}
+	idle := relay.DefaultIdleTimeout
+	if cfg.IdleTimeoutMillis > 0 {
+		idle = time.Duration(cfg.IdleTimeoutMillis) * time.Millisecond
+	}
+
+	log := logrus.New()
+	log.SetOutput(os.Stderr) // gomobile forwards stderr to logcat
+	log.SetLevel(logrus.WarnLevel)
+	if cfg.LogLevel != "" {
+		level, err := logrus.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %v", cfg.LogLevel, err)
+		}
+		log.SetLevel(level)
+	}
+
+	tunnel, err := shadowtls.NewClient(cfg.Server, cfg.SNI, cfg.Password, time.Duration(cfg.TimeoutMillis)*time.Millisecond, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+	return &Client{config: cfg, tunnel: tunnel, idle: idle, log: log}, nil
+}
+
+// Start binds the local listener and serves in the background.
+func (c *Client) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listener != nil {
+		return errors.New("client already started")
+	}
+	listener, err := net.Listen("tcp", c.config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", c.config.Listen, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.listener, c.cancel = listener, cancel
+
+	c.wg.Add(1)
+	go c.serve(ctx, listener)
+	c.log.Infof("Listening on %s, server %s", listener.Addr(), c.config.Server)
+	return nil
+}
+
+// Stop closes the listener and all relayed connections, and waits for them
+// to finish. The client may be started again afterwards.
+func (c *Client) Stop() {
+	c.mu.Lock()
+	listener, cancel := c.listener, c.cancel
+	c.listener, c.cancel = nil, nil
+	c.mu.Unlock()
+	if listener == nil {
+		return
+	}
+	cancel()
+	listener.Close()
+	c.wg.Wait()
+}
+
+// ListenAddr returns the bound local address, or "" when not started.
+func (c *Client) ListenAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listener == nil {
+		return ""
+	}
+	return c.listener.Addr().String()
+}
+
+// Probe dials one tunnel and closes it, returning the handshake time in
+// milliseconds. Use it to check the server and password before Start.
+func (c *Client) Probe() (int64, error) {
+	start := time.Now()
+	conn, err := c.tunnel.Dial(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start).Milliseconds(), nil
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Client) Stats() *Stats {
+	return &Stats{
+		Active:    c.active.Load(),
+		Total:     c.total.Load(),
+		Failed:    c.failed.Load(),
+		BytesUp:   c.bytesUp.Load(),
+		BytesDown: c.bytesDown.Load(),
+	}
+}
+
+func (c *Client) serve(ctx context.Context, listener net.Listener) {
+	defer c.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				c.log.Warnf("Accept failed: %v", err)
+			}
+			return
+		}
+		c.total.Add(1)
+		c.wg.Add(1)
+		go c.handle(ctx, conn)
+	}
+}
+
+// handle relays one local connection through a fresh tunnel.
+func (c *Client) handle(ctx context.Context, local net.Conn) {
+	defer c.wg.Done()
+	defer local.Close()
+
+	tunnel, err := c.tunnel.Dial(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.failed.Add(1)
+			c.log.Warnf("Tunnel dial failed: %v", err)
+		}
+		return
+	}
+	defer tunnel.Close()
+
+	c.active.Add(1)
+	defer c.active.Add(-1)
+
+	// Close both ends on Stop so blocked copies return
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			local.Close()
+			tunnel.Close()
+		case <-connDone:
+		}
+	}()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		relay.CopyConn(tunnel, local, 0, c.idle, relay.DefaultWriteTimeout, func(n int) {
+			c.bytesUp.Add(int64(n))
+		})
+		tunnel.Close()
+	}()
+	go func() {
+		defer func() { done <- struct{}{} }()
+		relay.CopyConn(local, tunnel, 0, c.idle, relay.DefaultWriteTimeout, func(n int) {
+			c.bytesDown.Add(int64(n))
+		})
+		local.Close()
+	}()
+	<-done
+	<-done
+}
@@ -0,0 +1,64 @@
+package mobile
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewClientValidates(t *testing.T) {
+	if _, err := NewClient(&Config{Server: "example.com:443", SNI: "www.google.com"}); err == nil {
+		t.Error("missing password should be rejected")
+	}
+	if _, err := NewClient(&Config{Server: "example.com:443", SNI: "www.google.com", Password: "x", LogLevel: "loud"}); err == nil {
+		t.Error("invalid log level should be rejected")
+	}
+}
+
+func TestClientStartStop(t *testing.T) {
+	// Nothing listens on the server address, so every tunnel dial is refused
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := dead.Addr().String()
+	dead.Close()
+
+	c, err := NewClient(&Config{Server: server, SNI: "www.google.com", Password: "x", Listen: "127.0.0.1:0", TimeoutMillis: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Probe(); err == nil {
+		t.Error("Probe succeeded against a closed port")
+	}
+
+	for round := 0; round < 2; round++ {
+		if err := c.Start(); err != nil {
+			t.Fatalf("round %d: Start: %v", round, err)
+		}
+		if err := c.Start(); err == nil {
+			t.Error("second Start should fail")
+		}
+
+		conn, err := net.Dial("tcp", c.ListenAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The client closes the local side once the tunnel dial fails
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("expected the connection to be closed")
+		}
+		conn.Close()
+
+		c.Stop()
+		if addr := c.ListenAddr(); addr != "" {
+			t.Errorf("ListenAddr = %q after Stop", addr)
+		}
+	}
+
+	s := c.Stats()
+	if s.Total != 2 || s.Failed != 2 || s.Active != 0 {
+		t.Errorf("stats = %+v, want 2 accepted, 2 failed, 0 active", *s)
+	}
+}
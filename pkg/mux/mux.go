@@ -0,0 +1,453 @@
+// Package mux carries many streams over one connection, so local connections
+// that would each need their own ShadowTLS tunnel can share a few
+// long-lived ones.
+//
+// Every frame has an 8-byte header: version, command, payload length (16
+// bits) and stream ID (32 bits), all big-endian. The client opens streams
+// with odd IDs and the server accepts them. Data on a stream is
+// flow-controlled: a sender may have at most the receiver's window of bytes
+// unread, and the receiver reports what it read with window updates.
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	version    = 1
+	headerSize = 8
+
+	// maxPayload is the most data sent in one frame
+	maxPayload = 32 << 10
+
+	cmdSYN = 0 // Open a stream
+	cmdFIN = 1 // The sender won't write to the stream any more
+	cmdPSH = 2 // Stream data
+	cmdNOP = 3 // Keepalive
+	cmdUPD = 4 // Window update: bytes read so far and the receive window, 32 bits each
+	cmdRST = 5 // Abort a stream
+
+	// initialWindow is what a sender may have unread before the receiver's
+	// first window update
+	initialWindow = 256 << 10
+
+	// DefaultKeepAlive is how often an idle session sends a keepalive
+	DefaultKeepAlive = 10 * time.Second
+	// DefaultTimeout closes a session that heard nothing from its peer
+	// for this long
+	DefaultTimeout = 30 * time.Second
+	// DefaultMaxStreams limits the streams a server accepts on one session
+	DefaultMaxStreams = 1024
+	// DefaultWriteTimeout bounds a single frame write to the connection
+	DefaultWriteTimeout = 30 * time.Second
+
+	// maxPendingResets bounds the resets waiting to be written; a peer that
+	// makes more while writes are stalled ends the session
+	maxPendingResets = 1024
+)
+
+var (
+	// ErrSessionClosed is returned by streams of a session that ended
+	ErrSessionClosed = errors.New("mux: session closed")
+	// ErrStreamReset is returned once the peer aborted a stream
+	ErrStreamReset = errors.New("mux: stream reset by peer")
+	// ErrPeerTimeout ends a session whose peer went silent
+	ErrPeerTimeout = errors.New("mux: peer stopped answering")
+)
+
+// Config tunes a session; zero values take the defaults.
+type Config struct {
+	Window     int           // Receive window per stream, at least the initial 256 KiB
+	KeepAlive  time.Duration // Keepalive interval
+	Timeout    time.Duration // Close the session after this long without a frame from the peer
+	MaxStreams int           // Open streams a server accepts at once
+
+	// OnPanic, if set, is called with the value of a panic in one of the
+	// session's goroutines before the panic continues
+	OnPanic func(v any)
+}
+
+func (c Config) withDefaults() Config {
+	if c.Window < initialWindow {
+		c.Window = initialWindow
+	}
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = DefaultKeepAlive
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.MaxStreams <= 0 {
+		c.MaxStreams = DefaultMaxStreams
+	}
+	return c
+}
+
+// Session multiplexes streams over a connection.
+type Session struct {
+	conn   net.Conn
+	config Config
+	client bool
+
+	writeMu sync.Mutex
+	wbuf    []byte
+
+	// Resets the receive loop asked for, written by resetLoop so a stalled
+	// write never holds up inbound frames
+	resetMu    sync.Mutex
+	resets     []uint32
+	resetReady chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	opened  uint64
+
+	accept   chan *Stream
+	lastRecv atomic.Int64 // Unix nanoseconds
+
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error // Why the session ended, set before die is closed
+}
+
+// Client starts the opening side of a session on conn.
+func Client(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, true)
+}
+
+// Server starts the accepting side of a session on conn.
+func Server(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, false)
+}
+
+func newSession(conn net.Conn, config Config, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		config:  config.withDefaults(),
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		nextID:  1,
+		die:     make(chan struct{}),
+
+		resetReady: make(chan struct{}, 1),
+	}
+	if !client {
+		s.accept = make(chan *Stream, 128)
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+	go s.recvLoop()
+	go s.resetLoop()
+	go s.keepAlive()
+	return s
+}
+
+// OpenStream opens a new stream; only the client side can.
+func (s *Session) OpenStream() (*Stream, error) {
+	if !s.client {
+		return nil, errors.New("mux: only the client opens streams")
+	}
+	s.mu.Lock()
+	if s.closed() {
+		s.mu.Unlock()
+		return nil, s.Err()
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.opened++
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, s.Err()
+	}
+}
+
+// NumStreams returns the streams open on the session.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Opened returns the streams opened or accepted over the session's life.
+func (s *Session) Opened() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opened
+}
+
+// Done is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.die
+}
+
+// Err returns why the session ended, nil while it runs.
+func (s *Session) Err() error {
+	select {
+	case <-s.die:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the session and every stream on it.
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// fail ends the session with err
+func (s *Session) fail(err error) {
+	s.dieOnce.Do(func() {
+		s.err = err
+		close(s.die)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) closed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// writeFrame sends one frame, header and payload in a single write so they
+// travel in one TLS record
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.closed() {
+		return s.err
+	}
+	frame := append(s.wbuf[:0], version, cmd)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = append(frame, payload...)
+	s.wbuf = frame
+	s.conn.SetWriteDeadline(time.Now().Add(DefaultWriteTimeout))
+	if _, err := s.conn.Write(frame); err != nil {
+		s.fail(fmt.Errorf("mux: write: %w", err))
+		return s.Err()
+	}
+	return nil
+}
+
+// windowUpdate tells the peer how much of stream id was read
+func (s *Session) windowUpdate(id, consumed uint32) error {
+	var payload [8]byte
+	binary.BigEndian.PutUint32(payload[:4], consumed)
+	binary.BigEndian.PutUint32(payload[4:], uint32(s.config.Window))
+	return s.writeFrame(cmdUPD, id, payload[:])
+}
+
+func (s *Session) recvLoop() {
+	defer s.guard()
+	r := bufio.NewReaderSize(s.conn, maxPayload+headerSize)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			s.fail(fmt.Errorf("mux: read: %w", err))
+			break
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+		if header[0] != version {
+			s.fail(fmt.Errorf("mux: unsupported version %d", header[0]))
+			break
+		}
+		cmd := header[1]
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		id := binary.BigEndian.Uint32(header[4:])
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				s.fail(fmt.Errorf("mux: read: %w", err))
+				break
+			}
+		}
+		if err := s.handle(cmd, id, payload); err != nil {
+			s.fail(err)
+			break
+		}
+	}
+	s.mu.Lock()
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+	for _, st := range streams {
+		st.notify()
+	}
+}
+
+func (s *Session) handle(cmd byte, id uint32, payload []byte) error {
+	switch cmd {
+	case cmdNOP:
+		return nil
+	case cmdSYN:
+		if s.client || id%2 == 0 {
+			return fmt.Errorf("mux: unexpected stream %d opened by the peer", id)
+		}
+		s.mu.Lock()
+		if _, dup := s.streams[id]; dup {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: stream %d opened twice", id)
+		}
+		if len(s.streams) >= s.config.MaxStreams {
+			s.mu.Unlock()
+			return s.reset(id)
+		}
+		st := newStream(s, id)
+		s.streams[id] = st
+		s.opened++
+		s.mu.Unlock()
+		select {
+		case s.accept <- st:
+			return nil
+		default:
+			s.forget(id)
+			return s.reset(id)
+		}
+	case cmdPSH:
+		st := s.stream(id)
+		if st == nil {
+			// Closed here while the peer was still sending
+			return s.reset(id)
+		}
+		if !st.push(payload) {
+			s.forget(id)
+			return s.reset(id)
+		}
+		return nil
+	case cmdFIN:
+		if st := s.stream(id); st != nil {
+			st.finReceived()
+		}
+		return nil
+	case cmdUPD:
+		if len(payload) != 8 {
+			return fmt.Errorf("mux: window update of %d bytes", len(payload))
+		}
+		if st := s.stream(id); st != nil {
+			st.update(binary.BigEndian.Uint32(payload[:4]), binary.BigEndian.Uint32(payload[4:]))
+		}
+		return nil
+	case cmdRST:
+		if st := s.stream(id); st != nil {
+			s.forget(id)
+			st.resetByPeer()
+		}
+		return nil
+	default:
+		return fmt.Errorf("mux: unknown command %d", cmd)
+	}
+}
+
+// reset queues a reset of stream id for resetLoop to write. It fails only
+// once too many are waiting.
+func (s *Session) reset(id uint32) error {
+	s.resetMu.Lock()
+	if len(s.resets) >= maxPendingResets {
+		s.resetMu.Unlock()
+		return errors.New("mux: too many stream resets waiting to be written")
+	}
+	s.resets = append(s.resets, id)
+	s.resetMu.Unlock()
+	select {
+	case s.resetReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// resetLoop writes the resets queued by the receive loop
+func (s *Session) resetLoop() {
+	defer s.guard()
+	for {
+		select {
+		case <-s.resetReady:
+		case <-s.die:
+			return
+		}
+		s.resetMu.Lock()
+		ids := s.resets
+		s.resets = nil
+		s.resetMu.Unlock()
+		for _, id := range ids {
+			if s.writeFrame(cmdRST, id, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// guard reports a panic in a session goroutine to Config.OnPanic and lets
+// it go on
+func (s *Session) guard() {
+	if s.config.OnPanic == nil {
+		return
+	}
+	if r := recover(); r != nil {
+		s.config.OnPanic(r)
+		panic(r)
+	}
+}
+
+// keepAlive sends a keepalive every interval and ends the session once the
+// peer has been silent for the timeout
+func (s *Session) keepAlive() {
+	defer s.guard()
+	ticker := time.NewTicker(s.config.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, s.lastRecv.Load())) > s.config.Timeout {
+				s.fail(ErrPeerTimeout)
+				return
+			}
+			if s.writeFrame(cmdNOP, 0, nil) != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns a client and a server session over an in-memory connection
+func pair(t *testing.T, config Config) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server := Client(a, config), Server(b, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// echo answers every accepted stream with what it reads, then half-closes
+func echo(server *Session) {
+	for {
+		st, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			io.Copy(st, st)
+			st.CloseWrite()
+		}()
+	}
+}
+
+func TestStreamsEcho(t *testing.T) {
+	client, server := pair(t, Config{})
+	go echo(server)
+
+	// Several streams at once, each moving more than the window
+	const streams, size = 8, 1 << 20
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer st.Close()
+			data := make([]byte, size)
+			rand.Read(data)
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- errors.New("echo mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := client.Opened(); n != streams {
+		t.Errorf("Opened = %d, want %d", n, streams)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for client.NumStreams() != 0 || server.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams left open: client %d, server %d", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := pair(t, Config{})
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads on the server, so writes stop at the window
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(make([]byte, 2*initialWindow))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != initialWindow {
+		t.Fatalf("Write = %d, %v, want the window and a timeout", n, err)
+	}
+
+	// Reading opens the window again
+	go io.Copy(io.Discard, peer)
+	st.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := st.Write(make([]byte, initialWindow)); err != nil {
+		t.Errorf("Write after the peer read: %v", err)
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, server := pair(t, Config{})
+	st, _ := client.OpenStream()
+	server.AcceptStream()
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	var netErr net.Error
+	if _, err := st.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Read = %v, want a timeout", err)
+	}
+}
+
+func TestStreamCloseResetsPeerWrites(t *testing.T) {
+	client, server := pair(t, Config{})
+	st, _ := client.OpenStream()
+	peer, _ := server.AcceptStream()
+	st.Close()
+
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("peer Read = %v, want EOF after FIN", err)
+	}
+	// Data for the forgotten stream is answered with a reset
+	peer.Write([]byte("late"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := peer.Write([]byte("x")); errors.Is(err, ErrStreamReset) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("writes to a closed stream never reset")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionCloseEndsStreams(t *testing.T) {
+	client, server := pair(t, Config{})
+	st, _ := client.OpenStream()
+	server.AcceptStream()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		done <- err
+	}()
+	server.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Read succeeded on a dead session")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read still blocked after the session ended")
+	}
+	<-client.Done()
+	if _, err := client.OpenStream(); err == nil {
+		t.Error("OpenStream on a dead session succeeded")
+	}
+}
+
+func TestSessionPeerTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// Drain whatever the session sends, but never answer
+	go io.Copy(io.Discard, b)
+	s := Client(a, Config{KeepAlive: 10 * time.Millisecond, Timeout: 50 * time.Millisecond})
+	select {
+	case <-s.Done():
+		if !errors.Is(s.Err(), ErrPeerTimeout) {
+			t.Errorf("Err = %v, want ErrPeerTimeout", s.Err())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session outlived a silent peer")
+	}
+}
+
+func TestServerLimitsStreams(t *testing.T) {
+	client, server := pair(t, Config{MaxStreams: 1})
+	first, _ := client.OpenStream()
+	server.AcceptStream()
+	defer first.Close()
+	second, _ := client.OpenStream()
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("stream over the limit: %v, want a reset", err)
+	}
+}
+
+// Resets owed to the peer are written apart from the receive loop, so a peer
+// that stops reading can't stall the frames it sends
+func TestResetDoesNotStallReceive(t *testing.T) {
+	a, b := net.Pipe()
+	server := Server(b, Config{})
+	defer server.Close()
+	defer a.Close()
+
+	frame := func(cmd byte, id uint32, payload string) []byte {
+		f := []byte{version, cmd, 0, byte(len(payload)), 0, 0, 0, byte(id)}
+		return append(f, payload...)
+	}
+	// a never reads, so the reset for the unknown stream 99 can't be written
+	go func() {
+		a.Write(frame(cmdPSH, 99, "lost"))
+		a.Write(frame(cmdSYN, 1, ""))
+		a.Write(frame(cmdPSH, 1, "hello"))
+	}()
+
+	accepted := make(chan *Stream, 1)
+	go func() {
+		if st, err := server.AcceptStream(); err == nil {
+			accepted <- st
+		}
+	}()
+	select {
+	case st := <-accepted:
+		st.SetReadDeadline(time.Now().Add(2 * time.Second))
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(st, got); err != nil || string(got) != "hello" {
+			t.Errorf("read %q, %v; want hello", got, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream never accepted while a reset was waiting to be written")
+	}
+}
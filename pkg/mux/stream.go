@@ -0,0 +1,312 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one connection carried by a session. It implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu       sync.Mutex
+	chunks   [][]byte // Received, not yet read
+	buffered int
+	consumed uint32 // Bytes read by the application, mod 2^32
+	reported uint32 // consumed as of the last window update
+	finRecv  bool   // The peer won't send more
+	finSent  bool
+	reset    bool
+	closed   bool
+
+	sent         uint32 // Bytes written, mod 2^32
+	peerConsumed uint32
+	peerWindow   uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{} // Signalled when data, FIN, RST or a deadline change arrives
+	writable chan struct{} // Signalled when the peer's window opens
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       s,
+		peerWindow: initialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream's number within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// notify wakes readers and writers to recheck the stream
+func (st *Stream) notify() {
+	signal(st.readable)
+	signal(st.writable)
+}
+
+// push queues data from the peer; false if it overran the window
+func (st *Stream) push(data []byte) bool {
+	st.mu.Lock()
+	if st.closed || st.reset {
+		st.mu.Unlock()
+		return true // Dropped; the stream is going away anyway
+	}
+	if st.buffered+len(data) > st.sess.config.Window {
+		st.reset = true
+		st.mu.Unlock()
+		st.notify()
+		return false
+	}
+	st.chunks = append(st.chunks, data)
+	st.buffered += len(data)
+	st.mu.Unlock()
+	signal(st.readable)
+	return true
+}
+
+func (st *Stream) finReceived() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+	if done {
+		st.sess.forget(st.id)
+	}
+	signal(st.readable)
+}
+
+func (st *Stream) resetByPeer() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	st.notify()
+}
+
+func (st *Stream) update(consumed, window uint32) {
+	st.mu.Lock()
+	st.peerConsumed = consumed
+	st.peerWindow = window
+	st.mu.Unlock()
+	signal(st.writable)
+}
+
+// Read reads data the peer wrote, returning io.EOF after the peer's FIN.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.chunks) > 0 {
+			n := 0
+			for n < len(b) && len(st.chunks) > 0 {
+				c := copy(b[n:], st.chunks[0])
+				n += c
+				if c == len(st.chunks[0]) {
+					st.chunks[0] = nil
+					st.chunks = st.chunks[1:]
+				} else {
+					st.chunks[0] = st.chunks[0][c:]
+				}
+			}
+			st.buffered -= n
+			st.consumed += uint32(n)
+			var update bool
+			// Every half initial window, so a sender still assuming the
+			// initial window learns of a larger one in time
+			if st.consumed-st.reported >= initialWindow/2 && !st.finRecv {
+				st.reported = st.consumed
+				update = true
+			}
+			consumed := st.consumed
+			st.mu.Unlock()
+			if update {
+				st.sess.windowUpdate(st.id, consumed)
+			}
+			return n, nil
+		}
+		err := st.readErr()
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readErr is why nothing more can be read, nil if data may still come;
+// st.mu must be held
+func (st *Stream) readErr() error {
+	switch {
+	case st.reset:
+		return ErrStreamReset
+	case st.finRecv:
+		return io.EOF
+	case st.closed:
+		return io.ErrClosedPipe
+	case st.sess.closed():
+		return st.sess.Err()
+	}
+	return nil
+}
+
+// Write sends b, waiting while the peer's window is full.
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		err := st.writeErr()
+		inflight := st.sent - st.peerConsumed
+		room := 0
+		if inflight < st.peerWindow {
+			room = int(st.peerWindow - inflight)
+		}
+		deadline := st.writeDeadline
+		if err == nil && room > 0 {
+			n := min(len(b)-written, room, maxPayload)
+			st.sent += uint32(n)
+			st.mu.Unlock()
+			if err := st.sess.writeFrame(cmdPSH, st.id, b[written:written+n]); err != nil {
+				return written, err
+			}
+			written += n
+			continue
+		}
+		st.mu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		if err := st.wait(st.writable, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writeErr is why nothing more can be written; st.mu must be held
+func (st *Stream) writeErr() error {
+	switch {
+	case st.reset:
+		return ErrStreamReset
+	case st.closed || st.finSent:
+		return io.ErrClosedPipe
+	case st.sess.closed():
+		return st.sess.Err()
+	}
+	return nil
+}
+
+// wait blocks until c is signalled, the deadline passes or the session ends
+func (st *Stream) wait(c chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-c:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.sess.die:
+		return nil // The caller reports the session's error
+	}
+}
+
+// CloseWrite sends FIN: the peer reads io.EOF once it has the data written
+// so far, and may keep writing.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.closed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+	if done {
+		st.sess.forget(st.id)
+	}
+	return st.sess.writeFrame(cmdFIN, st.id, nil)
+}
+
+// Close sends FIN if it wasn't sent and forgets the stream; data the peer
+// sends afterwards is answered with a reset.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFin := !st.finSent && !st.reset
+	st.finSent = true
+	st.chunks = nil
+	st.mu.Unlock()
+	st.sess.forget(st.id)
+	st.notify()
+	if sendFin {
+		return st.sess.writeFrame(cmdFIN, st.id, nil)
+	}
+	return nil
+}
+
+// LocalAddr returns the session connection's local address.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+// RemoteAddr returns the session connection's remote address.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	signal(st.readable)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for waiting on the peer's window.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	signal(st.writable)
+	return nil
+}
@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OnceConn is a net.Conn whose Close runs exactly once, whichever goroutine
+// gets there first: a relay direction unblocking the other, a shutdown
+// watcher or a deferred cleanup. Later calls return the first call's result
+// instead of a "use of closed network connection" error.
+type OnceConn struct {
+	net.Conn
+	once   sync.Once
+	closed atomic.Bool
+	err    error
+
+	deadlineMu sync.Mutex
+	readsEnd   time.Time // Set by ExpireReads; later read deadlines stop here
+}
+
+// CloseOnce wraps conn in an OnceConn, or returns it as is if it already is one
+func CloseOnce(conn net.Conn) *OnceConn {
+	if c, ok := conn.(*OnceConn); ok {
+		return c
+	}
+	return &OnceConn{Conn: conn}
+}
+
+// Close closes the connection the first time it is called and returns that
+// close's error on every call
+func (c *OnceConn) Close() error {
+	c.once.Do(func() {
+		c.closed.Store(true)
+		c.err = c.Conn.Close()
+	})
+	return c.err
+}
+
+// CloseWrite shuts down the writing side if the connection supports it,
+// such as a TCP connection. Otherwise it returns errors.ErrUnsupported.
+func (c *OnceConn) CloseWrite() error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// ExpireReads makes reads time out from t on, whatever read deadline is set
+// later. A relay direction that ended uses it to stop the other one when it
+// can't half-close the connection: the other direction gets until t to
+// finish what is in flight, then its read fails like an idle timeout.
+func (c *OnceConn) ExpireReads(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readsEnd = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// ReadsExpired reports whether ExpireReads was called, so that a read
+// timing out is not mistaken for an idle connection
+func (c *OnceConn) ReadsExpired() bool {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	return !c.readsEnd.IsZero()
+}
+
+// SetReadDeadline sets the read deadline, no later than ExpireReads allows
+func (c *OnceConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if !c.readsEnd.IsZero() && (t.IsZero() || t.After(c.readsEnd)) {
+		t = c.readsEnd
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetDeadline sets both deadlines, the read one no later than ExpireReads allows
+func (c *OnceConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+// Closed reports whether Close has been called
+func (c *OnceConn) Closed() bool {
+	return c.closed.Load()
+}
+
+// Unwrap returns the wrapped connection
+func (c *OnceConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Expected reports whether err from a read or write on this connection only
+// says that it was closed on purpose, by this side, so it is not worth
+// reporting
+func (c *OnceConn) Expected(err error) bool {
+	return err != nil && c.closed.Load() && isClosedErr(err)
+}
+
+// CloseError returns the error of the first Close if it is worth reporting:
+// nil if the connection is still open, closed cleanly, or was already closed
+// underneath this wrapper
+func (c *OnceConn) CloseError() error {
+	if !c.closed.Load() {
+		return nil
+	}
+	if err := c.Close(); !isClosedErr(err) {
+		return err
+	}
+	return nil
+}
+
+// isClosedErr reports the errors of using a closed connection: net.ErrClosed
+// from sockets, io.ErrClosedPipe from pipes and mux streams
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
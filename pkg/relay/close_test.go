@@ -0,0 +1,149 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingConn counts Close calls and fails every one after the first, as a
+// real connection does
+type countingConn struct {
+	net.Conn
+	closes atomic.Int32
+	err    error // Returned by the first Close
+}
+
+func (c *countingConn) Close() error {
+	if c.closes.Add(1) > 1 {
+		return net.ErrClosed
+	}
+	c.Conn.Close()
+	return c.err
+}
+
+func TestCloseOnce(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	inner := &countingConn{Conn: a}
+	c := CloseOnce(inner)
+	if CloseOnce(c) != c {
+		t.Error("CloseOnce wrapped an OnceConn again")
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Close(); err != nil {
+				t.Errorf("Close = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := inner.closes.Load(); n != 1 {
+		t.Errorf("underlying Close called %d times, want 1", n)
+	}
+
+	_, err := c.Read(make([]byte, 1))
+	if !c.Expected(err) {
+		t.Errorf("read after our own Close: %v not expected", err)
+	}
+	if c.Expected(io.EOF) {
+		t.Error("EOF from the peer counted as our own close")
+	}
+	if err := c.CloseError(); err != nil {
+		t.Errorf("CloseError = %v after a clean close", err)
+	}
+}
+
+// A failed close is reported, once, to every caller
+func TestCloseOnceError(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	failure := errors.New("flush failed")
+	c := CloseOnce(&countingConn{Conn: a, err: failure})
+	if err := c.CloseError(); err != nil {
+		t.Errorf("CloseError = %v before Close", err)
+	}
+	for range 2 {
+		if err := c.Close(); err != failure {
+			t.Errorf("Close = %v, want %v", err, failure)
+		}
+	}
+	if err := c.CloseError(); err != failure {
+		t.Errorf("CloseError = %v, want %v", err, failure)
+	}
+
+	// Something underneath closed it first: nothing worth reporting
+	a, b = net.Pipe()
+	defer b.Close()
+	a.Close()
+	c = CloseOnce(a)
+	c.Close()
+	if err := c.CloseError(); err != nil {
+		t.Errorf("CloseError = %v for a connection closed underneath", err)
+	}
+}
+
+func TestCloseOnceCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	c := CloseOnce(conn)
+	defer c.Close()
+	if err := c.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite on TCP = %v", err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("peer read %v, want EOF after CloseWrite", err)
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	p := CloseOnce(a)
+	defer p.Close()
+	if err := p.CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseWrite on a pipe = %v, want ErrUnsupported", err)
+	}
+}
+
+// After ExpireReads, a relay's per-read idle deadline can't extend reads
+// past the cutoff
+func TestCloseOnceExpireReads(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := CloseOnce(a)
+	defer c.Close()
+
+	c.ExpireReads(time.Now().Add(50 * time.Millisecond))
+	c.SetReadDeadline(time.Now().Add(time.Hour))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("read blocked %v past the cutoff", d)
+	}
+	if !c.ReadsExpired() {
+		t.Error("ReadsExpired = false after ExpireReads")
+	}
+}
@@ -10,6 +10,12 @@ const (
 	// DefaultWriteTimeout is the write deadline for each write operation.
 	DefaultWriteTimeout = 30 * time.Second
 
-	// bufSize is the buffer size used for copying data.
-	bufSize = 32 * 1024
+	// DefaultHalfCloseGrace is how long a relay direction may still run after
+	// the other ended, when the connection it reads can't be half-closed.
+	DefaultHalfCloseGrace = 10 * time.Second
+
+	// DefaultBufferSize is the buffer CopyConn allocates when given a size
+	// of 0. Smaller buffers save memory on low-end devices at some
+	// throughput cost.
+	DefaultBufferSize = 32 * 1024
 )
@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MinLimitBurst is the smallest burst a Limiter allows, so that very low
+// rates still pass whole packets instead of a few bytes at a time
+const MinLimitBurst = 4 * 1024
+
+// Limiter is a token bucket capping the bytes per second copied through it.
+// One Limiter may be shared by any number of copies, which then split the
+// rate between them. A nil *Limiter doesn't limit anything.
+type Limiter struct {
+	rate  float64 // Bytes per second
+	burst int     // Bucket size, a tenth of a second's worth or MinLimitBurst
+
+	mu     sync.Mutex
+	tokens float64 // Negative when copies have reserved more than is there
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter passing bytesPerSec, or nil if bytesPerSec
+// isn't positive
+func NewLimiter(bytesPerSec int64) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := int(max(bytesPerSec/10, MinLimitBurst))
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the limit in bytes per second, 0 for a nil Limiter
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// Burst returns the most bytes a single Wait may ask for
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	return l.burst
+}
+
+// Wait blocks until n bytes, at most Burst, may pass or ctx is done. The
+// bytes are reserved as soon as Wait is called, so copies sharing the
+// Limiter are served in the order they asked.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.burst))
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
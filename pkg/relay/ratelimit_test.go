@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewLimiter(t *testing.T) {
+	if l := NewLimiter(0); l != nil {
+		t.Errorf("NewLimiter(0) = %v, want nil", l)
+	}
+	var l *Limiter
+	if err := l.Wait(context.Background(), 1<<20); err != nil || l.Burst() != 0 || l.Rate() != 0 {
+		t.Error("a nil Limiter limits something")
+	}
+	if b := NewLimiter(1000).Burst(); b != MinLimitBurst {
+		t.Errorf("burst at 1000 B/s = %d, want %d", b, MinLimitBurst)
+	}
+	if b := NewLimiter(1 << 20).Burst(); b != 1<<20/10 {
+		t.Errorf("burst at 1 MB/s = %d, want a tenth of a second's worth", b)
+	}
+}
+
+// Past the initial burst, a limited copy runs at the limit's rate and reads
+// no more than a burst at a time
+func TestCopyConnLimited(t *testing.T) {
+	const rate = 400 * 1024
+	data := bytes.Repeat([]byte("x"), 200*1024)
+	limit := NewLimiter(rate)
+	src := &fakeSrc{steps: []step{{data: data}}}
+	dst := &fakeDst{}
+
+	start := time.Now()
+	written, err := CopyConnLimited(context.Background(), dst, src, 0, time.Minute, time.Minute, limit, nil)
+	elapsed := time.Since(start)
+	if written != int64(len(data)) || !bytes.Equal(dst.buf.Bytes(), data) {
+		t.Fatalf("written = %d, err = %v; want all %d bytes", written, err, len(data))
+	}
+	want := time.Duration(float64(len(data)-limit.Burst()) / rate * float64(time.Second))
+	if elapsed < want*9/10 {
+		t.Errorf("copied %d bytes in %v, want at least %v at %d B/s", len(data), elapsed, want, rate)
+	}
+	if n := (len(data) + limit.Burst() - 1) / limit.Burst(); dst.writes < n {
+		t.Errorf("%d writes, want at least %d of at most a burst each", dst.writes, n)
+	}
+}
+
+// Copies sharing a Limiter split its rate between them
+func TestLimiterShared(t *testing.T) {
+	const rate = 400 * 1024
+	limit := NewLimiter(rate)
+	per := 100 * 1024
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() {
+			src := &fakeSrc{steps: []step{{data: make([]byte, per)}}}
+			CopyConnLimited(context.Background(), &fakeDst{}, src, 0, time.Minute, time.Minute, limit, nil)
+		})
+	}
+	wg.Wait()
+	want := time.Duration(float64(2*per-limit.Burst()) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*9/10 {
+		t.Errorf("two copies of %d bytes took %v, want at least %v sharing %d B/s", per, elapsed, want, rate)
+	}
+}
+
+// A copy waiting on the limit returns as soon as ctx is cancelled
+func TestCopyConnLimitedCancel(t *testing.T) {
+	limit := NewLimiter(1024)
+	src := &fakeSrc{steps: []step{{data: make([]byte, 64*1024)}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	written, err := CopyConnLimited(ctx, &fakeDst{}, src, 0, time.Minute, time.Minute, limit, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if written != int64(limit.Burst()) {
+		t.Errorf("written = %d, want only the initial burst of %d", written, limit.Burst())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned %v after the cancel, want promptly", elapsed)
+	}
+}
@@ -1,19 +1,38 @@
 package relay
 
 import (
+	"context"
 	"net"
 	"time"
 )
 
-// CopyConn copies data from src to dst with idle and write timeouts to prevent
-// ghost connections. It blocks until src returns an error (including EOF/timeout)
+// CopyConn copies data from src to dst through a buffer of bufSize bytes
+// (DefaultBufferSize if 0), with idle and write timeouts to prevent ghost
+// connections. It blocks until src returns an error (including EOF/timeout)
 // or a write to dst fails.
-func CopyConn(dst, src net.Conn, idleTimeout, writeTimeout time.Duration, onWrite func(n int)) (written int64, err error) {
+func CopyConn(dst, src net.Conn, bufSize int, idleTimeout, writeTimeout time.Duration, onWrite func(n int)) (written int64, err error) {
+	return CopyConnLimited(context.Background(), dst, src, bufSize, idleTimeout, writeTimeout, nil, onWrite)
+}
+
+// CopyConnLimited is CopyConn holding each chunk back until limit lets it
+// pass; a nil limit copies at full speed. It also returns once ctx is done
+// while a chunk waits. Reads are capped at the limit's burst, so a slow
+// receiver pushes back on src instead of a large buffer piling up here.
+func CopyConnLimited(ctx context.Context, dst, src net.Conn, bufSize int, idleTimeout, writeTimeout time.Duration, limit *Limiter, onWrite func(n int)) (written int64, err error) {
+	if bufSize <= 0 {
+		bufSize = DefaultBufferSize
+	}
 	buf := make([]byte, bufSize)
+	if b := limit.Burst(); b > 0 && b < len(buf) {
+		buf = buf[:b]
+	}
 	for {
 		src.SetReadDeadline(time.Now().Add(idleTimeout))
 		n, rerr := src.Read(buf)
 		if n > 0 {
+			if err := limit.Wait(ctx, n); err != nil {
+				return written, err
+			}
 			dst.SetWriteDeadline(time.Now().Add(writeTimeout))
 			nw, werr := dst.Write(buf[:n])
 			if nw > 0 {
@@ -0,0 +1,284 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// step is one scripted Read: data arrives after wait on the fake clock, then
+// err (if any) is returned with it.
+type step struct {
+	data []byte
+	wait time.Duration
+	err  error
+}
+
+// fakeSrc replays steps. Instead of sleeping it keeps a virtual clock and
+// compares each step's wait against the read deadline armed before the Read,
+// so idle timeouts can be tested deterministically and instantly.
+type fakeSrc struct {
+	net.Conn
+	steps     []step
+	clock     time.Duration   // Virtual time spent waiting for data
+	deadlines []time.Duration // Remaining time of each armed read deadline
+	reads     int
+}
+
+func (s *fakeSrc) SetReadDeadline(t time.Time) error {
+	s.deadlines = append(s.deadlines, time.Until(t))
+	return nil
+}
+
+func (s *fakeSrc) Read(p []byte) (int, error) {
+	s.reads++
+	if len(s.steps) == 0 {
+		return 0, io.EOF
+	}
+	st := &s.steps[0]
+	if st.wait > 0 {
+		armed := s.deadlines[len(s.deadlines)-1]
+		if st.wait > armed {
+			s.clock += armed
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.clock += st.wait
+		st.wait = 0
+	}
+	n := copy(p, st.data)
+	st.data = st.data[n:]
+	if len(st.data) > 0 {
+		// The rest of a large chunk is already buffered
+		return n, nil
+	}
+	err := st.err
+	s.steps = s.steps[1:]
+	return n, err
+}
+
+// fakeDst collects written bytes. Writes after limit bytes are cut short
+// with failErr, and writes slower than the armed write deadline time out.
+type fakeDst struct {
+	net.Conn
+	buf       bytes.Buffer
+	limit     int // Accept at most this many bytes in total, 0 = unlimited
+	failErr   error
+	writeWait time.Duration // Virtual time each write takes
+	deadlines []time.Duration
+	writes    int
+}
+
+func (d *fakeDst) SetWriteDeadline(t time.Time) error {
+	d.deadlines = append(d.deadlines, time.Until(t))
+	return nil
+}
+
+func (d *fakeDst) Write(p []byte) (int, error) {
+	d.writes++
+	if d.writeWait > 0 && d.writeWait > d.deadlines[len(d.deadlines)-1] {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if d.limit > 0 && d.buf.Len()+len(p) > d.limit {
+		n := d.limit - d.buf.Len()
+		d.buf.Write(p[:n])
+		return n, d.failErr
+	}
+	return d.buf.Write(p)
+}
+
+// chunked splits data into randomly sized steps, some larger than DefaultBufferSize
+func chunked(rng *rand.Rand, data []byte) []step {
+	var steps []step
+	for len(data) > 0 {
+		n := min(1+rng.Intn(3*DefaultBufferSize), len(data))
+		steps = append(steps, step{data: data[:n]})
+		data = data[n:]
+	}
+	return steps
+}
+
+func TestCopyConnBytePerfect(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20+123)
+	rng.Read(data)
+
+	src := &fakeSrc{steps: chunked(rng, data)}
+	dst := &fakeDst{}
+	var callbacks, reported int
+	written, err := CopyConn(dst, src, 0, time.Minute, time.Minute, func(n int) {
+		callbacks++
+		reported += n
+	})
+
+	if err != io.EOF {
+		t.Errorf("err = %v, want EOF", err)
+	}
+	if written != int64(len(data)) {
+		t.Errorf("written = %d, want %d", written, len(data))
+	}
+	if !bytes.Equal(dst.buf.Bytes(), data) {
+		t.Error("destination bytes differ from source")
+	}
+	if reported != len(data) || callbacks != dst.writes {
+		t.Errorf("onWrite reported %d bytes in %d calls, want %d bytes in %d calls", reported, callbacks, len(data), dst.writes)
+	}
+}
+
+// A read that returns data together with an error must still deliver the data
+func TestCopyConnDataWithError(t *testing.T) {
+	src := &fakeSrc{steps: []step{
+		{data: []byte("hello ")},
+		{data: []byte("world"), err: io.EOF},
+	}}
+	dst := &fakeDst{}
+	written, err := CopyConn(dst, src, 0, time.Minute, time.Minute, nil)
+	if err != io.EOF || written != 11 || dst.buf.String() != "hello world" {
+		t.Errorf("got %q, written=%d, err=%v", dst.buf.String(), written, err)
+	}
+}
+
+// The buffer size bounds each chunk; 0 falls back to DefaultBufferSize
+func TestCopyConnBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		size, writes int
+	}{
+		{1024, 64},
+		{0, 2},
+	} {
+		src := &fakeSrc{steps: []step{{data: make([]byte, 64*1024)}}}
+		dst := &fakeDst{}
+		if written, err := CopyConn(dst, src, tt.size, time.Minute, time.Minute, nil); err != io.EOF || written != 64*1024 || dst.writes != tt.writes {
+			t.Errorf("size %d: written=%d in %d writes, err=%v; want %d writes", tt.size, written, dst.writes, err, tt.writes)
+		}
+	}
+}
+
+func TestCopyConnIdleDeadline(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	// Gaps just under the idle timeout keep the copy alive, even though the
+	// total is many times the timeout: the deadline is re-armed per read
+	var steps []step
+	for i := 0; i < 20; i++ {
+		steps = append(steps, step{data: []byte{byte(i)}, wait: 90 * time.Millisecond})
+	}
+	steps = append(steps, step{data: []byte("late"), wait: 150 * time.Millisecond})
+
+	src := &fakeSrc{steps: steps}
+	dst := &fakeDst{}
+	written, err := CopyConn(dst, src, 0, idle, time.Minute, nil)
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if written != 20 || dst.buf.Len() != 20 {
+		t.Errorf("written = %d (dst %d), want the 20 bytes before the gap", written, dst.buf.Len())
+	}
+	if src.clock < 20*90*time.Millisecond {
+		t.Errorf("virtual clock %v, want at least 1.8s", src.clock)
+	}
+	if len(src.deadlines) != src.reads {
+		t.Errorf("%d read deadlines for %d reads, want one per read", len(src.deadlines), src.reads)
+	}
+	for i, d := range src.deadlines {
+		if d <= 0 || d > idle {
+			t.Fatalf("read deadline %d armed %v ahead, want (0, %v]", i, d, idle)
+		}
+	}
+}
+
+func TestCopyConnWriteDeadline(t *testing.T) {
+	src := &fakeSrc{steps: []step{{data: []byte("stuck")}}}
+	dst := &fakeDst{writeWait: 2 * time.Second}
+	var reported int
+	written, err := CopyConn(dst, src, 0, time.Minute, time.Second, func(n int) { reported += n })
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if written != 0 || reported != 0 {
+		t.Errorf("written = %d, reported = %d, want 0", written, reported)
+	}
+	if len(dst.deadlines) != 1 || dst.deadlines[0] > time.Second {
+		t.Errorf("write deadlines = %v, want one of at most 1s", dst.deadlines)
+	}
+}
+
+func TestCopyConnPartialWrite(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	broken := errors.New("broken pipe")
+	src := &fakeSrc{steps: []step{{data: data}}}
+	dst := &fakeDst{limit: 40000, failErr: broken}
+	var reported int
+	written, err := CopyConn(dst, src, 0, time.Minute, time.Minute, func(n int) { reported += n })
+
+	if err != broken {
+		t.Fatalf("err = %v, want the write error", err)
+	}
+	if written != 40000 || reported != 40000 {
+		t.Errorf("written = %d, reported = %d, want 40000", written, reported)
+	}
+	if !bytes.Equal(dst.buf.Bytes(), data[:40000]) {
+		t.Error("partially written bytes differ from source")
+	}
+	if src.reads != 2 {
+		t.Errorf("%d reads, want 2 (no reads after the failed write)", src.reads)
+	}
+}
+
+// genSrc streams size pseudo-random bytes without holding them in memory
+type genSrc struct {
+	net.Conn
+	rng  *rand.Rand
+	left int64
+}
+
+func (g *genSrc) SetReadDeadline(time.Time) error { return nil }
+
+func (g *genSrc) Read(p []byte) (int, error) {
+	if g.left == 0 {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), g.left))
+	g.rng.Read(p[:n])
+	g.left -= int64(n)
+	return n, nil
+}
+
+type hashDst struct {
+	net.Conn
+	h io.Writer
+}
+
+func (d *hashDst) SetWriteDeadline(time.Time) error { return nil }
+func (d *hashDst) Write(p []byte) (int, error)      { return d.h.Write(p) }
+
+func TestCopyConnHugeTransfer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping huge transfer in short mode")
+	}
+	const size = 256 << 20
+
+	want := sha256.New()
+	io.CopyN(want, &genSrc{rng: rand.New(rand.NewSource(7)), left: size}, size)
+
+	got := sha256.New()
+	var reported int64
+	written, err := CopyConn(&hashDst{h: got}, &genSrc{rng: rand.New(rand.NewSource(7)), left: size}, 0, time.Minute, time.Minute, func(n int) {
+		reported += int64(n)
+	})
+	if err != io.EOF {
+		t.Fatalf("err = %v, want EOF", err)
+	}
+	if written != size || reported != size {
+		t.Errorf("written = %d, reported = %d, want %d", written, reported, size)
+	}
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Error("transferred stream hash differs")
+	}
+}
@@ -0,0 +1,126 @@
+package shadowtls
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Pin is the SHA-256 digest of a certificate's SubjectPublicKeyInfo, as
+// used by HPKP and most pinning tools
+type Pin [sha256.Size]byte
+
+// ParsePin parses a pin in base64, with an optional "sha256/" prefix, or in
+// hex with optional colons, e.g. the output of
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func ParsePin(s string) (Pin, error) {
+	var pin Pin
+	s = strings.TrimPrefix(strings.TrimSpace(s), "sha256/")
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(raw) != len(pin) {
+		raw, err = hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	}
+	if err != nil || len(raw) != len(pin) {
+		return pin, fmt.Errorf("invalid SHA-256 pin %q: want 32 bytes in base64 or hex", s)
+	}
+	copy(pin[:], raw)
+	return pin, nil
+}
+
+// ParsePins parses a comma-separated list of pins
+func ParsePins(list string) ([]Pin, error) {
+	var pins []Pin
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		pin, err := ParsePin(s)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// CertPin returns the pin of cert's public key
+func CertPin(cert *x509.Certificate) Pin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// String returns the pin in the "sha256/<base64>" form
+func (p Pin) String() string {
+	return "sha256/" + base64.StdEncoding.EncodeToString(p[:])
+}
+
+// CertPolicy checks the certificate the handshake server presents. The
+// ShadowTLS handshake is only camouflage, so by default any certificate is
+// accepted. But the handshake is relayed from the real decoy site, so a
+// certificate that doesn't chain to a trusted root for the SNI, or doesn't
+// match a pin, means something between the client and the server
+// terminated the TLS connection itself.
+type CertPolicy struct {
+	Verify bool           // Verify the chain and that it covers the SNI
+	Roots  *x509.CertPool // Roots for Verify, nil for the system roots
+	Pins   []Pin          // If set, a certificate in the chain must match one
+}
+
+// Equal reports whether p and o check the same things
+func (p *CertPolicy) Equal(o *CertPolicy) bool {
+	if p == nil || o == nil {
+		return p == o
+	}
+	return p.Verify == o.Verify && p.Roots.Equal(o.Roots) && slices.Equal(p.Pins, o.Pins)
+}
+
+// Check checks the chain presented for sni, leaf first
+func (p *CertPolicy) Check(sni string, chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return &CertError{SNI: sni, Reason: "no certificate was presented"}
+	}
+	if p.Verify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := chain[0].Verify(x509.VerifyOptions{
+			DNSName:       sni,
+			Roots:         p.Roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return &CertError{SNI: sni, Reason: "failed verification", Err: err}
+		}
+	}
+	if len(p.Pins) == 0 {
+		return nil
+	}
+	for _, cert := range chain {
+		if slices.Contains(p.Pins, CertPin(cert)) {
+			return nil
+		}
+	}
+	return &CertError{SNI: sni, Reason: fmt.Sprintf("matches no pin (leaf is %s)", CertPin(chain[0]))}
+}
+
+// CertError is returned by a dial whose handshake server presented a
+// certificate CertPolicy rejected
+type CertError struct {
+	SNI    string
+	Reason string
+	Err    error // The verification error, if any
+}
+
+func (e *CertError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("handshake certificate for %s %s: %v", e.SNI, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("handshake certificate for %s %s", e.SNI, e.Reason)
+}
+
+func (e *CertError) Unwrap() error { return e.Err }
@@ -0,0 +1,152 @@
+package shadowtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testChain issues a leaf for name from a fresh CA
+func testChain(t *testing.T, name string) (leaf, ca *x509.Certificate, cert tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ = x509.ParseCertificate(leafDER)
+	return leaf, ca, tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: key}
+}
+
+func TestParsePin(t *testing.T) {
+	leaf, _, _ := testChain(t, "example.com")
+	pin := CertPin(leaf)
+	for _, s := range []string{
+		pin.String(),
+		pin.String()[len("sha256/"):],
+		hex.EncodeToString(pin[:]),
+	} {
+		got, err := ParsePin(s)
+		if err != nil || got != pin {
+			t.Errorf("ParsePin(%q) = %v, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "sha256/abcd", "zz"} {
+		if _, err := ParsePin(s); err == nil {
+			t.Errorf("ParsePin(%q) accepted", s)
+		}
+	}
+
+	pins, err := ParsePins(" " + pin.String() + ", " + hex.EncodeToString(pin[:]) + ",")
+	if err != nil || len(pins) != 2 {
+		t.Errorf("ParsePins = %v, %v; want 2 pins", pins, err)
+	}
+	if _, err := ParsePins(pin.String() + ",zz"); err == nil {
+		t.Error("ParsePins accepted a bad pin in the list")
+	}
+}
+
+func TestCertPolicyCheck(t *testing.T) {
+	leaf, ca, _ := testChain(t, "example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	chain := []*x509.Certificate{leaf, ca}
+	other, _, _ := testChain(t, "example.com")
+
+	tests := []struct {
+		name   string
+		policy CertPolicy
+		sni    string
+		chain  []*x509.Certificate
+		ok     bool
+	}{
+		{"verified", CertPolicy{Verify: true, Roots: roots}, "example.com", chain, true},
+		{"wrong name", CertPolicy{Verify: true, Roots: roots}, "other.com", chain, false},
+		{"untrusted", CertPolicy{Verify: true, Roots: x509.NewCertPool()}, "example.com", chain, false},
+		{"leaf pin", CertPolicy{Pins: []Pin{CertPin(leaf)}}, "example.com", chain, true},
+		{"CA pin", CertPolicy{Pins: []Pin{CertPin(ca)}}, "example.com", chain, true},
+		{"replaced", CertPolicy{Pins: []Pin{CertPin(other)}}, "example.com", chain, false},
+		{"empty", CertPolicy{}, "example.com", nil, false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Check(tt.sni, tt.chain)
+		var certErr *CertError
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.ok && !errors.As(err, &certErr) {
+			t.Errorf("%s: Check = %v, want a *CertError", tt.name, err)
+		}
+	}
+}
+
+// A handshake server presenting a certificate the policy rejects fails the
+// dial, as an intercepting middlebox would
+func TestHandshakeCertPolicy(t *testing.T) {
+	leaf, _, cert := testChain(t, "example.com")
+	handshake := func(certs *CertPolicy) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			defer server.Close()
+			tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return newHandshakeFunc("example.com", nil, certs)(ctx, client, nil)
+	}
+
+	if err := handshake(nil); err != nil {
+		t.Fatalf("handshake without a policy: %v", err)
+	}
+	if err := handshake(&CertPolicy{Pins: []Pin{CertPin(leaf)}}); err != nil {
+		t.Errorf("handshake with the matching pin: %v", err)
+	}
+	other, _, _ := testChain(t, "example.com")
+	var certErr *CertError
+	if err := handshake(&CertPolicy{Pins: []Pin{CertPin(other)}}); !errors.As(err, &certErr) {
+		t.Errorf("handshake with another pin = %v, want a *CertError", err)
+	}
+	if err := handshake(&CertPolicy{Verify: true, Roots: x509.NewCertPool()}); !errors.As(err, &certErr) {
+		t.Errorf("handshake with an untrusted chain = %v, want a *CertError", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	sing_shadowtls "github.com/metacubex/sing-shadowtls"
+	M "github.com/metacubex/sing/common/metadata"
 	N "github.com/metacubex/sing/common/network"
 	"github.com/sirupsen/logrus"
 )
@@ -13,19 +14,29 @@ import (
 // Client wraps the sing-shadowtls client with timeout support.
 type Client struct {
 	client  *sing_shadowtls.Client
+	dialer  *checkedDialer
+	server  M.Socksaddr
+	sni     string
 	timeout time.Duration
 	logger  *logrus.Logger
+	hook    SessionIDHook
+	certs   *CertPolicy
+
+	onFailedHandshake func(t *Transcript, err error)
+	onDial            func(t DialTiming, err error)
 }
 
 // NewClient creates a new ShadowTLS v3 client.
 func NewClient(server, sni, password string, timeout time.Duration, logger *logrus.Logger) (*Client, error) {
 	serverHost, serverPort := ParseHostPort(server)
+	serverAddr := MakeSocksaddr(serverHost, serverPort)
+	dialer := &checkedDialer{}
 
 	client, err := sing_shadowtls.NewClient(sing_shadowtls.ClientConfig{
 		Version:    3,
 		Password:   password,
-		Server:     MakeSocksaddr(serverHost, serverPort),
-		Dialer:     N.SystemDialer,
+		Server:     serverAddr,
+		Dialer:     dialer,
 		StrictMode: false,
 		Logger:     &Logger{L: logger},
 	})
@@ -37,11 +48,36 @@ func NewClient(server, sni, password string, timeout time.Duration, logger *logr
 
 	return &Client{
 		client:  client,
+		dialer:  dialer,
+		server:  serverAddr,
+		sni:     sni,
 		timeout: timeout,
 		logger:  logger,
 	}, nil
 }
 
+// SetDialCheck installs a check run on every TCP connection to the server
+// before the handshake. It must be called before the first Dial.
+func (c *Client) SetDialCheck(check DialCheck) {
+	c.dialer.check = check
+}
+
+// SetSessionIDHook routes session ID generation through hook, e.g. to audit
+// the generated IDs or to plug in an alternative authentication scheme. It
+// must be called before the first Dial.
+func (c *Client) SetSessionIDHook(hook SessionIDHook) {
+	c.hook = hook
+	c.client.SetHandshakeFunc(newHandshakeFunc(c.sni, c.hook, c.certs))
+}
+
+// SetCertPolicy checks the handshake server's certificate against certs on
+// every dial; a dial it rejects fails with a *CertError. It must be called
+// before the first Dial.
+func (c *Client) SetCertPolicy(certs *CertPolicy) {
+	c.certs = certs
+	c.client.SetHandshakeFunc(newHandshakeFunc(c.sni, c.hook, c.certs))
+}
+
 // Dial establishes a new ShadowTLS connection.
 func (c *Client) Dial(ctx context.Context) (net.Conn, error) {
 	if c.timeout > 0 {
@@ -49,7 +85,57 @@ func (c *Client) Dial(ctx context.Context) (net.Conn, error) {
 		ctx, cancel = context.WithTimeout(ctx, c.timeout)
 		defer cancel()
 	}
-	return c.client.DialContext(ctx)
+
+	var timing DialTiming
+	raw, err := c.dialer.dial(ctx, N.NetworkTCP, c.server, &timing)
+	if err != nil {
+		c.traceDial(timing, err)
+		return nil, err
+	}
+	var rec *transcriptConn
+	handshakeConn := raw
+	if c.onFailedHandshake != nil {
+		rec = newTranscriptConn(raw)
+		handshakeConn = rec
+	}
+	start := time.Now()
+	conn, err := c.client.DialContextConn(ctx, handshakeConn)
+	timing.TLS = time.Since(start)
+	if rec != nil {
+		transcript := rec.finish()
+		if err != nil {
+			c.onFailedHandshake(transcript, err)
+		}
+	}
+	c.traceDial(timing, err)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SetDialTrace passes the stage timings of every dial, failed or not, to fn.
+// Telling the stages apart shows whether the server is unreachable (DNS or
+// TCP) or the handshake it relays to the SNI host fails or slows down. It
+// must be called before the first Dial.
+func (c *Client) SetDialTrace(fn func(t DialTiming, err error)) {
+	c.onDial = fn
+}
+
+func (c *Client) traceDial(t DialTiming, err error) {
+	if c.onDial != nil {
+		c.onDial(t, err)
+	}
+}
+
+// SetHandshakeTranscript records metadata of every handshake (record types,
+// lengths, hello extensions, timing; no payload) and passes it to fn when the
+// handshake fails, to help diagnose middlebox interference. Recording adds a
+// little overhead to each dial, so leave it off outside debugging. It must be
+// called before the first Dial.
+func (c *Client) SetHandshakeTranscript(fn func(t *Transcript, err error)) {
+	c.onFailedHandshake = fn
 }
 
 // Factory creates ShadowTLS connections for the pool.
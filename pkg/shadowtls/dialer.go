@@ -0,0 +1,113 @@
+package shadowtls
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	M "github.com/metacubex/sing/common/metadata"
+	N "github.com/metacubex/sing/common/network"
+)
+
+// DialCheck inspects a freshly dialed TCP connection to the server before the
+// TLS handshake starts. Returning an error closes the connection and fails the dial.
+type DialCheck func(conn net.Conn) error
+
+// DialStage is a step of a dial to the server
+type DialStage int
+
+const (
+	StageDNS DialStage = iota // Resolving the server name
+	StageTCP                  // TCP connect to the server
+	StageTLS                  // The handshake, which the server relays to the SNI host, and authentication
+)
+
+// String returns the short name used in logs and metrics
+func (s DialStage) String() string {
+	switch s {
+	case StageDNS:
+		return "dns"
+	case StageTCP:
+		return "tcp"
+	}
+	return "tls"
+}
+
+// DialTiming breaks a dial down into its stages. Stages the dial didn't
+// reach take no time.
+type DialTiming struct {
+	DNS   time.Duration // 0 when the server is given as an IP address
+	TCP   time.Duration
+	TLS   time.Duration
+	Stage DialStage // The last stage reached, where a failed dial stopped
+}
+
+// checkedDialer is the system dialer with an optional DialCheck.
+type checkedDialer struct {
+	check DialCheck
+}
+
+// DialContext dials destination and runs the check on the result.
+func (d *checkedDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	var timing DialTiming
+	return d.dial(ctx, network, destination, &timing)
+}
+
+// dial is DialContext recording how long the name lookup and the TCP connect
+// took in timing
+func (d *checkedDialer) dial(ctx context.Context, network string, destination M.Socksaddr, timing *DialTiming) (net.Conn, error) {
+	timing.Stage = StageDNS
+	var addrs []netip.Addr
+	if destination.IsFqdn() {
+		start := time.Now()
+		var err error
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", destination.Fqdn)
+		timing.DNS = time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timing.Stage = StageTCP
+	start := time.Now()
+	conn, err := dialAddrs(ctx, network, destination, addrs)
+	timing.TCP = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	if d.check != nil {
+		if err := d.check(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	timing.Stage = StageTLS
+	return conn, nil
+}
+
+// dialAddrs dials the resolved addrs of destination in order until one
+// connects, or destination itself if it is an address
+func dialAddrs(ctx context.Context, network string, destination M.Socksaddr, addrs []netip.Addr) (net.Conn, error) {
+	if addrs == nil {
+		return N.SystemDialer.DialContext(ctx, network, destination)
+	}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := N.SystemDialer.DialContext(ctx, network, M.SocksaddrFrom(addr, destination.Port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ListenPacket is passed through to the system dialer.
+func (d *checkedDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return N.SystemDialer.ListenPacket(ctx, destination)
+}
@@ -0,0 +1,64 @@
+package shadowtls
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A dial reports the stage it stopped in: a closed port fails the TCP
+// connect, a listener that hangs up fails the handshake
+func TestDialTrace(t *testing.T) {
+	dial := func(addr string) (DialTiming, error) {
+		client, err := NewClient(addr, "example.com", "password", 5*time.Second, logrus.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var traced DialTiming
+		var calls int
+		client.SetDialTrace(func(timing DialTiming, err error) {
+			traced = timing
+			calls++
+		})
+		_, err = client.Dial(t.Context())
+		if calls != 1 {
+			t.Errorf("dial to %s traced %d times, want once", addr, calls)
+		}
+		return traced, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	timing, err := dial("localhost:" + port)
+	if err == nil || timing.Stage != StageTLS {
+		t.Errorf("dial to a listener that hangs up: stage %v, err %v; want a tls failure", timing.Stage, err)
+	}
+	if timing.DNS <= 0 || timing.TCP <= 0 {
+		t.Errorf("name lookup %v, connect %v; want both timed", timing.DNS, timing.TCP)
+	}
+
+	ln.Close()
+	timing, err = dial("127.0.0.1:" + port)
+	if err == nil || timing.Stage != StageTCP {
+		t.Errorf("dial to a closed port: stage %v, err %v; want a tcp failure", timing.Stage, err)
+	}
+	if timing.DNS != 0 || timing.TLS != 0 {
+		t.Errorf("dial to an IP timed a lookup of %v and a handshake of %v, want neither", timing.DNS, timing.TLS)
+	}
+}
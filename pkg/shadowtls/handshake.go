@@ -8,19 +8,62 @@ import (
 	utls "github.com/refraction-networking/utls"
 )
 
+// Fingerprint is the uTLS ClientHello fingerprint used for the camouflage handshake.
+var Fingerprint = utls.HelloChrome_Auto
+
+// FingerprintName returns a readable name for Fingerprint, e.g. "Chrome-133".
+func FingerprintName() string {
+	return Fingerprint.Str()
+}
+
 // CreateHandshakeFunc creates a TLS handshake function that uses uTLS
 // with custom SessionID generation for ShadowTLS v3 authentication.
+//
+// Nothing is cached across connections. The ClientHello spec can't be:
+// GREASE values, the extension order shuffle and the key shares are
+// randomized per connection by the fingerprint, and reusing them would make
+// every tunnel send a byte-identical, linkable ClientHello. The extensions
+// also hold per-handshake state, so even an unrandomized template would
+// have to be deep-copied for each use. The config is no better: UClient
+// keeps it and the SNI extension writes to it, so a shared one would need a
+// clone per connection, which costs what building it does. Key share
+// generation dominates the per-handshake cost anyway.
 func CreateHandshakeFunc(sni string) sing_shadowtls.TLSHandshakeFunc {
+	return CreateHandshakeFuncWithHook(sni, nil)
+}
+
+// CreateHandshakeFuncWithHook is like CreateHandshakeFunc, but routes session
+// ID generation through hook when it is not nil.
+func CreateHandshakeFuncWithHook(sni string, hook SessionIDHook) sing_shadowtls.TLSHandshakeFunc {
+	return newHandshakeFunc(sni, hook, nil)
+}
+
+// newHandshakeFunc builds the handshake function, checking the handshake
+// server's certificate against certs when it is not nil
+func newHandshakeFunc(sni string, hook SessionIDHook, certs *CertPolicy) sing_shadowtls.TLSHandshakeFunc {
 	return func(ctx context.Context, conn net.Conn, sessionIDGenerator sing_shadowtls.TLSSessionIDGeneratorFunc) error {
+		if hook != nil {
+			generate := sessionIDGenerator
+			sessionIDGenerator = func(clientHello, sessionID []byte) error {
+				return hook(clientHello, sessionID, generate)
+			}
+		}
+
 		tlsConfig := &utls.Config{
 			ServerName: sni,
-			// Certificate verification is intentionally skipped: ShadowTLS
+			// Certificate verification is skipped by default: ShadowTLS
 			// authenticates via HMAC in the TLS SessionID, not via the
 			// certificate chain. The TLS handshake is camouflage only.
 			InsecureSkipVerify: true,
 		}
+		if certs != nil {
+			// Runs even with InsecureSkipVerify; the ClientHello is unchanged
+			tlsConfig.VerifyConnection = func(cs utls.ConnectionState) error {
+				return certs.Check(sni, cs.PeerCertificates)
+			}
+		}
 
-		uconn := utls.UClient(conn, tlsConfig, utls.HelloChrome_Auto)
+		uconn := utls.UClient(conn, tlsConfig, Fingerprint)
 
 		if err := uconn.BuildHandshakeState(); err != nil {
 			return err
@@ -0,0 +1,40 @@
+package shadowtls
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+
+	sing_shadowtls "github.com/metacubex/sing-shadowtls"
+)
+
+const (
+	// sessionIDOffset is where the session ID starts in a ClientHello
+	// handshake message: type(1) + length(3) + version(2) + random(32) + id length(1).
+	sessionIDOffset = 1 + 3 + 2 + 32 + 1
+	sessionIDSize   = 32
+	sessionHMACSize = 4
+)
+
+// SessionIDHook wraps ShadowTLS v3 session ID generation. It receives the
+// marshaled ClientHello handshake message (without the TLS record header),
+// the 32-byte session ID to fill in, and the default generator, which it can
+// call, replace or audit. The session ID is what authenticates the client,
+// so a hook that changes it must be matched by the server.
+type SessionIDHook func(clientHello, sessionID []byte, generate sing_shadowtls.TLSSessionIDGeneratorFunc) error
+
+// VerifySessionID reports whether the session ID in clientHello carries a
+// valid ShadowTLS v3 tag for password: the last 4 bytes must equal the first
+// 4 bytes of HMAC-SHA1(password, clientHello with those 4 bytes zeroed). This
+// is the check the server performs, as specified by the reference
+// implementation, and lets hooks and tests validate generated hellos.
+func VerifySessionID(clientHello []byte, password string) bool {
+	if len(clientHello) < sessionIDOffset+sessionIDSize || clientHello[sessionIDOffset-1] != sessionIDSize {
+		return false
+	}
+	tag := sessionIDOffset + sessionIDSize - sessionHMACSize
+	mac := hmac.New(sha1.New, []byte(password))
+	mac.Write(clientHello[:tag])
+	mac.Write(make([]byte, sessionHMACSize))
+	mac.Write(clientHello[tag+sessionHMACSize:])
+	return hmac.Equal(clientHello[tag:tag+sessionHMACSize], mac.Sum(nil)[:sessionHMACSize])
+}
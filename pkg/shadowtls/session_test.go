@@ -0,0 +1,133 @@
+package shadowtls
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	sing_shadowtls "github.com/metacubex/sing-shadowtls"
+	"github.com/sirupsen/logrus"
+)
+
+// referenceHello is a minimal ClientHello handshake message whose session ID
+// tag was computed independently with HMAC-SHA1("test-password", message
+// with the tag zeroed), as shadow-tls v3 specifies.
+func referenceHello(t *testing.T) []byte {
+	t.Helper()
+	var body []byte
+	body = append(body, 0x03, 0x03)
+	for i := 0; i < 32; i++ {
+		body = append(body, byte(i))
+	}
+	body = append(body, 0x20)
+	body = append(body, bytes.Repeat([]byte{0xaa}, 28)...)
+	tag, _ := hex.DecodeString("ede82a2e")
+	body = append(body, tag...)
+	body = append(body, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+	return append([]byte{0x01, 0, 0, byte(len(body))}, body...)
+}
+
+func TestVerifySessionIDReferenceVector(t *testing.T) {
+	hello := referenceHello(t)
+	if !VerifySessionID(hello, "test-password") {
+		t.Error("reference vector should verify")
+	}
+	if VerifySessionID(hello, "other-password") {
+		t.Error("wrong password should not verify")
+	}
+	tampered := append([]byte{}, hello...)
+	tampered[len(tampered)-1] ^= 1
+	if VerifySessionID(tampered, "test-password") {
+		t.Error("tampered hello should not verify")
+	}
+	if VerifySessionID(hello[:20], "test-password") {
+		t.Error("truncated hello should not verify")
+	}
+}
+
+// captureClientHello dials through client and returns the ClientHello
+// handshake message a fake server received.
+func captureClientHello(t *testing.T, client *Client, ln net.Listener) []byte {
+	t.Helper()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if conn, err := client.Dial(ctx); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	hello := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+func TestSessionIDHookInterop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := NewClient(ln.Addr().String(), "www.example.com", "secret", 2*time.Second, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []byte
+	client.SetSessionIDHook(func(clientHello, sessionID []byte, generate sing_shadowtls.TLSSessionIDGeneratorFunc) error {
+		if err := generate(clientHello, sessionID); err != nil {
+			return err
+		}
+		seen = append([]byte{}, sessionID...)
+		return nil
+	})
+
+	hello := captureClientHello(t, client, ln)
+	if !VerifySessionID(hello, "secret") {
+		t.Error("ClientHello from the default generator should verify with the reference check")
+	}
+	if !bytes.Contains(hello, seen) || len(seen) != sessionIDSize {
+		t.Errorf("hook saw session ID %x that is not in the sent ClientHello", seen)
+	}
+}
+
+func TestSessionIDHookReplacesGenerator(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := NewClient(ln.Addr().String(), "www.example.com", "secret", 2*time.Second, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An alternative scheme: leave the session ID random-looking but untagged
+	client.SetSessionIDHook(func(clientHello, sessionID []byte, _ sing_shadowtls.TLSSessionIDGeneratorFunc) error {
+		copy(sessionID, bytes.Repeat([]byte{0x42}, sessionIDSize))
+		return nil
+	})
+
+	hello := captureClientHello(t, client, ln)
+	if VerifySessionID(hello, "secret") {
+		t.Error("replaced generator should not produce a valid default tag")
+	}
+	if !bytes.Contains(hello, bytes.Repeat([]byte{0x42}, sessionIDSize)) {
+		t.Error("ClientHello should carry the hook's session ID")
+	}
+}
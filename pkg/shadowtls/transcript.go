@@ -0,0 +1,315 @@
+package shadowtls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// transcriptMaxRecords bounds how many records are kept per direction.
+	transcriptMaxRecords = 32
+	// transcriptMaxBuffer bounds buffering of one plaintext handshake record.
+	transcriptMaxBuffer = 5 + 16384 + 2048
+)
+
+// Transcript is handshake metadata captured for diagnosing failed
+// handshakes: record types and lengths, hello extensions and timing. No
+// payload is kept, so it is safe to log.
+type Transcript struct {
+	Start   time.Time
+	Records []RecordInfo
+	End     time.Duration // When the handshake failed, relative to Start
+	ReadErr string        // First read error, e.g. a reset by a middlebox
+	Read    int           // Bytes received
+	Written int           // Bytes sent
+}
+
+// RecordInfo describes one TLS record seen during the handshake.
+type RecordInfo struct {
+	At         time.Duration // Relative to Transcript.Start
+	Outbound   bool
+	Type       uint8
+	Length     int
+	Handshake  uint8    // First handshake message type, for handshake records
+	Version    uint16   // Hello legacy version, or selected version from supported_versions
+	Cipher     uint16   // ServerHello selected cipher suite
+	Ciphers    int      // ClientHello offered cipher suite count
+	Extensions []uint16 // Hello extension types in order
+	Alert      [2]uint8 // Level and description, for plaintext alerts
+	NonTLS     bool     // Bytes that are not a TLS record (e.g. an injected HTTP page)
+}
+
+// String renders a compact multi-line report.
+func (t *Transcript) String() string {
+	var b strings.Builder
+	for _, r := range t.Records {
+		dir := "in "
+		if r.Outbound {
+			dir = "out"
+		}
+		fmt.Fprintf(&b, "  +%-6v %s %s\n", r.At.Round(time.Millisecond), dir, r.describe())
+	}
+	fmt.Fprintf(&b, "  failed after %v: wrote %d bytes, read %d bytes", t.End.Round(time.Millisecond), t.Written, t.Read)
+	if t.ReadErr != "" {
+		fmt.Fprintf(&b, ", read error: %s", t.ReadErr)
+	}
+	return b.String()
+}
+
+func (r RecordInfo) describe() string {
+	if r.NonTLS {
+		return fmt.Sprintf("non-TLS data (first byte 0x%02x, %d bytes)", r.Type, r.Length)
+	}
+	s := fmt.Sprintf("%s len=%d", recordTypeName(r.Type), r.Length)
+	switch {
+	case r.Type == 21 && r.Length == 2:
+		level := "warning"
+		if r.Alert[0] == 2 {
+			level = "fatal"
+		}
+		s += fmt.Sprintf(" %s/%d", level, r.Alert[1])
+	case r.Type == 22:
+		s += " " + handshakeTypeName(r.Handshake)
+		if r.Version != 0 {
+			s += fmt.Sprintf(" ver=0x%04x", r.Version)
+		}
+		if r.Ciphers != 0 {
+			s += fmt.Sprintf(" ciphers=%d", r.Ciphers)
+		}
+		if r.Cipher != 0 {
+			s += fmt.Sprintf(" cipher=0x%04x", r.Cipher)
+		}
+		if r.Extensions != nil {
+			s += fmt.Sprintf(" ext=%v", r.Extensions)
+		}
+	}
+	return s
+}
+
+func recordTypeName(t uint8) string {
+	switch t {
+	case 20:
+		return "change_cipher_spec"
+	case 21:
+		return "alert"
+	case 22:
+		return "handshake"
+	case 23:
+		return "application_data"
+	}
+	return fmt.Sprintf("record(%d)", t)
+}
+
+func handshakeTypeName(t uint8) string {
+	switch t {
+	case 1:
+		return "ClientHello"
+	case 2:
+		return "ServerHello"
+	case 4:
+		return "NewSessionTicket"
+	case 11:
+		return "Certificate"
+	}
+	return fmt.Sprintf("handshake(%d)", t)
+}
+
+// transcriptConn records handshake metadata for both directions until
+// stopped; after that it only passes data through.
+type transcriptConn struct {
+	net.Conn
+	mu      sync.Mutex
+	t       Transcript
+	in, out recordParser
+	stopped bool
+}
+
+func newTranscriptConn(conn net.Conn) *transcriptConn {
+	c := &transcriptConn{Conn: conn}
+	c.t.Start = time.Now()
+	c.out.outbound = true
+	return c
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	if !c.stopped {
+		c.t.Read += n
+		c.in.feed(p[:n], time.Since(c.t.Start), &c.t)
+		if err != nil && c.t.ReadErr == "" {
+			c.t.ReadErr = err.Error()
+		}
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	if !c.stopped {
+		c.t.Written += n
+		c.out.feed(p[:n], time.Since(c.t.Start), &c.t)
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// finish stops recording and returns the transcript.
+func (c *transcriptConn) finish() *Transcript {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	c.t.End = time.Since(c.t.Start)
+	t := c.t
+	return &t
+}
+
+// recordParser splits one direction of the stream into TLS records.
+type recordParser struct {
+	outbound bool
+	buf      []byte
+	skip     int // Body bytes of the current record still to pass over
+	records  int
+	done     bool
+}
+
+func (p *recordParser) feed(data []byte, at time.Duration, t *Transcript) {
+	for len(data) > 0 && !p.done {
+		if p.skip > 0 {
+			n := min(p.skip, len(data))
+			p.skip -= n
+			data = data[n:]
+			continue
+		}
+		need := 5
+		if len(p.buf) >= 5 {
+			need = 5 + p.bodyNeeded()
+		}
+		n := min(need-len(p.buf), len(data))
+		p.buf = append(p.buf, data[:n]...)
+		data = data[n:]
+		if len(p.buf) < need {
+			continue
+		}
+		if len(p.buf) == 5 {
+			if typ := p.buf[0]; typ < 20 || typ > 23 {
+				p.add(t, RecordInfo{At: at, NonTLS: true, Type: typ, Length: len(p.buf) + len(data)})
+				p.done = true
+				return
+			}
+			if p.bodyNeeded() > 0 {
+				continue // Read the part of the body that is parsed
+			}
+		}
+		p.parse(at, t)
+	}
+}
+
+// bodyNeeded is how much of the record body is parsed: whole plaintext
+// handshake records, two bytes of an alert, nothing otherwise
+func (p *recordParser) bodyNeeded() int {
+	length := int(binary.BigEndian.Uint16(p.buf[3:5]))
+	switch p.buf[0] {
+	case 22:
+		return min(length, transcriptMaxBuffer-5)
+	case 21:
+		return min(length, 2)
+	}
+	return 0
+}
+
+func (p *recordParser) parse(at time.Duration, t *Transcript) {
+	length := int(binary.BigEndian.Uint16(p.buf[3:5]))
+	r := RecordInfo{At: at, Outbound: p.outbound, Type: p.buf[0], Length: length}
+	body := p.buf[5:]
+	switch r.Type {
+	case 21:
+		if len(body) == 2 {
+			r.Alert = [2]uint8{body[0], body[1]}
+		}
+	case 22:
+		if len(body) > 0 {
+			r.Handshake = body[0]
+			parseHello(body, &r)
+		}
+	}
+	p.add(t, r)
+	p.skip = length - len(body)
+	p.buf = p.buf[:0]
+}
+
+func (p *recordParser) add(t *Transcript, r RecordInfo) {
+	t.Records = append(t.Records, r)
+	p.records++
+	if p.records >= transcriptMaxRecords {
+		p.done = true
+	}
+}
+
+// parseHello extracts version, cipher and extension metadata from a
+// ClientHello or ServerHello handshake message. Malformed input is ignored.
+func parseHello(msg []byte, r *RecordInfo) {
+	if len(msg) < 4+2+32+1 || (msg[0] != 1 && msg[0] != 2) {
+		return
+	}
+	s := msg[4:]
+	r.Version = binary.BigEndian.Uint16(s)
+	s = s[2+32:]
+	sidLen := int(s[0])
+	if len(s) < 1+sidLen {
+		return
+	}
+	s = s[1+sidLen:]
+
+	if msg[0] == 1 {
+		if len(s) < 2 {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(s))
+		if len(s) < 2+n+1 {
+			return
+		}
+		r.Ciphers = n / 2
+		s = s[2+n:]
+		n = int(s[0])
+		if len(s) < 1+n {
+			return
+		}
+		s = s[1+n:]
+	} else {
+		if len(s) < 3 {
+			return
+		}
+		r.Cipher = binary.BigEndian.Uint16(s)
+		s = s[3:]
+	}
+
+	if len(s) < 2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(s))
+	s = s[2:]
+	if len(s) > n {
+		s = s[:n]
+	}
+	r.Extensions = []uint16{}
+	for len(s) >= 4 {
+		typ := binary.BigEndian.Uint16(s)
+		extLen := int(binary.BigEndian.Uint16(s[2:]))
+		if len(s) < 4+extLen {
+			return
+		}
+		r.Extensions = append(r.Extensions, typ)
+		// supported_versions in a ServerHello holds the negotiated version
+		if typ == 43 && msg[0] == 2 && extLen == 2 {
+			r.Version = binary.BigEndian.Uint16(s[4:])
+		}
+		s = s[4+extLen:]
+	}
+}
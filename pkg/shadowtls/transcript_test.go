@@ -0,0 +1,120 @@
+package shadowtls
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func record(typ uint8, body []byte) []byte {
+	return append([]byte{typ, 3, 3, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestRecordParser(t *testing.T) {
+	// ServerHello: version, random, empty session ID, TLS_AES_128_GCM_SHA256,
+	// no compression, supported_versions=TLS 1.3
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...)
+	hello = append(hello, 0x00, 0x13, 0x01, 0x00)
+	hello = append(hello, 0x00, 0x06, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)
+	msg := append([]byte{0x02, 0, 0, byte(len(hello))}, hello...)
+
+	var stream []byte
+	stream = append(stream, record(22, msg)...)
+	stream = append(stream, record(20, []byte{1})...)
+	stream = append(stream, record(23, make([]byte, 300))...)
+	stream = append(stream, record(21, []byte{2, 40})...)
+
+	// Feed in awkward chunks to exercise reassembly
+	var tr Transcript
+	var p recordParser
+	for i := 0; i < len(stream); i += 7 {
+		p.feed(stream[i:min(i+7, len(stream))], 0, &tr)
+	}
+
+	if len(tr.Records) != 4 {
+		t.Fatalf("got %d records, want 4: %+v", len(tr.Records), tr.Records)
+	}
+	sh := tr.Records[0]
+	if sh.Handshake != 2 || sh.Cipher != 0x1301 || sh.Version != 0x0304 || len(sh.Extensions) != 1 || sh.Extensions[0] != 43 {
+		t.Errorf("ServerHello parsed as %+v", sh)
+	}
+	if tr.Records[2].Type != 23 || tr.Records[2].Length != 300 {
+		t.Errorf("application data record parsed as %+v", tr.Records[2])
+	}
+	if tr.Records[3].Alert != [2]uint8{2, 40} {
+		t.Errorf("alert parsed as %+v", tr.Records[3])
+	}
+	report := tr.String()
+	for _, want := range []string{"ServerHello", "cipher=0x1301", "ver=0x0304", "alert len=2 fatal/40"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestRecordParserNonTLS(t *testing.T) {
+	var tr Transcript
+	var p recordParser
+	p.feed([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"), 0, &tr)
+	if len(tr.Records) != 1 || !tr.Records[0].NonTLS {
+		t.Fatalf("got %+v, want one non-TLS record", tr.Records)
+	}
+	if !strings.Contains(tr.String(), "non-TLS data (first byte 0x48") {
+		t.Errorf("report: %s", tr.String())
+	}
+}
+
+func TestHandshakeTranscriptOnFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A middlebox that reads the ClientHello and answers with a fatal alert
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 5)
+		io.ReadFull(conn, header)
+		io.CopyN(io.Discard, conn, int64(header[3])<<8|int64(header[4]))
+		conn.Write(record(21, []byte{2, 40}))
+	}()
+
+	client, err := NewClient(ln.Addr().String(), "www.example.com", "secret", 2*time.Second, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *Transcript, 1)
+	client.SetHandshakeTranscript(func(tr *Transcript, err error) {
+		got <- tr
+	})
+	if _, err := client.Dial(context.Background()); err == nil {
+		t.Fatal("expected handshake failure")
+	}
+
+	select {
+	case tr := <-got:
+		if len(tr.Records) < 2 || !tr.Records[0].Outbound || tr.Records[0].Handshake != 1 {
+			t.Fatalf("transcript should start with the outbound ClientHello:\n%s", tr)
+		}
+		if tr.Records[0].Ciphers == 0 || len(tr.Records[0].Extensions) == 0 {
+			t.Errorf("ClientHello metadata missing: %+v", tr.Records[0])
+		}
+		last := tr.Records[len(tr.Records)-1]
+		if last.Outbound || last.Type != 21 || last.Alert[1] != 40 {
+			t.Errorf("transcript should end with the inbound alert:\n%s", tr)
+		}
+	default:
+		t.Fatal("failure callback not called")
+	}
+}
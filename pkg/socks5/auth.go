@@ -0,0 +1,286 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultAuthTimeout bounds a single credential check by a backend
+	DefaultAuthTimeout = 5 * time.Second
+
+	// maxCachedCredentials caps a CachedAuth; when full, the least recently
+	// used entry makes room
+	maxCachedCredentials = 4096
+)
+
+// Authenticator checks the username and password a client sends with RFC 1929
+// authentication.
+type Authenticator interface {
+	// Authenticate reports whether the credentials are valid. An error means
+	// the check itself failed, e.g. an unreachable backend, and the client is
+	// refused.
+	Authenticate(ctx context.Context, username, password string) (bool, error)
+}
+
+// StaticAuth accepts the username/password pairs it holds.
+type StaticAuth map[string]string
+
+// Authenticate compares the password in constant time.
+func (s StaticAuth) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	return s.match([]byte(username), []byte(password)), nil
+}
+
+func (s StaticAuth) match(username, password []byte) bool {
+	want, ok := s[string(username)]
+	return ok && subtle.ConstantTimeCompare(password, []byte(want)) == 1
+}
+
+func (s StaticAuth) String() string {
+	return fmt.Sprintf("static (%d users)", len(s))
+}
+
+// HtpasswdAuth checks credentials against an Apache htpasswd file with bcrypt
+// (htpasswd -B) or SHA-1 ({SHA}, htpasswd -s) hashes. The file is read once;
+// load it again to pick up changes.
+type HtpasswdAuth struct {
+	path   string
+	hashes map[string]string
+}
+
+// LoadHtpasswd reads the htpasswd file at path. Entries with a hash format
+// other than bcrypt or {SHA} are rejected rather than never matching.
+func LoadHtpasswd(path string) (*HtpasswdAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: want user:hash", path, line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %q, use bcrypt (htpasswd -B)", path, line, username)
+		}
+		hashes[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &HtpasswdAuth{path: path, hashes: hashes}, nil
+}
+
+// Authenticate checks password against the user's hash.
+func (h *HtpasswdAuth) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	hash, ok := h.hashes[username]
+	if !ok {
+		return false, nil
+	}
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		got := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(got), []byte(sha)) == 1, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *HtpasswdAuth) String() string {
+	return fmt.Sprintf("htpasswd %s (%d users)", h.path, len(h.hashes))
+}
+
+// ExecAuth runs a command for every check, writing the username and the
+// password to its standard input on a line each. Exit status 0 accepts the
+// credentials, 1 rejects them, and anything else is an error. The
+// credentials never appear in its arguments or environment, where other
+// users could read them.
+type ExecAuth struct {
+	command []string
+}
+
+// NewExecAuth creates a backend running command, the program followed by its
+// arguments.
+func NewExecAuth(command []string) (*ExecAuth, error) {
+	if len(command) == 0 {
+		return nil, errors.New("empty auth command")
+	}
+	return &ExecAuth{command: command}, nil
+}
+
+// Authenticate runs the command, killing it when ctx is done.
+func (e *ExecAuth) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case ctx.Err() != nil:
+		return false, fmt.Errorf("auth command: %w", ctx.Err())
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return false, nil
+	default:
+		return false, fmt.Errorf("auth command: %w", err)
+	}
+}
+
+func (e *ExecAuth) String() string {
+	return "exec " + strings.Join(e.command, " ")
+}
+
+// HTTPAuth posts the credentials as JSON, {"username": ..., "password": ...},
+// to a URL. A 2xx status accepts them, 401 or 403 rejects them, and any other
+// status is an error.
+type HTTPAuth struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPAuth creates a backend posting to url.
+func NewHTTPAuth(url string) *HTTPAuth {
+	return &HTTPAuth{url: url, client: &http.Client{}}
+}
+
+// Authenticate posts the credentials, giving up when ctx is done.
+func (a *HTTPAuth) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	body, err := json.Marshal(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{username, password})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("auth endpoint: %s", resp.Status)
+	}
+}
+
+func (a *HTTPAuth) String() string {
+	return "http " + a.url
+}
+
+// CachedAuth remembers accepted credentials for a while, so an app opening
+// many connections doesn't run a bcrypt compare, a command or an HTTP
+// request for each. Rejections and errors are not cached: a cached
+// rejection would keep refusing a user whose password was just set, and
+// could be filled with guesses to push valid entries out.
+type CachedAuth struct {
+	backend Authenticator
+	ttl     time.Duration
+	salt    [32]byte // Random per cache, so keys can't be matched to precomputed hashes
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     list.List // Of [sha256.Size]byte keys, most recently used first
+}
+
+// NewCachedAuth caches backend's acceptances for ttl.
+func NewCachedAuth(backend Authenticator, ttl time.Duration) *CachedAuth {
+	c := &CachedAuth{
+		backend: backend,
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+	rand.Read(c.salt[:])
+	return c
+}
+
+type cachedEntry struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+// Authenticate answers from the cache or asks the backend. Entries are keyed
+// by a salted hash, so the cache holds no passwords.
+func (c *CachedAuth) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	h := sha256.New()
+	h.Write(c.salt[:])
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	now := time.Now()
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		if now.Before(el.Value.(*cachedEntry).expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return true, nil
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	valid, err := c.backend.Authenticate(ctx, username, password)
+	if err != nil || !valid {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		// Another connection with the same credentials got here first
+		el.Value.(*cachedEntry).expires = now.Add(c.ttl)
+		c.lru.MoveToFront(el)
+		return true, nil
+	}
+	if c.lru.Len() >= maxCachedCredentials {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedEntry{key: key, expires: now.Add(c.ttl)})
+	return true, nil
+}
+
+func (c *CachedAuth) String() string {
+	return fmt.Sprintf("%v, cached for %v", c.backend, c.ttl)
+}
@@ -0,0 +1,233 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// countingAuth counts checks and answers from a fixed set of credentials
+type countingAuth struct {
+	calls atomic.Int32
+	err   error
+}
+
+func (c *countingAuth) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	c.calls.Add(1)
+	if c.err != nil {
+		return false, c.err
+	}
+	return username == "alice" && password == "open sesame", nil
+}
+
+// authenticate runs the method selection and RFC 1929 exchange through h and
+// returns the handshake error
+func authenticate(h *Handler, username, password string) error {
+	var b []byte
+	b = append(b, Version, 1, AuthPassword, 0x01, byte(len(username)))
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	return h.handshake(context.Background(), &scriptConn{r: bytes.NewReader(b)}, make([]byte, scratchSize))
+}
+
+func TestSetAuthenticator(t *testing.T) {
+	h := NewHandler("", "", logrus.New())
+	backend := &countingAuth{}
+	h.SetAuthenticator(backend)
+	if err := authenticate(h, "alice", "open sesame"); err != nil {
+		t.Errorf("valid credentials refused: %v", err)
+	}
+	if err := authenticate(h, "alice", "guess"); err == nil {
+		t.Error("wrong password accepted")
+	}
+	backend.err = errors.New("backend down")
+	if err := authenticate(h, "alice", "open sesame"); err == nil || !strings.Contains(err.Error(), "backend down") {
+		t.Errorf("backend failure: %v", err)
+	}
+
+	// Without an authenticator the client must offer no-auth
+	h.SetAuthenticator(nil)
+	if err := authenticate(h, "alice", "open sesame"); err == nil {
+		t.Error("password-only client accepted without an authenticator")
+	}
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("open sesame"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\nalice:" + string(hash) + "\n\nbob:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		username, password string
+		want               bool
+	}{
+		{"alice", "open sesame", true},
+		{"alice", "guess", false},
+		{"bob", "test", true},
+		{"bob", "open sesame", false},
+		{"carol", "test", false},
+	} {
+		if ok, err := auth.Authenticate(context.Background(), tt.username, tt.password); ok != tt.want || err != nil {
+			t.Errorf("%s/%s: %v, %v, want %v", tt.username, tt.password, ok, err, tt.want)
+		}
+	}
+
+	// An MD5 hash would never match, so it fails the load instead
+	if err := os.WriteFile(path, []byte("alice:$apr1$xyz$abc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadHtpasswd(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Errorf("MD5 entry: %v", err)
+	}
+}
+
+func TestExecAuth(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	// Accept alice, reject anyone else, fail for mallory
+	script := `read u; read p
+[ "$u" = mallory ] && exit 2
+[ "$u" = alice ] && [ "$p" = "open sesame" ]`
+	auth, err := NewExecAuth([]string{"sh", "-c", script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if ok, err := auth.Authenticate(ctx, "alice", "open sesame"); !ok || err != nil {
+		t.Errorf("valid credentials: %v, %v", ok, err)
+	}
+	if ok, err := auth.Authenticate(ctx, "alice", "guess"); ok || err != nil {
+		t.Errorf("wrong password: %v, %v", ok, err)
+	}
+	if _, err := auth.Authenticate(ctx, "mallory", "x"); err == nil {
+		t.Error("exit status 2 not reported as an error")
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var creds struct{ Username, Password string }
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case creds.Username == "mallory":
+			w.WriteHeader(http.StatusInternalServerError)
+		case creds.Username != "alice" || creds.Password != "open sesame":
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	auth := NewHTTPAuth(srv.URL)
+	ctx := context.Background()
+	if ok, err := auth.Authenticate(ctx, "alice", "open sesame"); !ok || err != nil {
+		t.Errorf("valid credentials: %v, %v", ok, err)
+	}
+	if ok, err := auth.Authenticate(ctx, "alice", "guess"); ok || err != nil {
+		t.Errorf("wrong password: %v, %v", ok, err)
+	}
+	if _, err := auth.Authenticate(ctx, "mallory", "x"); err == nil {
+		t.Error("500 not reported as an error")
+	}
+}
+
+func TestCachedAuth(t *testing.T) {
+	backend := &countingAuth{}
+	auth := NewCachedAuth(backend, time.Minute)
+	ctx := context.Background()
+	for range 3 {
+		auth.Authenticate(ctx, "alice", "open sesame")
+		auth.Authenticate(ctx, "alice", "guess")
+	}
+	// Acceptances are cached, rejections asked every time
+	if n := backend.calls.Load(); n != 4 {
+		t.Errorf("%d backend calls, want 1 for the password and 3 for the guesses", n)
+	}
+	if ok, _ := auth.Authenticate(ctx, "alice", "guess"); ok {
+		t.Error("rejection turned into an acceptance")
+	}
+
+	// Errors are not cached
+	backend.err = errors.New("backend down")
+	for range 2 {
+		if _, err := auth.Authenticate(ctx, "bob", "x"); err == nil {
+			t.Error("backend error swallowed")
+		}
+	}
+	if n := backend.calls.Load(); n != 7 {
+		t.Errorf("%d backend calls, want errors retried", n)
+	}
+
+	// Expired answers are asked again
+	expired := NewCachedAuth(backend, 0)
+	backend.err = nil
+	expired.Authenticate(ctx, "alice", "open sesame")
+	expired.Authenticate(ctx, "alice", "open sesame")
+	if n := backend.calls.Load(); n != 9 {
+		t.Errorf("%d backend calls, want expired answers rechecked", n)
+	}
+}
+
+// A full cache makes room by dropping the least recently used entry
+func TestCachedAuthLRU(t *testing.T) {
+	auth := NewCachedAuth(acceptAll{}, time.Minute)
+	ctx := context.Background()
+	auth.Authenticate(ctx, "alice", "a")
+	for i := range maxCachedCredentials {
+		auth.Authenticate(ctx, fmt.Sprint("user", i), "x")
+		auth.Authenticate(ctx, "alice", "a") // Keeps alice recent
+	}
+	if n := auth.lru.Len(); n != maxCachedCredentials {
+		t.Errorf("%d entries, want the cap %d", n, maxCachedCredentials)
+	}
+	has := func(user, password string) bool {
+		h := sha256.New()
+		h.Write(auth.salt[:])
+		h.Write([]byte(user + "\x00" + password))
+		var key [sha256.Size]byte
+		h.Sum(key[:0])
+		_, ok := auth.entries[key]
+		return ok
+	}
+	if !has("alice", "a") {
+		t.Error("recently used entry was dropped")
+	}
+	if has("user0", "x") {
+		t.Error("least recently used entry was kept")
+	}
+}
+
+// acceptAll accepts any credentials
+type acceptAll struct{}
+
+func (acceptAll) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// The functions below read and write whole SOCKS5 messages as raw bytes,
+// for code that follows a negotiation it relays instead of serving it.
+
+// ReadGreeting reads a greeting: version, method count and methods
+func ReadGreeting(r io.Reader) ([]byte, error) {
+	b := make([]byte, 2, 2+255)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != Version {
+		return nil, fmt.Errorf("not SOCKS5: version %d", b[0])
+	}
+	return readMore(r, b, int(b[1]))
+}
+
+// ReadAuthRequest reads an RFC 1929 username/password request
+func ReadAuthRequest(r io.Reader) ([]byte, error) {
+	b := make([]byte, 2, 3+2*255)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	b, err := readMore(r, b, int(b[1])+1)
+	if err != nil {
+		return nil, err
+	}
+	return readMore(r, b, int(b[len(b)-1]))
+}
+
+// ReadAddrMessage reads a request or reply: version, command or reply code,
+// reserved byte, then an address and port
+func ReadAddrMessage(r io.Reader) ([]byte, error) {
+	b := make([]byte, 4, 4+1+255+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != Version {
+		return nil, fmt.Errorf("not SOCKS5: version %d", b[0])
+	}
+	switch b[3] {
+	case AtypIPv4:
+		return readMore(r, b, 4+2)
+	case AtypIPv6:
+		return readMore(r, b, 16+2)
+	case AtypDomain:
+		b, err := readMore(r, b, 1)
+		if err != nil {
+			return nil, err
+		}
+		return readMore(r, b, int(b[4])+2)
+	}
+	return nil, fmt.Errorf("unsupported address type %d", b[3])
+}
+
+// AppendReply appends a reply with code rep reporting addr
+func AppendReply(b []byte, rep byte, addr netip.AddrPort) []byte {
+	return appendAddrPort(append(b, Version, rep, 0), addr)
+}
+
+// appendAddrPort appends addr typed IPv6 for an IPv6 address and IPv4
+// otherwise, the unspecified address if it is not valid
+func appendAddrPort(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if !ip.IsValid() {
+		ip = netip.IPv4Unspecified()
+	}
+	if ip.Is6() {
+		b = append(b, AtypIPv6)
+		b = append(b, ip.AsSlice()...)
+	} else {
+		b = append(b, AtypIPv4)
+		ip4 := ip.As4()
+		b = append(b, ip4[:]...)
+	}
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// readMore appends the next n bytes from r to b
+func readMore(r io.Reader, b []byte, n int) ([]byte, error) {
+	l := len(b)
+	b = append(b, make([]byte, n)...)
+	_, err := io.ReadFull(r, b[l:])
+	return b, err
+}
@@ -0,0 +1,43 @@
+package socks5
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+// Each reader consumes exactly one message, leaving what follows it
+func TestReadMessages(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		read func(*bytes.Reader) ([]byte, error)
+		msg  []byte
+	}{
+		{"greeting", func(r *bytes.Reader) ([]byte, error) { return ReadGreeting(r) }, []byte{Version, 2, AuthNone, AuthPassword}},
+		{"auth", func(r *bytes.Reader) ([]byte, error) { return ReadAuthRequest(r) }, []byte{1, 1, 'u', 2, 'p', 'w'}},
+		{"ipv4", func(r *bytes.Reader) ([]byte, error) { return ReadAddrMessage(r) }, AppendReply(nil, RepSuccess, netip.MustParseAddrPort("10.0.0.1:53"))},
+		{"ipv6", func(r *bytes.Reader) ([]byte, error) { return ReadAddrMessage(r) }, AppendReply(nil, RepSuccess, netip.MustParseAddrPort("[::1]:53"))},
+		{"domain", func(r *bytes.Reader) ([]byte, error) { return ReadAddrMessage(r) }, []byte{Version, CmdConnect, 0, AtypDomain, 3, 'a', '.', 'b', 0, 80}},
+	} {
+		r := bytes.NewReader(append(bytes.Clone(tt.msg), 0xEE))
+		got, err := tt.read(r)
+		if err != nil || !bytes.Equal(got, tt.msg) || r.Len() != 1 {
+			t.Errorf("%s: read %x, %v with %d left, want %x", tt.name, got, err, r.Len(), tt.msg)
+		}
+	}
+
+	if _, err := ReadAddrMessage(bytes.NewReader([]byte{4, 1, 0, AtypIPv4, 1, 2, 3, 4, 0, 80})); err == nil {
+		t.Error("SOCKS4 request accepted")
+	}
+	if _, err := ReadAddrMessage(bytes.NewReader([]byte{Version, 1, 0, 0x09})); err == nil {
+		t.Error("unknown address type accepted")
+	}
+}
+
+// A reply without an address reports 0.0.0.0:0, as RFC 1928 expects
+func TestAppendReplyUnspecified(t *testing.T) {
+	want := []byte{Version, RepGeneralFailure, 0, AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if got := AppendReply(nil, RepGeneralFailure, netip.AddrPort{}); !bytes.Equal(got, want) {
+		t.Errorf("AppendReply = %x, want %x", got, want)
+	}
+}
@@ -1,13 +1,20 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -18,134 +25,353 @@ const (
 	// Version is the SOCKS protocol version (SOCKS5).
 	Version = 0x05
 
+	// DefaultNegotiationTimeout bounds the greeting, authentication and
+	// request of a connection unless SetNegotiationTimeout changes it.
+	DefaultNegotiationTimeout = 10 * time.Second
+
 	// Auth methods
-	authNone     = 0x00
-	authPassword = 0x02
-	authNoAccept = 0xFF
+	AuthNone     = 0x00
+	AuthPassword = 0x02
+	AuthNoAccept = 0xFF
 
 	// Commands
-	cmdConnect = 0x01
+	CmdConnect      = 0x01
+	CmdUDPAssociate = 0x03
 
 	// Address types
-	atypIPv4   = 0x01
-	atypDomain = 0x03
-	atypIPv6   = 0x04
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
 
 	// Reply codes
-	repSuccess          = 0x00
-	repHostUnreach      = 0x04
-	repCmdNotSupported  = 0x07
-	repAtypNotSupported = 0x08
+	RepSuccess          = 0x00
+	RepGeneralFailure   = 0x01
+	RepNotAllowed       = 0x02
+	RepNetUnreach       = 0x03
+	RepHostUnreach      = 0x04
+	RepConnRefused      = 0x05
+	RepTTLExpired       = 0x06
+	RepCmdNotSupported  = 0x07
+	RepAtypNotSupported = 0x08
+
+	// maxDomainLength is the longest DNS name; the wire allows 255
+	maxDomainLength = 253
+
+	// scratchSize fits the largest field: a 255-byte domain and its port read
+	// to the front with host:port formatted after them, or two credentials
+	scratchSize = 2*255 + 16
 )
 
+// ProtocolError reports a client message that violates RFC 1928/1929 or
+// exceeds the handler's limits. The connection is closed without a reply
+// where the protocol has none.
+type ProtocolError struct {
+	Field  string // Message field, e.g. "domain" or "username"
+	Value  int    // Offending length or value
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("invalid %s (%d): %s", e.Field, e.Value, e.Reason)
+}
+
+// ErrNotAllowed is returned by a dialer that refuses a target by policy. The
+// handler answers it with "connection not allowed by ruleset".
+var ErrNotAllowed = errors.New("connection not allowed by ruleset")
+
+// DialFunc opens the outbound connection for a CONNECT request, or the
+// "udp" socket to the target of a relayed datagram.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ConnectRecord describes a finished CONNECT for accounting.
+type ConnectRecord struct {
+	Target    string        // Requested host:port as sent by the client
+	Domain    string        // Requested domain name, empty for IP targets
+	Resolved  string        // ip:port the server actually connected to
+	BytesUp   int64         // Client to target
+	BytesDown int64         // Target to client
+	Duration  time.Duration // From the successful dial to close
+}
+
+// Stats counts how connections handled by a Handler ended up.
+type Stats struct {
+	Connects            uint64 // CONNECT requests that reached their target
+	NegotiationTimeouts uint64 // Closed for not finishing negotiation in time
+	NegotiationErrors   uint64 // Refused negotiations: auth failed, unsupported command, cut off
+	Malformed           uint64 // Closed for a ProtocolError
+	DialErrors          uint64 // CONNECT targets that could not be reached
+	UDPAssociations     uint64 // UDP ASSOCIATE requests granted
+	UDPSessions         uint64 // UDP targets relayed to
+	UDPDropped          uint64 // Datagrams dropped: malformed, fragmented or undeliverable
+}
+
 // Handler handles SOCKS5 protocol on a connection.
 type Handler struct {
-	username string
-	password string
-	logger   *logrus.Logger
+	auth        atomic.Pointer[Authenticator] // nil for no authentication
+	idleTimeout time.Duration
+	bufSize     int           // Relay copy buffer, 0 = relay.DefaultBufferSize
+	negotiation time.Duration // 0 = no deadline
+	dial        DialFunc
+	replyAddr   *net.TCPAddr // Reported instead of the real bound address, nil for none
+	account     func(ConnectRecord)
+	logger      *logrus.Logger
+	udp         bool // Accept UDP ASSOCIATE for UDPOverStreamHost
+	udpTimeout  time.Duration
+
+	connects            atomic.Uint64
+	negotiationTimeouts atomic.Uint64
+	negotiationErrors   atomic.Uint64
+	malformed           atomic.Uint64
+	dialErrors          atomic.Uint64
+	associations        atomic.Uint64
+	udpSessions         atomic.Uint64
+	udpDropped          atomic.Uint64
 }
 
-// NewHandler creates a new SOCKS5 handler.
+// NewHandler creates a new SOCKS5 handler. If username and password are both
+// set, clients must authenticate with them; SetAuthenticator can replace them
+// with another backend.
 func NewHandler(username, password string, logger *logrus.Logger) *Handler {
-	return &Handler{
-		username: username,
-		password: password,
-		logger:   logger,
+	h := &Handler{
+		idleTimeout: relay.DefaultIdleTimeout,
+		negotiation: DefaultNegotiationTimeout,
+		udpTimeout:  DefaultUDPSessionTimeout,
+		dial:        (&net.Dialer{}).DialContext,
+		logger:      logger,
+	}
+	if username != "" && password != "" {
+		h.SetAuthenticator(StaticAuth{username: password})
 	}
+	return h
+}
+
+// SetAuthenticator makes clients authenticate with a username and password
+// checked by auth, or not at all if auth is nil. It may be called while
+// connections are handled, e.g. on reload; negotiations already past the
+// method selection finish with the previous backend.
+func (h *Handler) SetAuthenticator(auth Authenticator) {
+	if auth == nil {
+		h.auth.Store(nil)
+		return
+	}
+	h.auth.Store(&auth)
+}
+
+// SetNegotiationTimeout sets how long a client may take from connecting to
+// sending its complete request, 0 for no limit. A client that never finishes
+// would otherwise hold its connection and goroutine forever.
+func (h *Handler) SetNegotiationTimeout(d time.Duration) {
+	if d >= 0 {
+		h.negotiation = d
+	}
+}
+
+// Stats returns the handler's counters.
+func (h *Handler) Stats() Stats {
+	return Stats{
+		Connects:            h.connects.Load(),
+		NegotiationTimeouts: h.negotiationTimeouts.Load(),
+		NegotiationErrors:   h.negotiationErrors.Load(),
+		Malformed:           h.malformed.Load(),
+		DialErrors:          h.dialErrors.Load(),
+		UDPAssociations:     h.associations.Load(),
+		UDPSessions:         h.udpSessions.Load(),
+		UDPDropped:          h.udpDropped.Load(),
+	}
+}
+
+// SetReplyAddr makes success replies report ip, and port when it is not
+// zero, as the bound address instead of the local address of the outbound
+// connection. Behind NAT that address is private and confuses some clients;
+// set the server's public address instead. ip may be IPv4 or IPv6.
+func (h *Handler) SetReplyAddr(ip net.IP, port int) {
+	if ip == nil {
+		h.replyAddr = nil
+		return
+	}
+	h.replyAddr = &net.TCPAddr{IP: ip, Port: port}
+}
+
+// boundAddr is the address to report for a connection bound to local,
+// applying the reply address override
+func (h *Handler) boundAddr(local net.Addr) *net.TCPAddr {
+	bound, _ := local.(*net.TCPAddr)
+	if h.replyAddr == nil {
+		return bound
+	}
+	addr := &net.TCPAddr{IP: h.replyAddr.IP, Port: h.replyAddr.Port}
+	if addr.Port == 0 && bound != nil {
+		addr.Port = bound.Port
+	}
+	return addr
+}
+
+// SetAccounting registers fn to be called with a record of every CONNECT
+// that was relayed, after both directions closed.
+func (h *Handler) SetAccounting(fn func(ConnectRecord)) {
+	h.account = fn
+}
+
+// SetDialer replaces the dialer used for CONNECT targets, e.g. with one that
+// enforces an ACL by returning ErrNotAllowed.
+func (h *Handler) SetDialer(dial DialFunc) {
+	if dial != nil {
+		h.dial = dial
+	}
+}
+
+// SetIdleTimeout sets how long a relayed connection may stay idle before it
+// is closed. The default is relay.DefaultIdleTimeout.
+func (h *Handler) SetIdleTimeout(d time.Duration) {
+	if d > 0 {
+		h.idleTimeout = d
+	}
+}
+
+// SetBufferSize sets the copy buffer of each relay direction. The default
+// is relay.DefaultBufferSize.
+func (h *Handler) SetBufferSize(n int) {
+	h.bufSize = n
 }
 
 // Handle processes a SOCKS5 connection.
 func (h *Handler) Handle(ctx context.Context, conn net.Conn) error {
-	if err := h.handshake(conn); err != nil {
-		return fmt.Errorf("handshake: %w", err)
+	if h.negotiation > 0 {
+		conn.SetDeadline(time.Now().Add(h.negotiation))
+	}
+	// One scratch buffer serves every field of the negotiation
+	buf := make([]byte, scratchSize)
+	if err := h.handshake(ctx, conn, buf); err != nil {
+		return h.negotiationFailed("handshake", err)
 	}
 
-	cmd, target, err := h.readRequest(conn)
+	cmd, target, err := h.readRequest(conn, buf)
 	if err != nil {
-		return fmt.Errorf("read request: %w", err)
+		return h.negotiationFailed("read request", err)
 	}
+	conn.SetDeadline(time.Time{})
 
 	switch cmd {
-	case cmdConnect:
-		return h.handleConnect(conn, target)
+	case CmdConnect:
+		return h.handleConnect(ctx, conn, buf, target)
+	case CmdUDPAssociate:
+		if h.udp && target == UDPOverStreamHost+":0" {
+			return h.handleUDPAssociate(ctx, conn, buf)
+		}
+		fallthrough
 	default:
-		_ = h.sendReply(conn, repCmdNotSupported, nil)
+		_ = h.sendReply(conn, buf, RepCmdNotSupported, nil)
+		h.negotiationErrors.Add(1)
 		return fmt.Errorf("unsupported command: %d", cmd)
 	}
 }
 
-func (h *Handler) handleConnect(conn net.Conn, target string) error {
-	h.logger.Infof("SOCKS5 CONNECT to %s", target)
+// negotiationFailed counts a failed negotiation by cause and wraps err
+func (h *Handler) negotiationFailed(stage string, err error) error {
+	var netErr net.Error
+	var protoErr *ProtocolError
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		h.negotiationTimeouts.Add(1)
+		return fmt.Errorf("%s: negotiation not finished within %v: %w", stage, h.negotiation, err)
+	case errors.As(err, &protoErr):
+		h.malformed.Add(1)
+	default:
+		h.negotiationErrors.Add(1)
+	}
+	return fmt.Errorf("%s: %w", stage, err)
+}
 
-	targetConn, err := net.Dial("tcp", target)
+func (h *Handler) handleConnect(ctx context.Context, conn net.Conn, buf []byte, target string) error {
+	targetConn, err := h.dial(ctx, "tcp", target)
 	if err != nil {
-		_ = h.sendReply(conn, repHostUnreach, nil)
+		h.logger.Debugf("SOCKS5 CONNECT to %s failed: %v", target, err)
+		_ = h.sendReply(conn, buf, replyCode(err), nil)
+		h.dialErrors.Add(1)
 		return fmt.Errorf("connect to %s: %w", target, err)
 	}
 	defer targetConn.Close()
+	h.connects.Add(1)
+
+	// Name the domain and the address it resolved to, so logs and accounting
+	// stay meaningful when a site's IPs rotate
+	record := ConnectRecord{Target: target, Resolved: targetConn.RemoteAddr().String()}
+	if host, _, _ := net.SplitHostPort(target); net.ParseIP(host) == nil {
+		record.Domain = host
+		h.logger.Infof("SOCKS5 CONNECT to %s (%s)", target, record.Resolved)
+	} else {
+		h.logger.Infof("SOCKS5 CONNECT to %s", target)
+	}
 
-	localAddr := targetConn.LocalAddr().(*net.TCPAddr)
-	if err := h.sendReply(conn, repSuccess, localAddr); err != nil {
+	if err := h.sendReply(conn, buf, RepSuccess, h.boundAddr(targetConn.LocalAddr())); err != nil {
 		return fmt.Errorf("send reply: %w", err)
 	}
 
+	start := time.Now()
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		relay.CopyConn(targetConn, conn, relay.DefaultIdleTimeout, relay.DefaultWriteTimeout, nil)
-		targetConn.(*net.TCPConn).CloseWrite()
+		record.BytesUp, _ = relay.CopyConn(targetConn, conn, h.bufSize, h.idleTimeout, relay.DefaultWriteTimeout, nil)
+		if tc, ok := targetConn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
 	}()
 
 	go func() {
 		defer wg.Done()
-		relay.CopyConn(conn, targetConn, relay.DefaultIdleTimeout, relay.DefaultWriteTimeout, nil)
+		record.BytesDown, _ = relay.CopyConn(conn, targetConn, h.bufSize, h.idleTimeout, relay.DefaultWriteTimeout, nil)
 		if tc, ok := conn.(*net.TCPConn); ok {
 			tc.CloseWrite()
 		}
 	}()
 
 	wg.Wait()
+	if h.account != nil {
+		record.Duration = time.Since(start)
+		h.account(record)
+	}
 	return nil
 }
 
-func (h *Handler) handshake(conn net.Conn) error {
-	header := make([]byte, 2)
+func (h *Handler) handshake(ctx context.Context, conn net.Conn, buf []byte) error {
+	header := buf[:2]
 	if _, err := io.ReadFull(conn, header); err != nil {
 		return err
 	}
 
 	if header[0] != Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+		return &ProtocolError{Field: "version", Value: int(header[0]), Reason: "not SOCKS5"}
+	}
+	if header[1] == 0 {
+		return &ProtocolError{Field: "method count", Value: 0, Reason: "at least one method is required"}
 	}
 
-	methods := make([]byte, header[1])
+	methods := buf[:header[1]]
 	if _, err := io.ReadFull(conn, methods); err != nil {
 		return err
 	}
 
-	needAuth := h.username != "" && h.password != ""
-
-	if needAuth {
-		if !slices.Contains(methods, authPassword) {
-			_, _ = conn.Write([]byte{Version, authNoAccept})
+	if auth := h.auth.Load(); auth != nil {
+		if !slices.Contains(methods, AuthPassword) {
+			_, _ = conn.Write(append(buf[:0], Version, AuthNoAccept))
 			return fmt.Errorf("client doesn't support password auth")
 		}
 
-		if _, err := conn.Write([]byte{Version, authPassword}); err != nil {
+		if _, err := conn.Write(append(buf[:0], Version, AuthPassword)); err != nil {
 			return fmt.Errorf("write auth method: %w", err)
 		}
 
-		if err := h.readAuth(conn); err != nil {
+		if err := h.readAuth(ctx, conn, buf, *auth); err != nil {
 			return err
 		}
 	} else {
-		if !slices.Contains(methods, authNone) {
-			_, _ = conn.Write([]byte{Version, authNoAccept})
+		if !slices.Contains(methods, AuthNone) {
+			_, _ = conn.Write(append(buf[:0], Version, AuthNoAccept))
 			return fmt.Errorf("client doesn't support no-auth")
 		}
-		if _, err := conn.Write([]byte{Version, authNone}); err != nil {
+		if _, err := conn.Write(append(buf[:0], Version, AuthNone)); err != nil {
 			return fmt.Errorf("write auth method: %w", err)
 		}
 	}
@@ -153,107 +379,174 @@ func (h *Handler) handshake(conn net.Conn) error {
 	return nil
 }
 
-func (h *Handler) readAuth(conn net.Conn) error {
-	version := make([]byte, 1)
-	if _, err := io.ReadFull(conn, version); err != nil {
+func (h *Handler) readAuth(ctx context.Context, conn net.Conn, buf []byte, auth Authenticator) error {
+	// Version and username length
+	header := buf[:2]
+	if _, err := io.ReadFull(conn, header); err != nil {
 		return err
 	}
-	if version[0] != 0x01 {
-		return fmt.Errorf("unsupported auth version: %d", version[0])
+	if header[0] != 0x01 {
+		return &ProtocolError{Field: "auth version", Value: int(header[0]), Reason: "not RFC 1929"}
 	}
-
-	ulen := make([]byte, 1)
-	if _, err := io.ReadFull(conn, ulen); err != nil {
-		return err
-	}
-	username := make([]byte, ulen[0])
-	if _, err := io.ReadFull(conn, username); err != nil {
-		return err
+	if header[1] == 0 {
+		return &ProtocolError{Field: "username", Value: 0, Reason: "must not be empty"}
 	}
 
-	plen := make([]byte, 1)
-	if _, err := io.ReadFull(conn, plen); err != nil {
+	// Username and password length, then the password after it
+	ulen := int(header[1])
+	if _, err := io.ReadFull(conn, buf[:ulen+1]); err != nil {
 		return err
 	}
-	password := make([]byte, plen[0])
-	if _, err := io.ReadFull(conn, password); err != nil {
+	plen := int(buf[ulen])
+	if plen == 0 {
+		return &ProtocolError{Field: "password", Value: 0, Reason: "must not be empty"}
+	}
+	if _, err := io.ReadFull(conn, buf[ulen:ulen+plen]); err != nil {
 		return err
 	}
+	username, password := buf[:ulen], buf[ulen:ulen+plen]
 
-	if string(username) != h.username || string(password) != h.password {
-		_, _ = conn.Write([]byte{0x01, 0x01})
-		return fmt.Errorf("auth: invalid credentials")
+	valid, err := checkAuth(ctx, auth, username, password)
+	if err != nil {
+		_, _ = conn.Write(append(buf[:0], 0x01, 0x01))
+		return fmt.Errorf("auth backend for %q: %w", username, err)
+	}
+	if !valid {
+		_, _ = conn.Write(append(buf[:0], 0x01, 0x01))
+		return fmt.Errorf("auth: invalid credentials for %q", username)
 	}
 
-	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+	if _, err := conn.Write(append(buf[:0], 0x01, 0x00)); err != nil {
 		return fmt.Errorf("write auth success: %w", err)
 	}
 	return nil
 }
 
-func (h *Handler) readRequest(conn net.Conn) (cmd byte, addr string, err error) {
-	header := make([]byte, 4)
+// checkAuth asks auth about the credentials. Static ones are checked in
+// place, keeping negotiation free of allocations; other backends get
+// DefaultAuthTimeout to answer.
+func checkAuth(ctx context.Context, auth Authenticator, username, password []byte) (bool, error) {
+	if static, ok := auth.(StaticAuth); ok {
+		return static.match(username, password), nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, DefaultAuthTimeout)
+	defer cancel()
+	return auth.Authenticate(ctx, string(username), string(password))
+}
+
+// readRequest parses a request into buf and formats the target as host:port
+// with a single allocation for the returned string
+func (h *Handler) readRequest(conn net.Conn, buf []byte) (cmd byte, addr string, err error) {
+	header := buf[:4]
 	if _, err := io.ReadFull(conn, header); err != nil {
 		return 0, "", err
 	}
 
 	if header[0] != Version {
-		return 0, "", fmt.Errorf("unsupported version: %d", header[0])
+		return 0, "", &ProtocolError{Field: "request version", Value: int(header[0]), Reason: "not SOCKS5"}
 	}
 
 	cmd = header[1]
 
-	var host string
+	// The address and port are read to the front of buf and the target is
+	// formatted after them
+	var n int
 	switch header[3] {
-	case atypIPv4:
-		addrBytes := make([]byte, 4)
-		if _, err := io.ReadFull(conn, addrBytes); err != nil {
-			return 0, "", err
-		}
-		host = net.IP(addrBytes).String()
-
-	case atypDomain:
-		lenByte := make([]byte, 1)
-		if _, err := io.ReadFull(conn, lenByte); err != nil {
-			return 0, "", err
-		}
-		domain := make([]byte, lenByte[0])
-		if _, err := io.ReadFull(conn, domain); err != nil {
+	case AtypIPv4:
+		n = 4
+	case AtypDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
 			return 0, "", err
 		}
-		host = string(domain)
-
-	case atypIPv6:
-		addrBytes := make([]byte, 16)
-		if _, err := io.ReadFull(conn, addrBytes); err != nil {
-			return 0, "", err
+		n = int(buf[0])
+		if n == 0 || n > maxDomainLength {
+			_ = h.sendReply(conn, buf, RepGeneralFailure, nil)
+			return 0, "", &ProtocolError{Field: "domain", Value: n, Reason: fmt.Sprintf("length must be 1-%d", maxDomainLength)}
 		}
-		host = net.IP(addrBytes).String()
-
+	case AtypIPv6:
+		n = 16
 	default:
-		_ = h.sendReply(conn, repAtypNotSupported, nil)
+		_ = h.sendReply(conn, buf, RepAtypNotSupported, nil)
 		return 0, "", fmt.Errorf("unsupported address type: %d", header[3])
 	}
-
-	portBytes := make([]byte, 2)
-	if _, err := io.ReadFull(conn, portBytes); err != nil {
+	atyp := header[3]
+	if _, err := io.ReadFull(conn, buf[:n+2]); err != nil {
 		return 0, "", err
 	}
-	port := binary.BigEndian.Uint16(portBytes)
+	port := binary.BigEndian.Uint16(buf[n : n+2])
+
+	out := buf[n+2 : n+2]
+	switch atyp {
+	case AtypIPv4:
+		out = netip.AddrPortFrom(netip.AddrFrom4([4]byte(buf[:4])), port).AppendTo(out)
+	case AtypIPv6:
+		out = netip.AddrPortFrom(netip.AddrFrom16([16]byte(buf[:16])), port).AppendTo(out)
+	default:
+		if i := bytes.IndexFunc(buf[:n], invalidDomainRune); i >= 0 {
+			// The reply is built in buf, so take the offending byte first
+			perr := &ProtocolError{Field: "domain", Value: int(buf[i]), Reason: "contains a control, space or ':' character"}
+			_ = h.sendReply(conn, buf, RepGeneralFailure, nil)
+			return 0, "", perr
+		}
+		out = append(out, buf[:n]...)
+		out = append(out, ':')
+		out = strconv.AppendUint(out, uint64(port), 10)
+	}
+	return cmd, string(out), nil
+}
 
-	return cmd, fmt.Sprintf("%s:%d", host, port), nil
+// replyCode maps a dial error to the SOCKS5 reply clients may branch on.
+// Timeouts are reported as TTL expired, the closest code for a target that
+// never answered; failed DNS lookups, timed out or not, as host unreachable.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return RepNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetUnreach
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return RepHostUnreach
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return RepTTLExpired
+	}
+	return RepGeneralFailure
 }
 
-func (h *Handler) sendReply(conn net.Conn, rep byte, addr *net.TCPAddr) error {
-	reply := []byte{Version, rep, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0}
+// invalidDomainRune reports characters that can't appear in a host name and
+// would confuse address parsing downstream
+func invalidDomainRune(r rune) bool {
+	return r <= ' ' || r == 0x7f || r == ':'
+}
+
+// sendReply writes a reply with addr as BND.ADDR and BND.PORT, typed IPv6
+// for an IPv6 address and IPv4 otherwise; nil reports 0.0.0.0:0. Strict
+// clients reject a reply whose address type doesn't match the bind.
+func (h *Handler) sendReply(conn net.Conn, buf []byte, rep byte, addr *net.TCPAddr) error {
+	reply := append(buf[:0], Version, rep, 0x00)
 
+	var ap netip.AddrPort
 	if addr != nil {
-		ip := addr.IP.To4()
-		if ip != nil {
-			copy(reply[4:8], ip)
+		ap = addr.AddrPort()
+	}
+	ip := ap.Addr().Unmap()
+	if ip.Is6() {
+		ip16 := ip.As16()
+		reply = append(reply, AtypIPv6)
+		reply = append(reply, ip16[:]...)
+	} else {
+		reply = append(reply, AtypIPv4)
+		ip4 := netip.IPv4Unspecified().As4()
+		if ip.IsValid() {
+			ip4 = ip.As4()
 		}
-		binary.BigEndian.PutUint16(reply[8:10], uint16(addr.Port))
+		reply = append(reply, ip4[:]...)
 	}
+	reply = binary.BigEndian.AppendUint16(reply, ap.Port())
 
 	_, err := conn.Write(reply)
 	return err
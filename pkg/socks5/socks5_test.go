@@ -0,0 +1,448 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReplyCode(t *testing.T) {
+	sysErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		desc string
+		err  error
+		want byte
+	}{
+		{"refused", sysErr(syscall.ECONNREFUSED), RepConnRefused},
+		{"network unreachable", sysErr(syscall.ENETUNREACH), RepNetUnreach},
+		{"host unreachable", sysErr(syscall.EHOSTUNREACH), RepHostUnreach},
+		{"unknown host", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}}, RepHostUnreach},
+		{"DNS timeout", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "timeout", Name: "x", IsTimeout: true}}, RepHostUnreach},
+		{"dial timeout", sysErr(syscall.ETIMEDOUT), RepTTLExpired},
+		{"context deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), RepTTLExpired},
+		{"ACL", fmt.Errorf("10.0.0.1:22: %w", ErrNotAllowed), RepNotAllowed},
+		{"other", errors.New("boom"), RepGeneralFailure},
+	}
+	for _, tt := range tests {
+		if got := replyCode(tt.err); got != tt.want {
+			t.Errorf("%s: replyCode(%v) = %#x, want %#x", tt.desc, tt.err, got, tt.want)
+		}
+	}
+}
+
+// connectReply runs a no-auth CONNECT to target through h and returns the
+// reply to the request
+func connectReply(t *testing.T, h *Handler, target *net.TCPAddr) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		h.Handle(context.Background(), server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	req := []byte{Version, 1, AuthNone, Version, CmdConnect, 0}
+	if ip4 := target.IP.To4(); ip4 != nil {
+		req = append(append(req, AtypIPv4), ip4...)
+	} else {
+		req = append(append(req, AtypIPv6), target.IP.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(target.Port))
+	// net.Pipe is unbuffered and the handler answers the greeting mid-request
+	go client.Write(req)
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil {
+		t.Fatal(err)
+	}
+	return readReply(t, client)
+}
+
+// readReply reads a reply to a request, with an address of the length its
+// type says
+func readReply(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	reply := make([]byte, 4, 4+16+2)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatal(err)
+	}
+	n := 4
+	switch reply[3] {
+	case AtypIPv4:
+	case AtypIPv6:
+		n = 16
+	default:
+		t.Fatalf("reply address type %#x", reply[3])
+	}
+	reply = reply[:4+n+2]
+	if _, err := io.ReadFull(r, reply[4:]); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// listenIPv6 listens on the IPv6 loopback, skipping the test without one
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestHandleConnectReplies(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := l.Addr().(*net.TCPAddr)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	defer l.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	h := NewHandler("", "", log)
+	if got := connectReply(t, h, open)[1]; got != RepSuccess {
+		t.Errorf("reachable target: reply %#x, want success", got)
+	}
+	if got := connectReply(t, h, refused)[1]; got != RepConnRefused {
+		t.Errorf("closed port: reply %#x, want connection refused", got)
+	}
+
+	h.SetDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, fmt.Errorf("%s: %w", addr, ErrNotAllowed)
+	})
+	if got := connectReply(t, h, open)[1]; got != RepNotAllowed {
+		t.Errorf("denied target: reply %#x, want not allowed", got)
+	}
+}
+
+func TestReplyAddr(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	target := l.Addr().(*net.TCPAddr)
+
+	h := NewHandler("", "", log)
+	reply := connectReply(t, h, target)
+	if !net.IP(reply[4:8]).Equal(net.IPv4(127, 0, 0, 1)) || binary.BigEndian.Uint16(reply[8:]) == 0 {
+		t.Errorf("default reply %v should report the real bound address", reply)
+	}
+
+	public := net.IPv4(203, 0, 113, 7).To4()
+	h.SetReplyAddr(public, 0)
+	reply = connectReply(t, h, target)
+	if !net.IP(reply[4:8]).Equal(public) || binary.BigEndian.Uint16(reply[8:]) == 0 {
+		t.Errorf("reply %v should report %s with the real port", reply, public)
+	}
+
+	h.SetReplyAddr(public, 8443)
+	reply = connectReply(t, h, target)
+	if !net.IP(reply[4:8]).Equal(public) || binary.BigEndian.Uint16(reply[8:]) != 8443 {
+		t.Errorf("reply %v should report %s:8443", reply, public)
+	}
+}
+
+// Replies for IPv6 binds carry an IPv6-typed address, not IPv4 zeros
+func TestReplyIPv6(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	l := listenIPv6(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	target := l.Addr().(*net.TCPAddr)
+
+	h := NewHandler("", "", log)
+	reply := connectReply(t, h, target)
+	if reply[1] != RepSuccess || reply[3] != AtypIPv6 {
+		t.Fatalf("reply %v, want success with an IPv6 address", reply)
+	}
+	if !net.IP(reply[4:20]).Equal(net.IPv6loopback) || binary.BigEndian.Uint16(reply[20:]) == 0 {
+		t.Errorf("reply %v should report the bound [::1] address and port", reply)
+	}
+
+	// The reply address override picks the type, whatever the bind
+	public := net.ParseIP("2001:db8::7")
+	h.SetReplyAddr(public, 0)
+	reply = connectReply(t, h, target)
+	if reply[3] != AtypIPv6 || !net.IP(reply[4:20]).Equal(public) || binary.BigEndian.Uint16(reply[20:]) == 0 {
+		t.Errorf("reply %v should report %s with the real port", reply, public)
+	}
+	h.SetReplyAddr(net.ParseIP("::ffff:203.0.113.7"), 8443)
+	reply = connectReply(t, h, target)
+	if reply[3] != AtypIPv4 || !net.IP(reply[4:8]).Equal(net.IPv4(203, 0, 113, 7)) || binary.BigEndian.Uint16(reply[8:]) != 8443 {
+		t.Errorf("reply %v should report the IPv4-mapped address as IPv4 203.0.113.7:8443", reply)
+	}
+
+	// Failures have no bound address and report 0.0.0.0:0
+	closed := listenIPv6(t)
+	refused := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+	h.SetReplyAddr(nil, 0)
+	reply = connectReply(t, h, refused)
+	if reply[1] != RepConnRefused || reply[3] != AtypIPv4 || !bytes.Equal(reply[4:], make([]byte, 6)) {
+		t.Errorf("failure reply %v, want connection refused from 0.0.0.0:0", reply)
+	}
+}
+
+func TestConnectAccounting(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	records := make(chan ConnectRecord, 1)
+	h := NewHandler("", "", log)
+	h.SetAccounting(func(r ConnectRecord) { records <- r })
+
+	client, server := net.Pipe()
+	go func() {
+		h.Handle(context.Background(), server)
+		server.Close()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	req := []byte{Version, 1, AuthNone, Version, CmdConnect, 0, AtypDomain, byte(len("localhost"))}
+	req = append(req, "localhost"...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	go client.Write(req)
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(client, resp); err != nil || resp[3] != RepSuccess {
+		t.Fatalf("reply %v, %v", resp, err)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case r := <-records:
+		want := fmt.Sprintf("127.0.0.1:%d", port)
+		if r.Target != fmt.Sprintf("localhost:%d", port) || r.Domain != "localhost" || r.Resolved != want {
+			t.Errorf("record = %+v, want domain localhost resolved to %s", r, want)
+		}
+		if r.BytesUp != 4 || r.BytesDown != 4 {
+			t.Errorf("record bytes = %d up, %d down, want 4 each", r.BytesUp, r.BytesDown)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no accounting record")
+	}
+}
+
+// scriptConn replays a client's negotiation and discards the replies
+type scriptConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *scriptConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *scriptConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestReadRequestTargets(t *testing.T) {
+	h := NewHandler("", "", logrus.New())
+	tests := []struct {
+		addr []byte
+		want string
+	}{
+		{[]byte{AtypIPv4, 10, 0, 0, 1, 0x01, 0xbb}, "10.0.0.1:443"},
+		{append(append([]byte{AtypIPv6}, net.ParseIP("2001:db8::1")...), 0x00, 0x16), "[2001:db8::1]:22"},
+		{append(append([]byte{AtypDomain, 11}, "example.com"...), 0x1f, 0x90), "example.com:8080"},
+	}
+	for _, tt := range tests {
+		req := append([]byte{Version, CmdConnect, 0}, tt.addr...)
+		conn := &scriptConn{r: bytes.NewReader(req)}
+		cmd, target, err := h.readRequest(conn, make([]byte, scratchSize))
+		if err != nil || cmd != CmdConnect || target != tt.want {
+			t.Errorf("readRequest = %d, %q, %v, want %q", cmd, target, err, tt.want)
+		}
+	}
+}
+
+// negotiation is a password-authenticated CONNECT request to a domain
+func negotiation() []byte {
+	b := []byte{Version, 2, AuthNone, AuthPassword}
+	b = append(b, 0x01, 4)
+	b = append(b, "user"...)
+	b = append(b, 6)
+	b = append(b, "secret"...)
+	b = append(b, Version, CmdConnect, 0, AtypDomain, 11)
+	b = append(b, "example.com"...)
+	return append(b, 0x01, 0xbb)
+}
+
+func TestNegotiationAllocs(t *testing.T) {
+	h := NewHandler("user", "secret", logrus.New())
+	script := negotiation()
+	buf := make([]byte, scratchSize)
+	conn := &scriptConn{r: bytes.NewReader(script)}
+	allocs := testing.AllocsPerRun(100, func() {
+		conn.r.Reset(script)
+		if err := h.handshake(context.Background(), conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, target, err := h.readRequest(conn, buf); err != nil || target != "example.com:443" {
+			t.Fatalf("readRequest = %q, %v", target, err)
+		}
+	})
+	// Only the target string is allocated
+	if allocs > 1 {
+		t.Errorf("negotiation allocated %v times, want at most 1", allocs)
+	}
+}
+
+func BenchmarkNegotiation(b *testing.B) {
+	h := NewHandler("user", "secret", logrus.New())
+	script := negotiation()
+	buf := make([]byte, scratchSize)
+	conn := &scriptConn{r: bytes.NewReader(script)}
+	b.ReportAllocs()
+	for b.Loop() {
+		conn.r.Reset(script)
+		h.handshake(context.Background(), conn, buf)
+		h.readRequest(conn, buf)
+	}
+}
+
+func TestNegotiationTimeout(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	h := NewHandler("", "", log)
+	h.SetNegotiationTimeout(50 * time.Millisecond)
+
+	handle := func(send []byte) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		done := make(chan error, 1)
+		go func() { done <- h.Handle(context.Background(), server) }()
+		go func() {
+			client.Write(send)
+			io.Copy(io.Discard, client)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Handle did not return")
+			return nil
+		}
+	}
+
+	// A greeting that never gets a request
+	if err := handle([]byte{Version, 1, AuthNone}); err == nil || !strings.Contains(err.Error(), "not finished within") {
+		t.Errorf("stalled client: err = %v", err)
+	}
+	if err := handle([]byte{0x04, 1, 0}); err == nil {
+		t.Error("SOCKS4 greeting should fail")
+	}
+	if s := h.Stats(); s.NegotiationTimeouts != 1 || s.Malformed != 1 || s.Connects != 0 {
+		t.Errorf("stats = %+v, want 1 timeout and 1 malformed", s)
+	}
+}
+
+func TestProtocolLimits(t *testing.T) {
+	h := NewHandler("user", "secret", logrus.New())
+	request := func(atyp byte, addr ...byte) []byte {
+		return append([]byte{Version, CmdConnect, 0, atyp}, append(addr, 0, 80)...)
+	}
+	long := append([]byte{254}, bytes.Repeat([]byte{'a'}, 254)...)
+	tests := []struct {
+		desc      string
+		handshake []byte // nil to test only the request
+		request   []byte
+		field     string
+		value     int
+	}{
+		{"no methods", []byte{Version, 0}, nil, "method count", 0},
+		{"empty username", []byte{Version, 1, AuthPassword, 0x01, 0}, nil, "username", 0},
+		{"empty password", []byte{Version, 1, AuthPassword, 0x01, 1, 'u', 0}, nil, "password", 0},
+		{"empty domain", nil, request(AtypDomain, 0), "domain", 0},
+		{"domain over 253 bytes", nil, request(AtypDomain, long...), "domain", 254},
+		{"domain with NUL", nil, request(AtypDomain, 3, 'a', 0, 'b'), "domain", 0},
+		{"domain with port", nil, request(AtypDomain, 4, 'a', ':', '2', '2'), "domain", ':'},
+	}
+	for _, tt := range tests {
+		buf := make([]byte, scratchSize)
+		var err error
+		if tt.handshake != nil {
+			err = h.handshake(context.Background(), &scriptConn{r: bytes.NewReader(tt.handshake)}, buf)
+		} else {
+			_, _, err = h.readRequest(&scriptConn{r: bytes.NewReader(tt.request)}, buf)
+		}
+		var pe *ProtocolError
+		if !errors.As(err, &pe) || pe.Field != tt.field || pe.Value != tt.value {
+			t.Errorf("%s: err = %v, want a ProtocolError for %s with %d", tt.desc, err, tt.field, tt.value)
+		}
+	}
+
+	// The longest valid name still parses
+	name := bytes.Repeat([]byte{'a'}, maxDomainLength)
+	_, target, err := h.readRequest(&scriptConn{r: bytes.NewReader(request(AtypDomain, append([]byte{maxDomainLength}, name...)...))}, make([]byte, scratchSize))
+	if err != nil || target != string(name)+":80" {
+		t.Errorf("253-byte domain: %q, %v", target, err)
+	}
+}
@@ -0,0 +1,313 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iprw/shadowtun/pkg/relay"
+)
+
+const (
+	// UDPOverStreamHost is the UDP ASSOCIATE address asking for the
+	// association's datagrams to be carried on the SOCKS5 connection itself,
+	// each as a UDPFrame, rather than through a UDP port of the server. Over
+	// a tunnel that keeps them inside it; the client's --socks5-udp turns an
+	// app's plain UDP ASSOCIATE into this one.
+	UDPOverStreamHost = "udp-over-stream.arpa"
+
+	// DefaultUDPSessionTimeout is how long a UDP target may go without a
+	// datagram either way before its session is dropped, unless
+	// SetUDPSessionTimeout changes it.
+	DefaultUDPSessionTimeout = time.Minute
+
+	// maxUDPSessions bounds the targets one association may talk to at once
+	maxUDPSessions = 256
+
+	// maxDatagram is the largest UDP payload plus the largest header
+	maxDatagram = 65535 + 262
+)
+
+// EnableUDP makes the handler accept UDP ASSOCIATE for UDPOverStreamHost.
+// A plain UDP ASSOCIATE, whose datagrams would reach the server outside the
+// connection that carried the request, is still refused.
+func (h *Handler) EnableUDP() {
+	h.udp = true
+}
+
+// SetUDPSessionTimeout sets how long a UDP target may stay idle before its
+// session is closed. The default is DefaultUDPSessionTimeout.
+func (h *Handler) SetUDPSessionTimeout(d time.Duration) {
+	if d > 0 {
+		h.udpTimeout = d
+	}
+}
+
+// AppendUDPOverStreamRequest appends the UDP ASSOCIATE request for
+// UDPOverStreamHost
+func AppendUDPOverStreamRequest(b []byte) []byte {
+	b = append(b, Version, CmdUDPAssociate, 0, AtypDomain, byte(len(UDPOverStreamHost)))
+	b = append(b, UDPOverStreamHost...)
+	return append(b, 0, 0)
+}
+
+// AppendUDPFrame appends datagram, a UDP request header as in RFC 1928 §7
+// and its payload, framed for a UDPOverStreamHost association: its length
+// as two big-endian bytes, then the datagram
+func AppendUDPFrame(b, datagram []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(datagram)))
+	return append(b, datagram...)
+}
+
+// ReadUDPFrame reads one frame written by AppendUDPFrame into buf, which
+// must hold 65535 bytes, and returns the datagram
+func ReadUDPFrame(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// udpAssociation relays the datagrams of one UDP ASSOCIATE, framed on its
+// SOCKS5 connection. Every target gets its own connected socket, NAT style,
+// so replies are matched to targets by the kernel and the dialer's ACL
+// applies per target.
+type udpAssociation struct {
+	h    *Handler
+	conn net.Conn
+
+	wmu sync.Mutex // Serializes frames written back to the client
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	wg       sync.WaitGroup
+
+	datagramsUp   atomic.Uint64
+	datagramsDown atomic.Uint64
+	targets       atomic.Uint64
+}
+
+type udpSession struct {
+	conn net.Conn
+	last atomic.Int64 // Unix nanoseconds of the last datagram either way
+}
+
+func (h *Handler) handleUDPAssociate(ctx context.Context, conn net.Conn, buf []byte) error {
+	// Nothing is bound for the client to send to: the datagrams follow on
+	// this connection
+	if err := h.sendReply(conn, buf, RepSuccess, nil); err != nil {
+		return fmt.Errorf("send reply: %w", err)
+	}
+	h.associations.Add(1)
+
+	a := &udpAssociation{
+		h:        h,
+		conn:     conn,
+		sessions: make(map[string]*udpSession),
+	}
+	h.logger.Infof("SOCKS5 UDP ASSOCIATE from %s", conn.RemoteAddr())
+
+	// The association lives as long as its connection (RFC 1928 §7)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	start := time.Now()
+	a.serve(ctx)
+	cancel()
+	a.close()
+	h.logger.Infof("SOCKS5 UDP association from %s closed after %v: %d targets, %d datagrams up, %d down",
+		conn.RemoteAddr(), time.Since(start).Round(time.Second), a.targets.Load(), a.datagramsUp.Load(), a.datagramsDown.Load())
+	return nil
+}
+
+// serve relays datagrams from the client until its connection closes or
+// carries nothing for the idle timeout
+func (a *udpAssociation) serve(ctx context.Context) {
+	buf := make([]byte, maxDatagram)
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(a.h.idleTimeout))
+		datagram, err := ReadUDPFrame(a.conn, buf)
+		if err != nil {
+			return
+		}
+		target, payload, err := parseUDPHeader(datagram)
+		if err != nil {
+			a.h.udpDropped.Add(1)
+			a.h.logger.Debugf("SOCKS5 UDP from %s: %v", a.conn.RemoteAddr(), err)
+			continue
+		}
+		s, err := a.session(ctx, target)
+		if err != nil {
+			a.h.udpDropped.Add(1)
+			a.h.logger.Debugf("SOCKS5 UDP to %s: %v", target, err)
+			continue
+		}
+		s.last.Store(time.Now().UnixNano())
+		if _, err := s.conn.Write(payload); err == nil {
+			a.datagramsUp.Add(1)
+		}
+	}
+}
+
+// session returns the session for target, dialing it if there is none
+func (a *udpAssociation) session(ctx context.Context, target string) (*udpSession, error) {
+	a.mu.Lock()
+	s, ok := a.sessions[target]
+	full := len(a.sessions) >= maxUDPSessions
+	a.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+	if full {
+		return nil, fmt.Errorf("over %d targets", maxUDPSessions)
+	}
+
+	conn, err := a.h.dial(ctx, "udp", target)
+	if err != nil {
+		return nil, err
+	}
+	s = &udpSession{conn: conn}
+	a.mu.Lock()
+	if ctx.Err() != nil {
+		a.mu.Unlock()
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	a.sessions[target] = s
+	a.wg.Add(1)
+	a.mu.Unlock()
+	a.targets.Add(1)
+	a.h.udpSessions.Add(1)
+	a.h.logger.Debugf("SOCKS5 UDP to %s (%s)", target, conn.RemoteAddr())
+
+	go func() {
+		defer a.wg.Done()
+		a.reply(s)
+		a.mu.Lock()
+		if a.sessions[target] == s {
+			delete(a.sessions, target)
+		}
+		a.mu.Unlock()
+		conn.Close()
+	}()
+	return s, nil
+}
+
+// reply relays datagrams from a target back to the client until the
+// session has been idle for the session timeout
+func (a *udpAssociation) reply(s *udpSession) {
+	// A frame is its length and at most 65535 bytes of header and payload
+	buf := make([]byte, 2+0xffff)
+	header := appendUDPHeader(buf[:2], s.conn.RemoteAddr())
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(a.h.udpTimeout))
+		n, err := s.conn.Read(buf[len(header):])
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, s.last.Load())) < a.h.udpTimeout {
+				continue // The client sent something since
+			}
+			return
+		}
+		s.last.Store(time.Now().UnixNano())
+		binary.BigEndian.PutUint16(buf, uint16(len(header)-2+n))
+		a.wmu.Lock()
+		a.conn.SetWriteDeadline(time.Now().Add(relay.DefaultWriteTimeout))
+		_, err = a.conn.Write(buf[:len(header)+n])
+		a.wmu.Unlock()
+		if err != nil {
+			a.conn.Close() // The client is gone; end the association
+			return
+		}
+		a.datagramsDown.Add(1)
+	}
+}
+
+// close ends every session and waits for them
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	for _, s := range a.sessions {
+		s.conn.Close()
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+}
+
+// parseUDPHeader splits a client datagram into its target host:port and
+// payload. Fragments are not supported and are refused, as RFC 1928 allows.
+func parseUDPHeader(b []byte) (target string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, &ProtocolError{Field: "UDP header", Value: len(b), Reason: "too short"}
+	}
+	if b[0] != 0 || b[1] != 0 {
+		return "", nil, &ProtocolError{Field: "UDP RSV", Value: int(binary.BigEndian.Uint16(b)), Reason: "must be zero"}
+	}
+	if b[2] != 0 {
+		return "", nil, &ProtocolError{Field: "UDP FRAG", Value: int(b[2]), Reason: "fragmentation not supported"}
+	}
+	var host string
+	rest := b[4:]
+	switch b[3] {
+	case AtypIPv4:
+		if len(rest) < 4+2 {
+			return "", nil, &ProtocolError{Field: "UDP header", Value: len(b), Reason: "too short"}
+		}
+		host = netip.AddrFrom4([4]byte(rest[:4])).String()
+		rest = rest[4:]
+	case AtypIPv6:
+		if len(rest) < 16+2 {
+			return "", nil, &ProtocolError{Field: "UDP header", Value: len(b), Reason: "too short"}
+		}
+		host = netip.AddrFrom16([16]byte(rest[:16])).String()
+		rest = rest[16:]
+	case AtypDomain:
+		if len(rest) < 1 {
+			return "", nil, &ProtocolError{Field: "UDP header", Value: len(b), Reason: "too short"}
+		}
+		n := int(rest[0])
+		if n == 0 || n > maxDomainLength {
+			return "", nil, &ProtocolError{Field: "domain", Value: n, Reason: fmt.Sprintf("length must be 1-%d", maxDomainLength)}
+		}
+		if len(rest) < 1+n+2 {
+			return "", nil, &ProtocolError{Field: "UDP header", Value: len(b), Reason: "too short"}
+		}
+		domain := rest[1 : 1+n]
+		for _, c := range domain {
+			if invalidDomainRune(rune(c)) {
+				return "", nil, &ProtocolError{Field: "domain", Value: int(c), Reason: "contains a control, space or ':' character"}
+			}
+		}
+		host = string(domain)
+		rest = rest[1+n:]
+	default:
+		return "", nil, &ProtocolError{Field: "address type", Value: int(b[3]), Reason: "unsupported"}
+	}
+	port := binary.BigEndian.Uint16(rest)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), rest[2:], nil
+}
+
+// appendUDPHeader appends the header of a datagram from addr to the client
+func appendUDPHeader(b []byte, addr net.Addr) []byte {
+	var ap netip.AddrPort
+	if u, ok := addr.(*net.UDPAddr); ok {
+		ap = u.AddrPort()
+	}
+	return appendAddrPort(append(b, 0, 0, 0), ap)
+}
@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// udpAssociate sends req, a UDP ASSOCIATE, to h after a no-auth greeting
+// over a real TCP connection and returns the connection, the reply and
+// Handle's result
+func udpAssociate(t *testing.T, h *Handler, req []byte) (net.Conn, []byte, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	done := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		done <- h.Handle(context.Background(), c)
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(append([]byte{Version, 1, AuthNone}, req...)); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil {
+		t.Fatal(err)
+	}
+	return client, readReply(t, client), done
+}
+
+// udpEcho starts a UDP server on ip answering each datagram in upper case
+func udpEcho(t *testing.T, ip net.IP) *net.UDPAddr {
+	t.Helper()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("no UDP on %v: %v", ip, err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+	return echo.LocalAddr().(*net.UDPAddr)
+}
+
+// exchange sends payload to target as a frame on conn and returns the
+// datagram framed back
+func exchange(t *testing.T, conn net.Conn, target net.Addr, payload string) []byte {
+	t.Helper()
+	datagram := append(appendUDPHeader(nil, target), payload...)
+	if _, err := conn.Write(AppendUDPFrame(nil, datagram)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadUDPFrame(conn, make([]byte, 0xffff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestUDPAssociate(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	target := udpEcho(t, net.IPv4(127, 0, 0, 1))
+
+	h := NewHandler("", "", log)
+	h.EnableUDP()
+	control, reply, done := udpAssociate(t, h, AppendUDPOverStreamRequest(nil))
+	if reply[1] != RepSuccess {
+		t.Fatalf("reply %#x, want success", reply[1])
+	}
+
+	header := appendUDPHeader(nil, target)
+	// A fragment is dropped, the datagram after it relayed
+	fragment := append([]byte{0, 0, 1}, header[3:]...)
+	control.Write(AppendUDPFrame(nil, append(fragment, "dropped"...)))
+	if got := exchange(t, control, target, "hello"); !bytes.Equal(got, append(header, "HELLO"...)) {
+		t.Errorf("reply datagram %q, want the echo's header and HELLO", got)
+	}
+	if s := h.Stats(); s.UDPAssociations != 1 || s.UDPSessions != 1 || s.UDPDropped != 1 {
+		t.Errorf("stats = %+v, want 1 association, 1 session, 1 dropped", s)
+	}
+
+	// Closing the connection ends the association
+	control.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Handle: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("association outlived its TCP connection")
+	}
+}
+
+// Datagrams reach IPv6-only targets, and come back with IPv6 headers
+func TestUDPAssociateIPv6(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	target := udpEcho(t, net.IPv6loopback)
+
+	h := NewHandler("", "", log)
+	h.EnableUDP()
+	control, reply, _ := udpAssociate(t, h, AppendUDPOverStreamRequest(nil))
+	if reply[1] != RepSuccess {
+		t.Fatalf("reply %#x, want success", reply[1])
+	}
+	got := exchange(t, control, target, "hello")
+	if header := appendUDPHeader(nil, target); got[3] != AtypIPv6 || !bytes.Equal(got, append(header, "HELLO"...)) {
+		t.Errorf("reply datagram %q, want an IPv6 header and HELLO", got)
+	}
+}
+
+// Without EnableUDP nothing is associated, and with it only associations
+// carried on the connection are: the server never opens a UDP port
+func TestUDPAssociateRefused(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	plain := []byte{Version, CmdUDPAssociate, 0, AtypIPv4, 0, 0, 0, 0, 0, 0}
+
+	enabled := NewHandler("", "", log)
+	enabled.EnableUDP()
+	for _, tt := range []struct {
+		desc string
+		h    *Handler
+		req  []byte
+	}{
+		{"disabled", NewHandler("", "", log), AppendUDPOverStreamRequest(nil)},
+		{"plain", enabled, plain},
+	} {
+		_, reply, done := udpAssociate(t, tt.h, tt.req)
+		if reply[1] != RepCmdNotSupported {
+			t.Errorf("%s: reply %#x, want command not supported", tt.desc, reply[1])
+		}
+		if err := <-done; err == nil {
+			t.Errorf("%s: Handle succeeded for a refused association", tt.desc)
+		}
+	}
+}
+
+func TestParseUDPHeader(t *testing.T) {
+	tests := []struct {
+		desc   string
+		in     []byte
+		target string
+		field  string // ProtocolError field, empty for success
+	}{
+		{"IPv4", []byte{0, 0, 0, AtypIPv4, 10, 0, 0, 1, 0, 53, 'x'}, "10.0.0.1:53", ""},
+		{"IPv6", append(append([]byte{0, 0, 0, AtypIPv6}, net.IPv6loopback...), 1, 187, 'x'), "[::1]:443", ""},
+		{"domain", []byte{0, 0, 0, AtypDomain, 3, 'a', '.', 'b', 0, 53, 'x'}, "a.b:53", ""},
+		{"short", []byte{0, 0, 0}, "", "UDP header"},
+		{"truncated address", []byte{0, 0, 0, AtypIPv4, 10, 0}, "", "UDP header"},
+		{"reserved set", []byte{0, 1, 0, AtypIPv4, 10, 0, 0, 1, 0, 53}, "", "UDP RSV"},
+		{"fragment", []byte{0, 0, 2, AtypIPv4, 10, 0, 0, 1, 0, 53}, "", "UDP FRAG"},
+		{"empty domain", []byte{0, 0, 0, AtypDomain, 0, 0, 53}, "", "domain"},
+		{"domain with port", []byte{0, 0, 0, AtypDomain, 3, 'a', ':', '1', 0, 53}, "", "domain"},
+		{"bad address type", []byte{0, 0, 0, 9, 0, 53}, "", "address type"},
+	}
+	for _, tt := range tests {
+		target, payload, err := parseUDPHeader(tt.in)
+		if tt.field == "" {
+			if err != nil || target != tt.target || string(payload) != "x" {
+				t.Errorf("%s: %q, %q, %v", tt.desc, target, payload, err)
+			}
+			continue
+		}
+		var pe *ProtocolError
+		if !errors.As(err, &pe) || pe.Field != tt.field {
+			t.Errorf("%s: err = %v, want a ProtocolError for %s", tt.desc, err, tt.field)
+		}
+	}
+}
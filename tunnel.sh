@@ -8,6 +8,9 @@
 # 3. Routes traffic through tun2socks
 # 4. Excludes the server IP to prevent routing loops
 #
+# With --uid/--cgroup only the matching processes are routed through the
+# tunnel (policy routing on an fwmark); everything else keeps the normal route.
+#
 
 set -e
 
@@ -21,6 +24,11 @@ TUN_NAME="${TUN_NAME:-tun0}"
 TUN_ADDR="${TUN_ADDR:-10.0.85.1}"
 TUN_GW="${TUN_GW:-10.0.85.2}"
 TUN_MASK="${TUN_MASK:-255.255.255.0}"
+ROUTE_TABLE="${ROUTE_TABLE:-85}"
+ROUTE_MARK="${ROUTE_MARK:-0x55}"
+SELF_CGROUP="${SELF_CGROUP:-shadowtls-tunnel}"
+MATCH_UIDS=()
+MATCH_CGROUPS=()
 
 # Parse command line arguments
 while [[ $# -gt 0 ]]; do
@@ -45,6 +53,14 @@ while [[ $# -gt 0 ]]; do
             POOL_SIZE="$2"
             shift 2
             ;;
+        --uid)
+            MATCH_UIDS+=("$2")
+            shift 2
+            ;;
+        --cgroup)
+            MATCH_CGROUPS+=("$2")
+            shift 2
+            ;;
         -h|--help)
             echo "Usage: $0 [options]"
             echo ""
@@ -56,9 +72,13 @@ while [[ $# -gt 0 ]]; do
             echo "Optional:"
             echo "  --port PORT               Local SOCKS5 port (default: 1080)"
             echo "  --pool SIZE               Connection pool size (default: 5)"
+            echo "  --uid USER                Only tunnel traffic from this user/UID (repeatable)"
+            echo "  --cgroup PATH             Only tunnel traffic from this cgroup v2 path (repeatable)"
             echo ""
             echo "Example:"
             echo "  sudo $0 -s example.com:443 --sni www.google.com -p secret123"
+            echo "  sudo $0 -s example.com:443 --sni www.google.com -p secret123 --uid alice"
+            echo "  sudo $0 ... --cgroup user.slice/user-1000.slice/user@1000.service/app.slice/app-firefox.scope"
             exit 0
             ;;
         *)
@@ -75,6 +95,12 @@ if [[ -z "$SERVER" || -z "$SNI" || -z "$PASSWORD" ]]; then
     exit 1
 fi
 
+# Per-app mode: only matching UIDs/cgroups go through the tunnel
+PER_APP=0
+if [[ ${#MATCH_UIDS[@]} -gt 0 || ${#MATCH_CGROUPS[@]} -gt 0 ]]; then
+    PER_APP=1
+fi
+
 # Check for root
 if [[ $EUID -ne 0 ]]; then
     echo "Error: This script must be run as root"
@@ -147,6 +173,21 @@ cleanup() {
     # Wait for processes to exit
     sleep 2
 
+    if [[ $PER_APP -eq 1 ]]; then
+        # Remove policy routing and marking rules
+        ip rule del fwmark "$ROUTE_MARK" lookup "$ROUTE_TABLE" 2>/dev/null || true
+        ip route flush table "$ROUTE_TABLE" 2>/dev/null || true
+        iptables -t mangle -D OUTPUT -j SHADOWTLS_MARK 2>/dev/null || true
+        iptables -t mangle -F SHADOWTLS_MARK 2>/dev/null || true
+        iptables -t mangle -X SHADOWTLS_MARK 2>/dev/null || true
+        iptables -D OUTPUT -o "$TUN_NAME" -p udp -j DROP 2>/dev/null || true
+        ip route del "$SERVER_IP/32" via "$DEFAULT_GW" dev "$DEFAULT_IF" 2>/dev/null || true
+        ip link del "$TUN_NAME" 2>/dev/null || true
+        rmdir "/sys/fs/cgroup/$SELF_CGROUP" 2>/dev/null || true
+        echo "Cleanup complete"
+        return
+    fi
+
     # Remove TUN default route
     ip route del default dev "$TUN_NAME" 2>/dev/null || true
 
@@ -202,6 +243,15 @@ echo "[2/5] Starting shadowtls client..."
     -vvv &
 SHADOWTLS_PID=$!
 
+# In per-app mode, keep the tunnel's own traffic out of the marking rules by
+# running it in a dedicated cgroup (cgroup v2)
+SELF_CGROUP_OK=0
+if [[ $PER_APP -eq 1 && -f /sys/fs/cgroup/cgroup.procs ]]; then
+    mkdir -p "/sys/fs/cgroup/$SELF_CGROUP" 2>/dev/null && \
+        echo "$SHADOWTLS_PID" > "/sys/fs/cgroup/$SELF_CGROUP/cgroup.procs" 2>/dev/null && \
+        SELF_CGROUP_OK=1
+fi
+
 # Wait for it to start
 sleep 2
 
@@ -224,6 +274,9 @@ echo "[4/5] Starting tun2socks..."
 tun2socks -device "tun://$TUN_NAME" -proxy "socks5://127.0.0.1:$LISTEN_PORT" -loglevel debug &
 TUN2SOCKS_PID=$!
 echo "      PID: $TUN2SOCKS_PID"
+if [[ $SELF_CGROUP_OK -eq 1 ]]; then
+    echo "$TUN2SOCKS_PID" > "/sys/fs/cgroup/$SELF_CGROUP/cgroup.procs" 2>/dev/null || true
+fi
 
 # Step 5: Set up routing
 echo "[5/5] Setting up routes..."
@@ -235,6 +288,49 @@ echo "[5/5] Setting up routes..."
 iptables -C OUTPUT -o "$TUN_NAME" -p udp -j DROP 2>/dev/null || \
     iptables -A OUTPUT -o "$TUN_NAME" -p udp -j DROP
 
+if [[ $PER_APP -eq 1 ]]; then
+    # Route marked packets via the TUN in a separate table; the main table and
+    # DNS stay untouched for everything else
+    ip route replace default dev "$TUN_NAME" table "$ROUTE_TABLE"
+    ip rule add fwmark "$ROUTE_MARK" lookup "$ROUTE_TABLE" 2>/dev/null || true
+
+    # Marked packets keep the source address chosen by the main table, so
+    # replies arriving on the TUN need loose reverse-path filtering
+    sysctl -qw "net.ipv4.conf.$TUN_NAME.rp_filter=2"
+
+    iptables -t mangle -N SHADOWTLS_MARK 2>/dev/null || iptables -t mangle -F SHADOWTLS_MARK
+    # Never mark the tunnel's own traffic: loopback, the server, and our processes
+    iptables -t mangle -A SHADOWTLS_MARK -o lo -j RETURN
+    iptables -t mangle -A SHADOWTLS_MARK -d "$SERVER_IP" -j RETURN
+    if [[ $SELF_CGROUP_OK -eq 1 ]]; then
+        iptables -t mangle -A SHADOWTLS_MARK -m cgroup --path "$SELF_CGROUP" -j RETURN
+    fi
+    for uid in "${MATCH_UIDS[@]}"; do
+        iptables -t mangle -A SHADOWTLS_MARK -m owner --uid-owner "$uid" -j MARK --set-mark "$ROUTE_MARK"
+    done
+    for cg in "${MATCH_CGROUPS[@]}"; do
+        iptables -t mangle -A SHADOWTLS_MARK -m cgroup --path "$cg" -j MARK --set-mark "$ROUTE_MARK"
+    done
+    iptables -t mangle -C OUTPUT -j SHADOWTLS_MARK 2>/dev/null || \
+        iptables -t mangle -A OUTPUT -j SHADOWTLS_MARK
+
+    echo ""
+    echo "=== Tunnel Active (per-app) ==="
+    echo ""
+    [[ ${#MATCH_UIDS[@]} -gt 0 ]] && echo "Tunneled users: ${MATCH_UIDS[*]}"
+    [[ ${#MATCH_CGROUPS[@]} -gt 0 ]] && echo "Tunneled cgroups: ${MATCH_CGROUPS[*]}"
+    if [[ $SELF_CGROUP_OK -eq 0 ]]; then
+        echo "Note: cgroup v2 unavailable; the tunnel is excluded by server IP only,"
+        echo "      so do not select the user shadowtls runs as (root)."
+    fi
+    echo "Everything else uses the normal route."
+    echo ""
+    echo "Press Ctrl+C to stop the tunnel"
+    echo ""
+    wait $SHADOWTLS_PID $TUN2SOCKS_PID
+    exit 0
+fi
+
 # Delete existing default route and add new one via TUN
 ip route del default 2>/dev/null || true
 ip route add default via "$DEFAULT_GW" dev "$DEFAULT_IF" metric 100